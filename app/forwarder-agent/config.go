@@ -17,9 +17,12 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/opsmx/oes-birger/internal/util"
 	"gopkg.in/yaml.v3"
 )
 
@@ -43,6 +46,56 @@ type agentConfig struct {
 	InsecureControllerAllowed bool    `yaml:"insecureControllerAllowed,omitempty" json:"insecureControllerAllowed,omitempty"`
 	DialMaxRetries            int     `json:"dialMaxRetries,omitempty" yaml:"dialMaxRetries,omitempty"`
 	DialRetryTime             int     `json:"dialRetryTime,omitempty" yaml:"dialRetryTime,omitempty"`
+	PrometheusListenPort      uint16  `json:"prometheusListenPort,omitempty" yaml:"prometheusListenPort,omitempty"`
+	PrometheusBindAddress     string  `json:"prometheusBindAddress,omitempty" yaml:"prometheusBindAddress,omitempty"`
+
+	// ControllerProxy is an HTTP CONNECT proxy used to reach the controller.
+	// If unset, HTTPS_PROXY, HTTP_PROXY, and NO_PROXY are used.
+	ControllerProxy string `json:"controllerProxy,omitempty" yaml:"controllerProxy,omitempty"`
+
+	// UserAgent is sent on requests to upstream services.  It defaults to
+	// oes-birger-agent/<version>.
+	UserAgent string `json:"userAgent,omitempty" yaml:"userAgent,omitempty"`
+
+	// CompressTunnel gzip compresses the messages sent to the controller,
+	// which then compresses its replies.  The controller must also enable
+	// compressTunnel.
+	CompressTunnel bool `json:"compressTunnel,omitempty" yaml:"compressTunnel,omitempty"`
+
+	// TunnelMessageSize limits the size of messages sent to and received
+	// from the controller, which should use the same limits.
+	TunnelMessageSize tunnel.MessageSizeConfig `json:"tunnelMessageSize,omitempty" yaml:"tunnelMessageSize,omitempty"`
+
+	// ManifestFile is the manifest generated for this agent by the
+	// controller's control API.  If set, the controller hostname, agent
+	// certificate, and key are taken from it rather than controllerHostname,
+	// certFile, and keyFile.  RequireSignedManifest rejects a manifest which
+	// the controller did not sign.  ManifestPublicKeyFile is the PEM public
+	// key of the controller's manifestSigningKeyFile; without it, manifests
+	// are verified with the CA certificate.
+	ManifestFile          string `json:"manifestFile,omitempty" yaml:"manifestFile,omitempty"`
+	RequireSignedManifest bool   `json:"requireSignedManifest,omitempty" yaml:"requireSignedManifest,omitempty"`
+	ManifestPublicKeyFile string `json:"manifestPublicKeyFile,omitempty" yaml:"manifestPublicKeyFile,omitempty"`
+
+	// MaxRequestLifetime, if set, is how long a request may run before its
+	// cancel function is assumed leaked, and is cancelled and removed.
+	MaxRequestLifetime time.Duration `json:"maxRequestLifetime,omitempty" yaml:"maxRequestLifetime,omitempty"`
+
+	// AllowedControllerIdentities, if set, are the only controller
+	// identities whose requests are served.  The identity is read once per
+	// tunnel from the controller's server certificate, and every request on
+	// a tunnel from any other controller is refused with a 403.  If empty,
+	// all are allowed.
+	AllowedControllerIdentities []string `json:"allowedControllerIdentities,omitempty" yaml:"allowedControllerIdentities,omitempty"`
+
+	// PeerReconnect is how connecting to a peer controller, which a
+	// draining controller hands the agent to, is retried before the peer
+	// is declared dead.
+	PeerReconnect tunnel.BackoffConfig `json:"peerReconnect,omitempty" yaml:"peerReconnect,omitempty"`
+
+	// TLSSettings sets minTLSVersion and cipherSuites for the controller
+	// connection and upstream services.
+	util.TLSSettings `yaml:",inline"`
 }
 
 func (c *agentConfig) applyDefaults() {
@@ -87,6 +140,14 @@ func loadConfig(filename string) (*agentConfig, error) {
 
 	config.applyDefaults()
 
+	if problems := config.TunnelMessageSize.Validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("tunnelMessageSize.%v", problems[0])
+	}
+
+	if problems := config.PeerReconnect.Validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("peerReconnect: %v", problems[0])
+	}
+
 	return config, nil
 }
 
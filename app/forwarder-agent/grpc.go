@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/tls"
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,10 +20,19 @@ import (
 
 type serverContext struct{}
 
-func tickerPinger(stream tunnel.GRPCEventStream) {
+// tickerPinger pings the controller until done is closed, which happens
+// when the tunnel is closed after reconnecting to another controller.
+func tickerPinger(stream tunnel.GRPCEventStream, done <-chan struct{}) {
 	ticker := time.NewTicker(time.Duration(*tickTime) * time.Second)
+	defer ticker.Stop()
 
-	for ts := range ticker.C {
+	for {
+		var ts time.Time
+		select {
+		case ts = <-ticker.C:
+		case <-done:
+			return
+		}
 		req := &tunnel.MessageWrapper{
 			Event: &tunnel.MessageWrapper_PingRequest{
 				PingRequest: &tunnel.PingRequest{Ts: uint64(ts.UnixNano())},
@@ -34,19 +44,69 @@ func tickerPinger(stream tunnel.GRPCEventStream) {
 	}
 }
 
-func handleHTTPRequests(session string, requestChan chan interface{}, httpids *util.SessionList, stream tunnel.GRPCEventStream) {
+// healthReporter checks the endpoints every interval, starting at once,
+// and reports their health to the controller, which stops sending
+// requests to those which fail until they pass again.
+func healthReporter(stream tunnel.GRPCEventStream, endpoints []serviceconfig.ConfiguredEndpoint, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		results := serviceconfig.CheckEndpoints(context.Background(), endpoints, *selfTestTimeout)
+		for _, result := range results {
+			if !result.Skipped && result.Err != nil {
+				zap.S().Debugw("endpoint health check failed", "endpointType", result.Type, "endpointName", result.Name, "error", result.Err)
+			}
+		}
+		report := &tunnel.MessageWrapper{
+			Event: &tunnel.MessageWrapper_EndpointHealthReport{
+				EndpointHealthReport: serviceconfig.HealthReportToPB(endpoints, results),
+			},
+		}
+		if err := stream.Send(report); err != nil {
+			zap.S().Warnw("unable to send endpoint health report", "error", err)
+			return
+		}
+		<-ticker.C
+	}
+}
+
+func handleHTTPRequests(session string, requestChan chan interface{}, httpids *util.SessionList, stream tunnel.GRPCEventStream, messageSize tunnel.MessageSizeConfig) {
 	for interfacedRequest := range requestChan {
 		switch value := interfacedRequest.(type) {
 		case *tunnelroute.HTTPMessage:
-			httpids.Add(value.Cmd.Id, value.Out)
 			resp := &tunnel.MessageWrapper{
 				Event: tunnel.MakeHTTPTunnelOpenTunnelRequest(value.Cmd),
 			}
+			if err := messageSize.CheckSend(resp); err != nil {
+				// Answered here, as the controller would, so the caller gets a 413.
+				zap.S().Errorw("unable to send HTTP request", "session", session, "id", value.Cmd.Id, "error", err)
+				value.Out <- tunnel.MakeRequestEntityTooLargeResponse(value.Cmd.Id)
+				continue
+			}
+			httpids.Add(value.Cmd.Id, value.Out)
 			if err := stream.Send(resp); err != nil {
 				zap.S().Warnw("unable to send HTTP request",
 					"session", session,
 					"id", value.Cmd.Id)
 			}
+		case *tunnelroute.HTTPUpgradeData:
+			resp := &tunnel.MessageWrapper{
+				Event: tunnel.MakeHTTPTunnelChunkedRequest(value.ID, value.Body),
+			}
+			if err := stream.Send(resp); err != nil {
+				zap.S().Warnw("unable to send upgrade data",
+					"session", session,
+					"id", value.ID)
+			}
+		case *tunnelroute.HTTPWindowUpdate:
+			resp := &tunnel.MessageWrapper{
+				Event: tunnel.MakeHTTPTunnelWindowUpdate(value.ID, value.Bytes),
+			}
+			if err := stream.Send(resp); err != nil {
+				zap.S().Warnw("unable to send window update",
+					"session", session,
+					"id", value.ID)
+			}
 		default:
 			zap.S().Debugf("Got unexpected message type: %T", interfacedRequest)
 		}
@@ -55,7 +115,7 @@ func handleHTTPRequests(session string, requestChan chan interface{}, httpids *u
 
 func handleHTTPCancelRequest(session string, cancelChan chan string, httpids *util.SessionList, stream tunnel.GRPCEventStream) {
 	for id := range cancelChan {
-		httpids.Remove(id)
+		httpids.Close(id)
 		resp := &tunnel.MessageWrapper{
 			Event: tunnel.MakeHTTPTunnelCancelRequest(id),
 		}
@@ -65,15 +125,37 @@ func handleHTTPCancelRequest(session string, cancelChan chan string, httpids *ut
 	}
 }
 
-func dataflowHandler(dataflow chan *tunnel.MessageWrapper, stream tunnel.GRPCEventStream) {
+// dataflowHandler sends responses to the controller until dataflow is
+// closed.  If canDrop returns true once a response cannot be sent, as for a
+// tunnel to a peer controller, which the agent falls back from when it
+// fails, or a tunnel which has been replaced, that and later responses are
+// dropped, so the requests still sending them can finish.
+func dataflowHandler(dataflow chan *tunnel.MessageWrapper, stream tunnel.GRPCEventStream, messageSize tunnel.MessageSizeConfig, canDrop func() bool) {
+	sender := messageSize.Sender(stream)
+	failed := false
 	for ew := range dataflow {
-		if err := stream.Send(ew); err != nil {
+		err := sender.Send(ew)
+		if err == nil || failed {
+			continue
+		}
+		if !canDrop() {
 			zap.S().Fatalw("Unable to respond over GRPC", "error", err)
 		}
+		zap.S().Warnw("unable to respond to controller, dropping responses", "error", err)
+		failed = true
 	}
 }
 
-func runTunnel(sa *serverContext, conn *grpc.ClientConn, agentInfo *tunnel.AgentInfo, endpoints []serviceconfig.ConfiguredEndpoint, insecure bool, clcert tls.Certificate) {
+// runTunnel runs the tunnel to the controller at target on conn until it
+// closes.  If the controller asks the agent to reconnect elsewhere, and
+// reconnect succeeds in starting a tunnel to the new controller, this
+// tunnel and conn are closed once the requests running on it finish.  The
+// agent keeps serving requests on this tunnel while reconnect retries.  If
+// a tunnel to a peer controller fails, the peer is reconnected to the same
+// way, and reconnect falls back to the configured controller if the peer
+// is declared dead.  Requests still running when a tunnel is lost are
+// cancelled, and its dataflow is closed once they finish.
+func runTunnel(sa *serverContext, conn *grpc.ClientConn, target string, agentInfo *tunnel.AgentInfo, endpoints []serviceconfig.ConfiguredEndpoint, insecure bool, clcert tls.Certificate, reconnect func(hostname string, handoff bool) bool) {
 	client := tunnel.NewAgentTunnelServiceClient(conn)
 	ctx := context.Background()
 
@@ -99,15 +181,33 @@ func runTunnel(sa *serverContext, conn *grpc.ClientConn, agentInfo *tunnel.Agent
 	}
 
 	dataflow := make(chan *tunnel.MessageWrapper, 20)
+	waitc := make(chan struct{})
 
-	go tickerPinger(stream)
-	go dataflowHandler(dataflow, stream)
+	tunnel.Go("pinger", func() { tickerPinger(stream, waitc) })
+	if *healthReportInterval > 0 {
+		tunnel.Go("healthReporter", func() { healthReporter(stream, endpoints, *healthReportInterval) })
+	}
+	// replaced is set once a tunnel to another controller takes over.
+	var replaced int32
+	tunnel.Go("dataflow", func() {
+		dataflowHandler(dataflow, stream, config.TunnelMessageSize, func() bool {
+			return target != config.ControllerHostname || atomic.LoadInt32(&replaced) != 0
+		})
+	})
 
 	sessionIdentity := ulid.GlobalContext.Ulid()
 
+	// Whether the controller may send requests is decided once, from the
+	// certificate it presented when the tunnel connected.
+	refusal := identityFilter.checkPeer(stream.Context())
+	if refusal != nil {
+		zap.S().Warnw("refusing requests from controller", "target", target, "error", refusal)
+	}
+
 	inRequest := make(chan interface{}, 1)
 	inCancelRequest := make(chan string, 1)
 	httpids := util.MakeSessionList()
+	inflight := makeInflightRequests()
 
 	state := &tunnelroute.DirectlyConnectedRoute{
 		Name:            "controller",
@@ -117,24 +217,39 @@ func runTunnel(sa *serverContext, conn *grpc.ClientConn, agentInfo *tunnel.Agent
 		ConnectedAt:     tunnel.Now(),
 	}
 
-	go handleHTTPRequests(sessionIdentity, inRequest, httpids, stream)
+	tunnel.Go("httpRequests", func() { handleHTTPRequests(sessionIdentity, inRequest, httpids, stream, config.TunnelMessageSize) })
 
-	go handleHTTPCancelRequest(sessionIdentity, inCancelRequest, httpids, stream)
+	tunnel.Go("httpCancelRequests", func() { handleHTTPCancelRequest(sessionIdentity, inCancelRequest, httpids, stream) })
 
-	waitc := make(chan struct{})
+	var closeOnce sync.Once
+	closeWait := func() { closeOnce.Do(func() { close(waitc) }) }
+	recvDone := make(chan struct{})
 	go func() {
+		defer close(recvDone)
 		for {
 			in, err := stream.Recv()
+			if atomic.LoadInt32(&replaced) != 0 {
+				return
+			}
 			if err == io.EOF {
 				httpids.CloseAll()
-				routes.Remove(state)
-				close(waitc)
+				inflight.cancelAll()
+				routes.Remove(state, tunnelroute.DisconnectClean)
+				closeWait()
 				return
 			}
 			if err != nil {
 				httpids.CloseAll()
-				routes.Remove(state)
-				zap.S().Fatalw("failed to receive GRPC", "error", err)
+				inflight.cancelAll()
+				routes.Remove(state, tunnelroute.DisconnectError)
+				if target == config.ControllerHostname {
+					zap.S().Fatalw("failed to receive GRPC", "error", err)
+				}
+				zap.S().Warnw("tunnel to peer controller failed, reconnecting", "target", target, "error", err)
+				atomic.StoreInt32(&replaced, 1)
+				closeWait()
+				go reconnect(target, false)
+				return
 			}
 
 			switch x := in.Event.(type) {
@@ -145,8 +260,9 @@ func runTunnel(sa *serverContext, conn *grpc.ClientConn, agentInfo *tunnel.Agent
 					zap.S().Warnw("unable to respond to ping",
 						"destination", state,
 						"error", err)
-					routes.Remove(state)
-					close(waitc)
+					inflight.cancelAll()
+					routes.Remove(state, tunnelroute.DisconnectError)
+					closeWait()
 					return
 				}
 			case *tunnel.MessageWrapper_Hello:
@@ -169,7 +285,24 @@ func runTunnel(sa *serverContext, conn *grpc.ClientConn, agentInfo *tunnel.Agent
 			case *tunnel.MessageWrapper_PingResponse:
 				continue
 			case *tunnel.MessageWrapper_HttpTunnelControl:
-				handleHTTPControl(in, httpids, endpoints, dataflow)
+				handleHTTPControl(in, httpids, inflight, endpoints, dataflow, refusal)
+			case *tunnel.MessageWrapper_Reconnect:
+				hostname := in.GetReconnect().ControllerHostname
+				zap.S().Infow("controller asked agent to reconnect", "target", hostname)
+				go func() {
+					if !reconnect(hostname, true) {
+						return
+					}
+					// Finish answering the requests this controller sent
+					// first, including any it cancelled when its drain
+					// timed out, while their cancels and window updates
+					// are still received.
+					inflight.wait()
+					atomic.StoreInt32(&replaced, 1)
+					httpids.CloseAll()
+					routes.Remove(state, tunnelroute.DisconnectClean)
+					closeWait()
+				}()
 			case nil:
 				continue
 			default:
@@ -178,27 +311,44 @@ func runTunnel(sa *serverContext, conn *grpc.ClientConn, agentInfo *tunnel.Agent
 		}
 	}()
 	<-waitc
-	close(dataflow)
 	_ = stream.CloseSend()
+	if atomic.LoadInt32(&replaced) != 0 {
+		_ = conn.Close()
+	}
+	<-recvDone
+	inflight.wait()
+	close(dataflow)
 }
 
-func handleHTTPControl(in *tunnel.MessageWrapper, httpids *util.SessionList, endpoints []serviceconfig.ConfiguredEndpoint, dataflow chan *tunnel.MessageWrapper) {
+// handleHTTPControl handles a control message from the controller.  If
+// refusal is set, requests are answered with a 403 rather than run.
+// Requests which are run are tracked in inflight until they finish.
+func handleHTTPControl(in *tunnel.MessageWrapper, httpids *util.SessionList, inflight *inflightRequests, endpoints []serviceconfig.ConfiguredEndpoint, dataflow chan *tunnel.MessageWrapper, refusal error) {
 	tunnelControl := in.GetHttpTunnelControl() // caller ensures this will work
 	switch controlMessage := tunnelControl.ControlType.(type) {
 	case *tunnel.HttpTunnelControl_CancelRequest:
 		tunnel.CallCancelFunction(controlMessage.CancelRequest.Id)
 	case *tunnel.HttpTunnelControl_OpenHTTPTunnelRequest:
 		req := controlMessage.OpenHTTPTunnelRequest
-		found := false
-		for _, endpoint := range endpoints {
-			if endpoint.Configured && endpoint.Type == req.Type && endpoint.Name == req.Name {
-				go endpoint.Instance.ExecuteHTTPRequest("", dataflow, req)
-				found = true
-				break
-			}
+		// A streamed body may arrive before the endpoint starts running.
+		tunnel.PrepareRequestBody(req)
+		if refusal != nil {
+			zap.S().Debugw("refusing request from controller", "requestId", req.Id, "error", refusal)
+			tunnel.ReleaseRequestBody(req)
+			dataflow <- tunnel.MakeForbiddenResponse(req.Id)
+			return
 		}
-		if !found {
+		if endpoint := serviceconfig.FindConfiguredEndpoint(endpoints, req.Type, req.Name); endpoint != nil {
+			inflight.start(req.Id)
+			go func() {
+				defer inflight.finish(req.Id)
+				tunnel.RunRequest(req.Id, dataflow, func(dataflow chan *tunnel.MessageWrapper) {
+					endpoint.Instance.ExecuteHTTPRequest("", dataflow, req)
+				})
+			}()
+		} else {
 			zap.S().Errorf("Request for unsupported HTTP tunnel type=%s name=%s", req.Type, req.Name)
+			tunnel.ReleaseRequestBody(req)
 			dataflow <- tunnel.MakeBadGatewayResponse(req.Id)
 		}
 	case *tunnel.HttpTunnelControl_HttpTunnelResponse:
@@ -227,6 +377,14 @@ func handleHTTPControl(in *tunnel.MessageWrapper, httpids *util.SessionList, end
 			zap.S().Debugf("Got response to unknown HTTP request id %s", resp.Id)
 		}
 		httpids.Unlock()
+	case *tunnel.HttpTunnelControl_HttpTunnelChunkedRequest:
+		req := controlMessage.HttpTunnelChunkedRequest
+		if err := tunnel.WriteUpgradeData(req.Id, req.Body); err != nil {
+			zap.S().Debugw("unable to write upgrade data", "requestId", req.Id, "error", err)
+		}
+	case *tunnel.HttpTunnelControl_HttpTunnelWindowUpdate:
+		update := controlMessage.HttpTunnelWindowUpdate
+		tunnel.UpdateFlowWindow(update.Id, update.Bytes)
 	case nil:
 		return
 	default:
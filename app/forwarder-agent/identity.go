@@ -0,0 +1,78 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/opsmx/oes-birger/internal/ca"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// controllerIdentityFilter refuses requests unless the controller's server
+// certificate, verified against the agent's CA when the tunnel connected,
+// names an allowed controller identity.  A nil filter allows every
+// controller.
+type controllerIdentityFilter struct {
+	allowed map[string]bool
+}
+
+func makeControllerIdentityFilter(allowed []string) *controllerIdentityFilter {
+	f := &controllerIdentityFilter{
+		allowed: map[string]bool{},
+	}
+	for _, identity := range allowed {
+		f.allowed[identity] = true
+	}
+	return f
+}
+
+// checkPeer returns an error if requests from the controller at the other
+// end of the tunnel whose context is ctx should be refused.  It is called
+// once per tunnel, rather than for each request.
+func (f *controllerIdentityFilter) checkPeer(ctx context.Context) error {
+	if f == nil {
+		return nil
+	}
+	p, found := peer.FromContext(ctx)
+	if !found {
+		return fmt.Errorf("controller connection has no peer")
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return fmt.Errorf("controller connection is not authenticated with TLS")
+	}
+	return f.check(info.State.PeerCertificates[0])
+}
+
+// check returns an error unless cert names an allowed controller identity.
+func (f *controllerIdentityFilter) check(cert *x509.Certificate) error {
+	if f == nil {
+		return nil
+	}
+	identity, err := ca.GetControllerIdentityFromCert(cert)
+	if err != nil {
+		return err
+	}
+	if !f.allowed[identity] {
+		return fmt.Errorf("controller identity %q is not allowed", identity)
+	}
+	return nil
+}
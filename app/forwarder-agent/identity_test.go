@@ -0,0 +1,148 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/opsmx/oes-birger/internal/ca"
+	"github.com/opsmx/oes-birger/internal/serviceconfig"
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/opsmx/oes-birger/internal/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// okProcessor answers every request with a 200.
+type okProcessor struct{}
+
+func (okProcessor) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	dataflow <- &tunnel.MessageWrapper{
+		Event: &tunnel.MessageWrapper_HttpTunnelControl{
+			HttpTunnelControl: &tunnel.HttpTunnelControl{
+				ControlType: &tunnel.HttpTunnelControl_HttpTunnelResponse{
+					HttpTunnelResponse: &tunnel.HttpTunnelResponse{Id: req.Id, Status: http.StatusOK},
+				},
+			},
+		},
+	}
+}
+
+func TestHandleHTTPControl_refusal(t *testing.T) {
+	endpoints := []serviceconfig.ConfiguredEndpoint{
+		{Type: "jenkins", Name: "jenkins1", Configured: true, Instance: okProcessor{}},
+	}
+	tests := []struct {
+		name       string
+		refusal    error
+		wantStatus int32
+	}{
+		{"allowed", nil, http.StatusOK},
+		{"refused", errors.New("controller identity \"controller-b\" is not allowed"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &tunnel.OpenHTTPTunnelRequest{
+				Id:     "req-" + tt.name,
+				Type:   "jenkins",
+				Name:   "jenkins1",
+				Method: http.MethodGet,
+				URI:    "/",
+			}
+			in := &tunnel.MessageWrapper{Event: tunnel.MakeHTTPTunnelOpenTunnelRequest(req)}
+			dataflow := make(chan *tunnel.MessageWrapper, 1)
+			inflight := makeInflightRequests()
+			handleHTTPControl(in, util.MakeSessionList(), inflight, endpoints, dataflow, tt.refusal)
+
+			resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+			require.NotNil(t, resp)
+			assert.Equal(t, req.Id, resp.Id)
+			assert.Equal(t, tt.wantStatus, resp.Status)
+			inflight.wait()
+		})
+	}
+}
+
+func decodePEM64(t *testing.T, s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func leafOf(t *testing.T, cert *tls.Certificate) *x509.Certificate {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf
+}
+
+func TestControllerIdentityFilter_check(t *testing.T) {
+	caCert, caKey, err := ca.MakeCertificateAuthority()
+	require.NoError(t, err)
+	authority, err := ca.MakeCAFromData(caCert, caKey)
+	require.NoError(t, err)
+
+	controllerA, err := authority.MakeControllerCert([]string{"localhost"}, "controller-a")
+	require.NoError(t, err)
+	controllerB, err := authority.MakeControllerCert([]string{"localhost"}, "controller-b")
+	require.NoError(t, err)
+	anonymous, err := authority.MakeServerCert([]string{"localhost"})
+	require.NoError(t, err)
+	_, agentCert64, agentKey64, err := authority.GenerateCertificate(ca.CertificateName{Name: "controller-a", Agent: "agent1", Purpose: ca.CertificatePurposeAgent}, 0)
+	require.NoError(t, err)
+	agentCert, err := tls.X509KeyPair(decodePEM64(t, agentCert64), decodePEM64(t, agentKey64))
+	require.NoError(t, err)
+
+	filter := makeControllerIdentityFilter([]string{"controller-a"})
+	assert.NoError(t, filter.check(leafOf(t, controllerA)))
+	assert.Error(t, filter.check(leafOf(t, controllerB)))
+	assert.Error(t, filter.check(leafOf(t, anonymous)), "a server certificate without an identity")
+	assert.Error(t, filter.check(leafOf(t, &agentCert)), "an agent certificate is not a controller certificate")
+
+	var allowAll *controllerIdentityFilter
+	assert.NoError(t, allowAll.check(leafOf(t, anonymous)))
+}
+
+func TestControllerIdentityFilter_checkPeer(t *testing.T) {
+	caCert, caKey, err := ca.MakeCertificateAuthority()
+	require.NoError(t, err)
+	authority, err := ca.MakeCAFromData(caCert, caKey)
+	require.NoError(t, err)
+	controllerA, err := authority.MakeControllerCert([]string{"localhost"}, "controller-a")
+	require.NoError(t, err)
+
+	withPeer := func(authInfo credentials.AuthInfo) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: authInfo})
+	}
+	tlsInfo := credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{leafOf(t, controllerA)}}}
+
+	filter := makeControllerIdentityFilter([]string{"controller-a"})
+	assert.NoError(t, filter.checkPeer(withPeer(tlsInfo)))
+	assert.Error(t, filter.checkPeer(context.Background()))
+	assert.Error(t, filter.checkPeer(withPeer(nil)), "an insecure connection")
+	assert.Error(t, filter.checkPeer(withPeer(credentials.TLSInfo{})))
+
+	var allowAll *controllerIdentityFilter
+	assert.NoError(t, allowAll.checkPeer(context.Background()))
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sync"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+)
+
+// inflightRequests tracks the requests a controller sent on one tunnel
+// which are still running, so the tunnel's dataflow is closed only once
+// none of them can send on it.
+type inflightRequests struct {
+	sync.Mutex
+	cond *sync.Cond
+	ids  map[string]int
+}
+
+func makeInflightRequests() *inflightRequests {
+	r := &inflightRequests{ids: map[string]int{}}
+	r.cond = sync.NewCond(r)
+	return r
+}
+
+// start records that the request is running.
+func (r *inflightRequests) start(id string) {
+	r.Lock()
+	defer r.Unlock()
+	r.ids[id]++
+}
+
+// finish records that the request is done.
+func (r *inflightRequests) finish(id string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.ids[id]--; r.ids[id] <= 0 {
+		delete(r.ids, id)
+	}
+	if len(r.ids) == 0 {
+		r.cond.Broadcast()
+	}
+}
+
+// cancelAll cancels every running request, when there is no longer a
+// controller to answer.
+func (r *inflightRequests) cancelAll() {
+	r.Lock()
+	ids := make([]string, 0, len(r.ids))
+	for id := range r.ids {
+		ids = append(ids, id)
+	}
+	r.Unlock()
+	for _, id := range ids {
+		tunnel.CallCancelFunction(id)
+	}
+}
+
+// wait returns once no requests are running.
+func (r *inflightRequests) wait() {
+	r.Lock()
+	defer r.Unlock()
+	for len(r.ids) > 0 {
+		r.cond.Wait()
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInflightRequests_wait(t *testing.T) {
+	inflight := makeInflightRequests()
+	inflight.wait()
+
+	inflight.start("a")
+	inflight.start("b")
+	done := make(chan struct{})
+	go func() {
+		inflight.wait()
+		close(done)
+	}()
+
+	inflight.finish("a")
+	select {
+	case <-done:
+		require.FailNow(t, "wait returned while a request was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	inflight.finish("b")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for requests to finish")
+	}
+}
+
+func TestInflightRequests_cancelAll(t *testing.T) {
+	inflight := makeInflightRequests()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer tunnel.UnregisterCancelFunction(tunnel.RegisterCancelFunction("inflight1", cancel))
+	otherCtx, otherCancel := context.WithCancel(context.Background())
+	defer otherCancel()
+	defer tunnel.UnregisterCancelFunction(tunnel.RegisterCancelFunction("elsewhere", otherCancel))
+
+	inflight.start("inflight1")
+	inflight.cancelAll()
+	assert.Error(t, ctx.Err())
+	assert.NoError(t, otherCtx.Err(), "requests on other tunnels are left alone")
+}
@@ -21,8 +21,10 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -38,11 +40,18 @@ import (
 	"github.com/OpsMx/go-app-base/tracer"
 	"github.com/OpsMx/go-app-base/util"
 	"github.com/OpsMx/go-app-base/version"
+	"github.com/opsmx/oes-birger/internal/buildinfo"
 	"github.com/opsmx/oes-birger/internal/ca"
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+	"github.com/opsmx/oes-birger/internal/logging"
+	"github.com/opsmx/oes-birger/internal/otlpmetrics"
 	"github.com/opsmx/oes-birger/internal/secrets"
 	"github.com/opsmx/oes-birger/internal/serviceconfig"
 	"github.com/opsmx/oes-birger/internal/tunnel"
 	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	internalutil "github.com/opsmx/oes-birger/internal/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"go.uber.org/zap"
 )
@@ -62,6 +71,16 @@ var (
 	traceRatio     = flag.Float64("traceRatio", 0.01, "ratio of traces to create, if incoming request is not traced")
 	showversion    = flag.Bool("version", false, "show the version and exit")
 
+	// eg, http://localhost:4318
+	otlpMetricsEndpoint = flag.String("otlpMetricsEndpoint", "", "OTLP/HTTP collector endpoint to push metrics to")
+	otlpMetricsInterval = flag.Duration("otlpMetricsInterval", otlpmetrics.DefaultInterval, "how often to push metrics to the OTLP collector")
+
+	initialLogLevel = flag.String("logLevel", "info", "log level, such as debug, info, or warn")
+	selfTest        = flag.Bool("selfTest", false, "check that each configured endpoint can be reached at startup, and log the results")
+	selfTestTimeout = flag.Duration("selfTestTimeout", serviceconfig.DefaultSelfTestTimeout, "how long each endpoint's self-test or health check may take")
+
+	healthReportInterval = flag.Duration("healthReportInterval", 0, "if set, how often to check each endpoint and report its health to the controller")
+
 	config         *agentConfig
 	tracerProvider *tracer.TracerProvider
 
@@ -76,6 +95,8 @@ var (
 	sl     *zap.SugaredLogger
 
 	agentInfo *tunnel.AgentInfo
+
+	identityFilter *controllerIdentityFilter
 )
 
 func loadCACertPEM() []byte {
@@ -126,7 +147,7 @@ func main() {
 
 	var err error
 
-	logger, err = zap.NewProduction()
+	logger, _, err = logging.NewLogger(*initialLogLevel)
 	if err != nil {
 		log.Fatalf("setting up logger: %v", err)
 	}
@@ -166,11 +187,40 @@ func main() {
 	util.Check(err)
 	defer tracerProvider.Shutdown(ctx)
 
+	if *otlpMetricsEndpoint == "" {
+		*otlpMetricsEndpoint = util.GetEnvar("OTLP_METRICS_URL", "")
+	}
+	if *otlpMetricsEndpoint != "" {
+		exporter, err := otlpmetrics.NewExporter(*otlpMetricsEndpoint, appName, version.GitHash(), prometheus.DefaultGatherer)
+		if err != nil {
+			sl.Fatalf("configuring OTLP metrics: %v", err)
+		}
+		sl.Infow("pushing metrics over OTLP", "endpoint", exporter.Endpoint(), "interval", *otlpMetricsInterval)
+		go exporter.Run(ctx, *otlpMetricsInterval)
+	}
+
 	c, err := loadConfig(*configFile)
 	if err != nil {
 		sl.Fatalf("loading config: %v", err)
 	}
 	config = c
+
+	if err := internalutil.SetTLSSettings(config.TLSSettings); err != nil {
+		sl.Fatalf("loading config: %v", err)
+	}
+
+	var manifest *fwdapi.ManifestResponse
+	if config.ManifestFile != "" || config.RequireSignedManifest {
+		keys, err := manifestKeys(config.ManifestPublicKeyFile, loadCACertPEM())
+		if err != nil {
+			sl.Fatalf("loading manifest keys: %v", err)
+		}
+		manifest, err = loadManifest(config.ManifestFile, keys, config.RequireSignedManifest)
+		if err != nil {
+			sl.Fatalf("loading manifest: %v", err)
+		}
+		config.ControllerHostname = manifestControllerHostname(manifest)
+	}
 	sl.Infow("config", "controllerHostname", config.ControllerHostname)
 
 	agentServiceConfig, err := serviceconfig.LoadServiceConfig(config.ServicesConfigPath)
@@ -179,6 +229,23 @@ func main() {
 	}
 
 	endpoints = serviceconfig.ConfigureEndpoints(secretsLoader, agentServiceConfig)
+	if *selfTest {
+		serviceconfig.SelfTestEndpoints(ctx, endpoints, *selfTestTimeout)
+	}
+
+	if config.PrometheusListenPort != 0 {
+		go runPrometheusHTTPServer(config.PrometheusBindAddress, config.PrometheusListenPort)
+	}
+
+	if config.MaxRequestLifetime > 0 {
+		sl.Infow("reaping cancel functions of requests running too long", "maxRequestLifetime", config.MaxRequestLifetime)
+		go tunnel.RunCancelSweeper(config.MaxRequestLifetime)
+	}
+
+	if len(config.AllowedControllerIdentities) > 0 {
+		sl.Infow("accepting requests only from allowed controllers", "allowedControllerIdentities", config.AllowedControllerIdentities)
+		identityFilter = makeControllerIdentityFilter(config.AllowedControllerIdentities)
+	}
 
 	// If the user supplied an agentInfo block in the service config file, load that as well.
 	agentInfo, err = loadAgentInfo(config.ServicesConfigPath)
@@ -187,7 +254,12 @@ func main() {
 	}
 
 	// load client cert/key, cacert
-	clcert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	var clcert tls.Certificate
+	if manifest != nil {
+		clcert, err = manifestKeyPair(manifest)
+	} else {
+		clcert, err = tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	}
 	if err != nil {
 		sl.Fatalf("loading agent certificate or key: %v", err)
 	}
@@ -197,10 +269,10 @@ func main() {
 		sl.Fatalf("append certificate to pool: %v", err)
 	}
 
-	ta := credentials.NewTLS(&tls.Config{
+	ta := credentials.NewTLS(internalutil.ApplyTLSSettings(&tls.Config{
 		Certificates: []tls.Certificate{clcert},
 		RootCAs:      caCertPool,
-	})
+	}))
 
 	sa := &serverContext{}
 
@@ -209,12 +281,29 @@ func main() {
 		grpc.WithReturnConnectionError(),
 	}
 
+	if config.UserAgent == "" {
+		config.UserAgent = tunnel.DefaultUserAgent + "/" + version.GitBranch()
+	}
+	tunnel.SetUserAgent(config.UserAgent)
+
+	proxy, err := internalutil.ControllerProxy(config.ControllerProxy, !config.InsecureControllerAllowed)
+	if err != nil {
+		sl.Fatalf("controllerProxy: %v", err)
+	}
+	opts = append(opts, grpc.WithContextDialer(internalutil.ProxyDialer(proxy)))
+
 	if config.InsecureControllerAllowed {
 		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	} else {
 		opts = append(opts, grpc.WithTransportCredentials(ta))
 	}
 
+	opts = append(opts, config.TunnelMessageSize.DialOptions()...)
+
+	if config.CompressTunnel {
+		opts = append(opts, tunnel.CompressionDialOptions()...)
+	}
+
 	var conn *grpc.ClientConn
 	for i := 1; i <= c.DialMaxRetries; i++ {
 		conn, err = retryDial(ctx, config.ControllerHostname, opts)
@@ -237,21 +326,65 @@ func main() {
 	defer conn.Close()
 	sl.Infow("controller-connection", "established", true)
 
-	go runTunnel(sa, conn, agentInfo, endpoints, config.InsecureControllerAllowed, clcert)
+	// When a draining controller hands the agent to a peer, the tunnel to
+	// the peer is started before the old one is closed.  Connecting to the
+	// peer is retried with backoff, and a peer which cannot be reached is
+	// declared dead, so the agent stays where it is.  If the tunnel to a
+	// peer fails and the peer is declared dead, the agent falls back to its
+	// configured controller.
+	peers := makePeerConnector(config.PeerReconnect, func(ctx context.Context, hostname string) (*grpc.ClientConn, error) {
+		return retryDial(ctx, hostname, opts)
+	})
+	var reconnect func(hostname string, handoff bool) bool
+	reconnect = func(hostname string, handoff bool) bool {
+		if handoff {
+			peers.revive(hostname)
+		}
+		newConn, err := peers.connect(ctx, hostname)
+		if err != nil && !handoff && !errors.Is(err, errPeerConnecting) {
+			sl.Warnw("Could not reconnect to peer controller, falling back", "target", hostname, "controller", config.ControllerHostname, "error", err)
+			hostname = config.ControllerHostname
+			newConn, err = peers.redial(ctx, hostname)
+		}
+		if err != nil {
+			sl.Warnw("Could not establish GRPC connection to new controller", "target", hostname, "error", err)
+			return false
+		}
+		sl.Infow("controller-connection", "established", true, "target", hostname)
+		go runTunnel(sa, newConn, hostname, agentInfo, endpoints, config.InsecureControllerAllowed, clcert, reconnect)
+		return true
+	}
+	go runTunnel(sa, conn, config.ControllerHostname, agentInfo, endpoints, config.InsecureControllerAllowed, clcert, reconnect)
 
-	for _, service := range agentServiceConfig.IncomingServices {
-		go serviceconfig.RunHTTPServer(routes, service)
+	for _, services := range serviceconfig.GroupIncomingServices(agentServiceConfig.IncomingServices) {
+		go serviceconfig.RunHTTPServer(routes, services, serviceconfig.AllowAllAuthorizer{})
 	}
 
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, syscall.SIGTERM, syscall.SIGINT)
 
 	<-sigchan
+	serviceconfig.CloseEndpoints(endpoints)
 	log.Printf("Exiting Cleanly")
 }
 
 func retryDial(ctx context.Context, hostname string, opts []grpc.DialOption) (*grpc.ClientConn, error) {
 	ctx2, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
-	return grpc.DialContext(ctx2, config.ControllerHostname, opts...)
+	return grpc.DialContext(ctx2, hostname, opts...)
+}
+
+// runPrometheusHTTPServer serves the agent's metrics, such as the status
+// codes returned by its endpoints.
+func runPrometheusHTTPServer(bindAddress string, port uint16) {
+	addr := internalutil.ListenAddress(bindAddress, port)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	buildinfo.RegisterHandler(mux)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	zap.S().Infow("running HTTP listener for Prometheus", "address", addr)
+	zap.S().Fatal(server.ListenAndServe())
 }
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/opsmx/oes-birger/internal/ca"
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+)
+
+// loadManifest loads the manifest the controller generated for this agent,
+// as returned by its control API.  If the manifest is signed, or
+// requireSigned is set, its signature is verified with keys, which must
+// come from somewhere other than the manifest, and the signed copy of the
+// manifest is returned.
+func loadManifest(filename string, keys []crypto.PublicKey, requireSigned bool) (*fwdapi.ManifestResponse, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("requireSignedManifest is set, but manifestFile is not")
+	}
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &fwdapi.ManifestResponse{}
+	if err := json.Unmarshal(buf, manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest: %v", err)
+	}
+
+	if requireSigned || manifest.Signature != "" {
+		if manifest, err = signedManifest(manifest, keys); err != nil {
+			return nil, err
+		}
+	}
+
+	if manifest.ServerHostname == "" || manifest.ServerPort == 0 {
+		return nil, fmt.Errorf("manifest has no serverHostname or serverPort")
+	}
+	return manifest, nil
+}
+
+// signedManifest verifies the manifest's signature of its signed copy, and
+// returns the signed copy.  The manifest's other fields are not signed, so
+// are not used.
+func signedManifest(manifest *fwdapi.ManifestResponse, keys []crypto.PublicKey) (*fwdapi.ManifestResponse, error) {
+	if manifest.SignedManifest == "" {
+		return nil, fmt.Errorf("manifest is not signed")
+	}
+	payload, err := base64.StdEncoding.DecodeString(manifest.SignedManifest)
+	if err != nil {
+		return nil, fmt.Errorf("decoding signedManifest: %v", err)
+	}
+	if err := ca.VerifyManifestSignature(keys, payload, manifest.Signature); err != nil {
+		return nil, err
+	}
+	signed := &fwdapi.ManifestResponse{}
+	if err := json.Unmarshal(payload, signed); err != nil {
+		return nil, fmt.Errorf("parsing signedManifest: %v", err)
+	}
+	return signed, nil
+}
+
+// manifestKeys returns the keys to verify a manifest's signature with: the
+// public key in publicKeyFile if it is set, or else the keys of the CA
+// certificates in caCertsPEM.
+func manifestKeys(publicKeyFile string, caCertsPEM []byte) ([]crypto.PublicKey, error) {
+	if publicKeyFile == "" {
+		return ca.ManifestKeysFromCACerts(caCertsPEM)
+	}
+	key, err := ca.LoadManifestPublicKey(publicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return []crypto.PublicKey{key}, nil
+}
+
+// manifestControllerHostname returns the host:port the manifest says to
+// connect to.
+func manifestControllerHostname(manifest *fwdapi.ManifestResponse) string {
+	return net.JoinHostPort(manifest.ServerHostname, strconv.Itoa(int(manifest.ServerPort)))
+}
+
+// manifestKeyPair returns the agent certificate and key from the manifest.
+func manifestKeyPair(manifest *fwdapi.ManifestResponse) (tls.Certificate, error) {
+	certPEM, err := base64.StdEncoding.DecodeString(manifest.AgentCertificate)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("decoding agentCertificate: %v", err)
+	}
+	keyPEM, err := base64.StdEncoding.DecodeString(manifest.AgentKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("decoding agentKey: %v", err)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opsmx/oes-birger/internal/ca"
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeManifest(t *testing.T, manifest fwdapi.ManifestResponse) string {
+	buf, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "manifest.json")
+	require.NoError(t, os.WriteFile(filename, buf, 0600))
+	return filename
+}
+
+func TestLoadManifest(t *testing.T) {
+	caCert, caKey, err := ca.MakeCertificateAuthority()
+	require.NoError(t, err)
+	authority, err := ca.MakeCAFromData(caCert, caKey)
+	require.NoError(t, err)
+	ca64, cert64, key64, err := authority.GenerateCertificate(ca.CertificateName{Agent: "agent1", Purpose: ca.CertificatePurposeAgent}, 0)
+	require.NoError(t, err)
+
+	unsigned := fwdapi.ManifestResponse{
+		AgentName:        "agent1",
+		ServerHostname:   "controller.local",
+		ServerPort:       9001,
+		AgentCertificate: cert64,
+		AgentKey:         key64,
+		CACert:           ca64,
+	}
+	sign := func(manifest fwdapi.ManifestResponse) fwdapi.ManifestResponse {
+		payload, err := json.Marshal(manifest)
+		require.NoError(t, err)
+		manifest.Signature, err = authority.SignManifest(payload)
+		require.NoError(t, err)
+		manifest.SignedManifest = base64.StdEncoding.EncodeToString(payload)
+		return manifest
+	}
+	signed := sign(unsigned)
+
+	// Only the signed copy is used, so changing the fields beside it
+	// changes nothing.
+	outerChanged := signed
+	outerChanged.ServerHostname = "attacker.local"
+
+	attacker := unsigned
+	attacker.ServerHostname = "attacker.local"
+	tampered := signed
+	tampered.SignedManifest = sign(attacker).SignedManifest
+
+	keys, err := ca.ManifestKeysFromCACerts(caCert)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		manifest      fwdapi.ManifestResponse
+		requireSigned bool
+		wantErr       bool
+	}{
+		{"signed", signed, true, false},
+		{"signed, not required", signed, false, false},
+		{"unsigned fields changed", outerChanged, true, false},
+		{"tampered", tampered, true, true},
+		{"tampered, not required", tampered, false, true},
+		{"unsigned", unsigned, true, true},
+		{"unsigned, not required", unsigned, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest, err := loadManifest(writeManifest(t, tt.manifest), keys, tt.requireSigned)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "controller.local:9001", manifestControllerHostname(manifest))
+			_, err = manifestKeyPair(manifest)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestLoadManifest_noFile(t *testing.T) {
+	_, err := loadManifest("", nil, true)
+	assert.ErrorContains(t, err, "manifestFile")
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+var (
+	errPeerDead       = errors.New("peer controller was declared dead")
+	errPeerConnecting = errors.New("already connecting to peer controller")
+)
+
+// peerConnector connects the agent to the peer controllers it is handed
+// to, retrying with backoff.  A peer which cannot be reached before the
+// backoff gives up is declared dead, and is not connected to again until
+// a controller hands the agent to it again, which revives it.
+type peerConnector struct {
+	sync.Mutex
+	backoff    tunnel.BackoffConfig
+	dial       func(ctx context.Context, hostname string) (*grpc.ClientConn, error)
+	dead       map[string]bool
+	connecting map[string]bool
+}
+
+func makePeerConnector(backoff tunnel.BackoffConfig, dial func(ctx context.Context, hostname string) (*grpc.ClientConn, error)) *peerConnector {
+	return &peerConnector{
+		backoff:    backoff,
+		dial:       dial,
+		dead:       map[string]bool{},
+		connecting: map[string]bool{},
+	}
+}
+
+// connect returns a connection to the peer, or an error once the backoff
+// gives up, when the peer is declared dead.  Only one connection to each
+// peer is attempted at a time.
+func (p *peerConnector) connect(ctx context.Context, hostname string) (*grpc.ClientConn, error) {
+	p.Lock()
+	if p.dead[hostname] {
+		p.Unlock()
+		return nil, errPeerDead
+	}
+	if p.connecting[hostname] {
+		p.Unlock()
+		return nil, errPeerConnecting
+	}
+	p.connecting[hostname] = true
+	p.Unlock()
+
+	var conn *grpc.ClientConn
+	attempts := 0
+	err := p.backoff.Retry(ctx, func(ctx context.Context) error {
+		attempts++
+		c, err := p.dial(ctx, hostname)
+		if err != nil {
+			zap.S().Warnw("could not connect to peer controller", "target", hostname, "attempt", attempts, "error", err)
+			return err
+		}
+		conn = c
+		return nil
+	})
+
+	p.Lock()
+	defer p.Unlock()
+	delete(p.connecting, hostname)
+	if err != nil {
+		p.dead[hostname] = true
+		zap.S().Errorw("peer controller declared dead", "target", hostname, "error", err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// revive re-adds a peer which was declared dead, so it is connected to
+// again.
+func (p *peerConnector) revive(hostname string) {
+	p.Lock()
+	defer p.Unlock()
+	if p.dead[hostname] {
+		delete(p.dead, hostname)
+		zap.S().Infow("peer controller re-added", "target", hostname)
+	}
+}
+
+// redial returns a connection to the controller, retrying with backoff
+// until it succeeds or ctx is done.  Unlike connect, it never gives up on
+// the controller.
+func (p *peerConnector) redial(ctx context.Context, hostname string) (*grpc.ClientConn, error) {
+	for {
+		var conn *grpc.ClientConn
+		err := p.backoff.Retry(ctx, func(ctx context.Context) error {
+			c, err := p.dial(ctx, hostname)
+			if err != nil {
+				return err
+			}
+			conn = c
+			return nil
+		})
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		zap.S().Warnw("still unable to connect to controller, retrying", "target", hostname, "error", err)
+	}
+}
+
+// isDead returns true if the peer was declared dead.
+func (p *peerConnector) isDead(hostname string) bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.dead[hostname]
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// fakePeerDialer fails the first failures dials, recording when each was
+// made.
+type fakePeerDialer struct {
+	sync.Mutex
+	failures int
+	dials    []time.Time
+}
+
+func (d *fakePeerDialer) dial(ctx context.Context, hostname string) (*grpc.ClientConn, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.dials = append(d.dials, time.Now())
+	if len(d.dials) <= d.failures {
+		return nil, errors.New("connection refused")
+	}
+	return &grpc.ClientConn{}, nil
+}
+
+func (d *fakePeerDialer) gaps() []time.Duration {
+	d.Lock()
+	defer d.Unlock()
+	gaps := []time.Duration{}
+	for i := 1; i < len(d.dials); i++ {
+		gaps = append(gaps, d.dials[i].Sub(d.dials[i-1]))
+	}
+	return gaps
+}
+
+func TestPeerConnector_backsOffThenGivesUp(t *testing.T) {
+	dialer := &fakePeerDialer{failures: 100}
+	backoff := tunnel.BackoffConfig{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond, Multiplier: 2, MaxAttempts: 5}
+	peers := makePeerConnector(backoff, dialer.dial)
+
+	_, err := peers.connect(context.Background(), "peer.local:9001")
+	require.Error(t, err)
+	assert.True(t, peers.isDead("peer.local:9001"))
+
+	gaps := dialer.gaps()
+	require.Len(t, gaps, 4)
+	for i, want := range []time.Duration{10, 20, 40, 40} {
+		assert.GreaterOrEqual(t, gaps[i], want*time.Millisecond, "wait before attempt %d", i+2)
+	}
+
+	// A dead peer is not dialed again.
+	_, err = peers.connect(context.Background(), "peer.local:9001")
+	assert.ErrorIs(t, err, errPeerDead)
+	assert.Len(t, dialer.gaps(), 4)
+
+	// Other peers are unaffected.
+	assert.False(t, peers.isDead("other.local:9001"))
+}
+
+func TestPeerConnector_connectsAfterRetrying(t *testing.T) {
+	dialer := &fakePeerDialer{failures: 2}
+	backoff := tunnel.BackoffConfig{InitialBackoff: time.Millisecond, MaxAttempts: 5}
+	peers := makePeerConnector(backoff, dialer.dial)
+
+	conn, err := peers.connect(context.Background(), "peer.local:9001")
+	require.NoError(t, err)
+	assert.NotNil(t, conn)
+	assert.False(t, peers.isDead("peer.local:9001"))
+	assert.Len(t, dialer.gaps(), 2)
+}
+
+func TestPeerConnector_maxDuration(t *testing.T) {
+	dialer := &fakePeerDialer{failures: 100}
+	backoff := tunnel.BackoffConfig{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond, MaxDuration: 100 * time.Millisecond}
+	peers := makePeerConnector(backoff, dialer.dial)
+
+	start := time.Now()
+	_, err := peers.connect(context.Background(), "peer.local:9001")
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.True(t, peers.isDead("peer.local:9001"))
+	assert.LessOrEqual(t, len(dialer.gaps()), 10)
+}
+
+func TestPeerConnector_reviveReAddsDeadPeer(t *testing.T) {
+	dialer := &fakePeerDialer{failures: 2}
+	backoff := tunnel.BackoffConfig{InitialBackoff: time.Millisecond, MaxAttempts: 2}
+	peers := makePeerConnector(backoff, dialer.dial)
+
+	_, err := peers.connect(context.Background(), "peer.local:9001")
+	require.Error(t, err)
+	require.True(t, peers.isDead("peer.local:9001"))
+
+	peers.revive("peer.local:9001")
+	assert.False(t, peers.isDead("peer.local:9001"))
+	conn, err := peers.connect(context.Background(), "peer.local:9001")
+	require.NoError(t, err)
+	assert.NotNil(t, conn)
+}
+
+func TestPeerConnector_redialRetriesPastBound(t *testing.T) {
+	dialer := &fakePeerDialer{failures: 7}
+	backoff := tunnel.BackoffConfig{InitialBackoff: time.Millisecond, MaxAttempts: 2}
+	peers := makePeerConnector(backoff, dialer.dial)
+
+	conn, err := peers.redial(context.Background(), "controller.local:9001")
+	require.NoError(t, err)
+	assert.NotNil(t, conn)
+	assert.Len(t, dialer.gaps(), 7)
+	assert.False(t, peers.isDead("controller.local:9001"))
+}
+
+func TestPeerConnector_redialStopsWhenCancelled(t *testing.T) {
+	dialer := &fakePeerDialer{failures: 1000}
+	backoff := tunnel.BackoffConfig{InitialBackoff: time.Millisecond, MaxAttempts: 2}
+	peers := makePeerConnector(backoff, dialer.dial)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := peers.redial(ctx, "controller.local:9001")
+	assert.Error(t, err)
+}
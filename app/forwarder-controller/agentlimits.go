@@ -0,0 +1,169 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+// defaultMaxEndpoints is how many endpoints an agent may advertise when
+// maxEndpoints is not set.
+const defaultMaxEndpoints = 1000
+
+// Reasons an agent connection is rejected.
+const (
+	rejectTooManyConnections = "too_many_connections"
+	rejectTooManyEndpoints   = "too_many_endpoints"
+)
+
+var agentRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "agent_connections_rejected_total",
+	Help: "The total number of agent connections rejected for exceeding a limit, by reason",
+}, []string{"reason"})
+
+// agentConnectionLimits bounds what agents may use of the agent gRPC
+// server.  MaxConnections limits the number of open connections, and
+// those beyond it are closed as soon as they are accepted.
+// MaxConcurrentStreams limits the streams on each connection.  Agents
+// sending keepalive pings more often than KeepaliveMinTime, or without an
+// open stream unless PermitKeepaliveWithoutStream is set, are
+// disconnected.  Zero values leave the gRPC defaults, and no connection
+// limit.  MaxEndpoints limits the endpoints an agent may advertise when
+// it connects, and is defaultMaxEndpoints if zero.
+type agentConnectionLimits struct {
+	MaxConnections               int           `yaml:"maxConnections,omitempty"`
+	MaxConcurrentStreams         uint32        `yaml:"maxConcurrentStreams,omitempty"`
+	KeepaliveMinTime             time.Duration `yaml:"keepaliveMinTime,omitempty"`
+	PermitKeepaliveWithoutStream bool          `yaml:"permitKeepaliveWithoutStream,omitempty"`
+	MaxEndpoints                 int           `yaml:"maxEndpoints,omitempty"`
+}
+
+func (l agentConnectionLimits) validate() []error {
+	problems := []error{}
+	if l.MaxConnections < 0 {
+		problems = append(problems, fmt.Errorf("maxConnections must not be negative"))
+	}
+	if l.KeepaliveMinTime < 0 {
+		problems = append(problems, fmt.Errorf("keepaliveMinTime must not be negative"))
+	}
+	if l.MaxEndpoints < 0 {
+		problems = append(problems, fmt.Errorf("maxEndpoints must not be negative"))
+	}
+	return problems
+}
+
+// maxEndpoints returns how many endpoints an agent may advertise.
+func (l agentConnectionLimits) maxEndpoints() int {
+	if l.MaxEndpoints > 0 {
+		return l.MaxEndpoints
+	}
+	return defaultMaxEndpoints
+}
+
+// checkEndpoints returns an error to reject an agent's connection if it
+// advertised more endpoints than allowed.
+func (l agentConnectionLimits) checkEndpoints(count int) error {
+	if max := l.maxEndpoints(); count > max {
+		agentRejectedCounter.WithLabelValues(rejectTooManyEndpoints).Inc()
+		return status.Errorf(codes.ResourceExhausted, "agent advertised %d endpoints, more than the limit of %d", count, max)
+	}
+	return nil
+}
+
+// serverOptions returns the gRPC server options applying the limits.
+func (l agentConnectionLimits) serverOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{}
+	if l.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(l.MaxConcurrentStreams))
+	}
+	if l.KeepaliveMinTime > 0 || l.PermitKeepaliveWithoutStream {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             l.KeepaliveMinTime,
+			PermitWithoutStream: l.PermitKeepaliveWithoutStream,
+		}))
+	}
+	return opts
+}
+
+// listener wraps lis to apply MaxConnections, if set.
+func (l agentConnectionLimits) listener(lis net.Listener) net.Listener {
+	if l.MaxConnections <= 0 {
+		return lis
+	}
+	return &limitListener{Listener: lis, max: l.MaxConnections}
+}
+
+// limitListener closes connections accepted while max are already open,
+// rather than leaving them waiting as netutil.LimitListener does, so an
+// agent beyond the limit fails at once and retries.
+type limitListener struct {
+	net.Listener
+	max int
+
+	sync.Mutex
+	open int
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		l.Lock()
+		if l.open >= l.max {
+			l.Unlock()
+			agentRejectedCounter.WithLabelValues(rejectTooManyConnections).Inc()
+			zap.S().Warnw("rejecting agent connection: too many connections", "remoteAddr", conn.RemoteAddr().String(), "maxConnections", l.max)
+			conn.Close()
+			continue
+		}
+		l.open++
+		l.Unlock()
+		return &limitedConn{Conn: conn, release: l.release}, nil
+	}
+}
+
+func (l *limitListener) release() {
+	l.Lock()
+	defer l.Unlock()
+	l.open--
+}
+
+// limitedConn releases its place in the limit once, when first closed.
+type limitedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
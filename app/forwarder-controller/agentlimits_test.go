@@ -0,0 +1,210 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/ca"
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestAgentConnectionLimits_serverOptions(t *testing.T) {
+	assert.Empty(t, agentConnectionLimits{}.serverOptions())
+	assert.Len(t, agentConnectionLimits{MaxConcurrentStreams: 10}.serverOptions(), 1)
+	assert.Len(t, agentConnectionLimits{MaxConcurrentStreams: 10, KeepaliveMinTime: time.Minute}.serverOptions(), 2)
+	assert.Len(t, agentConnectionLimits{PermitKeepaliveWithoutStream: true}.serverOptions(), 1)
+}
+
+func TestLimitListener(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	limited := agentConnectionLimits{MaxConnections: 2}.listener(lis)
+	defer limited.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := limited.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	closedByServer := func(conn net.Conn) bool {
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+
+	dial()
+	first := <-accepted
+	dial()
+	<-accepted
+
+	rejected := dial()
+	assert.True(t, closedByServer(rejected), "connection beyond the limit must be closed")
+
+	// Closing twice frees only one place.
+	require.NoError(t, first.Close())
+	_ = first.Close()
+	dial()
+	<-accepted
+	assert.True(t, closedByServer(dial()), "connection beyond the limit must be closed")
+}
+
+func TestAgentConnectionLimits_grpc(t *testing.T) {
+	limits := agentConnectionLimits{MaxConnections: 1, MaxConcurrentStreams: 5}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer(limits.serverOptions()...)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go func() { _ = server.Serve(limits.listener(lis)) }()
+	defer server.Stop()
+
+	check := func() error {
+		conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		return err
+	}
+
+	require.NoError(t, check())
+	err = check()
+	require.Error(t, err)
+	assert.Contains(t, []codes.Code{codes.Unavailable, codes.DeadlineExceeded}, status.Code(err))
+}
+
+// helloStream is an agent's tunnel which sends a hello and then ends.
+type helloStream struct {
+	grpc.ServerStream
+	sync.Mutex
+	received []*tunnel.MessageWrapper
+	sent     []*tunnel.MessageWrapper
+}
+
+func (s *helloStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *helloStream) Send(m *tunnel.MessageWrapper) error {
+	s.Lock()
+	defer s.Unlock()
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+func (s *helloStream) Recv() (*tunnel.MessageWrapper, error) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.received) == 0 {
+		return nil, io.EOF
+	}
+	m := s.received[0]
+	s.received = s.received[1:]
+	return m, nil
+}
+
+func agentCertificate(t *testing.T, name string) []byte {
+	caCert, caKey, err := ca.MakeCertificateAuthority()
+	require.NoError(t, err)
+	authority, err := ca.MakeCAFromData(caCert, caKey)
+	require.NoError(t, err)
+	_, cert64, _, err := authority.GenerateCertificate(ca.CertificateName{Agent: name, Purpose: ca.CertificatePurposeAgent}, 0)
+	require.NoError(t, err)
+	certPEM, err := base64.StdEncoding.DecodeString(cert64)
+	require.NoError(t, err)
+	block, _ := pem.Decode(certPEM)
+	require.NotNil(t, block)
+	return block.Bytes
+}
+
+func TestAgentConnectionLimits_maxEndpoints(t *testing.T) {
+	assert.Equal(t, defaultMaxEndpoints, agentConnectionLimits{}.maxEndpoints())
+	assert.Equal(t, 3, agentConnectionLimits{MaxEndpoints: 3}.maxEndpoints())
+
+	cert := agentCertificate(t, "endpoints-agent")
+	counter := agentRejectedCounter.WithLabelValues(rejectTooManyEndpoints)
+
+	tests := []struct {
+		name      string
+		endpoints int
+		wantErr   bool
+	}{
+		{"within the limit", 2, false},
+		{"at the limit", 3, false},
+		{"over the limit", 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoints := make([]*tunnel.EndpointHealth, tt.endpoints)
+			for i := range endpoints {
+				endpoints[i] = &tunnel.EndpointHealth{Type: "jenkins", Name: fmt.Sprintf("ci%d", i), Configured: true}
+			}
+			stream := &helloStream{received: []*tunnel.MessageWrapper{{
+				Event: &tunnel.MessageWrapper_Hello{Hello: &tunnel.Hello{
+					Endpoints:         endpoints,
+					ClientCertificate: cert,
+				}},
+			}}}
+			server := &agentTunnelServer{insecure: true, limits: agentConnectionLimits{MaxEndpoints: 3}}
+			before := testutil.ToFloat64(counter)
+
+			err := server.EventTunnel(stream)
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+				assert.Empty(t, stream.sent, "a rejected agent is not sent a hello")
+				assert.Equal(t, before+1, testutil.ToFloat64(counter))
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, stream.sent, 1)
+			assert.NotNil(t, stream.sent[0].GetHello())
+			assert.Equal(t, before, testutil.ToFloat64(counter))
+		})
+	}
+}
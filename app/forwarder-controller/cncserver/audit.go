@@ -0,0 +1,149 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/ca"
+)
+
+// Credential types, used in audit events and to look up certificate lifetimes.
+const (
+	CredentialTypeKubeconfig = "kubeconfig"
+	CredentialTypeManifest   = "manifest"
+	CredentialTypeService    = "service"
+	CredentialTypeControl    = "control"
+)
+
+// AuditEvent records the issuance of a credential.  Only metadata is
+// recorded; certificates, keys, and tokens must never be added here.
+type AuditEvent struct {
+	Time           time.Time  `json:"time"`
+	Event          string     `json:"event"`
+	CredentialType string     `json:"credentialType"`
+	Requester      string     `json:"requester,omitempty"`
+	AgentName      string     `json:"agentName,omitempty"`
+	Name           string     `json:"name,omitempty"`
+	ServiceType    string     `json:"serviceType,omitempty"`
+	TTL            string     `json:"ttl,omitempty"`
+	NotAfter       *time.Time `json:"notAfter,omitempty"`
+}
+
+// EventKey returns the agent the credential was issued for, so the events
+// for each agent are kept in order when published to Kafka.
+func (e AuditEvent) EventKey() string {
+	return e.AgentName
+}
+
+// AuditSink receives an AuditEvent for each credential issued.
+type AuditSink interface {
+	Audit(event AuditEvent)
+}
+
+type jsonAuditSink struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// NewJSONAuditSink returns a sink which writes each event as a single
+// line of JSON.
+func NewJSONAuditSink(w io.Writer) AuditSink {
+	return &jsonAuditSink{w: w}
+}
+
+func (s *jsonAuditSink) Audit(event AuditEvent) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("audit: unable to marshal event: %v", err)
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, err := s.w.Write(append(b, '\n')); err != nil {
+		log.Printf("audit: unable to write event: %v", err)
+	}
+}
+
+type webhookSender interface {
+	Send(msg interface{})
+}
+
+type webhookAuditSink struct {
+	hook webhookSender
+}
+
+// NewWebhookAuditSink returns a sink which sends each event to a webhook,
+// or anything else which takes the same events, such as a Kafka sink.
+func NewWebhookAuditSink(hook webhookSender) AuditSink {
+	return &webhookAuditSink{hook: hook}
+}
+
+func (s *webhookAuditSink) Audit(event AuditEvent) {
+	s.hook.Send(event)
+}
+
+type requesterKey struct{}
+
+func withRequester(r *http.Request, names *ca.CertificateName) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requesterKey{}, names.Name))
+}
+
+func requesterFrom(r *http.Request) string {
+	if name, ok := r.Context().Value(requesterKey{}).(string); ok {
+		return name
+	}
+	return ""
+}
+
+// certificateNotAfter returns the expiry of a base64 encoded PEM certificate,
+// as returned by GenerateCertificate, or nil if it cannot be parsed.
+func certificateNotAfter(cert64 string) *time.Time {
+	pemBytes, err := base64.StdEncoding.DecodeString(cert64)
+	if err != nil {
+		return nil
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+	return &cert.NotAfter
+}
+
+func (s *CNCServer) audit(r *http.Request, event AuditEvent, notAfter *time.Time) {
+	event.Time = time.Now().UTC()
+	event.Event = "credentialIssued"
+	event.Requester = requesterFrom(r)
+	if notAfter != nil {
+		event.NotAfter = notAfter
+		event.TTL = notAfter.Sub(event.Time).Round(time.Second).String()
+	}
+	s.auditSink.Audit(event)
+}
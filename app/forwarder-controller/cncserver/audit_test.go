@@ -0,0 +1,203 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/opsmx/oes-birger/internal/ca"
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+	"github.com/opsmx/oes-birger/internal/jwtutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingSink struct {
+	events []AuditEvent
+}
+
+func (s *recordingSink) Audit(event AuditEvent) {
+	s.events = append(s.events, event)
+}
+
+type recordingHook struct {
+	msgs []interface{}
+}
+
+func (h *recordingHook) Send(msg interface{}) {
+	h.msgs = append(h.msgs, msg)
+}
+
+func TestCNCServer_audit(t *testing.T) {
+	caCert, caKey, err := ca.MakeCertificateAuthority()
+	require.NoError(t, err)
+	authority, err := ca.MakeCAFromData(caCert, caKey)
+	require.NoError(t, err)
+
+	key1, err := jwk.New([]byte("key 1"))
+	require.NoError(t, err)
+	require.NoError(t, key1.Set(jwk.KeyIDKey, "key1"))
+	require.NoError(t, key1.Set(jwk.AlgorithmKey, jwa.HS256))
+	keyset := jwk.NewSet()
+	keyset.Add(key1)
+	require.NoError(t, jwtutil.RegisterServiceauthKeyset(keyset, "key1"))
+
+	controlCert := &x509.Certificate{
+		Subject: pkix.Name{
+			OrganizationalUnit: []string{`{"name":"operator","purpose":"control"}`},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		handler func(*CNCServer) http.HandlerFunc
+		request interface{}
+		want    AuditEvent
+		wantTTL bool
+	}{
+		{
+			"kubeconfig",
+			func(c *CNCServer) http.HandlerFunc { return c.generateKubectlComponents() },
+			fwdapi.KubeConfigRequest{AgentName: "agent smith", Name: "alice smith"},
+			AuditEvent{CredentialType: CredentialTypeKubeconfig, AgentName: "agent smith", Name: "alice smith", ServiceType: "kubernetes"},
+			true,
+		},
+		{
+			"manifest",
+			func(c *CNCServer) http.HandlerFunc { return c.generateAgentManifestComponents() },
+			fwdapi.ManifestRequest{AgentName: "agent smith"},
+			AuditEvent{CredentialType: CredentialTypeManifest, AgentName: "agent smith"},
+			true,
+		},
+		{
+			"service",
+			func(c *CNCServer) http.HandlerFunc { return c.generateServiceCredentials() },
+			fwdapi.ServiceCredentialRequest{AgentName: "agent smith", Type: "jenkins", Name: "service smith"},
+			AuditEvent{CredentialType: CredentialTypeService, AgentName: "agent smith", Name: "service smith", ServiceType: "jenkins"},
+			false,
+		},
+		{
+			"control",
+			func(c *CNCServer) http.HandlerFunc { return c.generateControlCredentials() },
+			fwdapi.ControlCredentialsRequest{Name: "contra smith"},
+			AuditEvent{CredentialType: CredentialTypeControl, Name: "contra smith"},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			c := MakeCNCServer(&mockConfig{}, authority, nil, "")
+			c.SetAuditSink(sink)
+
+			body, err := json.Marshal(tt.request)
+			require.NoError(t, err)
+			r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{controlCert}}
+			w := httptest.NewRecorder()
+			c.authenticate("POST", tt.handler(c)).ServeHTTP(w, r)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			require.Len(t, sink.events, 1)
+			event := sink.events[0]
+			assert.Equal(t, "credentialIssued", event.Event)
+			assert.Equal(t, "operator", event.Requester)
+			assert.Equal(t, tt.want.CredentialType, event.CredentialType)
+			assert.Equal(t, tt.want.AgentName, event.AgentName)
+			assert.Equal(t, tt.want.Name, event.Name)
+			assert.Equal(t, tt.want.ServiceType, event.ServiceType)
+			assert.WithinDuration(t, time.Now(), event.Time, time.Minute)
+			if tt.wantTTL {
+				require.NotNil(t, event.NotAfter)
+				assert.True(t, event.NotAfter.After(time.Now()))
+				assert.NotEmpty(t, event.TTL)
+			} else {
+				assert.Nil(t, event.NotAfter)
+			}
+
+			// Nothing from the response, which holds the secrets, may
+			// appear in the audit record.
+			var response map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			encoded, err := json.Marshal(event)
+			require.NoError(t, err)
+			for _, secret := range secretValues(response) {
+				assert.NotContains(t, string(encoded), secret)
+			}
+		})
+	}
+}
+
+// secretValues returns the long string values in a response, which
+// are the certificates, keys, and tokens.
+func secretValues(response map[string]interface{}) []string {
+	ret := []string{}
+	for _, v := range response {
+		switch value := v.(type) {
+		case string:
+			if len(value) > 40 {
+				ret = append(ret, value)
+			}
+		case map[string]interface{}:
+			ret = append(ret, secretValues(value)...)
+		}
+	}
+	return ret
+}
+
+func TestCNCServer_audit_failedRequest(t *testing.T) {
+	sink := &recordingSink{}
+	c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, "")
+	c.SetAuditSink(sink)
+
+	r := httptest.NewRequest("POST", "https://localhost/foo", strings.NewReader("{}"))
+	w := httptest.NewRecorder()
+	c.generateKubectlComponents().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, sink.events)
+}
+
+func TestJSONAuditSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONAuditSink(&buf)
+	sink.Audit(AuditEvent{Event: "credentialIssued", CredentialType: CredentialTypeManifest, AgentName: "a1"})
+	sink.Audit(AuditEvent{Event: "credentialIssued", CredentialType: CredentialTypeControl, Name: "c1"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var event AuditEvent
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &event))
+	assert.Equal(t, "a1", event.AgentName)
+}
+
+func TestWebhookAuditSink(t *testing.T) {
+	hook := &recordingHook{}
+	NewWebhookAuditSink(hook).Audit(AuditEvent{CredentialType: CredentialTypeService})
+	require.Len(t, hook.msgs, 1)
+	assert.Equal(t, CredentialTypeService, hook.msgs[0].(AuditEvent).CredentialType)
+}
@@ -21,22 +21,30 @@ package cncserver
 
 import (
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"regexp"
+	"sync/atomic"
+	"time"
 
 	"github.com/OpsMx/go-app-base/version"
 	"github.com/oklog/ulid/v2"
 	"github.com/opsmx/oes-birger/internal/ca"
 	"github.com/opsmx/oes-birger/internal/fwdapi"
 	"github.com/opsmx/oes-birger/internal/jwtutil"
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
 	"github.com/opsmx/oes-birger/internal/util"
 )
 
 type cncCertificateAuthority interface {
 	ca.CertificateIssuer
 	ca.CertPoolGenerator
+	ca.CABundler
 }
 
 type cncConfig interface {
@@ -45,10 +53,21 @@ type cncConfig interface {
 	GetServiceURL() string
 	GetControlURL() string
 	GetControlListenPort() uint16
+	GetControlBindAddress() string
+	GetMaxCertificateTTL(credentialType string) time.Duration
+	GetNamePattern() *regexp.Regexp
 }
 
 type cncAgentStatsReporter interface {
 	GetStatistics() interface{}
+	GetEndpointSummaries() []tunnelroute.EndpointSummary
+}
+
+// ServiceKeyRotator reloads the service-auth keys, promoting currentKeyName
+// to sign new tokens and dropping the retired keys.  It returns the names
+// of the keys now loaded.
+type ServiceKeyRotator interface {
+	RotateServiceKeys(currentKeyName string, retired []string) ([]string, error)
 }
 
 // CNCServer holds the context for a specific instance of a command and control http server.
@@ -57,6 +76,12 @@ type CNCServer struct {
 	authority     cncCertificateAuthority
 	agentReporter cncAgentStatsReporter
 	version       string
+	auditSink     AuditSink
+	keyRotator    ServiceKeyRotator
+	signer        ca.ManifestSigner
+	handoff       Handoff
+	advertiser    tunnelroute.RouteAdvertiser
+	standby       atomic.Bool
 }
 
 // MakeCNCServer will return a server that implenets the endpoints for command and control,
@@ -72,46 +97,126 @@ func MakeCNCServer(
 		authority:     authority,
 		agentReporter: agents,
 		version:       vers,
+		auditSink:     NewJSONAuditSink(os.Stdout),
 	}
 }
 
+// SetAuditSink replaces where audit events for issued credentials are sent.
+// By default, they are written as JSON to stdout.
+func (s *CNCServer) SetAuditSink(sink AuditSink) {
+	s.auditSink = sink
+}
+
+// SetServiceKeyRotator enables the endpoint which rotates service-auth keys.
+// Without one, requests to that endpoint fail.
+func (s *CNCServer) SetServiceKeyRotator(rotator ServiceKeyRotator) {
+	s.keyRotator = rotator
+}
+
+// SetManifestSigner enables signing of agent manifests, so agents which
+// require signed manifests can verify them.  Without one, manifests are
+// not signed.
+func (s *CNCServer) SetManifestSigner(signer ca.ManifestSigner) {
+	s.signer = signer
+}
+
 func (s *CNCServer) authenticate(method string, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != method {
 			err := fmt.Errorf("only '%s' is accepted (not '%s')", method, r.Method)
-			util.FailRequest(w, err, http.StatusMethodNotAllowed)
+			failRequest(w, err, http.StatusMethodNotAllowed, fwdapi.ErrorCodeMethodNotAllowed)
 			return
 		}
 
 		names, err := ca.GetCertificateNameFromCert(r.TLS.PeerCertificates[0])
 		if err != nil {
-			util.FailRequest(w, err, http.StatusForbidden)
+			failRequest(w, err, http.StatusForbidden, fwdapi.ErrorCodeForbidden)
 			return
 		}
 		if names.Purpose != ca.CertificatePurposeControl {
 			err := fmt.Errorf("certificate is not authorized for 'control': %s", names.Purpose)
-			util.FailRequest(w, err, http.StatusForbidden)
+			failRequest(w, err, http.StatusForbidden, fwdapi.ErrorCodeForbidden)
 			return
 		}
 
-		h(w, r)
+		h(w, withRequester(r, names))
 	}
 }
 
+// defaultMaxCertificateTTL is the longest lifetime for a certificate when
+// none is configured for its credential type, the same year the authority
+// issues certificates for by default.
+const defaultMaxCertificateTTL = 365 * 24 * time.Hour
+
+// certificateTTL returns the lifetime for a new certificate, which is the
+// requested TTL clamped to the configured maximum for the credential type,
+// or to defaultMaxCertificateTTL if none is configured.  If no TTL was
+// requested, the maximum is used.
+func (s *CNCServer) certificateTTL(credentialType string, requested string) time.Duration {
+	ttl, _ := fwdapi.ParseTTL(requested) // already validated
+	max := s.cfg.GetMaxCertificateTTL(credentialType)
+	if max <= 0 {
+		max = defaultMaxCertificateTTL
+	}
+	if ttl == 0 || ttl > max {
+		return max
+	}
+	return ttl
+}
+
+func expiry(notAfter *time.Time) uint64 {
+	if notAfter == nil {
+		return 0
+	}
+	return ulid.Timestamp(*notAfter)
+}
+
+// checkName returns a validation error if the value does not match the
+// configured name pattern.  Any name is allowed if no pattern is configured.
+func (s *CNCServer) checkName(field string, value string) error {
+	pattern := s.cfg.GetNamePattern()
+	if pattern == nil || pattern.MatchString(value) {
+		return nil
+	}
+	return &fwdapi.ValidationError{
+		Field:  field,
+		Reason: fmt.Sprintf("does not match the required pattern '%s'", pattern.String()),
+	}
+}
+
+// decodeKubeConfigRequest reads and validates a KubeConfigRequest.  If it
+// is not valid, the request is failed and false is returned.
+func (s *CNCServer) decodeKubeConfigRequest(w http.ResponseWriter, r *http.Request) (fwdapi.KubeConfigRequest, bool) {
+	var req fwdapi.KubeConfigRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
+		return req, false
+	}
+
+	err = req.Validate()
+	if err != nil {
+		failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
+		return req, false
+	}
+
+	if err := s.checkName("agentName", req.AgentName); err != nil {
+		failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
+		return req, false
+	}
+	if err := s.checkName("name", req.Name); err != nil {
+		failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
+		return req, false
+	}
+	return req, true
+}
+
 func (s *CNCServer) generateKubectlComponents() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("content-type", "application/json")
 
-		var req fwdapi.KubeConfigRequest
-		err := json.NewDecoder(r.Body).Decode(&req)
-		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
-			return
-		}
-
-		err = req.Validate()
-		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+		req, ok := s.decodeKubeConfigRequest(w, r)
+		if !ok {
 			return
 		}
 
@@ -121,11 +226,18 @@ func (s *CNCServer) generateKubectlComponents() http.HandlerFunc {
 			Agent:   req.AgentName,
 			Purpose: ca.CertificatePurposeService,
 		}
-		ca64, user64, key64, err := s.authority.GenerateCertificate(name)
+		ca64, user64, key64, err := s.authority.GenerateCertificate(name, s.certificateTTL(CredentialTypeKubeconfig, req.TTL))
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeCAError)
 			return
 		}
+		notAfter := certificateNotAfter(user64)
+		s.audit(r, AuditEvent{
+			CredentialType: CredentialTypeKubeconfig,
+			AgentName:      req.AgentName,
+			Name:           req.Name,
+			ServiceType:    name.Type,
+		}, notAfter)
 		ret := fwdapi.KubeConfigResponse{
 			AgentName:       req.AgentName,
 			Name:            req.Name,
@@ -133,10 +245,11 @@ func (s *CNCServer) generateKubectlComponents() http.HandlerFunc {
 			UserCertificate: user64,
 			UserKey:         key64,
 			CACert:          ca64,
+			NotAfter:        expiry(notAfter),
 		}
 		json, err := json.Marshal(ret)
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInternalError)
 			return
 		}
 		n, err := w.Write(json)
@@ -151,47 +264,126 @@ func (s *CNCServer) generateKubectlComponents() http.HandlerFunc {
 	}
 }
 
-func (s *CNCServer) generateAgentManifestComponents() http.HandlerFunc {
+// previewKubectlComponents validates a kubeconfig request exactly as
+// generateKubectlComponents does, but returns the response without issuing
+// a certificate.  The user certificate and key are left empty, and NotAfter
+// is when a certificate issued now would expire.
+func (s *CNCServer) previewKubectlComponents() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("content-type", "application/json")
 
-		var req fwdapi.ManifestRequest
-		err := json.NewDecoder(r.Body).Decode(&req)
-		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+		req, ok := s.decodeKubeConfigRequest(w, r)
+		if !ok {
 			return
 		}
 
-		err = req.Validate()
+		ca64, err := s.authority.GetCACert()
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeCAError)
 			return
 		}
-
-		name := ca.CertificateName{
-			Agent:   req.AgentName,
-			Purpose: ca.CertificatePurposeAgent,
+		notAfter := previewNotAfter(s.certificateTTL(CredentialTypeKubeconfig, req.TTL))
+		ret := fwdapi.KubeConfigResponse{
+			AgentName: req.AgentName,
+			Name:      req.Name,
+			ServerURL: s.cfg.GetServiceURL(),
+			CACert:    ca64,
+			NotAfter:  expiry(&notAfter),
+		}
+		json, err := json.Marshal(ret)
+		if err != nil {
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInternalError)
+			return
 		}
-		ca64, user64, key64, err := s.authority.GenerateCertificate(name)
+		n, err := w.Write(json)
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			log.Printf("previewKubectlComponents: error while writing: %v", err)
+			return
+		}
+		if n != len(json) {
+			log.Printf("previewKubectlComponents: failed to write entire message: %d of %d written", n, len(json))
 			return
 		}
-		ret := fwdapi.ManifestResponse{
-			AgentName:        req.AgentName,
-			ServerHostname:   s.cfg.GetAgentHostname(),
-			ServerPort:       s.cfg.GetAgentAdvertisePort(),
-			AgentCertificate: user64,
-			AgentVersion:     version.GitBranch(),
-			AgentKey:         key64,
-			CACert:           ca64,
+	}
+}
+
+// previewNotAfter returns when a certificate issued now with the given ttl
+// would expire.  The ttl comes from certificateTTL, so it is already
+// clamped to the credential type's maximum, or defaultMaxCertificateTTL.
+func previewNotAfter(ttl time.Duration) time.Time {
+	return time.Now().UTC().Add(ttl)
+}
+
+// issueManifest validates the request, and issues the agent certificate
+// for it.
+func (s *CNCServer) issueManifest(r *http.Request, req fwdapi.ManifestRequest) (*fwdapi.ManifestResponse, *requestError) {
+	err := req.Validate()
+	if err != nil {
+		return nil, invalidRequest(err)
+	}
+
+	if err := s.checkName("agentName", req.AgentName); err != nil {
+		return nil, invalidRequest(err)
+	}
+
+	name := ca.CertificateName{
+		Agent:   req.AgentName,
+		Purpose: ca.CertificatePurposeAgent,
+	}
+	ca64, user64, key64, err := s.authority.GenerateCertificate(name, s.certificateTTL(CredentialTypeManifest, req.TTL))
+	if err != nil {
+		return nil, &requestError{err, http.StatusBadRequest, fwdapi.ErrorCodeCAError}
+	}
+	notAfter := certificateNotAfter(user64)
+	ret := &fwdapi.ManifestResponse{
+		AgentName:        req.AgentName,
+		ServerHostname:   s.cfg.GetAgentHostname(),
+		ServerPort:       s.cfg.GetAgentAdvertisePort(),
+		AgentCertificate: user64,
+		AgentVersion:     version.GitBranch(),
+		AgentKey:         key64,
+		CACert:           ca64,
+		NotAfter:         expiry(notAfter),
+	}
+	if version.BuildType() != "release" {
+		ret.AgentVersion = "latest"
+	}
+	if s.signer != nil {
+		payload, err := json.Marshal(ret)
+		if err != nil {
+			return nil, &requestError{err, http.StatusBadRequest, fwdapi.ErrorCodeInternalError}
+		}
+		if ret.Signature, err = s.signer.SignManifest(payload); err != nil {
+			return nil, &requestError{err, http.StatusBadRequest, fwdapi.ErrorCodeCAError}
+		}
+		ret.SignedManifest = base64.StdEncoding.EncodeToString(payload)
+	}
+	s.audit(r, AuditEvent{
+		CredentialType: CredentialTypeManifest,
+		AgentName:      req.AgentName,
+	}, notAfter)
+	return ret, nil
+}
+
+func (s *CNCServer) generateAgentManifestComponents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+
+		var req fwdapi.ManifestRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
+			return
 		}
-		if version.BuildType() != "release" {
-			ret.AgentVersion = "latest"
+
+		ret, rerr := s.issueManifest(r, req)
+		if rerr != nil {
+			rerr.fail(w)
+			return
 		}
 		json, err := json.Marshal(ret)
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInternalError)
 			return
 		}
 		n, err := w.Write(json)
@@ -206,6 +398,84 @@ func (s *CNCServer) generateAgentManifestComponents() http.HandlerFunc {
 	}
 }
 
+// issueServiceCredential validates the request, and makes the service
+// credential for it.
+func (s *CNCServer) issueServiceCredential(r *http.Request, req fwdapi.ServiceCredentialRequest) (*fwdapi.ServiceCredentialResponse, *requestError) {
+	// TODO: remove in a future version, once sapor updates to using the proper capitalization.
+	if len(req.Type) == 0 {
+		req.Type = req.OldType
+	}
+	if len(req.Name) == 0 {
+		req.Name = req.OldName
+	}
+
+	err := req.Validate()
+	if err != nil {
+		return nil, invalidRequest(err)
+	}
+
+	if err := s.checkName("agentName", req.AgentName); err != nil {
+		return nil, invalidRequest(err)
+	}
+	if err := s.checkName("name", req.Name); err != nil {
+		return nil, invalidRequest(err)
+	}
+
+	if req.KeyName != "" && !jwtutil.IsSigningKey(req.KeyName) {
+		return nil, invalidRequest(&fwdapi.ValidationError{Field: "keyName", Reason: "is not a current signing key"})
+	}
+
+	scope := jwtutil.Scope{}
+	if req.Scope != nil {
+		scope.Services = req.Scope.Services
+		scope.Methods = req.Scope.Methods
+	}
+	token, err := jwtutil.MakeIdentifiedJWTWithKey(req.KeyName, req.Type, req.Name, req.AgentName, scope, nil)
+	if err != nil {
+		return nil, &requestError{err, http.StatusBadRequest, fwdapi.ErrorCodeTokenError}
+	}
+
+	cacert, err := s.authority.GetCACert()
+	if err != nil {
+		return nil, &requestError{err, http.StatusBadRequest, fwdapi.ErrorCodeCAError}
+	}
+
+	s.audit(r, AuditEvent{
+		CredentialType: CredentialTypeService,
+		AgentName:      req.AgentName,
+		Name:           req.Name,
+		ServiceType:    req.Type,
+	}, nil)
+	ret := &fwdapi.ServiceCredentialResponse{
+		AgentName: req.AgentName,
+		Name:      req.Name,
+		Type:      req.Type,
+		URL:       s.cfg.GetServiceURL(),
+		CACert:    cacert,
+		Scope:     req.Scope,
+	}
+
+	username := fmt.Sprintf("%s.%s", req.Name, req.AgentName)
+
+	switch req.Type {
+	case "aws":
+		ret.CredentialType = "aws"
+		ret.Credential = fwdapi.AwsCredentialResponse{
+			AwsAccessKey:       username,
+			AwsSecretAccessKey: token,
+		}
+	default:
+		ret.Username = username // deprecated
+		ret.Password = token    // deprecated
+		ret.CredentialType = "basic"
+		ret.Credential = fwdapi.BasicCredentialResponse{
+			Username: username,
+			Password: token,
+		}
+	}
+	return ret, nil
+}
+
 func (s *CNCServer) generateServiceCredentials() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("content-type", "application/json")
@@ -213,73 +483,86 @@ func (s *CNCServer) generateServiceCredentials() http.HandlerFunc {
 		var req fwdapi.ServiceCredentialRequest
 		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
 			return
 		}
-		// TODO: remove in a future version, once sapor updates to using the proper capitalization.
-		if len(req.Type) == 0 {
-			req.Type = req.OldType
-		}
-		if len(req.Name) == 0 {
-			req.Name = req.OldName
-		}
 
-		err = req.Validate()
+		ret, rerr := s.issueServiceCredential(r, req)
+		if rerr != nil {
+			rerr.fail(w)
+			return
+		}
+		json, err := json.Marshal(ret)
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInternalError)
 			return
 		}
-
-		token, err := jwtutil.MakeJWT(req.Type, req.Name, req.AgentName, nil)
+		n, err := w.Write(json)
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			log.Printf("generateServiceCredentials: error while writing: %v", err)
 			return
 		}
+		if n != len(json) {
+			log.Printf("generateServiceCredentials: failed to write entire message: %d of %d written", n, len(json))
+			return
+		}
+	}
+}
 
-		cacert, err := s.authority.GetCACert()
+// generateCredentialsBatch issues each manifest and service credential in
+// the batch as the single item endpoints would.  A failed item is reported
+// in its result, and the rest are still issued.
+func (s *CNCServer) generateCredentialsBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+
+		var req fwdapi.BatchCredentialRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
 			return
 		}
 
-		ret := fwdapi.ServiceCredentialResponse{
-			AgentName: req.AgentName,
-			Name:      req.Name,
-			Type:      req.Type,
-			URL:       s.cfg.GetServiceURL(),
-			CACert:    cacert,
+		err = req.Validate()
+		if err != nil {
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
+			return
 		}
 
-		username := fmt.Sprintf("%s.%s", req.Name, req.AgentName)
-
-		switch req.Type {
-		case "aws":
-			ret.CredentialType = "aws"
-			ret.Credential = fwdapi.AwsCredentialResponse{
-				AwsAccessKey:       username,
-				AwsSecretAccessKey: token,
+		ret := fwdapi.BatchCredentialResponse{}
+		for _, item := range req.Manifests {
+			var result fwdapi.ManifestResult
+			manifest, rerr := s.issueManifest(r, item)
+			if rerr != nil {
+				result.Error = rerr.detail()
+			} else {
+				result.Manifest = manifest
 			}
-		default:
-			ret.Username = username // deprecated
-			ret.Password = token    // deprecated
-			ret.CredentialType = "basic"
-			ret.Credential = fwdapi.BasicCredentialResponse{
-				Username: username,
-				Password: token,
+			ret.Manifests = append(ret.Manifests, result)
+		}
+		for _, item := range req.Services {
+			var result fwdapi.ServiceCredentialResult
+			credential, rerr := s.issueServiceCredential(r, item)
+			if rerr != nil {
+				result.Error = rerr.detail()
+			} else {
+				result.Credential = credential
 			}
+			ret.Services = append(ret.Services, result)
 		}
+
 		json, err := json.Marshal(ret)
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInternalError)
 			return
 		}
 		n, err := w.Write(json)
 		if err != nil {
-			log.Printf("generateServiceCredentials: error while writing: %v", err)
+			log.Printf("generateCredentialsBatch: error while writing: %v", err)
 			return
 		}
 		if n != len(json) {
-			log.Printf("generateServiceCredentials: failed to write entire message: %d of %d written", n, len(json))
+			log.Printf("generateCredentialsBatch: failed to write entire message: %d of %d written", n, len(json))
 			return
 		}
 	}
@@ -292,13 +575,13 @@ func (s *CNCServer) generateControlCredentials() http.HandlerFunc {
 		var req fwdapi.ControlCredentialsRequest
 		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
 			return
 		}
 
 		err = req.Validate()
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
 			return
 		}
 
@@ -306,21 +589,27 @@ func (s *CNCServer) generateControlCredentials() http.HandlerFunc {
 			Name:    req.Name,
 			Purpose: ca.CertificatePurposeAgent,
 		}
-		ca64, user64, key64, err := s.authority.GenerateCertificate(name)
+		ca64, user64, key64, err := s.authority.GenerateCertificate(name, s.certificateTTL(CredentialTypeControl, req.TTL))
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeCAError)
 			return
 		}
+		notAfter := certificateNotAfter(user64)
+		s.audit(r, AuditEvent{
+			CredentialType: CredentialTypeControl,
+			Name:           req.Name,
+		}, notAfter)
 		ret := fwdapi.ControlCredentialsResponse{
 			Name:        req.Name,
 			URL:         s.cfg.GetControlURL(),
 			Certificate: user64,
 			Key:         key64,
 			CACert:      ca64,
+			NotAfter:    expiry(notAfter),
 		}
 		json, err := json.Marshal(ret)
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInternalError)
 			return
 		}
 		n, err := w.Write(json)
@@ -337,25 +626,48 @@ func (s *CNCServer) generateControlCredentials() http.HandlerFunc {
 
 func (s *CNCServer) getStatistics() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("content-type", "application/json")
-
 		ret := fwdapi.StatisticsResponse{
 			ServerTime:      ulid.Now(),
 			Version:         s.version,
+			Role:            s.Role(),
+			Handoff:         s.handoffState(),
 			ConnectedAgents: s.agentReporter.GetStatistics(),
 		}
-		json, err := json.Marshal(ret)
+		writeResponse(w, r, "getStatistics", ret)
+	}
+}
+
+// getEndpoints returns the endpoints reachable now, so clients need not
+// work them out from the full statistics.
+func (s *CNCServer) getEndpoints() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ret := fwdapi.EndpointsResponse{
+			ServerTime: ulid.Now(),
+			Endpoints:  s.agentReporter.GetEndpointSummaries(),
+		}
+		writeResponse(w, r, "getEndpoints", ret)
+	}
+}
+
+// getCABundle returns the CA certificate and any intermediates as PEM, so
+// it can be added directly to a trust store.  The fingerprint is returned in
+// a header.
+func (s *CNCServer) getCABundle() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bundle, fingerprint, err := s.authority.GetCACertBundle()
 		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
+			failRequest(w, err, http.StatusInternalServerError, fwdapi.ErrorCodeInternalError)
 			return
 		}
-		n, err := w.Write(json)
+		w.Header().Set("content-type", "application/x-pem-file")
+		w.Header().Set(fwdapi.CAFingerprintHeader, fingerprint)
+		n, err := w.Write(bundle)
 		if err != nil {
-			log.Printf("getStatistics: error while writing: %v", err)
+			log.Printf("getCABundle: error while writing: %v", err)
 			return
 		}
-		if n != len(json) {
-			log.Printf("getStatistics: failed to write entire message: %d of %d written", n, len(json))
+		if n != len(bundle) {
+			log.Printf("getCABundle: failed to write entire message: %d of %d written", n, len(bundle))
 			return
 		}
 	}
@@ -363,26 +675,47 @@ func (s *CNCServer) getStatistics() http.HandlerFunc {
 
 func (s *CNCServer) routes(mux *http.ServeMux) {
 	mux.HandleFunc(fwdapi.KubeconfigEndpoint,
-		s.authenticate("POST", s.generateKubectlComponents()))
+		s.authenticate("POST", s.requireActive(s.generateKubectlComponents())))
+
+	mux.HandleFunc(fwdapi.KubeconfigPreviewEndpoint,
+		s.authenticate("POST", s.previewKubectlComponents()))
 
 	mux.HandleFunc(fwdapi.ManifestEndpoint,
-		s.authenticate("POST", s.generateAgentManifestComponents()))
+		s.authenticate("POST", s.requireActive(s.generateAgentManifestComponents())))
 
 	mux.HandleFunc(fwdapi.ServiceEndpoint,
-		s.authenticate("POST", s.generateServiceCredentials()))
+		s.authenticate("POST", s.requireActive(s.generateServiceCredentials())))
+
+	mux.HandleFunc(fwdapi.BatchEndpoint,
+		s.authenticate("POST", s.requireActive(s.generateCredentialsBatch())))
 
 	mux.HandleFunc(fwdapi.ControlEndpoint,
-		s.authenticate("POST", s.generateControlCredentials()))
+		s.authenticate("POST", s.requireActive(s.generateControlCredentials())))
 
 	mux.HandleFunc(fwdapi.StatisticsEndpoint,
 		s.authenticate("GET", s.getStatistics()))
 
+	mux.HandleFunc(fwdapi.EndpointsEndpoint,
+		s.authenticate("GET", s.getEndpoints()))
+
+	mux.HandleFunc(fwdapi.ServiceKeysEndpoint,
+		s.authenticate("POST", s.rotateServiceKeys()))
+
+	mux.HandleFunc(fwdapi.CAEndpoint,
+		s.authenticate("GET", s.getCABundle()))
+
+	mux.HandleFunc(fwdapi.DrainEndpoint,
+		s.authenticate("POST", s.drain()))
+
+	mux.HandleFunc(fwdapi.AdvertiseRoutesEndpoint,
+		s.authenticate("POST", s.advertiseRoutes()))
+
 }
 
 // RunServer will start the HTTPS server and serve requests.
-func (s *CNCServer) RunServer(serverCert tls.Certificate) {
-	log.Printf("Running Command and Control API HTTPS listener on port %d",
-		s.cfg.GetControlListenPort())
+func (s *CNCServer) RunServer(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) {
+	addr := util.ListenAddress(s.cfg.GetControlBindAddress(), s.cfg.GetControlListenPort())
+	log.Printf("Running Command and Control API HTTPS listener on %s", addr)
 
 	certPool, err := s.authority.MakeCertPool()
 	if err != nil {
@@ -390,20 +723,22 @@ func (s *CNCServer) RunServer(serverCert tls.Certificate) {
 	}
 
 	tlsConfig := &tls.Config{
-		ClientCAs:    certPool,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		Certificates: []tls.Certificate{serverCert},
-		MinVersion:   tls.VersionTLS12,
+		ClientCAs:      certPool,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS12,
 	}
+	util.ApplyTLSSettings(tlsConfig)
+	ca.ReloadingClientCAs(tlsConfig, s.authority)
 
 	mux := http.NewServeMux()
 
 	s.routes(mux)
 
 	srv := &http.Server{
-		Addr:      fmt.Sprintf(":%d", s.cfg.GetControlListenPort()),
+		Addr:      addr,
 		TLSConfig: tlsConfig,
-		Handler:   mux,
+		Handler:   tunnel.RecoverHandler("control", mux),
 	}
 
 	log.Fatal(srv.ListenAndServeTLS("", ""))
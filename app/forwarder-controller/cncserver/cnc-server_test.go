@@ -20,20 +20,28 @@ import (
 	"bytes"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/lestrrat-go/jwx/jwa"
 	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/oklog/ulid/v2"
 	"github.com/opsmx/oes-birger/internal/ca"
 	"github.com/opsmx/oes-birger/internal/fwdapi"
 	"github.com/opsmx/oes-birger/internal/jwtutil"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type handlerTracker struct {
@@ -46,21 +54,39 @@ func (h *handlerTracker) handler() http.HandlerFunc {
 	}
 }
 
-type mockConfig struct{}
+type mockConfig struct {
+	namePattern *regexp.Regexp
+}
 
 func (*mockConfig) GetAgentAdvertisePort() uint16 { return 1234 }
 
 func (*mockConfig) GetControlListenPort() uint16 { return 4321 }
 
+func (*mockConfig) GetControlBindAddress() string { return "" }
+
 func (*mockConfig) GetControlURL() string { return "https://control.local" }
 
 func (*mockConfig) GetServiceURL() string { return "https://service.local" }
 
 func (*mockConfig) GetAgentHostname() string { return "agent.local" }
 
-type mockAuthority struct{}
+func (c *mockConfig) GetNamePattern() *regexp.Regexp { return c.namePattern }
+
+func (*mockConfig) GetMaxCertificateTTL(credentialType string) time.Duration {
+	if credentialType == CredentialTypeKubeconfig {
+		return time.Hour
+	}
+	return 0
+}
+
+type mockAuthority struct {
+	ttl    time.Duration
+	issued int
+}
 
-func (*mockAuthority) GenerateCertificate(name ca.CertificateName) (string, string, string, error) {
+func (a *mockAuthority) GenerateCertificate(name ca.CertificateName, ttl time.Duration) (string, string, string, error) {
+	a.ttl = ttl
+	a.issued++
 	return "a", "b", "c", nil
 }
 
@@ -72,6 +98,10 @@ func (*mockAuthority) MakeCertPool() (*x509.CertPool, error) {
 	return nil, nil
 }
 
+func (*mockAuthority) GetCACertBundle() ([]byte, string, error) {
+	return []byte("pem-bundle"), "aa:bb", nil
+}
+
 type mockAgents struct{}
 
 func (*mockAgents) GetStatistics() interface{} {
@@ -80,11 +110,18 @@ func (*mockAgents) GetStatistics() interface{} {
 	}{Foo: "foostring"}
 }
 
+func (*mockAgents) GetEndpointSummaries() []tunnelroute.EndpointSummary {
+	return []tunnelroute.EndpointSummary{
+		{Type: "jenkins", Name: "ci", AgentCount: 2, SessionCount: 3, Direct: true, Agents: []string{"agent1", "agent2"}},
+	}
+}
+
 type verifierFunc func(*testing.T, []byte)
 
-func requireError(matchstring string) verifierFunc {
+func requireError(code string, matchstring string) verifierFunc {
 	type errorMessage struct {
 		Error struct {
+			Code    string `json:"code,omitempty"`
 			Message string `json:"message,omitempty"`
 		} `json:"error,omitempty"`
 	}
@@ -98,6 +135,9 @@ func requireError(matchstring string) verifierFunc {
 		if msg.Error.Message == "" {
 			t.Errorf("Expected non-empty error, got %v", msg)
 		}
+		if msg.Error.Code != code {
+			t.Errorf("Expected error code '%s', got '%s'", code, msg.Error.Code)
+		}
 		if matchstring == "" {
 			return
 		}
@@ -174,13 +214,13 @@ func TestCNCServer_generateKubectlComponents(t *testing.T) {
 		{
 			"badJSON",
 			"badjson",
-			requireError("json: cannot unmarshal"),
+			requireError(fwdapi.ErrorCodeInvalidRequest, "json: cannot unmarshal"),
 			http.StatusBadRequest,
 		},
 		{
 			"missingName",
 			fwdapi.KubeConfigRequest{},
-			requireError(" is invalid"),
+			requireError(fwdapi.ErrorCodeInvalidRequest, " is invalid"),
 			http.StatusBadRequest,
 		},
 		{
@@ -250,13 +290,13 @@ func TestCNCServer_generateAgentManifestComponents(t *testing.T) {
 		{
 			"badJSON",
 			"badjson",
-			requireError("json: cannot unmarshal"),
+			requireError(fwdapi.ErrorCodeInvalidRequest, "json: cannot unmarshal"),
 			http.StatusBadRequest,
 		},
 		{
 			"missingName",
 			fwdapi.ManifestRequest{},
-			requireError("'agentName' is invalid"),
+			requireError(fwdapi.ErrorCodeInvalidRequest, "'agentName' is invalid"),
 			http.StatusBadRequest,
 		},
 		{
@@ -351,6 +391,50 @@ func MakeAWSCheckFunc() func(*testing.T, []byte) {
 	}
 }
 
+// fakeManifestSigner "signs" a manifest with its payload, so tests can
+// check what was signed.
+type fakeManifestSigner struct {
+	err error
+}
+
+func (f *fakeManifestSigner) SignManifest(payload []byte) (string, error) {
+	return string(payload), f.err
+}
+
+func TestCNCServer_generateAgentManifestComponents_signed(t *testing.T) {
+	t.Run("signed", func(t *testing.T) {
+		c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, "")
+		c.SetManifestSigner(&fakeManifestSigner{})
+
+		r := httptest.NewRequest("POST", "https://localhost/foo", strings.NewReader(`{"agentName":"agent smith"}`))
+		w := httptest.NewRecorder()
+		c.generateAgentManifestComponents().ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var response fwdapi.ManifestResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		payload, err := base64.StdEncoding.DecodeString(response.SignedManifest)
+		require.NoError(t, err)
+		assert.Equal(t, string(payload), response.Signature, "the signed bytes are sent")
+		var signed fwdapi.ManifestResponse
+		require.NoError(t, json.Unmarshal(payload, &signed))
+		assert.Equal(t, "agent smith", signed.AgentName)
+		assert.Empty(t, signed.SignedManifest)
+		assert.Empty(t, signed.Signature)
+	})
+
+	t.Run("signing fails", func(t *testing.T) {
+		c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, "")
+		c.SetManifestSigner(&fakeManifestSigner{err: fmt.Errorf("no key")})
+
+		r := httptest.NewRequest("POST", "https://localhost/foo", strings.NewReader(`{"agentName":"agent smith"}`))
+		w := httptest.NewRecorder()
+		c.generateAgentManifestComponents().ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		requireError(fwdapi.ErrorCodeCAError, "no key")(t, w.Body.Bytes())
+	})
+}
+
 func TestCNCServer_generateServiceCredentials(t *testing.T) {
 	serviceCheckFunc := MakeServiceCheckFunc()
 	awsCheckFunc := MakeAWSCheckFunc()
@@ -364,13 +448,13 @@ func TestCNCServer_generateServiceCredentials(t *testing.T) {
 		{
 			"badJSON",
 			"badjson",
-			requireError("json: cannot unmarshal"),
+			requireError(fwdapi.ErrorCodeInvalidRequest, "json: cannot unmarshal"),
 			http.StatusBadRequest,
 		},
 		{
 			"missingName",
 			fwdapi.ServiceCredentialRequest{},
-			requireError("is invalid"),
+			requireError(fwdapi.ErrorCodeInvalidRequest, "is invalid"),
 			http.StatusBadRequest,
 		},
 		{
@@ -393,6 +477,70 @@ func TestCNCServer_generateServiceCredentials(t *testing.T) {
 			awsCheckFunc,
 			http.StatusOK,
 		},
+		{
+			"scoped",
+			fwdapi.ServiceCredentialRequest{
+				AgentName: "agent smith",
+				Type:      "jenkins",
+				Name:      "service smith",
+				Scope:     &fwdapi.CredentialScope{Services: []string{"jenkins"}, Methods: []string{"GET"}},
+			},
+			func(t *testing.T, body []byte) {
+				serviceCheckFunc(t, body)
+				var response fwdapi.ServiceCredentialResponse
+				require.NoError(t, json.Unmarshal(body, &response))
+				assert.Equal(t, &fwdapi.CredentialScope{Services: []string{"jenkins"}, Methods: []string{"GET"}}, response.Scope)
+				password := response.Credential.(map[string]interface{})["password"].(string)
+				_, _, _, scope, err := jwtutil.ValidateScopedJWT(password, nil)
+				require.NoError(t, err)
+				assert.Equal(t, jwtutil.Scope{Services: []string{"jenkins"}, Methods: []string{"GET"}}, scope)
+			},
+			http.StatusOK,
+		},
+		{
+			"badScopeMethod",
+			fwdapi.ServiceCredentialRequest{
+				AgentName: "agent smith",
+				Type:      "jenkins",
+				Name:      "service smith",
+				Scope:     &fwdapi.CredentialScope{Methods: []string{"get"}},
+			},
+			requireError(fwdapi.ErrorCodeInvalidRequest, "'scope.methods' is invalid"),
+			http.StatusBadRequest,
+		},
+		{
+			"additional signing key",
+			fwdapi.ServiceCredentialRequest{
+				AgentName: "agent smith",
+				Type:      "jenkins",
+				Name:      "service smith",
+				KeyName:   "key2",
+			},
+			func(t *testing.T, body []byte) {
+				serviceCheckFunc(t, body)
+				var response fwdapi.ServiceCredentialResponse
+				require.NoError(t, json.Unmarshal(body, &response))
+				password := response.Credential.(map[string]interface{})["password"].(string)
+				msg, err := jws.ParseString(password)
+				require.NoError(t, err)
+				require.Len(t, msg.Signatures(), 1)
+				assert.Equal(t, "key2", msg.Signatures()[0].ProtectedHeaders().KeyID())
+				_, _, _, err = jwtutil.ValidateJWT(password, nil)
+				require.NoError(t, err)
+			},
+			http.StatusOK,
+		},
+		{
+			"not a signing key",
+			fwdapi.ServiceCredentialRequest{
+				AgentName: "agent smith",
+				Type:      "jenkins",
+				Name:      "service smith",
+				KeyName:   "key3",
+			},
+			requireError(fwdapi.ErrorCodeInvalidRequest, "'keyName' is not a current signing key"),
+			http.StatusBadRequest,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -408,9 +556,14 @@ func TestCNCServer_generateServiceCredentials(t *testing.T) {
 			if err != nil {
 				panic(err)
 			}
+			key2, err := jwk.New([]byte("key 2"))
+			require.NoError(t, err)
+			require.NoError(t, key2.Set(jwk.KeyIDKey, "key2"))
+			require.NoError(t, key2.Set(jwk.AlgorithmKey, jwa.HS256))
 			keyset := jwk.NewSet()
 			keyset.Add(key1)
-			if err = jwtutil.RegisterServiceauthKeyset(keyset, "key1"); err != nil {
+			keyset.Add(key2)
+			if err = jwtutil.RegisterServiceauthKeyset(keyset, "key1", "key2"); err != nil {
 				panic(err)
 			}
 			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, "")
@@ -461,13 +614,13 @@ func TestCNCServer_generateControlCredentials(t *testing.T) {
 		{
 			"badJSON",
 			"badjson",
-			requireError("json: cannot unmarshal"),
+			requireError(fwdapi.ErrorCodeInvalidRequest, "json: cannot unmarshal"),
 			http.StatusBadRequest,
 		},
 		{
 			"missingName",
 			fwdapi.ControlCredentialsRequest{},
-			requireError("'name' is invalid"),
+			requireError(fwdapi.ErrorCodeInvalidRequest, "'name' is invalid"),
 			http.StatusBadRequest,
 		},
 		{
@@ -537,3 +690,371 @@ func TestCNCServer_getStatistics(t *testing.T) {
 		}
 	})
 }
+
+func TestCNCServer_getEndpoints(t *testing.T) {
+	routes := tunnelroute.MakeRoutes()
+	jenkins := tunnelroute.Endpoint{Type: "jenkins", Name: "ci", Configured: true}
+	argo := tunnelroute.Endpoint{Type: "argocd", Name: "argo", Configured: true}
+	for _, route := range []*tunnelroute.DirectlyConnectedRoute{
+		{Name: "agent1", Session: "agent1.session1", Endpoints: []tunnelroute.Endpoint{jenkins}},
+		{Name: "agent1", Session: "agent1.session2", Endpoints: []tunnelroute.Endpoint{jenkins, argo}},
+		{Name: "agent2", Session: "agent2.session1", Endpoints: []tunnelroute.Endpoint{jenkins}},
+	} {
+		routes.Add(route)
+	}
+
+	c := MakeCNCServer(nil, nil, routes, "")
+	mux := http.NewServeMux()
+	c.routes(mux)
+	r := httptest.NewRequest("GET", "https://localhost"+fwdapi.EndpointsEndpoint, nil)
+	r.TLS.PeerCertificates = []*x509.Certificate{&goodCert}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Result().Header.Get("content-type"))
+
+	var response struct {
+		Endpoints []tunnelroute.EndpointSummary `json:"endpoints"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []tunnelroute.EndpointSummary{
+		{Type: "argocd", Name: "argo", AgentCount: 1, SessionCount: 1, Direct: true, Agents: []string{"agent1"}},
+		{Type: "jenkins", Name: "ci", AgentCount: 2, SessionCount: 3, Direct: true, Agents: []string{"agent1", "agent2"}},
+	}, response.Endpoints)
+}
+
+func TestCNCServer_getCABundle(t *testing.T) {
+	caCert, caKey, err := ca.MakeCertificateAuthority()
+	require.NoError(t, err)
+	authority, err := ca.MakeCAFromData(caCert, caKey)
+	require.NoError(t, err)
+
+	c := MakeCNCServer(&mockConfig{}, authority, nil, "")
+	r := httptest.NewRequest("GET", "https://localhost/foo", nil)
+	w := httptest.NewRecorder()
+	c.getCABundle().ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-pem-file", w.Result().Header.Get("content-type"))
+
+	block, rest := pem.Decode(w.Body.Bytes())
+	require.NotNil(t, block)
+	assert.Equal(t, "CERTIFICATE", block.Type)
+	assert.Empty(t, rest)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	assert.True(t, cert.IsCA)
+	assert.Equal(t, authority.GetCACertificate(), cert.Raw)
+	assert.Equal(t, ca.Fingerprint(cert.Raw), w.Result().Header.Get(fwdapi.CAFingerprintHeader))
+}
+
+func TestCNCServer_certificateTTL(t *testing.T) {
+	tests := []struct {
+		name           string
+		credentialType string
+		requested      string
+		want           time.Duration
+	}{
+		{"under max", CredentialTypeKubeconfig, "30m", 30 * time.Minute},
+		{"clamped to max", CredentialTypeKubeconfig, "48h", time.Hour},
+		{"not requested uses max", CredentialTypeKubeconfig, "", time.Hour},
+		{"no max", CredentialTypeManifest, "48h", 48 * time.Hour},
+		{"no max, not requested", CredentialTypeManifest, "", defaultMaxCertificateTTL},
+		{"no max, too long", CredentialTypeManifest, "100000h", defaultMaxCertificateTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, "")
+			assert.Equal(t, tt.want, c.certificateTTL(tt.credentialType, tt.requested))
+		})
+	}
+}
+
+func TestCNCServer_generateKubectlComponents_ttl(t *testing.T) {
+	caCert, caKey, err := ca.MakeCertificateAuthority()
+	require.NoError(t, err)
+	authority, err := ca.MakeCAFromData(caCert, caKey)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		ttl        string
+		want       time.Duration
+		wantStatus int
+	}{
+		{"requested", "10m", 10 * time.Minute, http.StatusOK},
+		{"clamped", "1000h", time.Hour, http.StatusOK},
+		{"invalid", "soon", 0, http.StatusBadRequest},
+		{"negative", "-1h", 0, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(&mockConfig{}, authority, nil, "")
+			c.SetAuditSink(&recordingSink{})
+
+			body, err := json.Marshal(fwdapi.KubeConfigRequest{AgentName: "agent smith", Name: "alice smith", TTL: tt.ttl})
+			require.NoError(t, err)
+			r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			start := time.Now()
+			c.generateKubectlComponents().ServeHTTP(w, r)
+			require.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var response fwdapi.KubeConfigResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			notAfter := certificateNotAfter(response.UserCertificate)
+			require.NotNil(t, notAfter)
+			assert.WithinDuration(t, start.Add(tt.want), *notAfter, 5*time.Second)
+			assert.Equal(t, ulid.Timestamp(*notAfter), response.NotAfter)
+		})
+	}
+}
+
+func TestCNCServer_namePattern(t *testing.T) {
+	strict := regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+	tests := []struct {
+		name       string
+		pattern    *regexp.Regexp
+		handler    func(*CNCServer) http.HandlerFunc
+		request    interface{}
+		wantStatus int
+		wantField  string
+	}{
+		{
+			"permissive by default",
+			nil,
+			(*CNCServer).generateKubectlComponents,
+			fwdapi.KubeConfigRequest{AgentName: "agent smith", Name: "alice smith"},
+			http.StatusOK,
+			"",
+		},
+		{
+			"kubeconfig accepted",
+			strict,
+			(*CNCServer).generateKubectlComponents,
+			fwdapi.KubeConfigRequest{AgentName: "agent-smith", Name: "alice-1"},
+			http.StatusOK,
+			"",
+		},
+		{
+			"kubeconfig agentName rejected",
+			strict,
+			(*CNCServer).generateKubectlComponents,
+			fwdapi.KubeConfigRequest{AgentName: "agent smith", Name: "alice"},
+			http.StatusBadRequest,
+			"agentName",
+		},
+		{
+			"kubeconfig name rejected",
+			strict,
+			(*CNCServer).generateKubectlComponents,
+			fwdapi.KubeConfigRequest{AgentName: "agent", Name: "-alice"},
+			http.StatusBadRequest,
+			"name",
+		},
+		{
+			"manifest accepted",
+			strict,
+			(*CNCServer).generateAgentManifestComponents,
+			fwdapi.ManifestRequest{AgentName: "agent-smith"},
+			http.StatusOK,
+			"",
+		},
+		{
+			"manifest agentName rejected",
+			strict,
+			(*CNCServer).generateAgentManifestComponents,
+			fwdapi.ManifestRequest{AgentName: "Agent.Smith"},
+			http.StatusBadRequest,
+			"agentName",
+		},
+		{
+			"service agentName rejected",
+			strict,
+			(*CNCServer).generateServiceCredentials,
+			fwdapi.ServiceCredentialRequest{AgentName: "agent/smith", Type: "jenkins", Name: "jenkins"},
+			http.StatusBadRequest,
+			"agentName",
+		},
+		{
+			"service name rejected",
+			strict,
+			(*CNCServer).generateServiceCredentials,
+			fwdapi.ServiceCredentialRequest{AgentName: "agent", Type: "jenkins", Name: "jenkins "},
+			http.StatusBadRequest,
+			"name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(&mockConfig{namePattern: tt.pattern}, &mockAuthority{}, nil, "")
+			c.SetAuditSink(&recordingSink{})
+
+			body, err := json.Marshal(tt.request)
+			require.NoError(t, err)
+			r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			tt.handler(c).ServeHTTP(w, r)
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			if tt.wantStatus == http.StatusOK {
+				return
+			}
+
+			var response fwdapi.ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, fwdapi.ErrorCodeInvalidRequest, response.Error.Code)
+			assert.Equal(t, tt.wantField, response.Error.Field)
+			assert.Contains(t, response.Error.Message, "does not match the required pattern")
+		})
+	}
+}
+
+func TestCNCServer_previewKubectlComponents(t *testing.T) {
+	strict := regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+	tests := []struct {
+		name       string
+		pattern    *regexp.Regexp
+		request    interface{}
+		wantStatus int
+	}{
+		{"badJSON", nil, "badjson", http.StatusBadRequest},
+		{"missingName", nil, fwdapi.KubeConfigRequest{}, http.StatusBadRequest},
+		{"invalid ttl", nil, fwdapi.KubeConfigRequest{AgentName: "agent", Name: "alice", TTL: "soon"}, http.StatusBadRequest},
+		{"name rejected", strict, fwdapi.KubeConfigRequest{AgentName: "agent", Name: "-alice"}, http.StatusBadRequest},
+		{"working", nil, fwdapi.KubeConfigRequest{AgentName: "agent smith", Name: "alice smith", TTL: "10m"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(tt.request)
+			require.NoError(t, err)
+			serve := func(h func(*CNCServer) http.HandlerFunc, authority *mockAuthority) *httptest.ResponseRecorder {
+				c := MakeCNCServer(&mockConfig{namePattern: tt.pattern}, authority, nil, "")
+				c.SetAuditSink(&recordingSink{})
+				r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+				w := httptest.NewRecorder()
+				h(c).ServeHTTP(w, r)
+				return w
+			}
+
+			authority := &mockAuthority{}
+			start := time.Now()
+			w := serve((*CNCServer).previewKubectlComponents, authority)
+			assert.Equal(t, 0, authority.issued, "preview must not issue a certificate")
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			assert.Equal(t, "application/json", w.Result().Header.Get("content-type"))
+
+			// Validation must match the real endpoint.
+			generated := serve((*CNCServer).generateKubectlComponents, &mockAuthority{})
+			require.Equal(t, generated.Code, w.Code)
+			if tt.wantStatus != http.StatusOK {
+				assert.Equal(t, generated.Body.String(), w.Body.String())
+				return
+			}
+
+			var response fwdapi.KubeConfigResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, "agent smith", response.AgentName)
+			assert.Equal(t, "alice smith", response.Name)
+			assert.Equal(t, "https://service.local", response.ServerURL)
+			assert.Equal(t, "base64-cacert", response.CACert)
+			assert.Empty(t, response.UserCertificate)
+			assert.Empty(t, response.UserKey)
+			assert.InDelta(t, ulid.Timestamp(start.Add(10*time.Minute)), response.NotAfter, 5000)
+		})
+	}
+}
+
+func TestCNCServer_generateCredentialsBatch(t *testing.T) {
+	key1, err := jwk.New([]byte("key 1"))
+	require.NoError(t, err)
+	require.NoError(t, key1.Set(jwk.KeyIDKey, "key1"))
+	require.NoError(t, key1.Set(jwk.AlgorithmKey, jwa.HS256))
+	keyset := jwk.NewSet()
+	keyset.Add(key1)
+	require.NoError(t, jwtutil.RegisterServiceauthKeyset(keyset, "key1"))
+
+	serve := func(t *testing.T, authority *mockAuthority, sink *recordingSink, request interface{}) *httptest.ResponseRecorder {
+		c := MakeCNCServer(&mockConfig{}, authority, nil, "")
+		c.SetAuditSink(sink)
+		body, err := json.Marshal(request)
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		c.generateCredentialsBatch().ServeHTTP(w, r)
+		assert.Equal(t, "application/json", w.Result().Header.Get("content-type"))
+		return w
+	}
+
+	t.Run("mixed batch", func(t *testing.T) {
+		authority := &mockAuthority{}
+		sink := &recordingSink{}
+		w := serve(t, authority, sink, fwdapi.BatchCredentialRequest{
+			Manifests: []fwdapi.ManifestRequest{
+				{AgentName: "agent1"},
+				{},
+				{AgentName: "agent3", TTL: "1h"},
+			},
+			Services: []fwdapi.ServiceCredentialRequest{
+				{AgentName: "agent1", Type: "Not Valid", Name: "jenkins"},
+				{AgentName: "agent1", Type: "jenkins", Name: "jenkins"},
+			},
+		})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response fwdapi.BatchCredentialResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		require.Len(t, response.Manifests, 3)
+		require.Len(t, response.Services, 2)
+
+		require.NotNil(t, response.Manifests[0].Manifest)
+		assert.Nil(t, response.Manifests[0].Error)
+		assert.Equal(t, "agent1", response.Manifests[0].Manifest.AgentName)
+		assert.Equal(t, "b", response.Manifests[0].Manifest.AgentCertificate)
+
+		assert.Nil(t, response.Manifests[1].Manifest)
+		require.NotNil(t, response.Manifests[1].Error)
+		assert.Equal(t, fwdapi.ErrorCodeInvalidRequest, response.Manifests[1].Error.Code)
+		assert.Equal(t, "agentName", response.Manifests[1].Error.Field)
+
+		require.NotNil(t, response.Manifests[2].Manifest)
+		assert.Equal(t, "agent3", response.Manifests[2].Manifest.AgentName)
+
+		assert.Nil(t, response.Services[0].Credential)
+		require.NotNil(t, response.Services[0].Error)
+		assert.Equal(t, "type", response.Services[0].Error.Field)
+
+		require.NotNil(t, response.Services[1].Credential)
+		assert.Nil(t, response.Services[1].Error)
+		assert.Equal(t, "jenkins", response.Services[1].Credential.Name)
+		assert.Equal(t, "basic", response.Services[1].Credential.CredentialType)
+
+		assert.Equal(t, 2, authority.issued)
+		assert.Len(t, sink.events, 3, "only issued credentials are audited")
+	})
+
+	tests := []struct {
+		name    string
+		request interface{}
+		message string
+	}{
+		{"badJSON", "badjson", "json: cannot unmarshal"},
+		{"empty", fwdapi.BatchCredentialRequest{}, "are both empty"},
+		{"too large", fwdapi.BatchCredentialRequest{
+			Manifests: make([]fwdapi.ManifestRequest, fwdapi.MaxBatchSize),
+			Services:  make([]fwdapi.ServiceCredentialRequest, 1),
+		}, "more than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authority := &mockAuthority{}
+			w := serve(t, authority, &recordingSink{}, tt.request)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			requireError(fwdapi.ErrorCodeInvalidRequest, tt.message)(t, w.Body.Bytes())
+			assert.Equal(t, 0, authority.issued)
+		})
+	}
+}
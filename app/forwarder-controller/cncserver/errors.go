@@ -0,0 +1,83 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+)
+
+// failRequest writes a fwdapi.ErrorResponse with the status and code.  If the
+// error is a validation error, the invalid field is included.
+func failRequest(w http.ResponseWriter, err error, status int, code string) {
+	ret := fwdapi.ErrorResponse{
+		Error: errorDetail(err, code),
+	}
+	body, err := json.Marshal(ret)
+	if err != nil {
+		body = []byte(`{"error":{"code":"` + fwdapi.ErrorCodeInternalError + `","message":"Unknown Error"}}`)
+	}
+	w.WriteHeader(status)
+	n, err := w.Write(body)
+	if err != nil {
+		log.Printf("failRequest: error while writing: %v", err)
+		return
+	}
+	if n != len(body) {
+		log.Printf("failRequest: failed to write entire message: %d of %d written", n, len(body))
+	}
+}
+
+// errorDetail describes err with the code.  If the error is a validation
+// error, the invalid field is included.
+func errorDetail(err error, code string) fwdapi.ErrorDetail {
+	detail := fwdapi.ErrorDetail{
+		Code:    code,
+		Message: fmt.Sprintf("Unable to process request: %v", err),
+	}
+	var validationError *fwdapi.ValidationError
+	if errors.As(err, &validationError) {
+		detail.Field = validationError.Field
+	}
+	return detail
+}
+
+// requestError is why a credential could not be issued, with the status
+// and code to fail the request with.
+type requestError struct {
+	err    error
+	status int
+	code   string
+}
+
+func invalidRequest(err error) *requestError {
+	return &requestError{err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest}
+}
+
+func (e *requestError) fail(w http.ResponseWriter) {
+	failRequest(w, e.err, e.status, e.code)
+}
+
+func (e *requestError) detail() *fwdapi.ErrorDetail {
+	detail := errorDetail(e.err, e.code)
+	return &detail
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/opsmx/oes-birger/internal/ca"
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+	"github.com/opsmx/oes-birger/internal/jwtutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingAuthority struct {
+	mockAuthority
+}
+
+func (*failingAuthority) GenerateCertificate(name ca.CertificateName, ttl time.Duration) (string, string, string, error) {
+	return "", "", "", fmt.Errorf("signing failed")
+}
+
+func (*failingAuthority) GetCACert() (string, error) {
+	return "", fmt.Errorf("no CA certificate")
+}
+
+func TestCNCServer_errorCodes(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		cert       *x509.Certificate
+		authority  cncCertificateAuthority
+		handler    func(*CNCServer) http.HandlerFunc
+		request    interface{}
+		wantStatus int
+		wantCode   string
+		wantField  string
+	}{
+		{
+			"method not allowed",
+			"GET", &goodCert, &mockAuthority{},
+			(*CNCServer).generateAgentManifestComponents,
+			fwdapi.ManifestRequest{AgentName: "agent"},
+			http.StatusMethodNotAllowed, fwdapi.ErrorCodeMethodNotAllowed, "",
+		},
+		{
+			"not a control certificate",
+			"POST", &wrongTypeCert, &mockAuthority{},
+			(*CNCServer).generateAgentManifestComponents,
+			fwdapi.ManifestRequest{AgentName: "agent"},
+			http.StatusForbidden, fwdapi.ErrorCodeForbidden, "",
+		},
+		{
+			"bad json",
+			"POST", &goodCert, &mockAuthority{},
+			(*CNCServer).generateAgentManifestComponents,
+			"badjson",
+			http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest, "",
+		},
+		{
+			"missing field",
+			"POST", &goodCert, &mockAuthority{},
+			(*CNCServer).generateKubectlComponents,
+			fwdapi.KubeConfigRequest{AgentName: "agent"},
+			http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest, "name",
+		},
+		{
+			"invalid ttl",
+			"POST", &goodCert, &mockAuthority{},
+			(*CNCServer).generateControlCredentials,
+			fwdapi.ControlCredentialsRequest{Name: "control", TTL: "soon"},
+			http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest, "ttl",
+		},
+		{
+			"invalid service type",
+			"POST", &goodCert, &mockAuthority{},
+			(*CNCServer).generateServiceCredentials,
+			fwdapi.ServiceCredentialRequest{AgentName: "agent", Name: "jenkins", Type: "Not Valid"},
+			http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest, "type",
+		},
+		{
+			"certificate generation fails",
+			"POST", &goodCert, &failingAuthority{},
+			(*CNCServer).generateAgentManifestComponents,
+			fwdapi.ManifestRequest{AgentName: "agent"},
+			http.StatusBadRequest, fwdapi.ErrorCodeCAError, "",
+		},
+		{
+			"token generation fails",
+			"POST", &goodCert, &mockAuthority{},
+			(*CNCServer).generateServiceCredentials,
+			fwdapi.ServiceCredentialRequest{AgentName: "agent", Name: "jenkins", Type: "jenkins"},
+			http.StatusBadRequest, fwdapi.ErrorCodeTokenError, "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// An empty keyset makes signing service tokens fail.
+			require.NoError(t, jwtutil.RegisterServiceauthKeyset(jwk.NewSet(), "missing"))
+
+			c := MakeCNCServer(&mockConfig{}, tt.authority, nil, "")
+			c.SetAuditSink(&recordingSink{})
+			body, err := json.Marshal(tt.request)
+			require.NoError(t, err)
+			r := httptest.NewRequest(tt.method, "https://localhost/foo", bytes.NewReader(body))
+			r.TLS.PeerCertificates = []*x509.Certificate{tt.cert}
+			w := httptest.NewRecorder()
+			c.authenticate("POST", tt.handler(c))(w, r)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			var response fwdapi.ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, tt.wantCode, response.Error.Code)
+			assert.Equal(t, tt.wantField, response.Error.Field)
+			assert.Contains(t, response.Error.Message, "Unable to process request: ")
+		})
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeYAML = "application/yaml"
+)
+
+// yamlContentTypes are the media types accepted as asking for YAML.
+var yamlContentTypes = map[string]bool{
+	contentTypeYAML:      true,
+	"application/x-yaml": true,
+	"text/yaml":          true,
+}
+
+// responseContentType picks JSON or YAML from the request's Accept
+// header, preferring the higher quality and then the earlier type.
+// Anything else, including no Accept header, is compact JSON.
+func responseContentType(r *http.Request) string {
+	best := contentTypeJSON
+	bestQuality := -1.0
+	for _, accept := range r.Header.Values("accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+			contentType := ""
+			switch {
+			case mediaType == contentTypeJSON:
+				contentType = contentTypeJSON
+			case yamlContentTypes[mediaType]:
+				contentType = contentTypeYAML
+			default:
+				continue
+			}
+			quality := 1.0
+			if q, ok := params["q"]; ok {
+				quality, err = strconv.ParseFloat(q, 64)
+				if err != nil {
+					continue
+				}
+			}
+			if quality > 0 && quality > bestQuality {
+				best = contentType
+				bestQuality = quality
+			}
+		}
+	}
+	return best
+}
+
+// marshalResponse renders the response in the format the request asked
+// for.  JSON is indented if the request has `?pretty=true`.
+func marshalResponse(r *http.Request, response interface{}) (string, []byte, error) {
+	contentType := responseContentType(r)
+	if contentType == contentTypeYAML {
+		body, err := jsonToYAML(response)
+		return contentType, body, err
+	}
+	if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); pretty {
+		body, err := json.MarshalIndent(response, "", "  ")
+		return contentType, body, err
+	}
+	body, err := json.Marshal(response)
+	return contentType, body, err
+}
+
+// jsonToYAML renders the response as YAML with the same field names and
+// order as its JSON.  The response types only have JSON tags, so this
+// goes through JSON rather than marshalling them as YAML directly.
+func jsonToYAML(response interface{}) ([]byte, error) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(body, &node); err != nil {
+		return nil, err
+	}
+	clearStyle(&node)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// clearStyle drops the flow and quoting styles the nodes were parsed
+// with from JSON, so they are written as block YAML.
+func clearStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		clearStyle(child)
+	}
+}
+
+// writeResponse writes the response in the format the request asked for.
+func writeResponse(w http.ResponseWriter, r *http.Request, name string, response interface{}) {
+	contentType, body, err := marshalResponse(r, response)
+	if err != nil {
+		w.Header().Set("content-type", contentTypeJSON)
+		failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInternalError)
+		return
+	}
+	w.Header().Set("content-type", contentType)
+	n, err := w.Write(body)
+	if err != nil {
+		log.Printf("%s: error while writing: %v", name, err)
+		return
+	}
+	if n != len(body) {
+		log.Printf("%s: failed to write entire message: %d of %d written", name, n, len(body))
+		return
+	}
+}
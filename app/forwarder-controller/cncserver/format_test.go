@@ -0,0 +1,130 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestResponseContentType(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept []string
+		want   string
+	}{
+		{"none", nil, contentTypeJSON},
+		{"json", []string{"application/json"}, contentTypeJSON},
+		{"yaml", []string{"application/yaml"}, contentTypeYAML},
+		{"x-yaml", []string{"application/x-yaml"}, contentTypeYAML},
+		{"text yaml", []string{"text/yaml; charset=utf-8"}, contentTypeYAML},
+		{"anything", []string{"*/*"}, contentTypeJSON},
+		{"unsupported", []string{"text/html"}, contentTypeJSON},
+		{"first preferred", []string{"application/yaml, application/json"}, contentTypeYAML},
+		{"quality", []string{"application/yaml;q=0.5, application/json;q=0.9"}, contentTypeJSON},
+		{"quality yaml", []string{"application/json;q=0.5, application/yaml"}, contentTypeYAML},
+		{"refused", []string{"application/yaml;q=0"}, contentTypeJSON},
+		{"multiple headers", []string{"text/html", "application/yaml"}, contentTypeYAML},
+		{"malformed", []string{"application/yaml;;=", "application/json"}, contentTypeJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://localhost/foo", nil)
+			for _, accept := range tt.accept {
+				r.Header.Add("accept", accept)
+			}
+			assert.Equal(t, tt.want, responseContentType(r))
+		})
+	}
+}
+
+func TestCNCServer_getStatistics_formats(t *testing.T) {
+	tests := []struct {
+		name            string
+		accept          string
+		query           string
+		wantContentType string
+		wantIndented    bool
+	}{
+		{"default", "", "", contentTypeJSON, false},
+		{"json", "application/json", "", contentTypeJSON, false},
+		{"pretty", "", "?pretty=true", contentTypeJSON, true},
+		{"not pretty", "", "?pretty=false", contentTypeJSON, false},
+		{"bad pretty", "", "?pretty=maybe", contentTypeJSON, false},
+		{"yaml", "application/yaml", "", contentTypeYAML, false},
+		{"yaml ignores pretty", "application/yaml", "?pretty=true", contentTypeYAML, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(nil, nil, &mockAgents{}, "1.2.3")
+
+			r := httptest.NewRequest("GET", "https://localhost/foo"+tt.query, nil)
+			if tt.accept != "" {
+				r.Header.Set("accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			c.getStatistics().ServeHTTP(w, r)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, tt.wantContentType, w.Result().Header.Get("content-type"))
+
+			var response map[string]interface{}
+			if tt.wantContentType == contentTypeYAML {
+				require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &response))
+				assert.True(t, strings.HasPrefix(w.Body.String(), "serverTime: "), w.Body.String())
+				assert.Contains(t, w.Body.String(), "connectedAgents:\n  foo: foostring\n")
+			} else {
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+				assert.Equal(t, tt.wantIndented, strings.Contains(w.Body.String(), "\n  \"version\": "), w.Body.String())
+			}
+			assert.Equal(t, "1.2.3", response["version"])
+			assert.Equal(t, map[string]interface{}{"foo": "foostring"}, response["connectedAgents"])
+		})
+	}
+}
+
+func TestCNCServer_getEndpoints_yaml(t *testing.T) {
+	c := MakeCNCServer(nil, nil, &mockAgents{}, "")
+
+	r := httptest.NewRequest("GET", "https://localhost"+fwdapi.EndpointsEndpoint, nil)
+	r.Header.Set("accept", "application/yaml")
+	w := httptest.NewRecorder()
+	c.getEndpoints().ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, contentTypeYAML, w.Result().Header.Get("content-type"))
+
+	var response struct {
+		Endpoints []struct {
+			Type       string   `yaml:"type"`
+			Name       string   `yaml:"name"`
+			AgentCount int      `yaml:"agentCount"`
+			Agents     []string `yaml:"agents"`
+		} `yaml:"endpoints"`
+	}
+	require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Endpoints, 1)
+	assert.Equal(t, "jenkins", response.Endpoints[0].Type)
+	assert.Equal(t, 2, response.Endpoints[0].AgentCount)
+	assert.Equal(t, []string{"agent1", "agent2"}, response.Endpoints[0].Agents)
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+)
+
+// DefaultDrainTimeout is how long a drain waits for requests in progress
+// to finish, if the request does not say.
+const DefaultDrainTimeout = 5 * time.Minute
+
+// Handoff hands the controller's agents to a peer controller, and holds
+// requests for agents a draining peer is handing to this one.
+type Handoff interface {
+	Start(peer tunnelroute.Peer, timeout time.Duration, advertiser tunnelroute.RouteAdvertiser) error
+	State() (tunnelroute.HandoffState, tunnelroute.Peer)
+	Expect(agents []string, until time.Time)
+}
+
+// SetHandoff enables the endpoints which drain this controller to a peer,
+// and receive agents from a draining peer.  The advertiser, which may be
+// nil, tells the peer which agents are coming.
+func (s *CNCServer) SetHandoff(handoff Handoff, advertiser tunnelroute.RouteAdvertiser) {
+	s.handoff = handoff
+	s.advertiser = advertiser
+}
+
+// handoffState returns the state of the handoff, or "" if there is none.
+func (s *CNCServer) handoffState() string {
+	if s.handoff == nil {
+		return ""
+	}
+	state, _ := s.handoff.State()
+	return string(state)
+}
+
+func (s *CNCServer) drain() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+
+		if s.handoff == nil {
+			err := fmt.Errorf("handoff is not enabled")
+			failRequest(w, err, http.StatusInternalServerError, fwdapi.ErrorCodeInternalError)
+			return
+		}
+
+		var req fwdapi.DrainRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
+			return
+		}
+
+		err = req.Validate()
+		if err != nil {
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
+			return
+		}
+
+		timeout := DefaultDrainTimeout
+		if req.Timeout != "" {
+			timeout, _ = time.ParseDuration(req.Timeout) // already validated
+		}
+		peer := tunnelroute.Peer{
+			ServiceHostname: req.ServiceHostname,
+			AgentHostname:   req.AgentHostname,
+			ControlURL:      req.ControlURL,
+		}
+		var advertiser tunnelroute.RouteAdvertiser
+		if req.ControlURL != "" {
+			advertiser = s.advertiser
+		}
+		if err := s.handoff.Start(peer, timeout, advertiser); err != nil {
+			failRequest(w, err, http.StatusConflict, fwdapi.ErrorCodeHandoffError)
+			return
+		}
+		log.Printf("drain: %s started handoff to %s", requesterFrom(r), req.AgentHostname)
+
+		ret := fwdapi.DrainResponse{
+			State: s.handoffState(),
+		}
+		json, err := json.Marshal(ret)
+		if err != nil {
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInternalError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		n, err := w.Write(json)
+		if err != nil {
+			log.Printf("drain: error while writing: %v", err)
+			return
+		}
+		if n != len(json) {
+			log.Printf("drain: failed to write entire message: %d of %d written", n, len(json))
+			return
+		}
+	}
+}
+
+func (s *CNCServer) advertiseRoutes() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+
+		if s.handoff == nil {
+			err := fmt.Errorf("handoff is not enabled")
+			failRequest(w, err, http.StatusInternalServerError, fwdapi.ErrorCodeInternalError)
+			return
+		}
+
+		var req fwdapi.AdvertiseRoutesRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
+			return
+		}
+
+		err = req.Validate()
+		if err != nil {
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
+			return
+		}
+
+		s.handoff.Expect(req.Agents, time.UnixMilli(int64(req.Until)))
+		log.Printf("advertiseRoutes: %s is handing over %d agents", requesterFrom(r), len(req.Agents))
+
+		ret := fwdapi.AdvertiseRoutesResponse{
+			Agents: len(req.Agents),
+		}
+		json, err := json.Marshal(ret)
+		if err != nil {
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInternalError)
+			return
+		}
+		n, err := w.Write(json)
+		if err != nil {
+			log.Printf("advertiseRoutes: error while writing: %v", err)
+			return
+		}
+		if n != len(json) {
+			log.Printf("advertiseRoutes: failed to write entire message: %d of %d written", n, len(json))
+			return
+		}
+	}
+}
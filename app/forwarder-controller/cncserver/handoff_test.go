@@ -0,0 +1,238 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockHandoff struct {
+	err        error
+	state      tunnelroute.HandoffState
+	peer       tunnelroute.Peer
+	timeout    time.Duration
+	advertiser tunnelroute.RouteAdvertiser
+	agents     []string
+	until      time.Time
+}
+
+func (m *mockHandoff) Start(peer tunnelroute.Peer, timeout time.Duration, advertiser tunnelroute.RouteAdvertiser) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.state = tunnelroute.HandoffDraining
+	m.peer = peer
+	m.timeout = timeout
+	m.advertiser = advertiser
+	return nil
+}
+
+func (m *mockHandoff) State() (tunnelroute.HandoffState, tunnelroute.Peer) {
+	return m.state, m.peer
+}
+
+func (m *mockHandoff) Expect(agents []string, until time.Time) {
+	m.agents = agents
+	m.until = until
+}
+
+type mockAdvertiser struct{}
+
+func (m *mockAdvertiser) AdvertiseRoutes(peer tunnelroute.Peer, agents []string, until time.Time) error {
+	return nil
+}
+
+func TestCNCServer_drain(t *testing.T) {
+	tests := []struct {
+		name           string
+		handoff        *mockHandoff
+		request        interface{}
+		wantStatus     int
+		wantCode       string
+		wantTimeout    time.Duration
+		wantAdvertiser bool
+	}{
+		{
+			"not enabled",
+			nil,
+			fwdapi.DrainRequest{ServiceHostname: "peer.local", AgentHostname: "peer.local:9001"},
+			http.StatusInternalServerError,
+			fwdapi.ErrorCodeInternalError,
+			0,
+			false,
+		},
+		{
+			"badJSON",
+			&mockHandoff{},
+			"badjson",
+			http.StatusBadRequest,
+			fwdapi.ErrorCodeInvalidRequest,
+			0,
+			false,
+		},
+		{
+			"missing agentHostname port",
+			&mockHandoff{},
+			fwdapi.DrainRequest{ServiceHostname: "peer.local", AgentHostname: "peer.local"},
+			http.StatusBadRequest,
+			fwdapi.ErrorCodeInvalidRequest,
+			0,
+			false,
+		},
+		{
+			"already draining",
+			&mockHandoff{err: fmt.Errorf("handoff is already draining")},
+			fwdapi.DrainRequest{ServiceHostname: "peer.local", AgentHostname: "peer.local:9001"},
+			http.StatusConflict,
+			fwdapi.ErrorCodeHandoffError,
+			0,
+			false,
+		},
+		{
+			"working",
+			&mockHandoff{},
+			fwdapi.DrainRequest{ServiceHostname: "peer.local", AgentHostname: "peer.local:9001"},
+			http.StatusAccepted,
+			"",
+			DefaultDrainTimeout,
+			false,
+		},
+		{
+			"working with peer control URL",
+			&mockHandoff{},
+			fwdapi.DrainRequest{
+				ServiceHostname: "peer.local",
+				AgentHostname:   "peer.local:9001",
+				ControlURL:      "https://peer.local:9003",
+				Timeout:         "30s",
+			},
+			http.StatusAccepted,
+			"",
+			30 * time.Second,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, "")
+			if tt.handoff != nil {
+				c.SetHandoff(tt.handoff, &mockAdvertiser{})
+			}
+
+			body, err := json.Marshal(tt.request)
+			require.NoError(t, err)
+			r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			c.drain().ServeHTTP(w, r)
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			assert.Equal(t, "application/json", w.Result().Header.Get("content-type"))
+
+			if tt.wantStatus != http.StatusAccepted {
+				var response fwdapi.ErrorResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+				assert.Equal(t, tt.wantCode, response.Error.Code)
+				return
+			}
+
+			var response fwdapi.DrainResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, string(tunnelroute.HandoffDraining), response.State)
+			assert.Equal(t, "peer.local:9001", tt.handoff.peer.AgentHostname)
+			assert.Equal(t, tt.wantTimeout, tt.handoff.timeout)
+			assert.Equal(t, tt.wantAdvertiser, tt.handoff.advertiser != nil)
+		})
+	}
+}
+
+func TestCNCServer_advertiseRoutes(t *testing.T) {
+	tests := []struct {
+		name       string
+		handoff    *mockHandoff
+		request    interface{}
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			"not enabled",
+			nil,
+			fwdapi.AdvertiseRoutesRequest{Agents: []string{"agent1"}, Until: 1700000000000},
+			http.StatusInternalServerError,
+			fwdapi.ErrorCodeInternalError,
+		},
+		{
+			"badJSON",
+			&mockHandoff{},
+			"badjson",
+			http.StatusBadRequest,
+			fwdapi.ErrorCodeInvalidRequest,
+		},
+		{
+			"missing until",
+			&mockHandoff{},
+			fwdapi.AdvertiseRoutesRequest{Agents: []string{"agent1"}},
+			http.StatusBadRequest,
+			fwdapi.ErrorCodeInvalidRequest,
+		},
+		{
+			"working",
+			&mockHandoff{},
+			fwdapi.AdvertiseRoutesRequest{Agents: []string{"agent1", "agent2"}, Until: 1700000000000},
+			http.StatusOK,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, "")
+			if tt.handoff != nil {
+				c.SetHandoff(tt.handoff, nil)
+			}
+
+			body, err := json.Marshal(tt.request)
+			require.NoError(t, err)
+			r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			c.advertiseRoutes().ServeHTTP(w, r)
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			assert.Equal(t, "application/json", w.Result().Header.Get("content-type"))
+
+			if tt.wantStatus != http.StatusOK {
+				var response fwdapi.ErrorResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+				assert.Equal(t, tt.wantCode, response.Error.Code)
+				return
+			}
+
+			var response fwdapi.AdvertiseRoutesResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, 2, response.Agents)
+			assert.Equal(t, []string{"agent1", "agent2"}, tt.handoff.agents)
+			assert.Equal(t, time.UnixMilli(1700000000000), tt.handoff.until)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+)
+
+// Redundant controllers run with one active, and the rest on standby.  Only
+// the active controller issues credentials, so a standby can be promoted
+// (usually by leader election) without two controllers minting at once.
+const (
+	RoleActive  = "active"
+	RoleStandby = "standby"
+)
+
+// SetStandby puts the server on standby, where it refuses to issue
+// credentials, or makes it active again.  Servers start active.
+func (s *CNCServer) SetStandby(standby bool) {
+	if s.standby.Swap(standby) != standby {
+		log.Printf("Control API is now %s", s.Role())
+	}
+}
+
+// Role returns RoleActive or RoleStandby.
+func (s *CNCServer) Role() string {
+	if s.standby.Load() {
+		return RoleStandby
+	}
+	return RoleActive
+}
+
+// requireActive rejects requests while the server is on standby.
+func (s *CNCServer) requireActive(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.standby.Load() {
+			err := fmt.Errorf("controller is on standby, and does not issue credentials")
+			failRequest(w, err, http.StatusServiceUnavailable, fwdapi.ErrorCodeStandby)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serveControlRequest(t *testing.T, c *CNCServer, method string, path string, request interface{}) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	c.routes(mux)
+	body, err := json.Marshal(request)
+	require.NoError(t, err)
+	r := httptest.NewRequest(method, "https://localhost"+path, bytes.NewReader(body))
+	r.TLS.PeerCertificates = []*x509.Certificate{&goodCert}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestCNCServer_standby(t *testing.T) {
+	// Service credentials also need a keyset, so only the certificate
+	// requests are checked once active.
+	credentialRequests := []struct {
+		path        string
+		request     interface{}
+		checkActive bool
+	}{
+		{fwdapi.KubeconfigEndpoint, fwdapi.KubeConfigRequest{AgentName: "agent", Name: "user"}, true},
+		{fwdapi.ManifestEndpoint, fwdapi.ManifestRequest{AgentName: "agent"}, true},
+		{fwdapi.ServiceEndpoint, fwdapi.ServiceCredentialRequest{AgentName: "agent", Name: "jenkins", Type: "jenkins"}, false},
+		{fwdapi.ControlEndpoint, fwdapi.ControlCredentialsRequest{Name: "control"}, true},
+		{fwdapi.BatchEndpoint, fwdapi.BatchCredentialRequest{Manifests: []fwdapi.ManifestRequest{{AgentName: "agent"}}}, true},
+	}
+
+	c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, &mockAgents{}, "")
+	sink := &recordingSink{}
+	c.SetAuditSink(sink)
+	assert.Equal(t, RoleActive, c.Role())
+
+	c.SetStandby(true)
+	assert.Equal(t, RoleStandby, c.Role())
+	for _, tt := range credentialRequests {
+		t.Run("standby "+tt.path, func(t *testing.T) {
+			w := serveControlRequest(t, c, "POST", tt.path, tt.request)
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+			var response fwdapi.ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, fwdapi.ErrorCodeStandby, response.Error.Code)
+			assert.Contains(t, response.Error.Message, "standby")
+		})
+	}
+	assert.Empty(t, sink.events, "nothing may be issued on standby")
+
+	// Other endpoints still work, and report the role.
+	w := serveControlRequest(t, c, "POST", fwdapi.KubeconfigPreviewEndpoint, fwdapi.KubeConfigRequest{AgentName: "agent", Name: "user"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveControlRequest(t, c, "GET", fwdapi.StatisticsEndpoint, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var stats fwdapi.StatisticsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, RoleStandby, stats.Role)
+
+	c.SetStandby(false)
+	assert.Equal(t, RoleActive, c.Role())
+	for _, tt := range credentialRequests {
+		if !tt.checkActive {
+			continue
+		}
+		t.Run("active "+tt.path, func(t *testing.T) {
+			w := serveControlRequest(t, c, "POST", tt.path, tt.request)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+	assert.Len(t, sink.events, 4)
+}
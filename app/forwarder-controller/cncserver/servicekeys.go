@@ -0,0 +1,77 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+)
+
+func (s *CNCServer) rotateServiceKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+
+		if s.keyRotator == nil {
+			err := fmt.Errorf("service key rotation is not enabled")
+			failRequest(w, err, http.StatusInternalServerError, fwdapi.ErrorCodeInternalError)
+			return
+		}
+
+		var req fwdapi.ServiceKeysRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
+			return
+		}
+
+		err = req.Validate()
+		if err != nil {
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInvalidRequest)
+			return
+		}
+
+		names, err := s.keyRotator.RotateServiceKeys(req.CurrentKeyName, req.RetiredKeyNames)
+		if err != nil {
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeKeysetError)
+			return
+		}
+		log.Printf("rotateServiceKeys: %s set current key %s, retired %v", requesterFrom(r), req.CurrentKeyName, req.RetiredKeyNames)
+
+		ret := fwdapi.ServiceKeysResponse{
+			CurrentKeyName: req.CurrentKeyName,
+			KeyNames:       names,
+		}
+		json, err := json.Marshal(ret)
+		if err != nil {
+			failRequest(w, err, http.StatusBadRequest, fwdapi.ErrorCodeInternalError)
+			return
+		}
+		n, err := w.Write(json)
+		if err != nil {
+			log.Printf("rotateServiceKeys: error while writing: %v", err)
+			return
+		}
+		if n != len(json) {
+			log.Printf("rotateServiceKeys: failed to write entire message: %d of %d written", n, len(json))
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockKeyRotator struct {
+	err            error
+	currentKeyName string
+	retired        []string
+}
+
+func (m *mockKeyRotator) RotateServiceKeys(currentKeyName string, retired []string) ([]string, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.currentKeyName = currentKeyName
+	m.retired = retired
+	return []string{"key2", currentKeyName}, nil
+}
+
+func TestCNCServer_rotateServiceKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		rotator    *mockKeyRotator
+		request    interface{}
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			"not enabled",
+			nil,
+			fwdapi.ServiceKeysRequest{CurrentKeyName: "key3"},
+			http.StatusInternalServerError,
+			fwdapi.ErrorCodeInternalError,
+		},
+		{
+			"badJSON",
+			&mockKeyRotator{},
+			"badjson",
+			http.StatusBadRequest,
+			fwdapi.ErrorCodeInvalidRequest,
+		},
+		{
+			"missing currentKeyName",
+			&mockKeyRotator{},
+			fwdapi.ServiceKeysRequest{},
+			http.StatusBadRequest,
+			fwdapi.ErrorCodeInvalidRequest,
+		},
+		{
+			"retiring currentKeyName",
+			&mockKeyRotator{},
+			fwdapi.ServiceKeysRequest{CurrentKeyName: "key3", RetiredKeyNames: []string{"key3"}},
+			http.StatusBadRequest,
+			fwdapi.ErrorCodeInvalidRequest,
+		},
+		{
+			"rotation fails",
+			&mockKeyRotator{err: fmt.Errorf("current key 'key3' is not in the loaded keys")},
+			fwdapi.ServiceKeysRequest{CurrentKeyName: "key3"},
+			http.StatusBadRequest,
+			fwdapi.ErrorCodeKeysetError,
+		},
+		{
+			"working",
+			&mockKeyRotator{},
+			fwdapi.ServiceKeysRequest{CurrentKeyName: "key3", RetiredKeyNames: []string{"key1"}},
+			http.StatusOK,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, "")
+			if tt.rotator != nil {
+				c.SetServiceKeyRotator(tt.rotator)
+			}
+
+			body, err := json.Marshal(tt.request)
+			require.NoError(t, err)
+			r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			c.rotateServiceKeys().ServeHTTP(w, r)
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			assert.Equal(t, "application/json", w.Result().Header.Get("content-type"))
+
+			if tt.wantStatus != http.StatusOK {
+				var response fwdapi.ErrorResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+				assert.Equal(t, tt.wantCode, response.Error.Code)
+				return
+			}
+
+			var response fwdapi.ServiceKeysResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, "key3", response.CurrentKeyName)
+			assert.Equal(t, []string{"key2", "key3"}, response.KeyNames)
+			assert.Equal(t, "key3", tt.rotator.currentKeyName)
+			assert.Equal(t, []string{"key1"}, tt.rotator.retired)
+		})
+	}
+}
@@ -20,11 +20,22 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"regexp"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 
+	"github.com/opsmx/oes-birger/app/forwarder-controller/cncserver"
 	"github.com/opsmx/oes-birger/internal/ca"
+	"github.com/opsmx/oes-birger/internal/jwtutil"
+	"github.com/opsmx/oes-birger/internal/kafka"
+	"github.com/opsmx/oes-birger/internal/metricsauth"
+	"github.com/opsmx/oes-birger/internal/ocspstaple"
 	"github.com/opsmx/oes-birger/internal/serviceconfig"
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	"github.com/opsmx/oes-birger/internal/util"
 )
 
 // ControllerConfig holds all the configuration for the controller.  The
@@ -34,33 +45,135 @@ type ControllerConfig struct {
 	Agents                   map[string]*agentConfig     `yaml:"agents,omitempty"`
 	ServiceAuth              serviceAuthConfig           `yaml:"serviceAuth,omitempty"`
 	Webhook                  string                      `yaml:"webhook,omitempty"`
+	Kafka                    *kafka.Config               `yaml:"kafka,omitempty"`
+	CredentialAudit          string                      `yaml:"credentialAudit,omitempty"`
+	MaxCertificateTTL        maxCertificateTTLConfig     `yaml:"maxCertificateTTL,omitempty"`
+	NamePattern              string                      `yaml:"namePattern,omitempty"`
+	IdleRouteTimeout         time.Duration               `yaml:"idleRouteTimeout,omitempty"`
+	ReconnectGrace           time.Duration               `yaml:"reconnectGrace,omitempty"`
+	MaxRequestLifetime       time.Duration               `yaml:"maxRequestLifetime,omitempty"`
 	ServerNames              []string                    `yaml:"serverNames,omitempty"`
 	CAConfig                 ca.Config                   `yaml:"caConfig,omitempty"`
 	PrometheusListenPort     uint16                      `yaml:"prometheusListenPort"`
+	PrometheusBindAddress    string                      `yaml:"prometheusBindAddress,omitempty"`
+	MetricsAuth              metricsauth.Config          `yaml:"metricsAuth,omitempty"`
 	ServiceHostname          *string                     `yaml:"serviceHostname"`
 	ServiceListenPort        uint16                      `yaml:"serviceListenPort"`
+	ServiceBindAddress       string                      `yaml:"serviceBindAddress,omitempty"`
 	ControlHostname          *string                     `yaml:"controlHostname"`
 	ControlListenPort        uint16                      `yaml:"controlListenPort"`
+	ControlBindAddress       string                      `yaml:"controlBindAddress,omitempty"`
 	AgentHostname            *string                     `yaml:"agentHostname"`
 	AgentListenPort          uint16                      `yaml:"agentListenPort"`
+	AgentBindAddress         string                      `yaml:"agentBindAddress,omitempty"`
 	AgentAdvertisePort       uint16                      `yaml:"agentAdvertisePort"`
 	ServiceConfig            serviceconfig.ServiceConfig `yaml:"services,omitempty"`
 	InsecureAgentConnections bool                        `yanl:"insecureAgentConnections,omitempty"`
+
+	// AgentConnectionLimits bounds connections to the agent gRPC server.
+	AgentConnectionLimits agentConnectionLimits `yaml:"agentConnectionLimits,omitempty"`
+
+	// TunnelMessageSize limits the size of messages sent to and received
+	// from agents.
+	TunnelMessageSize tunnel.MessageSizeConfig `yaml:"tunnelMessageSize,omitempty"`
+
+	// AgentCertificateClockSkew is how far outside its validity period an
+	// agent's certificate is still accepted, allowing for clock drift.
+	// Zero uses ca.DefaultClockSkew.
+	AgentCertificateClockSkew time.Duration `yaml:"agentCertificateClockSkew,omitempty"`
+
+	// CompressTunnel accepts agents which compress the tunnel, and
+	// compresses what is sent to them.
+	CompressTunnel bool `yaml:"compressTunnel,omitempty"`
+
+	// SignManifests signs agent manifests, for agents which require a
+	// signed manifest.  They are signed with the PEM private key in
+	// ManifestSigningKeyFile if it is set, or else with the CA's key.
+	SignManifests          bool   `yaml:"signManifests,omitempty"`
+	ManifestSigningKeyFile string `yaml:"manifestSigningKeyFile,omitempty"`
+
+	// ControllerIdentity, if set, is named in the controller's server
+	// certificate, so agents may accept only some identities.
+	ControllerIdentity string `yaml:"controllerIdentity,omitempty"`
+
+	// EndpointOverrides bounds the endpoint settings agents may override.
+	EndpointOverrides tunnelroute.EndpointOverrideLimits `yaml:"endpointOverrides,omitempty"`
+
+	// EndpointTypes are endpoint types agents may advertise, in addition
+	// to the built in ones.
+	EndpointTypes tunnelroute.EndpointTypes `yaml:"endpointTypes,omitempty"`
+
+	// EndpointAliases are other names requests may use for endpoints
+	// agents advertise.
+	EndpointAliases tunnelroute.EndpointAliases `yaml:"endpointAliases,omitempty"`
+
+	// Standby starts the control API refusing to issue credentials, and
+	// LeaderElection promotes it to active while it holds a lease.
+	Standby        bool                 `yaml:"standby,omitempty"`
+	LeaderElection leaderElectionConfig `yaml:"leaderElection,omitempty"`
+
+	// TLSSettings sets minTLSVersion and cipherSuites for every listener
+	// and upstream service.
+	util.TLSSettings `yaml:",inline"`
+
+	// OCSPStapling configures stapling OCSP responses for the server
+	// certificate on the service and control listeners.
+	OCSPStapling ocspstaple.Config `yaml:"ocspStapling,omitempty"`
+
+	namePattern *regexp.Regexp
 }
 
 type agentConfig struct {
 	Name string `yaml:"name,omitempty"`
 }
 
+// maxCertificateTTLConfig holds the longest lifetime allowed for each type
+// of certificate issued by the control API.  Zero allows up to a year, the
+// authority's default.
+type maxCertificateTTLConfig struct {
+	Kubeconfig time.Duration `yaml:"kubeconfig,omitempty"`
+	Manifest   time.Duration `yaml:"manifest,omitempty"`
+	Control    time.Duration `yaml:"control,omitempty"`
+}
+
 type serviceAuthConfig struct {
 	CurrentKeyName        string `yaml:"currentKeyName,omitempty"`
 	HeaderMutationKeyName string `yaml:"headerMutationKeyName,omitempty"`
 	SecretsPath           string `yaml:"secretsPath,omitempty"`
+	// AdditionalKeyNames are also current during a rotation, such as keys
+	// other controllers sharing these keys still sign with.  They must be
+	// loaded, and cannot be retired.
+	AdditionalKeyNames []string `yaml:"additionalKeyNames,omitempty"`
+	// RetiredKeyNames are never loaded, even if their files are still in
+	// SecretsPath, so keys retired through the control API stay retired
+	// after a restart.
+	RetiredKeyNames []string `yaml:"retiredKeyNames,omitempty"`
+	// ExternalJWKS, if set, also accepts service credentials signed by
+	// an external issuer.  Credentials are still only signed locally.
+	ExternalJWKS *jwtutil.JWKSConfig `yaml:"externalJWKS,omitempty"`
+	// ReplayProtection, if set, refuses a service credential presented
+	// again for a non-idempotent request within the window.
+	ReplayProtection *jwtutil.ReplayConfig `yaml:"replayProtection,omitempty"`
+}
+
+// ConfigError lists every problem found in a configuration, so they can
+// all be fixed at once.
+type ConfigError struct {
+	Problems []error
+}
+
+func (e *ConfigError) Error() string {
+	lines := []string{fmt.Sprintf("configuration has %d problem(s):", len(e.Problems))}
+	for _, problem := range e.Problems {
+		lines = append(lines, "  "+problem.Error())
+	}
+	return strings.Join(lines, "\n")
 }
 
 // LoadConfig will load YAML configuration from the provided filename,
 // and then apply environment variables to override some subset of
-// available options.
+// available options.  If the configuration is invalid, a *ConfigError
+// lists all the problems found.
 func LoadConfig(f io.Reader) (*ControllerConfig, error) {
 	buf, err := io.ReadAll(f)
 	if err != nil {
@@ -73,43 +186,195 @@ func LoadConfig(f io.Reader) (*ControllerConfig, error) {
 		return nil, err
 	}
 
-	if config.AgentListenPort == 0 {
-		config.AgentListenPort = 9001
-	}
-	if config.AgentAdvertisePort == 0 {
-		config.AgentAdvertisePort = config.AgentListenPort
-	}
-	if config.AgentHostname == nil {
-		return nil, fmt.Errorf("agentHostname not set")
+	if problems := config.validate(); len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems}
 	}
 
 	if config.ServiceListenPort == 0 {
 		config.ServiceListenPort = 9002
 	}
-	if config.ServiceHostname == nil {
-		return nil, fmt.Errorf("serviceHostname not set")
-	}
-
 	if config.ControlListenPort == 0 {
 		config.ControlListenPort = 9003
 	}
-	if config.ControlHostname == nil {
-		return nil, fmt.Errorf("controlHostname not set")
-	}
-
 	if config.PrometheusListenPort == 0 {
 		config.PrometheusListenPort = 9102
 	}
+	if config.AgentListenPort == 0 {
+		config.AgentListenPort = 9001
+	}
+	if config.AgentAdvertisePort == 0 {
+		config.AgentAdvertisePort = config.AgentListenPort
+	}
+
+	if config.CredentialAudit == "" {
+		config.CredentialAudit = "stdout"
+	}
 
 	if len(config.ServiceAuth.SecretsPath) == 0 {
 		config.ServiceAuth.SecretsPath = "/app/secrets/serviceAuth"
 	}
 
+	if config.LeaderElection.enabled() {
+		config.LeaderElection.applyDefaults()
+	}
+
 	config.addAllHostnames()
 
 	return config, nil
 }
 
+// validate checks the configuration as loaded, before defaults are applied,
+// and returns every problem found.
+func (c *ControllerConfig) validate() []error {
+	problems := []error{}
+
+	if c.AgentHostname == nil {
+		problems = append(problems, fmt.Errorf("agentHostname not set"))
+	}
+	if c.ServiceHostname == nil {
+		problems = append(problems, fmt.Errorf("serviceHostname not set"))
+	}
+	if c.ControlHostname == nil {
+		problems = append(problems, fmt.Errorf("controlHostname not set"))
+	}
+
+	// Zero ports take their defaults, so are compared as the default.
+	ports := []struct {
+		name string
+		port uint16
+	}{
+		{"agentListenPort", withDefault(c.AgentListenPort, 9001)},
+		{"serviceListenPort", withDefault(c.ServiceListenPort, 9002)},
+		{"controlListenPort", withDefault(c.ControlListenPort, 9003)},
+		{"prometheusListenPort", withDefault(c.PrometheusListenPort, 9102)},
+	}
+	for i, a := range ports {
+		for _, b := range ports[:i] {
+			if a.port == b.port {
+				problems = append(problems, fmt.Errorf("%s and %s are both %d", b.name, a.name, a.port))
+			}
+		}
+	}
+
+	switch c.CredentialAudit {
+	case "", "stdout":
+	case "webhook":
+		if len(c.Webhook) == 0 {
+			problems = append(problems, fmt.Errorf("credentialAudit is 'webhook' but no webhook is set"))
+		}
+	case "kafka":
+		if c.Kafka == nil {
+			problems = append(problems, fmt.Errorf("credentialAudit is 'kafka' but kafka is not configured"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("credentialAudit must be 'stdout', 'webhook', or 'kafka', not '%s'", c.CredentialAudit))
+	}
+
+	if c.Kafka != nil {
+		for _, err := range c.Kafka.Validate() {
+			problems = append(problems, fmt.Errorf("kafka: %v", err))
+		}
+	}
+
+	if c.NamePattern != "" {
+		var err error
+		c.namePattern, err = regexp.Compile(c.NamePattern)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("namePattern is invalid: %v", err))
+		}
+	}
+
+	if c.IdleRouteTimeout < 0 {
+		problems = append(problems, fmt.Errorf("idleRouteTimeout must not be negative"))
+	}
+
+	if c.ReconnectGrace < 0 {
+		problems = append(problems, fmt.Errorf("reconnectGrace must not be negative"))
+	}
+
+	if c.MaxRequestLifetime < 0 {
+		problems = append(problems, fmt.Errorf("maxRequestLifetime must not be negative"))
+	}
+
+	for _, err := range c.EndpointOverrides.Validate() {
+		problems = append(problems, fmt.Errorf("endpointOverrides.%v", err))
+	}
+
+	for _, err := range c.EndpointAliases.Validate() {
+		problems = append(problems, fmt.Errorf("endpointAliases%v", err))
+	}
+
+	for _, err := range c.LeaderElection.validate() {
+		problems = append(problems, fmt.Errorf("leaderElection: %v", err))
+	}
+
+	for _, err := range c.AgentConnectionLimits.validate() {
+		problems = append(problems, fmt.Errorf("agentConnectionLimits.%v", err))
+	}
+
+	for _, err := range c.TunnelMessageSize.Validate() {
+		problems = append(problems, fmt.Errorf("tunnelMessageSize.%v", err))
+	}
+
+	if c.AgentCertificateClockSkew < 0 {
+		problems = append(problems, fmt.Errorf("agentCertificateClockSkew must not be negative"))
+	}
+
+	if c.ManifestSigningKeyFile != "" && !c.SignManifests {
+		problems = append(problems, fmt.Errorf("manifestSigningKeyFile is set but signManifests is not"))
+	}
+
+	if c.CAConfig.SecretReloadInterval < 0 {
+		problems = append(problems, fmt.Errorf("caConfig.secretReloadInterval must not be negative"))
+	}
+
+	problems = append(problems, c.TLSSettings.Validate()...)
+
+	if c.ServiceAuth.ExternalJWKS != nil {
+		for _, err := range c.ServiceAuth.ExternalJWKS.Validate() {
+			problems = append(problems, fmt.Errorf("serviceAuth.externalJWKS: %v", err))
+		}
+	}
+	if c.ServiceAuth.ReplayProtection != nil {
+		for _, err := range c.ServiceAuth.ReplayProtection.Validate() {
+			problems = append(problems, fmt.Errorf("serviceAuth.replayProtection: %v", err))
+		}
+	}
+
+	for _, err := range c.OCSPStapling.Validate() {
+		problems = append(problems, fmt.Errorf("ocspStapling: %v", err))
+	}
+
+	ttls := []struct {
+		name string
+		ttl  time.Duration
+	}{
+		{"kubeconfig", c.MaxCertificateTTL.Kubeconfig},
+		{"manifest", c.MaxCertificateTTL.Manifest},
+		{"control", c.MaxCertificateTTL.Control},
+	}
+	for _, ttl := range ttls {
+		if ttl.ttl < 0 {
+			problems = append(problems, fmt.Errorf("maxCertificateTTL.%s must not be negative", ttl.name))
+		}
+	}
+
+	if err := c.MetricsAuth.Load(); err != nil {
+		problems = append(problems, err)
+	}
+
+	problems = append(problems, c.ServiceConfig.Validate()...)
+
+	return problems
+}
+
+func withDefault(port uint16, defaultPort uint16) uint16 {
+	if port == 0 {
+		return defaultPort
+	}
+	return port
+}
+
 func (c *ControllerConfig) hasServerName(target string) bool {
 	for _, a := range c.ServerNames {
 		if a == target {
@@ -158,6 +423,31 @@ func (c *ControllerConfig) GetControlListenPort() uint16 {
 	return c.ControlListenPort
 }
 
+// GetMaxCertificateTTL returns the longest lifetime allowed for certificates
+// of the credential type.
+func (c *ControllerConfig) GetMaxCertificateTTL(credentialType string) time.Duration {
+	switch credentialType {
+	case cncserver.CredentialTypeKubeconfig:
+		return c.MaxCertificateTTL.Kubeconfig
+	case cncserver.CredentialTypeManifest:
+		return c.MaxCertificateTTL.Manifest
+	case cncserver.CredentialTypeControl:
+		return c.MaxCertificateTTL.Control
+	}
+	return 0
+}
+
+// GetNamePattern returns the pattern agent and service names must match
+// before credentials are issued, or nil if any name is allowed.
+func (c *ControllerConfig) GetNamePattern() *regexp.Regexp {
+	return c.namePattern
+}
+
+// GetControlBindAddress returns the address the CNC server should listen on.
+func (c *ControllerConfig) GetControlBindAddress() string {
+	return c.ControlBindAddress
+}
+
 // Dump will display MOST of the controller's configuration.
 func (c *ControllerConfig) Dump() {
 	log.Println("ControllerConfig:")
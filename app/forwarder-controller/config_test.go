@@ -0,0 +1,372 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const validConfig = `
+agentHostname: agent.example.com
+serviceHostname: service.example.com
+controlHostname: control.example.com
+`
+
+func TestLoadConfig_valid(t *testing.T) {
+	config, err := LoadConfig(strings.NewReader(validConfig))
+	require.NoError(t, err)
+	assert.Equal(t, uint16(9001), config.AgentListenPort)
+	assert.Equal(t, uint16(9001), config.AgentAdvertisePort)
+	assert.Equal(t, uint16(9002), config.ServiceListenPort)
+	assert.Equal(t, uint16(9003), config.ControlListenPort)
+	assert.Equal(t, uint16(9102), config.PrometheusListenPort)
+	assert.Equal(t, "stdout", config.CredentialAudit)
+}
+
+func TestLoadConfig_problems(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		wantProblems []string
+	}{
+		{
+			"missing hostnames",
+			`{}`,
+			[]string{
+				"agentHostname not set",
+				"serviceHostname not set",
+				"controlHostname not set",
+			},
+		},
+		{
+			"endpoint override bounds",
+			validConfig + `
+endpointOverrides:
+  maxConcurrency:
+    default: 100
+    min: 1
+    max: 50
+  weight:
+    min: -1
+`,
+			[]string{
+				"endpointOverrides.maxConcurrency: default 100 is outside min and max",
+				"endpointOverrides.weight: values must not be negative",
+			},
+		},
+		{
+			"leader election timings",
+			validConfig + `
+leaderElection:
+  leaseName: controller
+  leaseDuration: 10s
+  retryPeriod: 10s
+`,
+			[]string{
+				"leaderElection: leaseDuration must be greater than renewDeadline",
+				"leaderElection: renewDeadline must be greater than retryPeriod",
+			},
+		},
+		{
+			"tls settings",
+			validConfig + `
+minTLSVersion: "1.1"
+cipherSuites:
+  - TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+  - TLS_RSA_WITH_RC4_128_SHA
+  - TLS_AES_128_GCM_SHA256
+`,
+			[]string{
+				"minTLSVersion must be 1.2 or 1.3, not '1.1'",
+				"cipherSuites: 'TLS_RSA_WITH_RC4_128_SHA' is not a known secure cipher suite",
+				"cipherSuites: 'TLS_AES_128_GCM_SHA256' is a TLS 1.3 cipher suite",
+			},
+		},
+		{
+			"external jwks",
+			validConfig + `
+serviceAuth:
+  externalJWKS:
+    url: issuer.example.com/jwks.json
+    minRefreshInterval: -1m
+`,
+			[]string{
+				"serviceAuth.externalJWKS: url 'issuer.example.com/jwks.json' must be an http or https URL",
+				"serviceAuth.externalJWKS: issuer not set",
+				"serviceAuth.externalJWKS: minRefreshInterval must not be negative",
+			},
+		},
+		{
+			"replay protection",
+			validConfig + `
+serviceAuth:
+  replayProtection:
+    window: -1m
+    maxEntries: -1
+`,
+			[]string{
+				"serviceAuth.replayProtection: window must not be negative",
+				"serviceAuth.replayProtection: maxEntries must not be negative",
+			},
+		},
+		{
+			"kafka settings",
+			validConfig + `
+credentialAudit: kafka
+kafka:
+  brokers: [""]
+  batchSize: -1
+  sasl:
+    mechanism: GSSAPI
+`,
+			[]string{
+				"kafka: brokers must not be empty",
+				"kafka: topic not set",
+				"kafka: bufferSize, batchSize, and batchTimeout must not be negative",
+				"kafka: sasl.mechanism must be PLAIN, SCRAM-SHA-256, or SCRAM-SHA-512, not 'GSSAPI'",
+				"kafka: sasl.username and sasl.passwordFile are required",
+			},
+		},
+		{
+			"kafka audit without kafka",
+			validConfig + `
+credentialAudit: kafka
+`,
+			[]string{
+				"credentialAudit is 'kafka' but kafka is not configured",
+			},
+		},
+		{
+			"ocsp stapling",
+			validConfig + `
+ocspStapling:
+  responderURL: ocsp.example.com
+  refreshInterval: -1m
+`,
+			[]string{
+				"ocspStapling: responderURL 'ocsp.example.com' must be an http or https URL",
+				"ocspStapling: refreshInterval must not be negative",
+			},
+		},
+		{
+			"incoming service nextProtos",
+			validConfig + `
+services:
+  incomingServices:
+    - name: jenkins
+      port: 8001
+      hostnames: [jenkins.example.com]
+      nextProtos: [h2, http/1.1]
+    - name: argo
+      port: 8001
+      hostnames: [argo.example.com]
+      nextProtos: [http/1.1]
+    - name: spinnaker
+      port: 8002
+      nextProtos: [h2, h2]
+    - name: plain
+      port: 8003
+      useHTTP: true
+      destination: agent
+      serviceType: jenkins
+      destinationService: ci
+      nextProtos: [h2]
+`,
+			[]string{
+				"incomingServices argo: nextProtos must match jenkins, which also uses port 8001",
+				"incomingServices spinnaker: nextProtos must be unique and not empty",
+				"incomingServices plain: nextProtos cannot be used with useHTTP",
+			},
+		},
+		{
+			"shared incoming service ports",
+			validConfig + `
+services:
+  incomingServices:
+    - name: jenkins
+      port: 8001
+      hostnames: [jenkins.example.com]
+    - name: argo
+      port: 8001
+      hostnames: [argo.example.com, JENKINS.example.com]
+    - name: default
+      port: 8001
+    - name: spinnaker
+      port: 8001
+      useHTTP: true
+      destination: agent
+      serviceType: spinnaker
+      destinationService: gate
+      hostnames: ["spinnaker.example.com:8001"]
+`,
+			[]string{
+				"incomingServices argo: hostname 'JENKINS.example.com' on port 8001 is also used by jenkins",
+				"incomingServices spinnaker: useHTTP must match jenkins, which also uses port 8001",
+				"incomingServices spinnaker: hostname 'spinnaker.example.com:8001' must be a host name without a port",
+			},
+		},
+		{
+			"outgoing service name patterns",
+			validConfig + `
+services:
+  outgoingServices:
+    - name: jenkins-*
+      type: jenkins
+    - name: "jenkins-[a-"
+      type: jenkins
+    - name: k8s
+      type: kubernetes
+      namespaces:
+        - name: "team-[a"
+          namespaces: [a]
+`,
+			[]string{
+				"outgoingServices[1]: invalid endpoint name pattern 'jenkins-[a-'",
+				"outgoingServices[2]: namespaces: invalid endpoint name pattern 'team-[a'",
+			},
+		},
+		{
+			"agent connection limits",
+			validConfig + `
+agentConnectionLimits:
+  maxConnections: -1
+  maxConcurrentStreams: 10
+  keepaliveMinTime: -1s
+  maxEndpoints: -1
+`,
+			[]string{
+				"agentConnectionLimits.maxConnections must not be negative",
+				"agentConnectionLimits.keepaliveMinTime must not be negative",
+				"agentConnectionLimits.maxEndpoints must not be negative",
+			},
+		},
+		{
+			"endpoint aliases",
+			validConfig + `
+endpointAliases:
+  - type: jenkins
+    alias: old-jenkins
+  - type: jenkins
+    alias: ci
+    name: jenkins1
+  - type: jenkins
+    alias: ci
+    name: jenkins2
+`,
+			[]string{
+				"endpointAliases[0]: type, alias, and name are required",
+				"endpointAliases[2]: alias jenkins/ci is defined more than once",
+			},
+		},
+		{
+			"tunnel message size",
+			validConfig + `
+tunnelMessageSize:
+  maxRecvMsgSize: -1
+  maxSendMsgSize: 4096
+`,
+			[]string{
+				"tunnelMessageSize.maxRecvMsgSize must not be negative",
+				"tunnelMessageSize.maxSendMsgSize must be at least 1114112 bytes",
+			},
+		},
+		{
+			"negative agent certificate clock skew",
+			validConfig + `
+agentCertificateClockSkew: -1m
+`,
+			[]string{"agentCertificateClockSkew must not be negative"},
+		},
+		{
+			"manifest signing key without signing",
+			validConfig + `
+manifestSigningKeyFile: /app/secrets/manifest.key
+`,
+			[]string{"manifestSigningKeyFile is set but signManifests is not"},
+		},
+		{
+			"negative CA secret reload interval",
+			validConfig + `
+caConfig:
+  caSecretName: forwarder-ca
+  secretReloadInterval: -1m
+`,
+			[]string{"caConfig.secretReloadInterval must not be negative"},
+		},
+		{
+			"many problems",
+			`
+agentHostname: agent.example.com
+controlListenPort: 9102
+credentialAudit: syslog
+namePattern: "[a-z"
+idleRouteTimeout: -1s
+reconnectGrace: -1s
+maxRequestLifetime: -1s
+metricsAuth:
+  type: password
+services:
+  incomingServices:
+    - name: jenkins
+      port: 8001
+      useHTTP: true
+    - name: other
+      port: 8001
+  outgoingServices:
+    - name: jenkins
+      type: jenkins
+      config:
+        credentials:
+          type: password
+    - type: aws
+`,
+			[]string{
+				"serviceHostname not set",
+				"controlHostname not set",
+				"controlListenPort and prometheusListenPort are both 9102",
+				"credentialAudit must be 'stdout', 'webhook', or 'kafka', not 'syslog'",
+				"namePattern is invalid",
+				"idleRouteTimeout must not be negative",
+				"reconnectGrace must not be negative",
+				"maxRequestLifetime must not be negative",
+				"metrics auth: unknown type 'password'",
+				"incomingServices jenkins: destination is required with useHTTP",
+				"incomingServices jenkins: serviceType is required with useHTTP",
+				"incomingServices jenkins: destinationService is required with useHTTP",
+				"incomingServices other: port 8001 is also used by jenkins",
+				"outgoingServices[0]: credentials type 'password' must be one of none, basic, bearer, or token",
+				"outgoingServices[1]: name is required",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(strings.NewReader(tt.config))
+			var configError *ConfigError
+			require.True(t, errors.As(err, &configError), "got error %v", err)
+			require.Len(t, configError.Problems, len(tt.wantProblems), "%v", configError)
+			for i, want := range tt.wantProblems {
+				assert.Contains(t, configError.Problems[i].Error(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/opsmx/oes-birger/internal/kafka"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	"github.com/opsmx/oes-birger/internal/webhook"
+)
+
+// eventSender takes events to deliver, such as an agent connecting.  The
+// webhook Runner and the Kafka Sink are both eventSenders.
+type eventSender interface {
+	Send(msg interface{})
+}
+
+// eventSenders sends each event to all of them.
+type eventSenders []eventSender
+
+func (s eventSenders) Send(msg interface{}) {
+	for _, sender := range s {
+		sender.Send(msg)
+	}
+}
+
+// eventSinks are the configured destinations for events.
+type eventSinks struct {
+	webhook *webhook.Runner
+	kafka   *kafka.Sink
+}
+
+// startEventSinks starts the webhook and Kafka sinks, whichever are
+// configured.  The Kafka sink publishes until ctx is done.
+func startEventSinks(ctx context.Context, c *ControllerConfig, newProducer func(kafka.Config) (kafka.Producer, error)) (*eventSinks, error) {
+	sinks := &eventSinks{}
+	if c.Kafka != nil {
+		producer, err := newProducer(*c.Kafka)
+		if err != nil {
+			return nil, fmt.Errorf("kafka: %v", err)
+		}
+		sinks.kafka = kafka.NewSink(*c.Kafka, producer)
+		go sinks.kafka.Run(ctx)
+	}
+	if len(c.Webhook) > 0 {
+		sinks.webhook = webhook.NewRunner(c.Webhook)
+		go sinks.webhook.Run()
+	}
+	return sinks, nil
+}
+
+// agentEvents returns where agent events go, which is every configured
+// sink, or nil if there are none.
+func (s *eventSinks) agentEvents() eventSender {
+	senders := eventSenders{}
+	if s.webhook != nil {
+		senders = append(senders, s.webhook)
+	}
+	if s.kafka != nil {
+		senders = append(senders, s.kafka)
+	}
+	if len(senders) == 0 {
+		return nil
+	}
+	return senders
+}
+
+// auditEvents returns where credential audit events go, for the
+// credentialAudit setting, or nil if they are written to stdout.
+func (s *eventSinks) auditEvents(credentialAudit string) eventSender {
+	switch {
+	case credentialAudit == "webhook" && s.webhook != nil:
+		return s.webhook
+	case credentialAudit == "kafka" && s.kafka != nil:
+		return s.kafka
+	}
+	return nil
+}
+
+const (
+	agentEventConnected    = "connected"
+	agentEventDisconnected = "disconnected"
+)
+
+// agentEvent is sent to the webhook, and to Kafka, when an agent connects
+// or disconnects.
+// The agent's statistics are inlined, so a connection event carries the
+// same fields it always has, along with the event.
+type agentEvent struct {
+	Event  string                       `json:"event"`
+	Reason tunnelroute.DisconnectReason `json:"reason,omitempty"`
+	*tunnelroute.BaseStatistics
+}
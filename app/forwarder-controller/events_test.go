@@ -0,0 +1,192 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/app/forwarder-controller/cncserver"
+	"github.com/opsmx/oes-birger/internal/kafka"
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSender records the events it is sent.
+type recordingSender struct {
+	sync.Mutex
+	events []*agentEvent
+}
+
+func (s *recordingSender) Send(msg interface{}) {
+	s.Lock()
+	defer s.Unlock()
+	s.events = append(s.events, msg.(*agentEvent))
+}
+
+func useRecordingSender(t *testing.T) *recordingSender {
+	sender := &recordingSender{}
+	previous := hook
+	hook = sender
+	t.Cleanup(func() { hook = previous })
+	return sender
+}
+
+func TestEventTunnel_sendsConnectAndDisconnect(t *testing.T) {
+	sender := useRecordingSender(t)
+	stream := &helloStream{received: []*tunnel.MessageWrapper{{
+		Event: &tunnel.MessageWrapper_Hello{Hello: &tunnel.Hello{
+			Endpoints: []*tunnel.EndpointHealth{
+				{Type: "jenkins", Name: "ci", Configured: true},
+			},
+			ClientCertificate: agentCertificate(t, "events-agent"),
+		}},
+	}}}
+	server := &agentTunnelServer{insecure: true}
+
+	require.NoError(t, server.EventTunnel(stream))
+
+	require.Len(t, sender.events, 2)
+	connected, disconnected := sender.events[0], sender.events[1]
+	assert.Equal(t, agentEventConnected, connected.Event)
+	assert.Equal(t, "events-agent", connected.Name)
+	require.Len(t, connected.Endpoints, 1)
+	assert.Equal(t, "ci", connected.Endpoints[0].Name)
+
+	assert.Equal(t, agentEventDisconnected, disconnected.Event)
+	assert.Equal(t, tunnelroute.DisconnectClean, disconnected.Reason)
+	assert.Equal(t, "events-agent", disconnected.Name)
+	assert.Equal(t, connected.Session, disconnected.Session)
+}
+
+func TestEventTunnel_noEventsWithoutHello(t *testing.T) {
+	sender := useRecordingSender(t)
+	stream := &helloStream{received: []*tunnel.MessageWrapper{{
+		Event: &tunnel.MessageWrapper_Hello{Hello: &tunnel.Hello{
+			Endpoints: []*tunnel.EndpointHealth{
+				{Type: "jenkins", Name: "ci1", Configured: true},
+				{Type: "jenkins", Name: "ci2", Configured: true},
+			},
+			ClientCertificate: agentCertificate(t, "rejected-agent"),
+		}},
+	}}}
+	server := &agentTunnelServer{insecure: true, limits: agentConnectionLimits{MaxEndpoints: 1}}
+
+	require.Error(t, server.EventTunnel(stream))
+
+	assert.Empty(t, sender.events, "an agent rejected at hello never connected")
+}
+
+// recordingProducer records the messages it is given, and closes done
+// when the sink closes it.
+type recordingProducer struct {
+	sync.Mutex
+	topic    string
+	messages []kafka.Message
+	done     chan struct{}
+}
+
+func (p *recordingProducer) Produce(ctx context.Context, topic string, messages []kafka.Message) error {
+	p.Lock()
+	defer p.Unlock()
+	p.topic = topic
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+func (p *recordingProducer) Close() error {
+	close(p.done)
+	return nil
+}
+
+func TestStartEventSinks_kafka(t *testing.T) {
+	producer := &recordingProducer{done: make(chan struct{})}
+	c := &ControllerConfig{
+		CredentialAudit: "kafka",
+		Kafka:           &kafka.Config{Brokers: []string{"kafka:9092"}, Topic: "events"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sinks, err := startEventSinks(ctx, c, func(kafka.Config) (kafka.Producer, error) {
+		return producer, nil
+	})
+	require.NoError(t, err)
+
+	events := sinks.agentEvents()
+	require.NotNil(t, events)
+	events.Send(&agentEvent{
+		Event:          agentEventConnected,
+		BaseStatistics: &tunnelroute.BaseStatistics{Name: "agent1", Session: "session1"},
+	})
+
+	audit := sinks.auditEvents(c.CredentialAudit)
+	require.NotNil(t, audit)
+	cncserver.NewWebhookAuditSink(audit).Audit(cncserver.AuditEvent{Event: "issued", AgentName: "agent2"})
+
+	cancel()
+	select {
+	case <-producer.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sink did not close the producer")
+	}
+
+	producer.Lock()
+	defer producer.Unlock()
+	assert.Equal(t, "events", producer.topic)
+	require.Len(t, producer.messages, 2)
+	assert.Equal(t, "agent1", string(producer.messages[0].Key))
+	assert.Contains(t, string(producer.messages[0].Value), `"event":"connected"`)
+	assert.Contains(t, string(producer.messages[0].Value), `"session":"session1"`)
+	assert.Equal(t, "agent2", string(producer.messages[1].Key))
+	assert.Contains(t, string(producer.messages[1].Value), `"event":"issued"`)
+}
+
+func TestStartEventSinks_selection(t *testing.T) {
+	newProducer := func(kafka.Config) (kafka.Producer, error) {
+		return &recordingProducer{done: make(chan struct{})}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sinks, err := startEventSinks(ctx, &ControllerConfig{CredentialAudit: "stdout"}, newProducer)
+	require.NoError(t, err)
+	assert.Nil(t, sinks.agentEvents())
+	assert.Nil(t, sinks.auditEvents("stdout"))
+	assert.Nil(t, sinks.auditEvents("kafka"))
+
+	sinks, err = startEventSinks(ctx, &ControllerConfig{
+		CredentialAudit: "webhook",
+		Webhook:         "http://localhost:1/hook",
+		Kafka:           &kafka.Config{Brokers: []string{"kafka:9092"}, Topic: "events"},
+	}, newProducer)
+	require.NoError(t, err)
+	assert.Len(t, sinks.agentEvents(), 2)
+	assert.Equal(t, sinks.webhook, sinks.auditEvents("webhook"))
+	assert.Nil(t, sinks.auditEvents("stdout"))
+
+	_, err = startEventSinks(ctx, &ControllerConfig{
+		Kafka: &kafka.Config{Brokers: []string{"kafka:9092"}, Topic: "events"},
+	}, func(kafka.Config) (kafka.Producer, error) {
+		return nil, errors.New("no brokers")
+	})
+	assert.EqualError(t, err, "kafka: no brokers")
+}
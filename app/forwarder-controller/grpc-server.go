@@ -25,6 +25,7 @@ import (
 	"sync/atomic"
 
 	"github.com/OpsMx/go-app-base/version"
+	"github.com/opsmx/oes-birger/internal/ca"
 	"github.com/opsmx/oes-birger/internal/serviceconfig"
 	"github.com/opsmx/oes-birger/internal/tunnel"
 	"github.com/opsmx/oes-birger/internal/tunnelroute"
@@ -35,6 +36,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
 )
 
 func (s *agentTunnelServer) sendWebhook(state tunnelroute.Route, endpoints []*tunnel.EndpointHealth) {
@@ -62,20 +64,60 @@ func (s *agentTunnelServer) sendWebhook(state tunnelroute.Route, endpoints []*tu
 		Session:   state.GetSession(),
 		Endpoints: eh,
 	}
-	hook.Send(req)
+	hook.Send(&agentEvent{Event: agentEventConnected, BaseStatistics: req})
 }
 
-func handleHTTPRequests(session string, requestChan chan interface{}, httpids *util.SessionList, stream tunnel.GRPCEventStream) {
+// sendDisconnectWebhook tells the webhook that an agent's session has ended,
+// and why.
+func (s *agentTunnelServer) sendDisconnectWebhook(state tunnelroute.Route, reason tunnelroute.DisconnectReason) {
+	if hook == nil {
+		return
+	}
+	hook.Send(&agentEvent{
+		Event:  agentEventDisconnected,
+		Reason: reason,
+		BaseStatistics: &tunnelroute.BaseStatistics{
+			Name:    state.GetName(),
+			Session: state.GetSession(),
+		},
+	})
+}
+
+func handleHTTPRequests(session string, requestChan chan interface{}, httpids *util.SessionList, stream tunnel.GRPCEventStream, messageSize tunnel.MessageSizeConfig) {
 	for interfacedRequest := range requestChan {
 		switch value := interfacedRequest.(type) {
 		case *tunnelroute.HTTPMessage:
-			httpids.Add(value.Cmd.Id, value.Out)
 			resp := &tunnel.MessageWrapper{
 				Event: tunnel.MakeHTTPTunnelOpenTunnelRequest(value.Cmd),
 			}
+			if err := messageSize.CheckSend(resp); err != nil {
+				// Answered here, as the agent would, so the caller gets a 413.
+				zap.S().Errorw("unable to send HTTP request over GRPC", "session", session, "requestId", value.Cmd.Id, "error", err)
+				value.Out <- tunnel.MakeRequestEntityTooLargeResponse(value.Cmd.Id)
+				continue
+			}
+			httpids.Add(value.Cmd.Id, value.Out)
 			if err := stream.Send(resp); err != nil {
 				zap.S().Warnw("unable to send HTTP request over GRPC", "session", session, "requestId", value.Cmd.Id, "error", err)
 			}
+		case *tunnelroute.HTTPUpgradeData:
+			resp := &tunnel.MessageWrapper{
+				Event: tunnel.MakeHTTPTunnelChunkedRequest(value.ID, value.Body),
+			}
+			if err := stream.Send(resp); err != nil {
+				zap.S().Warnw("unable to send upgrade data over GRPC", "session", session, "requestId", value.ID, "error", err)
+			}
+		case *tunnelroute.HTTPWindowUpdate:
+			resp := &tunnel.MessageWrapper{
+				Event: tunnel.MakeHTTPTunnelWindowUpdate(value.ID, value.Bytes),
+			}
+			if err := stream.Send(resp); err != nil {
+				zap.S().Warnw("unable to send window update over GRPC", "session", session, "requestId", value.ID, "error", err)
+			}
+		case *tunnelroute.ReconnectMessage:
+			if err := stream.Send(tunnel.MakeReconnect(value.ControllerHostname)); err != nil {
+				zap.S().Warnw("unable to send reconnect over GRPC", "session", session, "error", err)
+			}
 		default:
 			zap.S().Warnw("unexpected message", "messageType", fmt.Sprintf("%T", interfacedRequest))
 		}
@@ -84,7 +126,7 @@ func handleHTTPRequests(session string, requestChan chan interface{}, httpids *u
 
 func handleHTTPCancelRequest(session string, cancelChan chan string, httpids *util.SessionList, stream tunnel.GRPCEventStream) {
 	for id := range cancelChan {
-		httpids.Remove(id)
+		httpids.Close(id)
 		resp := &tunnel.MessageWrapper{
 			Event: tunnel.MakeHTTPTunnelCancelRequest(id),
 		}
@@ -95,9 +137,10 @@ func handleHTTPCancelRequest(session string, cancelChan chan string, httpids *ut
 	zap.S().Infow("session closed", "session", session)
 }
 
-func dataflowHandler(dataflow chan *tunnel.MessageWrapper, stream tunnel.GRPCEventStream) {
+func dataflowHandler(dataflow chan *tunnel.MessageWrapper, stream tunnel.GRPCEventStream, messageSize tunnel.MessageSizeConfig) {
+	sender := messageSize.Sender(stream)
 	for ew := range dataflow {
-		if err := stream.Send(ew); err != nil {
+		if err := sender.Send(ew); err != nil {
 			zap.S().Errorw("stream.Send() failed", "error", err)
 		}
 	}
@@ -117,7 +160,7 @@ func (s *agentTunnelServer) EventTunnel(stream tunnel.AgentTunnelService_EventTu
 
 	dataflow := make(chan *tunnel.MessageWrapper, 20)
 
-	go dataflowHandler(dataflow, stream)
+	tunnel.Go("dataflow", func() { dataflowHandler(dataflow, stream, s.messageSize) })
 
 	sessionIdentity := ulid.GlobalContext.Ulid()
 
@@ -131,6 +174,7 @@ func (s *agentTunnelServer) EventTunnel(stream tunnel.AgentTunnelService_EventTu
 		InRequest:       inRequest,
 		InCancelRequest: inCancelRequest,
 		ConnectedAt:     tunnel.Now(),
+		InFlight:        httpids,
 	}
 
 	remote := "unknown"
@@ -139,36 +183,61 @@ func (s *agentTunnelServer) EventTunnel(stream tunnel.AgentTunnelService_EventTu
 	}
 	zap.S().Infow("agent-connect", "route", state.String(), "remote-address", remote)
 
-	go handleHTTPRequests(sessionIdentity, inRequest, httpids, stream)
+	tunnel.Go("httpRequests", func() { handleHTTPRequests(sessionIdentity, inRequest, httpids, stream, s.messageSize) })
 
-	go handleHTTPCancelRequest(sessionIdentity, inCancelRequest, httpids, stream)
+	tunnel.Go("httpCancelRequests", func() { handleHTTPCancelRequest(sessionIdentity, inCancelRequest, httpids, stream) })
+
+	// Once the webhook has been told the agent connected, it is told when
+	// the session ends, however that happens.
+	announced := false
+	disconnectReason := tunnelroute.DisconnectError
+	defer func() {
+		if announced {
+			s.sendDisconnectWebhook(state, disconnectReason)
+		}
+	}()
 
 	for {
 		in, err := stream.Recv()
 		if err == io.EOF {
 			zap.S().Infow("EOF", "route", state.String())
+			disconnectReason = tunnelroute.DisconnectClean
 			httpids.CloseAll()
-			routes.Remove(state)
+			routes.Remove(state, tunnelroute.DisconnectClean)
 			return nil
 		}
 		if err != nil {
 			zap.S().Infow("remote-closed", "route", state.String())
 			httpids.CloseAll()
-			routes.Remove(state)
+			routes.Remove(state, tunnelroute.DisconnectError)
 			return err
 		}
 
+		// A route removed for being idle has nothing left to serve it, so
+		// the connection is dropped.
+		if state.IsClosed() {
+			zap.S().Infow("idle-disconnect", "route", state.String())
+			disconnectReason = tunnelroute.DisconnectIdle
+			httpids.CloseAll()
+			return fmt.Errorf("session closed after being idle")
+		}
+
 		switch x := in.Event.(type) {
 		case *tunnel.MessageWrapper_PingRequest:
 			req := in.GetPingRequest()
 			atomic.StoreUint64(&state.LastPing, tunnel.Now())
 			if err := stream.Send(tunnel.MakePingResponse(req)); err != nil {
 				zap.S().Warnw("unable to respond to agent ping", "route", state.String(), "error", err)
-				routes.Remove(state)
+				routes.Remove(state, tunnelroute.DisconnectError)
 				return err
 			}
 		case *tunnel.MessageWrapper_Hello:
 			req := in.GetHello()
+			if err := s.limits.checkEndpoints(len(req.Endpoints)); err != nil {
+				zap.S().Warnw("rejecting agent connection: too many endpoints", "route", state.String(), "error", err)
+				state.Close()
+				return err
+			}
 			if s.insecure {
 				if agentIdentity, err = getAgentNameFromBytes(req.ClientCertificate); err != nil {
 					return err
@@ -176,20 +245,29 @@ func (s *agentTunnelServer) EventTunnel(stream tunnel.AgentTunnelService_EventTu
 				state.Name = agentIdentity
 			}
 			state.Endpoints = reqToEndpoints(req.Endpoints)
+			for _, err := range s.endpointTypes.MarkUnsupported(state.Endpoints) {
+				zap.S().Warnw("agent advertised an unsupported endpoint", "route", state.String(), "error", err)
+			}
+			for _, err := range s.overrideLimits.Apply(state.Endpoints) {
+				zap.S().Warnw("rejected endpoint override", "route", state.String(), "error", err)
+			}
 			state.Version = req.Version
 			state.Hostname = req.Hostname
 			state.AgentInfo = req.AgentInfo.FromPB()
 			routes.Add(state)
 			s.sendWebhook(state, req.Endpoints)
+			announced = true
 
 			if err = s.sendHello(stream); err != nil {
 				zap.S().Warnw("unable to responsd with hello, closing", "route", state.String(), "error", err)
-				routes.Remove(state)
+				routes.Remove(state, tunnelroute.DisconnectError)
 				return err
 			}
 			zap.S().Infow("agent-handshake-complete", "route", state.String())
 		case *tunnel.MessageWrapper_HttpTunnelControl:
 			handleHTTPControl(state.Name, in, httpids, s.endpoints, dataflow)
+		case *tunnel.MessageWrapper_EndpointHealthReport:
+			updateEndpointHealth(state, in.GetEndpointHealthReport())
 		case nil:
 			// ignore for now
 		default:
@@ -198,6 +276,23 @@ func (s *agentTunnelServer) EventTunnel(stream tunnel.AgentTunnelService_EventTu
 	}
 }
 
+// updateEndpointHealth records an agent's report of its endpoints' health
+// and circuit breakers, logging those which have become unhealthy or
+// recovered.
+func updateEndpointHealth(state *tunnelroute.DirectlyConnectedRoute, report *tunnel.EndpointHealthReport) {
+	for _, ep := range report.Endpoints {
+		state.SetEndpointCircuitBreaker(ep.Type, ep.Name, ep.CircuitBreaker)
+		if !state.SetEndpointHealth(ep.Type, ep.Name, ep.Healthy, ep.Reason) {
+			continue
+		}
+		if ep.Healthy {
+			zap.S().Infow("agent endpoint recovered", "route", state.String(), "endpointType", ep.Type, "endpointName", ep.Name)
+		} else {
+			zap.S().Warnw("agent endpoint unhealthy", "route", state.String(), "endpointType", ep.Type, "endpointName", ep.Name, "reason", ep.Reason)
+		}
+	}
+}
+
 func getAgentNameFromBytes(data []byte) (name string, err error) {
 	cert, err := x509.ParseCertificate(data)
 	if err != nil {
@@ -224,6 +319,9 @@ func reqToEndpoints(health []*tunnel.EndpointHealth) []tunnelroute.Endpoint {
 			Namespaces:  ep.Namespaces,
 			AccountID:   ep.AccountID,
 			AssumeRole:  ep.AssumeRole,
+
+			MaxConcurrency: int(ep.MaxConcurrency),
+			Weight:         int(ep.Weight),
 		}
 	}
 	return endpoints
@@ -250,16 +348,22 @@ func handleHTTPControl(agentName string, in *tunnel.MessageWrapper, httpids *uti
 		tunnel.CallCancelFunction(controlMessage.CancelRequest.Id)
 	case *tunnel.HttpTunnelControl_OpenHTTPTunnelRequest:
 		req := controlMessage.OpenHTTPTunnelRequest
+		// A streamed body may arrive before the endpoint starts running.
+		tunnel.PrepareRequestBody(req)
 		found := false
 		for _, endpoint := range endpoints {
 			if endpoint.Configured && endpoint.Type == req.Type && endpoint.Name == req.Name {
-				go endpoint.Instance.ExecuteHTTPRequest(agentName, dataflow, req)
+				instance := endpoint.Instance
+				go tunnel.RunRequest(req.Id, dataflow, func(dataflow chan *tunnel.MessageWrapper) {
+					instance.ExecuteHTTPRequest(agentName, dataflow, req)
+				})
 				found = true
 				break
 			}
 		}
 		if !found {
 			zap.S().Warnf("Request for unsupported HTTP tunnel type=%s name=%s", req.Type, req.Name)
+			tunnel.ReleaseRequestBody(req)
 			dataflow <- tunnel.MakeBadGatewayResponse(req.Id)
 		}
 	case *tunnel.HttpTunnelControl_HttpTunnelResponse:
@@ -288,6 +392,14 @@ func handleHTTPControl(agentName string, in *tunnel.MessageWrapper, httpids *uti
 			zap.S().Debugf("Got response to unknown HTTP request id %s", resp.Id)
 		}
 		httpids.Unlock()
+	case *tunnel.HttpTunnelControl_HttpTunnelChunkedRequest:
+		req := controlMessage.HttpTunnelChunkedRequest
+		if err := tunnel.WriteUpgradeData(req.Id, req.Body); err != nil {
+			zap.S().Debugw("unable to write upgrade data", "requestId", req.Id, "error", err)
+		}
+	case *tunnel.HttpTunnelControl_HttpTunnelWindowUpdate:
+		update := controlMessage.HttpTunnelWindowUpdate
+		tunnel.UpdateFlowWindow(update.Id, update.Bytes)
 	case nil:
 		return
 	default:
@@ -297,25 +409,40 @@ func handleHTTPControl(agentName string, in *tunnel.MessageWrapper, httpids *uti
 
 type agentTunnelServer struct {
 	tunnel.UnimplementedAgentTunnelServiceServer
-	endpoints []serviceconfig.ConfiguredEndpoint
-	insecure  bool
+	endpoints      []serviceconfig.ConfiguredEndpoint
+	insecure       bool
+	overrideLimits tunnelroute.EndpointOverrideLimits
+	endpointTypes  tunnelroute.EndpointTypes
+	limits         agentConnectionLimits
+	messageSize    tunnel.MessageSizeConfig
 }
 
-func runAgentGRPCServer(insecureAgents bool, serverCert tls.Certificate) {
-	zap.S().Infow("starting agent GRPC server", "port", config.AgentListenPort)
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", config.AgentListenPort))
+func runAgentGRPCServer(insecureAgents bool, enableReflection bool, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) {
+	addr := util.ListenAddress(config.AgentBindAddress, config.AgentListenPort)
+	zap.S().Infow("starting agent GRPC server", "address", addr)
+	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		zap.S().Fatalw("failed to listen on agent port", "error", err)
 	}
+	lis = config.AgentConnectionLimits.listener(lis)
+	if config.CompressTunnel {
+		tunnel.EnableCompression()
+	}
+	opts := config.AgentConnectionLimits.serverOptions()
+	opts = append(opts, config.TunnelMessageSize.ServerOptions()...)
 
 	if insecureAgents {
 		m := cmux.New(lis)
 		grpcL := m.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
 
-		grpcServer := grpc.NewServer()
-		server := &agentTunnelServer{insecure: insecureAgents}
+		grpcServer := grpc.NewServer(opts...)
+		server := &agentTunnelServer{insecure: insecureAgents, overrideLimits: config.EndpointOverrides, endpointTypes: config.EndpointTypes, limits: config.AgentConnectionLimits}
 		server.endpoints = endpoints
+		server.messageSize = config.TunnelMessageSize
 		tunnel.RegisterAgentTunnelServiceServer(grpcServer, server)
+		if enableReflection {
+			reflection.Register(grpcServer)
+		}
 
 		go func() {
 			if err := grpcServer.Serve(grpcL); err != nil {
@@ -327,21 +454,25 @@ func runAgentGRPCServer(insecureAgents bool, serverCert tls.Certificate) {
 			zap.S().Fatalw("Failed to run m.Serve()", "error", err)
 		}
 	} else {
-		certPool, err := authority.MakeCertPool()
-		if err != nil {
-			zap.S().Fatalw("authority.MakeCertPool", "error", err)
+		skew := config.AgentCertificateClockSkew
+		if skew == 0 {
+			skew = ca.DefaultClockSkew
 		}
-		creds := credentials.NewTLS(&tls.Config{
-			ClientCAs:    certPool,
-			ClientAuth:   tls.RequireAndVerifyClientCert,
-			Certificates: []tls.Certificate{serverCert},
-			MinVersion:   tls.VersionTLS13,
-		})
-		opts := []grpc.ServerOption{grpc.Creds(creds)}
+		creds := credentials.NewTLS(util.ApplyTLSSettings(&tls.Config{
+			ClientAuth:            tls.RequireAnyClientCert,
+			VerifyPeerCertificate: authority.VerifyAgentWithClockSkew(skew),
+			GetCertificate:        getCertificate,
+			MinVersion:            tls.VersionTLS13,
+		}))
+		opts = append(opts, grpc.Creds(creds))
 		grpcServer := grpc.NewServer(opts...)
-		server := &agentTunnelServer{insecure: insecureAgents}
+		server := &agentTunnelServer{insecure: insecureAgents, overrideLimits: config.EndpointOverrides, endpointTypes: config.EndpointTypes, limits: config.AgentConnectionLimits}
 		server.endpoints = endpoints
+		server.messageSize = config.TunnelMessageSize
 		tunnel.RegisterAgentTunnelServiceServer(grpcServer, server)
+		if enableReflection {
+			reflection.Register(grpcServer)
+		}
 		if err := grpcServer.Serve(lis); err != nil {
 			zap.S().Fatalw("grpcServer.Serve() failed", "error", err)
 		}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/ca"
+	"github.com/opsmx/oes-birger/internal/fwdapi"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	internalutil "github.com/opsmx/oes-birger/internal/util"
+)
+
+// handoffCertificateTTL is the lifetime of the control certificate used to
+// advertise routes to a peer.
+const handoffCertificateTTL = 10 * time.Minute
+
+// controlAPIAdvertiser advertises routes to a peer's control API.  The
+// peer must share this controller's CA, as its agents must for their
+// certificates to be accepted there, so a short lived control certificate
+// issued by the CA is used to authenticate.
+type controlAPIAdvertiser struct {
+	authority *ca.CA
+}
+
+func (a *controlAPIAdvertiser) AdvertiseRoutes(peer tunnelroute.Peer, agents []string, until time.Time) error {
+	client, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(fwdapi.AdvertiseRoutesRequest{
+		Agents: agents,
+		Until:  uint64(until.UnixMilli()),
+	})
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(peer.ControlURL, "/") + fwdapi.AdvertiseRoutesEndpoint
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned %d: %s", url, resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// client returns an HTTP client which presents a new control certificate,
+// and trusts the CA.
+func (a *controlAPIAdvertiser) client() (*http.Client, error) {
+	name := ca.CertificateName{
+		Name:    "handoff",
+		Purpose: ca.CertificatePurposeControl,
+	}
+	_, cert64, key64, err := a.authority.GenerateCertificate(name, handoffCertificateTTL)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := base64.StdEncoding.DecodeString(cert64)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := base64.StdEncoding.DecodeString(key64)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := a.authority.MakeCertPool()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: internalutil.ApplyTLSSettings(&tls.Config{
+				Certificates: []tls.Certificate{cert},
+				RootCAs:      roots,
+				MinVersion:   tls.VersionTLS12,
+			}),
+		},
+	}, nil
+}
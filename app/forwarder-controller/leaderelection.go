@@ -0,0 +1,149 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 2 * time.Second
+)
+
+// leaderElectionConfig makes redundant controllers elect an active one
+// using a Kubernetes Lease.  If LeaseName is set, the controller starts on
+// standby, and is active only while it holds the lease.  Namespace defaults
+// to POD_NAMESPACE, and Identity to the hostname (the pod name).
+type leaderElectionConfig struct {
+	LeaseName     string        `yaml:"leaseName,omitempty"`
+	Namespace     string        `yaml:"namespace,omitempty"`
+	Identity      string        `yaml:"identity,omitempty"`
+	LeaseDuration time.Duration `yaml:"leaseDuration,omitempty"`
+	RenewDeadline time.Duration `yaml:"renewDeadline,omitempty"`
+	RetryPeriod   time.Duration `yaml:"retryPeriod,omitempty"`
+}
+
+type standbySetter interface {
+	SetStandby(standby bool)
+}
+
+func (c *leaderElectionConfig) enabled() bool {
+	return c.LeaseName != ""
+}
+
+func (c *leaderElectionConfig) applyDefaults() {
+	if c.Namespace == "" {
+		c.Namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if c.Identity == "" {
+		c.Identity, _ = os.Hostname()
+	}
+	if c.LeaseDuration == 0 {
+		c.LeaseDuration = defaultLeaseDuration
+	}
+	if c.RenewDeadline == 0 {
+		c.RenewDeadline = defaultRenewDeadline
+	}
+	if c.RetryPeriod == 0 {
+		c.RetryPeriod = defaultRetryPeriod
+	}
+}
+
+// validate checks the timings, which must be in decreasing order, once
+// defaults are applied.
+func (c leaderElectionConfig) validate() []error {
+	if !c.enabled() {
+		return nil
+	}
+	problems := []error{}
+	if c.LeaseDuration < 0 || c.RenewDeadline < 0 || c.RetryPeriod < 0 {
+		problems = append(problems, fmt.Errorf("leaseDuration, renewDeadline, and retryPeriod must not be negative"))
+		return problems
+	}
+	c.applyDefaults()
+	if c.LeaseDuration <= c.RenewDeadline {
+		problems = append(problems, fmt.Errorf("leaseDuration must be greater than renewDeadline"))
+	}
+	if c.RenewDeadline <= c.RetryPeriod {
+		problems = append(problems, fmt.Errorf("renewDeadline must be greater than retryPeriod"))
+	}
+	return problems
+}
+
+// runLeaderElection keeps the target on standby except while this
+// controller holds the lease.  Losing the lease puts it back on standby,
+// and it then tries to acquire it again.
+func runLeaderElection(ctx context.Context, config leaderElectionConfig, target standbySetter) {
+	if config.Namespace == "" {
+		log.Fatalf("leaderElection: namespace not set, and POD_NAMESPACE is not set")
+	}
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		log.Fatalf("leaderElection: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		log.Fatalf("leaderElection: %v", err)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      config.LeaseName,
+			Namespace: config.Namespace,
+		},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: config.Identity},
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   config.LeaseDuration,
+		RenewDeadline:   config.RenewDeadline,
+		RetryPeriod:     config.RetryPeriod,
+		Name:            config.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				target.SetStandby(false)
+			},
+			OnStoppedLeading: func() {
+				target.SetStandby(true)
+			},
+			OnNewLeader: func(identity string) {
+				log.Printf("leaderElection: %s holds lease %s/%s", identity, config.Namespace, config.LeaseName)
+			},
+		},
+	})
+	if err != nil {
+		log.Fatalf("leaderElection: %v", err)
+	}
+
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+}
@@ -18,17 +18,17 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"flag"
 	"fmt"
-	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"runtime"
 	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -40,15 +40,22 @@ import (
 	"github.com/OpsMx/go-app-base/tracer"
 	"github.com/OpsMx/go-app-base/util"
 	"github.com/OpsMx/go-app-base/version"
-	"github.com/lestrrat-go/jwx/jwa"
-	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/opsmx/oes-birger/app/forwarder-controller/cncserver"
+	"github.com/opsmx/oes-birger/internal/buildinfo"
 	"github.com/opsmx/oes-birger/internal/ca"
+	"github.com/opsmx/oes-birger/internal/debugserver"
 	"github.com/opsmx/oes-birger/internal/jwtutil"
+	"github.com/opsmx/oes-birger/internal/kafka"
+	"github.com/opsmx/oes-birger/internal/logging"
+	"github.com/opsmx/oes-birger/internal/metricsauth"
+	"github.com/opsmx/oes-birger/internal/ocspstaple"
+	"github.com/opsmx/oes-birger/internal/otlpmetrics"
 	"github.com/opsmx/oes-birger/internal/secrets"
 	"github.com/opsmx/oes-birger/internal/serviceconfig"
+	"github.com/opsmx/oes-birger/internal/tunnel"
 	"github.com/opsmx/oes-birger/internal/tunnelroute"
-	"github.com/opsmx/oes-birger/internal/webhook"
+	internalutil "github.com/opsmx/oes-birger/internal/util"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -64,18 +71,26 @@ var (
 	traceToStdout  = flag.Bool("traceToStdout", false, "log traces to stdout")
 	traceRatio     = flag.Float64("traceRatio", 0.01, "ratio of traces to create, if incoming request is not traced")
 	showversion    = flag.Bool("version", false, "show the version and exit")
+	enableDebug    = flag.Bool("debug", false, "enable GRPC reflection on the agent port and /debug/routes on the Prometheus port")
+
+	// eg, http://localhost:4318
+	otlpMetricsEndpoint = flag.String("otlpMetricsEndpoint", "", "OTLP/HTTP collector endpoint to push metrics to")
+	otlpMetricsInterval = flag.Duration("otlpMetricsInterval", otlpmetrics.DefaultInterval, "how often to push metrics to the OTLP collector")
+
+	initialLogLevel = flag.String("logLevel", "info", "log level, such as debug, info, or warn.  It may be changed while running at "+logging.LevelEndpoint+" on the Prometheus port")
+	selfTest        = flag.Bool("selfTest", false, "check that each configured endpoint can be reached at startup, and log the results")
+	selfTestTimeout = flag.Duration("selfTestTimeout", serviceconfig.DefaultSelfTestTimeout, "how long each endpoint's startup self-test may take")
 
 	tracerProvider *tracer.TracerProvider
 
-	jwtKeyset     = jwk.NewSet()
-	jwtCurrentKey string
 	config        *ControllerConfig
 	secretsLoader secrets.SecretLoader
 	authority     *ca.CA
-	hook          *webhook.Runner
+	hook          eventSender
 	routes        = tunnelroute.MakeRoutes()
 	endpoints     []serviceconfig.ConfiguredEndpoint
 	logger        *zap.Logger
+	logLevel      zap.AtomicLevel
 	sl            *zap.SugaredLogger
 )
 
@@ -88,15 +103,17 @@ func getAgentNameFromContext(ctx context.Context) (string, error) {
 	if !ok {
 		return "", status.Error(codes.Unauthenticated, "unexpected peer transport credentials")
 	}
-	if len(tlsAuth.State.VerifiedChains) == 0 || len(tlsAuth.State.VerifiedChains[0]) == 0 {
+	// The certificate was verified during the handshake, allowing for
+	// clock skew, so there are no VerifiedChains.
+	if len(tlsAuth.State.PeerCertificates) == 0 {
 		return "", status.Error(codes.Unauthenticated, "could not verify peer certificate")
 	}
-	return getAgentNameFromCertificate(tlsAuth.State.VerifiedChains[0][0])
+	return getAgentNameFromCertificate(tlsAuth.State.PeerCertificates[0])
 }
 
 func getAgentNameFromCertificate(cert *x509.Certificate) (string, error) {
 	// TODO: should verify the certificate here...
-	names, err := ca.GetCertificateNameFromCert(cert)
+	names, err := authority.GetCertificateNameFromCert(cert)
 	if err != nil {
 		return "", err
 	}
@@ -141,18 +158,31 @@ func healthcheck(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func runPrometheusHTTPServer(port uint16) {
-	log.Printf("Running HTTP listener for Prometheus on port %d", port)
+func runPrometheusHTTPServer(bindAddress string, port uint16, auth metricsauth.Config, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) {
+	addr := internalutil.ListenAddress(bindAddress, port)
+	tlsConfig, err := auth.TLSConfig(authority, getCertificate)
+	if err != nil {
+		log.Fatalf("While making metrics TLS config: %v", err)
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", auth.Handler(promhttp.Handler()))
+	debugserver.Register(mux, *enableDebug, auth.Handler, routes)
+	logging.RegisterLevelHandler(mux, auth.Handler, logLevel)
+	buildinfo.RegisterHandler(mux)
 	mux.HandleFunc("/", healthcheck)
 	mux.HandleFunc("/health", healthcheck)
 
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: mux,
+		Addr:      addr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig != nil {
+		log.Printf("Running HTTPS listener for Prometheus on %s", addr)
+		log.Fatal(server.ListenAndServeTLS("", ""))
 	}
+	log.Printf("Running HTTP listener for Prometheus on %s (metrics auth: %s)", addr, auth.Type)
 	log.Fatal(server.ListenAndServe())
 }
 
@@ -160,52 +190,52 @@ func loadKeyset() {
 	if config.ServiceAuth.CurrentKeyName == "" {
 		log.Fatalf("No primary serviceAuth key name provided")
 	}
+	if len(config.ServiceAuth.HeaderMutationKeyName) == 0 {
+		log.Fatal("serviceAuth.headerMutationKeyName is not set")
+	}
 
-	err := filepath.WalkDir(config.ServiceAuth.SecretsPath, func(path string, info fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		// skip not refular files
-		if !info.Type().IsRegular() {
-			return nil
-		}
-		content, err := os.ReadFile(path)
-		if err != nil {
-			return err
-		}
-		key, err := jwk.New(content)
-		if err != nil {
-			return err
-		}
-		err = key.Set(jwk.KeyIDKey, info.Name())
-		if err != nil {
-			return err
-		}
-		err = key.Set(jwk.AlgorithmKey, jwa.HS256)
-		if err != nil {
-			return err
-		}
-		jwtKeyset.Add(key)
-		log.Printf("Loaded service key name %s, length %d", info.Name(), len(content))
-		return nil
-	})
+	// Create registry entries to sign and validate JWTs for service authentication,
+	// and protect x-spinnaker-user header.
+	keyset, err := jwtutil.ReloadKeysets(config.ServiceAuth.SecretsPath,
+		config.ServiceAuth.CurrentKeyName, config.ServiceAuth.AdditionalKeyNames,
+		config.ServiceAuth.HeaderMutationKeyName, config.ServiceAuth.RetiredKeyNames)
 	if err != nil {
-		log.Fatalf("cannot load key serviceAuth keys: %v", err)
+		log.Fatalf("cannot load serviceAuth keys: %v", err)
 	}
 
-	jwtCurrentKey = config.ServiceAuth.CurrentKeyName
-	if len(jwtCurrentKey) == 0 {
-		log.Fatal("serviceAuth.currentKeyName is not set")
+	log.Printf("Loaded %d serviceKeys: %v", keyset.Len(), jwtutil.KeyNames(keyset))
+}
+
+// loadExternalJWKS accepts service credentials from the external issuer,
+// if one is configured.  The controller starts even if the keys cannot be
+// fetched yet, as they are fetched again when a credential needs them.
+func loadExternalJWKS(ctx context.Context) {
+	jwks := config.ServiceAuth.ExternalJWKS
+	if jwks == nil {
+		return
 	}
-	if _, found := jwtKeyset.LookupKeyID(jwtCurrentKey); !found {
-		log.Fatal("serviceAuth.currentKeyName is not in the loaded list of keys")
+	client := &http.Client{Timeout: 30 * time.Second}
+	if err := jwtutil.RegisterExternalJWKS(ctx, *jwks, client); err != nil {
+		log.Printf("Cannot fetch external JWKS from %s, will retry when needed: %v", jwks.URL, err)
+		return
 	}
+	log.Printf("Accepting service credentials from %s, with keys from %s", jwks.Issuer, jwks.URL)
+}
 
-	if len(config.ServiceAuth.HeaderMutationKeyName) == 0 {
-		log.Fatal("serviceAuth.headerMutationKeyName is not set")
-	}
+// serviceKeyRotator reloads the service-auth keys from disk when asked
+// through the control API.
+type serviceKeyRotator struct{}
 
-	log.Printf("Loaded %d serviceKeys", jwtKeyset.Len())
+func (*serviceKeyRotator) RotateServiceKeys(currentKeyName string, retired []string) ([]string, error) {
+	keyset, err := jwtutil.ReloadKeysets(config.ServiceAuth.SecretsPath,
+		currentKeyName, config.ServiceAuth.AdditionalKeyNames,
+		config.ServiceAuth.HeaderMutationKeyName, retired)
+	if err != nil {
+		return nil, err
+	}
+	names := jwtutil.KeyNames(keyset)
+	log.Printf("Rotated serviceKeys: current key %s, retired %v, loaded %v", currentKeyName, retired, names)
+	return names, nil
 }
 
 func parseConfig(filename string) (*ControllerConfig, error) {
@@ -231,7 +261,7 @@ func main() {
 
 	var err error
 
-	logger, err = zap.NewProduction()
+	logger, logLevel, err = logging.NewLogger(*initialLogLevel)
 	if err != nil {
 		log.Fatalf("setting up logger: %v", err)
 	}
@@ -264,11 +294,24 @@ func main() {
 	util.Check(err)
 	defer tracerProvider.Shutdown(ctx)
 
+	if *otlpMetricsEndpoint == "" {
+		*otlpMetricsEndpoint = util.GetEnvar("OTLP_METRICS_URL", "")
+	}
+	if *otlpMetricsEndpoint != "" {
+		exporter, err := otlpmetrics.NewExporter(*otlpMetricsEndpoint, appName, version.GitHash(), prometheus.DefaultGatherer)
+		if err != nil {
+			sl.Fatalf("configuring OTLP metrics: %v", err)
+		}
+		sl.Infow("pushing metrics over OTLP", "endpoint", exporter.Endpoint(), "interval", *otlpMetricsInterval)
+		go exporter.Run(ctx, *otlpMetricsInterval)
+	}
+
 	config, err = parseConfig(*configFile)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
 	config.Dump()
+	util.Check(internalutil.SetTLSSettings(config.TLSSettings))
 
 	namespace, ok := os.LookupEnv("POD_NAMESPACE")
 	if ok {
@@ -281,63 +324,139 @@ func main() {
 	}
 
 	loadKeyset()
+	loadExternalJWKS(ctx)
 
-	// Create registry entries to sign and validate JWTs for service authentication,
-	// and protect x-spinnaker-user header.
-	if err = jwtutil.RegisterServiceauthKeyset(jwtKeyset, config.ServiceAuth.CurrentKeyName); err != nil {
-		log.Fatal(err)
-	}
-	if err = jwtutil.RegisterMutationKeyset(jwtKeyset, config.ServiceAuth.HeaderMutationKeyName); err != nil {
+	sinks, err := startEventSinks(ctx, config, kafka.NewProducer)
+	if err != nil {
 		log.Fatal(err)
 	}
-
-	if len(config.Webhook) > 0 {
-		hook = webhook.NewRunner(config.Webhook)
-		go hook.Run()
-	}
+	hook = sinks.agentEvents()
 
 	//
 	// Make a new CA, for our use to generate server and other certificates.
 	//
-	caLocal, err := ca.LoadCAFromFile(config.CAConfig)
-	if err != nil {
-		log.Fatalf("Cannot create authority: %v", err)
+	if config.CAConfig.CASecretName != "" {
+		caLocal, err := ca.LoadCAFromSecret(config.CAConfig, secretsLoader)
+		if err != nil {
+			log.Fatalf("Cannot create authority: %v", err)
+		}
+		authority = caLocal
+	} else {
+		caLocal, err := ca.LoadCAFromFile(config.CAConfig)
+		if err != nil {
+			log.Fatalf("Cannot create authority: %v", err)
+		}
+		authority = caLocal
 	}
-	authority = caLocal
 
 	//
 	// Make a server certificate.
 	//
 	log.Println("Generating a server certificate...")
-	serverCert, err := authority.MakeServerCert(config.ServerNames)
+	serverCert, err := authority.MakeControllerCert(config.ServerNames, config.ControllerIdentity)
 	if err != nil {
 		log.Fatalf("Cannot make server certificate: %v", err)
 	}
+	stapler, err := ocspstaple.NewStapler(*serverCert, authority.GetCACertificate(), config.OCSPStapling)
+	if err != nil {
+		log.Fatalf("Cannot staple server certificate: %v", err)
+	}
+	go stapler.Run(ctx)
+
+	// When the CA is reloaded from its secret, issue the server
+	// certificate again from the new CA, so clients trusting only the new
+	// CA can connect.
+	if config.CAConfig.CASecretName != "" {
+		authority.OnReload(func() {
+			serverCert, err := authority.MakeControllerCert(config.ServerNames, config.ControllerIdentity)
+			if err != nil {
+				log.Printf("Cannot make server certificate from reloaded CA, keeping the current one: %v", err)
+				return
+			}
+			if err := stapler.SetCertificate(*serverCert, authority.GetCACertificate()); err != nil {
+				log.Printf("Cannot use server certificate from reloaded CA, keeping the current one: %v", err)
+				return
+			}
+			log.Printf("Issued a new server certificate from the reloaded CA")
+		})
+		go authority.WatchSecret(ctx, secretsLoader)
+	}
 
 	endpoints = serviceconfig.ConfigureEndpoints(secretsLoader, &config.ServiceConfig)
+	if *selfTest {
+		serviceconfig.SelfTestEndpoints(ctx, endpoints, *selfTestTimeout)
+	}
 
 	cnc := cncserver.MakeCNCServer(config, authority, routes, version.GitBranch())
-	go cnc.RunServer(*serverCert)
+	if audit := sinks.auditEvents(config.CredentialAudit); audit != nil {
+		cnc.SetAuditSink(cncserver.NewWebhookAuditSink(audit))
+	}
+	cnc.SetServiceKeyRotator(&serviceKeyRotator{})
+	cnc.SetHandoff(routes.Handoff(), &controlAPIAdvertiser{authority: authority})
+	if config.SignManifests {
+		var signer ca.ManifestSigner = authority
+		if config.ManifestSigningKeyFile != "" {
+			if signer, err = ca.LoadManifestSigningKey(config.ManifestSigningKeyFile); err != nil {
+				log.Fatalf("loading manifestSigningKeyFile: %v", err)
+			}
+		}
+		cnc.SetManifestSigner(signer)
+	}
+	if config.Standby || config.LeaderElection.enabled() {
+		cnc.SetStandby(true)
+	}
+	if config.LeaderElection.enabled() {
+		go runLeaderElection(ctx, config.LeaderElection, cnc)
+	}
+	go cnc.RunServer(stapler.GetCertificate)
+
+	routes.SetEndpointAliases(config.EndpointAliases)
+	if config.ReconnectGrace > 0 {
+		log.Printf("Waiting up to %s for disconnected agents to reconnect", config.ReconnectGrace)
+		routes.SetReconnectGrace(config.ReconnectGrace)
+	}
+
+	go runAgentGRPCServer(config.InsecureAgentConnections, *enableDebug, stapler.GetCertificate)
+
+	if config.IdleRouteTimeout > 0 {
+		log.Printf("Removing agent sessions idle for more than %s", config.IdleRouteTimeout)
+		go routes.RunIdleSweeper(config.IdleRouteTimeout)
+	}
 
-	go runAgentGRPCServer(config.InsecureAgentConnections, *serverCert)
+	if config.MaxRequestLifetime > 0 {
+		log.Printf("Reaping cancel functions of requests running more than %s", config.MaxRequestLifetime)
+		go tunnel.RunCancelSweeper(config.MaxRequestLifetime)
+	}
+
+	var authorizer serviceconfig.Authorizer = serviceconfig.AllowAllAuthorizer{}
+	if replay := config.ServiceAuth.ReplayProtection; replay != nil {
+		log.Printf("Refusing replayed service credentials for non-idempotent requests")
+		authorizer = serviceconfig.ReplayProtectingAuthorizer{
+			Cache: jwtutil.NewReplayCache(*replay),
+			Next:  authorizer,
+		}
+	}
 
 	// Always listen on our well-known port, and always use HTTPS for this one.
-	go serviceconfig.RunHTTPSServer(routes, authority, *serverCert, serviceconfig.IncomingServiceConfig{
-		Name: "_services",
-		Port: config.ServiceListenPort,
-	})
+	go serviceconfig.RunHTTPSServer(routes, authority, stapler.GetCertificate, []serviceconfig.IncomingServiceConfig{{
+		Name:        "_services",
+		Port:        config.ServiceListenPort,
+		BindAddress: config.ServiceBindAddress,
+	}}, authorizer, nil)
 
 	// Now, add all the others defined by our config.
-	for _, service := range config.ServiceConfig.IncomingServices {
-		if service.UseHTTP {
-			go serviceconfig.RunHTTPServer(routes, service)
+	// Services on the same port share a listener.
+	for _, services := range serviceconfig.GroupIncomingServices(config.ServiceConfig.IncomingServices) {
+		if services[0].UseHTTP {
+			go serviceconfig.RunHTTPServer(routes, services, authorizer)
 		} else {
-			go serviceconfig.RunHTTPSServer(routes, authority, *serverCert, service)
+			go serviceconfig.RunHTTPSServer(routes, authority, stapler.GetCertificate, services, authorizer, nil)
 		}
 	}
 
-	go runPrometheusHTTPServer(config.PrometheusListenPort)
+	go runPrometheusHTTPServer(config.PrometheusBindAddress, config.PrometheusListenPort, config.MetricsAuth, stapler.GetCertificate)
 
 	<-sigchan
+	serviceconfig.CloseEndpoints(endpoints)
 	log.Printf("Exiting Cleanly")
 }
@@ -36,7 +36,8 @@ var (
 	endpointName  = flag.String("name", "", "Item name")
 	agentIdentity = flag.String("agent", "", "agent name")
 	endpointType  = flag.String("type", "", "endpoint type")
-	action        = flag.String("action", "", "action, one of: kubectl, agent-manifest, service, or control")
+	action        = flag.String("action", "", "action, one of: kubectl, kubectl-preview, agent-manifest, service, control, statistics, endpoints, or ca")
+	ttl           = flag.String("ttl", "", "requested certificate lifetime, such as 24h (kubectl, agent-manifest, and control only)")
 	showversion   = flag.Bool("version", false, "show the version and exit")
 )
 
@@ -50,6 +51,7 @@ func usage(message string) {
 	fmt.Fprintf(os.Stderr, "  'service' requires: agent, endpointType, endpointName.\n")
 	fmt.Fprintf(os.Stderr, "  'agent-manifest' requires: agent.\n")
 	fmt.Fprintf(os.Stderr, "  'control' requires no other options.\n")
+	fmt.Fprintf(os.Stderr, "  'ca' requires no other options, and writes a PEM bundle to stdout.\n")
 	os.Exit(-1)
 }
 
@@ -64,16 +66,17 @@ func makeClient() *resty.Client {
 	return client
 }
 
-func getKubeconfigCreds() {
+func getKubeconfigCreds(endpoint string) {
 	request := fwdapi.KubeConfigRequest{
 		AgentName: *agentIdentity,
 		Name:      *endpointName,
+		TTL:       *ttl,
 	}
 	client := makeClient()
 	resp, err := client.R().
 		EnableTrace().
 		SetBody(request).
-		Post(fmt.Sprintf("%s%s", *url, fwdapi.KubeconfigEndpoint))
+		Post(fmt.Sprintf("%s%s", *url, endpoint))
 	if err != nil {
 		fmt.Printf("%v\n", err)
 	}
@@ -86,6 +89,7 @@ func getKubeconfigCreds() {
 func getAgentManifest() {
 	request := fwdapi.ManifestRequest{
 		AgentName: *agentIdentity,
+		TTL:       *ttl,
 	}
 	client := makeClient()
 	resp, err := client.R().
@@ -124,6 +128,7 @@ func getService() {
 func getControl() {
 	request := fwdapi.ControlCredentialsRequest{
 		Name: *endpointName,
+		TTL:  *ttl,
 	}
 	client := makeClient()
 	resp, err := client.R().
@@ -153,6 +158,35 @@ func getStatistics() {
 	fmt.Printf("%s\n", string(resp.Body()))
 }
 
+func getEndpoints() {
+	client := makeClient()
+	resp, err := client.R().
+		EnableTrace().
+		Get(fmt.Sprintf("%s%s", *url, fwdapi.EndpointsEndpoint))
+	if err != nil {
+		fmt.Printf("%v\n", err)
+	}
+	if resp.StatusCode() != 200 {
+		log.Fatalf("Request failed: %s", resp.Status())
+	}
+	fmt.Printf("%s\n", string(resp.Body()))
+}
+
+func getCABundle() {
+	client := makeClient()
+	resp, err := client.R().
+		EnableTrace().
+		Get(fmt.Sprintf("%s%s", *url, fwdapi.CAEndpoint))
+	if err != nil {
+		fmt.Printf("%v\n", err)
+	}
+	if resp.StatusCode() != 200 {
+		log.Fatalf("Request failed: %s", resp.Status())
+	}
+	log.Printf("CA certificate SHA-256 fingerprint: %s", resp.Header().Get(fwdapi.CAFingerprintHeader))
+	fmt.Printf("%s", string(resp.Body()))
+}
+
 func insist(s *string, name string, expected bool) {
 	if expected && (s == nil || *s == "") {
 		usage(fmt.Sprintf("%s: required", name))
@@ -174,7 +208,12 @@ func main() {
 		insist(agentIdentity, "agent", true)
 		insist(endpointName, "name", true)
 		insist(endpointType, "type", false)
-		getKubeconfigCreds()
+		getKubeconfigCreds(fwdapi.KubeconfigEndpoint)
+	case "kubectl-preview":
+		insist(agentIdentity, "agent", true)
+		insist(endpointName, "name", true)
+		insist(endpointType, "type", false)
+		getKubeconfigCreds(fwdapi.KubeconfigPreviewEndpoint)
 	case "agent-manifest":
 		insist(agentIdentity, "agent", true)
 		insist(endpointName, "name", false)
@@ -195,6 +234,16 @@ func main() {
 		insist(endpointName, "name", false)
 		insist(endpointType, "type", false)
 		getStatistics()
+	case "endpoints":
+		insist(agentIdentity, "agent", false)
+		insist(endpointName, "name", false)
+		insist(endpointType, "type", false)
+		getEndpoints()
+	case "ca":
+		insist(agentIdentity, "agent", false)
+		insist(endpointName, "name", false)
+		insist(endpointType, "type", false)
+		getCABundle()
 	default:
 		usage(fmt.Sprintf("Unknown action: %s", *action))
 	}
@@ -68,7 +68,7 @@ func main() {
 		Name:    "oes",
 		Purpose: ca.CertificatePurposeControl,
 	}
-	ca64too, cert64, certPrivKey64, err := authority.GenerateCertificate(name)
+	ca64too, cert64, certPrivKey64, err := authority.GenerateCertificate(name, 0)
 	check(err)
 	if ca64too != ca64 {
 		log.Fatal("Code error, returned CA cert base64 doesn't match generated CA cert")
@@ -131,7 +131,7 @@ func main() {
 			Agent:   *alsoAgentNamed,
 			Purpose: ca.CertificatePurposeAgent,
 		}
-		_, user64, key64, err := authority.GenerateCertificate(name)
+		_, user64, key64, err := authority.GenerateCertificate(name, 0)
 		check(err)
 
 		cert, err := base64.StdEncoding.DecodeString(user64)
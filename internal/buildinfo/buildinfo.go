@@ -0,0 +1,92 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package buildinfo describes how the running binary was built, for the
+// version endpoint.
+package buildinfo
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/OpsMx/go-app-base/version"
+)
+
+// Endpoint is the path the build information is served on.
+const Endpoint = "/version"
+
+// buildTime is set at link time, with
+// -X 'github.com/opsmx/oes-birger/internal/buildinfo.buildTime=...'.
+// If unset, the commit time recorded by the Go toolchain is used.
+var buildTime = ""
+
+// Info is the JSON served on the Endpoint.  Version is the git branch or
+// tag the binary was built from, as reported by version.GitBranch, so it
+// is also returned as GitBranch.
+type Info struct {
+	Version   string `json:"version"`
+	GitHash   string `json:"gitHash"`
+	GitBranch string `json:"gitBranch"`
+	BuildType string `json:"buildType"`
+	GoVersion string `json:"goVersion"`
+	BuildTime string `json:"buildTime,omitempty"`
+}
+
+// Get returns the build information for this binary.
+func Get() Info {
+	return Info{
+		Version:   version.GitBranch(),
+		GitHash:   version.GitHash(),
+		GitBranch: version.GitBranch(),
+		BuildType: version.BuildType(),
+		GoVersion: runtime.Version(),
+		BuildTime: getBuildTime(),
+	}
+}
+
+func getBuildTime() string {
+	if buildTime != "" {
+		return buildTime
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.time" {
+				return setting.Value
+			}
+		}
+	}
+	return ""
+}
+
+// RegisterHandler adds the version endpoint to mux.  It needs no
+// authentication, and the response is built once.
+func RegisterHandler(mux *http.ServeMux) {
+	mux.Handle(Endpoint, handler(Get()))
+}
+
+func handler(info Info) http.Handler {
+	body, _ := json.Marshal(info) // cannot fail
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	})
+}
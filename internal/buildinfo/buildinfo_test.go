@@ -0,0 +1,61 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package buildinfo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/OpsMx/go-app-base/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterHandler(t *testing.T) {
+	saved := buildTime
+	buildTime = "2022-10-01T12:00:00Z"
+	defer func() { buildTime = saved }()
+
+	mux := http.NewServeMux()
+	RegisterHandler(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, Endpoint, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var info Info
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, Info{
+		Version:   version.GitBranch(),
+		GitHash:   version.GitHash(),
+		GitBranch: version.GitBranch(),
+		BuildType: version.BuildType(),
+		GoVersion: runtime.Version(),
+		BuildTime: "2022-10-01T12:00:00Z",
+	}, info)
+	for _, field := range []string{info.Version, info.GitHash, info.GitBranch, info.BuildType, info.GoVersion} {
+		assert.NotEmpty(t, field)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, Endpoint, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
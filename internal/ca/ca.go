@@ -23,14 +23,21 @@ import (
 	"bytes"
 	crand "crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"math/big"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -43,7 +50,7 @@ const (
 
 // CertificateIssuer implements a generic CA
 type CertificateIssuer interface {
-	GenerateCertificate(CertificateName) (string, string, string, error)
+	GenerateCertificate(CertificateName, time.Duration) (string, string, string, error)
 	GetCACert() (string, error)
 }
 
@@ -52,12 +59,30 @@ type CertPoolGenerator interface {
 	MakeCertPool() (*x509.CertPool, error)
 }
 
+// CABundler implements a method to get the CA certificate and its chain, for
+// clients to add to their trust store.
+type CABundler interface {
+	GetCACertBundle() ([]byte, string, error)
+}
+
 //
 // CA holds the state for the certificate authority.
 //
 type CA struct {
 	config *Config
-	caCert tls.Certificate
+
+	// caCert may be replaced when the CA is reloaded from a secret, so
+	// it is only read through current().  The certificates it replaced
+	// are still trusted until the overlap after the reload has passed.
+	sync.RWMutex
+	caCert   tls.Certificate
+	previous []previousCA
+	onReload []func()
+
+	spiffeTrustDomain string
+	trustedCerts      []*x509.Certificate
+
+	serials *serialCounter
 }
 
 //
@@ -67,8 +92,38 @@ type CA struct {
 type Config struct {
 	CACertFile string `yaml:"caCertFile,omitempty" json:"caCertFile,omitempty"`
 	CAKeyFile  string `yaml:"caKeyFile,omitempty" json:"caKeyFile,omitempty"`
+
+	// SPIFFETrustDomain, if set, adds a SPIFFE ID to agent certificates.
+	SPIFFETrustDomain string `yaml:"spiffeTrustDomain,omitempty" json:"spiffeTrustDomain,omitempty"`
+
+	// TrustedCACertFiles are additional CA certificates (PEM, possibly
+	// several per file) trusted when verifying agents, such as a previous
+	// CA while agents are moved to a new one.  They are never used to sign.
+	TrustedCACertFiles []string `yaml:"trustedCACertFiles,omitempty" json:"trustedCACertFiles,omitempty"`
+
+	// CASecretName, if set, is the Kubernetes secret holding the CA
+	// certificate and key (as tls.crt and tls.key), used instead of
+	// CACertFile and CAKeyFile.  See LoadCAFromSecret.
+	CASecretName string `yaml:"caSecretName,omitempty" json:"caSecretName,omitempty"`
+
+	// SecretReloadInterval is how often the CA secret is checked for
+	// changes.  If zero, DefaultSecretReloadInterval is used.
+	SecretReloadInterval time.Duration `yaml:"secretReloadInterval,omitempty" json:"secretReloadInterval,omitempty"`
+
+	// SecretReloadOverlap is how long certificates issued by the previous
+	// CA are still trusted after the CA is reloaded from the secret, so
+	// agents and clients can move to the new CA.  If zero,
+	// DefaultSecretReloadOverlap is used.
+	SecretReloadOverlap time.Duration `yaml:"secretReloadOverlap,omitempty" json:"secretReloadOverlap,omitempty"`
+
+	// SerialFile, if set, holds the last certificate serial number issued,
+	// so serials are never reused across restarts.  It is created if it
+	// does not exist, and must be on writable, persistent storage.
+	SerialFile string `yaml:"serialFile,omitempty" json:"serialFile,omitempty"`
 }
 
+var spiffeTrustDomainRegexp = regexp.MustCompile(`^[a-z0-9._-]+$`)
+
 func (c *Config) applyDefaults() {
 	if len(c.CACertFile) == 0 {
 		c.CACertFile = defaultTLSCertificatePath
@@ -105,9 +160,82 @@ func LoadCAFromFile(c Config) (*CA, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = ca.configure()
+	if err != nil {
+		return nil, err
+	}
 	return ca, nil
 }
 
+// configure applies the settings in c.config which do not depend on where
+// the CA certificate and key were loaded from.
+func (c *CA) configure() error {
+	err := c.SetSPIFFETrustDomain(c.config.SPIFFETrustDomain)
+	if err != nil {
+		return err
+	}
+	c.serials, err = loadSerialCounter(c.config.SerialFile)
+	if err != nil {
+		return err
+	}
+	for _, filename := range c.config.TrustedCACertFiles {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("unable to load trusted CA certificate: %v", err)
+		}
+		err = c.AddTrustedCACerts(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	return nil
+}
+
+//
+// AddTrustedCACerts adds the PEM encoded CA certificates to those trusted
+// when verifying agents.
+//
+func (c *CA) AddTrustedCACerts(certsPEM []byte) error {
+	found := 0
+	for {
+		var block *pem.Block
+		block, certsPEM = pem.Decode(certsPEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		err := ValidateCACert(block.Bytes)
+		if err != nil {
+			return err
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		c.trustedCerts = append(c.trustedCerts, cert)
+		found++
+	}
+	if found == 0 {
+		return fmt.Errorf("no CA certificates found")
+	}
+	return nil
+}
+
+//
+// SetSPIFFETrustDomain sets the trust domain used for the SPIFFE ID
+// (spiffe://<trust domain>/agent/<agent name>) added as a URI SAN to
+// agent certificates.  An empty trust domain disables this.
+//
+func (c *CA) SetSPIFFETrustDomain(trustDomain string) error {
+	if trustDomain != "" && !spiffeTrustDomainRegexp.MatchString(trustDomain) {
+		return fmt.Errorf("invalid SPIFFE trust domain %q", trustDomain)
+	}
+	c.spiffeTrustDomain = trustDomain
+	return nil
+}
+
 //
 // MakeCAFromData does approximately the same thing as LoadCAFromFile() except the CA
 // contents are loaded from PEM strings.
@@ -117,7 +245,7 @@ func MakeCAFromData(certPEM []byte, certPrivKeyPEM []byte) (*CA, error) {
 	if err != nil {
 		return nil, err
 	}
-	ca := &CA{caCert: caCert}
+	ca := &CA{caCert: caCert, serials: &serialCounter{}}
 	err = ValidateCACert(ca.caCert.Certificate[0])
 	if err != nil {
 		return nil, err
@@ -154,7 +282,14 @@ func ValidateCACert(certbytes []byte) error {
 // GetCACertificate returns the public certificate for the CA.
 //
 func (c *CA) GetCACertificate() []byte {
-	return c.caCert.Certificate[0]
+	return c.current().Certificate[0]
+}
+
+// current returns the CA certificate and key in use.
+func (c *CA) current() tls.Certificate {
+	c.RLock()
+	defer c.RUnlock()
+	return c.caCert
 }
 
 func toPEM(data []byte, t string) ([]byte, error) {
@@ -218,9 +353,19 @@ func MakeCertificateAuthority() ([]byte, []byte, error) {
 // with a validity period of 1 year.  The DNS names will be applied.
 //
 func (c *CA) MakeServerCert(names []string) (*tls.Certificate, error) {
+	return c.MakeControllerCert(names, "")
+}
+
+//
+// MakeControllerCert is MakeServerCert, except that if identity is set the
+// certificate also names the controller's identity, which agents read with
+// GetControllerIdentityFromCert to check which controller they connected to.
+//
+func (c *CA) MakeControllerCert(names []string, identity string) (*tls.Certificate, error) {
 	now := time.Now().UTC()
 
-	caCert, err := x509.ParseCertificate(c.caCert.Certificate[0])
+	signer := c.current()
+	caCert, err := x509.ParseCertificate(signer.Certificate[0])
 	if err != nil {
 		return nil, err
 	}
@@ -230,8 +375,13 @@ func (c *CA) MakeServerCert(names []string) (*tls.Certificate, error) {
 		return nil, err
 	}
 
+	serial, err := c.serials.next()
+	if err != nil {
+		return nil, err
+	}
+
 	certTemplate := &x509.Certificate{
-		SerialNumber: big.NewInt(now.UnixNano()),
+		SerialNumber: serial,
 		Subject: pkix.Name{
 			Organization: []string{"OpsMx API Forwarder Server Certificate"},
 			Country:      []string{"US"},
@@ -242,8 +392,15 @@ func (c *CA) MakeServerCert(names []string) (*tls.Certificate, error) {
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		DNSNames:    names,
 	}
+	if identity != "" {
+		jsonName, err := json.Marshal(CertificateName{Name: identity, Purpose: CertificatePurposeController})
+		if err != nil {
+			return nil, err
+		}
+		certTemplate.Subject.OrganizationalUnit = []string{string(jsonName)}
+	}
 
-	certBytes, err := x509.CreateCertificate(crand.Reader, certTemplate, caCert, &certPrivKey.PublicKey, c.caCert.PrivateKey)
+	certBytes, err := x509.CreateCertificate(crand.Reader, certTemplate, caCert, &certPrivKey.PublicKey, signer.PrivateKey)
 	if err != nil {
 		return nil, err
 	}
@@ -279,9 +436,10 @@ type CertificateName struct {
 
 // Certificate purposes, intended to be on CertificateName.Purpose
 const (
-	CertificatePurposeControl = "control"
-	CertificatePurposeAgent   = "agent"
-	CertificatePurposeService = "service"
+	CertificatePurposeControl    = "control"
+	CertificatePurposeAgent      = "agent"
+	CertificatePurposeService    = "service"
+	CertificatePurposeController = "controller"
 )
 
 // GetCertificateNameFromCert extracts the CertificateName from the certificate, or returns
@@ -299,12 +457,58 @@ func GetCertificateNameFromCert(cert *x509.Certificate) (*CertificateName, error
 	return &name, nil
 }
 
+func spiffeID(trustDomain string, agent string) *url.URL {
+	return &url.URL{
+		Scheme: "spiffe",
+		Host:   trustDomain,
+		Path:   "/" + CertificatePurposeAgent + "/" + agent,
+	}
+}
+
+// GetCertificateNameFromCert is GetCertificateNameFromCert, except that a
+// certificate without the JSON OrganizationalUnit is also accepted if it
+// has an agent SPIFFE ID in the CA's trust domain.  IDs in other trust
+// domains, such as those issued by a service mesh, are never accepted.
+func (c *CA) GetCertificateNameFromCert(cert *x509.Certificate) (*CertificateName, error) {
+	if len(cert.Subject.OrganizationalUnit) < 1 && c.spiffeTrustDomain != "" {
+		if name, found := certificateNameFromSPIFFE(cert, c.spiffeTrustDomain); found {
+			return name, nil
+		}
+	}
+	return GetCertificateNameFromCert(cert)
+}
+
+// certificateNameFromSPIFFE returns the agent named by the certificate's
+// SPIFFE ID in the trust domain, if it has one.
+func certificateNameFromSPIFFE(cert *x509.Certificate, trustDomain string) (*CertificateName, bool) {
+	for _, u := range cert.URIs {
+		if u.Scheme != "spiffe" || u.Host != trustDomain {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+		if len(parts) == 2 && parts[0] == CertificatePurposeAgent && parts[1] != "" {
+			return &CertificateName{Agent: parts[1], Purpose: CertificatePurposeAgent}, true
+		}
+	}
+	return nil, false
+}
+
 //
 // GenerateCertificate will make a new certificate, and return a base64 encoded
-// string for the certificate, key, and authority certificate.
+// string for the certificate, key, and authority certificate.  The certificate
+// is valid for ttl, or for one year if ttl is zero.
 //
-func (c *CA) GenerateCertificate(name CertificateName) (string, string, string, error) {
+func (c *CA) GenerateCertificate(name CertificateName, ttl time.Duration) (string, string, string, error) {
+	return c.generateCertificate(name, ttl, c.serials.next)
+}
+
+// generateCertificate issues a certificate with a serial from nextSerial.
+func (c *CA) generateCertificate(name CertificateName, ttl time.Duration, nextSerial func() (*big.Int, error)) (string, string, string, error) {
 	now := time.Now().UTC()
+	notAfter := now.AddDate(1, 0, 0)
+	if ttl > 0 {
+		notAfter = now.Add(ttl)
+	}
 	jsonName, err := json.Marshal(name)
 	if err != nil {
 		return "", "", "", err
@@ -312,17 +516,19 @@ func (c *CA) GenerateCertificate(name CertificateName) (string, string, string,
 	json := string(jsonName)
 	orgName := fmt.Sprintf("OpsMx Tunnel Certificate: %s-%s-%s", name.Agent, name.Name, name.Type)
 	cert := &x509.Certificate{
-		SerialNumber: big.NewInt(now.UnixNano()),
 		Subject: pkix.Name{
 			CommonName:         orgName,
 			Organization:       []string{orgName},
 			OrganizationalUnit: []string{json},
 		},
 		NotBefore:   now,
-		NotAfter:    now.AddDate(1, 0, 0),
+		NotAfter:    notAfter,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		KeyUsage:    x509.KeyUsageDigitalSignature,
 	}
+	if c.spiffeTrustDomain != "" && name.Purpose == CertificatePurposeAgent {
+		cert.URIs = []*url.URL{spiffeID(c.spiffeTrustDomain, name.Agent)}
+	}
 	certPrivKey, err := rsa.GenerateKey(crand.Reader, 2048)
 	if err != nil {
 		return "", "", "", err
@@ -330,17 +536,23 @@ func (c *CA) GenerateCertificate(name CertificateName) (string, string, string,
 
 	// we now have a certificate and private key.  Now, sign the cert with the CA.
 
-	caCert, err := x509.ParseCertificate(c.caCert.Certificate[0])
+	signer := c.current()
+	caCert, err := x509.ParseCertificate(signer.Certificate[0])
+	if err != nil {
+		return "", "", "", err
+	}
+
+	cert.SerialNumber, err = nextSerial()
 	if err != nil {
 		return "", "", "", err
 	}
 
-	certBytes, err := x509.CreateCertificate(crand.Reader, cert, caCert, &certPrivKey.PublicKey, c.caCert.PrivateKey)
+	certBytes, err := x509.CreateCertificate(crand.Reader, cert, caCert, &certPrivKey.PublicKey, signer.PrivateKey)
 	if err != nil {
 		return "", "", "", err
 	}
 
-	ca64, err := c.GetCACert()
+	ca64, err := bytesTo64("CERTIFICATE", signer.Certificate[0])
 	if err != nil {
 		return "", "", "", err
 	}
@@ -358,9 +570,50 @@ func (c *CA) GenerateCertificate(name CertificateName) (string, string, string,
 	return ca64, cert64, certPrivKey64, nil
 }
 
+//
+// DryRunGenerateCertificate runs the same key generation, signing, and
+// encoding as GenerateCertificate, but discards the result and returns only
+// how long it took.  This is intended for measuring issuance capacity, and
+// is deliberately not part of CertificateIssuer, so it is not reachable
+// through the control API.  It does not use up a serial number.
+//
+func (c *CA) DryRunGenerateCertificate(name CertificateName, ttl time.Duration) (time.Duration, error) {
+	start := time.Now()
+	_, _, _, err := c.generateCertificate(name, ttl, func() (*big.Int, error) {
+		return big.NewInt(time.Now().UnixNano()), nil
+	})
+	return time.Since(start), err
+}
+
 // GetCACert returns the authority certificate encoded as base64.
 func (c *CA) GetCACert() (string, error) {
-	return bytesTo64("CERTIFICATE", c.caCert.Certificate[0])
+	return bytesTo64("CERTIFICATE", c.current().Certificate[0])
+}
+
+// GetCACertBundle returns the authority certificate, followed by any
+// intermediate certificates loaded with it, as PEM.  The SHA-256 fingerprint
+// of the authority certificate is also returned.
+func (c *CA) GetCACertBundle() ([]byte, string, error) {
+	caCert := c.current()
+	bundle := &bytes.Buffer{}
+	for _, cert := range caCert.Certificate {
+		err := pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: cert})
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return bundle.Bytes(), Fingerprint(caCert.Certificate[0]), nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a DER encoded certificate,
+// as lower case hex with colons between the bytes.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = hex.EncodeToString([]byte{b})
+	}
+	return strings.Join(parts, ":")
 }
 
 func bytesTo64(prefix string, data []byte) (string, error) {
@@ -372,17 +625,34 @@ func bytesTo64(prefix string, data []byte) (string, error) {
 }
 
 //
-// MakeCertPool will return a certificate pool with our CA installed.
+// MakeCertPool will return a certificate pool with our CA installed, along
+// with any CA it replaced whose overlap has not yet passed.
 //
 func (c *CA) MakeCertPool() (*x509.CertPool, error) {
 	caCertPool := x509.NewCertPool()
-	for _, cert := range c.caCert.Certificate {
-		x, err := x509.ParseCertificate(cert)
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse certificate: %v", err)
+	for _, caCert := range c.trusted(time.Now()) {
+		for _, cert := range caCert.Certificate {
+			x, err := x509.ParseCertificate(cert)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse certificate: %v", err)
+			}
+			caCertPool.AddCert(x)
 		}
-		caCertPool.AddCert(x)
-		caCertPool.AppendCertsFromPEM(cert)
+	}
+	return caCertPool, nil
+}
+
+//
+// MakeAgentCertPool will return a certificate pool with our CA and any
+// additional trusted CAs installed, for verifying agents.
+//
+func (c *CA) MakeAgentCertPool() (*x509.CertPool, error) {
+	caCertPool, err := c.MakeCertPool()
+	if err != nil {
+		return nil, err
+	}
+	for _, cert := range c.trustedCerts {
+		caCertPool.AddCert(cert)
 	}
 	return caCertPool, nil
 }
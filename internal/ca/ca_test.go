@@ -0,0 +1,489 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeTestCA(tb testing.TB) *CA {
+	caCert, caKey, err := MakeCertificateAuthority()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	authority, err := MakeCAFromData(caCert, caKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return authority
+}
+
+func TestCA_DryRunGenerateCertificate(t *testing.T) {
+	authority := makeTestCA(t)
+	beforeSerial := authority.serials.last
+	beforeCert := append([][]byte{}, authority.caCert.Certificate...)
+
+	name := CertificateName{Agent: "agent", Name: "dry-run", Type: "jenkins", Purpose: CertificatePurposeService}
+	elapsed, err := authority.DryRunGenerateCertificate(name, time.Hour)
+	if err != nil {
+		t.Fatalf("DryRunGenerateCertificate() error = %v", err)
+	}
+	if elapsed <= 0 {
+		t.Errorf("DryRunGenerateCertificate() elapsed = %v, want > 0", elapsed)
+	}
+
+	if authority.serials.last != beforeSerial {
+		t.Errorf("DryRunGenerateCertificate() used up a serial number")
+	}
+	if !reflect.DeepEqual(beforeCert, authority.caCert.Certificate) {
+		t.Errorf("DryRunGenerateCertificate() modified the CA certificate")
+	}
+}
+
+func BenchmarkCA_DryRunGenerateCertificate(b *testing.B) {
+	authority := makeTestCA(b)
+	name := CertificateName{Agent: "agent", Name: "bench", Type: "jenkins", Purpose: CertificatePurposeService}
+
+	b.ResetTimer()
+	var total time.Duration
+	for i := 0; i < b.N; i++ {
+		elapsed, err := authority.DryRunGenerateCertificate(name, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		total += elapsed
+	}
+	b.ReportMetric(float64(b.N)/total.Seconds(), "certs/s")
+}
+
+func parseCert64(t *testing.T, cert64 string) *x509.Certificate {
+	certPEM, err := base64.StdEncoding.DecodeString(cert64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("no PEM block found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCA_GenerateCertificate_SPIFFE(t *testing.T) {
+	authority := makeTestCA(t)
+
+	tests := []struct {
+		name        string
+		trustDomain string
+		certName    CertificateName
+		wantURI     string
+	}{
+		{
+			"agent",
+			"example.org",
+			CertificateName{Agent: "agent1", Purpose: CertificatePurposeAgent},
+			"spiffe://example.org/agent/agent1",
+		},
+		{
+			"no trust domain",
+			"",
+			CertificateName{Agent: "agent1", Purpose: CertificatePurposeAgent},
+			"",
+		},
+		{
+			"service certificates are unchanged",
+			"example.org",
+			CertificateName{Agent: "agent1", Name: "jenkins", Type: "jenkins", Purpose: CertificatePurposeService},
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := authority.SetSPIFFETrustDomain(tt.trustDomain); err != nil {
+				t.Fatal(err)
+			}
+			_, cert64, _, err := authority.GenerateCertificate(tt.certName, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert := parseCert64(t, cert64)
+
+			var uris []string
+			for _, u := range cert.URIs {
+				uris = append(uris, u.String())
+			}
+			if tt.wantURI == "" {
+				if len(uris) != 0 {
+					t.Errorf("URIs = %v, want none", uris)
+				}
+			} else if !reflect.DeepEqual(uris, []string{tt.wantURI}) {
+				t.Errorf("URIs = %v, want %s", uris, tt.wantURI)
+			}
+
+			got, err := GetCertificateNameFromCert(cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.certName) {
+				t.Errorf("GetCertificateNameFromCert() = %v, want %v", *got, tt.certName)
+			}
+		})
+	}
+}
+
+func TestCA_GetCertificateNameFromCert_SPIFFEOnly(t *testing.T) {
+	authority := makeTestCA(t)
+	if err := authority.SetSPIFFETrustDomain("example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		uri     string
+		want    *CertificateName
+		wantErr bool
+	}{
+		{"agent", "spiffe://example.org/agent/agent1", &CertificateName{Agent: "agent1", Purpose: CertificatePurposeAgent}, false},
+		{"foreign trust domain", "spiffe://mesh.example.com/agent/agent1", nil, true},
+		{"trust domain suffix", "spiffe://evil.example.org/agent/agent1", nil, true},
+		{"other path", "spiffe://example.org/workload/agent1", nil, true},
+		{"missing agent", "spiffe://example.org/agent/", nil, true},
+		{"not spiffe", "https://example.org/agent/agent1", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := authority.GetCertificateNameFromCert(&x509.Certificate{URIs: []*url.URL{u}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetCertificateNameFromCert() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetCertificateNameFromCert() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetCertificateNameFromCert_SPIFFEIgnored(t *testing.T) {
+	u, err := url.Parse("spiffe://example.org/agent/agent1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &x509.Certificate{URIs: []*url.URL{u}}
+
+	// Without a CA, or a trust domain, the SPIFFE ID is never an identity.
+	if got, err := GetCertificateNameFromCert(cert); err == nil {
+		t.Errorf("GetCertificateNameFromCert() = %v, want an error", got)
+	}
+	authority := makeTestCA(t)
+	if got, err := authority.GetCertificateNameFromCert(cert); err == nil {
+		t.Errorf("GetCertificateNameFromCert() with no trust domain = %v, want an error", got)
+	}
+}
+
+func TestCA_SetSPIFFETrustDomain(t *testing.T) {
+	tests := []struct {
+		trustDomain string
+		wantErr     bool
+	}{
+		{"", false},
+		{"example.org", false},
+		{"prod_cluster-1.example.org", false},
+		{"Example.org", true},
+		{"example.org/path", true},
+		{"spiffe://example.org", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.trustDomain, func(t *testing.T) {
+			c := &CA{}
+			if err := c.SetSPIFFETrustDomain(tt.trustDomain); (err != nil) != tt.wantErr {
+				t.Errorf("SetSPIFFETrustDomain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// agentCertPEM issues an agent certificate from the authority.
+func agentCertPEM(t *testing.T, authority *CA) ([]byte, []byte) {
+	_, cert64, key64, err := authority.GenerateCertificate(CertificateName{Agent: "agent", Purpose: CertificatePurposeAgent}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := base64.StdEncoding.DecodeString(cert64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := base64.StdEncoding.DecodeString(key64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPEM, keyPEM
+}
+
+func agentKeypair(t *testing.T, authority *CA) tls.Certificate {
+	keypair, err := tls.X509KeyPair(agentCertPEM(t, authority))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keypair
+}
+
+// handshake connects a client presenting clientCert to a server which
+// verifies client certificates against clientCAs.
+func handshake(t *testing.T, serverCert tls.Certificate, clientCAs *x509.CertPool, clientCert tls.Certificate) error {
+	return handshakeWithConfig(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}, clientCert)
+}
+
+// handshakeWithConfig connects a client presenting clientCert to a server
+// using serverConfig.
+func handshakeWithConfig(t *testing.T, serverConfig *tls.Config, clientCert tls.Certificate) error {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	server := tls.Server(serverConn, serverConfig)
+	client := tls.Client(clientConn, &tls.Config{
+		Certificates:       []tls.Certificate{clientCert},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+	})
+	go func() {
+		_ = client.Handshake()
+		// Wait for the server's verdict on our certificate.
+		_, _ = client.Read(make([]byte, 1))
+		client.Close()
+	}()
+	return server.Handshake()
+}
+
+func TestLoadCAFromFile_trustedCACertFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, data []byte) string {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	primaryCert, primaryKey, err := MakeCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCert, oldKey, err := MakeCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, otherKey, err := MakeCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authority, err := LoadCAFromFile(Config{
+		CACertFile:         writeFile("ca.crt", primaryCert),
+		CAKeyFile:          writeFile("ca.key", primaryKey),
+		TrustedCACertFiles: []string{writeFile("old.crt", oldCert)},
+	})
+	if err != nil {
+		t.Fatalf("LoadCAFromFile() error = %v", err)
+	}
+	oldAuthority, err := MakeCAFromData(oldCert, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherAuthority, err := MakeCAFromData(otherCert, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert, err := authority.MakeServerCert([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentCAs, err := authority.MakeAgentCertPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		authority *CA
+		wantErr   bool
+	}{
+		{"primary CA", authority, false},
+		{"trusted CA", oldAuthority, false},
+		{"untrusted CA", otherAuthority, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handshake(t, *serverCert, agentCAs, agentKeypair(t, tt.authority))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Agents are issued certificates signed by the primary CA only.
+	agentCert, _ := agentCertPEM(t, authority)
+	block, _ := pem.Decode(agentCert)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, err := x509.ParseCertificate(authority.GetCACertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignatureFrom(primary); err != nil {
+		t.Errorf("certificate not signed by the primary CA: %v", err)
+	}
+
+	// Certificates which are not CAs are rejected.
+	_, err = LoadCAFromFile(Config{
+		CACertFile:         filepath.Join(dir, "ca.crt"),
+		CAKeyFile:          filepath.Join(dir, "ca.key"),
+		TrustedCACertFiles: []string{writeFile("agent.crt", agentCert)},
+	})
+	if err == nil {
+		t.Errorf("LoadCAFromFile() with a non-CA trusted certificate did not fail")
+	}
+}
+
+// makeIntermediateCA returns an authority whose certificate is signed by
+// root, loaded with the root as its chain.
+func makeIntermediateCA(t *testing.T, root *CA) *CA {
+	rootCert, err := x509.ParseCertificate(root.GetCACertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{Organization: []string{"Intermediate CA"}},
+		NotBefore:             now.Add(-10 * time.Second),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, rootCert, &priv.PublicKey, root.caCert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootCert.Raw})...)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	authority, err := MakeCAFromData(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authority
+}
+
+func parseBundle(t *testing.T, bundle []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			t.Errorf("unexpected PEM block type %s", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(bytes.TrimSpace(bundle)) != 0 {
+		t.Errorf("trailing data after PEM bundle: %q", bundle)
+	}
+	return certs
+}
+
+func TestCA_GetCACertBundle(t *testing.T) {
+	root := makeTestCA(t)
+	intermediate := makeIntermediateCA(t, root)
+
+	tests := []struct {
+		name      string
+		authority *CA
+		wantCerts int
+	}{
+		{"root", root, 1},
+		{"intermediate", intermediate, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle, fingerprint, err := tt.authority.GetCACertBundle()
+			if err != nil {
+				t.Fatal(err)
+			}
+			certs := parseBundle(t, bundle)
+			if len(certs) != tt.wantCerts {
+				t.Fatalf("bundle has %d certificates, want %d", len(certs), tt.wantCerts)
+			}
+			if !bytes.Equal(certs[0].Raw, tt.authority.GetCACertificate()) {
+				t.Errorf("first certificate in the bundle is not the CA certificate")
+			}
+			for i := 1; i < len(certs); i++ {
+				if err := certs[i-1].CheckSignatureFrom(certs[i]); err != nil {
+					t.Errorf("certificate %d not signed by the next in the chain: %v", i-1, err)
+				}
+			}
+			sum := sha256.Sum256(certs[0].Raw)
+			if got := strings.ReplaceAll(fingerprint, ":", ""); got != hex.EncodeToString(sum[:]) {
+				t.Errorf("fingerprint = %s, want %x", fingerprint, sum)
+			}
+		})
+	}
+}
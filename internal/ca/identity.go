@@ -0,0 +1,36 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"crypto/x509"
+	"fmt"
+)
+
+// GetControllerIdentityFromCert returns the controller identity named by a
+// server certificate from MakeControllerCert.  The certificate must already
+// have been verified against the CA, such as by the TLS handshake.
+func GetControllerIdentityFromCert(cert *x509.Certificate) (string, error) {
+	name, err := GetCertificateNameFromCert(cert)
+	if err != nil {
+		return "", fmt.Errorf("controller certificate has no identity: %v", err)
+	}
+	if name.Purpose != CertificatePurposeController || name.Name == "" {
+		return "", fmt.Errorf("certificate is not a controller certificate")
+	}
+	return name.Name, nil
+}
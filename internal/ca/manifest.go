@@ -0,0 +1,175 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// ManifestSigner signs agent manifests, so an agent can check that its
+// manifest was made by the controller.
+type ManifestSigner interface {
+	SignManifest(payload []byte) (string, error)
+}
+
+// SignManifest returns a detached signature, base64 encoded, of the
+// payload made with the CA's private key.
+func (c *CA) SignManifest(payload []byte) (string, error) {
+	signer, ok := c.current().PrivateKey.(crypto.Signer)
+	if !ok {
+		return "", fmt.Errorf("CA private key cannot sign")
+	}
+	return signManifest(signer, payload)
+}
+
+// keySigner signs manifests with a key kept only for that, rather than
+// the CA's key.
+type keySigner struct {
+	key crypto.Signer
+}
+
+func (s *keySigner) SignManifest(payload []byte) (string, error) {
+	return signManifest(s.key, payload)
+}
+
+// LoadManifestSigningKey returns a ManifestSigner using the PEM encoded
+// RSA, ECDSA, or Ed25519 private key in filename.
+func LoadManifestSigningKey(filename string) (ManifestSigner, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM private key found", filename)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: %T cannot sign", filename, key)
+	}
+	return &keySigner{key: signer}, nil
+}
+
+// signManifest signs the payload with key.  RSA and ECDSA keys sign a
+// SHA-256 digest of the payload, and Ed25519 keys sign it directly.
+func signManifest(key crypto.Signer, payload []byte) (string, error) {
+	var sig []byte
+	var err error
+	switch key.Public().(type) {
+	case ed25519.PublicKey:
+		sig, err = key.Sign(crand.Reader, payload, crypto.Hash(0))
+	default:
+		digest := sha256.Sum256(payload)
+		sig, err = key.Sign(crand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// ManifestKeysFromCACerts returns the public keys of the CA certificates
+// in caCertsPEM, to verify manifests signed with the CA's key.
+func ManifestKeysFromCACerts(caCertsPEM []byte) ([]crypto.PublicKey, error) {
+	keys := []crypto.PublicKey{}
+	for rest := caCertsPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return keys, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, cert.PublicKey)
+	}
+}
+
+// LoadManifestPublicKey returns the PEM encoded public key in filename, to
+// verify manifests signed with a key loaded by LoadManifestSigningKey.
+func LoadManifestPublicKey(filename string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: no PEM public key found", filename)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return key, nil
+}
+
+// VerifyManifestSignature returns nil if signature is a signature of
+// exactly the payload, made by SignManifest with one of the keys.
+func VerifyManifestSignature(keys []crypto.PublicKey, payload []byte, signature string) error {
+	if signature == "" {
+		return fmt.Errorf("manifest is not signed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("decoding manifest signature: %v", err)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys to verify the manifest with")
+	}
+	digest := sha256.Sum256(payload)
+	for _, key := range keys {
+		var valid bool
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			valid = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+		case *ecdsa.PublicKey:
+			valid = ecdsa.VerifyASN1(key, digest[:], sig)
+		case ed25519.PublicKey:
+			valid = ed25519.Verify(key, payload, sig)
+		}
+		if valid {
+			return nil
+		}
+	}
+	return fmt.Errorf("manifest signature is not valid")
+}
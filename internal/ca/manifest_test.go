@@ -0,0 +1,141 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeManifestKeys writes key, and its public key, as PEM files, and
+// returns their names.
+func writeManifestKeys(t *testing.T, key crypto.Signer) (string, string) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "manifest.key")
+	pubFile := filepath.Join(dir, "manifest.pub")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return keyFile, pubFile
+}
+
+func TestVerifyManifestSignature(t *testing.T) {
+	caCert, caKey, err := MakeCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, err := MakeCAFromData(caCert, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, otherKey, err := MakeCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := MakeCAFromData(otherCert, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKeys, err := ManifestKeysFromCACerts(caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bothKeys, err := ManifestKeysFromCACerts(append(append([]byte{}, otherCert...), caCert...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerFor := func(key crypto.Signer) (ManifestSigner, []crypto.PublicKey) {
+		keyFile, pubFile := writeManifestKeys(t, key)
+		signer, err := LoadManifestSigningKey(keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := LoadManifestPublicKey(pubFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer, []crypto.PublicKey{pub}
+	}
+	ecSigner, ecKeys := signerFor(ecKey)
+	edSigner, edKeys := signerFor(edKey)
+
+	payload := []byte(`{"agentName":"agent1","serverHostname":"controller.local"}`)
+	sign := func(signer ManifestSigner) string {
+		signature, err := signer.SignManifest(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+	signature := sign(authority)
+
+	tests := []struct {
+		name      string
+		keys      []crypto.PublicKey
+		payload   []byte
+		signature string
+		wantErr   bool
+	}{
+		{"valid", caKeys, payload, signature, false},
+		{"valid, one of several CAs", bothKeys, payload, signature, false},
+		{"dedicated ECDSA key", ecKeys, payload, sign(ecSigner), false},
+		{"dedicated Ed25519 key", edKeys, payload, sign(edSigner), false},
+		{"dedicated key, checked with the CA", caKeys, payload, sign(ecSigner), true},
+		{"tampered", caKeys, []byte(`{"agentName":"agent1","serverHostname":"attacker.local"}`), signature, true},
+		{"reformatted", caKeys, []byte(`{"agentName": "agent1", "serverHostname": "controller.local"}`), signature, true},
+		{"unsigned", caKeys, payload, "", true},
+		{"not base64", caKeys, payload, "not base64!", true},
+		{"signed by another CA", caKeys, payload, sign(other), true},
+		{"no keys", nil, payload, signature, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyManifestSignature(tt.keys, tt.payload, tt.signature)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyManifestSignature() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/opsmx/oes-birger/internal/secrets"
+)
+
+// The keys in a CA secret, as used by Kubernetes TLS secrets.
+const (
+	SecretCertificateKey = "tls.crt"
+	SecretKeyKey         = "tls.key"
+)
+
+// DefaultSecretReloadInterval is how often the CA secret is checked for
+// changes, if Config.SecretReloadInterval is not set.
+const DefaultSecretReloadInterval = time.Minute
+
+// DefaultSecretReloadOverlap is how long the previous CA is still trusted
+// after a reload, if Config.SecretReloadOverlap is not set.
+const DefaultSecretReloadOverlap = 24 * time.Hour
+
+// previousCA is a CA replaced by a reload, trusted until the overlap
+// has passed.
+type previousCA struct {
+	cert  tls.Certificate
+	until time.Time
+}
+
+// LoadCAFromSecret will load an existing authority from the secret named by
+// c.CASecretName, rather than from files.  Use WatchSecret to pick up
+// changes to the secret.
+func LoadCAFromSecret(c Config, loader secrets.SecretLoader) (*CA, error) {
+	if c.CASecretName == "" {
+		return nil, fmt.Errorf("no CA secret name")
+	}
+	if loader == nil {
+		return nil, fmt.Errorf("no secret loader for CA secret %s", c.CASecretName)
+	}
+
+	caCert, err := loadSecretKeyPair(loader, c.CASecretName)
+	if err != nil {
+		return nil, err
+	}
+	ca := &CA{
+		config: &c,
+		caCert: caCert,
+	}
+	err = ca.configure()
+	if err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// loadSecretKeyPair fetches and validates the CA certificate and key held
+// in the named secret.
+func loadSecretKeyPair(loader secrets.SecretLoader, name string) (tls.Certificate, error) {
+	secret, err := loader.GetSecret(name)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("unable to load CA secret %s: %v", name, err)
+	}
+	certPEM, found := (*secret)[SecretCertificateKey]
+	if !found {
+		return tls.Certificate{}, fmt.Errorf("CA secret %s has no %s", name, SecretCertificateKey)
+	}
+	keyPEM, found := (*secret)[SecretKeyKey]
+	if !found {
+		return tls.Certificate{}, fmt.Errorf("CA secret %s has no %s", name, SecretKeyKey)
+	}
+	caCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("unable to load CA cetificate or key from secret %s: %v", name, err)
+	}
+	err = ValidateCACert(caCert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return caCert, nil
+}
+
+// ReloadFromSecret loads the CA secret again and, if the certificate or key
+// has changed, uses it for all further issuance.  It returns true if the
+// CA was replaced, after calling the functions registered with OnReload.
+// Certificates issued by the previous CA are still trusted until
+// Config.SecretReloadOverlap has passed.  Connections which have already
+// been verified are unaffected.  If the secret cannot be loaded, or does
+// not hold a usable CA, the current CA is kept.
+func (c *CA) ReloadFromSecret(loader secrets.SecretLoader) (bool, error) {
+	caCert, err := loadSecretKeyPair(loader, c.config.CASecretName)
+	if err != nil {
+		return false, err
+	}
+	overlap := c.config.SecretReloadOverlap
+	if overlap <= 0 {
+		overlap = DefaultSecretReloadOverlap
+	}
+
+	c.Lock()
+	if sameKeyPair(c.caCert, caCert) {
+		c.Unlock()
+		return false, nil
+	}
+	now := time.Now()
+	previous := []previousCA{{cert: c.caCert, until: now.Add(overlap)}}
+	for _, p := range c.previous {
+		if now.Before(p.until) && !sameKeyPair(p.cert, caCert) {
+			previous = append(previous, p)
+		}
+	}
+	c.previous = previous
+	c.caCert = caCert
+	onReload := c.onReload
+	c.Unlock()
+
+	for _, f := range onReload {
+		f()
+	}
+	return true, nil
+}
+
+// OnReload registers f to be called each time the CA is replaced by
+// ReloadFromSecret, such as to issue a new server certificate.
+func (c *CA) OnReload(f func()) {
+	c.Lock()
+	defer c.Unlock()
+	c.onReload = append(c.onReload, f)
+}
+
+// trusted returns the current CA, and the previous ones whose overlap has
+// not passed at now.
+func (c *CA) trusted(now time.Time) []tls.Certificate {
+	c.RLock()
+	defer c.RUnlock()
+	certs := []tls.Certificate{c.caCert}
+	for _, p := range c.previous {
+		if now.Before(p.until) {
+			certs = append(certs, p.cert)
+		}
+	}
+	return certs
+}
+
+func sameKeyPair(a tls.Certificate, b tls.Certificate) bool {
+	if len(a.Certificate) != len(b.Certificate) {
+		return false
+	}
+	for i := range a.Certificate {
+		if !bytes.Equal(a.Certificate[i], b.Certificate[i]) {
+			return false
+		}
+	}
+	type equaler interface {
+		Equal(x crypto.PrivateKey) bool
+	}
+	key, ok := a.PrivateKey.(equaler)
+	return ok && key.Equal(b.PrivateKey)
+}
+
+// WatchSecret checks the CA secret for changes every
+// Config.SecretReloadInterval, and reloads the CA when it changes, until
+// ctx is done.
+func (c *CA) WatchSecret(ctx context.Context, loader secrets.SecretLoader) {
+	interval := c.config.SecretReloadInterval
+	if interval <= 0 {
+		interval = DefaultSecretReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := c.ReloadFromSecret(loader)
+			if err != nil {
+				zap.S().Warnw("cannot reload CA secret, keeping the current CA",
+					"secret", c.config.CASecretName, "error", err)
+				continue
+			}
+			if reloaded {
+				zap.S().Infow("reloaded CA from secret", "secret", c.config.CASecretName)
+			}
+		}
+	}
+}
+
+// ReloadingClientCAs makes tlsConfig verify client certificates against
+// the current pool from pools on each handshake, rather than a pool fixed
+// when the server started, so a reloaded CA is used for new connections.
+// tlsConfig is copied as it is at each handshake, so changes made after
+// this call, such as the ALPN protocols HTTP/2 adds when it is configured,
+// still apply.  net/http only adds its default protocols to its own copy
+// of the config, which the copy returned here replaces, so if tlsConfig
+// offers none, h2 and http/1.1 are offered as net/http would.
+func ReloadingClientCAs(tlsConfig *tls.Config, pools CertPoolGenerator) *tls.Config {
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		certPool, err := pools.MakeCertPool()
+		if err != nil {
+			return nil, err
+		}
+		config := tlsConfig.Clone()
+		config.GetConfigForClient = nil
+		config.ClientCAs = certPool
+		return config, nil
+	}
+	return tlsConfig
+}
@@ -0,0 +1,292 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/opsmx/oes-birger/internal/secrets"
+)
+
+func caSecret(name string, certPEM []byte, keyPEM []byte) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns1"},
+		Type:       v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			SecretCertificateKey: certPEM,
+			SecretKeyKey:         keyPEM,
+		},
+	}
+}
+
+// fakeCASecret holds a CA secret in a fake Kubernetes clientset, which can
+// be replaced to simulate rotation.
+type fakeCASecret struct {
+	clientset *fake.Clientset
+	loader    secrets.SecretLoader
+}
+
+func makeFakeCASecret(t *testing.T) (*fakeCASecret, string) {
+	certPEM, keyPEM, err := MakeCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientset := fake.NewSimpleClientset(caSecret("forwarder-ca", certPEM, keyPEM))
+	return &fakeCASecret{
+		clientset: clientset,
+		loader:    secrets.MakeKubernetesSecretLoaderFromClientset("ns1", clientset),
+	}, "forwarder-ca"
+}
+
+// rotate replaces the secret with a new CA, and returns it.
+func (f *fakeCASecret) rotate(t *testing.T) *CA {
+	certPEM, keyPEM, err := MakeCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.update(t, caSecret("forwarder-ca", certPEM, keyPEM))
+	authority, err := MakeCAFromData(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authority
+}
+
+func (f *fakeCASecret) update(t *testing.T, secret *v1.Secret) {
+	_, err := f.clientset.CoreV1().Secrets("ns1").Update(context.Background(), secret, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadCAFromSecret(t *testing.T) {
+	secret, name := makeFakeCASecret(t)
+
+	authority, err := LoadCAFromSecret(Config{CASecretName: name}, secret.loader)
+	if err != nil {
+		t.Fatalf("LoadCAFromSecret() error = %v", err)
+	}
+
+	roots, err := authority.MakeCertPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := authority.MakeServerCert([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, *serverCert, roots, agentKeypair(t, authority)); err != nil {
+		t.Errorf("expected a certificate issued by the CA to be accepted: %v", err)
+	}
+}
+
+func TestLoadCAFromSecret_errors(t *testing.T) {
+	certPEM, keyPEM, err := MakeCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	missingKey := caSecret("missing-key", certPEM, nil)
+	delete(missingKey.Data, SecretKeyKey)
+	loader := secrets.MakeKubernetesSecretLoaderFromClientset("ns1", fake.NewSimpleClientset(
+		missingKey,
+		caSecret("not-a-ca", []byte("junk"), keyPEM),
+	))
+
+	tests := []struct {
+		name   string
+		config Config
+		loader secrets.SecretLoader
+	}{
+		{"no secret name", Config{}, loader},
+		{"no loader", Config{CASecretName: "missing-key"}, nil},
+		{"no such secret", Config{CASecretName: "nonexistent"}, loader},
+		{"missing key", Config{CASecretName: "missing-key"}, loader},
+		{"not a CA", Config{CASecretName: "not-a-ca"}, loader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadCAFromSecret(tt.config, tt.loader); err == nil {
+				t.Error("LoadCAFromSecret() expected an error")
+			}
+		})
+	}
+}
+
+func TestCA_ReloadFromSecret(t *testing.T) {
+	secret, name := makeFakeCASecret(t)
+	authority, err := LoadCAFromSecret(Config{CASecretName: name}, secret.loader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := authority.MakeServerCert([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := ReloadingClientCAs(&tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}, authority)
+	oldAgent := agentKeypair(t, authority)
+	reloads := 0
+	authority.OnReload(func() { reloads++ })
+
+	reloaded, err := authority.ReloadFromSecret(secret.loader)
+	if err != nil || reloaded {
+		t.Fatalf("ReloadFromSecret() of an unchanged secret = %v, %v, want false, nil", reloaded, err)
+	}
+	if reloads != 0 {
+		t.Errorf("OnReload functions called %d times for an unchanged secret", reloads)
+	}
+
+	rotated := secret.rotate(t)
+	reloaded, err = authority.ReloadFromSecret(secret.loader)
+	if err != nil || !reloaded {
+		t.Fatalf("ReloadFromSecret() of a changed secret = %v, %v, want true, nil", reloaded, err)
+	}
+	if reloads != 1 {
+		t.Errorf("OnReload functions called %d times, want 1", reloads)
+	}
+
+	got, err := authority.GetCACert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := rotated.GetCACert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Error("GetCACert() did not return the reloaded CA")
+	}
+	if err := handshakeWithConfig(t, serverConfig, agentKeypair(t, authority)); err != nil {
+		t.Errorf("expected a certificate issued by the reloaded CA to be accepted: %v", err)
+	}
+	if err := handshakeWithConfig(t, serverConfig, oldAgent); err != nil {
+		t.Errorf("expected a certificate issued by the previous CA to be accepted during the overlap: %v", err)
+	}
+
+	// Once the overlap has passed, only the reloaded CA is trusted.
+	authority.Lock()
+	for i := range authority.previous {
+		authority.previous[i].until = time.Now().Add(-time.Second)
+	}
+	authority.Unlock()
+	if err := handshakeWithConfig(t, serverConfig, oldAgent); err == nil {
+		t.Error("expected a certificate issued by the previous CA to be rejected after the overlap")
+	}
+	if err := handshakeWithConfig(t, serverConfig, agentKeypair(t, authority)); err != nil {
+		t.Errorf("expected a certificate issued by the reloaded CA to be accepted: %v", err)
+	}
+
+	secret.update(t, caSecret(name, []byte("junk"), []byte("junk")))
+	if _, err := authority.ReloadFromSecret(secret.loader); err == nil {
+		t.Error("ReloadFromSecret() of a broken secret expected an error")
+	}
+	got, err = authority.GetCACert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Error("a broken secret replaced the CA")
+	}
+}
+
+func TestCA_WatchSecret(t *testing.T) {
+	secret, name := makeFakeCASecret(t)
+	authority, err := LoadCAFromSecret(Config{CASecretName: name, SecretReloadInterval: 10 * time.Millisecond}, secret.loader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go authority.WatchSecret(ctx, secret.loader)
+
+	want, err := secret.rotate(t).GetCACert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := authority.GetCACert()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("WatchSecret() did not reload the changed secret")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadingClientCAs_keepsALPN(t *testing.T) {
+	secret, name := makeFakeCASecret(t)
+	authority, err := LoadCAFromSecret(Config{CASecretName: name}, secret.loader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := authority.MakeServerCert([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := authority.MakeCertPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	server.TLS = ReloadingClientCAs(&tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}, authority)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	for _, protocol := range []string{"h2", "http/1.1"} {
+		t.Run(protocol, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+				RootCAs:    roots,
+				ServerName: "localhost",
+				NextProtos: []string{protocol},
+				MinVersion: tls.VersionTLS12,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := conn.ConnectionState().NegotiatedProtocol; got != protocol {
+				t.Errorf("negotiated protocol %q, want %q", got, protocol)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serialCounter hands out certificate serial numbers which only increase.
+// Each is the current time in nanoseconds, or one more than the last if
+// that is not later, so serials stay unique when issued concurrently or
+// when the clock steps back.  If file is set, each serial is written to it
+// before it is used, and the counter resumes from it after a restart.
+type serialCounter struct {
+	sync.Mutex
+	file string
+	last int64
+}
+
+// loadSerialCounter returns a counter which resumes from the serial saved
+// in file, if it exists.  An empty file name keeps the counter in memory.
+func loadSerialCounter(file string) (*serialCounter, error) {
+	s := &serialCounter{file: file}
+	if file == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load serial file: %v", err)
+	}
+	s.last, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || s.last < 0 {
+		return nil, fmt.Errorf("serial file %s does not hold a serial number", file)
+	}
+	return s, nil
+}
+
+// next returns a serial number which has not been returned before.
+func (s *serialCounter) next() (*big.Int, error) {
+	s.Lock()
+	defer s.Unlock()
+	serial := time.Now().UnixNano()
+	if serial <= s.last {
+		serial = s.last + 1
+	}
+	if s.file != "" {
+		if err := writeFileAtomic(s.file, []byte(strconv.FormatInt(serial, 10)+"\n")); err != nil {
+			return nil, fmt.Errorf("unable to save serial: %v", err)
+		}
+	}
+	s.last = serial
+	return big.NewInt(serial), nil
+}
+
+// writeFileAtomic replaces the file with data, so a crash leaves either
+// the old or the new contents.
+func writeFileAtomic(file string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
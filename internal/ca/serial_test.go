@@ -0,0 +1,189 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestCA writes a new authority to dir, and returns a config for it
+// which saves serials in dir.
+func writeTestCA(t *testing.T, dir string) Config {
+	caCert, caKey, err := MakeCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		CACertFile: filepath.Join(dir, "tls.crt"),
+		CAKeyFile:  filepath.Join(dir, "tls.key"),
+		SerialFile: filepath.Join(dir, "serial"),
+	}
+	if err := os.WriteFile(config.CACertFile, caCert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.CAKeyFile, caKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func issuedSerial(t *testing.T, authority *CA) *big.Int {
+	_, cert64, _, err := authority.GenerateCertificate(CertificateName{Agent: "agent", Purpose: CertificatePurposeAgent}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certSerial(t, cert64)
+}
+
+func certSerial(t *testing.T, cert64 string) *big.Int {
+	certPEM, err := base64.StdEncoding.DecodeString(cert64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.SerialNumber
+}
+
+func TestCA_GenerateCertificate_concurrentSerials(t *testing.T) {
+	authority := makeTestCA(t)
+	const count = 16
+	certs := make(chan string, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, cert64, _, err := authority.GenerateCertificate(CertificateName{Agent: "agent", Purpose: CertificatePurposeAgent}, time.Hour)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			certs <- cert64
+		}()
+	}
+	wg.Wait()
+	close(certs)
+	seen := map[string]bool{}
+	for cert64 := range certs {
+		serial := certSerial(t, cert64).String()
+		if seen[serial] {
+			t.Errorf("serial %s issued twice", serial)
+		}
+		seen[serial] = true
+	}
+	if len(seen) != count {
+		t.Errorf("got %d serials, want %d", len(seen), count)
+	}
+}
+
+func TestSerialCounter_next(t *testing.T) {
+	s := &serialCounter{}
+	const count = 1000
+	serials := make(chan int64, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serial, err := s.next()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			serials <- serial.Int64()
+		}()
+	}
+	wg.Wait()
+	close(serials)
+	seen := map[int64]bool{}
+	for serial := range serials {
+		if seen[serial] {
+			t.Errorf("serial %d returned twice", serial)
+		}
+		seen[serial] = true
+	}
+
+	// A serial ahead of the clock is still followed by a larger one.
+	s.last = math.MaxInt64 - 1
+	serial, err := s.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial.Int64() != math.MaxInt64 {
+		t.Errorf("next() = %d, want %d", serial, int64(math.MaxInt64))
+	}
+}
+
+func TestLoadCAFromFile_serialFile(t *testing.T) {
+	dir := t.TempDir()
+	config := writeTestCA(t, dir)
+
+	authority, err := LoadCAFromFile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := issuedSerial(t, authority)
+	data, err := os.ReadFile(config.SerialFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); got != first.String() {
+		t.Errorf("serial file holds %s, want %s", got, first)
+	}
+
+	// Pretend a serial far ahead of the clock was issued before a restart.
+	ahead := time.Now().Add(24 * time.Hour).UnixNano()
+	if err := os.WriteFile(config.SerialFile, []byte(big.NewInt(ahead).String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authority, err = LoadCAFromFile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := issuedSerial(t, authority); got.Int64() != ahead+1 {
+		t.Errorf("serial after reload = %s, want %d", got, ahead+1)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("temporary files left in %s: %v", dir, entries)
+	}
+
+	if err := os.WriteFile(config.SerialFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCAFromFile(config); err == nil || !strings.Contains(err.Error(), "does not hold a serial number") {
+		t.Errorf("LoadCAFromFile() error = %v, want a bad serial file error", err)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// DefaultClockSkew is how far the clocks of a peer and the controller may
+// disagree when checking a certificate's validity period, if no other
+// allowance is configured.
+const DefaultClockSkew = time.Minute
+
+// VerifyClientWithClockSkew returns a function for tls.Config's
+// VerifyPeerCertificate which verifies a client's certificate chain
+// against roots, as tls.RequireAndVerifyClientCert would, except that a
+// certificate which is not yet valid, or has expired, by no more than skew
+// is accepted.  It is used with tls.RequireAnyClientCert, which leaves all
+// verification to it.
+func VerifyClientWithClockSkew(roots *x509.CertPool, skew time.Duration) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return verifyClientWithClockSkew(roots, skew, time.Now(), rawCerts)
+	}
+}
+
+// VerifyAgentWithClockSkew is VerifyClientWithClockSkew, except that
+// agents are verified against the authority's current agent certificate
+// pool on each handshake, so a reloaded CA is used for new connections.
+func (c *CA) VerifyAgentWithClockSkew(skew time.Duration) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		roots, err := c.MakeAgentCertPool()
+		if err != nil {
+			return err
+		}
+		return verifyClientWithClockSkew(roots, skew, time.Now(), rawCerts)
+	}
+}
+
+func verifyClientWithClockSkew(roots *x509.CertPool, skew time.Duration, now time.Time, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("parsing client certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   skewedTime(certs[0], now, skew),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// skewedTime returns the time to verify cert at: now, moved by up to skew
+// into its validity period if it is just outside it.
+func skewedTime(cert *x509.Certificate, now time.Time, skew time.Duration) time.Time {
+	if now.Before(cert.NotBefore) && !now.Add(skew).Before(cert.NotBefore) {
+		return cert.NotBefore
+	}
+	if now.After(cert.NotAfter) && !now.Add(-skew).After(cert.NotAfter) {
+		return cert.NotAfter
+	}
+	return now
+}
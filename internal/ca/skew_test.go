@@ -0,0 +1,137 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// agentCertValidFor issues an agent certificate from authority valid from
+// notBefore until notAfter.
+func agentCertValidFor(t *testing.T, authority *CA, notBefore time.Time, notAfter time.Time) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(authority.caCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "agent"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, caCert, &key.PublicKey, authority.caCert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestVerifyClientWithClockSkew(t *testing.T) {
+	authority := makeTestCA(t)
+	roots, err := authority.MakeAgentCertPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Later than now, so the checks stay within the CA's validity.
+	now := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name      string
+		notBefore time.Time
+		notAfter  time.Time
+		skew      time.Duration
+		wantErr   bool
+	}{
+		{"valid", now.Add(-time.Hour), now.Add(time.Hour), time.Minute, false},
+		{"not yet valid, inside skew", now.Add(30 * time.Second), now.Add(time.Hour), time.Minute, false},
+		{"not yet valid, at skew", now.Add(time.Minute), now.Add(time.Hour), time.Minute, false},
+		{"not yet valid, outside skew", now.Add(2 * time.Minute), now.Add(time.Hour), time.Minute, true},
+		{"expired, inside skew", now.Add(-time.Hour), now.Add(-30 * time.Second), time.Minute, false},
+		{"expired, outside skew", now.Add(-time.Hour), now.Add(-2 * time.Minute), time.Minute, true},
+		{"no skew", now.Add(time.Second), now.Add(time.Hour), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := agentCertValidFor(t, authority, tt.notBefore, tt.notAfter)
+			err := verifyClientWithClockSkew(roots, tt.skew, now, cert.Certificate)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyClientWithClockSkew() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyClientWithClockSkew_untrusted(t *testing.T) {
+	authority := makeTestCA(t)
+	roots, err := makeTestCA(t).MakeAgentCertPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := VerifyClientWithClockSkew(roots, DefaultClockSkew)
+
+	cert := agentCertValidFor(t, authority, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err := verify(cert.Certificate, nil); err == nil {
+		t.Error("expected a certificate from another CA to be rejected")
+	}
+	if err := verify(nil, nil); err == nil {
+		t.Error("expected no certificate to be rejected")
+	}
+	if err := verify([][]byte{[]byte("junk")}, nil); err == nil {
+		t.Error("expected a malformed certificate to be rejected")
+	}
+}
+
+func TestVerifyClientWithClockSkew_handshake(t *testing.T) {
+	authority := makeTestCA(t)
+	roots, err := authority.MakeAgentCertPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := authority.MakeServerCert([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Issued by a controller whose clock is a little ahead.
+	clientCert := agentCertValidFor(t, authority, time.Now().Add(20*time.Second), time.Now().Add(time.Hour))
+
+	if err := handshake(t, *serverCert, roots, clientCert); err == nil {
+		t.Error("expected the standard verification to reject the certificate")
+	}
+	err = handshakeWithConfig(t, &tls.Config{
+		Certificates:          []tls.Certificate{*serverCert},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: VerifyClientWithClockSkew(roots, DefaultClockSkew),
+		MinVersion:            tls.VersionTLS13,
+	}, clientCert)
+	if err != nil {
+		t.Errorf("expected the certificate to be accepted within the clock skew: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package debugserver implements opt-in HTTP endpoints which help debug
+// agent connectivity.  These expose internal state, and must only be
+// enabled on request.
+package debugserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+)
+
+// RoutesEndpoint is the path the connected routes are rendered on.
+const RoutesEndpoint = "/debug/routes"
+
+// StatisticsReporter returns statistics for all connected routes, as
+// tunnelroute.ConnectedRoutes does.
+type StatisticsReporter interface {
+	GetStatistics() interface{}
+}
+
+// Register adds the debug endpoints to mux, wrapped by middleware, but only
+// if enabled is true.
+func Register(mux *http.ServeMux, enabled bool, middleware func(http.Handler) http.Handler, routes StatisticsReporter) {
+	if !enabled {
+		return
+	}
+	mux.Handle(RoutesEndpoint, middleware(routesHandler(routes)))
+}
+
+func routesHandler(routes StatisticsReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		writeRoutes(w, routes.GetStatistics())
+	})
+}
+
+func formatTimestamp(ts uint64) string {
+	if ts == 0 {
+		return "never"
+	}
+	return time.UnixMilli(int64(ts)).UTC().Format(time.RFC3339)
+}
+
+func writeRoutes(w io.Writer, stats interface{}) {
+	list, _ := stats.([]interface{})
+	sort.SliceStable(list, func(i, j int) bool {
+		return sortKey(list[i]) < sortKey(list[j])
+	})
+	fmt.Fprintf(w, "%d connected routes\n", len(list))
+	for _, item := range list {
+		fmt.Fprintln(w)
+		switch route := item.(type) {
+		case *tunnelroute.DirectlyConnectedRouteStatistics:
+			writeDirectRoute(w, route)
+		default:
+			b, err := json.MarshalIndent(route, "", "  ")
+			if err != nil {
+				fmt.Fprintf(w, "unprintable route: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(w, "%s\n", b)
+		}
+	}
+}
+
+func sortKey(item interface{}) string {
+	if route, ok := item.(*tunnelroute.DirectlyConnectedRouteStatistics); ok {
+		return route.Name + "/" + route.Session
+	}
+	return ""
+}
+
+func writeDirectRoute(w io.Writer, route *tunnelroute.DirectlyConnectedRouteStatistics) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "route:\t%s\n", route.Name)
+	fmt.Fprintf(tw, "session:\t%s\n", route.Session)
+	fmt.Fprintf(tw, "connection type:\t%s\n", route.ConnectionType)
+	fmt.Fprintf(tw, "version:\t%s\n", route.Version)
+	fmt.Fprintf(tw, "hostname:\t%s\n", route.Hostname)
+	fmt.Fprintf(tw, "connected at:\t%s\n", formatTimestamp(route.ConnectedAt))
+	fmt.Fprintf(tw, "last ping:\t%s\n", formatTimestamp(route.LastPing))
+	fmt.Fprintf(tw, "last use:\t%s\n", formatTimestamp(route.LastUse))
+	fmt.Fprintf(tw, "in-flight requests:\t%d\n", route.InFlight)
+	fmt.Fprintf(tw, "endpoints:\t%d\n", len(route.Endpoints))
+	for _, ep := range route.Endpoints {
+		details := []string{fmt.Sprintf("configured=%v", ep.Configured)}
+		if len(ep.Namespaces) > 0 {
+			details = append(details, "namespaces="+strings.Join(ep.Namespaces, ","))
+		}
+		if ep.AccountID != "" {
+			details = append(details, "accountId="+ep.AccountID)
+		}
+		if ep.AssumeRole != "" {
+			details = append(details, "assumeRole="+ep.AssumeRole)
+		}
+		if ep.Unhealthy {
+			details = append(details, fmt.Sprintf("unhealthy=%q", ep.UnhealthyReason))
+		}
+		fmt.Fprintf(tw, "  %s/%s\t%s\n", ep.Type, ep.Name, strings.Join(details, " "))
+	}
+	tw.Flush()
+}
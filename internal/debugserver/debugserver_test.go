@@ -0,0 +1,91 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debugserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeInFlight int
+
+func (f fakeInFlight) Len() int { return int(f) }
+
+func (f fakeInFlight) IDs() []string { return make([]string, f) }
+
+func makeRoutes() *tunnelroute.ConnectedRoutes {
+	routes := tunnelroute.MakeRoutes()
+	route := &tunnelroute.DirectlyConnectedRoute{
+		Name:     "agent1",
+		Session:  "session1",
+		Version:  "v1.2.3",
+		InFlight: fakeInFlight(3),
+		Endpoints: []tunnelroute.Endpoint{
+			{Type: "kubernetes", Name: "k8s", Configured: true, Namespaces: []string{"ns1", "ns2"}},
+			{Type: "jenkins", Name: "ci", Configured: true},
+		},
+	}
+	route.SetEndpointHealth("jenkins", "ci", false, "connection refused")
+	routes.Add(route)
+	return routes
+}
+
+func noMiddleware(h http.Handler) http.Handler { return h }
+
+func TestRegister_disabled(t *testing.T) {
+	mux := http.NewServeMux()
+	Register(mux, false, noMiddleware, makeRoutes())
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, RoutesEndpoint, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRegister_enabled(t *testing.T) {
+	mux := http.NewServeMux()
+	Register(mux, true, noMiddleware, makeRoutes())
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, RoutesEndpoint, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, "1 connected routes")
+	assert.Contains(t, body, "agent1")
+	assert.Contains(t, body, "session1")
+	assert.Contains(t, body, "v1.2.3")
+	assert.Regexp(t, `in-flight requests:\s+3`, body)
+	assert.Regexp(t, `kubernetes/k8s\s+configured=true namespaces=ns1,ns2\n`, body)
+	assert.Regexp(t, `jenkins/ci\s+configured=true unhealthy="connection refused"`, body)
+}
+
+func TestRegister_middleware(t *testing.T) {
+	deny := func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		})
+	}
+	mux := http.NewServeMux()
+	Register(mux, true, deny, makeRoutes())
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, RoutesEndpoint, nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
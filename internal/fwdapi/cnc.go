@@ -20,20 +20,39 @@ package fwdapi
 
 // Endpoint paths
 const (
-	KubeconfigEndpoint = "/api/v1/generateKubectlComponents"
-	ManifestEndpoint   = "/api/v1/generateAgentManifestComponents"
-	ServiceEndpoint    = "/api/v1/generateServiceCredentials"
-	StatisticsEndpoint = "/api/v1/getAgentStatistics"
-	ControlEndpoint    = "/api/v1/generateControlCredentials"
+	KubeconfigEndpoint        = "/api/v1/generateKubectlComponents"
+	KubeconfigPreviewEndpoint = "/api/v1/previewKubectlComponents"
+	ManifestEndpoint          = "/api/v1/generateAgentManifestComponents"
+	ServiceEndpoint           = "/api/v1/generateServiceCredentials"
+	BatchEndpoint             = "/api/v1/generateCredentialsBatch"
+	StatisticsEndpoint        = "/api/v1/getAgentStatistics"
+	ControlEndpoint           = "/api/v1/generateControlCredentials"
+	ServiceKeysEndpoint       = "/api/v1/rotateServiceKeys"
+	DrainEndpoint             = "/api/v1/drain"
+	AdvertiseRoutesEndpoint   = "/api/v1/advertiseRoutes"
+	CAEndpoint                = "/api/v1/ca"
+	EndpointsEndpoint         = "/api/v1/endpoints"
 )
 
-// KubeConfigRequest defines the request for the KubeconfigEndpoint
+// CAFingerprintHeader is set on responses from the CAEndpoint to the SHA-256
+// fingerprint of the CA certificate, as hex with colons between the bytes.
+const CAFingerprintHeader = "X-CA-Fingerprint-SHA256"
+
+// KubeConfigRequest defines the request for the KubeconfigEndpoint and
+// the KubeconfigPreviewEndpoint.
+// TTL, if set, is a duration such as "24h" requesting a shorter
+// certificate lifetime than the controller's maximum.
 type KubeConfigRequest struct {
 	AgentName string `json:"agentName,omitempty"`
 	Name      string `json:"name,omitempty"`
+	TTL       string `json:"ttl,omitempty"`
 }
 
-// KubeConfigResponse defines the response for the KubeconfigEndpoint
+// KubeConfigResponse defines the response for the KubeconfigEndpoint.
+// NotAfter is when the certificate expires, in milliseconds since the epoch.
+// The KubeconfigPreviewEndpoint returns the same shape with UserCertificate
+// and UserKey empty, and NotAfter set to when a certificate issued now
+// would expire.
 type KubeConfigResponse struct {
 	AgentName       string `json:"agentName,omitempty"`
 	Name            string `json:"name,omitempty"`
@@ -41,11 +60,14 @@ type KubeConfigResponse struct {
 	UserCertificate string `json:"userCertificate,omitempty"`
 	UserKey         string `json:"userKey,omitempty"`
 	CACert          string `json:"caCert,omitempty"`
+	NotAfter        uint64 `json:"notAfter,omitempty"`
 }
 
-// ManifestRequest defines the request for the ManifestEndpoint
+// ManifestRequest defines the request for the ManifestEndpoint.
+// TTL is as for KubeConfigRequest.
 type ManifestRequest struct {
 	AgentName string `json:"agentName,omitempty"`
+	TTL       string `json:"ttl,omitempty"`
 }
 
 // ManifestResponse defines the response for the ManifestEndpoint
@@ -57,15 +79,34 @@ type ManifestResponse struct {
 	AgentVersion     string `json:"agentVersion,omitempty"`
 	AgentKey         string `json:"agentKey,omitempty"`
 	CACert           string `json:"caCert,omitempty"`
+	NotAfter         uint64 `json:"notAfter,omitempty"`
+
+	// SignedManifest and Signature are set if the controller signs
+	// manifests.  SignedManifest is the manifest's JSON, base64 encoded,
+	// and Signature is a detached signature of exactly those bytes, so
+	// an agent checking the signature uses the signed copy and ignores
+	// the fields above.
+	SignedManifest string `json:"signedManifest,omitempty"`
+	Signature      string `json:"signature,omitempty"`
 }
 
 // StatisticsResponse defines the response for the StatisticsEndpoint
 type StatisticsResponse struct {
 	ServerTime      uint64      `json:"serverTime,omitempty"`
 	Version         string      `json:"version,omitempty"`
+	Role            string      `json:"role,omitempty"`
+	Handoff         string      `json:"handoff,omitempty"`
 	ConnectedAgents interface{} `json:"connectedAgents,omitempty"`
 }
 
+// EndpointsResponse defines the response for the EndpointsEndpoint.  Each
+// of the Endpoints gives an endpoint's type and name, the agents currently
+// serving it, and whether any of them are directly connected.
+type EndpointsResponse struct {
+	ServerTime uint64      `json:"serverTime,omitempty"`
+	Endpoints  interface{} `json:"endpoints"`
+}
+
 // ServiceCredentialRequest defines the request for the ServiceEndpoint
 type ServiceCredentialRequest struct {
 	AgentName string `json:"agentName,omitempty"`
@@ -73,6 +114,23 @@ type ServiceCredentialRequest struct {
 	Name      string `json:"name,omitempty"`
 	OldType   string `json:"Type,omitempty"` // depricated
 	OldName   string `json:"Name,omitempty"` // depricated
+
+	Scope *CredentialScope `json:"scope,omitempty"`
+
+	// KeyName, if set, signs the credential with that service-auth key
+	// rather than the current one.  It must be the current key or one of
+	// the additional current keys.
+	KeyName string `json:"keyName,omitempty"`
+}
+
+// CredentialScope limits where a service credential may be used.  Empty
+// lists place no limit.
+type CredentialScope struct {
+	// Services are the names of the controller's incoming services
+	// the credential may be presented to.
+	Services []string `json:"services,omitempty"`
+	// Methods are the HTTP methods the credential may be used with.
+	Methods []string `json:"methods,omitempty"`
 }
 
 // ServiceCredentialResponse defines the response for the ServiceEndpoint
@@ -86,6 +144,41 @@ type ServiceCredentialResponse struct {
 	Credential     interface{} `json:"credential,omitempty"`
 	URL            string      `json:"url,omitempty"`
 	CACert         string      `json:"caCert,omitempty"`
+
+	Scope *CredentialScope `json:"scope,omitempty"`
+}
+
+// MaxBatchSize is the most items a BatchCredentialRequest may hold, counting
+// both manifests and service credentials.
+const MaxBatchSize = 500
+
+// BatchCredentialRequest defines the request for the BatchEndpoint.  Each
+// item is handled as it would be by the ManifestEndpoint or ServiceEndpoint.
+type BatchCredentialRequest struct {
+	Manifests []ManifestRequest          `json:"manifests,omitempty"`
+	Services  []ServiceCredentialRequest `json:"services,omitempty"`
+}
+
+// BatchCredentialResponse defines the response for the BatchEndpoint, with
+// one result for each item in the request, in the same order.  An item
+// which failed does not stop the others from being issued.
+type BatchCredentialResponse struct {
+	Manifests []ManifestResult          `json:"manifests,omitempty"`
+	Services  []ServiceCredentialResult `json:"services,omitempty"`
+}
+
+// ManifestResult holds either the manifest components for a
+// ManifestRequest in a batch, or why they could not be issued.
+type ManifestResult struct {
+	Manifest *ManifestResponse `json:"manifest,omitempty"`
+	Error    *ErrorDetail      `json:"error,omitempty"`
+}
+
+// ServiceCredentialResult holds either the credential for a
+// ServiceCredentialRequest in a batch, or why it could not be issued.
+type ServiceCredentialResult struct {
+	Credential *ServiceCredentialResponse `json:"credential,omitempty"`
+	Error      *ErrorDetail               `json:"error,omitempty"`
 }
 
 // BasicCredentialResponse is the "http basic auth" configuration.
@@ -100,9 +193,11 @@ type AwsCredentialResponse struct {
 	AwsSecretAccessKey string `json:"awsSecretAccessKey,omitempty"`
 }
 
-// ControlCredentialsRequest defines the request for the ControlEndpoint
+// ControlCredentialsRequest defines the request for the ControlEndpoint.
+// TTL is as for KubeConfigRequest.
 type ControlCredentialsRequest struct {
 	Name string `json:"name,omitempty"`
+	TTL  string `json:"ttl,omitempty"`
 }
 
 // ControlCredentialsResponse defines the response for the ControlEndpoint
@@ -112,4 +207,82 @@ type ControlCredentialsResponse struct {
 	Certificate string `json:"userCertificate,omitempty"`
 	Key         string `json:"userKey,omitempty"`
 	CACert      string `json:"caCert,omitempty"`
+	NotAfter    uint64 `json:"notAfter,omitempty"`
+}
+
+// ServiceKeysRequest defines the request for the ServiceKeysEndpoint.
+// The service-auth keys are reloaded from disk, CurrentKeyName becomes
+// the key used to sign new tokens, and RetiredKeyNames are dropped so
+// tokens signed with them no longer validate.
+type ServiceKeysRequest struct {
+	CurrentKeyName  string   `json:"currentKeyName,omitempty"`
+	RetiredKeyNames []string `json:"retiredKeyNames,omitempty"`
+}
+
+// ServiceKeysResponse defines the response for the ServiceKeysEndpoint.
+// KeyNames lists the keys which tokens may now be signed with.
+type ServiceKeysResponse struct {
+	CurrentKeyName string   `json:"currentKeyName,omitempty"`
+	KeyNames       []string `json:"keyNames,omitempty"`
+}
+
+// DrainRequest defines the request for the DrainEndpoint, which hands the
+// controller's agents to a peer controller.  New service requests are
+// redirected to ServiceHostname, the agents are advertised to the peer's
+// ControlURL (if set), and once the requests in progress have finished, or
+// Timeout (a duration such as "5m") has passed, agents are asked to
+// reconnect to AgentHostname, a host:port.
+type DrainRequest struct {
+	ServiceHostname string `json:"serviceHostname,omitempty"`
+	AgentHostname   string `json:"agentHostname,omitempty"`
+	ControlURL      string `json:"controlUrl,omitempty"`
+	Timeout         string `json:"timeout,omitempty"`
+}
+
+// DrainResponse defines the response for the DrainEndpoint.  State is the
+// state of the handoff, such as "draining".
+type DrainResponse struct {
+	State string `json:"state,omitempty"`
+}
+
+// AdvertiseRoutesRequest defines the request for the
+// AdvertiseRoutesEndpoint, sent by a draining peer.  Requests for the
+// Agents wait for them to connect until Until, in milliseconds since the
+// epoch.
+type AdvertiseRoutesRequest struct {
+	Agents []string `json:"agents,omitempty"`
+	Until  uint64   `json:"until,omitempty"`
+}
+
+// AdvertiseRoutesResponse defines the response for the
+// AdvertiseRoutesEndpoint.
+type AdvertiseRoutesResponse struct {
+	Agents int `json:"agents"`
+}
+
+// Error codes returned in ErrorDetail.Code.
+const (
+	ErrorCodeInvalidRequest   = "INVALID_REQUEST"
+	ErrorCodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	ErrorCodeForbidden        = "FORBIDDEN"
+	ErrorCodeCAError          = "CA_ERROR"
+	ErrorCodeTokenError       = "TOKEN_ERROR"
+	ErrorCodeKeysetError      = "KEYSET_ERROR"
+	ErrorCodeInternalError    = "INTERNAL_ERROR"
+	ErrorCodeStandby          = "STANDBY"
+	ErrorCodeHandoffError     = "HANDOFF_ERROR"
+)
+
+// ErrorResponse is returned by all endpoints when a request fails.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes why a request failed.  Code is one of the
+// ErrorCode constants, and Field names the request field which failed
+// validation, if any.  Message is meant for people, and may change.
+type ErrorDetail struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
 }
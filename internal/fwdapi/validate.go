@@ -18,11 +18,32 @@ package fwdapi
 
 import (
 	"fmt"
+	"net"
 	"regexp"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+// ValidationError is returned by Validate, naming the field which is invalid.
+// Reason, if set, describes why.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("'%s' %s", e.Field, e.Reason)
+	}
+	return fmt.Sprintf("'%s' is invalid", e.Field)
+}
+
+func invalid(field string) error {
+	return &ValidationError{Field: field}
+}
+
 // NamePresent ensures the string is not null.
 func namePresent(n string) bool {
 	return n != ""
@@ -39,31 +60,135 @@ func typeValid(n string) bool {
 	return matched
 }
 
+// methodValid ensures the HTTP method is uppercase letters only.
+func methodValid(m string) bool {
+	matched, err := regexp.MatchString("^[A-Z]+$", m)
+	if err != nil {
+		zap.S().Warnf("matching method: %v", err)
+		return false
+	}
+	return matched
+}
+
 // Validate ensures that the required fields are set to reasonable values, usually just non-empty strings.
 func (req *ServiceCredentialRequest) Validate() error {
 	if !namePresent(req.AgentName) {
-		return fmt.Errorf("'agentName' is invalid")
+		return invalid("agentName")
 	}
 
 	if !namePresent(req.Name) {
-		return fmt.Errorf("'name' is invalid")
+		return invalid("name")
 	}
 
 	if !typeValid(req.Type) {
-		return fmt.Errorf("'type' is invalid")
+		return invalid("type")
+	}
+
+	if req.Scope != nil {
+		for _, service := range req.Scope.Services {
+			if !namePresent(service) || strings.Contains(service, ",") {
+				return invalid("scope.services")
+			}
+		}
+		for _, method := range req.Scope.Methods {
+			if !methodValid(method) {
+				return invalid("scope.methods")
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate ensures the batch is not empty, and not larger than MaxBatchSize.
+// The items are validated individually when they are issued.
+func (req *BatchCredentialRequest) Validate() error {
+	count := len(req.Manifests) + len(req.Services)
+	if count == 0 {
+		return &ValidationError{Field: "manifests", Reason: "and 'services' are both empty"}
+	}
+	if count > MaxBatchSize {
+		return &ValidationError{Field: "manifests", Reason: fmt.Sprintf("and 'services' have more than %d items", MaxBatchSize)}
+	}
+	return nil
+}
+
+// Validate ensures that the required fields are set, and the current key
+// is not also being retired.
+func (req *ServiceKeysRequest) Validate() error {
+	if !namePresent(req.CurrentKeyName) {
+		return invalid("currentKeyName")
+	}
+
+	for _, name := range req.RetiredKeyNames {
+		if name == req.CurrentKeyName {
+			return invalid("retiredKeyNames")
+		}
 	}
 
 	return nil
 }
 
+// Validate ensures the peer's hostnames are set, and the timeout, if any,
+// is a positive duration.
+func (req *DrainRequest) Validate() error {
+	if !namePresent(req.ServiceHostname) {
+		return invalid("serviceHostname")
+	}
+
+	if _, _, err := net.SplitHostPort(req.AgentHostname); err != nil {
+		return invalid("agentHostname")
+	}
+
+	if req.Timeout != "" {
+		if d, err := time.ParseDuration(req.Timeout); err != nil || d <= 0 {
+			return invalid("timeout")
+		}
+	}
+
+	return nil
+}
+
+// Validate ensures agents are named, and they are expected until some time.
+func (req *AdvertiseRoutesRequest) Validate() error {
+	for _, agent := range req.Agents {
+		if !namePresent(agent) {
+			return invalid("agents")
+		}
+	}
+
+	if req.Until == 0 {
+		return invalid("until")
+	}
+
+	return nil
+}
+
+// ParseTTL returns the requested certificate lifetime, or zero if none
+// was requested.
+func ParseTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return 0, invalid("ttl")
+	}
+	return d, nil
+}
+
 // Validate ensures that the required fields are set to reasonable values, usually just non-empty strings.
 func (req *KubeConfigRequest) Validate() error {
 	if !namePresent(req.AgentName) {
-		return fmt.Errorf("'agentName' is invalid")
+		return invalid("agentName")
 	}
 
 	if !namePresent(req.Name) {
-		return fmt.Errorf("'name' is invalid")
+		return invalid("name")
+	}
+
+	if _, err := ParseTTL(req.TTL); err != nil {
+		return err
 	}
 
 	return nil
@@ -72,7 +197,11 @@ func (req *KubeConfigRequest) Validate() error {
 // Validate ensures that the required fields are set to reasonable values, usually just non-empty strings.
 func (req *ManifestRequest) Validate() error {
 	if !namePresent(req.AgentName) {
-		return fmt.Errorf("'agentName' is invalid")
+		return invalid("agentName")
+	}
+
+	if _, err := ParseTTL(req.TTL); err != nil {
+		return err
 	}
 
 	return nil
@@ -81,7 +210,11 @@ func (req *ManifestRequest) Validate() error {
 // Validate ensures that the required fields are set to reasonable values, usually just non-empty strings.
 func (req *ControlCredentialsRequest) Validate() error {
 	if !namePresent(req.Name) {
-		return fmt.Errorf("'name' is invalid")
+		return invalid("name")
+	}
+
+	if _, err := ParseTTL(req.TTL); err != nil {
+		return err
 	}
 
 	return nil
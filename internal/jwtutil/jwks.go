@@ -0,0 +1,167 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+const defaultJWKSMinRefreshInterval = 15 * time.Minute
+
+// JWKSConfig describes an external issuer whose service credentials are
+// accepted alongside those signed with the local keys.  Its public keys
+// are fetched from URL, and refreshed as the response's Cache-Control or
+// Expires headers allow, but no more often than MinRefreshInterval, which
+// defaults to 15 minutes.
+type JWKSConfig struct {
+	URL                string        `yaml:"url,omitempty"`
+	Issuer             string        `yaml:"issuer,omitempty"`
+	MinRefreshInterval time.Duration `yaml:"minRefreshInterval,omitempty"`
+}
+
+// Validate returns every problem with the configuration.
+func (c JWKSConfig) Validate() []error {
+	problems := []error{}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Errorf("url '%s' must be an http or https URL", c.URL))
+	}
+	if c.Issuer == "" {
+		problems = append(problems, fmt.Errorf("issuer not set"))
+	}
+	if c.MinRefreshInterval < 0 {
+		problems = append(problems, fmt.Errorf("minRefreshInterval must not be negative"))
+	}
+	return problems
+}
+
+// externalKeys validates tokens against a cached, periodically refreshed
+// JWKS.  These keys are never used to sign.
+type externalKeys struct {
+	url       string
+	issuer    string
+	refresher *jwk.AutoRefresh
+}
+
+var (
+	registeredExternalKeys     *externalKeys
+	registeredExternalKeysLock sync.RWMutex
+)
+
+// RegisterExternalJWKS accepts service credentials signed by the keys
+// published at the configured URL, with the configured issuer, until ctx
+// is done.  The keys are fetched once before returning.  If that fails
+// the error is returned, but the JWKS stays registered, and is fetched
+// again when a credential needs it.
+func RegisterExternalJWKS(ctx context.Context, config JWKSConfig, client *http.Client) error {
+	minRefresh := config.MinRefreshInterval
+	if minRefresh == 0 {
+		minRefresh = defaultJWKSMinRefreshInterval
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	refresher := jwk.NewAutoRefresh(ctx)
+	refresher.Configure(config.URL,
+		jwk.WithMinRefreshInterval(minRefresh),
+		jwk.WithHTTPClient(client))
+
+	registeredExternalKeysLock.Lock()
+	registeredExternalKeys = &externalKeys{
+		url:       config.URL,
+		issuer:    config.Issuer,
+		refresher: refresher,
+	}
+	registeredExternalKeysLock.Unlock()
+
+	_, err := refresher.Refresh(ctx, config.URL)
+	return err
+}
+
+// UnregisterExternalJWKS stops accepting service credentials from the
+// external issuer.
+func UnregisterExternalJWKS() {
+	registeredExternalKeysLock.Lock()
+	defer registeredExternalKeysLock.Unlock()
+	registeredExternalKeys = nil
+}
+
+func getExternalKeys() *externalKeys {
+	registeredExternalKeysLock.RLock()
+	defer registeredExternalKeysLock.RUnlock()
+	return registeredExternalKeys
+}
+
+func (e *externalKeys) keyset() (jwk.Set, error) {
+	return e.refresher.Fetch(context.Background(), e.url)
+}
+
+// hasKeyID returns true if the JWKS has a key with the key ID.
+func (e *externalKeys) hasKeyID(kid string) bool {
+	keyset, err := e.keyset()
+	if err != nil || kid == "" {
+		return false
+	}
+	_, found := keyset.LookupKeyID(kid)
+	return found
+}
+
+// validate checks the token's signature against the JWKS, and its
+// issuer and times, returning the private claims as the registry does.
+func (e *externalKeys) validate(tokenString string, clock jwt.Clock) (map[string]string, error) {
+	keyset, err := e.keyset()
+	if err != nil {
+		return nil, fmt.Errorf("fetching external JWKS: %w", err)
+	}
+	opts := []jwt.ParseOption{
+		jwt.WithValidate(true),
+		jwt.WithIssuer(e.issuer),
+		jwt.WithKeySet(keyset),
+		jwt.InferAlgorithmFromKey(true),
+	}
+	if clock != nil {
+		opts = append(opts, jwt.WithClock(clock))
+	}
+	token, err := jwt.ParseString(tokenString, opts...)
+	if err != nil {
+		return nil, err
+	}
+	claims := make(map[string]string)
+	for k, v := range token.PrivateClaims() {
+		claims[k] = fmt.Sprintf("%v", v)
+	}
+	return claims, nil
+}
+
+// tokenKeyID returns the key ID the token says it was signed with, without
+// verifying it, or "" if there is none.
+func tokenKeyID(tokenString string) string {
+	msg, err := jws.ParseString(tokenString)
+	if err != nil || len(msg.Signatures()) != 1 {
+		return ""
+	}
+	return msg.Signatures()[0].ProtectedHeaders().KeyID()
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/skandragon/jwtregistry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testExternalIssuer = "https://issuer.example.com"
+
+func makeRSAKey(t *testing.T, kid string) jwk.Key {
+	raw, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key, err := jwk.New(raw)
+	require.NoError(t, err)
+	require.NoError(t, key.Set(jwk.KeyIDKey, kid))
+	require.NoError(t, key.Set(jwk.AlgorithmKey, jwa.RS256))
+	return key
+}
+
+// startJWKSServer serves the public half of a new RSA key with the key ID
+// as a JWKS, registers it as the external JWKS, and returns the private
+// key and a count of fetches.
+func startJWKSServer(t *testing.T, kid string) (jwk.Key, *int32) {
+	private := makeRSAKey(t, kid)
+	public, err := private.PublicKey()
+	require.NoError(t, err)
+	keyset := jwk.NewSet()
+	keyset.Add(public)
+	body, err := json.Marshal(keyset)
+	require.NoError(t, err)
+
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "max-age=3600")
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	t.Cleanup(UnregisterExternalJWKS)
+	err = RegisterExternalJWKS(ctx, JWKSConfig{URL: server.URL, Issuer: testExternalIssuer}, server.Client())
+	require.NoError(t, err)
+	return private, &fetches
+}
+
+func signExternalToken(t *testing.T, key jwk.Key, issuer string) string {
+	token := jwt.New()
+	require.NoError(t, token.Set(jwt.IssuerKey, issuer))
+	require.NoError(t, token.Set(jwt.IssuedAtKey, time.Unix(1000, 0)))
+	require.NoError(t, token.Set(jwtEndpointTypeKey, "jenkins"))
+	require.NoError(t, token.Set(jwtEndpointNameKey, "ci"))
+	require.NoError(t, token.Set(jwtAgentKey, "agent1"))
+	signed, err := jwt.Sign(token, jwa.RS256, key)
+	require.NoError(t, err)
+	return string(signed)
+}
+
+func TestValidateJWT_externalJWKS(t *testing.T) {
+	keyset := LoadTestKeys(t)
+	require.NoError(t, RegisterServiceauthKeyset(keyset, "key1"))
+	external, fetches := startJWKSServer(t, "external1")
+	clock := &jwtregistry.TimeClock{NowTime: 2000}
+
+	epType, epName, agent, err := ValidateJWT(signExternalToken(t, external, testExternalIssuer), clock)
+	require.NoError(t, err)
+	assert.Equal(t, "jenkins", epType)
+	assert.Equal(t, "ci", epName)
+	assert.Equal(t, "agent1", agent)
+
+	// Local keys still sign and validate, and signing never uses the
+	// external key.
+	local, err := MakeJWT("jenkins", "ci", "agent1", clock)
+	require.NoError(t, err)
+	assert.Equal(t, "key1", tokenKeyID(local))
+	_, _, _, err = ValidateJWT(local, clock)
+	require.NoError(t, err)
+
+	// The external issuer must be the one configured.
+	_, _, _, err = ValidateJWT(signExternalToken(t, external, serviceauthIssuer), clock)
+	assert.Error(t, err)
+
+	// A key the JWKS does not have is rejected.
+	other := makeRSAKey(t, "external2")
+	_, _, _, err = ValidateJWT(signExternalToken(t, other, testExternalIssuer), clock)
+	assert.Error(t, err)
+
+	// The JWKS is cached, not fetched for each validation.
+	assert.Equal(t, int32(1), atomic.LoadInt32(fetches))
+}
+
+func TestValidateJWT_externalJWKSUnregistered(t *testing.T) {
+	keyset := LoadTestKeys(t)
+	require.NoError(t, RegisterServiceauthKeyset(keyset, "key1"))
+	external, _ := startJWKSServer(t, "external1")
+	token := signExternalToken(t, external, testExternalIssuer)
+	UnregisterExternalJWKS()
+
+	_, _, _, err := ValidateJWT(token, &jwtregistry.TimeClock{NowTime: 2000})
+	assert.Error(t, err)
+}
+
+func TestJWKSConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config JWKSConfig
+		want   []string
+	}{
+		{
+			"valid",
+			JWKSConfig{URL: "https://issuer.example.com/.well-known/jwks.json", Issuer: testExternalIssuer},
+			[]string{},
+		},
+		{
+			"empty",
+			JWKSConfig{},
+			[]string{"url '' must be an http or https URL", "issuer not set"},
+		},
+		{
+			"bad values",
+			JWKSConfig{URL: "issuer.example.com/jwks.json", Issuer: testExternalIssuer, MinRefreshInterval: -time.Minute},
+			[]string{"url 'issuer.example.com/jwks.json' must be an http or https URL", "minRefreshInterval must not be negative"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, err := range tt.config.Validate() {
+				got = append(got, err.Error())
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -21,6 +21,7 @@ package jwtutil
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jwt"
@@ -35,44 +36,84 @@ const (
 	serviceauthRegistryName = "service-auth"
 )
 
+var (
+	// signers maps the name of each key new tokens may be signed with to
+	// the registry which signs with it.
+	signers     = map[string]string{}
+	signersLock sync.RWMutex
+)
+
 // RegisterServiceauthKeyset registers (or re-registers) a new keyset and signing key name.
-func RegisterServiceauthKeyset(keyset jwk.Set, signingKeyName string) error {
-	return jwtregistry.Register(serviceauthRegistryName, serviceauthIssuer,
+// Tokens may also be signed with any of the additionalSigningKeyNames, using
+// MakeIdentifiedJWTWithKey.
+func RegisterServiceauthKeyset(keyset jwk.Set, signingKeyName string, additionalSigningKeyNames ...string) error {
+	err := jwtregistry.Register(serviceauthRegistryName, serviceauthIssuer,
 		jwtregistry.WithKeyset(keyset),
 		jwtregistry.WithSigningKeyName(signingKeyName),
 	)
-}
+	if err != nil {
+		return err
+	}
+	setServiceauthKeyset(keyset)
 
-// MakeJWT will return a token with provided type, name, and agent name embedded in the claims.
-func MakeJWT(epType string, epName string, agent string, clock jwt.Clock) (string, error) {
-	claims := map[string]string{
-		jwtEndpointTypeKey: epType,
-		jwtEndpointNameKey: epName,
-		jwtAgentKey:        agent,
+	registered := map[string]string{signingKeyName: serviceauthRegistryName}
+	for _, name := range additionalSigningKeyNames {
+		if _, found := registered[name]; found {
+			continue
+		}
+		registry := serviceauthRegistryName + ":" + name
+		err := jwtregistry.Register(registry, serviceauthIssuer,
+			jwtregistry.WithKeyset(keyset),
+			jwtregistry.WithSigningKeyName(name),
+		)
+		if err != nil {
+			return err
+		}
+		registered[name] = registry
+	}
+	inUse := map[string]bool{}
+	for _, registry := range registered {
+		inUse[registry] = true
+	}
+	signersLock.Lock()
+	defer signersLock.Unlock()
+	for _, registry := range signers {
+		if !inUse[registry] {
+			jwtregistry.Delete(registry)
+		}
 	}
+	signers = registered
+	return nil
+}
 
-	signed, err := jwtregistry.Sign(serviceauthRegistryName, claims, clock)
-	if err != nil {
-		return "", err
+// IsSigningKey returns true if new tokens may be signed with the key.
+func IsSigningKey(name string) bool {
+	signersLock.RLock()
+	defer signersLock.RUnlock()
+	_, found := signers[name]
+	return found
+}
+
+func signingRegistry(keyName string) (string, error) {
+	if keyName == "" {
+		return serviceauthRegistryName, nil
+	}
+	signersLock.RLock()
+	defer signersLock.RUnlock()
+	registry, found := signers[keyName]
+	if !found {
+		return "", fmt.Errorf("'%s' is not a current signing key", keyName)
 	}
-	return string(signed), nil
+	return registry, nil
+}
+
+// MakeJWT will return a token with provided type, name, and agent name embedded in the claims.
+func MakeJWT(epType string, epName string, agent string, clock jwt.Clock) (string, error) {
+	return MakeScopedJWT(epType, epName, agent, Scope{}, clock)
 }
 
 // ValidateJWT will validate and return the enbedded claims.
 func ValidateJWT(tokenString string, clock jwt.Clock) (epType string, epName string, agent string, err error) {
-	claims, err := jwtregistry.Validate(serviceauthRegistryName, []byte(tokenString), clock)
-	if err != nil {
-		return
-	}
-	var found bool
-	if epType, found = claims[jwtEndpointTypeKey]; !found {
-		err = fmt.Errorf("no '%s' key in JWT claims", jwtEndpointTypeKey)
-	}
-	if epName, found = claims[jwtEndpointNameKey]; !found {
-		err = fmt.Errorf("no '%s' key in JWT claims", jwtEndpointNameKey)
-	}
-	if agent, found = claims[jwtAgentKey]; !found {
-		err = fmt.Errorf("no '%s' key in JWT claims", jwtAgentKey)
-	}
+	epType, epName, agent, _, err = ValidateScopedJWT(tokenString, clock)
 	return
 }
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+var (
+	reloadLock sync.Mutex
+	// retiredKeyNames holds every key retired so far, protected by
+	// reloadLock, so a retired key stays retired on later reloads even
+	// if its file is still on disk.
+	retiredKeyNames = map[string]bool{}
+)
+
+// LoadKeyset reads each regular file in dir as an HS256 key, using the
+// file name as the key ID.
+func LoadKeyset(dir string) (jwk.Set, error) {
+	keyset := jwk.NewSet()
+	err := filepath.WalkDir(dir, func(path string, info fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// skip not regular files
+		if !info.Type().IsRegular() {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		key, err := jwk.New(content)
+		if err != nil {
+			return err
+		}
+		err = key.Set(jwk.KeyIDKey, info.Name())
+		if err != nil {
+			return err
+		}
+		err = key.Set(jwk.AlgorithmKey, jwa.HS256)
+		if err != nil {
+			return err
+		}
+		keyset.Add(key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keyset, nil
+}
+
+// ReloadKeysets loads the keyset from dir, removes any retired keys, and
+// registers the result for both service-auth and header mutation.  Each
+// registration replaces the previous one in a single step, so tokens signed
+// with any key which was not retired continue to validate.  Keys retired
+// by an earlier successful reload stay retired, even if retired does not
+// name them again.
+//
+// New tokens are signed with currentKeyName, or with one of the
+// additionalKeyNames if MakeIdentifiedJWTWithKey asks for it.  These are
+// keys which are also current during a rotation, such as one which other
+// controllers sharing these keys still sign with, and so must stay loaded.
+// Nothing is registered if the current, an additional, or the mutation key
+// is missing or retired.
+func ReloadKeysets(dir string, currentKeyName string, additionalKeyNames []string, mutationKeyName string, retired []string) (jwk.Set, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	keyset, err := LoadKeyset(dir)
+	if err != nil {
+		return nil, err
+	}
+	allRetired := map[string]bool{}
+	for name := range retiredKeyNames {
+		allRetired[name] = true
+	}
+	for _, name := range retired {
+		allRetired[name] = true
+	}
+	for name := range allRetired {
+		if key, found := keyset.LookupKeyID(name); found {
+			keyset.Remove(key)
+		}
+	}
+	if _, found := keyset.LookupKeyID(currentKeyName); !found {
+		return nil, fmt.Errorf("current key '%s' is not in the loaded keys", currentKeyName)
+	}
+	for _, name := range additionalKeyNames {
+		if _, found := keyset.LookupKeyID(name); !found {
+			return nil, fmt.Errorf("additional current key '%s' is not in the loaded keys", name)
+		}
+	}
+	if _, found := keyset.LookupKeyID(mutationKeyName); !found {
+		return nil, fmt.Errorf("header mutation key '%s' is not in the loaded keys", mutationKeyName)
+	}
+
+	if err := RegisterServiceauthKeyset(keyset, currentKeyName, additionalKeyNames...); err != nil {
+		return nil, err
+	}
+	if err := RegisterMutationKeyset(keyset, mutationKeyName); err != nil {
+		return nil, err
+	}
+	retiredKeyNames = allRetired
+	return keyset, nil
+}
+
+// KeyNames returns the key IDs in the keyset.
+func KeyNames(keyset jwk.Set) []string {
+	names := []string{}
+	for i := 0; i < keyset.Len(); i++ {
+		if key, ok := keyset.Get(i); ok {
+			names = append(names, key.KeyID())
+		}
+	}
+	return names
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKey(t *testing.T, dir string, name string, content string) {
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+}
+
+// forgetRetiredKeys clears the keys retired by earlier reloads.
+func forgetRetiredKeys() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	retiredKeyNames = map[string]bool{}
+}
+
+func TestLoadKeyset(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "key1", "this is a key")
+	writeKey(t, dir, "key2", "this is a key2")
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "subdir"), 0700))
+
+	keyset, err := LoadKeyset(dir)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"key1", "key2"}, KeyNames(keyset))
+
+	_, err = LoadKeyset(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestReloadKeysets_rotation(t *testing.T) {
+	t.Cleanup(UnregisterMutationKeyset)
+	t.Cleanup(forgetRetiredKeys)
+	dir := t.TempDir()
+	writeKey(t, dir, "key1", "this is a key")
+	writeKey(t, dir, "key2", "this is a key2")
+
+	_, err := ReloadKeysets(dir, "key1", nil, "key2", nil)
+	require.NoError(t, err)
+	token1, err := MakeJWT("jenkins", "bob", "agent1", nil)
+	require.NoError(t, err)
+
+	// Promote key2, leaving key1 loaded so existing tokens still work.
+	_, err = ReloadKeysets(dir, "key2", nil, "key2", nil)
+	require.NoError(t, err)
+	token2, err := MakeJWT("jenkins", "bob", "agent1", nil)
+	require.NoError(t, err)
+	_, _, _, err = ValidateJWT(token1, nil)
+	require.NoError(t, err)
+
+	// Add key3 on disk, promote it, and retire key1.
+	writeKey(t, dir, "key3", "this is a key3")
+	keyset, err := ReloadKeysets(dir, "key3", nil, "key2", []string{"key1"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"key2", "key3"}, KeyNames(keyset))
+	token3, err := MakeJWT("jenkins", "bob", "agent1", nil)
+	require.NoError(t, err)
+
+	_, _, _, err = ValidateJWT(token1, nil)
+	require.Error(t, err, "token signed with the retired key must fail")
+	_, _, _, err = ValidateJWT(token2, nil)
+	require.NoError(t, err)
+	epType, epName, agent, err := ValidateJWT(token3, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "jenkins", epType)
+	assert.Equal(t, "bob", epName)
+	assert.Equal(t, "agent1", agent)
+
+	mutated, err := MutateHeader("alice", nil)
+	require.NoError(t, err)
+	username, err := UnmutateHeader(mutated, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", username)
+}
+
+func TestReloadKeysets_retiredKeysStayRetired(t *testing.T) {
+	t.Cleanup(UnregisterMutationKeyset)
+	t.Cleanup(forgetRetiredKeys)
+	dir := t.TempDir()
+	writeKey(t, dir, "key1", "this is a key")
+	writeKey(t, dir, "key2", "this is a key2")
+	writeKey(t, dir, "key3", "this is a key3")
+
+	_, err := ReloadKeysets(dir, "key1", nil, "key3", nil)
+	require.NoError(t, err)
+	token1, err := MakeJWT("jenkins", "bob", "agent1", nil)
+	require.NoError(t, err)
+
+	// Rotate to key2, retiring key1, whose file stays on disk.
+	_, err = ReloadKeysets(dir, "key2", nil, "key3", []string{"key1"})
+	require.NoError(t, err)
+	_, _, _, err = ValidateJWT(token1, nil)
+	require.Error(t, err)
+
+	// Rotate again without naming key1.
+	keyset, err := ReloadKeysets(dir, "key2", nil, "key3", nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"key2", "key3"}, KeyNames(keyset))
+	_, _, _, err = ValidateJWT(token1, nil)
+	require.Error(t, err, "token signed with the retired key must still fail")
+
+	// A retired key cannot be made current again.
+	_, err = ReloadKeysets(dir, "key1", nil, "key3", nil)
+	require.Error(t, err)
+}
+
+func TestReloadKeysets_failedReloadDoesNotRetire(t *testing.T) {
+	t.Cleanup(UnregisterMutationKeyset)
+	t.Cleanup(forgetRetiredKeys)
+	dir := t.TempDir()
+	writeKey(t, dir, "key1", "this is a key")
+	writeKey(t, dir, "key2", "this is a key2")
+
+	_, err := ReloadKeysets(dir, "key1", nil, "key1", nil)
+	require.NoError(t, err)
+	_, err = ReloadKeysets(dir, "key3", nil, "key1", []string{"key2"})
+	require.Error(t, err)
+
+	keyset, err := ReloadKeysets(dir, "key2", nil, "key1", nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"key1", "key2"}, KeyNames(keyset))
+}
+
+func TestReloadKeysets_additionalCurrentKeys(t *testing.T) {
+	t.Cleanup(UnregisterMutationKeyset)
+	t.Cleanup(forgetRetiredKeys)
+	dir := t.TempDir()
+	writeKey(t, dir, "key1", "this is a key")
+	writeKey(t, dir, "key2", "this is a key2")
+
+	// During the overlap, one controller still signs with the outgoing
+	// key1, and another has moved to the incoming key2.
+	_, err := ReloadKeysets(dir, "key1", []string{"key2"}, "key1", nil)
+	require.NoError(t, err)
+	outgoing, err := MakeJWT("jenkins", "bob", "agent1", nil)
+	require.NoError(t, err)
+
+	_, err = ReloadKeysets(dir, "key2", []string{"key1"}, "key1", nil)
+	require.NoError(t, err)
+	incoming, err := MakeJWT("jenkins", "bob", "agent1", nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, outgoing, incoming)
+
+	for _, token := range []string{outgoing, incoming} {
+		epType, epName, agent, err := ValidateJWT(token, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "jenkins", epType)
+		assert.Equal(t, "bob", epName)
+		assert.Equal(t, "agent1", agent)
+	}
+
+	// Either key may be asked for while both are current.
+	for _, name := range []string{"key1", "key2"} {
+		token, err := MakeIdentifiedJWTWithKey(name, "jenkins", "bob", "agent1", Scope{}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, name, tokenKeyID(token))
+		_, _, _, err = ValidateJWT(token, nil)
+		require.NoError(t, err)
+	}
+	defaultKey, err := MakeIdentifiedJWTWithKey("", "jenkins", "bob", "agent1", Scope{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "key2", tokenKeyID(defaultKey))
+
+	// The outgoing key cannot be retired while it is still current.
+	_, err = ReloadKeysets(dir, "key2", []string{"key1"}, "key2", []string{"key1"})
+	require.Error(t, err)
+	_, _, _, err = ValidateJWT(outgoing, nil)
+	require.NoError(t, err)
+
+	// Once the rotation is over, only the new key signs, though tokens
+	// signed with the old one still validate until it is retired.
+	_, err = ReloadKeysets(dir, "key2", nil, "key1", nil)
+	require.NoError(t, err)
+	assert.False(t, IsSigningKey("key1"))
+	_, err = MakeIdentifiedJWTWithKey("key1", "jenkins", "bob", "agent1", Scope{}, nil)
+	require.Error(t, err)
+	_, _, _, err = ValidateJWT(outgoing, nil)
+	require.NoError(t, err)
+}
+
+func TestReloadKeysets_errors(t *testing.T) {
+	t.Cleanup(UnregisterMutationKeyset)
+	t.Cleanup(forgetRetiredKeys)
+	dir := t.TempDir()
+	writeKey(t, dir, "key1", "this is a key")
+	writeKey(t, dir, "key2", "this is a key2")
+
+	_, err := ReloadKeysets(dir, "key1", nil, "key1", nil)
+	require.NoError(t, err)
+	token, err := MakeJWT("jenkins", "bob", "agent1", nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		dir             string
+		currentKeyName  string
+		additional      []string
+		mutationKeyName string
+		retired         []string
+	}{
+		{"missing dir", filepath.Join(dir, "missing"), "key1", nil, "key1", nil},
+		{"missing current key", dir, "key3", nil, "key1", nil},
+		{"retired current key", dir, "key2", nil, "key1", []string{"key2"}},
+		{"missing additional key", dir, "key1", []string{"key3"}, "key1", nil},
+		{"retired additional key", dir, "key1", []string{"key2"}, "key1", []string{"key2"}},
+		{"retired mutation key", dir, "key2", nil, "key1", []string{"key1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReloadKeysets(tt.dir, tt.currentKeyName, tt.additional, tt.mutationKeyName, tt.retired)
+			require.Error(t, err)
+
+			// The previous registration is left in place.
+			_, _, _, err = ValidateJWT(token, nil)
+			require.NoError(t, err)
+		})
+	}
+}
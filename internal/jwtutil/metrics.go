@@ -0,0 +1,96 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The results a service credential validation is counted under.
+const (
+	validationSuccess       = "success"
+	validationExpired       = "expired"
+	validationBadSignature  = "bad_signature"
+	validationUnknownKey    = "unknown_key"
+	validationMalformed     = "malformed"
+	validationInvalidClaims = "invalid_claims"
+)
+
+var (
+	jwtValidationCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jwt_validation_total",
+		Help: "The total number of service credential validations, by result",
+	}, []string{"result"})
+
+	// serviceauthKeyset is the keyset last registered for service-auth,
+	// kept so a failed validation can tell an unknown key ID from a bad
+	// signature.
+	serviceauthKeyset     jwk.Set
+	serviceauthKeysetLock sync.RWMutex
+)
+
+func setServiceauthKeyset(keyset jwk.Set) {
+	serviceauthKeysetLock.Lock()
+	defer serviceauthKeysetLock.Unlock()
+	serviceauthKeyset = keyset
+}
+
+func knownServiceauthKeyID(kid string) bool {
+	serviceauthKeysetLock.RLock()
+	defer serviceauthKeysetLock.RUnlock()
+	if serviceauthKeyset == nil || kid == "" {
+		return false
+	}
+	_, found := serviceauthKeyset.LookupKeyID(kid)
+	return found
+}
+
+func recordJWTValidation(result string) {
+	jwtValidationCounter.WithLabelValues(result).Inc()
+}
+
+// validationFailure classifies why tokenString failed validation with err,
+// re-parsing the token without verifying it.
+func validationFailure(tokenString string, err error) string {
+	msg, parseErr := jws.ParseString(tokenString)
+	if parseErr != nil || len(msg.Signatures()) != 1 {
+		return validationMalformed
+	}
+	if _, parseErr := jwt.Parse(msg.Payload()); parseErr != nil {
+		return validationMalformed
+	}
+	kid := msg.Signatures()[0].ProtectedHeaders().KeyID()
+	if !knownServiceauthKeyID(kid) {
+		if external := getExternalKeys(); external == nil || !external.hasKeyID(kid) {
+			return validationUnknownKey
+		}
+	}
+	if errors.Is(err, jwt.ErrTokenExpired()) {
+		return validationExpired
+	}
+	if jwt.IsValidationError(err) {
+		return validationInvalidClaims
+	}
+	return validationBadSignature
+}
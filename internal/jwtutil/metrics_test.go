@@ -0,0 +1,152 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/skandragon/jwtregistry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signTestToken(t *testing.T, key jwk.Key, claims map[string]interface{}) string {
+	token := jwt.New()
+	for k, v := range claims {
+		require.NoError(t, token.Set(k, v))
+	}
+	signed, err := jwt.Sign(token, jwa.HS256, key)
+	require.NoError(t, err)
+	return string(signed)
+}
+
+func TestValidateScopedJWT_metrics(t *testing.T) {
+	keyset := LoadTestKeys(t)
+	require.NoError(t, RegisterServiceauthKeyset(keyset, "key1"))
+	key1, _ := keyset.LookupKeyID("key1")
+	clock := &jwtregistry.TimeClock{NowTime: 2000}
+	issued := time.Unix(1000, 0)
+
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		ret := map[string]interface{}{
+			jwt.IssuerKey:      serviceauthIssuer,
+			jwt.IssuedAtKey:    issued,
+			jwtEndpointTypeKey: "jenkins",
+			jwtEndpointNameKey: "ci",
+			jwtAgentKey:        "agent1",
+		}
+		for k, v := range extra {
+			ret[k] = v
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name  string
+		token func(t *testing.T) string
+		want  string
+	}{
+		{
+			"success",
+			func(t *testing.T) string {
+				return signTestToken(t, key1, claims(nil))
+			},
+			validationSuccess,
+		},
+		{
+			"expired",
+			func(t *testing.T) string {
+				return signTestToken(t, key1, claims(map[string]interface{}{
+					jwt.ExpirationKey: time.Unix(1500, 0),
+				}))
+			},
+			validationExpired,
+		},
+		{
+			"bad signature",
+			func(t *testing.T) string {
+				return signTestToken(t, makekey(t, "key1", "not the right key"), claims(nil))
+			},
+			validationBadSignature,
+		},
+		{
+			"unknown key",
+			func(t *testing.T) string {
+				return signTestToken(t, makekey(t, "key9", "this is a key"), claims(nil))
+			},
+			validationUnknownKey,
+		},
+		{
+			"no key ID",
+			func(t *testing.T) string {
+				key, err := jwk.New([]byte("this is a key"))
+				require.NoError(t, err)
+				return signTestToken(t, key, claims(nil))
+			},
+			validationUnknownKey,
+		},
+		{
+			"not a JWT",
+			func(t *testing.T) string {
+				return "not.a.jwt"
+			},
+			validationMalformed,
+		},
+		{
+			"missing claim",
+			func(t *testing.T) string {
+				c := claims(nil)
+				delete(c, jwtAgentKey)
+				return signTestToken(t, key1, c)
+			},
+			validationMalformed,
+		},
+		{
+			"wrong issuer",
+			func(t *testing.T) string {
+				return signTestToken(t, key1, claims(map[string]interface{}{
+					jwt.IssuerKey: "someone-else",
+				}))
+			},
+			validationInvalidClaims,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := map[string]float64{}
+			for _, result := range []string{validationSuccess, validationExpired, validationBadSignature, validationUnknownKey, validationMalformed, validationInvalidClaims} {
+				before[result] = testutil.ToFloat64(jwtValidationCounter.WithLabelValues(result))
+			}
+
+			_, _, _, _, err := ValidateScopedJWT(tt.token(t), clock)
+			assert.Equal(t, tt.want == validationSuccess, err == nil, err)
+
+			for result, count := range before {
+				want := count
+				if result == tt.want {
+					want++
+				}
+				assert.Equal(t, want, testutil.ToFloat64(jwtValidationCounter.WithLabelValues(result)), result)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/opsmx/oes-birger/internal/ulid"
+)
+
+const (
+	defaultReplayWindow     = 5 * time.Minute
+	defaultReplayMaxEntries = 100000
+)
+
+// ErrTokenReplayed is returned by ReplayCache.Check for a token ID which
+// was already used within the window.
+var ErrTokenReplayed = errors.New("service credential token ID was already used")
+
+// ReplayConfig configures the ReplayCache.  A token ID is remembered for
+// Window, which defaults to 5 minutes, or until the token expires if that
+// is sooner.  At most MaxEntries, which defaults to 100000, are remembered;
+// when full, the entry closest to expiring is forgotten first.
+type ReplayConfig struct {
+	Window     time.Duration `yaml:"window,omitempty"`
+	MaxEntries int           `yaml:"maxEntries,omitempty"`
+}
+
+// Validate returns every problem with the configuration.
+func (c ReplayConfig) Validate() []error {
+	problems := []error{}
+	if c.Window < 0 {
+		problems = append(problems, fmt.Errorf("window must not be negative"))
+	}
+	if c.MaxEntries < 0 {
+		problems = append(problems, fmt.Errorf("maxEntries must not be negative"))
+	}
+	return problems
+}
+
+// MakeIdentifiedJWT is MakeScopedJWT, with a unique token ID ("jti") also
+// embedded in the claims, so a ReplayCache can detect the token's reuse.
+func MakeIdentifiedJWT(epType string, epName string, agent string, scope Scope, clock jwt.Clock) (string, error) {
+	return makeScopedJWT(serviceauthRegistryName, epType, epName, agent, scope, ulid.GlobalContext.Ulid(), clock)
+}
+
+// MakeIdentifiedJWTWithKey is MakeIdentifiedJWT, signed with keyName, which
+// must be the current key or one of the additional current keys.  An empty
+// keyName signs with the current key.
+func MakeIdentifiedJWTWithKey(keyName string, epType string, epName string, agent string, scope Scope, clock jwt.Clock) (string, error) {
+	registry, err := signingRegistry(keyName)
+	if err != nil {
+		return "", err
+	}
+	return makeScopedJWT(registry, epType, epName, agent, scope, ulid.GlobalContext.Ulid(), clock)
+}
+
+// TokenID returns the token ID and expiry embedded in the token, without
+// verifying it, so it must only be used on a token which has already been
+// validated.  A token made without one returns "", and a token which does
+// not expire returns the zero time.
+func TokenID(tokenString string) (id string, expires time.Time) {
+	msg, err := jws.ParseString(tokenString)
+	if err != nil {
+		return "", time.Time{}
+	}
+	token, err := jwt.Parse(msg.Payload())
+	if err != nil {
+		return "", time.Time{}
+	}
+	return token.JwtID(), token.Expiration()
+}
+
+// ReplayCache remembers the token IDs it has seen, until they leave the
+// window, so each may be used only once.  It is safe for concurrent use.
+type ReplayCache struct {
+	sync.Mutex
+	window     time.Duration
+	maxEntries int
+	entries    map[string]*replayEntry
+	expiries   replayHeap
+	now        func() time.Time
+}
+
+type replayEntry struct {
+	id      string
+	expires time.Time
+	index   int
+}
+
+// NewReplayCache returns an empty cache using the configuration.
+func NewReplayCache(config ReplayConfig) *ReplayCache {
+	c := &ReplayCache{
+		window:     config.Window,
+		maxEntries: config.MaxEntries,
+		entries:    map[string]*replayEntry{},
+		now:        time.Now,
+	}
+	if c.window == 0 {
+		c.window = defaultReplayWindow
+	}
+	if c.maxEntries == 0 {
+		c.maxEntries = defaultReplayMaxEntries
+	}
+	return c
+}
+
+// Check records the token ID, and returns ErrTokenReplayed if it was
+// already recorded and has not left the window.  The ID is remembered
+// until the window ends, or until expires if that is sooner, as the token
+// cannot be used after it expires.  A zero expires means the token does
+// not expire.
+func (c *ReplayCache) Check(id string, expires time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	c.evictExpired(now)
+	if _, found := c.entries[id]; found {
+		return ErrTokenReplayed
+	}
+	until := now.Add(c.window)
+	if !expires.IsZero() && expires.Before(until) {
+		until = expires
+	}
+	if !until.After(now) {
+		return nil
+	}
+	for len(c.entries) >= c.maxEntries {
+		c.remove(c.expiries[0])
+	}
+	entry := &replayEntry{id: id, expires: until}
+	c.entries[id] = entry
+	heap.Push(&c.expiries, entry)
+	return nil
+}
+
+// Forget removes the token ID, so the token may be used again.  It is used
+// when the request the token was recorded for was never carried out.
+func (c *ReplayCache) Forget(id string) {
+	c.Lock()
+	defer c.Unlock()
+	if entry, found := c.entries[id]; found {
+		c.remove(entry)
+	}
+}
+
+// Len returns the number of token IDs remembered.
+func (c *ReplayCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.entries)
+}
+
+func (c *ReplayCache) evictExpired(now time.Time) {
+	for len(c.expiries) > 0 && !c.expiries[0].expires.After(now) {
+		c.remove(c.expiries[0])
+	}
+}
+
+func (c *ReplayCache) remove(entry *replayEntry) {
+	heap.Remove(&c.expiries, entry.index)
+	delete(c.entries, entry.id)
+}
+
+// replayHeap orders the entries by when they expire, soonest first.
+type replayHeap []*replayEntry
+
+func (h replayHeap) Len() int           { return len(h) }
+func (h replayHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+
+func (h replayHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *replayHeap) Push(x interface{}) {
+	entry := x.(*replayEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *replayHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
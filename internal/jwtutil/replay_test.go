@@ -0,0 +1,129 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestReplayCache returns a cache whose clock is advanced by moving the
+// returned time.
+func newTestReplayCache(config ReplayConfig) (*ReplayCache, *time.Time) {
+	now := time.Unix(1000000, 0)
+	c := NewReplayCache(config)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestReplayConfig_Validate(t *testing.T) {
+	assert.Empty(t, ReplayConfig{}.Validate())
+	assert.Empty(t, ReplayConfig{Window: time.Minute, MaxEntries: 10}.Validate())
+	assert.Len(t, ReplayConfig{Window: -1, MaxEntries: -1}.Validate(), 2)
+}
+
+func TestReplayCache_Check(t *testing.T) {
+	c, _ := newTestReplayCache(ReplayConfig{})
+	require.NoError(t, c.Check("id1", time.Time{}))
+	assert.ErrorIs(t, c.Check("id1", time.Time{}), ErrTokenReplayed)
+	assert.NoError(t, c.Check("id2", time.Time{}))
+	assert.NoError(t, c.Check("id3", time.Time{}))
+	assert.ErrorIs(t, c.Check("id2", time.Time{}), ErrTokenReplayed)
+	assert.Equal(t, 3, c.Len())
+}
+
+func TestReplayCache_Forget(t *testing.T) {
+	c, _ := newTestReplayCache(ReplayConfig{})
+	require.NoError(t, c.Check("id1", time.Time{}))
+	c.Forget("id1")
+	c.Forget("unknown")
+	assert.Equal(t, 0, c.Len())
+	assert.NoError(t, c.Check("id1", time.Time{}))
+	assert.ErrorIs(t, c.Check("id1", time.Time{}), ErrTokenReplayed)
+}
+
+func TestReplayCache_window(t *testing.T) {
+	c, now := newTestReplayCache(ReplayConfig{Window: time.Minute})
+	require.NoError(t, c.Check("id1", time.Time{}))
+
+	*now = now.Add(59 * time.Second)
+	assert.ErrorIs(t, c.Check("id1", time.Time{}), ErrTokenReplayed)
+
+	*now = now.Add(time.Second)
+	assert.NoError(t, c.Check("id1", time.Time{}))
+}
+
+func TestReplayCache_tokenExpiry(t *testing.T) {
+	c, now := newTestReplayCache(ReplayConfig{Window: time.Hour})
+
+	// The ID is forgotten when the token expires, before the window ends.
+	require.NoError(t, c.Check("id1", now.Add(time.Minute)))
+	*now = now.Add(30 * time.Second)
+	assert.ErrorIs(t, c.Check("id1", time.Time{}), ErrTokenReplayed)
+	*now = now.Add(30 * time.Second)
+	assert.NoError(t, c.Check("id1", time.Time{}))
+
+	// An already expired token is not remembered.
+	require.NoError(t, c.Check("expired", now.Add(-time.Second)))
+	require.NoError(t, c.Check("expired", now.Add(-time.Second)))
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestReplayCache_maxEntries(t *testing.T) {
+	c, now := newTestReplayCache(ReplayConfig{Window: time.Minute, MaxEntries: 3})
+	for i := 0; i < 10; i++ {
+		require.NoError(t, c.Check(fmt.Sprintf("id%d", i), time.Time{}))
+		*now = now.Add(time.Second)
+		assert.LessOrEqual(t, c.Len(), 3)
+	}
+
+	// The entries closest to expiring were forgotten first.
+	assert.NoError(t, c.Check("id0", time.Time{}))
+	assert.ErrorIs(t, c.Check("id9", time.Time{}), ErrTokenReplayed)
+}
+
+func TestMakeIdentifiedJWT(t *testing.T) {
+	require.NoError(t, RegisterServiceauthKeyset(LoadTestKeys(t), "key1"))
+
+	token1, err := MakeIdentifiedJWT("jenkins", "ci", "agent1", Scope{Methods: []string{"POST"}}, nil)
+	require.NoError(t, err)
+	token2, err := MakeIdentifiedJWT("jenkins", "ci", "agent1", Scope{}, nil)
+	require.NoError(t, err)
+
+	epType, epName, agent, scope, err := ValidateScopedJWT(token1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "jenkins", epType)
+	assert.Equal(t, "ci", epName)
+	assert.Equal(t, "agent1", agent)
+	assert.Equal(t, []string{"POST"}, scope.Methods)
+
+	id1, expires := TokenID(token1)
+	assert.NotEmpty(t, id1)
+	assert.True(t, expires.IsZero())
+	id2, _ := TokenID(token2)
+	assert.NotEmpty(t, id2)
+	assert.NotEqual(t, id1, id2)
+
+	unidentified, err := MakeJWT("jenkins", "ci", "agent1", nil)
+	require.NoError(t, err)
+	id, _ := TokenID(unidentified)
+	assert.Empty(t, id)
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/skandragon/jwtregistry"
+)
+
+const (
+	jwtScopeServicesKey = "s"
+	jwtScopeMethodsKey  = "m"
+)
+
+// Scope limits where a service credential may be used.  An empty list
+// places no limit, so the zero Scope allows everything a credential
+// without a scope would.
+type Scope struct {
+	// Services are the names of the incoming services the credential
+	// may be presented to.
+	Services []string
+	// Methods are the HTTP methods the credential may be used with.
+	Methods []string
+}
+
+// Allows returns true if a request using method, made to the incoming
+// service named service, is within the scope.
+func (s Scope) Allows(service string, method string) bool {
+	if len(s.Services) > 0 && !contains(s.Services, service) {
+		return false
+	}
+	if len(s.Methods) > 0 && !contains(s.Methods, strings.ToUpper(method)) {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// MakeScopedJWT is MakeJWT, with the scope also embedded in the claims.
+// The names in the scope must not contain commas.
+func MakeScopedJWT(epType string, epName string, agent string, scope Scope, clock jwt.Clock) (string, error) {
+	return makeScopedJWT(serviceauthRegistryName, epType, epName, agent, scope, "", clock)
+}
+
+func makeScopedJWT(registry string, epType string, epName string, agent string, scope Scope, tokenID string, clock jwt.Clock) (string, error) {
+	claims := map[string]string{
+		jwtEndpointTypeKey: epType,
+		jwtEndpointNameKey: epName,
+		jwtAgentKey:        agent,
+	}
+	if len(scope.Services) > 0 {
+		claims[jwtScopeServicesKey] = strings.Join(scope.Services, ",")
+	}
+	if len(scope.Methods) > 0 {
+		claims[jwtScopeMethodsKey] = strings.ToUpper(strings.Join(scope.Methods, ","))
+	}
+	if tokenID != "" {
+		claims[jwt.JwtIDKey] = tokenID
+	}
+
+	signed, err := jwtregistry.Sign(registry, claims, clock)
+	if err != nil {
+		return "", err
+	}
+	return string(signed), nil
+}
+
+// validateClaims validates the token with the local keys, or, if it was
+// signed with a key they do not have, with the external JWKS if one is
+// registered.
+func validateClaims(tokenString string, clock jwt.Clock) (map[string]string, error) {
+	if external := getExternalKeys(); external != nil && !knownServiceauthKeyID(tokenKeyID(tokenString)) {
+		return external.validate(tokenString, clock)
+	}
+	return jwtregistry.Validate(serviceauthRegistryName, []byte(tokenString), clock)
+}
+
+// ValidateScopedJWT is ValidateJWT, also returning the embedded scope.
+// Tokens made without a scope return the zero Scope.
+func ValidateScopedJWT(tokenString string, clock jwt.Clock) (epType string, epName string, agent string, scope Scope, err error) {
+	claims, err := validateClaims(tokenString, clock)
+	if err != nil {
+		recordJWTValidation(validationFailure(tokenString, err))
+		return
+	}
+	var found bool
+	if epType, found = claims[jwtEndpointTypeKey]; !found {
+		err = fmt.Errorf("no '%s' key in JWT claims", jwtEndpointTypeKey)
+	}
+	if epName, found = claims[jwtEndpointNameKey]; !found {
+		err = fmt.Errorf("no '%s' key in JWT claims", jwtEndpointNameKey)
+	}
+	if agent, found = claims[jwtAgentKey]; !found {
+		err = fmt.Errorf("no '%s' key in JWT claims", jwtAgentKey)
+	}
+	if err != nil {
+		recordJWTValidation(validationMalformed)
+		return
+	}
+	if services, found := claims[jwtScopeServicesKey]; found {
+		scope.Services = strings.Split(services, ",")
+	}
+	if methods, found := claims[jwtScopeMethodsKey]; found {
+		scope.Methods = strings.Split(methods, ",")
+	}
+	recordJWTValidation(validationSuccess)
+	return
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScope_Allows(t *testing.T) {
+	tests := []struct {
+		name    string
+		scope   Scope
+		service string
+		method  string
+		want    bool
+	}{
+		{"unscoped", Scope{}, "jenkins", "DELETE", true},
+		{"service allowed", Scope{Services: []string{"a", "b"}}, "b", "GET", true},
+		{"service denied", Scope{Services: []string{"a"}}, "b", "GET", false},
+		{"method allowed", Scope{Methods: []string{"GET", "HEAD"}}, "a", "HEAD", true},
+		{"method case", Scope{Methods: []string{"GET"}}, "a", "get", true},
+		{"method denied", Scope{Methods: []string{"GET"}}, "a", "POST", false},
+		{"both allowed", Scope{Services: []string{"a"}, Methods: []string{"GET"}}, "a", "GET", true},
+		{"both, method denied", Scope{Services: []string{"a"}, Methods: []string{"GET"}}, "a", "PUT", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.scope.Allows(tt.service, tt.method))
+		})
+	}
+}
+
+func TestMakeScopedJWT(t *testing.T) {
+	require.NoError(t, RegisterServiceauthKeyset(LoadTestKeys(t), "key1"))
+
+	tests := []struct {
+		name  string
+		scope Scope
+		want  Scope
+	}{
+		{"unscoped", Scope{}, Scope{}},
+		{"services", Scope{Services: []string{"a", "b"}}, Scope{Services: []string{"a", "b"}}},
+		{"methods", Scope{Methods: []string{"get", "POST"}}, Scope{Methods: []string{"GET", "POST"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := MakeScopedJWT("jenkins", "ci", "agent1", tt.scope, nil)
+			require.NoError(t, err)
+			epType, epName, agent, scope, err := ValidateScopedJWT(token, nil)
+			require.NoError(t, err)
+			assert.Equal(t, "jenkins", epType)
+			assert.Equal(t, "ci", epName)
+			assert.Equal(t, "agent1", agent)
+			assert.Equal(t, tt.want, scope)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package kafka publishes the controller's events, such as agent
+// connections and credential issuance, to a Kafka topic.  Events are
+// buffered and sent in batches by a Sink, through a Producer which talks
+// to the brokers.
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultBufferSize   = 1000
+	defaultBatchSize    = 100
+	defaultBatchTimeout = time.Second
+	defaultSendTimeout  = 10 * time.Second
+)
+
+// Config describes where events are published, and how they are buffered.
+// Up to BufferSize (default 1000) events wait to be sent; more are dropped.
+// They are sent in batches of up to BatchSize (default 100), at least every
+// BatchTimeout (default 1s).
+type Config struct {
+	Brokers      []string      `yaml:"brokers,omitempty"`
+	Topic        string        `yaml:"topic,omitempty"`
+	ClientID     string        `yaml:"clientId,omitempty"`
+	TLS          bool          `yaml:"tls,omitempty"`
+	SASL         *SASLConfig   `yaml:"sasl,omitempty"`
+	BufferSize   int           `yaml:"bufferSize,omitempty"`
+	BatchSize    int           `yaml:"batchSize,omitempty"`
+	BatchTimeout time.Duration `yaml:"batchTimeout,omitempty"`
+}
+
+// SASLConfig authenticates to the brokers.  The password is read from
+// PasswordFile, so it can be mounted from a secret.
+type SASLConfig struct {
+	Mechanism    string `yaml:"mechanism,omitempty"`
+	Username     string `yaml:"username,omitempty"`
+	PasswordFile string `yaml:"passwordFile,omitempty"`
+}
+
+var saslMechanisms = map[string]bool{
+	"PLAIN":         true,
+	"SCRAM-SHA-256": true,
+	"SCRAM-SHA-512": true,
+}
+
+// Validate returns every problem with the configuration.
+func (c Config) Validate() []error {
+	problems := []error{}
+	if len(c.Brokers) == 0 {
+		problems = append(problems, fmt.Errorf("brokers not set"))
+	}
+	for _, broker := range c.Brokers {
+		if broker == "" {
+			problems = append(problems, fmt.Errorf("brokers must not be empty"))
+		}
+	}
+	if c.Topic == "" {
+		problems = append(problems, fmt.Errorf("topic not set"))
+	}
+	if c.BufferSize < 0 || c.BatchSize < 0 || c.BatchTimeout < 0 {
+		problems = append(problems, fmt.Errorf("bufferSize, batchSize, and batchTimeout must not be negative"))
+	}
+	if c.SASL != nil {
+		if !saslMechanisms[c.SASL.Mechanism] {
+			problems = append(problems, fmt.Errorf("sasl.mechanism must be PLAIN, SCRAM-SHA-256, or SCRAM-SHA-512, not '%s'", c.SASL.Mechanism))
+		}
+		if c.SASL.Username == "" || c.SASL.PasswordFile == "" {
+			problems = append(problems, fmt.Errorf("sasl.username and sasl.passwordFile are required"))
+		}
+	}
+	return problems
+}
+
+// Message is a single record to publish.  A nil Key lets the producer
+// choose the partition.
+type Message struct {
+	Key   []byte
+	Value []byte
+}
+
+// Producer publishes batches of messages to a topic.  Produce returns once
+// the brokers have accepted the batch, or with an error if they did not.
+// It must not keep the messages after it returns.
+type Producer interface {
+	Produce(ctx context.Context, topic string, messages []Message) error
+	Close() error
+}
+
+// Keyed is implemented by events which have a natural key, such as the
+// agent they concern.  Events with the same key are published to the same
+// partition, so they are consumed in order.
+type Keyed interface {
+	EventKey() string
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// writerBatchTimeout is how long the writer waits for more messages before
+// sending a partial batch to a partition.  The Sink has already batched
+// them, so there is nothing to gain from waiting long.
+const writerBatchTimeout = 10 * time.Millisecond
+
+// writerProducer publishes through a kafka-go Writer.  Messages with a key
+// are hashed to a partition, so those with the same key stay in order.
+type writerProducer struct {
+	writer *kafkago.Writer
+}
+
+// NewProducer returns a Producer connected to the configured brokers.  The
+// connection is made when the first batch is published, so an unreachable
+// broker is not an error here.
+func NewProducer(config Config) (Producer, error) {
+	transport := &kafkago.Transport{
+		ClientID: config.ClientID,
+	}
+	if config.TLS {
+		transport.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if config.SASL != nil {
+		mechanism, err := config.SASL.mechanism()
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = mechanism
+	}
+	batchSize := config.BatchSize
+	if batchSize == 0 {
+		batchSize = defaultBatchSize
+	}
+	return &writerProducer{
+		writer: &kafkago.Writer{
+			Addr:         kafkago.TCP(config.Brokers...),
+			Balancer:     &kafkago.Hash{},
+			BatchSize:    batchSize,
+			BatchTimeout: writerBatchTimeout,
+			RequiredAcks: kafkago.RequireAll,
+			Transport:    transport,
+		},
+	}, nil
+}
+
+// mechanism reads the password and returns the SASL mechanism to use.
+func (c *SASLConfig) mechanism() (sasl.Mechanism, error) {
+	b, err := os.ReadFile(c.PasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("sasl.passwordFile: %v", err)
+	}
+	password := strings.TrimSpace(string(b))
+	switch c.Mechanism {
+	case "PLAIN":
+		return plain.Mechanism{Username: c.Username, Password: password}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, c.Username, password)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, c.Username, password)
+	}
+	return nil, fmt.Errorf("unknown sasl.mechanism '%s'", c.Mechanism)
+}
+
+func (p *writerProducer) Produce(ctx context.Context, topic string, messages []Message) error {
+	records := make([]kafkago.Message, len(messages))
+	for i, m := range messages {
+		records[i] = kafkago.Message{Topic: topic, Key: m.Key, Value: m.Value}
+	}
+	return p.writer.WriteMessages(ctx, records...)
+}
+
+func (p *writerProducer) Close() error {
+	return p.writer.Close()
+}
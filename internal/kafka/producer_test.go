@@ -0,0 +1,63 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafka
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewProducer(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("secret\n"), 0600))
+
+	tests := []struct {
+		name    string
+		sasl    *SASLConfig
+		wantErr string
+	}{
+		{"no sasl", nil, ""},
+		{"plain", &SASLConfig{Mechanism: "PLAIN", Username: "u", PasswordFile: passwordFile}, ""},
+		{"scram", &SASLConfig{Mechanism: "SCRAM-SHA-512", Username: "u", PasswordFile: passwordFile}, ""},
+		{"missing password", &SASLConfig{Mechanism: "PLAIN", Username: "u", PasswordFile: passwordFile + ".missing"}, "sasl.passwordFile"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			producer, err := NewProducer(Config{Brokers: []string{"kafka:9092"}, Topic: "events", SASL: tt.sasl})
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.NoError(t, producer.Close())
+		})
+	}
+}
+
+func TestSASLConfig_mechanism(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("secret\n"), 0600))
+
+	mechanism, err := (&SASLConfig{Mechanism: "PLAIN", Username: "u", PasswordFile: passwordFile}).mechanism()
+	require.NoError(t, err)
+	assert.Equal(t, plain.Mechanism{Username: "u", Password: "secret"}, mechanism)
+}
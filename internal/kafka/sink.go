@@ -0,0 +1,160 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// The reasons an event is counted as dropped.
+const (
+	dropBufferFull    = "buffer_full"
+	dropMarshalFailed = "marshal_failed"
+	dropPublishFailed = "publish_failed"
+)
+
+var (
+	publishedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_events_published_total",
+		Help: "The total number of events published to Kafka, by topic",
+	}, []string{"topic"})
+
+	droppedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_events_dropped_total",
+		Help: "The total number of events which were not published to Kafka, by topic and reason",
+	}, []string{"topic", "reason"})
+)
+
+// Sink publishes the events sent to it as JSON, in batches.  Send never
+// blocks: when the buffer is full, because the brokers are slow or
+// unreachable, the event is dropped and counted instead.  It takes the
+// same events as the webhook Runner.
+type Sink struct {
+	topic        string
+	producer     Producer
+	batchSize    int
+	batchTimeout time.Duration
+	events       chan Message
+}
+
+// NewSink returns a sink publishing to the configured topic through the
+// producer.  Call Run to start publishing.
+func NewSink(config Config, producer Producer) *Sink {
+	s := &Sink{
+		topic:        config.Topic,
+		producer:     producer,
+		batchSize:    config.BatchSize,
+		batchTimeout: config.BatchTimeout,
+	}
+	bufferSize := config.BufferSize
+	if bufferSize == 0 {
+		bufferSize = defaultBufferSize
+	}
+	if s.batchSize == 0 {
+		s.batchSize = defaultBatchSize
+	}
+	if s.batchTimeout == 0 {
+		s.batchTimeout = defaultBatchTimeout
+	}
+	s.events = make(chan Message, bufferSize)
+	return s
+}
+
+// Send queues the event to be published.  It is keyed by its EventKey, if
+// it is Keyed.
+func (s *Sink) Send(msg interface{}) {
+	value, err := json.Marshal(msg)
+	if err != nil {
+		zap.S().Errorw("unable to marshal event for Kafka", "error", err)
+		droppedCounter.WithLabelValues(s.topic, dropMarshalFailed).Inc()
+		return
+	}
+	m := Message{Value: value}
+	if keyed, ok := msg.(Keyed); ok {
+		m.Key = []byte(keyed.EventKey())
+	}
+	select {
+	case s.events <- m:
+	default:
+		droppedCounter.WithLabelValues(s.topic, dropBufferFull).Inc()
+	}
+}
+
+// Run publishes batches of events until ctx is done, then publishes those
+// still buffered and closes the producer.
+func (s *Sink) Run(ctx context.Context) {
+	defer s.producer.Close()
+	ticker := time.NewTicker(s.batchTimeout)
+	defer ticker.Stop()
+	batch := make([]Message, 0, s.batchSize)
+	for {
+		select {
+		case m := <-s.events:
+			batch = append(batch, m)
+			if len(batch) < s.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.flush(batch)
+			return
+		}
+		batch = s.publish(ctx, batch)
+	}
+}
+
+// flush publishes the batch, and everything buffered, before Run returns.
+func (s *Sink) flush(batch []Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSendTimeout)
+	defer cancel()
+	for {
+		select {
+		case m := <-s.events:
+			batch = append(batch, m)
+			if len(batch) >= s.batchSize {
+				batch = s.publish(ctx, batch)
+			}
+		default:
+			s.publish(ctx, batch)
+			return
+		}
+	}
+}
+
+// publish sends the batch, and returns it emptied for reuse.  A batch
+// which the brokers do not accept is dropped, as retrying it would only
+// hold up the events behind it.
+func (s *Sink) publish(ctx context.Context, batch []Message) []Message {
+	if len(batch) == 0 {
+		return batch
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultSendTimeout)
+	defer cancel()
+	if err := s.producer.Produce(ctx, s.topic, batch); err != nil {
+		zap.S().Warnw("unable to publish events to Kafka", "topic", s.topic, "events", len(batch), "error", err)
+		droppedCounter.WithLabelValues(s.topic, dropPublishFailed).Add(float64(len(batch)))
+	} else {
+		publishedCounter.WithLabelValues(s.topic).Add(float64(len(batch)))
+	}
+	return batch[:0]
+}
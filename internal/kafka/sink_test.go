@@ -0,0 +1,196 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockProducer records the batches it is given.
+type mockProducer struct {
+	sync.Mutex
+	topics  []string
+	batches [][]Message
+	err     error
+	closed  bool
+}
+
+func (p *mockProducer) Produce(ctx context.Context, topic string, messages []Message) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.topics = append(p.topics, topic)
+	p.batches = append(p.batches, append([]Message{}, messages...))
+	return nil
+}
+
+func (p *mockProducer) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (p *mockProducer) messages() []Message {
+	p.Lock()
+	defer p.Unlock()
+	ret := []Message{}
+	for _, batch := range p.batches {
+		ret = append(ret, batch...)
+	}
+	return ret
+}
+
+type agentEvent struct {
+	Name string `json:"name"`
+}
+
+func (e agentEvent) EventKey() string {
+	return e.Name
+}
+
+type unkeyedEvent struct {
+	Message string `json:"message"`
+}
+
+// runSink runs the sink until the returned function is called, which waits
+// for it to finish.
+func runSink(s *Sink) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr []string
+	}{
+		{"valid", Config{Brokers: []string{"kafka:9092"}, Topic: "events"}, []string{}},
+		{"valid sasl", Config{Brokers: []string{"kafka:9092"}, Topic: "events", SASL: &SASLConfig{Mechanism: "SCRAM-SHA-512", Username: "u", PasswordFile: "/p"}}, []string{}},
+		{"empty", Config{}, []string{"brokers not set", "topic not set"}},
+		{"negative", Config{Brokers: []string{""}, Topic: "events", BufferSize: -1}, []string{
+			"brokers must not be empty",
+			"bufferSize, batchSize, and batchTimeout must not be negative",
+		}},
+		{"bad sasl", Config{Brokers: []string{"kafka:9092"}, Topic: "events", SASL: &SASLConfig{Mechanism: "GSSAPI"}}, []string{
+			"sasl.mechanism must be PLAIN, SCRAM-SHA-256, or SCRAM-SHA-512, not 'GSSAPI'",
+			"sasl.username and sasl.passwordFile are required",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, err := range tt.config.Validate() {
+				got = append(got, err.Error())
+			}
+			assert.Equal(t, tt.wantErr, got)
+		})
+	}
+}
+
+func TestSink_keys(t *testing.T) {
+	producer := &mockProducer{}
+	s := NewSink(Config{Topic: "keys", BatchTimeout: time.Hour}, producer)
+	s.Send(agentEvent{Name: "agent1"})
+	s.Send(unkeyedEvent{Message: "hello"})
+	s.Send(&agentEvent{Name: "agent2"})
+	runSink(s)()
+
+	assert.True(t, producer.closed)
+	assert.Equal(t, []string{"keys"}, producer.topics)
+	assert.Equal(t, []Message{
+		{Key: []byte("agent1"), Value: []byte(`{"name":"agent1"}`)},
+		{Value: []byte(`{"message":"hello"}`)},
+		{Key: []byte("agent2"), Value: []byte(`{"name":"agent2"}`)},
+	}, producer.messages())
+	assert.Equal(t, 3.0, testutil.ToFloat64(publishedCounter.WithLabelValues("keys")))
+}
+
+func TestSink_batches(t *testing.T) {
+	producer := &mockProducer{}
+	s := NewSink(Config{Topic: "batches", BatchSize: 2, BatchTimeout: time.Hour}, producer)
+	stop := runSink(s)
+	for i := 0; i < 4; i++ {
+		s.Send(agentEvent{Name: "agent"})
+	}
+	require.Eventually(t, func() bool { return len(producer.messages()) == 4 }, 5*time.Second, time.Millisecond)
+	s.Send(agentEvent{Name: "last"})
+	stop()
+
+	require.Len(t, producer.batches, 3)
+	assert.Len(t, producer.batches[0], 2)
+	assert.Len(t, producer.batches[1], 2)
+	assert.Equal(t, []Message{{Key: []byte("last"), Value: []byte(`{"name":"last"}`)}}, producer.batches[2])
+}
+
+func TestSink_batchTimeout(t *testing.T) {
+	producer := &mockProducer{}
+	s := NewSink(Config{Topic: "timeout", BatchTimeout: 10 * time.Millisecond}, producer)
+	stop := runSink(s)
+	defer stop()
+	s.Send(agentEvent{Name: "agent"})
+	require.Eventually(t, func() bool { return len(producer.messages()) == 1 }, 5*time.Second, time.Millisecond)
+}
+
+func TestSink_bufferFull(t *testing.T) {
+	producer := &mockProducer{}
+	s := NewSink(Config{Topic: "full", BufferSize: 2, BatchTimeout: time.Hour}, producer)
+
+	// Nothing is publishing, as if the brokers were not keeping up.
+	for i := 0; i < 5; i++ {
+		s.Send(agentEvent{Name: "agent"})
+	}
+	assert.Equal(t, 3.0, testutil.ToFloat64(droppedCounter.WithLabelValues("full", dropBufferFull)))
+
+	runSink(s)()
+	assert.Len(t, producer.messages(), 2)
+}
+
+func TestSink_publishFailed(t *testing.T) {
+	producer := &mockProducer{err: errors.New("broker unavailable")}
+	s := NewSink(Config{Topic: "failed", BatchTimeout: time.Hour}, producer)
+	s.Send(agentEvent{Name: "agent1"})
+	s.Send(agentEvent{Name: "agent2"})
+	runSink(s)()
+	assert.Equal(t, 2.0, testutil.ToFloat64(droppedCounter.WithLabelValues("failed", dropPublishFailed)))
+	assert.Empty(t, producer.messages())
+}
+
+func TestSink_marshalFailed(t *testing.T) {
+	s := NewSink(Config{Topic: "marshal"}, &mockProducer{})
+	s.Send(func() {})
+	assert.Equal(t, 1.0, testutil.ToFloat64(droppedCounter.WithLabelValues("marshal", dropMarshalFailed)))
+}
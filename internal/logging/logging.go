@@ -0,0 +1,60 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package logging builds the process's logger, at a level which can be
+// changed while it runs.
+package logging
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// LevelEndpoint is the path the log level is served on.  A GET returns
+// the current level, such as {"level":"info"}, and a PUT of the same
+// JSON changes it.
+const LevelEndpoint = "/loglevel"
+
+// NewLogger returns a production logger at the named level, such as
+// "debug" or "info", and the level, which changes the logger when set.
+func NewLogger(level string) (*zap.Logger, zap.AtomicLevel, error) {
+	atom, err := zap.ParseAtomicLevel(level)
+	if err != nil {
+		return nil, atom, fmt.Errorf("log level: %v", err)
+	}
+	config := zap.NewProductionConfig()
+	config.Level = atom
+	logger, err := config.Build()
+	return logger, atom, err
+}
+
+// RegisterLevelHandler adds the log level endpoint to mux, wrapped by
+// middleware, which should authenticate the caller.
+func RegisterLevelHandler(mux *http.ServeMux, middleware func(http.Handler) http.Handler, level zap.AtomicLevel) {
+	mux.Handle(LevelEndpoint, middleware(levelHandler(level)))
+}
+
+func levelHandler(level zap.AtomicLevel) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		before := level.Level()
+		level.ServeHTTP(w, r)
+		if after := level.Level(); after != before {
+			zap.S().Infow("log level changed", "from", before, "to", after, "remoteAddr", r.RemoteAddr)
+		}
+	})
+}
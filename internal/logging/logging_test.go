@@ -0,0 +1,86 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opsmx/oes-birger/internal/metricsauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNewLogger(t *testing.T) {
+	logger, level, err := NewLogger("warn")
+	require.NoError(t, err)
+	assert.Equal(t, zap.WarnLevel, level.Level())
+	assert.Nil(t, logger.Check(zap.InfoLevel, "hidden"))
+
+	level.SetLevel(zap.DebugLevel)
+	assert.NotNil(t, logger.Check(zap.DebugLevel, "shown"))
+
+	_, _, err = NewLogger("loud")
+	assert.Error(t, err)
+}
+
+func TestRegisterLevelHandler(t *testing.T) {
+	open := metricsauth.Config{Type: metricsauth.TypeNone}
+	bearer := metricsauth.Config{Type: metricsauth.TypeBearer, Token: "secret"}
+
+	tests := []struct {
+		name       string
+		auth       metricsauth.Config
+		authHeader string
+		method     string
+		body       string
+		wantStatus int
+		wantBody   string
+		wantLevel  string
+	}{
+		{"get", open, "", http.MethodGet, "", http.StatusOK, `{"level":"info"}`, "info"},
+		{"set", open, "", http.MethodPut, `{"level":"debug"}`, http.StatusOK, `{"level":"debug"}`, "debug"},
+		{"set invalid", open, "", http.MethodPut, `{"level":"loud"}`, http.StatusBadRequest, "", "info"},
+		{"set without token", bearer, "", http.MethodPut, `{"level":"debug"}`, http.StatusUnauthorized, "", "info"},
+		{"set with wrong token", bearer, "Bearer wrong", http.MethodPut, `{"level":"debug"}`, http.StatusUnauthorized, "", "info"},
+		{"set with token", bearer, "Bearer secret", http.MethodPut, `{"level":"error"}`, http.StatusOK, `{"level":"error"}`, "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, level, err := NewLogger("info")
+			require.NoError(t, err)
+			mux := http.NewServeMux()
+			RegisterLevelHandler(mux, tt.auth.Handler, level)
+
+			r := httptest.NewRequest(tt.method, LevelEndpoint, strings.NewReader(tt.body))
+			if tt.authHeader != "" {
+				r.Header.Set("Authorization", tt.authHeader)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, w.Body.String())
+			}
+			assert.Equal(t, tt.wantLevel, level.String())
+			assert.Equal(t, tt.wantLevel == "debug", logger.Core().Enabled(zap.DebugLevel))
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package metricsauth optionally protects the Prometheus metrics endpoint
+// with a bearer token or a client certificate.
+package metricsauth
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/opsmx/oes-birger/internal/ca"
+	"github.com/opsmx/oes-birger/internal/util"
+)
+
+// Authentication types
+const (
+	TypeNone   = "none"
+	TypeBearer = "bearer"
+	TypeMTLS   = "mtls"
+)
+
+// Config describes how the metrics endpoint is protected.  If Type is empty
+// or "none", the endpoint is open.  For "bearer", the token is read from
+// TokenFile if set, otherwise Token is used.  For "mtls", clients must
+// present a control certificate issued by the controller's CA.
+type Config struct {
+	Type      string `yaml:"type,omitempty"`
+	Token     string `yaml:"token,omitempty"`
+	TokenFile string `yaml:"tokenFile,omitempty"`
+}
+
+// Load validates the configuration, and reads the token file if one is used.
+func (c *Config) Load() error {
+	switch c.Type {
+	case "", TypeNone:
+		c.Type = TypeNone
+	case TypeBearer:
+		if c.TokenFile != "" {
+			b, err := os.ReadFile(c.TokenFile)
+			if err != nil {
+				return fmt.Errorf("metrics auth: %v", err)
+			}
+			c.Token = strings.TrimSpace(string(b))
+		}
+		if c.Token == "" {
+			return fmt.Errorf("metrics auth: bearer token is empty")
+		}
+	case TypeMTLS:
+	default:
+		return fmt.Errorf("metrics auth: unknown type '%s'", c.Type)
+	}
+	return nil
+}
+
+// Handler wraps h to require the configured authentication.
+func (c Config) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.authorized(r) {
+			if c.Type == TypeBearer {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (c Config) authorized(r *http.Request) bool {
+	switch c.Type {
+	case TypeBearer:
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			return false
+		}
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) == 1
+	case TypeMTLS:
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			return false
+		}
+		name, err := ca.GetCertificateNameFromCert(r.TLS.VerifiedChains[0][0])
+		return err == nil && name.Purpose == ca.CertificatePurposeControl
+	}
+	return true
+}
+
+// TLSConfig returns the server TLS configuration needed for mTLS, or nil
+// if the server should use plain HTTP.  Client certificates are optional at
+// the TLS layer so health checks continue to work without one; Handler
+// rejects metrics requests which did not present a verified certificate.
+func (c Config) TLSConfig(authority ca.CertPoolGenerator, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Config, error) {
+	if c.Type != TypeMTLS {
+		return nil, nil
+	}
+	certPool, err := authority.MakeCertPool()
+	if err != nil {
+		return nil, err
+	}
+	return ca.ReloadingClientCAs(util.ApplyTLSSettings(&tls.Config{
+		ClientCAs:      certPool,
+		ClientAuth:     tls.VerifyClientCertIfGiven,
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}), authority), nil
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metricsauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opsmx/oes-birger/internal/ca"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func TestConfig_Load(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("from-file\n"), 0600))
+
+	tests := []struct {
+		name      string
+		config    Config
+		wantType  string
+		wantToken string
+		wantErr   bool
+	}{
+		{"default", Config{}, TypeNone, "", false},
+		{"bearer", Config{Type: TypeBearer, Token: "abc"}, TypeBearer, "abc", false},
+		{"bearer from file", Config{Type: TypeBearer, Token: "abc", TokenFile: tokenFile}, TypeBearer, "from-file", false},
+		{"bearer without token", Config{Type: TypeBearer}, "", "", true},
+		{"missing token file", Config{Type: TypeBearer, TokenFile: tokenFile + ".missing"}, "", "", true},
+		{"mtls", Config{Type: TypeMTLS}, TypeMTLS, "", false},
+		{"unknown", Config{Type: "magic"}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Load()
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantType, tt.config.Type)
+			assert.Equal(t, tt.wantToken, tt.config.Token)
+		})
+	}
+}
+
+func TestConfig_Handler(t *testing.T) {
+	verifiedAs := func(purpose string) *tls.ConnectionState {
+		name, err := json.Marshal(ca.CertificateName{Name: "prometheus", Purpose: purpose})
+		require.NoError(t, err)
+		cert := &x509.Certificate{Subject: pkix.Name{OrganizationalUnit: []string{string(name)}}}
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	tests := []struct {
+		name       string
+		config     Config
+		authHeader string
+		tls        *tls.ConnectionState
+		wantStatus int
+	}{
+		{"open", Config{Type: TypeNone}, "", nil, http.StatusOK},
+		{"bearer, no token", Config{Type: TypeBearer, Token: "secret"}, "", nil, http.StatusUnauthorized},
+		{"bearer, wrong token", Config{Type: TypeBearer, Token: "secret"}, "Bearer wrong", nil, http.StatusUnauthorized},
+		{"bearer, right token", Config{Type: TypeBearer, Token: "secret"}, "Bearer secret", nil, http.StatusOK},
+		{"mtls, plain http", Config{Type: TypeMTLS}, "", nil, http.StatusUnauthorized},
+		{"mtls, no client cert", Config{Type: TypeMTLS}, "", &tls.ConnectionState{}, http.StatusUnauthorized},
+		{"bearer, token without scheme", Config{Type: TypeBearer, Token: "secret"}, "secret", nil, http.StatusUnauthorized},
+		{"bearer, other scheme", Config{Type: TypeBearer, Token: "secret"}, "Basic secret", nil, http.StatusUnauthorized},
+		{"mtls, verified control cert", Config{Type: TypeMTLS}, "", verifiedAs(ca.CertificatePurposeControl), http.StatusOK},
+		{"mtls, verified agent cert", Config{Type: TypeMTLS}, "", verifiedAs(ca.CertificatePurposeAgent), http.StatusUnauthorized},
+		{"mtls, verified cert without name", Config{Type: TypeMTLS}, "", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.authHeader != "" {
+				r.Header.Set("Authorization", tt.authHeader)
+			}
+			r.TLS = tt.tls
+			w := httptest.NewRecorder()
+			tt.config.Handler(okHandler).ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
+
+type fakeAuthority struct{}
+
+func (*fakeAuthority) MakeCertPool() (*x509.CertPool, error) {
+	return x509.NewCertPool(), nil
+}
+
+func TestConfig_TLSConfig(t *testing.T) {
+	tlsConfig, err := Config{Type: TypeBearer}.TLSConfig(&fakeAuthority{}, nil)
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	tlsConfig, err = Config{Type: TypeMTLS}.TLSConfig(&fakeAuthority{}, nil)
+	require.NoError(t, err)
+	require.NotNil(t, tlsConfig)
+	assert.NotNil(t, tlsConfig.ClientCAs)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, tlsConfig.ClientAuth)
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ocspstaple fetches and refreshes an OCSP response for a server
+// certificate, so TLS listeners can staple it.
+package ocspstaple
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	defaultRefreshInterval = time.Hour
+	minRefreshInterval     = time.Minute
+	retryInterval          = time.Minute
+	maxResponseBytes       = 1024 * 1024
+)
+
+// Config describes where to fetch OCSP responses.  ResponderURL overrides
+// the responder named in the server certificate, and RefreshInterval is
+// the longest time a response is used before fetching another, which is
+// sooner if the response expires first.  It defaults to one hour.
+type Config struct {
+	ResponderURL    string        `yaml:"responderURL,omitempty"`
+	RefreshInterval time.Duration `yaml:"refreshInterval,omitempty"`
+}
+
+// Validate returns every problem with the configuration.
+func (c Config) Validate() []error {
+	problems := []error{}
+	if c.ResponderURL != "" {
+		u, err := url.Parse(c.ResponderURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("responderURL '%s' must be an http or https URL", c.ResponderURL))
+		}
+	}
+	if c.RefreshInterval < 0 {
+		problems = append(problems, fmt.Errorf("refreshInterval must not be negative"))
+	}
+	return problems
+}
+
+// Stapler holds a server certificate and the most recent OCSP response
+// for it.
+type Stapler struct {
+	sync.RWMutex
+	cert       tls.Certificate
+	leaf       *x509.Certificate
+	issuer     *x509.Certificate
+	config     Config
+	responder  string
+	refresh    time.Duration
+	nextUpdate time.Time
+	client     *http.Client
+	changed    chan struct{}
+}
+
+// NewStapler returns a Stapler for cert, which must have been issued by
+// the DER encoded issuer certificate.
+func NewStapler(cert tls.Certificate, issuerDER []byte, config Config) (*Stapler, error) {
+	s := &Stapler{
+		config:  config,
+		refresh: config.RefreshInterval,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		changed: make(chan struct{}, 1),
+	}
+	if s.refresh == 0 {
+		s.refresh = defaultRefreshInterval
+	}
+	if err := s.setCertificate(cert, issuerDER); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetCertificate replaces the server certificate, such as one issued again
+// after the CA is reloaded, dropping the staple for the previous one.  Run
+// fetches a response for the new certificate at once.
+func (s *Stapler) SetCertificate(cert tls.Certificate, issuerDER []byte) error {
+	if err := s.setCertificate(cert, issuerDER); err != nil {
+		return err
+	}
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *Stapler) setCertificate(cert tls.Certificate, issuerDER []byte) error {
+	if len(cert.Certificate) == 0 {
+		return fmt.Errorf("server certificate is empty")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing server certificate: %v", err)
+	}
+	issuer, err := x509.ParseCertificate(issuerDER)
+	if err != nil {
+		return fmt.Errorf("parsing issuer certificate: %v", err)
+	}
+	responder := s.config.ResponderURL
+	if responder == "" && len(leaf.OCSPServer) > 0 {
+		responder = leaf.OCSPServer[0]
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	cert.OCSPStaple = nil
+	s.cert = cert
+	s.leaf = leaf
+	s.issuer = issuer
+	s.responder = responder
+	s.nextUpdate = time.Time{}
+	return nil
+}
+
+// Responder returns the OCSP responder URL used, or "" if there is none.
+func (s *Stapler) Responder() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.responder
+}
+
+// GetCertificate returns the server certificate with the current OCSP
+// staple, if any.  It is suitable for tls.Config.GetCertificate.
+func (s *Stapler) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.RLock()
+	defer s.RUnlock()
+	cert := s.cert
+	return &cert, nil
+}
+
+// Refresh fetches a new OCSP response and staples it.
+func (s *Stapler) Refresh(ctx context.Context) error {
+	s.RLock()
+	leaf, issuer, responder := s.leaf, s.issuer, s.responder
+	s.RUnlock()
+
+	der, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, responder, bytes.NewReader(der))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OCSP responder returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return err
+	}
+	parsed, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return fmt.Errorf("parsing OCSP response: %v", err)
+	}
+	if parsed.Status == ocsp.Unknown {
+		return fmt.Errorf("OCSP responder does not know the server certificate")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.leaf != leaf {
+		return fmt.Errorf("server certificate was replaced while fetching its OCSP response")
+	}
+	s.cert.OCSPStaple = body
+	s.nextUpdate = parsed.NextUpdate
+	return nil
+}
+
+// dropExpired removes the staple once its response has expired.
+func (s *Stapler) dropExpired(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	if s.cert.OCSPStaple != nil && !s.nextUpdate.IsZero() && now.After(s.nextUpdate) {
+		s.cert.OCSPStaple = nil
+	}
+}
+
+// nextRefresh returns how long to wait before refreshing the response,
+// which is halfway to its expiry if that is sooner than the interval.
+func (s *Stapler) nextRefresh(now time.Time) time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+	wait := s.refresh
+	if !s.nextUpdate.IsZero() {
+		if half := s.nextUpdate.Sub(now) / 2; half < wait {
+			wait = half
+		}
+	}
+	if wait < minRefreshInterval {
+		wait = minRefreshInterval
+	}
+	return wait
+}
+
+// Run keeps the staple fresh until ctx is done, fetching a response at
+// once when the certificate is replaced.  If the certificate has no OCSP
+// responder, as for the built in CA, it logs and returns at once.
+func (s *Stapler) Run(ctx context.Context) {
+	responder := s.Responder()
+	if responder == "" {
+		zap.S().Infow("server certificate has no OCSP responder, not stapling")
+		return
+	}
+	zap.S().Infow("stapling OCSP responses", "responder", responder)
+	for {
+		wait := retryInterval
+		if err := s.Refresh(ctx); err != nil {
+			zap.S().Warnw("fetching OCSP response", "responder", s.Responder(), "error", err)
+			s.dropExpired(time.Now())
+		} else {
+			wait = s.nextRefresh(time.Now())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.changed:
+		case <-time.After(wait):
+		}
+	}
+}
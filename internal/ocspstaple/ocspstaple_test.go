@@ -0,0 +1,255 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ocspstaple
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func makeTestAuthority(t *testing.T) *testAuthority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testAuthority{cert: cert, key: key}
+}
+
+func (a *testAuthority) serverCert(t *testing.T, responders ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		OCSPServer:   responders,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// responder is a mock OCSP responder which answers with status for every
+// certificate, and counts the requests it receives.
+func (a *testAuthority) responder(t *testing.T, status int, nextUpdate time.Duration) (*httptest.Server, *int32) {
+	count := new(int32)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(count, 1)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		req, err := ocsp.ParseRequest(body)
+		require.NoError(t, err)
+		resp, err := ocsp.CreateResponse(a.cert, a.cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(nextUpdate),
+		}, a.key)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(resp)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, count
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   []string
+	}{
+		{"defaults", Config{}, []string{}},
+		{"valid", Config{ResponderURL: "http://ocsp.example.com", RefreshInterval: time.Minute}, []string{}},
+		{"bad url", Config{ResponderURL: "ocsp.example.com"}, []string{"responderURL 'ocsp.example.com' must be an http or https URL"}},
+		{"negative refresh", Config{RefreshInterval: -time.Second}, []string{"refreshInterval must not be negative"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := tt.config.Validate()
+			require.Len(t, problems, len(tt.want), "%v", problems)
+			for i, want := range tt.want {
+				assert.Equal(t, want, problems[i].Error())
+			}
+		})
+	}
+}
+
+func TestStapler_staplesResponse(t *testing.T) {
+	authority := makeTestAuthority(t)
+	responder, _ := authority.responder(t, ocsp.Good, time.Hour)
+
+	s, err := NewStapler(authority.serverCert(t, responder.URL), authority.cert.Raw, Config{})
+	require.NoError(t, err)
+	assert.Equal(t, responder.URL, s.Responder())
+	require.NoError(t, s.Refresh(context.Background()))
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{GetCertificate: s.GetCertificate}
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.cert)
+	conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{
+		RootCAs:    roots,
+		ServerName: "localhost",
+		MinVersion: tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	staple := conn.ConnectionState().OCSPResponse
+	require.NotEmpty(t, staple)
+	parsed, err := ocsp.ParseResponseForCert(staple, conn.ConnectionState().PeerCertificates[0], authority.cert)
+	require.NoError(t, err)
+	assert.Equal(t, ocsp.Good, parsed.Status)
+}
+
+func TestStapler_responderOverride(t *testing.T) {
+	authority := makeTestAuthority(t)
+	responder, count := authority.responder(t, ocsp.Good, time.Hour)
+
+	s, err := NewStapler(authority.serverCert(t, "http://unused.example.com"), authority.cert.Raw, Config{ResponderURL: responder.URL})
+	require.NoError(t, err)
+	require.NoError(t, s.Refresh(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(count))
+	cert, err := s.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.NotEmpty(t, cert.OCSPStaple)
+}
+
+func TestStapler_unknownStatus(t *testing.T) {
+	authority := makeTestAuthority(t)
+	responder, _ := authority.responder(t, ocsp.Unknown, time.Hour)
+
+	s, err := NewStapler(authority.serverCert(t, responder.URL), authority.cert.Raw, Config{})
+	require.NoError(t, err)
+	require.Error(t, s.Refresh(context.Background()))
+	cert, err := s.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Empty(t, cert.OCSPStaple)
+}
+
+func TestStapler_noResponder(t *testing.T) {
+	authority := makeTestAuthority(t)
+	s, err := NewStapler(authority.serverCert(t), authority.cert.Raw, Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "", s.Responder())
+
+	done := make(chan struct{})
+	go func() {
+		s.Run(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return without a responder")
+	}
+	cert, err := s.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Empty(t, cert.OCSPStaple)
+}
+
+func TestStapler_refreshTiming(t *testing.T) {
+	authority := makeTestAuthority(t)
+	responder, _ := authority.responder(t, ocsp.Good, 30*time.Minute)
+
+	s, err := NewStapler(authority.serverCert(t, responder.URL), authority.cert.Raw, Config{})
+	require.NoError(t, err)
+	now := time.Now()
+	assert.Equal(t, time.Hour, s.nextRefresh(now))
+
+	require.NoError(t, s.Refresh(context.Background()))
+	wait := s.nextRefresh(now)
+	assert.True(t, wait > 14*time.Minute && wait <= 15*time.Minute, "wait %s", wait)
+
+	s.dropExpired(now)
+	cert, _ := s.GetCertificate(nil)
+	assert.NotEmpty(t, cert.OCSPStaple)
+
+	s.dropExpired(now.Add(time.Hour))
+	cert, _ = s.GetCertificate(nil)
+	assert.Empty(t, cert.OCSPStaple)
+	assert.Equal(t, minRefreshInterval, s.nextRefresh(now.Add(time.Hour)))
+}
+
+func TestStapler_SetCertificate(t *testing.T) {
+	authority := makeTestAuthority(t)
+	responder, count := authority.responder(t, ocsp.Good, time.Hour)
+
+	s, err := NewStapler(authority.serverCert(t, responder.URL), authority.cert.Raw, Config{})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(count) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// A certificate from a reloaded CA replaces the old one and its
+	// staple, and a response for it is fetched without waiting for the
+	// refresh interval.
+	reloaded := makeTestAuthority(t)
+	replacement := reloaded.serverCert(t, responder.URL)
+	require.NoError(t, s.SetCertificate(replacement, reloaded.cert.Raw))
+	cert, err := s.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, replacement.Certificate, cert.Certificate)
+	assert.Empty(t, cert.OCSPStaple)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(count) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	require.Error(t, s.SetCertificate(tls.Certificate{}, reloaded.cert.Raw))
+	cert, err = s.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, replacement.Certificate, cert.Certificate)
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package otlpmetrics
+
+import (
+	"math"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// These follow the JSON encoding of the OTLP metrics protobuf messages, in
+// which 64 bit integers are strings.
+
+// aggregationTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const aggregationTemporalityCumulative = 2
+
+type exportRequest struct {
+	ResourceMetrics []resourceMetrics `json:"resourceMetrics"`
+}
+
+type resourceMetrics struct {
+	Resource     resource       `json:"resource"`
+	ScopeMetrics []scopeMetrics `json:"scopeMetrics"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeMetrics struct {
+	Scope   scope    `json:"scope"`
+	Metrics []metric `json:"metrics"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func stringAttribute(key string, value string) keyValue {
+	return keyValue{Key: key, Value: anyValue{StringValue: value}}
+}
+
+type metric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Gauge       *gauge     `json:"gauge,omitempty"`
+	Sum         *sum       `json:"sum,omitempty"`
+	Histogram   *histogram `json:"histogram,omitempty"`
+	Summary     *summary   `json:"summary,omitempty"`
+}
+
+type gauge struct {
+	DataPoints []numberDataPoint `json:"dataPoints"`
+}
+
+type sum struct {
+	DataPoints             []numberDataPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type histogram struct {
+	DataPoints             []histogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                  `json:"aggregationTemporality"`
+}
+
+type summary struct {
+	DataPoints []summaryDataPoint `json:"dataPoints"`
+}
+
+type numberDataPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	AsDouble          float64    `json:"asDouble"`
+}
+
+type histogramDataPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	Count             string     `json:"count"`
+	Sum               float64    `json:"sum"`
+	BucketCounts      []string   `json:"bucketCounts"`
+	ExplicitBounds    []float64  `json:"explicitBounds"`
+}
+
+type summaryDataPoint struct {
+	Attributes        []keyValue      `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               float64         `json:"sum"`
+	QuantileValues    []quantileValue `json:"quantileValues"`
+}
+
+type quantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+func nanos(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+func count(n uint64) string {
+	return strconv.FormatUint(n, 10)
+}
+
+// request converts the gathered metric families to an export request.
+// Values which JSON cannot represent, NaN and the infinities, are left
+// out.
+func (e *Exporter) request(families []*dto.MetricFamily) *exportRequest {
+	start := nanos(e.startTime.UnixNano())
+	now := nanos(e.now().UnixNano())
+	metrics := []metric{}
+	for _, family := range families {
+		if m, ok := convertFamily(family, start, now); ok {
+			metrics = append(metrics, m)
+		}
+	}
+	return &exportRequest{
+		ResourceMetrics: []resourceMetrics{{
+			Resource: resource{Attributes: e.resource},
+			ScopeMetrics: []scopeMetrics{{
+				Scope:   scope{Name: scopeName},
+				Metrics: metrics,
+			}},
+		}},
+	}
+}
+
+func finite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+func attributes(m *dto.Metric) []keyValue {
+	attrs := make([]keyValue, 0, len(m.GetLabel()))
+	for _, label := range m.GetLabel() {
+		attrs = append(attrs, stringAttribute(label.GetName(), label.GetValue()))
+	}
+	return attrs
+}
+
+func convertFamily(family *dto.MetricFamily, start string, now string) (metric, bool) {
+	m := metric{Name: family.GetName(), Description: family.GetHelp()}
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		s := &sum{AggregationTemporality: aggregationTemporalityCumulative, IsMonotonic: true}
+		for _, pm := range family.GetMetric() {
+			if v := pm.GetCounter().GetValue(); finite(v) {
+				s.DataPoints = append(s.DataPoints, numberDataPoint{Attributes: attributes(pm), StartTimeUnixNano: start, TimeUnixNano: now, AsDouble: v})
+			}
+		}
+		m.Sum = s
+		return m, len(s.DataPoints) > 0
+	case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		g := &gauge{}
+		for _, pm := range family.GetMetric() {
+			v := pm.GetGauge().GetValue()
+			if family.GetType() == dto.MetricType_UNTYPED {
+				v = pm.GetUntyped().GetValue()
+			}
+			if finite(v) {
+				g.DataPoints = append(g.DataPoints, numberDataPoint{Attributes: attributes(pm), TimeUnixNano: now, AsDouble: v})
+			}
+		}
+		m.Gauge = g
+		return m, len(g.DataPoints) > 0
+	case dto.MetricType_HISTOGRAM:
+		h := &histogram{AggregationTemporality: aggregationTemporalityCumulative}
+		for _, pm := range family.GetMetric() {
+			if finite(pm.GetHistogram().GetSampleSum()) {
+				h.DataPoints = append(h.DataPoints, convertHistogram(pm, start, now))
+			}
+		}
+		m.Histogram = h
+		return m, len(h.DataPoints) > 0
+	case dto.MetricType_SUMMARY:
+		s := &summary{}
+		for _, pm := range family.GetMetric() {
+			ps := pm.GetSummary()
+			if !finite(ps.GetSampleSum()) {
+				continue
+			}
+			dp := summaryDataPoint{
+				Attributes:        attributes(pm),
+				StartTimeUnixNano: start,
+				TimeUnixNano:      now,
+				Count:             count(ps.GetSampleCount()),
+				Sum:               ps.GetSampleSum(),
+				QuantileValues:    []quantileValue{},
+			}
+			for _, q := range ps.GetQuantile() {
+				if finite(q.GetValue()) {
+					dp.QuantileValues = append(dp.QuantileValues, quantileValue{Quantile: q.GetQuantile(), Value: q.GetValue()})
+				}
+			}
+			s.DataPoints = append(s.DataPoints, dp)
+		}
+		m.Summary = s
+		return m, len(s.DataPoints) > 0
+	}
+	return m, false
+}
+
+// convertHistogram converts Prometheus' cumulative buckets to OTLP's
+// counts per bucket, where the last bucket is everything above the
+// largest explicit bound.
+func convertHistogram(pm *dto.Metric, start string, now string) histogramDataPoint {
+	ph := pm.GetHistogram()
+	dp := histogramDataPoint{
+		Attributes:        attributes(pm),
+		StartTimeUnixNano: start,
+		TimeUnixNano:      now,
+		Count:             count(ph.GetSampleCount()),
+		Sum:               ph.GetSampleSum(),
+		BucketCounts:      []string{},
+		ExplicitBounds:    []float64{},
+	}
+	var previous uint64
+	for _, bucket := range ph.GetBucket() {
+		if !finite(bucket.GetUpperBound()) {
+			continue
+		}
+		dp.ExplicitBounds = append(dp.ExplicitBounds, bucket.GetUpperBound())
+		dp.BucketCounts = append(dp.BucketCounts, count(bucket.GetCumulativeCount()-previous))
+		previous = bucket.GetCumulativeCount()
+	}
+	dp.BucketCounts = append(dp.BucketCounts, count(ph.GetSampleCount()-previous))
+	return dp
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package otlpmetrics pushes the registered Prometheus metrics to an
+// OpenTelemetry collector, using OTLP over HTTP with JSON encoding.
+package otlpmetrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultInterval is how often metrics are pushed unless configured
+	// otherwise.
+	DefaultInterval = time.Minute
+
+	// DefaultPath is added to an endpoint given without a path.
+	DefaultPath = "/v1/metrics"
+
+	scopeName = "github.com/opsmx/oes-birger/internal/otlpmetrics"
+
+	exportTimeout = 30 * time.Second
+)
+
+// Exporter pushes the metrics from a Prometheus gatherer to an OTLP/HTTP
+// collector.  Counters are exported as cumulative sums, gauges and untyped
+// metrics as gauges, and histograms and summaries as themselves.
+type Exporter struct {
+	endpoint  string
+	gatherer  prometheus.Gatherer
+	resource  []keyValue
+	client    *http.Client
+	startTime time.Time
+	now       func() time.Time
+}
+
+// NewExporter returns an exporter pushing to the endpoint, such as
+// http://otel-collector:4318.  If the endpoint has no path, DefaultPath is
+// used.  The service name and version are sent as resource attributes.
+func NewExporter(endpoint string, serviceName string, serviceVersion string, gatherer prometheus.Gatherer) (*Exporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("OTLP metrics endpoint: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("OTLP metrics endpoint %q must be an http or https URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = DefaultPath
+	}
+	return &Exporter{
+		endpoint: u.String(),
+		gatherer: gatherer,
+		resource: []keyValue{
+			stringAttribute("service.name", serviceName),
+			stringAttribute("service.version", serviceVersion),
+		},
+		client:    &http.Client{Timeout: exportTimeout},
+		startTime: time.Now(),
+		now:       time.Now,
+	}, nil
+}
+
+// Endpoint returns the URL metrics are pushed to.
+func (e *Exporter) Endpoint() string {
+	return e.endpoint
+}
+
+// Run pushes the metrics every interval until ctx is done, and once more
+// as it ends so the final values are not lost.
+func (e *Exporter) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), exportTimeout)
+			e.logError(e.Export(final))
+			cancel()
+			return
+		}
+		e.logError(e.Export(ctx))
+	}
+}
+
+func (e *Exporter) logError(err error) {
+	if err != nil {
+		zap.S().Warnw("unable to export metrics over OTLP", "endpoint", e.endpoint, "error", err)
+	}
+}
+
+// Export gathers the metrics and pushes them to the collector once.
+func (e *Exporter) Export(ctx context.Context) error {
+	families, err := e.gatherer.Gather()
+	if err != nil && len(families) == 0 {
+		return fmt.Errorf("gathering metrics: %v", err)
+	}
+	body, err := json.Marshal(e.request(families))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
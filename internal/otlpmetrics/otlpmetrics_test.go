@@ -0,0 +1,202 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package otlpmetrics
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockCollector records the export requests it receives.
+type mockCollector struct {
+	*httptest.Server
+	requests chan *exportRequest
+	paths    chan string
+	status   int
+}
+
+func newMockCollector(t *testing.T, status int) *mockCollector {
+	c := &mockCollector{requests: make(chan *exportRequest, 10), paths: make(chan string, 10), status: status}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		req := &exportRequest{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(req))
+		c.paths <- r.URL.Path
+		c.requests <- req
+		w.WriteHeader(c.status)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func findMetric(req *exportRequest, name string) *metric {
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for i := range sm.Metrics {
+				if sm.Metrics[i].Name == name {
+					return &sm.Metrics[i]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func TestNewExporter(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		{"http://collector:4318", "http://collector:4318/v1/metrics", false},
+		{"http://collector:4318/", "http://collector:4318/v1/metrics", false},
+		{"https://collector/custom/path", "https://collector/custom/path", false},
+		{"collector:4318", "", true},
+		{"grpc://collector:4317", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			e, err := NewExporter(tt.endpoint, "svc", "v1", prometheus.NewRegistry())
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, e.Endpoint())
+		})
+	}
+}
+
+func TestExporter_Export(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_requests_total", Help: "requests"}, []string{"endpointName"})
+	gaugeMetric := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_in_flight", Help: "in flight"})
+	histogramMetric := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_latency_seconds", Help: "latency", Buckets: []float64{0.1, 1}})
+	registry.MustRegister(counter, gaugeMetric, histogramMetric)
+	counter.WithLabelValues("jenkins1").Add(3)
+	gaugeMetric.Set(2)
+	histogramMetric.Observe(0.05)
+	histogramMetric.Observe(0.5)
+	histogramMetric.Observe(5)
+
+	collector := newMockCollector(t, http.StatusOK)
+	e, err := NewExporter(collector.URL, "forwarder-agent", "abc123", registry)
+	require.NoError(t, err)
+	require.NoError(t, e.Export(context.Background()))
+
+	assert.Equal(t, DefaultPath, <-collector.paths)
+	req := <-collector.requests
+	require.Len(t, req.ResourceMetrics, 1)
+	assert.Contains(t, req.ResourceMetrics[0].Resource.Attributes, stringAttribute("service.name", "forwarder-agent"))
+	assert.Contains(t, req.ResourceMetrics[0].Resource.Attributes, stringAttribute("service.version", "abc123"))
+
+	requests := findMetric(req, "test_requests_total")
+	require.NotNil(t, requests)
+	require.NotNil(t, requests.Sum)
+	assert.True(t, requests.Sum.IsMonotonic)
+	assert.Equal(t, aggregationTemporalityCumulative, requests.Sum.AggregationTemporality)
+	require.Len(t, requests.Sum.DataPoints, 1)
+	assert.Equal(t, 3.0, requests.Sum.DataPoints[0].AsDouble)
+	assert.Equal(t, []keyValue{stringAttribute("endpointName", "jenkins1")}, requests.Sum.DataPoints[0].Attributes)
+
+	inFlight := findMetric(req, "test_in_flight")
+	require.NotNil(t, inFlight)
+	require.NotNil(t, inFlight.Gauge)
+	assert.Equal(t, 2.0, inFlight.Gauge.DataPoints[0].AsDouble)
+
+	latency := findMetric(req, "test_latency_seconds")
+	require.NotNil(t, latency)
+	require.NotNil(t, latency.Histogram)
+	dp := latency.Histogram.DataPoints[0]
+	assert.Equal(t, "3", dp.Count)
+	assert.Equal(t, []float64{0.1, 1}, dp.ExplicitBounds)
+	assert.Equal(t, []string{"1", "1", "1"}, dp.BucketCounts)
+}
+
+func TestExporter_Export_nonFinite(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	nanGauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_nan", Help: "nan"})
+	infCounter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_inf_total", Help: "inf"})
+	nanHistogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_nan_seconds", Help: "nan", Buckets: []float64{1}})
+	infSummary := prometheus.NewSummary(prometheus.SummaryOpts{Name: "test_inf_summary", Help: "inf"})
+	finiteGauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_finite", Help: "finite"})
+	registry.MustRegister(nanGauge, infCounter, nanHistogram, infSummary, finiteGauge)
+	nanGauge.Set(math.NaN())
+	infCounter.Add(math.Inf(1))
+	nanHistogram.Observe(math.NaN())
+	infSummary.Observe(math.Inf(-1))
+	finiteGauge.Set(1)
+
+	collector := newMockCollector(t, http.StatusOK)
+	e, err := NewExporter(collector.URL, "forwarder-agent", "abc123", registry)
+	require.NoError(t, err)
+	require.NoError(t, e.Export(context.Background()))
+
+	<-collector.paths
+	req := <-collector.requests
+	for _, name := range []string{"test_nan", "test_inf_total", "test_nan_seconds", "test_inf_summary"} {
+		assert.Nil(t, findMetric(req, name), name)
+	}
+	assert.NotNil(t, findMetric(req, "test_finite"))
+}
+
+func TestExporter_Export_collectorError(t *testing.T) {
+	collector := newMockCollector(t, http.StatusServiceUnavailable)
+	e, err := NewExporter(collector.URL, "svc", "v1", prometheus.NewRegistry())
+	require.NoError(t, err)
+	assert.Error(t, e.Export(context.Background()))
+}
+
+func TestExporter_Run(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_ticks_total", Help: "ticks"})
+	registry.MustRegister(counter)
+	counter.Inc()
+
+	collector := newMockCollector(t, http.StatusOK)
+	e, err := NewExporter(collector.URL, "svc", "v1", registry)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	select {
+	case req := <-collector.requests:
+		assert.NotNil(t, findMetric(req, "test_ticks_total"))
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no metrics were pushed")
+	}
+
+	// Stopping pushes the final values.
+	cancel()
+	<-done
+	pushed := len(collector.requests)
+	assert.GreaterOrEqual(t, pushed, 1)
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"go.uber.org/zap"
+)
+
+// AccessLogConfig configures the access log of an outgoing service.  If
+// Enabled, each request is logged once it completes, with its status,
+// duration, and response size.  SampleRate, if set, is the fraction of
+// successful responses logged, such as 0.01 for 1%.  Error responses,
+// with a 4xx or 5xx status or none at all, are always logged.
+type AccessLogConfig struct {
+	Enabled    bool    `yaml:"enabled,omitempty"`
+	SampleRate float64 `yaml:"sampleRate,omitempty"`
+}
+
+// accessLogger wraps an endpoint's request processor, logging requests as
+// they complete.
+type accessLogger struct {
+	next         httpRequestProcessor
+	endpointType string
+	endpointName string
+	sampleRate   float64
+	random       func() float64
+}
+
+func newAccessLogger(endpointType string, endpointName string, config AccessLogConfig, next httpRequestProcessor) *accessLogger {
+	sampleRate := config.SampleRate
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = 1
+	}
+	return &accessLogger{
+		next:         next,
+		endpointType: endpointType,
+		endpointName: endpointName,
+		sampleRate:   sampleRate,
+		random:       rand.Float64,
+	}
+}
+
+func (a *accessLogger) unwrap() httpRequestProcessor {
+	return a.next
+}
+
+// shouldLog returns true if a response with the status should be logged.
+func (a *accessLogger) shouldLog(status int32) bool {
+	if status == 0 || status >= http.StatusBadRequest {
+		return true
+	}
+	return a.random() < a.sampleRate
+}
+
+// ExecuteHTTPRequest runs the request through the wrapped endpoint, and
+// logs it once it is done if it is sampled.
+func (a *accessLogger) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	start := time.Now()
+
+	// Watch for the response headers and body as they pass by.
+	intercept := make(chan *tunnel.MessageWrapper)
+	type result struct {
+		status int32
+		bytes  int
+	}
+	resultChan := make(chan result)
+	go func() {
+		var r result
+		for msg := range intercept {
+			if resp := msg.GetHttpTunnelControl().GetHttpTunnelResponse(); resp != nil && r.status == 0 {
+				r.status = resp.Status
+			}
+			if chunk := msg.GetHttpTunnelControl().GetHttpTunnelChunkedResponse(); chunk != nil {
+				r.bytes += len(chunk.Body)
+			}
+			dataflow <- msg
+		}
+		resultChan <- r
+	}()
+	a.next.ExecuteHTTPRequest(agentName, intercept, req)
+	close(intercept)
+	r := <-resultChan
+
+	if !a.shouldLog(r.status) {
+		return
+	}
+	zap.S().Infow("access",
+		"endpointType", a.endpointType,
+		"endpointName", a.endpointName,
+		"method", req.Method,
+		"uri", req.URI,
+		"status", r.status,
+		"bytes", r.bytes,
+		"durationMs", time.Since(start).Milliseconds(),
+		"requestId", tunnel.RequestID(req))
+}
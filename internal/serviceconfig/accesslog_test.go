@@ -0,0 +1,94 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// observeAccessLog captures the access log until the test ends.
+func observeAccessLog(t *testing.T) *observer.ObservedLogs {
+	core, logs := observer.New(zapcore.InfoLevel)
+	t.Cleanup(zap.ReplaceGlobals(zap.New(core)))
+	return logs
+}
+
+// steppedRandom returns 0, 0.01, 0.02, and so on, wrapping at 1, so
+// a sample rate of r logs exactly r of every 100 successful responses.
+func steppedRandom() func() float64 {
+	n := 0
+	return func() float64 {
+		v := float64(n%100) / 100
+		n++
+		return v
+	}
+}
+
+func runAccessLogged(t *testing.T, a *accessLogger, status int32, count int) {
+	upstream := &fakeProcessor{status: status}
+	a.next = upstream
+	for i := 0; i < count; i++ {
+		dataflow := make(chan *tunnel.MessageWrapper, 1)
+		a.ExecuteHTTPRequest("agent", dataflow, &tunnel.OpenHTTPTunnelRequest{Id: "id", Method: http.MethodGet, URI: "/job"})
+		resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+		require.NotNil(t, resp, "response should be passed on")
+		assert.Equal(t, status, resp.Status)
+	}
+}
+
+func TestAccessLogger_sampling(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleRate float64
+		status     int32
+		want       int
+	}{
+		{"all successes by default", 0, http.StatusOK, 200},
+		{"1% of successes", 0.01, http.StatusOK, 2},
+		{"25% of successes", 0.25, http.StatusNoContent, 50},
+		{"25% of redirects", 0.25, http.StatusFound, 50},
+		{"all client errors", 0.01, http.StatusNotFound, 200},
+		{"all server errors", 0.01, http.StatusBadGateway, 200},
+		{"all failures without a response", 0.01, 0, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := observeAccessLog(t)
+			a := newAccessLogger("jenkins", "ci", AccessLogConfig{Enabled: true, SampleRate: tt.sampleRate}, nil)
+			a.random = steppedRandom()
+
+			runAccessLogged(t, a, tt.status, 200)
+
+			entries := logs.FilterMessage("access").All()
+			assert.Len(t, entries, tt.want)
+			if len(entries) > 0 {
+				fields := entries[0].ContextMap()
+				assert.Equal(t, "ci", fields["endpointName"])
+				assert.Equal(t, "/job", fields["uri"])
+				assert.Equal(t, tt.status, fields["status"])
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// The ALPN protocols served by net/http itself.
+const (
+	protocolHTTP2  = "h2"
+	protocolHTTP11 = "http/1.1"
+)
+
+// ProtocolHandler serves a TLS connection which negotiated a protocol
+// other than HTTP, such as a raw stream.  It owns the connection, and
+// must close it.
+type ProtocolHandler func(conn *tls.Conn)
+
+// nextProtos returns the ALPN protocols configured for services sharing a
+// listener.  Validation ensures they all agree, so the first set found is
+// used.
+func nextProtos(services []IncomingServiceConfig) []string {
+	for _, service := range services {
+		if len(service.NextProtos) > 0 {
+			return service.NextProtos
+		}
+	}
+	return nil
+}
+
+// configureProtocols sets the ALPN protocols the server offers, in order
+// of preference, and dispatches each negotiated protocol: h2 to the HTTP/2
+// server, http/1.1 (or no ALPN at all) to net/http, and any other to its
+// handler.  Protocols with no handler are not offered.  With no protocols
+// configured, the net/http defaults of h2 and http/1.1 are left in place.
+//
+// net/http always adds http/1.1 when serving TLS, so it is offered last
+// even if not listed.
+func configureProtocols(server *http.Server, protocols []string, handlers map[string]ProtocolHandler) error {
+	if len(protocols) == 0 {
+		return nil
+	}
+	offered := []string{}
+	// A non-nil map stops net/http enabling HTTP/2 on its own.
+	server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	serveHTTP2 := false
+	for _, protocol := range protocols {
+		switch protocol {
+		case protocolHTTP2:
+			serveHTTP2 = true
+		case protocolHTTP11:
+		default:
+			handler, found := handlers[protocol]
+			if !found {
+				zap.S().Warnw("not offering ALPN protocol without a handler", "protocol", protocol, "addr", server.Addr)
+				continue
+			}
+			server.TLSNextProto[protocol] = func(_ *http.Server, conn *tls.Conn, _ http.Handler) {
+				handler(conn)
+			}
+		}
+		offered = append(offered, protocol)
+	}
+	server.TLSConfig.NextProtos = offered
+	if serveHTTP2 {
+		return http2.ConfigureServer(server, &http2.Server{})
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opsmx/oes-birger/internal/ca"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+// startALPNServer serves HTTP requests with the protocol they arrived
+// over, and the raw protocol "x-raw" by writing "raw" to the connection.
+func startALPNServer(t *testing.T, protocols []string) string {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	})
+	ts := httptest.NewUnstartedServer(handler)
+	server := &http.Server{Handler: handler, TLSConfig: &tls.Config{}}
+	err := configureProtocols(server, protocols, map[string]ProtocolHandler{
+		"x-raw": func(conn *tls.Conn) {
+			defer conn.Close()
+			_, _ = conn.Write([]byte("raw"))
+		},
+	})
+	require.NoError(t, err)
+	ts.Config = server
+	ts.TLS = server.TLSConfig
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts.Listener.Addr().String()
+}
+
+func TestConfigureProtocols(t *testing.T) {
+	tests := []struct {
+		name        string
+		protocols   []string
+		clientProto []string
+		want        string
+		wantBody    string
+	}{
+		{"h2 preferred", []string{"h2", "http/1.1"}, []string{"http/1.1", "h2"}, "h2", "HTTP/2.0"},
+		{"http/1.1 preferred", []string{"http/1.1", "h2"}, []string{"h2", "http/1.1"}, "http/1.1", "HTTP/1.1"},
+		{"h2 not offered", []string{"http/1.1"}, []string{"h2", "http/1.1"}, "http/1.1", "HTTP/1.1"},
+		{"no ALPN from client", []string{"h2", "http/1.1"}, nil, "", "HTTP/1.1"},
+		{"raw protocol", []string{"x-raw", "h2", "http/1.1"}, []string{"x-raw", "h2"}, "x-raw", "raw"},
+		{"raw protocol not asked for", []string{"x-raw", "h2"}, []string{"h2"}, "h2", "HTTP/2.0"},
+		{"protocol without handler", []string{"x-other", "http/1.1"}, []string{"x-other", "http/1.1"}, "http/1.1", "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startALPNServer(t, tt.protocols)
+			conn, err := tls.Dial("tcp", addr, &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         tt.clientProto,
+			})
+			require.NoError(t, err)
+			defer conn.Close()
+			assert.Equal(t, tt.want, conn.ConnectionState().NegotiatedProtocol)
+
+			var body string
+			switch tt.want {
+			case "x-raw":
+				b, err := io.ReadAll(conn)
+				require.NoError(t, err)
+				body = string(b)
+			default:
+				body = getOverConn(t, conn)
+			}
+			assert.Equal(t, tt.wantBody, body)
+		})
+	}
+}
+
+func TestConfigureProtocols_defaults(t *testing.T) {
+	server := &http.Server{TLSConfig: &tls.Config{}}
+	require.NoError(t, configureProtocols(server, nil, nil))
+	assert.Nil(t, server.TLSNextProto)
+	assert.Empty(t, server.TLSConfig.NextProtos)
+}
+
+// startHTTPSServer serves the services with the server RunHTTPSServer
+// would run, and a raw protocol "x-raw" which writes "raw".
+func startHTTPSServer(t *testing.T, authority *ca.CA, services []IncomingServiceConfig) string {
+	serverCert, err := authority.MakeServerCert([]string{"localhost"})
+	require.NoError(t, err)
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return serverCert, nil }
+
+	server, err := makeHTTPSServer(tunnelroute.MakeRoutes(), authority, getCertificate, services, AllowAllAuthorizer{}, map[string]ProtocolHandler{
+		"x-raw": func(conn *tls.Conn) {
+			defer conn.Close()
+			_, _ = conn.Write([]byte("raw"))
+		},
+	})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = server.ServeTLS(listener, "", "") }()
+	t.Cleanup(func() { _ = server.Close() })
+	return listener.Addr().String()
+}
+
+func TestRunHTTPSServer_negotiatesProtocols(t *testing.T) {
+	caCert, caKey, err := ca.MakeCertificateAuthority()
+	require.NoError(t, err)
+	authority, err := ca.MakeCAFromData(caCert, caKey)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		protocols   []string
+		clientProto []string
+		want        string
+	}{
+		{"defaults h2", nil, []string{"h2", "http/1.1"}, "h2"},
+		{"defaults http/1.1", nil, []string{"http/1.1"}, "http/1.1"},
+		{"configured http/1.1 preferred", []string{"http/1.1", "h2"}, []string{"h2", "http/1.1"}, "http/1.1"},
+		{"configured h2 only", []string{"h2"}, []string{"h2"}, "h2"},
+		{"configured raw protocol", []string{"x-raw", "h2"}, []string{"x-raw", "h2"}, "x-raw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startHTTPSServer(t, authority, []IncomingServiceConfig{{Name: "jenkins", ServiceType: "jenkins", NextProtos: tt.protocols}})
+			conn, err := tls.Dial("tcp", addr, &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         tt.clientProto,
+			})
+			require.NoError(t, err)
+			defer conn.Close()
+			require.Equal(t, tt.want, conn.ConnectionState().NegotiatedProtocol)
+
+			if tt.want == "x-raw" {
+				b, err := io.ReadAll(conn)
+				require.NoError(t, err)
+				assert.Equal(t, "raw", string(b))
+				return
+			}
+			// The request is not authorized, but is served over the
+			// negotiated protocol.
+			getOverConn(t, conn)
+		})
+	}
+}
+
+// getOverConn makes a request over an established connection, with
+// HTTP/2 if it was negotiated, and returns the body.
+func getOverConn(t *testing.T, conn *tls.Conn) string {
+	var transport http.RoundTripper
+	if conn.ConnectionState().NegotiatedProtocol == "h2" {
+		h2 := &http2.Transport{}
+		cc, err := h2.NewClientConn(conn)
+		require.NoError(t, err)
+		transport = cc
+	} else {
+		transport = &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return conn, nil
+			},
+		}
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("https://localhost/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/jwtutil"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+)
+
+// How the sender of an incoming service request was identified.
+const (
+	IdentityMethodCertificate = "certificate"
+	IdentityMethodJWT         = "jwt"
+	// IdentityMethodFixed is used for plain HTTP services, which always
+	// send to their configured destination without checking credentials.
+	IdentityMethodFixed = "fixed"
+)
+
+// ServiceIdentity describes the credentials an incoming service request
+// was made with.
+type ServiceIdentity struct {
+	Method       string
+	Agent        string
+	EndpointType string
+	EndpointName string
+	// Scope limits where a JWT credential may be used.  It is always
+	// enforced, before the Authorizer is called.
+	Scope jwtutil.Scope
+	// TokenID is the JWT credential's unique ID ("jti"), if it has one,
+	// and TokenExpires when it expires, if it does.
+	TokenID      string
+	TokenExpires time.Time
+}
+
+// Authorizer decides whether an incoming service request may be sent to
+// its target endpoint.  It is called for every request, before the request
+// is routed, and a non-nil error denies the request with 403 Forbidden.
+// The error is logged but not returned to the client.
+type Authorizer interface {
+	Authorize(r *http.Request, identity ServiceIdentity, target tunnelroute.Search) error
+}
+
+// AuthorizationReleaser is implemented by an Authorizer which records
+// something when it allows a request, such as the credential's token ID,
+// which must be undone if the request is then not sent on to its endpoint,
+// such as when no agent is connected.
+type AuthorizationReleaser interface {
+	Release(r *http.Request, identity ServiceIdentity)
+}
+
+// AllowAllAuthorizer allows every request which has valid credentials.
+type AllowAllAuthorizer struct{}
+
+// Authorize always allows the request.
+func (AllowAllAuthorizer) Authorize(*http.Request, ServiceIdentity, tunnelroute.Search) error {
+	return nil
+}
+
+// ReplayProtectingAuthorizer refuses a JWT credential presented again for
+// a non-idempotent request while its token ID is still in the cache, so a
+// captured credential cannot be replayed to repeat the request.  Requests
+// allowed by Next record the token ID, which is released again if the
+// request is not sent on to its endpoint, so the client may retry it.
+// Idempotent requests, credentials without a token ID, and certificates
+// are not checked.
+type ReplayProtectingAuthorizer struct {
+	Cache *jwtutil.ReplayCache
+	Next  Authorizer
+}
+
+// Authorize asks Next, then checks the credential has not been replayed.
+func (a ReplayProtectingAuthorizer) Authorize(r *http.Request, identity ServiceIdentity, target tunnelroute.Search) error {
+	if err := a.Next.Authorize(r, identity, target); err != nil {
+		return err
+	}
+	if identity.Method != IdentityMethodJWT || identity.TokenID == "" || idempotentMethod(r.Method) {
+		return nil
+	}
+	if err := a.Cache.Check(identity.TokenID, identity.TokenExpires); err != nil {
+		return fmt.Errorf("%w: %s", err, identity.TokenID)
+	}
+	return nil
+}
+
+// Release forgets the token ID recorded by Authorize, and releases Next.
+func (a ReplayProtectingAuthorizer) Release(r *http.Request, identity ServiceIdentity) {
+	if identity.Method == IdentityMethodJWT && identity.TokenID != "" && !idempotentMethod(r.Method) {
+		a.Cache.Forget(identity.TokenID)
+	}
+	if releaser, ok := a.Next.(AuthorizationReleaser); ok {
+		releaser.Release(r, identity)
+	}
+}
+
+// idempotentMethod returns true for the methods RFC 9110 defines as
+// idempotent, which are safe to repeat.
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// checkScope returns an error if the scope does not allow the request to
+// be made to the incoming service.
+func checkScope(scope jwtutil.Scope, service IncomingServiceConfig, r *http.Request) error {
+	if !scope.Allows(service.Name, r.Method) {
+		return fmt.Errorf("credential is not scoped for %s requests to service '%s'", r.Method, service.Name)
+	}
+	return nil
+}
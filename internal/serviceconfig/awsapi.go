@@ -19,6 +19,7 @@ package serviceconfig
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -31,13 +32,25 @@ import (
 	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/opsmx/oes-birger/internal/secrets"
 	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/opsmx/oes-birger/internal/util"
 	"go.uber.org/zap"
-	"golang.org/x/net/context"
 	"gopkg.in/yaml.v3"
 )
 
 type awsConfig struct {
-	Credentials awsCredentials `yaml:"credentials,omitempty"`
+	Credentials awsCredentials     `yaml:"credentials,omitempty"`
+	Chunking    tunnel.ChunkConfig `yaml:"chunking,omitempty"`
+	Headers     tunnel.HeaderRules `yaml:"headers,omitempty"`
+	Transport   transportConfig    `yaml:"transport,omitempty"`
+
+	MaxRequestBodyBytes     int64    `yaml:"maxRequestBodyBytes,omitempty"`
+	PreserveHopByHopHeaders []string `yaml:"preserveHopByHopHeaders,omitempty"`
+	AllowResponseHeaders    []string `yaml:"allowResponseHeaders,omitempty"`
+	MaxResponseHeaderBytes  int64    `yaml:"maxResponseHeaderBytes,omitempty"`
+
+	StatusMap tunnel.StatusMap `yaml:"statusMap,omitempty"`
+
+	tunnel.ResponseBodyLimit `yaml:",inline"`
 }
 
 type awsCredentials struct {
@@ -47,8 +60,13 @@ type awsCredentials struct {
 
 // AwsEndpoint holds the AWS state for proxying AWS calls.
 type AwsEndpoint struct {
-	creds  *credentials.Credentials
-	signer *v4.Signer
+	creds   *credentials.Credentials
+	signer  *v4.Signer
+	headers tunnel.HeaderRules
+	client  *http.Client
+
+	maxRequestBodyBytes int64
+	responses           tunnel.ResponseOptions
 }
 
 const awsTimeFormat = "20060102T150405Z"
@@ -73,6 +91,14 @@ func MakeAwsEndpoint(name string, configBytes []byte, secretsLoader secrets.Secr
 		return nil, false, err
 	}
 
+	if err := config.Transport.validate(); err != nil {
+		return k, false, fmt.Errorf("aws/%s: transport: %v", name, err)
+	}
+
+	if err := config.StatusMap.Validate(); err != nil {
+		return k, false, fmt.Errorf("aws/%s: statusMap%v", name, err)
+	}
+
 	switch config.Credentials.Type {
 	case "kubernetes-secret":
 		if config.Credentials.SecretName == "" {
@@ -106,6 +132,19 @@ func MakeAwsEndpoint(name string, configBytes []byte, secretsLoader secrets.Secr
 	}
 
 	k.signer = v4.NewSigner(k.creds)
+	k.headers = config.Headers
+	k.client = config.Transport.makeClient(util.ApplyTLSSettings(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}))
+	k.maxRequestBodyBytes = config.MaxRequestBodyBytes
+	k.responses = tunnel.ResponseOptions{
+		Chunking:        config.Chunking,
+		PreserveHeaders: config.PreserveHopByHopHeaders,
+		AllowedHeaders:  config.AllowResponseHeaders,
+		MaxHeaderBytes:  config.MaxResponseHeaderBytes,
+		BodyLimit:       config.ResponseBodyLimit,
+		StatusMap:       config.StatusMap,
+	}
 
 	return k, true, nil
 }
@@ -114,17 +153,11 @@ func MakeAwsEndpoint(name string, configBytes []byte, secretsLoader secrets.Secr
 // tunnel.
 func (a *AwsEndpoint) ExecuteHTTPRequest(_ string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
 	zap.S().Debugf("Running request %v", req)
-	tlsConfig := &tls.Config{
-		MinVersion: tls.VersionTLS12,
-	}
-	tr := &http.Transport{
-		MaxIdleConns:       10,
-		IdleConnTimeout:    30 * time.Second,
-		DisableCompression: true,
-		TLSClientConfig:    tlsConfig,
-	}
-	client := &http.Client{
-		Transport: tr,
+	defer tunnel.ReleaseRequestBody(req)
+	if tunnel.RequestBodyTooLarge(req, a.maxRequestBodyBytes) {
+		zap.S().Warnw("request body too large", "method", req.Method, "uri", req.URI, "size", tunnel.RequestContentLength(req), "limit", a.maxRequestBodyBytes)
+		dataflow <- tunnel.MakeRequestEntityTooLargeResponse(req.Id)
+		return
 	}
 
 	host := req.GetHeaderValue("x-opsmx-original-host")
@@ -144,14 +177,28 @@ func (a *AwsEndpoint) ExecuteHTTPRequest(_ string, dataflow chan *tunnel.Message
 		return
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	tunnel.RegisterCancelFunction(req.Id, cancel)
-	defer tunnel.UnregisterCancelFunction(req.Id)
+	ctx, cancel := tunnel.RequestContext(req)
+	defer cancel()
+	cancelRegistration := tunnel.RegisterCancelFunction(req.Id, cancel)
+	defer tunnel.UnregisterCancelFunction(cancelRegistration)
 
 	baseURL := fmt.Sprintf("https://%s:%s", host, port)
 	actualurl := fmt.Sprintf("https://%s:%s%s", host, port, req.URI)
 
-	httpRequest, err := http.NewRequestWithContext(ctx, req.Method, actualurl, bytes.NewBuffer(req.Body))
+	// The signature covers the body, so a streamed body must be read in full.
+	body, err := tunnel.ReadRequestBody(tunnel.RequestBody(req, dataflow), tunnel.BufferedBodyLimit(a.maxRequestBodyBytes))
+	if errors.Is(err, tunnel.ErrRequestBodyTooLarge) {
+		zap.S().Warnw("request body too large", "method", req.Method, "uri", req.URI, "limit", tunnel.BufferedBodyLimit(a.maxRequestBodyBytes))
+		dataflow <- tunnel.MakeRequestEntityTooLargeResponse(req.Id)
+		return
+	}
+	if err != nil {
+		zap.S().Warnw("failed to read request body", "error", err)
+		dataflow <- tunnel.MakeBadGatewayResponse(req.Id)
+		return
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, req.Method, actualurl, bytes.NewBuffer(body))
 	if err != nil {
 		zap.S().Warnw("failed to build request",
 			"method", req.Method,
@@ -170,8 +217,10 @@ func (a *AwsEndpoint) ExecuteHTTPRequest(_ string, dataflow chan *tunnel.Message
 			httpRequest.Header.Add(header.Name, value)
 		}
 	}
+	tunnel.SetUpstreamHeaders(req, httpRequest.Header)
+	a.headers.Apply(httpRequest.Header)
 
-	bodyBuffer := bytes.NewReader(req.Body)
+	bodyBuffer := bytes.NewReader(body)
 	_, err = a.signer.Sign(httpRequest, bodyBuffer, signerService, signingRegion, ts)
 	if err != nil {
 		zap.S().Warnw("failed to sign AWS request", "error", err)
@@ -179,5 +228,5 @@ func (a *AwsEndpoint) ExecuteHTTPRequest(_ string, dataflow chan *tunnel.Message
 		return
 	}
 
-	tunnel.RunHTTPRequest(client, req, httpRequest, dataflow, baseURL)
+	tunnel.RunHTTPRequest(a.client, req, httpRequest, dataflow, baseURL, a.responses)
 }
@@ -0,0 +1,226 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tevino/abool"
+	"go.uber.org/zap"
+)
+
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+// Circuit breaker states, also used as the value of the state gauge.
+const (
+	circuitClosed   = 0
+	circuitOpen     = 1
+	circuitHalfOpen = 2
+)
+
+// circuitStateNames are the states as reported in endpoint statistics.
+var circuitStateNames = map[int]string{
+	circuitClosed:   "closed",
+	circuitOpen:     "open",
+	circuitHalfOpen: "half-open",
+}
+
+var (
+	circuitBreakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "endpoint_circuit_breaker_state",
+		Help: "The circuit breaker state for an endpoint: 0 closed, 1 open, 2 half-open",
+	}, []string{"endpointType", "endpointName"})
+
+	circuitBreakerRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "endpoint_circuit_breaker_rejected_total",
+		Help: "The total number of requests rejected by an open circuit breaker",
+	}, []string{"endpointType", "endpointName"})
+)
+
+// CircuitBreakerConfig configures the circuit breaker for an outgoing
+// service.  After FailureThreshold consecutive failures, requests are
+// rejected with a 503 for Cooldown, after which a single request is let
+// through to probe whether the service has recovered.  A threshold of
+// zero disables the breaker.
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `yaml:"failureThreshold,omitempty"`
+	Cooldown         time.Duration `yaml:"cooldown,omitempty"`
+}
+
+// circuitBreaker wraps an endpoint's request processor.  Responses with a
+// 502, 503, or 504 status, or no response at all, count as failures.
+// Requests cancelled by the client count as neither success nor failure.
+type circuitBreaker struct {
+	sync.Mutex
+	next         httpRequestProcessor
+	endpointType string
+	endpointName string
+	threshold    int
+	cooldown     time.Duration
+	now          func() time.Time
+
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(endpointType string, endpointName string, config CircuitBreakerConfig, next httpRequestProcessor) *circuitBreaker {
+	cb := &circuitBreaker{
+		next:         next,
+		endpointType: endpointType,
+		endpointName: endpointName,
+		threshold:    config.FailureThreshold,
+		cooldown:     config.Cooldown,
+		now:          time.Now,
+	}
+	if cb.cooldown <= 0 {
+		cb.cooldown = defaultCircuitBreakerCooldown
+	}
+	cb.setState(circuitClosed)
+	return cb
+}
+
+func (cb *circuitBreaker) unwrap() httpRequestProcessor {
+	return cb.next
+}
+
+// circuitBreakerFor returns the circuit breaker wrapping the endpoint, or
+// nil if it has none.
+func circuitBreakerFor(p httpRequestProcessor) *circuitBreaker {
+	for {
+		switch w := p.(type) {
+		case *circuitBreaker:
+			return w
+		case processorWrapper:
+			p = w.unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// stateName returns the breaker's state, as reported in statistics.
+func (cb *circuitBreaker) stateName() string {
+	cb.Lock()
+	defer cb.Unlock()
+	return circuitStateNames[cb.state]
+}
+
+// setState must be called with the lock held.
+func (cb *circuitBreaker) setState(state int) {
+	if cb.state != state {
+		zap.S().Infow("circuit breaker state change",
+			"endpointType", cb.endpointType,
+			"endpointName", cb.endpointName,
+			"from", cb.state,
+			"to", state)
+	}
+	cb.state = state
+	circuitBreakerStateGauge.WithLabelValues(cb.endpointType, cb.endpointName).Set(float64(state))
+}
+
+// allow returns true if a request may be sent.  When half-open, only
+// one request at a time is allowed through as a probe.
+func (cb *circuitBreaker) allow() bool {
+	cb.Lock()
+	defer cb.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if cb.now().Sub(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.setState(circuitHalfOpen)
+		cb.probing = true
+		return true
+	case circuitHalfOpen:
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	}
+	return true
+}
+
+func (cb *circuitBreaker) record(success bool, cancelled bool) {
+	cb.Lock()
+	defer cb.Unlock()
+	if cb.state == circuitHalfOpen {
+		cb.probing = false
+	}
+	if cancelled {
+		return
+	}
+	if success {
+		cb.failures = 0
+		cb.setState(circuitClosed)
+		return
+	}
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= cb.threshold {
+		cb.openedAt = cb.now()
+		cb.setState(circuitOpen)
+	}
+}
+
+func isFailureStatus(status int32) bool {
+	switch status {
+	case 0, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// ExecuteHTTPRequest runs the request through the wrapped endpoint, unless the
+// circuit is open.
+func (cb *circuitBreaker) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	if !cb.allow() {
+		circuitBreakerRejectedCounter.WithLabelValues(cb.endpointType, cb.endpointName).Inc()
+		tunnel.ReleaseRequestBody(req)
+		dataflow <- tunnel.MakeServiceUnavailableResponse(req.Id)
+		return
+	}
+
+	var cancelled abool.AtomicBool
+	cancelRegistration := tunnel.RegisterCancelFunction(req.Id, cancelled.Set)
+	defer tunnel.UnregisterCancelFunction(cancelRegistration)
+
+	// Watch for the response headers as they pass by.
+	intercept := make(chan *tunnel.MessageWrapper)
+	statusChan := make(chan int32)
+	go func() {
+		var status int32
+		for msg := range intercept {
+			if resp := msg.GetHttpTunnelControl().GetHttpTunnelResponse(); resp != nil && status == 0 {
+				status = resp.Status
+			}
+			dataflow <- msg
+		}
+		statusChan <- status
+	}()
+	cb.next.ExecuteHTTPRequest(agentName, intercept, req)
+	close(intercept)
+	status := <-statusChan
+
+	cb.record(!isFailureStatus(status), cancelled.IsSet())
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProcessor responds with status, optionally after the client cancels.
+type fakeProcessor struct {
+	status int32
+	cancel bool
+	calls  int
+}
+
+func (f *fakeProcessor) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	f.calls++
+	if f.cancel {
+		tunnel.CallCancelFunction(req.Id)
+	}
+	dataflow <- &tunnel.MessageWrapper{
+		Event: &tunnel.MessageWrapper_HttpTunnelControl{
+			HttpTunnelControl: &tunnel.HttpTunnelControl{
+				ControlType: &tunnel.HttpTunnelControl_HttpTunnelResponse{
+					HttpTunnelResponse: &tunnel.HttpTunnelResponse{Id: req.Id, Status: f.status},
+				},
+			},
+		},
+	}
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func makeTestBreaker(next httpRequestProcessor) (*circuitBreaker, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	cb := newCircuitBreaker("test", "breaker", CircuitBreakerConfig{FailureThreshold: 3, Cooldown: time.Minute}, next)
+	cb.now = clock.now
+	return cb, clock
+}
+
+func execute(t *testing.T, cb *circuitBreaker) int32 {
+	dataflow := make(chan *tunnel.MessageWrapper, 10)
+	cb.ExecuteHTTPRequest("", dataflow, &tunnel.OpenHTTPTunnelRequest{Id: "cb-request"})
+	require.Len(t, dataflow, 1)
+	return (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse().Status
+}
+
+func TestCircuitBreaker_transitions(t *testing.T) {
+	upstream := &fakeProcessor{status: http.StatusBadGateway}
+	cb, clock := makeTestBreaker(upstream)
+
+	// Closed: failures below the threshold pass through.
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, int32(http.StatusBadGateway), execute(t, cb))
+		assert.Equal(t, circuitClosed, cb.state)
+	}
+
+	// The third consecutive failure opens the circuit.
+	assert.Equal(t, int32(http.StatusBadGateway), execute(t, cb))
+	assert.Equal(t, circuitOpen, cb.state)
+	assert.Equal(t, 3, upstream.calls)
+
+	// Open: short-circuited without calling the upstream.
+	assert.Equal(t, int32(http.StatusServiceUnavailable), execute(t, cb))
+	assert.Equal(t, 3, upstream.calls)
+
+	// After the cooldown, a failing probe opens it again.
+	clock.t = clock.t.Add(time.Minute)
+	assert.Equal(t, int32(http.StatusBadGateway), execute(t, cb))
+	assert.Equal(t, circuitOpen, cb.state)
+	assert.Equal(t, 4, upstream.calls)
+	assert.Equal(t, int32(http.StatusServiceUnavailable), execute(t, cb))
+
+	// A successful probe closes it.
+	clock.t = clock.t.Add(time.Minute)
+	upstream.status = http.StatusOK
+	assert.Equal(t, int32(http.StatusOK), execute(t, cb))
+	assert.Equal(t, circuitClosed, cb.state)
+	assert.Equal(t, 0, cb.failures)
+}
+
+func TestCircuitBreaker_halfOpenSingleProbe(t *testing.T) {
+	cb, clock := makeTestBreaker(&fakeProcessor{})
+	cb.state = circuitOpen
+	cb.openedAt = clock.t
+
+	assert.False(t, cb.allow(), "open, cooldown not passed")
+	clock.t = clock.t.Add(time.Minute)
+	assert.True(t, cb.allow(), "first probe")
+	assert.Equal(t, circuitHalfOpen, cb.state)
+	assert.False(t, cb.allow(), "second request while probing")
+}
+
+func TestCircuitBreaker_successResetsCount(t *testing.T) {
+	upstream := &fakeProcessor{status: http.StatusGatewayTimeout}
+	cb, _ := makeTestBreaker(upstream)
+
+	execute(t, cb)
+	execute(t, cb)
+	upstream.status = http.StatusNotFound // not an upstream availability failure
+	execute(t, cb)
+	upstream.status = http.StatusGatewayTimeout
+	execute(t, cb)
+	execute(t, cb)
+	assert.Equal(t, circuitClosed, cb.state)
+}
+
+func TestCircuitBreaker_cancelledNotCounted(t *testing.T) {
+	upstream := &fakeProcessor{status: http.StatusBadGateway, cancel: true}
+	cb, clock := makeTestBreaker(upstream)
+
+	for i := 0; i < 5; i++ {
+		execute(t, cb)
+	}
+	assert.Equal(t, circuitClosed, cb.state)
+	assert.Equal(t, 0, cb.failures)
+
+	// A cancelled probe leaves the circuit half-open, ready for another probe.
+	cb.state = circuitOpen
+	cb.openedAt = clock.t.Add(-time.Minute)
+	execute(t, cb)
+	assert.Equal(t, circuitHalfOpen, cb.state)
+	assert.True(t, cb.allow())
+}
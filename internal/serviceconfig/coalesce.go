@@ -0,0 +1,347 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/opsmx/oes-birger/internal/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/proto"
+)
+
+var coalescedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "endpoint_coalesced_requests_total",
+	Help: "The total number of GET requests which shared the response to an identical request already in flight",
+}, []string{"endpointType", "endpointName"})
+
+// maxCoalescedBytes is how much of a response is held so requests which
+// join late can be sent all of it.  Past this, no more requests join, and
+// the response is passed on no faster than every request sharing it can
+// send it, rather than being held.
+const maxCoalescedBytes = 1024 * 1024
+
+// perRequestHeaders differ between otherwise identical requests, so they
+// are not compared when deciding whether requests may share a response.
+var perRequestHeaders = map[string]bool{
+	http.CanonicalHeaderKey(tunnel.RequestIDHeader): true,
+	"Traceparent": true,
+	"Tracestate":  true,
+}
+
+// coalescer wraps an endpoint's request processor, so identical GET
+// requests in flight at the same time share one request to the service.
+// Requests are identical if their endpoint, URI, and headers, other than
+// perRequestHeaders, are the same, so requests for different users never
+// share a response.  The credential the caller presented to the
+// controller, an Authorization header, an X-Opsmx-Token, or a client
+// certificate, is removed before the request reaches the agent, so
+// callers with different ones may share a response.  Each was allowed to
+// send that request to this endpoint.
+type coalescer struct {
+	sync.Mutex
+	next         httpRequestProcessor
+	endpointType string
+	endpointName string
+	flights      map[string]*flight
+}
+
+// flight is one request to the service.  Its response is recorded, up to
+// maxCoalescedBytes, so each request sharing it is sent all of it, however
+// late it joined.
+type flight struct {
+	sync.Mutex
+	cond       *sync.Cond
+	id         string
+	key        string
+	messages   []*tunnel.MessageWrapper // the response from message number base on
+	base       int
+	bytes      int
+	overflowed bool
+	done       bool
+	positions  map[int]int // the next message each follower will send
+	followers  int
+
+	// waiting and finished are protected by the coalescer's lock.
+	waiting  int
+	finished bool
+}
+
+func newCoalescer(endpointType string, endpointName string, next httpRequestProcessor) *coalescer {
+	return &coalescer{
+		next:         next,
+		endpointType: endpointType,
+		endpointName: endpointName,
+		flights:      map[string]*flight{},
+	}
+}
+
+func (c *coalescer) unwrap() httpRequestProcessor {
+	return c.next
+}
+
+// isCoalescable returns true for a GET which may share its response with
+// identical requests.
+func isCoalescable(req *tunnel.OpenHTTPTunnelRequest) bool {
+	if req.Method != http.MethodGet || req.StreamBody || len(req.Body) != 0 || req.GetHeaderValue("Upgrade") != "" {
+		return false
+	}
+	return !isStreamingRequest(req)
+}
+
+// streamingQueryParameters ask for a response which does not end, such as
+// a Kubernetes watch or a followed log, unless they are false.
+var streamingQueryParameters = []string{"watch", "follow"}
+
+// isStreamingRequest returns true if the request asks for a response which
+// may never end, such as a watch or an event stream.  Sharing one would
+// hold its flight open for as long as it runs.  A URI which cannot be
+// parsed is assumed to be streaming.
+func isStreamingRequest(req *tunnel.OpenHTTPTunnelRequest) bool {
+	for _, header := range req.Headers {
+		if !strings.EqualFold(header.Name, "Accept") {
+			continue
+		}
+		for _, value := range header.Values {
+			if strings.Contains(strings.ToLower(value), "text/event-stream") {
+				return true
+			}
+		}
+	}
+	u, err := url.ParseRequestURI(req.URI)
+	if err != nil {
+		return true
+	}
+	query := u.Query()
+	for _, name := range streamingQueryParameters {
+		values, found := query[name]
+		if !found {
+			continue
+		}
+		if value := strings.ToLower(values[0]); value != "false" && value != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+func coalesceKey(req *tunnel.OpenHTTPTunnelRequest) string {
+	headers := []string{}
+	for _, header := range req.Headers {
+		name := http.CanonicalHeaderKey(header.Name)
+		if perRequestHeaders[name] {
+			continue
+		}
+		headers = append(headers, name+": "+strings.Join(header.Values, "\x00"))
+	}
+	sort.Strings(headers)
+	return strings.Join(append([]string{req.Type, req.Name, req.Method, req.URI}, headers...), "\n")
+}
+
+// ExecuteHTTPRequest runs the request through the wrapped endpoint, unless
+// an identical request is already in flight, in which case its response is
+// sent instead.
+func (c *coalescer) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	if !isCoalescable(req) {
+		c.next.ExecuteHTTPRequest(agentName, dataflow, req)
+		return
+	}
+
+	f, follower, leader := c.join(coalesceKey(req))
+	defer c.leave(f, follower)
+	if leader {
+		go c.run(f, agentName, req)
+	} else {
+		coalescedCounter.WithLabelValues(c.endpointType, c.endpointName).Inc()
+	}
+	f.follow(dataflow, req.Id, follower)
+}
+
+// join returns the flight for key, starting a new one if there is none,
+// in which case true is also returned and the caller must run it.  The
+// caller follows the flight as the returned follower.
+func (c *coalescer) join(key string) (*flight, int, bool) {
+	c.Lock()
+	defer c.Unlock()
+	f, found := c.flights[key]
+	if !found {
+		f = &flight{id: ulid.GlobalContext.Ulid(), key: key, positions: map[int]int{}}
+		f.cond = sync.NewCond(f)
+		c.flights[key] = f
+	}
+	f.waiting++
+	f.Lock()
+	defer f.Unlock()
+	follower := f.followers
+	f.followers++
+	f.positions[follower] = 0
+	return f, follower, !found
+}
+
+// leave is called when a request is done with the flight.  If the flight
+// is still running with no one waiting for it, as all its requests were
+// cancelled, it is cancelled too.
+func (c *coalescer) leave(f *flight, follower int) {
+	f.unfollow(follower)
+	c.Lock()
+	f.waiting--
+	abandoned := f.waiting == 0 && !f.finished
+	if abandoned && c.flights[f.key] == f {
+		delete(c.flights, f.key)
+	}
+	c.Unlock()
+	if abandoned {
+		tunnel.CallCancelFunction(f.id)
+	}
+}
+
+// run sends the request to the service under the flight's id, recording
+// the response.  The response is not flow controlled, as there is no one
+// to acknowledge it for that id, so past maxCoalescedBytes it is read no
+// faster than the requests sharing it send it on.
+func (c *coalescer) run(f *flight, agentName string, req *tunnel.OpenHTTPTunnelRequest) {
+	shared := proto.Clone(req).(*tunnel.OpenHTTPTunnelRequest)
+	shared.Id = f.id
+	shared.WindowSize = 0
+
+	results := make(chan *tunnel.MessageWrapper)
+	go func() {
+		c.next.ExecuteHTTPRequest(agentName, results, shared)
+		close(results)
+	}()
+	for msg := range results {
+		if f.record(msg) {
+			// Too large to hold for requests yet to come, so they go to
+			// the service themselves.
+			c.Lock()
+			if c.flights[f.key] == f {
+				delete(c.flights, f.key)
+			}
+			c.Unlock()
+		}
+	}
+
+	// Requests from now on get a new flight.
+	c.Lock()
+	if c.flights[f.key] == f {
+		delete(c.flights, f.key)
+	}
+	f.finished = true
+	c.Unlock()
+	f.finish()
+}
+
+// record adds msg to the response, and returns true once the response has
+// grown past maxCoalescedBytes.  From then on, the caller must stop anyone
+// else joining, and record waits for every follower to send what has been
+// recorded, which is then dropped, before adding more.
+func (f *flight) record(msg *tunnel.MessageWrapper) bool {
+	f.Lock()
+	defer f.Unlock()
+	if f.overflowed {
+		end := f.base + len(f.messages)
+		for f.slowest() < end {
+			f.cond.Wait()
+		}
+		f.base = end
+		f.messages = nil
+	}
+	f.messages = append(f.messages, msg)
+	f.bytes += proto.Size(msg)
+	f.cond.Broadcast()
+	if f.overflowed || f.bytes <= maxCoalescedBytes {
+		return false
+	}
+	f.overflowed = true
+	return true
+}
+
+// slowest returns the position of the follower furthest behind.
+func (f *flight) slowest() int {
+	slowest := math.MaxInt
+	for _, position := range f.positions {
+		if position < slowest {
+			slowest = position
+		}
+	}
+	return slowest
+}
+
+func (f *flight) unfollow(follower int) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.positions, follower)
+	f.cond.Broadcast()
+}
+
+func (f *flight) finish() {
+	f.Lock()
+	defer f.Unlock()
+	f.done = true
+	f.cond.Broadcast()
+}
+
+// follow sends the flight's response to dataflow as the response to the
+// request id, until the response is complete or the request is cancelled.
+func (f *flight) follow(dataflow chan *tunnel.MessageWrapper, id string, follower int) {
+	cancelled := false
+	cancelRegistration := tunnel.RegisterCancelFunction(id, func() {
+		f.Lock()
+		defer f.Unlock()
+		cancelled = true
+		f.cond.Broadcast()
+	})
+	defer tunnel.UnregisterCancelFunction(cancelRegistration)
+
+	for i := 0; ; i++ {
+		f.Lock()
+		for i >= f.base+len(f.messages) && !f.done && !cancelled {
+			f.cond.Wait()
+		}
+		if cancelled || i >= f.base+len(f.messages) {
+			f.Unlock()
+			return
+		}
+		msg := f.messages[i-f.base]
+		f.Unlock()
+		dataflow <- withRequestID(msg, id)
+
+		f.Lock()
+		f.positions[follower] = i + 1
+		f.cond.Broadcast()
+		f.Unlock()
+	}
+}
+
+// withRequestID returns a copy of a response message for another request id.
+func withRequestID(msg *tunnel.MessageWrapper, id string) *tunnel.MessageWrapper {
+	msg = proto.Clone(msg).(*tunnel.MessageWrapper)
+	switch control := msg.GetHttpTunnelControl().GetControlType().(type) {
+	case *tunnel.HttpTunnelControl_HttpTunnelResponse:
+		control.HttpTunnelResponse.Id = id
+	case *tunnel.HttpTunnelControl_HttpTunnelChunkedResponse:
+		control.HttpTunnelChunkedResponse.Id = id
+	}
+	return msg
+}
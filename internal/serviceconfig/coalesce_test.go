@@ -0,0 +1,410 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatedProcessor responds once release is closed, unless cancelled first.
+type gatedProcessor struct {
+	sync.Mutex
+	release   chan struct{}
+	calls     int
+	cancelled bool
+}
+
+func (g *gatedProcessor) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	g.Lock()
+	g.calls++
+	g.Unlock()
+
+	cancel := make(chan struct{})
+	var once sync.Once
+	cancelRegistration := tunnel.RegisterCancelFunction(req.Id, func() { once.Do(func() { close(cancel) }) })
+	defer tunnel.UnregisterCancelFunction(cancelRegistration)
+
+	select {
+	case <-g.release:
+	case <-cancel:
+		g.Lock()
+		g.cancelled = true
+		g.Unlock()
+		return
+	}
+	dataflow <- &tunnel.MessageWrapper{
+		Event: &tunnel.MessageWrapper_HttpTunnelControl{
+			HttpTunnelControl: &tunnel.HttpTunnelControl{
+				ControlType: &tunnel.HttpTunnelControl_HttpTunnelResponse{
+					HttpTunnelResponse: &tunnel.HttpTunnelResponse{Id: req.Id, Status: http.StatusOK},
+				},
+			},
+		},
+	}
+	dataflow <- &tunnel.MessageWrapper{
+		Event: &tunnel.MessageWrapper_HttpTunnelControl{
+			HttpTunnelControl: &tunnel.HttpTunnelControl{
+				ControlType: &tunnel.HttpTunnelControl_HttpTunnelChunkedResponse{
+					HttpTunnelChunkedResponse: &tunnel.HttpTunnelChunkedResponse{Id: req.Id, Body: []byte("pods")},
+				},
+			},
+		},
+	}
+	dataflow <- &tunnel.MessageWrapper{
+		Event: &tunnel.MessageWrapper_HttpTunnelControl{
+			HttpTunnelControl: &tunnel.HttpTunnelControl{
+				ControlType: &tunnel.HttpTunnelControl_HttpTunnelChunkedResponse{
+					HttpTunnelChunkedResponse: &tunnel.HttpTunnelChunkedResponse{Id: req.Id},
+				},
+			},
+		},
+	}
+}
+
+func (g *gatedProcessor) stats() (int, bool) {
+	g.Lock()
+	defer g.Unlock()
+	return g.calls, g.cancelled
+}
+
+func coalesceRequest(id string, method string, authorization string) *tunnel.OpenHTTPTunnelRequest {
+	return &tunnel.OpenHTTPTunnelRequest{
+		Id:     id,
+		Type:   "kubernetes",
+		Name:   "coalesce",
+		Method: method,
+		URI:    "/api/v1/pods",
+		Headers: []*tunnel.HttpHeader{
+			{Name: "Authorization", Values: []string{authorization}},
+			{Name: tunnel.RequestIDHeader, Values: []string{"request-" + id}},
+		},
+	}
+}
+
+// startCoalesced runs the request, returning the channel its response is
+// sent on and one which is closed once it is done.
+func startCoalesced(c *coalescer, req *tunnel.OpenHTTPTunnelRequest) (chan *tunnel.MessageWrapper, chan struct{}) {
+	dataflow := make(chan *tunnel.MessageWrapper, 10)
+	done := make(chan struct{})
+	go func() {
+		c.ExecuteHTTPRequest("agent", dataflow, req)
+		close(done)
+	}()
+	return dataflow, done
+}
+
+func waitForCoalesced(t *testing.T, c *coalescer, n int) {
+	require.Eventually(t, func() bool {
+		c.Lock()
+		defer c.Unlock()
+		waiting := 0
+		for _, f := range c.flights {
+			waiting += f.waiting
+		}
+		return waiting == n
+	}, time.Second, time.Millisecond)
+}
+
+func waitDone(t *testing.T, done chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("request did not complete")
+	}
+}
+
+// assertResponse checks that the whole response was sent for the id.
+func assertResponse(t *testing.T, dataflow chan *tunnel.MessageWrapper, id string) {
+	require.Len(t, dataflow, 3)
+	resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+	require.NotNil(t, resp)
+	assert.Equal(t, id, resp.Id)
+	assert.Equal(t, int32(http.StatusOK), resp.Status)
+	chunk := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelChunkedResponse()
+	require.NotNil(t, chunk)
+	assert.Equal(t, id, chunk.Id)
+	assert.Equal(t, []byte("pods"), chunk.Body)
+	eof := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelChunkedResponse()
+	require.NotNil(t, eof)
+	assert.Equal(t, id, eof.Id)
+	assert.Empty(t, eof.Body)
+}
+
+func TestCoalescer_identicalGETs(t *testing.T) {
+	upstream := &gatedProcessor{release: make(chan struct{})}
+	c := newCoalescer("kubernetes", "coalesce", upstream)
+
+	dataflowA, doneA := startCoalesced(c, coalesceRequest("a", http.MethodGet, "Bearer alice"))
+	dataflowB, doneB := startCoalesced(c, coalesceRequest("b", http.MethodGet, "Bearer alice"))
+	waitForCoalesced(t, c, 2)
+	close(upstream.release)
+	waitDone(t, doneA)
+	waitDone(t, doneB)
+
+	calls, _ := upstream.stats()
+	assert.Equal(t, 1, calls)
+	assertResponse(t, dataflowA, "a")
+	assertResponse(t, dataflowB, "b")
+	assert.Empty(t, c.flights)
+}
+
+func TestCoalescer_notCoalesced(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  *tunnel.OpenHTTPTunnelRequest
+		second *tunnel.OpenHTTPTunnelRequest
+	}{
+		{
+			"different credentials",
+			coalesceRequest("a", http.MethodGet, "Bearer alice"),
+			coalesceRequest("b", http.MethodGet, "Bearer bob"),
+		},
+		{
+			"not GET",
+			coalesceRequest("a", http.MethodHead, "Bearer alice"),
+			coalesceRequest("b", http.MethodHead, "Bearer alice"),
+		},
+		{
+			"different URI",
+			coalesceRequest("a", http.MethodGet, "Bearer alice"),
+			&tunnel.OpenHTTPTunnelRequest{Id: "b", Type: "kubernetes", Name: "coalesce", Method: http.MethodGet, URI: "/api/v1/nodes",
+				Headers: []*tunnel.HttpHeader{{Name: "Authorization", Values: []string{"Bearer alice"}}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &gatedProcessor{release: make(chan struct{})}
+			close(upstream.release)
+			c := newCoalescer("kubernetes", "coalesce", upstream)
+
+			dataflowA, doneA := startCoalesced(c, tt.first)
+			dataflowB, doneB := startCoalesced(c, tt.second)
+			waitDone(t, doneA)
+			waitDone(t, doneB)
+
+			calls, _ := upstream.stats()
+			assert.Equal(t, 2, calls)
+			assertResponse(t, dataflowA, "a")
+			assertResponse(t, dataflowB, "b")
+		})
+	}
+}
+
+func TestCoalescer_cancel(t *testing.T) {
+	upstream := &gatedProcessor{release: make(chan struct{})}
+	c := newCoalescer("kubernetes", "coalesce", upstream)
+
+	dataflowA, doneA := startCoalesced(c, coalesceRequest("a", http.MethodGet, "Bearer alice"))
+	dataflowB, doneB := startCoalesced(c, coalesceRequest("b", http.MethodGet, "Bearer alice"))
+	waitForCoalesced(t, c, 2)
+
+	// Cancelling one request leaves the other sharing the response.
+	require.Eventually(t, func() bool {
+		tunnel.CallCancelFunction("a")
+		select {
+		case <-doneA:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond)
+	assert.Empty(t, dataflowA)
+	_, cancelled := upstream.stats()
+	assert.False(t, cancelled)
+
+	// Once no request is waiting, the upstream request is cancelled.
+	require.Eventually(t, func() bool {
+		tunnel.CallCancelFunction("b")
+		_, cancelled := upstream.stats()
+		return cancelled
+	}, time.Second, time.Millisecond)
+	waitDone(t, doneB)
+	assert.Empty(t, dataflowB)
+
+	// A new request is not joined to the cancelled one.
+	close(upstream.release)
+	dataflowC, doneC := startCoalesced(c, coalesceRequest("c", http.MethodGet, "Bearer alice"))
+	waitDone(t, doneC)
+	assertResponse(t, dataflowC, "c")
+	calls, _ := upstream.stats()
+	assert.Equal(t, 2, calls)
+}
+
+// chunkedProcessor sends a response with a chunk for each body sent on
+// chunks, ending it once chunks is closed.
+type chunkedProcessor struct {
+	sync.Mutex
+	chunks chan []byte
+	calls  int
+}
+
+func (p *chunkedProcessor) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	p.Lock()
+	p.calls++
+	p.Unlock()
+	dataflow <- &tunnel.MessageWrapper{
+		Event: &tunnel.MessageWrapper_HttpTunnelControl{
+			HttpTunnelControl: &tunnel.HttpTunnelControl{
+				ControlType: &tunnel.HttpTunnelControl_HttpTunnelResponse{
+					HttpTunnelResponse: &tunnel.HttpTunnelResponse{Id: req.Id, Status: http.StatusOK, ContentLength: -1},
+				},
+			},
+		},
+	}
+	for body := range p.chunks {
+		dataflow <- &tunnel.MessageWrapper{
+			Event: &tunnel.MessageWrapper_HttpTunnelControl{
+				HttpTunnelControl: &tunnel.HttpTunnelControl{
+					ControlType: &tunnel.HttpTunnelControl_HttpTunnelChunkedResponse{
+						HttpTunnelChunkedResponse: &tunnel.HttpTunnelChunkedResponse{Id: req.Id, Body: body},
+					},
+				},
+			},
+		}
+	}
+	dataflow <- &tunnel.MessageWrapper{
+		Event: &tunnel.MessageWrapper_HttpTunnelControl{
+			HttpTunnelControl: &tunnel.HttpTunnelControl{
+				ControlType: &tunnel.HttpTunnelControl_HttpTunnelChunkedResponse{
+					HttpTunnelChunkedResponse: &tunnel.HttpTunnelChunkedResponse{Id: req.Id},
+				},
+			},
+		},
+	}
+}
+
+func (p *chunkedProcessor) callCount() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.calls
+}
+
+func TestCoalescer_largeResponse(t *testing.T) {
+	upstream := &chunkedProcessor{chunks: make(chan []byte)}
+	c := newCoalescer("kubernetes", "coalesce", upstream)
+
+	dataflowA := make(chan *tunnel.MessageWrapper, 10)
+	doneA := make(chan struct{})
+	go func() {
+		c.ExecuteHTTPRequest("agent", dataflowA, coalesceRequest("a", http.MethodGet, "Bearer alice"))
+		close(doneA)
+	}()
+	waitForCoalesced(t, c, 1)
+	// Nothing reads the second request's response for now.
+	dataflowB := make(chan *tunnel.MessageWrapper)
+	doneB := make(chan struct{})
+	go func() {
+		c.ExecuteHTTPRequest("agent", dataflowB, coalesceRequest("b", http.MethodGet, "Bearer alice"))
+		close(doneB)
+	}()
+	waitForCoalesced(t, c, 2)
+
+	// Once past maxCoalescedBytes, no one else may join.
+	chunk := make([]byte, maxCoalescedBytes/2+1)
+	upstream.chunks <- chunk
+	upstream.chunks <- chunk
+	require.Eventually(t, func() bool {
+		c.Lock()
+		defer c.Unlock()
+		return len(c.flights) == 0
+	}, time.Second, time.Millisecond)
+
+	// Nor is any more read from the service until the slower request has
+	// sent what is held.
+	sent := make(chan struct{})
+	go func() {
+		upstream.chunks <- chunk
+		upstream.chunks <- chunk
+		close(upstream.chunks)
+		close(sent)
+	}()
+	assert.Never(t, func() bool { return len(dataflowA) > 3 }, 100*time.Millisecond, 5*time.Millisecond)
+
+	// Both requests are still sent the whole response.
+	received := 0
+	for msg := range dataflowB {
+		received++
+		if chunk := msg.GetHttpTunnelControl().GetHttpTunnelChunkedResponse(); chunk != nil && len(chunk.Body) == 0 {
+			break
+		}
+	}
+	waitDone(t, doneA)
+	waitDone(t, doneB)
+	<-sent
+	assert.Equal(t, 6, received)
+	assert.Len(t, dataflowA, 6)
+	assert.Equal(t, 1, upstream.callCount())
+}
+
+func TestIsCoalescable_streaming(t *testing.T) {
+	tests := []struct {
+		name   string
+		uri    string
+		accept string
+		want   bool
+	}{
+		{"list", "/api/v1/pods", "", true},
+		{"watch", "/api/v1/pods?watch=true", "", false},
+		{"watch 1", "/api/v1/pods?watch=1", "", false},
+		{"watch false", "/api/v1/pods?watch=false", "", true},
+		{"follow logs", "/api/v1/namespaces/default/pods/web/log?follow=true", "", false},
+		{"logs", "/api/v1/namespaces/default/pods/web/log?follow=0", "", true},
+		{"event stream", "/events", "text/event-stream", false},
+		{"json", "/events", "application/json", true},
+		{"unparsable", "%zz", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &tunnel.OpenHTTPTunnelRequest{Method: http.MethodGet, URI: tt.uri}
+			if tt.accept != "" {
+				req.Headers = []*tunnel.HttpHeader{{Name: "Accept", Values: []string{tt.accept}}}
+			}
+			assert.Equal(t, tt.want, isCoalescable(req))
+		})
+	}
+}
+
+func TestCoalescer_watchNotCoalesced(t *testing.T) {
+	upstream := &gatedProcessor{release: make(chan struct{})}
+	c := newCoalescer("kubernetes", "coalesce", upstream)
+
+	watch := func(id string) *tunnel.OpenHTTPTunnelRequest {
+		req := coalesceRequest(id, http.MethodGet, "Bearer alice")
+		req.URI = "/api/v1/pods?watch=true"
+		return req
+	}
+	dataflowA, doneA := startCoalesced(c, watch("a"))
+	dataflowB, doneB := startCoalesced(c, watch("b"))
+	require.Eventually(t, func() bool {
+		calls, _ := upstream.stats()
+		return calls == 2
+	}, time.Second, time.Millisecond)
+	assert.Empty(t, c.flights)
+
+	close(upstream.release)
+	waitDone(t, doneA)
+	waitDone(t, doneB)
+	assertResponse(t, dataflowA, "a")
+	assertResponse(t, dataflowB, "b")
+}
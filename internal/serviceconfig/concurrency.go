@@ -0,0 +1,176 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var queuedRequestsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "endpoint_queued_requests",
+	Help: "The number of requests waiting for the endpoint's concurrency limit",
+}, []string{"endpointType", "endpointName"})
+
+// concurrencyLimiter wraps an endpoint's request processor, so no more
+// than max requests run through it at once.  Requests beyond that wait,
+// and are started highest priority first, then in the order they arrived.
+type concurrencyLimiter struct {
+	sync.Mutex
+	next         httpRequestProcessor
+	endpointType string
+	endpointName string
+	max          int
+	running      int
+	waiting      waitQueue
+	arrivals     uint64
+}
+
+// waiter is a request waiting for a place.  ready is closed once it has
+// one.
+type waiter struct {
+	priority int32
+	arrival  uint64
+	ready    chan struct{}
+	index    int
+}
+
+// waitQueue is a heap of waiters, the next to start first.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].arrival < q[j].arrival
+}
+
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+func newConcurrencyLimiter(endpointType string, endpointName string, max int, next httpRequestProcessor) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		next:         next,
+		endpointType: endpointType,
+		endpointName: endpointName,
+		max:          max,
+	}
+}
+
+func (l *concurrencyLimiter) unwrap() httpRequestProcessor {
+	return l.next
+}
+
+// ExecuteHTTPRequest runs the request through the wrapped endpoint once
+// fewer than max requests are running.  A request cancelled while waiting
+// is dropped, and one whose deadline passes while waiting is answered with
+// a 504, as the controller does not enforce the deadline itself.
+func (l *concurrencyLimiter) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	if err := l.acquire(req); err != nil {
+		tunnel.ReleaseRequestBody(req)
+		if errors.Is(err, context.DeadlineExceeded) {
+			dataflow <- tunnel.MakeGatewayTimeoutResponse(req.Id)
+		}
+		return
+	}
+	defer l.release()
+	l.next.ExecuteHTTPRequest(agentName, dataflow, req)
+}
+
+// acquire waits for a place for the request, returning the context's error
+// if it was cancelled or its deadline passed first.
+func (l *concurrencyLimiter) acquire(req *tunnel.OpenHTTPTunnelRequest) error {
+	l.Lock()
+	if l.running < l.max && len(l.waiting) == 0 {
+		l.running++
+		l.Unlock()
+		return nil
+	}
+	l.arrivals++
+	w := &waiter{priority: req.Priority, arrival: l.arrivals, ready: make(chan struct{})}
+	heap.Push(&l.waiting, w)
+	gauge := queuedRequestsGauge.WithLabelValues(l.endpointType, l.endpointName)
+	gauge.Inc()
+	l.Unlock()
+
+	ctx, cancel := tunnel.RequestContext(req)
+	defer cancel()
+	cancelRegistration := tunnel.RegisterCancelFunction(req.Id, cancel)
+	defer tunnel.UnregisterCancelFunction(cancelRegistration)
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if w.index < 0 {
+		// Given a place as it was cancelled, so pass it on.
+		l.startNextLocked()
+		return ctx.Err()
+	}
+	heap.Remove(&l.waiting, w.index)
+	gauge.Dec()
+	return ctx.Err()
+}
+
+// release gives up a place, starting the next waiting request if any.
+func (l *concurrencyLimiter) release() {
+	l.Lock()
+	defer l.Unlock()
+	l.startNextLocked()
+}
+
+// startNextLocked hands a running request's place to the next waiting
+// request, or frees it if none are waiting.
+func (l *concurrencyLimiter) startNextLocked() {
+	if len(l.waiting) == 0 {
+		l.running--
+		return
+	}
+	w := heap.Pop(&l.waiting).(*waiter)
+	queuedRequestsGauge.WithLabelValues(l.endpointType, l.endpointName).Dec()
+	close(w.ready)
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// orderedProcessor records the order requests start in, and holds each
+// until it is finished.
+type orderedProcessor struct {
+	sync.Mutex
+	started  []string
+	finished map[string]chan struct{}
+}
+
+func newOrderedProcessor(ids ...string) *orderedProcessor {
+	p := &orderedProcessor{finished: map[string]chan struct{}{}}
+	for _, id := range ids {
+		p.finished[id] = make(chan struct{})
+	}
+	return p
+}
+
+func (p *orderedProcessor) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	p.Lock()
+	p.started = append(p.started, req.Id)
+	finished := p.finished[req.Id]
+	p.Unlock()
+	<-finished
+}
+
+func (p *orderedProcessor) startedOrder() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string{}, p.started...)
+}
+
+func (p *orderedProcessor) finish(id string) {
+	close(p.finished[id])
+}
+
+// startLimited runs the request, returning a channel which is closed once
+// it is done.
+func startLimited(l *concurrencyLimiter, id string, priority int32) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		l.ExecuteHTTPRequest("agent", make(chan *tunnel.MessageWrapper, 10), &tunnel.OpenHTTPTunnelRequest{Id: id, Priority: priority})
+		close(done)
+	}()
+	return done
+}
+
+func waitForQueued(t *testing.T, l *concurrencyLimiter, n int) {
+	require.Eventually(t, func() bool {
+		l.Lock()
+		defer l.Unlock()
+		return len(l.waiting) == n
+	}, time.Second, time.Millisecond)
+}
+
+func waitForStarted(t *testing.T, p *orderedProcessor, n int) {
+	require.Eventually(t, func() bool {
+		return len(p.startedOrder()) == n
+	}, time.Second, time.Millisecond)
+}
+
+func TestConcurrencyLimiter_highPriorityJumpsQueue(t *testing.T) {
+	upstream := newOrderedProcessor("running", "low1", "low2", "low3", "high")
+	l := newConcurrencyLimiter("kubernetes", "limited", 1, upstream)
+
+	done := []chan struct{}{startLimited(l, "running", 0)}
+	waitForStarted(t, upstream, 1)
+	for i, id := range []string{"low1", "low2", "low3"} {
+		done = append(done, startLimited(l, id, 0))
+		waitForQueued(t, l, i+1)
+	}
+	done = append(done, startLimited(l, "high", 10))
+	waitForQueued(t, l, 4)
+
+	for _, id := range []string{"running", "high", "low1", "low2"} {
+		n := len(upstream.startedOrder())
+		upstream.finish(id)
+		waitForStarted(t, upstream, n+1)
+	}
+	upstream.finish("low3")
+	for _, d := range done {
+		waitDone(t, d)
+	}
+
+	assert.Equal(t, []string{"running", "high", "low1", "low2", "low3"}, upstream.startedOrder())
+	assert.Equal(t, 0, l.running)
+}
+
+func TestConcurrencyLimiter_underLimit(t *testing.T) {
+	upstream := newOrderedProcessor("a", "b")
+	l := newConcurrencyLimiter("kubernetes", "limited", 2, upstream)
+
+	doneA := startLimited(l, "a", 0)
+	doneB := startLimited(l, "b", 0)
+	waitForStarted(t, upstream, 2)
+
+	upstream.finish("a")
+	upstream.finish("b")
+	waitDone(t, doneA)
+	waitDone(t, doneB)
+}
+
+func TestConcurrencyLimiter_cancelWhileQueued(t *testing.T) {
+	upstream := newOrderedProcessor("running", "cancelled", "next")
+	l := newConcurrencyLimiter("kubernetes", "limited", 1, upstream)
+
+	doneRunning := startLimited(l, "running", 0)
+	waitForStarted(t, upstream, 1)
+	doneCancelled := startLimited(l, "cancelled", 5)
+	waitForQueued(t, l, 1)
+	doneNext := startLimited(l, "next", 0)
+	waitForQueued(t, l, 2)
+
+	tunnel.CallCancelFunction("cancelled")
+	waitDone(t, doneCancelled)
+	waitForQueued(t, l, 1)
+
+	upstream.finish("running")
+	waitForStarted(t, upstream, 2)
+	upstream.finish("next")
+	waitDone(t, doneRunning)
+	waitDone(t, doneNext)
+
+	assert.Equal(t, []string{"running", "next"}, upstream.startedOrder())
+}
+
+func TestConcurrencyLimiter_deadlineWhileQueued(t *testing.T) {
+	upstream := newOrderedProcessor("running", "late")
+	l := newConcurrencyLimiter("kubernetes", "limited", 1, upstream)
+
+	doneRunning := startLimited(l, "running", 0)
+	waitForStarted(t, upstream, 1)
+
+	// Queued behind a full limiter until its deadline passes.
+	dataflow := make(chan *tunnel.MessageWrapper, 10)
+	l.ExecuteHTTPRequest("agent", dataflow, &tunnel.OpenHTTPTunnelRequest{Id: "late", TimeoutMillis: 50})
+	require.Len(t, dataflow, 1)
+	resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+	require.NotNil(t, resp)
+	assert.Equal(t, "late", resp.Id)
+	assert.Equal(t, int32(http.StatusGatewayTimeout), resp.Status)
+	waitForQueued(t, l, 0)
+
+	upstream.finish("running")
+	waitDone(t, doneRunning)
+	assert.Equal(t, []string{"running"}, upstream.startedOrder())
+	assert.Equal(t, 0, l.running)
+}
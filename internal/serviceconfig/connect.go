@@ -0,0 +1,119 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConnectDialTimeout = 10 * time.Second
+
+type connectConfig struct {
+	AllowedTargets []string           `yaml:"allowedTargets,omitempty"`
+	DialTimeout    time.Duration      `yaml:"dialTimeout,omitempty"`
+	Chunking       tunnel.ChunkConfig `yaml:"chunking,omitempty"`
+}
+
+// ConnectEndpoint handles HTTP CONNECT requests by opening a TCP connection
+// to the requested host and port, and passing data in both directions.
+// Only targets matching one of the AllowedTargets patterns may be reached.
+type ConnectEndpoint struct {
+	endpointName string
+	config       connectConfig
+	dialer       *net.Dialer
+}
+
+// MakeConnectEndpoint returns an endpoint which allows tunneling TCP
+// connections to the configured targets.
+func MakeConnectEndpoint(name string, configBytes []byte) (*ConnectEndpoint, bool, error) {
+	var config connectConfig
+	err := yaml.Unmarshal(configBytes, &config)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(config.AllowedTargets) == 0 {
+		zap.S().Errorf("allowedTargets not set for connect/%s", name)
+		return nil, false, nil
+	}
+	for _, pattern := range config.AllowedTargets {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, false, fmt.Errorf("connect/%s: invalid allowedTargets pattern %q: %v", name, pattern, err)
+		}
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = defaultConnectDialTimeout
+	}
+
+	ep := &ConnectEndpoint{
+		endpointName: name,
+		config:       config,
+		dialer:       &net.Dialer{Timeout: config.DialTimeout},
+	}
+	return ep, true, nil
+}
+
+// allowed returns true if target is a host:port which matches one of the
+// allowed patterns.
+func (ep *ConnectEndpoint) allowed(target string) bool {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return false
+	}
+	for _, pattern := range ep.config.AllowedTargets {
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ExecuteHTTPRequest opens a connection to the target named in a CONNECT
+// request, and will send the data back over the tunnel.
+func (ep *ConnectEndpoint) ExecuteHTTPRequest(_ string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	if req.Method != http.MethodConnect {
+		zap.S().Warnw("connect endpoint only accepts CONNECT", "endpointName", ep.endpointName, "method", req.Method)
+		dataflow <- tunnel.MakeMethodNotAllowedResponse(req.Id)
+		return
+	}
+	if !ep.allowed(req.URI) {
+		zap.S().Warnw("connect target not allowed", "endpointName", ep.endpointName, "target", req.URI)
+		dataflow <- tunnel.MakeForbiddenResponse(req.Id)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelRegistration := tunnel.RegisterCancelFunction(req.Id, cancel)
+	defer tunnel.UnregisterCancelFunction(cancelRegistration)
+
+	conn, err := ep.dialer.DialContext(ctx, "tcp", req.URI)
+	if err != nil {
+		zap.S().Warnw("failed to connect", "endpointName", ep.endpointName, "target", req.URI, "error", err)
+		dataflow <- tunnel.MakeBadGatewayResponse(req.Id)
+		return
+	}
+
+	tunnel.RunTCPStream(ctx, req, conn, dataflow, ep.config.Chunking)
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeConnectEndpoint(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         string
+		wantConfigured bool
+		wantErr        bool
+	}{
+		{"no targets", "{}", false, false},
+		{"bad pattern", "allowedTargets: ['[:443']", false, true},
+		{"ok", "allowedTargets: ['*.svc.cluster.local:443']", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep, configured, err := MakeConnectEndpoint("proxy", []byte(tt.config))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantConfigured, configured)
+			if configured {
+				assert.Equal(t, defaultConnectDialTimeout, ep.config.DialTimeout)
+			}
+		})
+	}
+}
+
+func TestConnectEndpoint_allowed(t *testing.T) {
+	ep := &ConnectEndpoint{
+		config: connectConfig{
+			AllowedTargets: []string{"*.svc.cluster.local:443", "10.0.0.1:*", "db:5432"},
+		},
+	}
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"jenkins.default.svc.cluster.local:443", true},
+		{"jenkins.default.svc.cluster.local:80", false},
+		{"10.0.0.1:8443", true},
+		{"10.0.0.2:8443", false},
+		{"db:5432", true},
+		{"db", false},
+		{"db:5433", false},
+		{"evil.com:443", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			assert.Equal(t, tt.want, ep.allowed(tt.target))
+		})
+	}
+}
+
+func TestConnectEndpoint_ExecuteHTTPRequest_rejects(t *testing.T) {
+	ep, configured, err := MakeConnectEndpoint("proxy", []byte("allowedTargets: ['db:5432']"))
+	require.NoError(t, err)
+	require.True(t, configured)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int32
+	}{
+		{"not CONNECT", http.MethodGet, "/", http.StatusMethodNotAllowed},
+		{"not allowed", http.MethodConnect, "evil.com:443", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataflow := make(chan *tunnel.MessageWrapper, 10)
+			ep.ExecuteHTTPRequest("", dataflow, &tunnel.OpenHTTPTunnelRequest{Id: "id", Method: tt.method, URI: tt.target})
+			resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+			require.NotNil(t, resp)
+			assert.Equal(t, tt.wantStatus, resp.Status)
+		})
+	}
+}
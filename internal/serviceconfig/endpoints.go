@@ -18,9 +18,11 @@ package serviceconfig
 
 import (
 	"fmt"
+	"io"
 
 	"github.com/opsmx/oes-birger/internal/secrets"
 	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
 )
@@ -35,17 +37,50 @@ type ConfiguredEndpoint struct {
 	AccountID   string            `json:"accountId,omitempty"`
 	AssumeRole  string            `json:"assumeRole,omitempty"`
 
+	MaxConcurrency int `json:"maxConcurrency,omitempty"`
+	Weight         int `json:"weight,omitempty"`
+
 	Instance httpRequestProcessor `json:"_"`
+
+	// closer, if set, releases the endpoint's resources, such as
+	// goroutines refreshing its credentials.  It may be shared by several
+	// endpoints.
+	closer io.Closer
 }
 
 type httpRequestProcessor interface {
 	ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest)
 }
 
+// processorWrapper is implemented by the processors which wrap an
+// endpoint, such as the retrier, and returns the processor they wrap.
+type processorWrapper interface {
+	unwrap() httpRequestProcessor
+}
+
 func (e *ConfiguredEndpoint) String() string {
 	return fmt.Sprintf("(type=%s, name=%s, configured=%v)", e.Type, e.Name, e.Configured)
 }
 
+// FindConfiguredEndpoint returns the configured endpoint with the type and
+// name, or if there is none, the first whose name is a pattern matching it.
+func FindConfiguredEndpoint(endpoints []ConfiguredEndpoint, endpointType string, endpointName string) *ConfiguredEndpoint {
+	var match *ConfiguredEndpoint
+	for i := range endpoints {
+		ep := &endpoints[i]
+		if !ep.Configured || ep.Type != endpointType {
+			continue
+		}
+		if ep.Name == endpointName {
+			return ep
+		}
+		if match == nil && tunnelroute.EndpointNameMatches(ep.Name, endpointName) {
+			match = ep
+		}
+	}
+	return match
+}
+
 // EndpointsToPB builds the protobuf component of the "hello" message to advertise the
 // endpoints we have defined.
 func EndpointsToPB(endpoints []ConfiguredEndpoint) []*tunnel.EndpointHealth {
@@ -63,12 +98,56 @@ func EndpointsToPB(endpoints []ConfiguredEndpoint) []*tunnel.EndpointHealth {
 			Namespaces:  ep.Namespace,
 			AccountID:   ep.AccountID,
 			AssumeRole:  ep.AssumeRole,
+
+			MaxConcurrency: int32(ep.MaxConcurrency),
+			Weight:         int32(ep.Weight),
 		}
 		pbEndpoints[i] = endp
 	}
 	return pbEndpoints
 }
 
+// HealthReportToPB builds an endpoint health report from the results of
+// CheckEndpoints for endpoints, along with the state of each endpoint's
+// circuit breaker.  Skipped endpoints without a breaker are left out, so
+// they stay healthy.
+func HealthReportToPB(endpoints []ConfiguredEndpoint, results []SelfTestResult) *tunnel.EndpointHealthReport {
+	report := &tunnel.EndpointHealthReport{}
+	for i, result := range results {
+		circuitBreaker := ""
+		if cb := circuitBreakerFor(endpoints[i].Instance); cb != nil {
+			circuitBreaker = cb.stateName()
+		}
+		if result.Skipped && circuitBreaker == "" {
+			continue
+		}
+		status := &tunnel.EndpointStatus{
+			Type:           result.Type,
+			Name:           result.Name,
+			Healthy:        result.Skipped || result.Passed(),
+			CircuitBreaker: circuitBreaker,
+		}
+		if result.Err != nil {
+			status.Reason = result.Err.Error()
+		}
+		report.Endpoints = append(report.Endpoints, status)
+	}
+	return report
+}
+
+// CloseEndpoints releases the resources of endpoints which are no longer
+// used, such as when the configuration is replaced or on shutdown.
+func CloseEndpoints(endpoints []ConfiguredEndpoint) {
+	for _, ep := range endpoints {
+		if ep.closer == nil {
+			continue
+		}
+		if err := ep.closer.Close(); err != nil {
+			zap.S().Warnw("unable to close endpoint", "endpointType", ep.Type, "endpointName", ep.Name, "error", err)
+		}
+	}
+}
+
 // ConfigureEndpoints will load services from the config, attach a processor, and return the configured
 // list.
 func ConfigureEndpoints(secretsLoader secrets.SecretLoader, serviceConfig *ServiceConfig) []ConfiguredEndpoint {
@@ -77,6 +156,7 @@ func ConfigureEndpoints(secretsLoader secrets.SecretLoader, serviceConfig *Servi
 	for _, service := range serviceConfig.OutgoingServices {
 		var instance httpRequestProcessor
 		var configured bool
+		var closer io.Closer
 
 		if service.Enabled {
 			config, err := yaml.Marshal(service.Config)
@@ -88,9 +168,15 @@ func ConfigureEndpoints(secretsLoader secrets.SecretLoader, serviceConfig *Servi
 				if secretsLoader == nil {
 					zap.S().Fatalf("kuberenetes is disabled, but a kubernetes service is configured.")
 				}
-				instance, configured, err = MakeKubernetesEndpoint(service.Name, config)
+				var ke *KubernetesEndpoint
+				ke, configured, err = MakeKubernetesEndpoint(service.Name, config)
+				instance, closer = ke, ke
 			case "aws":
 				instance, configured, err = MakeAwsEndpoint(service.Name, config, secretsLoader)
+			case "connect":
+				instance, configured, err = MakeConnectEndpoint(service.Name, config)
+			case "grpc":
+				instance, configured, err = MakeGRPCEndpoint(service.Name, config)
 			default:
 				instance, configured, err = MakeGenericEndpoint(service.Type, service.Name, config, secretsLoader)
 			}
@@ -100,6 +186,30 @@ func ConfigureEndpoints(secretsLoader secrets.SecretLoader, serviceConfig *Servi
 				zap.S().Fatal(err)
 			}
 
+			if configured && service.Retry.enabled() {
+				instance = newRetrier(service.Type, service.Name, service.Retry, instance)
+			}
+
+			if configured && service.CircuitBreaker.FailureThreshold > 0 {
+				instance = newCircuitBreaker(service.Type, service.Name, service.CircuitBreaker, instance)
+			}
+
+			if configured && service.MaxConcurrency > 0 {
+				instance = newConcurrencyLimiter(service.Type, service.Name, service.MaxConcurrency, instance)
+			}
+
+			if configured && service.CoalesceGETs {
+				instance = newCoalescer(service.Type, service.Name, instance)
+			}
+
+			if configured && service.Cache.TTL > 0 {
+				instance = newResponseCache(service.Type, service.Name, service.Cache, instance)
+			}
+
+			if configured && service.AccessLog.Enabled {
+				instance = newAccessLogger(service.Type, service.Name, service.AccessLog, instance)
+			}
+
 			if len(service.Namespaces) == 0 {
 				// If it did not return an error, a nil instance means it is not fully configured.
 				zap.S().Infow("adding endpoint",
@@ -115,6 +225,11 @@ func ConfigureEndpoints(secretsLoader secrets.SecretLoader, serviceConfig *Servi
 					Instance:    instance,
 					AccountID:   service.AccountID,
 					AssumeRole:  service.AssumeRole,
+
+					MaxConcurrency: service.MaxConcurrency,
+					Weight:         service.Weight,
+
+					closer: closer,
 				})
 			} else {
 				for _, ns := range service.Namespaces {
@@ -129,6 +244,11 @@ func ConfigureEndpoints(secretsLoader secrets.SecretLoader, serviceConfig *Servi
 						Configured: configured,
 						Instance:   instance,
 						Namespace:  ns.Namespaces,
+
+						MaxConcurrency: service.MaxConcurrency,
+						Weight:         service.Weight,
+
+						closer: closer,
 					}
 					endpoints = append(endpoints, newep)
 				}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFindConfiguredEndpoint(t *testing.T) {
+	endpoints := []ConfiguredEndpoint{
+		{Type: "jenkins", Name: "jenkins-*", Configured: true},
+		{Type: "jenkins", Name: "jenkins-prod", Configured: true},
+		{Type: "jenkins", Name: "jenkins-off", Configured: false},
+	}
+	tests := []struct {
+		name string
+		want *ConfiguredEndpoint
+	}{
+		{"jenkins-prod", &endpoints[1]},
+		{"jenkins-dev", &endpoints[0]},
+		{"jenkins-off", &endpoints[0]},
+		{"argo", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Same(t, tt.want, FindConfiguredEndpoint(endpoints, "jenkins", tt.name))
+		})
+	}
+	assert.Nil(t, FindConfiguredEndpoint(endpoints, "argo", "jenkins-prod"))
+}
+
+func TestHealthReportToPB(t *testing.T) {
+	open := newCircuitBreaker("jenkins", "ci", CircuitBreakerConfig{FailureThreshold: 1}, &AwsEndpoint{})
+	open.record(false, false)
+	closed := newCircuitBreaker("aws", "aws-breaker", CircuitBreakerConfig{FailureThreshold: 1}, &AwsEndpoint{})
+	endpoints := []ConfiguredEndpoint{
+		{Type: "jenkins", Name: "ci", Configured: true, Instance: newRetrier("jenkins", "ci", RetryConfig{Attempts: 1}, open)},
+		{Type: "kubernetes", Name: "k8s", Configured: true, Instance: &KubernetesEndpoint{}},
+		{Type: "aws", Name: "aws", Configured: true, Instance: &AwsEndpoint{}},
+		{Type: "aws", Name: "aws-breaker", Configured: true, Instance: closed},
+	}
+	results := []SelfTestResult{
+		{Type: "jenkins", Name: "ci"},
+		{Type: "kubernetes", Name: "k8s", Err: errors.New("connection refused")},
+		{Type: "aws", Name: "aws", Skipped: true},
+		{Type: "aws", Name: "aws-breaker", Skipped: true},
+	}
+	want := &tunnel.EndpointHealthReport{
+		Endpoints: []*tunnel.EndpointStatus{
+			{Type: "jenkins", Name: "ci", Healthy: true, CircuitBreaker: "open"},
+			{Type: "kubernetes", Name: "k8s", Healthy: false, Reason: "connection refused"},
+			{Type: "aws", Name: "aws-breaker", Healthy: true, CircuitBreaker: "closed"},
+		},
+	}
+	got := HealthReportToPB(endpoints, results)
+	assert.True(t, proto.Equal(want, got), "got %v", got)
+}
@@ -17,20 +17,20 @@
 package serviceconfig
 
 import (
-	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/opsmx/oes-birger/internal/jwtutil"
 	"github.com/opsmx/oes-birger/internal/secrets"
 	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/opsmx/oes-birger/internal/util"
 	"go.uber.org/zap"
-	"golang.org/x/net/context"
 	"gopkg.in/yaml.v3"
 )
 
@@ -46,10 +46,35 @@ type genericEndpointCredentials struct {
 	rawToken    string `yaml:"-"`
 }
 
+// genericEndpointTLS holds an optional client certificate presented to the
+// service, and an optional CA used to verify the service's certificate.  The
+// values are base64 encoded PEM, or if SecretName is set, are read from the
+// "tls.crt", "tls.key", and "ca.crt" keys of that Kubernetes secret.
+type genericEndpointTLS struct {
+	ClientCert string `yaml:"clientCert,omitempty"`
+	ClientKey  string `yaml:"clientKey,omitempty"`
+	ServerCA   string `yaml:"serverCA,omitempty"`
+	SecretName string `yaml:"secretName,omitempty"`
+}
+
 type genericEndpointConfig struct {
 	URL         string                     `yaml:"url,omitempty"`
 	Insecure    bool                       `yaml:"insecure,omitempty"`
 	Credentials genericEndpointCredentials `yaml:"credentials,omitempty"`
+	TLS         genericEndpointTLS         `yaml:"tls,omitempty"`
+	Transport   transportConfig            `yaml:"transport,omitempty"`
+	Chunking    tunnel.ChunkConfig         `yaml:"chunking,omitempty"`
+	Headers     tunnel.HeaderRules         `yaml:"headers,omitempty"`
+
+	MaxRequestBodyBytes     int64    `yaml:"maxRequestBodyBytes,omitempty"`
+	PreserveHopByHopHeaders []string `yaml:"preserveHopByHopHeaders,omitempty"`
+	AllowResponseHeaders    []string `yaml:"allowResponseHeaders,omitempty"`
+	MaxResponseHeaderBytes  int64    `yaml:"maxResponseHeaderBytes,omitempty"`
+
+	BodyTransforms []tunnel.BodyTransformConfig `yaml:"bodyTransforms,omitempty"`
+	StatusMap      tunnel.StatusMap             `yaml:"statusMap,omitempty"`
+
+	tunnel.ResponseBodyLimit `yaml:",inline"`
 }
 
 // GenericEndpoint defines the state (config and credentials) for a generic HTTP
@@ -58,6 +83,12 @@ type GenericEndpoint struct {
 	endpointType string
 	endpointName string
 	config       genericEndpointConfig
+	clientCert   *tls.Certificate
+	serverCAs    *x509.CertPool
+	client       *http.Client
+	responses    tunnel.ResponseOptions
+
+	bodyTransforms tunnel.BodyTransforms
 }
 
 func (ep *GenericEndpoint) loadSecrets(secretsLoader secrets.SecretLoader) error {
@@ -152,6 +183,72 @@ func (ep *GenericEndpoint) loadKubernetesSecrets(secretsLoader secrets.SecretLoa
 	}
 }
 
+func (ep *GenericEndpoint) loadTLS(secretsLoader secrets.SecretLoader) error {
+	c := ep.config.TLS
+	var certPEM, keyPEM, caPEM []byte
+	if c.SecretName != "" {
+		if secretsLoader == nil {
+			return fmt.Errorf("cannot load Kubernetes secrets from outside the cluster")
+		}
+		secret, err := secretsLoader.GetSecret(c.SecretName)
+		if err != nil {
+			return err
+		}
+		cert, hasCert := getItem(secret, "tls.crt")
+		key, hasKey := getItem(secret, "tls.key")
+		if !hasCert || !hasKey {
+			return fmt.Errorf("tls: tls.crt or tls.key missing in secret")
+		}
+		certPEM, keyPEM = cert, key
+		caPEM, _ = getItem(secret, "ca.crt")
+	} else if c.ClientCert != "" || c.ClientKey != "" {
+		if c.ClientCert == "" || c.ClientKey == "" {
+			return fmt.Errorf("tls: clientCert and clientKey must both be set")
+		}
+		var err error
+		if certPEM, err = base64.StdEncoding.DecodeString(c.ClientCert); err != nil {
+			return fmt.Errorf("tls: clientCert: %v", err)
+		}
+		if keyPEM, err = base64.StdEncoding.DecodeString(c.ClientKey); err != nil {
+			return fmt.Errorf("tls: clientKey: %v", err)
+		}
+	}
+	if c.ServerCA != "" {
+		var err error
+		if caPEM, err = base64.StdEncoding.DecodeString(c.ServerCA); err != nil {
+			return fmt.Errorf("tls: serverCA: %v", err)
+		}
+	}
+
+	if certPEM != nil {
+		keypair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("tls: loading client keypair: %v", err)
+		}
+		ep.clientCert = &keypair
+	}
+	if len(caPEM) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("tls: no certificates found in server CA")
+		}
+		ep.serverCAs = pool
+	}
+	return nil
+}
+
+func (ep *GenericEndpoint) makeClient() {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		RootCAs:            ep.serverCAs,
+		InsecureSkipVerify: ep.config.Insecure,
+	}
+	if ep.clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*ep.clientCert}
+	}
+	ep.client = ep.config.Transport.makeClient(util.ApplyTLSSettings(tlsConfig))
+}
+
 // MakeGenericEndpoint returns a generic HTTP endpoint which allows calling a HTTP service.
 func MakeGenericEndpoint(endpointType string, endpointName string, configBytes []byte, secretsLoader secrets.SecretLoader) (*GenericEndpoint, bool, error) {
 	ep := &GenericEndpoint{
@@ -166,12 +263,32 @@ func MakeGenericEndpoint(endpointType string, endpointName string, configBytes [
 	}
 	ep.config = config
 
+	ep.bodyTransforms, err = tunnel.MakeBodyTransforms(config.BodyTransforms)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s/%s: bodyTransforms%v", endpointType, endpointName, err)
+	}
+
+	if err := config.Transport.validate(); err != nil {
+		return nil, false, fmt.Errorf("%s/%s: transport: %v", endpointType, endpointName, err)
+	}
+
+	if err := config.StatusMap.Validate(); err != nil {
+		return nil, false, fmt.Errorf("%s/%s: statusMap%v", endpointType, endpointName, err)
+	}
+
 	err = ep.loadSecrets(secretsLoader)
 	if err != nil {
 		zap.S().Errorf("Unable to load secret: %v", err)
 		return nil, false, nil
 	}
 
+	err = ep.loadTLS(secretsLoader)
+	if err != nil {
+		zap.S().Errorf("Unable to load TLS configuration for %s/%s: %v", endpointType, endpointName, err)
+		return nil, false, nil
+	}
+	ep.makeClient()
+
 	if ep.config.URL == "" {
 		zap.S().Errorf("url not set for %s/%s", endpointType, endpointName)
 		return nil, false, nil
@@ -182,6 +299,15 @@ func MakeGenericEndpoint(endpointType string, endpointName string, configBytes [
 		ep.config.URL = newURL
 	}
 
+	ep.responses = tunnel.ResponseOptions{
+		Chunking:        config.Chunking,
+		PreserveHeaders: config.PreserveHopByHopHeaders,
+		AllowedHeaders:  config.AllowResponseHeaders,
+		MaxHeaderBytes:  config.MaxResponseHeaderBytes,
+		BodyLimit:       config.ResponseBodyLimit,
+		StatusMap:       config.StatusMap,
+	}
+
 	return ep, true, nil
 }
 
@@ -209,20 +335,11 @@ func (ep *GenericEndpoint) unmutateURI(typ string, method string, uri string, cl
 // tunnel.
 func (ep *GenericEndpoint) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
 	zap.S().Debugf("Running request %v", req)
-	tlsConfig := &tls.Config{
-		MinVersion: tls.VersionTLS12,
-	}
-	tr := &http.Transport{
-		MaxIdleConns:       10,
-		IdleConnTimeout:    30 * time.Second,
-		DisableCompression: true,
-		TLSClientConfig:    tlsConfig,
-	}
-	if ep.config.Insecure {
-		tr.TLSClientConfig.InsecureSkipVerify = true
-	}
-	client := &http.Client{
-		Transport: tr,
+	defer tunnel.ReleaseRequestBody(req)
+	if tunnel.RequestBodyTooLarge(req, ep.config.MaxRequestBodyBytes) {
+		zap.S().Warnw("request body too large", "method", req.Method, "uri", req.URI, "size", tunnel.RequestContentLength(req), "limit", ep.config.MaxRequestBodyBytes)
+		dataflow <- tunnel.MakeRequestEntityTooLargeResponse(req.Id)
+		return
 	}
 
 	uri, err := ep.unmutateURI(req.Type, req.Method, req.URI, nil)
@@ -232,16 +349,18 @@ func (ep *GenericEndpoint) ExecuteHTTPRequest(agentName string, dataflow chan *t
 		return
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	tunnel.RegisterCancelFunction(req.Id, cancel)
-	defer tunnel.UnregisterCancelFunction(req.Id)
+	ctx, cancel := tunnel.RequestContext(req)
+	defer cancel()
+	cancelRegistration := tunnel.RegisterCancelFunction(req.Id, cancel)
+	defer tunnel.UnregisterCancelFunction(cancelRegistration)
 
-	httpRequest, err := http.NewRequestWithContext(ctx, req.Method, ep.config.URL+uri, bytes.NewBuffer(req.Body))
+	httpRequest, err := http.NewRequestWithContext(ctx, req.Method, ep.config.URL+uri, tunnel.LimitRequestBody(tunnel.RequestBody(req, dataflow), ep.config.MaxRequestBodyBytes))
 	if err != nil {
 		zap.S().Errorf("Failed to build request for %s to %s: %v", req.Method, ep.config.URL+uri, err)
 		dataflow <- tunnel.MakeBadGatewayResponse(req.Id)
 		return
 	}
+	httpRequest.ContentLength = tunnel.RequestContentLength(req)
 
 	err = tunnel.CopyHeaders(req.Headers, &httpRequest.Header)
 	if err != nil {
@@ -249,11 +368,26 @@ func (ep *GenericEndpoint) ExecuteHTTPRequest(agentName string, dataflow chan *t
 		dataflow <- tunnel.MakeBadGatewayResponse(req.Id)
 		return
 	}
+	// The client's Authorization is for the controller, not the service.
+	// Header rules and credentials may set one of their own.
+	httpRequest.Header.Del("Authorization")
+	tunnel.SetUpstreamHeaders(req, httpRequest.Header)
+	ep.config.Headers.Apply(httpRequest.Header)
 
 	if agentName != "" {
 		httpRequest.Header.Set("x-opsmx-agent-name", agentName)
 	}
 
+	if err := ep.bodyTransforms.Apply(httpRequest, tunnel.BufferedBodyLimit(ep.config.MaxRequestBodyBytes)); err != nil {
+		zap.S().Warnw("failed to transform request body", "method", req.Method, "uri", req.URI, "error", err)
+		if errors.Is(err, tunnel.ErrRequestBodyTooLarge) {
+			dataflow <- tunnel.MakeRequestEntityTooLargeResponse(req.Id)
+			return
+		}
+		dataflow <- tunnel.MakeBadGatewayResponse(req.Id)
+		return
+	}
+
 	creds := ep.config.Credentials
 	switch creds.Type {
 	case "basic":
@@ -271,14 +405,14 @@ func (ep *GenericEndpoint) ExecuteHTTPRequest(agentName string, dataflow chan *t
 		if t != creds.rawToken {
 			zap.S().Infof("warning: trimming whitespace from token for %s/%s", ep.endpointType, ep.endpointName)
 		}
-		httpRequest.Header.Set("Authorization", "Bearer "+creds.rawToken)
+		httpRequest.Header.Set("Authorization", "Bearer "+t)
 	case "token":
 		t := strings.TrimSpace(creds.rawToken)
 		if t != creds.rawToken {
 			zap.S().Infof("warning: trimming whitespace from token for %s/%s", ep.endpointType, ep.endpointName)
 		}
-		httpRequest.Header.Set("Authorization", "Token "+creds.rawToken)
+		httpRequest.Header.Set("Authorization", "Token "+t)
 	}
 
-	tunnel.RunHTTPRequest(client, req, httpRequest, dataflow, ep.config.URL)
+	tunnel.RunHTTPRequest(ep.client, req, httpRequest, dataflow, ep.config.URL, ep.responses)
 }
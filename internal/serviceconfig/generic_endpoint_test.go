@@ -17,14 +17,25 @@
 package serviceconfig
 
 import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/opsmx/oes-birger/internal/ca"
 	"github.com/opsmx/oes-birger/internal/jwtutil"
+	"github.com/opsmx/oes-birger/internal/tunnel"
 	"github.com/skandragon/jwtregistry"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -434,3 +445,429 @@ func TestGenericEndpoint_unmutateURI_key(t *testing.T) {
 		})
 	}
 }
+
+func TestGenericEndpoint_ExecuteHTTPRequest_maxRequestBodyBytes(t *testing.T) {
+	var received []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int32
+	}{
+		{"under limit", "0123456789", http.StatusOK},
+		{"over limit", "0123456789a", http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = nil
+			ep := GenericEndpoint{
+				config: genericEndpointConfig{URL: upstream.URL, MaxRequestBodyBytes: 10},
+			}
+			ep.makeClient()
+			req := &tunnel.OpenHTTPTunnelRequest{
+				Id:     "id",
+				Type:   "xxx",
+				Method: http.MethodPost,
+				URI:    "/",
+				Body:   []byte(tt.body),
+			}
+			dataflow := make(chan *tunnel.MessageWrapper, 10)
+			ep.ExecuteHTTPRequest("", dataflow, req)
+			resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+			require.NotNil(t, resp)
+			assert.Equal(t, tt.wantStatus, resp.Status)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, tt.body, string(received))
+			} else {
+				assert.Nil(t, received, "request should not reach the upstream")
+			}
+		})
+	}
+}
+
+func TestGenericEndpoint_ExecuteHTTPRequest_maxRequestBodyBytesStreamed(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+	}))
+	defer upstream.Close()
+
+	ep := GenericEndpoint{
+		config: genericEndpointConfig{URL: upstream.URL, MaxRequestBodyBytes: 10},
+	}
+	ep.makeClient()
+	// A streamed body without a Content-Length is counted as it is sent.
+	req := &tunnel.OpenHTTPTunnelRequest{
+		Id:         "streamed-too-large",
+		Type:       "xxx",
+		Method:     http.MethodPost,
+		URI:        "/",
+		StreamBody: true,
+	}
+	tunnel.PrepareRequestBody(req)
+	require.NoError(t, tunnel.WriteUpgradeData(req.Id, []byte("0123456789a")))
+	require.NoError(t, tunnel.WriteUpgradeData(req.Id, []byte{}))
+
+	dataflow := make(chan *tunnel.MessageWrapper, 10)
+	ep.ExecuteHTTPRequest("", dataflow, req)
+	resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+	require.NotNil(t, resp)
+	assert.Equal(t, int32(http.StatusRequestEntityTooLarge), resp.Status)
+}
+
+func TestGenericEndpoint_ExecuteHTTPRequest_bodyTransforms(t *testing.T) {
+	var received []byte
+	var receivedLength int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		receivedLength = r.ContentLength
+	}))
+	defer upstream.Close()
+
+	config := "url: " + upstream.URL + `
+bodyTransforms:
+  - name: jsonDefaults
+    options:
+      metadata.namespace: default
+`
+	ep, configured, err := MakeGenericEndpoint("jenkins", "transform", []byte(config), nil)
+	require.NoError(t, err)
+	require.True(t, configured)
+
+	body := `{"kind":"ConfigMap","metadata":{"name":"x"}}`
+	req := &tunnel.OpenHTTPTunnelRequest{
+		Id:     "id",
+		Type:   "xxx",
+		Method: http.MethodPost,
+		URI:    "/api/v1/configmaps",
+		Headers: []*tunnel.HttpHeader{
+			{Name: "Content-Type", Values: []string{"application/json"}},
+			{Name: "Content-Length", Values: []string{fmt.Sprint(len(body))}},
+		},
+		Body: []byte(body),
+	}
+	dataflow := make(chan *tunnel.MessageWrapper, 10)
+	ep.ExecuteHTTPRequest("", dataflow, req)
+	resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+	require.NotNil(t, resp)
+	assert.Equal(t, int32(http.StatusOK), resp.Status)
+	want := `{"kind":"ConfigMap","metadata":{"name":"x","namespace":"default"}}`
+	assert.Equal(t, want, string(received))
+	assert.Equal(t, int64(len(want)), receivedLength)
+
+	_, _, err = MakeGenericEndpoint("jenkins", "transform", []byte("url: "+upstream.URL+"\nbodyTransforms: [{name: nope}]"), nil)
+	assert.EqualError(t, err, "jenkins/transform: bodyTransforms[0]: unknown transform 'nope'")
+}
+
+func TestGenericEndpoint_ExecuteHTTPRequest_headers(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	ep := GenericEndpoint{
+		config: genericEndpointConfig{
+			URL: upstream.URL,
+			Headers: tunnel.HeaderRules{
+				Remove: []string{"cookie"},
+				Set:    map[string]string{"X-Forwarded-Host": "example.com"},
+				Add:    map[string]string{"Accept": "application/json"},
+			},
+		},
+	}
+	ep.makeClient()
+	req := &tunnel.OpenHTTPTunnelRequest{
+		Id:     "id",
+		Type:   "xxx",
+		Method: http.MethodGet,
+		URI:    "/",
+		Headers: []*tunnel.HttpHeader{
+			{Name: "Cookie", Values: []string{"session=secret"}},
+			{Name: "X-Forwarded-Host", Values: []string{"client.example.com"}},
+			{Name: "Accept", Values: []string{"text/plain"}},
+		},
+	}
+	dataflow := make(chan *tunnel.MessageWrapper, 10)
+	ep.ExecuteHTTPRequest("", dataflow, req)
+	resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+	require.NotNil(t, resp)
+	assert.Equal(t, int32(http.StatusOK), resp.Status)
+	assert.Empty(t, received.Values("Cookie"))
+	assert.Equal(t, []string{"example.com"}, received.Values("X-Forwarded-Host"))
+	assert.Equal(t, []string{"text/plain", "application/json"}, received.Values("Accept"))
+}
+
+func TestGenericEndpoint_ExecuteHTTPRequest_upstreamHeaders(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	tunnel.SetUserAgent("test-agent/1.0")
+	defer tunnel.SetUserAgent(tunnel.DefaultUserAgent)
+
+	tests := []struct {
+		name          string
+		headers       []*tunnel.HttpHeader
+		rules         tunnel.HeaderRules
+		wantUserAgent string
+		wantRequestID string
+	}{
+		{
+			"generated request id",
+			[]*tunnel.HttpHeader{{Name: "User-Agent", Values: []string{"curl/7.0"}}},
+			tunnel.HeaderRules{},
+			"test-agent/1.0",
+			"tunnel-id",
+		},
+		{
+			"client request id",
+			[]*tunnel.HttpHeader{{Name: "X-Request-Id", Values: []string{"client-id"}}},
+			tunnel.HeaderRules{},
+			"test-agent/1.0",
+			"client-id",
+		},
+		{
+			"endpoint user agent",
+			nil,
+			tunnel.HeaderRules{Set: map[string]string{"User-Agent": "endpoint-agent"}},
+			"endpoint-agent",
+			"tunnel-id",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep := GenericEndpoint{
+				config: genericEndpointConfig{URL: upstream.URL, Headers: tt.rules},
+			}
+			ep.makeClient()
+			req := &tunnel.OpenHTTPTunnelRequest{
+				Id:      "tunnel-id",
+				Type:    "xxx",
+				Method:  http.MethodGet,
+				URI:     "/",
+				Headers: tt.headers,
+			}
+			dataflow := make(chan *tunnel.MessageWrapper, 10)
+			ep.ExecuteHTTPRequest("", dataflow, req)
+			resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+			require.NotNil(t, resp)
+			assert.Equal(t, []string{tt.wantUserAgent}, received.Values("User-Agent"))
+			assert.Equal(t, []string{tt.wantRequestID}, received.Values("X-Request-Id"))
+		})
+	}
+}
+
+func TestGenericEndpoint_ExecuteHTTPRequest_credentials(t *testing.T) {
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Values("Authorization")
+	}))
+	defer upstream.Close()
+
+	// The client's own Authorization header is never passed on, even when
+	// the endpoint has no credentials to send in its place.
+	tests := []struct {
+		name        string
+		credentials string
+		want        string
+	}{
+		{"none", "{type: none}", ""},
+		{"no credentials", "{}", ""},
+		{"basic", "{type: basic, username: " + fooString + ", password: " + barString + "}", "Basic Zm9vOmJhcg=="},
+		{"bearer", "{type: bearer, token: " + bazString + "}", "Bearer baz"},
+		{"token", "{type: token, token: " + bazString + "}", "Token baz"},
+		{"bearer trimmed", "{type: bearer, token: IGJheiA=}", "Bearer baz"},
+		{"basic from secret", "{type: basic, secretName: up_}", "Basic Zm9vOmJhcg=="},
+		{"bearer from secret", "{type: bearer, secretName: __t}", "Bearer baz"},
+		{"token from secret", "{type: token, secretName: upt}", "Token baz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = []string{"unset"}
+			config := fmt.Sprintf("url: %s\ncredentials: %s\n", upstream.URL, tt.credentials)
+			ep, configured, err := MakeGenericEndpoint("jenkins", "test", []byte(config), &FakeSecretLoader{})
+			require.NoError(t, err)
+			require.True(t, configured)
+			req := &tunnel.OpenHTTPTunnelRequest{
+				Id:      "id",
+				Type:    "jenkins",
+				Method:  http.MethodGet,
+				URI:     "/",
+				Headers: []*tunnel.HttpHeader{{Name: "Authorization", Values: []string{"Bearer from-client"}}},
+			}
+			dataflow := make(chan *tunnel.MessageWrapper, 10)
+			ep.ExecuteHTTPRequest("", dataflow, req)
+			resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+			require.NotNil(t, resp)
+			if tt.want == "" {
+				assert.Empty(t, received)
+			} else {
+				assert.Equal(t, []string{tt.want}, received)
+			}
+		})
+	}
+}
+
+type mapSecretLoader map[string]*map[string][]byte
+
+func (m mapSecretLoader) GetSecret(name string) (*map[string][]byte, error) {
+	if secret, found := m[name]; found {
+		return secret, nil
+	}
+	return nil, fmt.Errorf("secret key not found")
+}
+
+func decode64(t *testing.T, s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func TestGenericEndpoint_ExecuteHTTPRequest_clientCert(t *testing.T) {
+	caCert, caKey, err := ca.MakeCertificateAuthority()
+	require.NoError(t, err)
+	authority, err := ca.MakeCAFromData(caCert, caKey)
+	require.NoError(t, err)
+	clientCAs, err := authority.MakeCertPool()
+	require.NoError(t, err)
+	_, cert64, key64, err := authority.GenerateCertificate(ca.CertificateName{Name: "client"}, 0)
+	require.NoError(t, err)
+
+	var received *http.Request
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	upstream.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+	serverCAPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	serverCA64 := base64.StdEncoding.EncodeToString(serverCAPEM)
+
+	loader := mapSecretLoader{
+		"client-tls": &map[string][]byte{
+			"tls.crt": decode64(t, cert64),
+			"tls.key": decode64(t, key64),
+			"ca.crt":  serverCAPEM,
+		},
+	}
+
+	tests := []struct {
+		name       string
+		config     string
+		wantStatus int32
+	}{
+		{
+			"inline keypair with token",
+			"tls: {clientCert: " + cert64 + ", clientKey: " + key64 + ", serverCA: " + serverCA64 + "}\n" +
+				"credentials: {type: bearer, token: " + bazString + "}\n",
+			http.StatusOK,
+		},
+		{
+			"keypair from secret",
+			"tls: {secretName: client-tls}\n",
+			http.StatusOK,
+		},
+		{
+			"no client certificate",
+			"tls: {serverCA: " + serverCA64 + "}\n",
+			http.StatusBadGateway,
+		},
+		{
+			"server not trusted",
+			"tls: {clientCert: " + cert64 + ", clientKey: " + key64 + "}\n",
+			http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = nil
+			config := "url: " + upstream.URL + "\n" + tt.config
+			ep, configured, err := MakeGenericEndpoint("jenkins", "test", []byte(config), loader)
+			require.NoError(t, err)
+			require.True(t, configured)
+			req := &tunnel.OpenHTTPTunnelRequest{
+				Id:     "id",
+				Type:   "jenkins",
+				Method: http.MethodGet,
+				URI:    "/",
+			}
+			dataflow := make(chan *tunnel.MessageWrapper, 10)
+			ep.ExecuteHTTPRequest("", dataflow, req)
+			resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+			require.NotNil(t, resp)
+			assert.Equal(t, tt.wantStatus, resp.Status)
+			if tt.wantStatus != http.StatusOK {
+				assert.Nil(t, received)
+				return
+			}
+			require.NotNil(t, received)
+			require.NotEmpty(t, received.TLS.PeerCertificates)
+			assert.Contains(t, received.TLS.PeerCertificates[0].Subject.CommonName, "client")
+			if strings.Contains(tt.config, "bearer") {
+				assert.Equal(t, "Bearer baz", received.Header.Get("Authorization"))
+			}
+		})
+	}
+}
+
+func TestGenericEndpoint_loadTLS_errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config genericEndpointTLS
+	}{
+		{"cert without key", genericEndpointTLS{ClientCert: fooString}},
+		{"key without cert", genericEndpointTLS{ClientKey: fooString}},
+		{"invalid keypair", genericEndpointTLS{ClientCert: fooString, ClientKey: barString}},
+		{"invalid server CA", genericEndpointTLS{ServerCA: fooString}},
+		{"missing secret", genericEndpointTLS{SecretName: "missing"}},
+		{"secret without keypair", genericEndpointTLS{SecretName: "up_"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep := &GenericEndpoint{config: genericEndpointConfig{TLS: tt.config}}
+			assert.Error(t, ep.loadTLS(&FakeSecretLoader{}))
+		})
+	}
+}
+
+func BenchmarkGenericEndpoint_ExecuteHTTPRequest(b *testing.B) {
+	var connections int64
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&connections, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	ep, configured, err := MakeGenericEndpoint("jenkins", "bench", []byte("url: "+upstream.URL), nil)
+	if err != nil || !configured {
+		b.Fatalf("unable to configure endpoint: %v", err)
+	}
+	req := &tunnel.OpenHTTPTunnelRequest{
+		Id:     "bench",
+		Type:   "jenkins",
+		Method: http.MethodGet,
+		URI:    "/",
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dataflow := make(chan *tunnel.MessageWrapper, 10)
+		ep.ExecuteHTTPRequest("", dataflow, req)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&connections))/float64(b.N), "conns/op")
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/opsmx/oes-birger/internal/util"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+type grpcEndpointConfig struct {
+	URL      string             `yaml:"url,omitempty"`
+	Insecure bool               `yaml:"insecure,omitempty"`
+	Chunking tunnel.ChunkConfig `yaml:"chunking,omitempty"`
+	Headers  tunnel.HeaderRules `yaml:"headers,omitempty"`
+
+	PreserveHopByHopHeaders []string `yaml:"preserveHopByHopHeaders,omitempty"`
+	AllowResponseHeaders    []string `yaml:"allowResponseHeaders,omitempty"`
+	MaxResponseHeaderBytes  int64    `yaml:"maxResponseHeaderBytes,omitempty"`
+
+	Transport transportConfig `yaml:"transport,omitempty"`
+
+	tunnel.ResponseBodyLimit `yaml:",inline"`
+}
+
+// GRPCEndpoint forwards gRPC calls to a service over HTTP/2.  The request
+// body is streamed from the client as it arrives, and the response, including
+// the trailers which hold the call's status, is streamed back.  An "http"
+// URL uses HTTP/2 without TLS, as most in-cluster gRPC services expect.
+type GRPCEndpoint struct {
+	endpointName string
+	config       grpcEndpointConfig
+	client       *http.Client
+	responses    tunnel.ResponseOptions
+}
+
+// MakeGRPCEndpoint returns an endpoint which forwards gRPC calls to the
+// configured URL.
+func MakeGRPCEndpoint(name string, configBytes []byte) (*GRPCEndpoint, bool, error) {
+	var config grpcEndpointConfig
+	err := yaml.Unmarshal(configBytes, &config)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if config.URL == "" {
+		zap.S().Errorf("url not set for grpc/%s", name)
+		return nil, false, nil
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, false, fmt.Errorf("grpc/%s: invalid url: %v", name, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, false, fmt.Errorf("grpc/%s: url scheme must be http or https, not '%s'", name, u.Scheme)
+	}
+
+	if err := config.Transport.validateHTTP2(); err != nil {
+		return nil, false, fmt.Errorf("grpc/%s: transport: %v", name, err)
+	}
+
+	ep := &GRPCEndpoint{
+		endpointName: name,
+		config:       config,
+		client: config.Transport.makeHTTP2Client(util.ApplyTLSSettings(&tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: config.Insecure,
+		}), u.Scheme == "http"),
+		responses: tunnel.ResponseOptions{
+			Chunking:        config.Chunking,
+			PreserveHeaders: config.PreserveHopByHopHeaders,
+			AllowedHeaders:  config.AllowResponseHeaders,
+			MaxHeaderBytes:  config.MaxResponseHeaderBytes,
+			BodyLimit:       config.ResponseBodyLimit,
+		},
+	}
+	return ep, true, nil
+}
+
+// ExecuteHTTPRequest forwards a gRPC call, and will send the response back
+// over the tunnel.
+func (ep *GRPCEndpoint) ExecuteHTTPRequest(_ string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	defer tunnel.ReleaseRequestBody(req)
+
+	ctx, cancel := tunnel.RequestContext(req)
+	defer cancel()
+	cancelRegistration := tunnel.RegisterCancelFunction(req.Id, cancel)
+	defer tunnel.UnregisterCancelFunction(cancelRegistration)
+
+	httpRequest, err := http.NewRequestWithContext(ctx, req.Method, ep.config.URL+req.URI, tunnel.RequestBody(req, dataflow))
+	if err != nil {
+		zap.S().Warnw("failed to build request", "endpointName", ep.endpointName, "error", err)
+		dataflow <- tunnel.MakeBadGatewayResponse(req.Id)
+		return
+	}
+	httpRequest.ContentLength = tunnel.RequestContentLength(req)
+
+	err = tunnel.CopyHeaders(req.Headers, &httpRequest.Header)
+	if err != nil {
+		zap.S().Warnw("failed to copy headers", "endpointName", ep.endpointName, "error", err)
+		dataflow <- tunnel.MakeBadGatewayResponse(req.Id)
+		return
+	}
+	tunnel.SetUpstreamHeaders(req, httpRequest.Header)
+	ep.config.Headers.Apply(httpRequest.Header)
+
+	tunnel.RunHTTPRequest(ep.client, req, httpRequest, dataflow, ep.config.URL, ep.responses)
+}
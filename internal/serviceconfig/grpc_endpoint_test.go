@@ -0,0 +1,194 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestMakeGRPCEndpoint(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         string
+		wantConfigured bool
+		wantErr        bool
+	}{
+		{"no url", "{}", false, false},
+		{"bad scheme", "url: ftp://example.com", false, true},
+		{"bad url", "url: 'http://[::1'", false, true},
+		{"plaintext", "url: http://echo.default.svc:9000", true, false},
+		{"tls", "url: https://echo.default.svc:9000", true, false},
+		{"transport", "{url: https://echo.default.svc:9000, transport: {tlsSessionCacheSize: 8, tcpKeepAlive: 45s}}", true, false},
+		{"socks5 proxy", "{url: http://echo.default.svc:9000, transport: {proxy: 'socks5://proxy.example.com:1080'}}", true, false},
+		{"http proxy", "{url: http://echo.default.svc:9000, transport: {proxy: 'http://proxy.example.com:3128'}}", false, true},
+		{"bad transport", "{url: http://echo.default.svc:9000, transport: {tlsRenegotiation: sometimes}}", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep, configured, err := MakeGRPCEndpoint("echo", []byte(tt.config))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantConfigured, configured)
+			if configured {
+				assert.NotNil(t, ep.client)
+			}
+		})
+	}
+}
+
+// rawCodec passes messages as plain bytes, so the echo service needs no
+// generated code.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) { return *(v.(*[]byte)), nil }
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*(v.(*[]byte)) = append([]byte{}, data...)
+	return nil
+}
+
+func (rawCodec) Name() string { return "raw" }
+
+var echoServiceDesc = grpc.ServiceDesc{
+	ServiceName: "test.Echo",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Echo", Handler: echoHandler, ServerStreams: true, ClientStreams: true},
+		{StreamName: "Fail", Handler: failHandler, ServerStreams: true, ClientStreams: true},
+	},
+}
+
+// echoHandler sends back each message, and a trailer with the count.
+func echoHandler(_ interface{}, stream grpc.ServerStream) error {
+	count := 0
+	defer func() {
+		stream.SetTrailer(metadata.Pairs("echo-count", strconv.Itoa(count)))
+	}()
+	for {
+		var msg []byte
+		err := stream.RecvMsg(&msg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		count++
+		if err := stream.SendMsg(&msg); err != nil {
+			return err
+		}
+	}
+}
+
+// failHandler fails before sending anything, which gRPC sends as a
+// trailers-only response.
+func failHandler(_ interface{}, _ grpc.ServerStream) error {
+	return status.Error(codes.PermissionDenied, "not allowed")
+}
+
+func TestRunAPIHandler_grpc(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	upstream := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}))
+	upstream.RegisterService(&echoServiceDesc, nil)
+	go func() { _ = upstream.Serve(lis) }()
+	defer upstream.Stop()
+
+	echo, configured, err := MakeGRPCEndpoint("echo", []byte("url: http://"+lis.Addr().String()))
+	require.NoError(t, err)
+	require.True(t, configured)
+
+	routes := tunnelroute.MakeRoutes()
+	route := &tunnelroute.DirectlyConnectedRoute{
+		Name:            "grpc-agent",
+		Session:         "session",
+		Endpoints:       []tunnelroute.Endpoint{{Type: "grpc", Name: "echo", Configured: true}},
+		InRequest:       make(chan interface{}),
+		InCancelRequest: make(chan string),
+	}
+	routes.Add(route)
+	defer routes.Remove(route, tunnelroute.DisconnectClean)
+	go runFakeAgent(route, echo)
+
+	service := IncomingServiceConfig{Destination: "grpc-agent", ServiceType: "grpc", DestinationService: "echo"}
+	handler := fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler)
+	proxy := httptest.NewServer(h2c.NewHandler(allowConnect(mux, handler), &http2.Server{}))
+	defer proxy.Close()
+
+	conn, err := grpc.Dial(strings.TrimPrefix(proxy.URL, "http://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+
+	t.Run("echo", func(t *testing.T) {
+		stream, err := conn.NewStream(ctx, desc, "/test.Echo/Echo")
+		require.NoError(t, err)
+		// Each reply is read before the next message is sent, which only
+		// works if both directions are streamed.
+		for _, msg := range []string{"one", "two"} {
+			out := []byte(msg)
+			require.NoError(t, stream.SendMsg(&out))
+			var in []byte
+			require.NoError(t, stream.RecvMsg(&in))
+			assert.Equal(t, msg, string(in))
+		}
+		require.NoError(t, stream.CloseSend())
+		var in []byte
+		require.Equal(t, io.EOF, stream.RecvMsg(&in))
+		assert.Equal(t, []string{"2"}, stream.Trailer().Get("echo-count"))
+	})
+
+	t.Run("trailers-only error", func(t *testing.T) {
+		stream, err := conn.NewStream(ctx, desc, "/test.Echo/Fail")
+		require.NoError(t, err)
+		require.NoError(t, stream.CloseSend())
+		var in []byte
+		err = stream.RecvMsg(&in)
+		require.Error(t, err)
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+		assert.Equal(t, "not allowed", status.Convert(err).Message())
+	})
+}
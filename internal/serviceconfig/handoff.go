@@ -0,0 +1,65 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	"github.com/opsmx/oes-birger/internal/util"
+	"go.uber.org/zap"
+)
+
+// redirectToPeer redirects a request made while the controller is handing
+// off to a peer to the same port on the peer's service hostname.  CONNECT
+// requests cannot be redirected, so they fail and the client should retry.
+func redirectToPeer(w http.ResponseWriter, r *http.Request, peer tunnelroute.Peer) {
+	if r.Method == http.MethodConnect || peer.ServiceHostname == "" {
+		w.Header().Set("Retry-After", "1")
+		util.FailRequest(w, fmt.Errorf("controller is draining"), http.StatusServiceUnavailable)
+		return
+	}
+	target := peerURL(r, peer)
+	zap.S().Debugw("redirecting to peer", "url", r.URL, "peer", target)
+	http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+}
+
+// peerURL returns the request's URL, with the host changed to the peer's
+// service hostname.  The port is the one the request was received on.
+func peerURL(r *http.Request, peer tunnelroute.Peer) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := peer.ServiceHostname
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			host = net.JoinHostPort(host, port)
+		}
+	}
+	target := url.URL{
+		Scheme:   scheme,
+		Host:     host,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
+	}
+	return target.String()
+}
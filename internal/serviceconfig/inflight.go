@@ -0,0 +1,44 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	endpointInflightGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "endpoint_inflight_requests",
+		Help: "The number of requests in progress, by agent and endpoint",
+	}, []string{"agent", "endpoint"})
+)
+
+// trackInFlight counts a request to an agent's endpoint as in flight, and
+// returns a function to call when it completes, whether it succeeded,
+// failed, was cancelled, or panicked.  Only the first call of the returned
+// function has any effect, so the count cannot be decremented twice.
+func trackInFlight(agent string, endpoint string) func() {
+	gauge := endpointInflightGauge.WithLabelValues(agent, endpoint)
+	gauge.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(gauge.Dec)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func inFlight(agent string, endpoint string) float64 {
+	return testutil.ToFloat64(endpointInflightGauge.WithLabelValues(agent, endpoint))
+}
+
+func TestTrackInFlight(t *testing.T) {
+	done := trackInFlight("track-agent", "ci")
+	other := trackInFlight("track-agent", "ci")
+	assert.Equal(t, 2.0, inFlight("track-agent", "ci"))
+
+	done()
+	done()
+	assert.Equal(t, 1.0, inFlight("track-agent", "ci"), "done must only decrement once")
+
+	func() {
+		defer func() { _ = recover() }()
+		defer other()
+		panic("boom")
+	}()
+	other()
+	assert.Equal(t, 0.0, inFlight("track-agent", "ci"))
+}
+
+func TestRunAPIHandler_inFlight(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+			_, _ = w.Write([]byte("done"))
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	cancelled := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer hanging.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	routes := tunnelroute.MakeRoutes()
+	route := &tunnelroute.DirectlyConnectedRoute{
+		Name:    "inflight-agent",
+		Session: "session",
+		Endpoints: []tunnelroute.Endpoint{
+			{Type: "jenkins", Name: "slow", Configured: true},
+			{Type: "jenkins", Name: "hanging", Configured: true},
+			{Type: "jenkins", Name: "down", Configured: true},
+		},
+		InRequest:       make(chan interface{}),
+		InCancelRequest: make(chan string),
+	}
+	routes.Add(route)
+	defer routes.Remove(route, tunnelroute.DisconnectClean)
+	endpoints := map[string]string{"slow": upstream.URL, "hanging": hanging.URL, "down": closed.URL}
+	go runFakeAgent(route, &endpointsByName{t: t, urls: endpoints})
+
+	proxyFor := func(endpoint string) *httptest.Server {
+		service := IncomingServiceConfig{Destination: "inflight-agent", ServiceType: "jenkins", DestinationService: endpoint}
+		return httptest.NewServer(http.HandlerFunc(fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})))
+	}
+	settled := func(endpoint string) {
+		assert.Eventually(t, func() bool { return inFlight("inflight-agent", endpoint) == 0 }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		proxy := proxyFor("slow")
+		defer proxy.Close()
+		result := make(chan int, 1)
+		go func() {
+			resp, err := http.Get(proxy.URL + "/job")
+			if err != nil {
+				result <- 0
+				return
+			}
+			resp.Body.Close()
+			result <- resp.StatusCode
+		}()
+		require.Eventually(t, func() bool { return inFlight("inflight-agent", "slow") == 1 }, 5*time.Second, 10*time.Millisecond)
+		close(release)
+		assert.Equal(t, http.StatusOK, <-result)
+		settled("slow")
+	})
+
+	t.Run("error", func(t *testing.T) {
+		proxy := proxyFor("down")
+		defer proxy.Close()
+		resp, err := http.Get(proxy.URL + "/job")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		settled("down")
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		proxy := proxyFor("hanging")
+		defer proxy.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, proxy.URL+"/job", nil)
+		require.NoError(t, err)
+		go func() {
+			resp, err := http.DefaultClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		require.Eventually(t, func() bool { return inFlight("inflight-agent", "hanging") == 1 }, 5*time.Second, 10*time.Millisecond)
+		cancel()
+		settled("hanging")
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Error("upstream request was not cancelled")
+		}
+	})
+
+	t.Run("not sent", func(t *testing.T) {
+		proxy := proxyFor("missing")
+		defer proxy.Close()
+		resp, err := http.Get(proxy.URL + "/job")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		settled("missing")
+	})
+}
+
+// endpointsByName sends each request to a generic endpoint for the URL
+// configured for its name.
+type endpointsByName struct {
+	t    *testing.T
+	urls map[string]string
+}
+
+func (e *endpointsByName) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	ep, _, err := MakeGenericEndpoint("jenkins", req.Name, []byte("url: "+e.urls[req.Name]), nil)
+	if !assert.NoError(e.t, err) {
+		return
+	}
+	ep.ExecuteHTTPRequest(agentName, dataflow, req)
+}
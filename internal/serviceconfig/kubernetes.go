@@ -22,6 +22,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -30,13 +31,46 @@ import (
 
 	"github.com/opsmx/oes-birger/internal/kubeconfig"
 	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/opsmx/oes-birger/internal/util"
 	"go.uber.org/zap"
-	"golang.org/x/net/context"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// serverContextRefreshInterval is how often the kubeconfig is reloaded.
+	serverContextRefreshInterval = 600 * time.Second
+
+	// defaultContextHeader is the request header which selects one of the
+	// selectable contexts, unless another is configured.
+	defaultContextHeader = "X-Kube-Context"
+)
+
+// kubernetesConfig holds the endpoint's configuration.  Context selects
+// the kubeconfig context to use, in place of its current-context.  A
+// request may instead select one of SelectableContexts by naming it in
+// the ContextHeader header.
 type kubernetesConfig struct {
-	KubeConfig string `yaml:"kubeConfig,omitempty"`
+	KubeConfig string             `yaml:"kubeConfig,omitempty"`
+	Context    string             `yaml:"context,omitempty"`
+	Chunking   tunnel.ChunkConfig `yaml:"chunking,omitempty"`
+	Headers    tunnel.HeaderRules `yaml:"headers,omitempty"`
+	Transport  transportConfig    `yaml:"transport,omitempty"`
+
+	SelectableContexts []string `yaml:"selectableContexts,omitempty"`
+	ContextHeader      string   `yaml:"contextHeader,omitempty"`
+
+	MaxRequestBodyBytes     int64    `yaml:"maxRequestBodyBytes,omitempty"`
+	PreserveHopByHopHeaders []string `yaml:"preserveHopByHopHeaders,omitempty"`
+	AllowResponseHeaders    []string `yaml:"allowResponseHeaders,omitempty"`
+	MaxResponseHeaderBytes  int64    `yaml:"maxResponseHeaderBytes,omitempty"`
+	PinnedServerCertSHA256  string   `yaml:"pinnedServerCertSHA256,omitempty"`
+
+	BodyTransforms []tunnel.BodyTransformConfig `yaml:"bodyTransforms,omitempty"`
+	StatusMap      tunnel.StatusMap             `yaml:"statusMap,omitempty"`
+
+	tunnel.ResponseBodyLimit `yaml:",inline"`
 }
 
 // KubernetesEndpoint implements a kubernetes endpoint state, including the credentials and namespaces
@@ -45,6 +79,22 @@ type KubernetesEndpoint struct {
 	sync.RWMutex
 	f      kubeContext
 	config kubernetesConfig
+	pin    []byte
+
+	// contexts are the selectable contexts, by name, each with its own
+	// client.
+	contexts map[string]*kubeContext
+
+	// saToken is the service account token, once one has been loaded.
+	saToken *tokenFile
+
+	bodyTransforms tunnel.BodyTransforms
+	responses      tunnel.ResponseOptions
+
+	// stop is closed by Close, and stopped once the refresh has ended.
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
 }
 
 type kubeContext struct {
@@ -53,12 +103,19 @@ type kubeContext struct {
 	serverCA   *x509.Certificate
 	clientCert *tls.Certificate
 	token      string
+	tokenFile  *tokenFile
 	insecure   bool
+
+	// client is built from the fields above, and replaced with them.
+	client *http.Client
 }
 
 // MakeKubernetesEndpoint creates a new Kubernetes endpoint based on the provided config.
 func MakeKubernetesEndpoint(name string, configBytes []byte) (*KubernetesEndpoint, bool, error) {
-	k := &KubernetesEndpoint{}
+	k := &KubernetesEndpoint{
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
 
 	var config kubernetesConfig
 	err := yaml.Unmarshal(configBytes, &config)
@@ -69,15 +126,76 @@ func MakeKubernetesEndpoint(name string, configBytes []byte) (*KubernetesEndpoin
 	if config.KubeConfig == "" {
 		config.KubeConfig = "/app/config/kubeconfig.yaml"
 	}
+	if config.ContextHeader == "" {
+		config.ContextHeader = defaultContextHeader
+	}
+
+	k.pin, err = parseCertificatePin(config.PinnedServerCertSHA256)
+	if err != nil {
+		return nil, false, fmt.Errorf("kubernetes/%s: pinnedServerCertSHA256: %v", name, err)
+	}
+
+	k.bodyTransforms, err = tunnel.MakeBodyTransforms(config.BodyTransforms)
+	if err != nil {
+		return nil, false, fmt.Errorf("kubernetes/%s: bodyTransforms%v", name, err)
+	}
+
+	if err := config.Transport.validate(); err != nil {
+		return nil, false, fmt.Errorf("kubernetes/%s: transport: %v", name, err)
+	}
+
+	if err := config.StatusMap.Validate(); err != nil {
+		return nil, false, fmt.Errorf("kubernetes/%s: statusMap%v", name, err)
+	}
 
 	k.config = config
-	k.f = *k.loadKubernetesSecurity()
+	k.responses = tunnel.ResponseOptions{
+		Chunking:        config.Chunking,
+		PreserveHeaders: config.PreserveHopByHopHeaders,
+		AllowedHeaders:  config.AllowResponseHeaders,
+		MaxHeaderBytes:  config.MaxResponseHeaderBytes,
+		BodyLimit:       config.ResponseBodyLimit,
+		StatusMap:       config.StatusMap,
+	}
+	f, err := k.loadKubernetesSecurity()
+	if err != nil {
+		return nil, false, fmt.Errorf("kubernetes/%s: %v", name, err)
+	}
+	k.f = *f
+	k.f.client = k.makeClient(&k.f)
 
-	go k.updateServerContextTicker()
+	contexts, err := k.loadSelectableContexts()
+	if err != nil {
+		return nil, false, fmt.Errorf("kubernetes/%s: selectableContexts: %v", name, err)
+	}
+	k.updateSelectableContexts(contexts)
+
+	go k.updateServerContextTicker(serverContextRefreshInterval)
 
 	return k, true, nil
 }
 
+// Close stops reloading the security context, waiting until it has
+// stopped, and closes idle connections.  Requests in progress are not
+// affected.  It is safe to call more than once.
+func (ke *KubernetesEndpoint) Close() error {
+	ke.closeOnce.Do(func() {
+		if ke.stop != nil {
+			close(ke.stop)
+			<-ke.stopped
+		}
+		if client := ke.makeServerContextFields().client; client != nil {
+			client.CloseIdleConnections()
+		}
+		ke.RLock()
+		for _, c := range ke.contexts {
+			c.client.CloseIdleConnections()
+		}
+		ke.RUnlock()
+	})
+	return nil
+}
+
 func (ke *KubernetesEndpoint) makeServerContextFields() *kubeContext {
 	ke.RLock()
 	defer ke.RUnlock()
@@ -87,61 +205,112 @@ func (ke *KubernetesEndpoint) makeServerContextFields() *kubeContext {
 		serverCA:   ke.f.serverCA,
 		clientCert: ke.f.clientCert,
 		token:      ke.f.token,
+		tokenFile:  ke.f.tokenFile,
 		insecure:   ke.f.insecure,
+		client:     ke.f.client,
 	}
 }
 
-func (ke *KubernetesEndpoint) serverContextFromKubeconfig(kconfig *kubeconfig.KubeConfig) *kubeContext {
-	names := kconfig.GetContextNames()
-	for _, name := range names {
-		if name != kconfig.CurrentContext {
-			continue
-		}
-		user, cluster, err := kconfig.FindContext(name)
-		if err != nil {
-			zap.S().Fatalf("Unable to retrieve cluster and user info for context %s: %v", name, err)
-		}
+// bearerToken returns the token to send, re-read from its file if it
+// came from one.
+func (c *kubeContext) bearerToken() string {
+	if c.tokenFile != nil {
+		return c.tokenFile.Token()
+	}
+	return c.token
+}
 
-		certData, err := base64.StdEncoding.DecodeString(user.User.ClientCertificateData)
-		if err != nil {
-			zap.S().Fatalf("Error decoding user cert from base64 (%s): %v", user.Name, err)
-		}
-		keyData, err := base64.StdEncoding.DecodeString(user.User.ClientKeyData)
-		if err != nil {
-			zap.S().Fatalf("Error decoding user key from base64 (%s): %v", user.Name, err)
-		}
+func (ke *KubernetesEndpoint) makeClient(c *kubeContext) *http.Client {
+	// TODO: A ServerCA is technically optional, but we might want to fail if it's not present...
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.insecure,
+	}
+	util.ApplyTLSSettings(tlsConfig)
+	if c.serverCA != nil {
+		caCertPool := x509.NewCertPool()
+		caCertPool.AddCert(c.serverCA)
+		tlsConfig.RootCAs = caCertPool
+		//tlsConfig.BuildNameToCertificate()
+	}
+	if c.clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*c.clientCert}
+	}
+	if ke.pin != nil {
+		tlsConfig.VerifyPeerCertificate = verifyPinnedCertificate(ke.pin)
+	}
+	return ke.config.Transport.makeClient(tlsConfig)
+}
 
-		clientKeypair, err := tls.X509KeyPair(certData, keyData)
-		if err != nil {
-			zap.S().Fatalf("Error loading client cert/key: %v", err)
-		}
+// serverContextFromKubeconfig returns the security context for the
+// configured context, or the kubeconfig's current-context if none is set.
+func (ke *KubernetesEndpoint) serverContextFromKubeconfig(kconfig *kubeconfig.KubeConfig) (*kubeContext, error) {
+	name := ke.config.Context
+	if name == "" {
+		name = kconfig.CurrentContext
+	}
+	if name == "" {
+		return nil, fmt.Errorf("kubeconfig has no current-context, and no context is configured")
+	}
+	return serverContextNamed(kconfig, name)
+}
 
-		saf := &kubeContext{
-			username:   user.Name,
-			clientCert: &clientKeypair,
-			serverURL:  cluster.Cluster.Server,
-			insecure:   cluster.Cluster.InsecureSkipTLSVerify,
+// serverContextNamed returns the security context for the named context.
+func serverContextNamed(kconfig *kubeconfig.KubeConfig, name string) (*kubeContext, error) {
+	found := false
+	for _, contextName := range kconfig.GetContextNames() {
+		if contextName == name {
+			found = true
+			break
 		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %s not found in kubeconfig", name)
+	}
 
-		if len(cluster.Cluster.CertificateAuthorityData) > 0 {
-			serverCA, err := base64.StdEncoding.DecodeString(cluster.Cluster.CertificateAuthorityData)
-			if err != nil {
-				zap.S().Fatalf("Error decoding server CA cert from base64 (%s): %v", cluster.Name, err)
-			}
-			pemBlock, _ := pem.Decode(serverCA)
-			serverCert, err := x509.ParseCertificate(pemBlock.Bytes)
-			if err != nil {
-				zap.S().Fatalf("Error parsing server certificate: %v", err)
-			}
-			saf.serverCA = serverCert
-		}
+	user, cluster, err := kconfig.FindContext(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve cluster and user info for context %s: %v", name, err)
+	}
 
-		return saf
+	certData, err := base64.StdEncoding.DecodeString(user.User.ClientCertificateData)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding user cert from base64 (%s): %v", user.Name, err)
+	}
+	keyData, err := base64.StdEncoding.DecodeString(user.User.ClientKeyData)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding user key from base64 (%s): %v", user.Name, err)
 	}
 
-	zap.S().Fatalf("Default context not found in kubeconfig")
+	clientKeypair, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return nil, fmt.Errorf("error loading client cert/key: %v", err)
+	}
 
-	return nil
+	saf := &kubeContext{
+		username:   user.Name,
+		clientCert: &clientKeypair,
+		serverURL:  cluster.Cluster.Server,
+		insecure:   cluster.Cluster.InsecureSkipTLSVerify,
+	}
+
+	if len(cluster.Cluster.CertificateAuthorityData) > 0 {
+		serverCA, err := base64.StdEncoding.DecodeString(cluster.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding server CA cert from base64 (%s): %v", cluster.Name, err)
+		}
+		pemBlock, _ := pem.Decode(serverCA)
+		if pemBlock == nil {
+			return nil, fmt.Errorf("server CA cert for %s is not PEM encoded", cluster.Name)
+		}
+		serverCert, err := x509.ParseCertificate(pemBlock.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing server certificate: %v", err)
+		}
+		saf.serverCA = serverCert
+	}
+
+	return saf, nil
 }
 
 func tlsCertEqual(s1 *tls.Certificate, s2 *tls.Certificate) bool {
@@ -165,7 +334,7 @@ func x509CertEqual(s1 *x509.Certificate, s2 *x509.Certificate) bool {
 }
 
 func (scf *kubeContext) isSameAs(scf2 *kubeContext) bool {
-	if scf.username != scf2.username || scf.serverURL != scf2.serverURL || scf.token != scf2.token || scf.insecure != scf2.insecure {
+	if scf.username != scf2.username || scf.serverURL != scf2.serverURL || scf.token != scf2.token || scf.tokenFile != scf2.tokenFile || scf.insecure != scf2.insecure {
 		return false
 	}
 
@@ -176,10 +345,16 @@ func (scf *kubeContext) isSameAs(scf2 *kubeContext) bool {
 	return tlsCertEqual(scf.clientCert, scf2.clientCert)
 }
 
+// loadServiceAccount returns the security context for the pod's service
+// account.  Its token is re-read as it rotates, rather than only when the
+// context is reloaded.
 func (ke *KubernetesEndpoint) loadServiceAccount() (*kubeContext, error) {
-	token, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/token")
-	if err != nil {
-		return nil, err
+	if ke.saToken == nil {
+		token, err := newTokenFile(serviceAccountTokenPath)
+		if err != nil {
+			return nil, err
+		}
+		ke.saToken = token
 	}
 
 	serverCA, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/ca.crt")
@@ -205,7 +380,7 @@ func (ke *KubernetesEndpoint) loadServiceAccount() (*kubeContext, error) {
 		username:  "ServiceAccount",
 		serverURL: "https://" + serviceHost + ":" + servicePort,
 		serverCA:  serverCert,
-		token:     string(token),
+		tokenFile: ke.saToken,
 		insecure:  true,
 	}, nil
 }
@@ -213,43 +388,34 @@ func (ke *KubernetesEndpoint) loadServiceAccount() (*kubeContext, error) {
 // ExecuteHTTPRequest does the actual call to connect to HTTP, and will send the data back over the
 // tunnel.
 func (ke *KubernetesEndpoint) ExecuteHTTPRequest(_ string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
-	c := ke.makeServerContextFields()
-
-	// TODO: A ServerCA is technically optional, but we might want to fail if it's not present...
-	zap.S().Debugw("running request", "request", "req")
-	tlsConfig := &tls.Config{
-		MinVersion:         tls.VersionTLS12,
-		InsecureSkipVerify: c.insecure,
-	}
-	if c.serverCA != nil {
-		caCertPool := x509.NewCertPool()
-		caCertPool.AddCert(c.serverCA)
-		tlsConfig.RootCAs = caCertPool
-		//tlsConfig.BuildNameToCertificate()
-	}
-	if c.clientCert != nil {
-		tlsConfig.Certificates = []tls.Certificate{*c.clientCert}
-	}
-	tr := &http.Transport{
-		MaxIdleConns:       10,
-		IdleConnTimeout:    30 * time.Second,
-		DisableCompression: true,
-		TLSClientConfig:    tlsConfig,
+	defer tunnel.ReleaseRequestBody(req)
+	if tunnel.RequestBodyTooLarge(req, ke.config.MaxRequestBodyBytes) {
+		zap.S().Warnw("request body too large", "method", req.Method, "uri", req.URI, "size", tunnel.RequestContentLength(req), "limit", ke.config.MaxRequestBodyBytes)
+		dataflow <- tunnel.MakeRequestEntityTooLargeResponse(req.Id)
+		return
 	}
-	client := &http.Client{
-		Transport: tr,
+
+	c, err := ke.selectContext(req)
+	if err != nil {
+		zap.S().Warnw("unable to select Kubernetes context", "method", req.Method, "uri", req.URI, "error", err)
+		dataflow <- tunnel.MakeBadRequestResponse(req.Id)
+		return
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	tunnel.RegisterCancelFunction(req.Id, cancel)
-	defer tunnel.UnregisterCancelFunction(req.Id)
+	zap.S().Debugw("running request", "request", "req")
+
+	ctx, cancel := tunnel.RequestContext(req)
+	defer cancel()
+	cancelRegistration := tunnel.RegisterCancelFunction(req.Id, cancel)
+	defer tunnel.UnregisterCancelFunction(cancelRegistration)
 
-	httpRequest, err := http.NewRequestWithContext(ctx, req.Method, c.serverURL+req.URI, bytes.NewBuffer(req.Body))
+	httpRequest, err := http.NewRequestWithContext(ctx, req.Method, c.serverURL+req.URI, tunnel.LimitRequestBody(tunnel.RequestBody(req, dataflow), ke.config.MaxRequestBodyBytes))
 	if err != nil {
 		zap.S().Warnf("Failed to build request for %s to %s: %v", req.Method, c.serverURL+req.URI, err)
 		dataflow <- tunnel.MakeBadGatewayResponse(req.Id)
 		return
 	}
+	httpRequest.ContentLength = tunnel.RequestContentLength(req)
 
 	err = tunnel.CopyHeaders(req.Headers, &httpRequest.Header)
 	if err != nil {
@@ -257,38 +423,151 @@ func (ke *KubernetesEndpoint) ExecuteHTTPRequest(_ string, dataflow chan *tunnel
 		dataflow <- tunnel.MakeBadGatewayResponse(req.Id)
 		return
 	}
-	if len(c.token) > 0 {
-		httpRequest.Header.Set("Authorization", "Bearer "+c.token)
+	if len(ke.config.SelectableContexts) > 0 {
+		httpRequest.Header.Del(ke.config.ContextHeader)
+	}
+	tunnel.SetUpstreamHeaders(req, httpRequest.Header)
+	ke.config.Headers.Apply(httpRequest.Header)
+
+	if err := ke.bodyTransforms.Apply(httpRequest, tunnel.BufferedBodyLimit(ke.config.MaxRequestBodyBytes)); err != nil {
+		zap.S().Warnw("failed to transform request body", "method", req.Method, "uri", req.URI, "error", err)
+		if errors.Is(err, tunnel.ErrRequestBodyTooLarge) {
+			dataflow <- tunnel.MakeRequestEntityTooLargeResponse(req.Id)
+			return
+		}
+		dataflow <- tunnel.MakeBadGatewayResponse(req.Id)
+		return
+	}
+	if token := c.bearerToken(); len(token) > 0 {
+		httpRequest.Header.Set("Authorization", "Bearer "+token)
 	}
 
-	tunnel.RunHTTPRequest(client, req, httpRequest, dataflow, c.serverURL)
+	tunnel.RunHTTPRequest(c.client, req, httpRequest, dataflow, c.serverURL, ke.responses)
 }
 
-func (ke *KubernetesEndpoint) loadKubernetesSecurity() *kubeContext {
+func (ke *KubernetesEndpoint) loadKubernetesSecurity() (*kubeContext, error) {
 	yamlString, err := os.Open(ke.config.KubeConfig)
 	if err == nil {
+		defer yamlString.Close()
 		kconfig, err := kubeconfig.ReadKubeConfig(yamlString)
 		if err != nil {
-			zap.S().Fatalf("Unable to read kubeconfig: %v", err)
+			return nil, fmt.Errorf("unable to read kubeconfig: %v", err)
 		}
 		return ke.serverContextFromKubeconfig(kconfig)
 	}
 	sa, err := ke.loadServiceAccount()
 	if err != nil {
-		zap.S().Fatalf("No kubeconfig and no Kubernetes account found: %v", err)
+		return nil, fmt.Errorf("no kubeconfig and no Kubernetes account found: %v", err)
+	}
+	return sa, nil
+}
+
+// updateServerContext replaces the security context, and the client built
+// from it, if it has changed.  It returns true if a change was made.
+func (ke *KubernetesEndpoint) updateServerContext(saf *kubeContext) bool {
+	ke.Lock()
+	defer ke.Unlock()
+	if ke.f.isSameAs(saf) {
+		return false
 	}
-	return sa
+	zap.L().Info("Updating security context for API calls to Kubernetes")
+	if old := ke.f.client; old != nil {
+		old.CloseIdleConnections()
+	}
+	saf.client = ke.makeClient(saf)
+	ke.f = *saf
+	return true
 }
 
-func (ke *KubernetesEndpoint) updateServerContextTicker() {
+// updateServerContextTicker reloads the security context every interval
+// until the endpoint is closed.  If it cannot be loaded, the previous one
+// is kept.
+func (ke *KubernetesEndpoint) updateServerContextTicker(interval time.Duration) {
+	defer close(ke.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		saf := ke.loadKubernetesSecurity()
-		ke.Lock()
-		if !ke.f.isSameAs(saf) {
-			zap.L().Info("Updating security context for API calls to Kubernetes")
-			ke.f = *saf
+		select {
+		case <-ke.stop:
+			return
+		case <-ticker.C:
+		}
+		saf, err := ke.loadKubernetesSecurity()
+		if err != nil {
+			zap.S().Warnw("unable to reload Kubernetes credentials, keeping the previous ones", "kubeConfig", ke.config.KubeConfig, "error", err)
+			continue
+		}
+		ke.updateServerContext(saf)
+		contexts, err := ke.loadSelectableContexts()
+		if err != nil {
+			zap.S().Warnw("unable to reload selectable Kubernetes contexts, keeping the previous ones", "kubeConfig", ke.config.KubeConfig, "error", err)
+			continue
+		}
+		ke.updateSelectableContexts(contexts)
+	}
+}
+
+// selectContext returns the security context the request names in the
+// context header, or the endpoint's own if it names none or no contexts
+// are selectable.  A name which is not one of the selectable contexts is
+// an error.
+func (ke *KubernetesEndpoint) selectContext(req *tunnel.OpenHTTPTunnelRequest) (*kubeContext, error) {
+	if len(ke.config.SelectableContexts) == 0 {
+		return ke.makeServerContextFields(), nil
+	}
+	name := req.GetHeaderValue(ke.config.ContextHeader)
+	if name == "" {
+		return ke.makeServerContextFields(), nil
+	}
+	ke.RLock()
+	defer ke.RUnlock()
+	c, found := ke.contexts[name]
+	if !found {
+		return nil, fmt.Errorf("context %q is not selectable", name)
+	}
+	return c, nil
+}
+
+// loadSelectableContexts returns the security context for each selectable
+// context, all of which must be in the kubeconfig.
+func (ke *KubernetesEndpoint) loadSelectableContexts() (map[string]*kubeContext, error) {
+	if len(ke.config.SelectableContexts) == 0 {
+		return nil, nil
+	}
+	f, err := os.Open(ke.config.KubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	kconfig, err := kubeconfig.ReadKubeConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read kubeconfig: %v", err)
+	}
+	contexts := map[string]*kubeContext{}
+	for _, name := range ke.config.SelectableContexts {
+		c, err := serverContextNamed(kconfig, name)
+		if err != nil {
+			return nil, err
+		}
+		contexts[name] = c
+	}
+	return contexts, nil
+}
+
+// updateSelectableContexts replaces the selectable contexts, keeping the
+// client of each which has not changed.
+func (ke *KubernetesEndpoint) updateSelectableContexts(contexts map[string]*kubeContext) {
+	ke.Lock()
+	defer ke.Unlock()
+	for name, c := range contexts {
+		if old, found := ke.contexts[name]; found {
+			if old.isSameAs(c) {
+				contexts[name] = old
+				continue
+			}
+			old.client.CloseIdleConnections()
 		}
-		ke.Unlock()
-		time.Sleep(time.Second * 600)
+		c.client = ke.makeClient(c)
 	}
+	ke.contexts = contexts
 }
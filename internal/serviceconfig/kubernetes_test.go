@@ -17,9 +17,27 @@
 package serviceconfig
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
 )
 
 var (
@@ -72,3 +90,340 @@ func TestKubernetesx509CertCompare(t *testing.T) {
 		})
 	}
 }
+
+func TestKubernetesEndpoint_updateServerContext(t *testing.T) {
+	ke := &KubernetesEndpoint{}
+	ke.f = kubeContext{username: "user", serverURL: "https://example.com", token: "token1"}
+	ke.f.client = ke.makeClient(&ke.f)
+	original := ke.makeServerContextFields().client
+
+	unchanged := &kubeContext{username: "user", serverURL: "https://example.com", token: "token1"}
+	if ke.updateServerContext(unchanged) {
+		t.Errorf("unchanged context reported as updated")
+	}
+	if got := ke.makeServerContextFields().client; got != original {
+		t.Errorf("client rebuilt for unchanged context")
+	}
+
+	changed := &kubeContext{username: "user", serverURL: "https://example.com", token: "token2", clientCert: &goodTLS}
+	if !ke.updateServerContext(changed) {
+		t.Errorf("changed context not reported as updated")
+	}
+	c := ke.makeServerContextFields()
+	if c.client == nil || c.client == original {
+		t.Errorf("client not rebuilt for changed context")
+	}
+	if c.token != "token2" {
+		t.Errorf("token not updated: got %s", c.token)
+	}
+}
+
+func TestParseCertificatePin(t *testing.T) {
+	fingerprint := strings.Repeat("ab", sha256.Size)
+	tests := []struct {
+		name        string
+		fingerprint string
+		wantPin     bool
+		wantErr     bool
+	}{
+		{"empty", "", false, false},
+		{"hex", fingerprint, true, false},
+		{"colons", strings.TrimSuffix(strings.Repeat("AB:", sha256.Size), ":"), true, false},
+		{"not hex", "xyz", false, true},
+		{"too short", "abcd", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pin, err := parseCertificatePin(tt.fingerprint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCertificatePin() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (pin != nil) != tt.wantPin {
+				t.Errorf("parseCertificatePin() = %v, wantPin %v", pin, tt.wantPin)
+			}
+		})
+	}
+}
+
+func TestKubernetesEndpoint_makeClient_pinned(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	fingerprint := sha256.Sum256(server.Certificate().Raw)
+	matching := hex.EncodeToString(fingerprint[:])
+	mismatching := strings.Repeat("00", sha256.Size)
+
+	tests := []struct {
+		name     string
+		pin      string
+		insecure bool
+		serverCA *x509.Certificate
+		wantErr  bool
+	}{
+		{"matching pin replaces CA verification", matching, true, nil, false},
+		{"mismatching pin with insecure", mismatching, true, nil, true},
+		{"matching pin with CA", matching, false, server.Certificate(), false},
+		{"mismatching pin with CA", mismatching, false, server.Certificate(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pin, err := parseCertificatePin(tt.pin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ke := &KubernetesEndpoint{pin: pin}
+			c := &kubeContext{serverURL: server.URL, insecure: tt.insecure, serverCA: tt.serverCA}
+			client := ke.makeClient(c)
+
+			resp, err := client.Get(server.URL)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "does not match the pinned fingerprint") {
+				t.Errorf("Get() error = %v, want a pin mismatch", err)
+			}
+		})
+	}
+}
+
+// writeKubeconfig writes a kubeconfig with production and staging contexts,
+// and the given current-context, returning its path.
+func writeKubeconfig(t *testing.T, currentContext string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "user"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certData := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
+	keyData := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+
+	contents := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: %s
+clusters:
+  - name: production
+    cluster:
+      server: https://production.example.com
+  - name: staging
+    cluster:
+      server: https://staging.example.com
+contexts:
+  - name: production
+    context:
+      cluster: production
+      user: user
+  - name: staging
+    context:
+      cluster: staging
+      user: user
+users:
+  - name: user
+    user:
+      client-certificate-data: %s
+      client-key-data: %s
+`, currentContext, certData, keyData)
+	path := filepath.Join(t.TempDir(), "kubeconfig.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMakeKubernetesEndpoint_context(t *testing.T) {
+	tests := []struct {
+		name           string
+		currentContext string
+		context        string
+		wantServer     string
+		wantErr        string
+	}{
+		{"current context", "production", "", "https://production.example.com", ""},
+		{"explicit context", "production", "staging", "https://staging.example.com", ""},
+		{"explicit context without current context", "", "staging", "https://staging.example.com", ""},
+		{"no current context", "", "", "", "kubeconfig has no current-context, and no context is configured"},
+		{"missing current context", "development", "", "", "context development not found in kubeconfig"},
+		{"missing explicit context", "production", "development", "", "context development not found in kubeconfig"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeKubeconfig(t, tt.currentContext)
+			config := fmt.Sprintf("kubeConfig: %s\ncontext: %q\n", path, tt.context)
+			ke, configured, err := MakeKubernetesEndpoint("k8s", []byte(config))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, wanted %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !configured {
+				t.Errorf("endpoint not configured")
+			}
+			if got := ke.makeServerContextFields().serverURL; got != tt.wantServer {
+				t.Errorf("got server %s, wanted %s", got, tt.wantServer)
+			}
+		})
+	}
+}
+
+func TestMakeKubernetesEndpoint_selectableContexts(t *testing.T) {
+	path := writeKubeconfig(t, "production")
+	ke, _, err := MakeKubernetesEndpoint("k8s", []byte(fmt.Sprintf("kubeConfig: %s\nselectableContexts: [production, staging]\n", path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ke.Close()
+	for name, want := range map[string]string{"production": "https://production.example.com", "staging": "https://staging.example.com"} {
+		c, found := ke.contexts[name]
+		if !found {
+			t.Fatalf("context %s not loaded", name)
+		}
+		if c.serverURL != want || c.client == nil {
+			t.Errorf("context %s: got server %s, client %v", name, c.serverURL, c.client)
+		}
+	}
+
+	_, _, err = MakeKubernetesEndpoint("k8s", []byte(fmt.Sprintf("kubeConfig: %s\nselectableContexts: [staging, development]\n", path)))
+	if err == nil || !strings.Contains(err.Error(), "selectableContexts: context development not found in kubeconfig") {
+		t.Errorf("got error %v, wanted missing selectable context", err)
+	}
+}
+
+func TestKubernetesEndpoint_ExecuteHTTPRequest_contextHeader(t *testing.T) {
+	cluster := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Cluster", name)
+			w.Header().Set("X-Saw-Context-Header", r.Header.Get(defaultContextHeader))
+		}))
+	}
+	production, staging := cluster("production"), cluster("staging")
+	defer production.Close()
+	defer staging.Close()
+
+	ke := &KubernetesEndpoint{config: kubernetesConfig{
+		SelectableContexts: []string{"production", "staging"},
+		ContextHeader:      defaultContextHeader,
+	}}
+	ke.f = kubeContext{serverURL: production.URL, token: "default"}
+	ke.f.client = ke.makeClient(&ke.f)
+	ke.updateSelectableContexts(map[string]*kubeContext{
+		"production": {serverURL: production.URL, token: "production"},
+		"staging":    {serverURL: staging.URL, token: "staging"},
+	})
+
+	tests := []struct {
+		name        string
+		context     string
+		wantStatus  int32
+		wantCluster string
+	}{
+		{"no header", "", http.StatusOK, "production"},
+		{"production", "production", http.StatusOK, "production"},
+		{"staging", "staging", http.StatusOK, "staging"},
+		{"not selectable", "development", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &tunnel.OpenHTTPTunnelRequest{Id: "id", Method: http.MethodGet, URI: "/api/v1/namespaces"}
+			if tt.context != "" {
+				req.Headers = []*tunnel.HttpHeader{{Name: defaultContextHeader, Values: []string{tt.context}}}
+			}
+			dataflow := make(chan *tunnel.MessageWrapper, 10)
+			ke.ExecuteHTTPRequest("", dataflow, req)
+			resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+			if resp == nil {
+				t.Fatal("no response")
+			}
+			if resp.Status != tt.wantStatus {
+				t.Fatalf("got status %d, wanted %d", resp.Status, tt.wantStatus)
+			}
+			headers := http.Header{}
+			for _, h := range resp.Headers {
+				headers[h.Name] = h.Values
+			}
+			if got := headers.Get("X-Cluster"); got != tt.wantCluster {
+				t.Errorf("got cluster %q, wanted %q", got, tt.wantCluster)
+			}
+			if got := headers.Get("X-Saw-Context-Header"); got != "" {
+				t.Errorf("context header was sent to the cluster: %q", got)
+			}
+		})
+	}
+}
+
+func TestKubernetesEndpoint_Close(t *testing.T) {
+	path := writeKubeconfig(t, "production")
+	ke, _, err := MakeKubernetesEndpoint("k8s", []byte(fmt.Sprintf("kubeConfig: %s\n", path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ke.stopped:
+		t.Fatal("refresh stopped before Close")
+	default:
+	}
+
+	if err := ke.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ke.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("refresh did not stop after Close")
+	}
+
+	// Closing again does nothing.
+	if err := ke.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseEndpoints(t *testing.T) {
+	path := writeKubeconfig(t, "production")
+	endpoints := ConfigureEndpoints(mapSecretLoader{}, &ServiceConfig{
+		OutgoingServices: []OutgoingServiceConfig{
+			{
+				Enabled: true,
+				Name:    "k8s",
+				Type:    "kubernetes",
+				Config:  map[interface{}]interface{}{"kubeConfig": path},
+				Namespaces: []serviceNamespace{
+					{Name: "prod", Namespaces: []string{"default"}},
+					{Name: "staging", Namespaces: []string{"staging"}},
+				},
+				CoalesceGETs: true,
+			},
+		},
+	})
+	if len(endpoints) != 2 {
+		t.Fatalf("got %d endpoints, wanted 2", len(endpoints))
+	}
+	ke, ok := endpoints[0].closer.(*KubernetesEndpoint)
+	if !ok {
+		t.Fatalf("endpoint closer is %T, wanted *KubernetesEndpoint", endpoints[0].closer)
+	}
+
+	CloseEndpoints(endpoints)
+	select {
+	case <-ke.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("refresh did not stop after CloseEndpoints")
+	}
+}
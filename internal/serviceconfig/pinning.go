@@ -0,0 +1,59 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// parseCertificatePin decodes a SHA-256 fingerprint written as hex, with or
+// without colons between the bytes.  An empty string means no pin.
+func parseCertificatePin(fingerprint string) ([]byte, error) {
+	if fingerprint == "" {
+		return nil, nil
+	}
+	pin, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SHA-256 fingerprint: %v", err)
+	}
+	if len(pin) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 fingerprint: %d bytes, not %d", len(pin), sha256.Size)
+	}
+	return pin, nil
+}
+
+// verifyPinnedCertificate returns a tls.Config.VerifyPeerCertificate function
+// which rejects the connection unless the server's leaf certificate has the
+// pinned fingerprint.  This is called even when InsecureSkipVerify is set, so
+// the pin can replace CA verification.
+func verifyPinnedCertificate(pin []byte) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("server presented no certificate")
+		}
+		fingerprint := sha256.Sum256(rawCerts[0])
+		if !bytes.Equal(fingerprint[:], pin) {
+			return fmt.Errorf("server certificate fingerprint %s does not match the pinned fingerprint", hex.EncodeToString(fingerprint[:]))
+		}
+		return nil
+	}
+}
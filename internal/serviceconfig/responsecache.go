@@ -0,0 +1,360 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultCacheMaxEntries   = 1000
+	defaultCacheMaxBodyBytes = 1024 * 1024
+)
+
+// Results counted by the response cache.
+const (
+	cacheHit         = "hit"
+	cacheMiss        = "miss"
+	cacheRevalidated = "revalidated"
+	cacheBypass      = "bypass"
+)
+
+var cacheRequestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "endpoint_cache_requests_total",
+	Help: "The total number of GET requests seen by an endpoint's response cache, by result",
+}, []string{"endpointType", "endpointName", "result"})
+
+// ResponseCacheConfig configures the agent's cache of an outgoing
+// service's GET responses.  Responses are kept for TTL, or for less if
+// their Cache-Control max-age says so.  A TTL of zero disables the cache.
+// MaxEntries and MaxBodyBytes, which bound the memory used, default to
+// 1000 responses of up to 1 MiB each.
+type ResponseCacheConfig struct {
+	TTL          time.Duration `yaml:"ttl,omitempty"`
+	MaxEntries   int           `yaml:"maxEntries,omitempty"`
+	MaxBodyBytes int64         `yaml:"maxBodyBytes,omitempty"`
+}
+
+// responseCache wraps an endpoint's request processor, answering GET
+// requests from responses it has already seen.  Requests share a cached
+// response only if they would be coalesced, so requests with different
+// credentials or for different users never do.  Once stale, a response
+// with an ETag or Last-Modified header is revalidated with the service
+// rather than fetched again.
+type responseCache struct {
+	sync.Mutex
+	next         httpRequestProcessor
+	endpointType string
+	endpointName string
+	ttl          time.Duration
+	maxEntries   int
+	maxBodyBytes int64
+	now          func() time.Time
+
+	entries map[string]*cacheEntry
+}
+
+// cacheEntry is a complete response, as the messages it was sent in.
+type cacheEntry struct {
+	messages     []*tunnel.MessageWrapper
+	expires      time.Time
+	etag         string
+	lastModified string
+}
+
+func newResponseCache(endpointType string, endpointName string, config ResponseCacheConfig, next httpRequestProcessor) *responseCache {
+	c := &responseCache{
+		next:         next,
+		endpointType: endpointType,
+		endpointName: endpointName,
+		ttl:          config.TTL,
+		maxEntries:   config.MaxEntries,
+		maxBodyBytes: config.MaxBodyBytes,
+		now:          time.Now,
+		entries:      map[string]*cacheEntry{},
+	}
+	if c.maxEntries <= 0 {
+		c.maxEntries = defaultCacheMaxEntries
+	}
+	if c.maxBodyBytes <= 0 {
+		c.maxBodyBytes = defaultCacheMaxBodyBytes
+	}
+	return c
+}
+
+func (c *responseCache) unwrap() httpRequestProcessor {
+	return c.next
+}
+
+// isCacheable returns true if the response to the request may be taken
+// from the cache.  Requests the client made conditional, or asked not to
+// be answered from a cache, go to the service.
+func isCacheable(req *tunnel.OpenHTTPTunnelRequest) bool {
+	if !isCoalescable(req) {
+		return false
+	}
+	if req.GetHeaderValue("If-None-Match") != "" || req.GetHeaderValue("If-Modified-Since") != "" {
+		return false
+	}
+	cacheControl := parseCacheControl(req.GetHeaderValue("Cache-Control"))
+	_, noCache := cacheControl["no-cache"]
+	_, noStore := cacheControl["no-store"]
+	return !noCache && !noStore && !strings.Contains(strings.ToLower(req.GetHeaderValue("Pragma")), "no-cache")
+}
+
+// parseCacheControl returns the Cache-Control directives, lower cased,
+// with their values, if any.
+func parseCacheControl(value string) map[string]string {
+	directives := map[string]string{}
+	for _, directive := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+func headerValue(headers []*tunnel.HttpHeader, name string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) && len(header.Values) > 0 {
+			return header.Values[0]
+		}
+	}
+	return ""
+}
+
+// ExecuteHTTPRequest answers the request from the cache if it can, and
+// otherwise runs it through the wrapped endpoint, caching the response.
+func (c *responseCache) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	if !isCacheable(req) {
+		c.count(cacheBypass)
+		c.next.ExecuteHTTPRequest(agentName, dataflow, req)
+		return
+	}
+
+	key := coalesceKey(req)
+	entry := c.lookup(key)
+	if entry != nil && c.now().Before(entry.expires) {
+		c.count(cacheHit)
+		c.replay(dataflow, entry, req.Id)
+		return
+	}
+	if entry != nil && (entry.etag != "" || entry.lastModified != "") {
+		c.revalidate(agentName, dataflow, req, key, entry)
+		return
+	}
+	c.count(cacheMiss)
+	c.fetch(agentName, dataflow, req, key)
+}
+
+func (c *responseCache) count(result string) {
+	cacheRequestsCounter.WithLabelValues(c.endpointType, c.endpointName, result).Inc()
+}
+
+func (c *responseCache) lookup(key string) *cacheEntry {
+	c.Lock()
+	defer c.Unlock()
+	return c.entries[key]
+}
+
+func (c *responseCache) replay(dataflow chan *tunnel.MessageWrapper, entry *cacheEntry, id string) {
+	for _, msg := range entry.messages {
+		dataflow <- withRequestID(msg, id)
+	}
+}
+
+// fetch runs the request, sending the response on as it arrives, and
+// caches it once complete if it may be.
+func (c *responseCache) fetch(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest, key string) {
+	messages := c.record(agentName, dataflow, req, nil)
+	c.store(key, messages)
+}
+
+// revalidate asks the service whether the stale entry is still current.
+// If it is, the entry is refreshed and sent; otherwise the new response
+// is sent and cached in its place.
+func (c *responseCache) revalidate(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest, key string, entry *cacheEntry) {
+	conditional := proto.Clone(req).(*tunnel.OpenHTTPTunnelRequest)
+	if entry.etag != "" {
+		conditional.Headers = append(conditional.Headers, &tunnel.HttpHeader{Name: "If-None-Match", Values: []string{entry.etag}})
+	}
+	if entry.lastModified != "" {
+		conditional.Headers = append(conditional.Headers, &tunnel.HttpHeader{Name: "If-Modified-Since", Values: []string{entry.lastModified}})
+	}
+
+	notModified := false
+	messages := c.record(agentName, dataflow, conditional, func(resp *tunnel.HttpTunnelResponse) bool {
+		notModified = resp.Status == http.StatusNotModified
+		return !notModified
+	})
+	if !notModified {
+		c.count(cacheMiss)
+		c.store(key, messages)
+		return
+	}
+	c.count(cacheRevalidated)
+	refreshed := *entry
+	refreshed.expires = c.now().Add(c.freshness(messages[0].GetHttpTunnelControl().GetHttpTunnelResponse().Headers))
+	c.Lock()
+	if c.entries[key] == entry {
+		c.entries[key] = &refreshed
+	}
+	c.Unlock()
+	c.replay(dataflow, &refreshed, req.Id)
+}
+
+// record runs the request, returning the messages of its response.  They
+// are sent on to dataflow as they arrive, unless forward returns false
+// when given the response headers.  Once the body is larger than can be
+// cached, the rest of it is not kept, and only the response headers are
+// returned.
+func (c *responseCache) record(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest, forward func(*tunnel.HttpTunnelResponse) bool) []*tunnel.MessageWrapper {
+	intercept := make(chan *tunnel.MessageWrapper)
+	recorded := make(chan []*tunnel.MessageWrapper)
+	go func() {
+		messages := []*tunnel.MessageWrapper{}
+		send := true
+		discard := false
+		var size int64
+		for msg := range intercept {
+			if resp := msg.GetHttpTunnelControl().GetHttpTunnelResponse(); resp != nil && len(messages) == 0 && forward != nil {
+				send = forward(resp)
+			}
+			if chunk := msg.GetHttpTunnelControl().GetHttpTunnelChunkedResponse(); chunk != nil && !discard {
+				size += int64(len(chunk.Body))
+				if size > c.maxBodyBytes {
+					discard = true
+					if len(messages) > 1 {
+						messages = messages[:1]
+					}
+				}
+			}
+			if !discard {
+				messages = append(messages, msg)
+			}
+			if send {
+				dataflow <- msg
+			}
+		}
+		recorded <- messages
+	}()
+	c.next.ExecuteHTTPRequest(agentName, intercept, req)
+	close(intercept)
+	return <-recorded
+}
+
+// freshness is how long a response with the headers may be used without
+// revalidating it: the configured TTL, or its max-age if shorter.
+func (c *responseCache) freshness(headers []*tunnel.HttpHeader) time.Duration {
+	ttl := c.ttl
+	cacheControl := parseCacheControl(headerValue(headers, "Cache-Control"))
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, found := cacheControl[directive]; found {
+			if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+				if maxAge := time.Duration(seconds) * time.Second; maxAge < ttl {
+					ttl = maxAge
+				}
+				break
+			}
+		}
+	}
+	if _, found := cacheControl["no-cache"]; found {
+		ttl = 0
+	}
+	return ttl
+}
+
+// store caches a complete 200 response which the service allows to be
+// kept by a shared cache.  A response which must always be revalidated
+// is only kept if it can be.
+func (c *responseCache) store(key string, messages []*tunnel.MessageWrapper) {
+	if len(messages) < 2 {
+		return
+	}
+	resp := messages[0].GetHttpTunnelControl().GetHttpTunnelResponse()
+	if resp == nil || resp.Status != http.StatusOK {
+		return
+	}
+	last := messages[len(messages)-1].GetHttpTunnelControl().GetHttpTunnelChunkedResponse()
+	if last == nil || len(last.Body) != 0 {
+		return // incomplete, such as a cancelled request
+	}
+	var size int64
+	for _, msg := range messages[1:] {
+		chunk := msg.GetHttpTunnelControl().GetHttpTunnelChunkedResponse()
+		if chunk == nil {
+			return
+		}
+		size += int64(len(chunk.Body))
+	}
+	if size > c.maxBodyBytes {
+		return
+	}
+	cacheControl := parseCacheControl(headerValue(resp.Headers, "Cache-Control"))
+	for _, directive := range []string{"no-store", "private"} {
+		if _, found := cacheControl[directive]; found {
+			c.remove(key)
+			return
+		}
+	}
+	entry := &cacheEntry{
+		messages:     messages,
+		expires:      c.now().Add(c.freshness(resp.Headers)),
+		etag:         headerValue(resp.Headers, "ETag"),
+		lastModified: headerValue(resp.Headers, "Last-Modified"),
+	}
+	if !c.now().Before(entry.expires) && entry.etag == "" && entry.lastModified == "" {
+		c.remove(key)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if _, found := c.entries[key]; !found && len(c.entries) >= c.maxEntries {
+		c.evict()
+	}
+	c.entries[key] = entry
+}
+
+func (c *responseCache) remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, key)
+}
+
+// evict removes the entry which expires first, and must be called with
+// the lock held.
+func (c *responseCache) evict() {
+	var oldestKey string
+	var oldest *cacheEntry
+	for key, entry := range c.entries {
+		if oldest == nil || entry.expires.Before(oldest.expires) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	delete(c.entries, oldestKey)
+}
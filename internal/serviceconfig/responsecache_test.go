@@ -0,0 +1,284 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cachedUpstream serves a versioned document, answering conditional
+// requests for the current version with a 304.
+type cachedUpstream struct {
+	sync.Mutex
+	version      int
+	cacheControl string
+	requests     []http.Header
+}
+
+func (u *cachedUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.Lock()
+	defer u.Unlock()
+	u.requests = append(u.requests, r.Header.Clone())
+	etag := fmt.Sprintf(`"v%d"`, u.version)
+	w.Header().Set("ETag", etag)
+	if u.cacheControl != "" {
+		w.Header().Set("Cache-Control", u.cacheControl)
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	_, _ = fmt.Fprintf(w, "version %d", u.version)
+}
+
+func (u *cachedUpstream) calls() []http.Header {
+	u.Lock()
+	defer u.Unlock()
+	return u.requests
+}
+
+func (u *cachedUpstream) setVersion(version int) {
+	u.Lock()
+	defer u.Unlock()
+	u.version = version
+}
+
+func makeTestCache(t *testing.T, upstream *cachedUpstream, config ResponseCacheConfig) (*responseCache, *fakeClock) {
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+	generic, configured, err := MakeGenericEndpoint("jenkins", "ci", []byte("url: "+server.URL), nil)
+	require.NoError(t, err)
+	require.True(t, configured)
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	c := newResponseCache("jenkins", "ci", config, generic)
+	c.now = clock.now
+	return c, clock
+}
+
+func cacheRequest(id string, method string, headers ...string) *tunnel.OpenHTTPTunnelRequest {
+	req := &tunnel.OpenHTTPTunnelRequest{
+		Id:     id,
+		Type:   "jenkins",
+		Name:   "ci",
+		Method: method,
+		URI:    "/configmap",
+		Headers: []*tunnel.HttpHeader{
+			{Name: tunnel.RequestIDHeader, Values: []string{"request-" + id}},
+		},
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Headers = append(req.Headers, &tunnel.HttpHeader{Name: headers[i], Values: []string{headers[i+1]}})
+	}
+	return req
+}
+
+// doCached runs the request through the cache, returning the status and
+// body sent for it.
+func doCached(t *testing.T, c *responseCache, req *tunnel.OpenHTTPTunnelRequest) (int32, string) {
+	dataflow := make(chan *tunnel.MessageWrapper, 100)
+	c.ExecuteHTTPRequest("agent", dataflow, req)
+	close(dataflow)
+	var status int32
+	body := ""
+	for msg := range dataflow {
+		switch control := msg.GetHttpTunnelControl().GetControlType().(type) {
+		case *tunnel.HttpTunnelControl_HttpTunnelResponse:
+			assert.Equal(t, req.Id, control.HttpTunnelResponse.Id)
+			status = control.HttpTunnelResponse.Status
+		case *tunnel.HttpTunnelControl_HttpTunnelChunkedResponse:
+			assert.Equal(t, req.Id, control.HttpTunnelChunkedResponse.Id)
+			body += string(control.HttpTunnelChunkedResponse.Body)
+		}
+	}
+	return status, body
+}
+
+func TestResponseCache_reusedWithinTTL(t *testing.T) {
+	upstream := &cachedUpstream{version: 1}
+	c, clock := makeTestCache(t, upstream, ResponseCacheConfig{TTL: time.Minute})
+
+	for i, id := range []string{"a", "b", "c"} {
+		status, body := doCached(t, c, cacheRequest(id, http.MethodGet, "Authorization", "Bearer alice"))
+		assert.Equal(t, int32(http.StatusOK), status, i)
+		assert.Equal(t, "version 1", body, i)
+		clock.t = clock.t.Add(20 * time.Second)
+	}
+	assert.Len(t, upstream.calls(), 1)
+}
+
+func TestResponseCache_revalidatedAfterExpiry(t *testing.T) {
+	upstream := &cachedUpstream{version: 1}
+	c, clock := makeTestCache(t, upstream, ResponseCacheConfig{TTL: time.Minute})
+
+	status, body := doCached(t, c, cacheRequest("a", http.MethodGet))
+	assert.Equal(t, int32(http.StatusOK), status)
+	assert.Equal(t, "version 1", body)
+
+	// Still current: the service answers 304, and the client gets the
+	// cached response.
+	clock.t = clock.t.Add(2 * time.Minute)
+	status, body = doCached(t, c, cacheRequest("b", http.MethodGet))
+	assert.Equal(t, int32(http.StatusOK), status)
+	assert.Equal(t, "version 1", body)
+	calls := upstream.calls()
+	require.Len(t, calls, 2)
+	assert.Equal(t, `"v1"`, calls[1].Get("If-None-Match"))
+
+	// Revalidating refreshed the entry.
+	status, body = doCached(t, c, cacheRequest("c", http.MethodGet))
+	assert.Equal(t, int32(http.StatusOK), status)
+	assert.Equal(t, "version 1", body)
+	assert.Len(t, upstream.calls(), 2)
+
+	// Changed: the new version is sent and cached.
+	upstream.setVersion(2)
+	clock.t = clock.t.Add(2 * time.Minute)
+	status, body = doCached(t, c, cacheRequest("d", http.MethodGet))
+	assert.Equal(t, int32(http.StatusOK), status)
+	assert.Equal(t, "version 2", body)
+	status, body = doCached(t, c, cacheRequest("e", http.MethodGet))
+	assert.Equal(t, int32(http.StatusOK), status)
+	assert.Equal(t, "version 2", body)
+	assert.Len(t, upstream.calls(), 3)
+}
+
+func TestResponseCache_bypassed(t *testing.T) {
+	tests := []struct {
+		name      string
+		first     *tunnel.OpenHTTPTunnelRequest
+		second    *tunnel.OpenHTTPTunnelRequest
+		wantCalls int
+	}{
+		{
+			"different authorization",
+			cacheRequest("a", http.MethodGet, "Authorization", "Bearer alice"),
+			cacheRequest("b", http.MethodGet, "Authorization", "Bearer bob"),
+			2,
+		},
+		{
+			"different tenant",
+			cacheRequest("a", http.MethodGet, "X-Tenant", "alice"),
+			cacheRequest("b", http.MethodGet, "X-Tenant", "bob"),
+			2,
+		},
+		{
+			"not GET",
+			cacheRequest("a", http.MethodPost),
+			cacheRequest("b", http.MethodPost),
+			2,
+		},
+		{
+			"client asks for no-cache",
+			cacheRequest("a", http.MethodGet),
+			cacheRequest("b", http.MethodGet, "Cache-Control", "no-cache"),
+			2,
+		},
+		{
+			"client sends its own conditional",
+			cacheRequest("a", http.MethodGet),
+			cacheRequest("b", http.MethodGet, "If-None-Match", `"v0"`),
+			2,
+		},
+		{
+			"same request",
+			cacheRequest("a", http.MethodGet, "Authorization", "Bearer alice"),
+			cacheRequest("b", http.MethodGet, "Authorization", "Bearer alice"),
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &cachedUpstream{version: 1}
+			c, _ := makeTestCache(t, upstream, ResponseCacheConfig{TTL: time.Minute})
+			doCached(t, c, tt.first)
+			doCached(t, c, tt.second)
+			assert.Len(t, upstream.calls(), tt.wantCalls)
+		})
+	}
+}
+
+func TestResponseCache_cacheControl(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		advance      time.Duration
+		wantCalls    int
+	}{
+		{"max-age shorter than TTL", "max-age=10", 20 * time.Second, 2},
+		{"max-age longer than TTL", "max-age=3600", 2 * time.Minute, 2},
+		{"within max-age", "max-age=30", 20 * time.Second, 1},
+		{"no-store", "no-store", 0, 2},
+		{"private", "private, max-age=30", 0, 2},
+		{"no-cache is always revalidated", "no-cache", 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &cachedUpstream{version: 1, cacheControl: tt.cacheControl}
+			c, clock := makeTestCache(t, upstream, ResponseCacheConfig{TTL: time.Minute})
+			doCached(t, c, cacheRequest("a", http.MethodGet))
+			clock.t = clock.t.Add(tt.advance)
+			status, body := doCached(t, c, cacheRequest("b", http.MethodGet))
+			assert.Equal(t, int32(http.StatusOK), status)
+			assert.Equal(t, "version 1", body)
+			assert.Len(t, upstream.calls(), tt.wantCalls)
+		})
+	}
+}
+
+func TestResponseCache_limits(t *testing.T) {
+	upstream := &cachedUpstream{version: 1}
+	c, clock := makeTestCache(t, upstream, ResponseCacheConfig{TTL: time.Minute, MaxEntries: 2})
+	for _, user := range []string{"alice", "bob", "carol"} {
+		doCached(t, c, cacheRequest("a", http.MethodGet, "X-Tenant", user))
+		clock.t = clock.t.Add(time.Second)
+	}
+	c.Lock()
+	assert.Len(t, c.entries, 2)
+	c.Unlock()
+	// alice's response expired first, so was evicted.
+	doCached(t, c, cacheRequest("b", http.MethodGet, "X-Tenant", "carol"))
+	assert.Len(t, upstream.calls(), 3)
+	doCached(t, c, cacheRequest("c", http.MethodGet, "X-Tenant", "alice"))
+	assert.Len(t, upstream.calls(), 4)
+
+	small, _ := makeTestCache(t, upstream, ResponseCacheConfig{TTL: time.Minute, MaxBodyBytes: 4})
+	doCached(t, small, cacheRequest("a", http.MethodGet))
+	doCached(t, small, cacheRequest("b", http.MethodGet))
+	assert.Len(t, upstream.calls(), 6)
+}
+
+func TestResponseCache_recordDiscardsLargeBody(t *testing.T) {
+	upstream := &cachedUpstream{version: 1}
+	c, _ := makeTestCache(t, upstream, ResponseCacheConfig{TTL: time.Minute, MaxBodyBytes: 4})
+
+	dataflow := make(chan *tunnel.MessageWrapper, 100)
+	messages := c.record("agent", dataflow, cacheRequest("a", http.MethodGet), nil)
+	close(dataflow)
+	// The whole response is still sent, but only its headers are kept.
+	assert.Greater(t, len(dataflow), 1)
+	require.Len(t, messages, 1)
+	assert.NotNil(t, messages[0].GetHttpTunnelControl().GetHttpTunnelResponse())
+}
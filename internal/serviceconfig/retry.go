@@ -0,0 +1,343 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tevino/abool"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRetryBudgetRatio        = 0.1
+	defaultRetryBudgetMinPerSecond = 1
+	defaultRetryBudgetMax          = 10
+	defaultRetryDNSDelay           = 200 * time.Millisecond
+)
+
+var (
+	retryBudgetGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "endpoint_retry_budget_tokens",
+		Help: "The number of retries an endpoint's retry budget currently allows",
+	}, []string{"endpointType", "endpointName"})
+
+	retriesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "endpoint_retries_total",
+		Help: "The total number of retries of failed requests, by whether the retry budget allowed them",
+	}, []string{"endpointType", "endpointName", "result"})
+)
+
+// RetryConfig configures retries of requests to an outgoing service which
+// fail with a 502 or 503, such as when the connection is refused.  Only GET,
+// HEAD, and OPTIONS requests whose body is not streamed are retried, up to
+// Attempts more times.  Zero attempts disables retries.
+//
+// Retries are limited by a budget shared by all requests to the endpoint, so
+// a service which is down is not sent several times its usual load.  Each
+// request adds BudgetRatio (default 0.1) of a retry to the budget, and
+// BudgetMinPerSecond (default 1) are added each second so quiet endpoints can
+// still retry.  The budget holds at most BudgetMax (default 10) retries.
+//
+// A request which failed because the upstream's hostname did not resolve is
+// retried up to DNSAttempts more times instead, each after DNSDelay (default
+// 200ms), as resolution failures are often brief.  These retries are also
+// limited by the budget, and a request cancelled during the delay is not
+// retried.  With no DNSAttempts, such a failure is retried as
+// any other 502.
+type RetryConfig struct {
+	Attempts           int           `yaml:"attempts,omitempty"`
+	BudgetRatio        float64       `yaml:"budgetRatio,omitempty"`
+	BudgetMinPerSecond float64       `yaml:"budgetMinPerSecond,omitempty"`
+	BudgetMax          float64       `yaml:"budgetMax,omitempty"`
+	DNSAttempts        int           `yaml:"dnsAttempts,omitempty"`
+	DNSDelay           time.Duration `yaml:"dnsDelay,omitempty"`
+}
+
+// enabled returns true if any failures are retried.
+func (c RetryConfig) enabled() bool {
+	return c.Attempts > 0 || c.DNSAttempts > 0
+}
+
+// retryBudget is a token bucket, where a token is one retry.
+type retryBudget struct {
+	sync.Mutex
+	endpointType string
+	endpointName string
+	ratio        float64
+	perSecond    float64
+	max          float64
+	now          func() time.Time
+
+	tokens float64
+	last   time.Time
+}
+
+func newRetryBudget(endpointType string, endpointName string, config RetryConfig) *retryBudget {
+	b := &retryBudget{
+		endpointType: endpointType,
+		endpointName: endpointName,
+		ratio:        config.BudgetRatio,
+		perSecond:    config.BudgetMinPerSecond,
+		max:          config.BudgetMax,
+		now:          time.Now,
+	}
+	if b.ratio <= 0 {
+		b.ratio = defaultRetryBudgetRatio
+	}
+	if b.perSecond <= 0 {
+		b.perSecond = defaultRetryBudgetMinPerSecond
+	}
+	if b.max <= 0 {
+		b.max = defaultRetryBudgetMax
+	}
+	b.last = b.now()
+	b.add(b.max)
+	return b
+}
+
+// add must be called with the lock held.
+func (b *retryBudget) add(n float64) {
+	b.tokens += n
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+	retryBudgetGauge.WithLabelValues(b.endpointType, b.endpointName).Set(b.tokens)
+}
+
+// refill must be called with the lock held.
+func (b *retryBudget) refill() {
+	now := b.now()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.add(elapsed.Seconds() * b.perSecond)
+	}
+	b.last = now
+}
+
+// deposit adds to the budget for a request.
+func (b *retryBudget) deposit() {
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	b.add(b.ratio)
+}
+
+// withdraw returns true, and spends a token, if the budget allows a retry.
+func (b *retryBudget) withdraw() bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.add(-1)
+	return true
+}
+
+// retrier wraps an endpoint's request processor, retrying failed requests
+// while the budget allows.
+type retrier struct {
+	next         httpRequestProcessor
+	endpointType string
+	endpointName string
+	attempts     int
+	dnsAttempts  int
+	dnsDelay     time.Duration
+	budget       *retryBudget
+	sleep        func(ctx context.Context, d time.Duration) bool
+}
+
+func newRetrier(endpointType string, endpointName string, config RetryConfig, next httpRequestProcessor) *retrier {
+	r := &retrier{
+		next:         next,
+		endpointType: endpointType,
+		endpointName: endpointName,
+		attempts:     config.Attempts,
+		dnsAttempts:  config.DNSAttempts,
+		dnsDelay:     config.DNSDelay,
+		budget:       newRetryBudget(endpointType, endpointName, config),
+		sleep:        sleepContext,
+	}
+	if r.dnsDelay == 0 {
+		r.dnsDelay = defaultRetryDNSDelay
+	}
+	return r
+}
+
+// sleepContext waits for d, returning false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// pause waits for the DNS retry delay, returning false if the request is
+// cancelled while it waits.
+func (r *retrier) pause(req *tunnel.OpenHTTPTunnelRequest) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelRegistration := tunnel.RegisterCancelFunction(req.Id, cancel)
+	defer tunnel.UnregisterCancelFunction(cancelRegistration)
+	return r.sleep(ctx, r.dnsDelay)
+}
+
+func (r *retrier) unwrap() httpRequestProcessor {
+	return r.next
+}
+
+func isRetryable(req *tunnel.OpenHTTPTunnelRequest) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	return !req.StreamBody && req.GetHeaderValue("Upgrade") == ""
+}
+
+func isRetryStatus(status int32) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable
+}
+
+// failure is how an attempt failed, if it may be retried.  The zero value
+// means it did not.
+type failure struct {
+	status int32
+	dns    bool
+}
+
+func failedResponse(id string, failed failure) *tunnel.MessageWrapper {
+	if failed.dns {
+		return tunnel.MakeDNSFailureResponse(id)
+	}
+	if failed.status == http.StatusServiceUnavailable {
+		return tunnel.MakeServiceUnavailableResponse(id)
+	}
+	return tunnel.MakeBadGatewayResponse(id)
+}
+
+// attempt runs the request once.  If it failed in a way which retryable
+// says may be retried, nothing is sent and the failure is returned.
+// Otherwise, the response is sent and the zero failure is returned.
+func (r *retrier) attempt(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest, retryable func(failure) bool) failure {
+	var cancelled abool.AtomicBool
+	cancelRegistration := tunnel.RegisterCancelFunction(req.Id, cancelled.Set)
+	defer tunnel.UnregisterCancelFunction(cancelRegistration)
+
+	// Forward everything unless the response says to retry, in which case
+	// the rest of this attempt is discarded.  Discarded body chunks are
+	// acknowledged here, as the controller will never see them.
+	intercept := make(chan *tunnel.MessageWrapper)
+	failedChan := make(chan failure)
+	go func() {
+		seen := false
+		var failed failure
+		for msg := range intercept {
+			control := msg.GetHttpTunnelControl()
+			if resp := control.GetHttpTunnelResponse(); resp != nil && !seen {
+				seen = true
+				f := failure{status: resp.Status, dns: tunnel.IsDNSFailureResponse(resp)}
+				if isRetryStatus(resp.Status) && retryable(f) {
+					failed = f
+				}
+			}
+			if failed.status == 0 {
+				dataflow <- msg
+				continue
+			}
+			if chunk := control.GetHttpTunnelChunkedResponse(); chunk != nil && len(chunk.Body) > 0 {
+				tunnel.UpdateFlowWindow(req.Id, int64(len(chunk.Body)))
+			}
+		}
+		failedChan <- failed
+	}()
+	r.next.ExecuteHTTPRequest(agentName, intercept, req)
+	close(intercept)
+	failed := <-failedChan
+
+	// A cancelled request has no one waiting for a retry.
+	if failed.status != 0 && cancelled.IsSet() {
+		dataflow <- failedResponse(req.Id, failed)
+		return failure{}
+	}
+	return failed
+}
+
+// ExecuteHTTPRequest runs the request through the wrapped endpoint, retrying
+// it if it fails and the budget allows.  When the budget is exhausted, the
+// failed status is returned to the client without its body.
+func (r *retrier) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	r.budget.deposit()
+	if !isRetryable(req) {
+		r.next.ExecuteHTTPRequest(agentName, dataflow, req)
+		return
+	}
+
+	retries, dnsRetries := 0, 0
+	retryable := func(f failure) bool {
+		if f.dns && r.dnsAttempts > 0 {
+			return dnsRetries < r.dnsAttempts
+		}
+		return retries < r.attempts
+	}
+	for {
+		if retries >= r.attempts && dnsRetries >= r.dnsAttempts {
+			r.next.ExecuteHTTPRequest(agentName, dataflow, req)
+			return
+		}
+		failed := r.attempt(agentName, dataflow, req, retryable)
+		if failed.status == 0 {
+			return
+		}
+		dnsRetry := failed.dns && r.dnsAttempts > 0
+		if !r.budget.withdraw() {
+			retriesCounter.WithLabelValues(r.endpointType, r.endpointName, "suppressed").Inc()
+			zap.S().Warnw("retry budget exhausted",
+				"endpointType", r.endpointType,
+				"endpointName", r.endpointName,
+				"method", req.Method,
+				"uri", req.URI)
+			dataflow <- failedResponse(req.Id, failed)
+			return
+		}
+		retriesCounter.WithLabelValues(r.endpointType, r.endpointName, "attempted").Inc()
+		if dnsRetry {
+			dnsRetries++
+			zap.S().Infow("upstream hostname did not resolve, retrying",
+				"endpointType", r.endpointType,
+				"endpointName", r.endpointName,
+				"uri", req.URI,
+				"delay", r.dnsDelay)
+			if !r.pause(req) {
+				dataflow <- failedResponse(req.Id, failed)
+				return
+			}
+		} else {
+			retries++
+		}
+	}
+}
@@ -0,0 +1,296 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sequenceProcessor responds with each status in turn, repeating the last.
+type sequenceProcessor struct {
+	statuses []int32
+	calls    int
+}
+
+func (f *sequenceProcessor) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	status := f.statuses[len(f.statuses)-1]
+	if f.calls < len(f.statuses) {
+		status = f.statuses[f.calls]
+	}
+	f.calls++
+	dataflow <- &tunnel.MessageWrapper{
+		Event: &tunnel.MessageWrapper_HttpTunnelControl{
+			HttpTunnelControl: &tunnel.HttpTunnelControl{
+				ControlType: &tunnel.HttpTunnelControl_HttpTunnelResponse{
+					HttpTunnelResponse: &tunnel.HttpTunnelResponse{Id: req.Id, Status: status},
+				},
+			},
+		},
+	}
+	dataflow <- &tunnel.MessageWrapper{
+		Event: &tunnel.MessageWrapper_HttpTunnelControl{
+			HttpTunnelControl: &tunnel.HttpTunnelControl{
+				ControlType: &tunnel.HttpTunnelControl_HttpTunnelChunkedResponse{
+					HttpTunnelChunkedResponse: &tunnel.HttpTunnelChunkedResponse{Id: req.Id},
+				},
+			},
+		},
+	}
+}
+
+func makeTestRetrier(name string, config RetryConfig, next httpRequestProcessor) (*retrier, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	r := newRetrier("test", name, config, next)
+	r.budget.now = clock.now
+	r.budget.last = clock.t
+	return r, clock
+}
+
+// executeRetry returns the response status and how many messages were sent.
+func executeRetry(t *testing.T, r *retrier, method string) (int32, int) {
+	dataflow := make(chan *tunnel.MessageWrapper, 10)
+	r.ExecuteHTTPRequest("", dataflow, &tunnel.OpenHTTPTunnelRequest{Id: "retry-request", Method: method})
+	close(dataflow)
+	var status int32
+	count := 0
+	for msg := range dataflow {
+		if resp := msg.GetHttpTunnelControl().GetHttpTunnelResponse(); resp != nil {
+			require.Zero(t, status, "more than one response sent")
+			status = resp.Status
+		}
+		count++
+	}
+	return status, count
+}
+
+func TestRetrier_retries(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		statuses   []int32
+		wantStatus int32
+		wantCalls  int
+	}{
+		{"success", http.MethodGet, []int32{200}, 200, 1},
+		{"recovers", http.MethodGet, []int32{502, 503, 200}, 200, 3},
+		{"gives up after attempts", http.MethodGet, []int32{502}, 502, 3},
+		{"not retried status", http.MethodGet, []int32{504, 200}, 504, 1},
+		{"not idempotent", http.MethodPost, []int32{502, 200}, 502, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &sequenceProcessor{statuses: tt.statuses}
+			r, _ := makeTestRetrier("retries", RetryConfig{Attempts: 2}, upstream)
+			status, count := executeRetry(t, r, tt.method)
+			assert.Equal(t, tt.wantStatus, status)
+			assert.Equal(t, tt.wantCalls, upstream.calls)
+			assert.Equal(t, 2, count, "only the final attempt is sent")
+		})
+	}
+}
+
+func TestRetrier_budget(t *testing.T) {
+	upstream := &sequenceProcessor{statuses: []int32{http.StatusServiceUnavailable}}
+	r, clock := makeTestRetrier("budget", RetryConfig{Attempts: 1, BudgetRatio: 0.1, BudgetMinPerSecond: 1, BudgetMax: 3}, upstream)
+	attempted := retriesCounter.WithLabelValues("test", "budget", "attempted")
+	suppressed := retriesCounter.WithLabelValues("test", "budget", "suppressed")
+
+	// The budget starts full, and each failing request retries once.  The
+	// 0.1 of a retry each request deposits is not enough to keep up.
+	for i := 0; i < 3; i++ {
+		status, _ := executeRetry(t, r, http.MethodGet)
+		assert.Equal(t, int32(http.StatusServiceUnavailable), status)
+	}
+	assert.Equal(t, 6, upstream.calls)
+	assert.Equal(t, 3.0, testutil.ToFloat64(attempted))
+	assert.InDelta(t, 0.2, testutil.ToFloat64(retryBudgetGauge.WithLabelValues("test", "budget")), 0.001)
+
+	// Once exhausted, retries are suppressed, and the failure is returned.
+	status, count := executeRetry(t, r, http.MethodGet)
+	assert.Equal(t, int32(http.StatusServiceUnavailable), status)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 7, upstream.calls)
+	assert.Equal(t, 1.0, testutil.ToFloat64(suppressed))
+
+	// The budget is replenished over time.
+	clock.t = clock.t.Add(2 * time.Second)
+	executeRetry(t, r, http.MethodGet)
+	assert.Equal(t, 9, upstream.calls)
+	assert.Equal(t, 4.0, testutil.ToFloat64(attempted))
+
+	// But never past the maximum.
+	clock.t = clock.t.Add(time.Hour)
+	for i := 0; i < 4; i++ {
+		executeRetry(t, r, http.MethodGet)
+	}
+	assert.Equal(t, 7.0, testutil.ToFloat64(attempted))
+	assert.Equal(t, 2.0, testutil.ToFloat64(suppressed))
+}
+
+func TestRetryBudget_shared(t *testing.T) {
+	b := newRetryBudget("test", "shared", RetryConfig{BudgetRatio: 0.5, BudgetMax: 1})
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	b.now = clock.now
+	b.last = clock.t
+
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+	b.deposit()
+	assert.False(t, b.withdraw())
+	b.deposit()
+	assert.True(t, b.withdraw())
+}
+
+// flakyResolverProcessor sends requests to the upstream through a client
+// whose hostname lookups fail the first failures times.
+type flakyResolverProcessor struct {
+	sync.Mutex
+	client   *http.Client
+	upstream string
+	failures int
+	calls    int
+}
+
+func newFlakyResolverProcessor(upstream *httptest.Server, failures int) *flakyResolverProcessor {
+	p := &flakyResolverProcessor{upstream: upstream.URL, failures: failures}
+	dialer := &net.Dialer{}
+	p.client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			p.Lock()
+			fail := p.calls <= p.failures
+			p.Unlock()
+			if fail {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "server misbehaving", Name: "upstream.example.com", IsTemporary: true}}
+			}
+			return dialer.DialContext(ctx, network, upstream.Listener.Addr().String())
+		},
+		DisableKeepAlives: true,
+	}}
+	return p
+}
+
+func (p *flakyResolverProcessor) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	p.Lock()
+	p.calls++
+	p.Unlock()
+	httpRequest, _ := http.NewRequest(req.Method, "http://upstream.example.com"+req.URI, nil)
+	tunnel.RunHTTPRequest(p.client, req, httpRequest, dataflow, "http://upstream.example.com", tunnel.ResponseOptions{})
+}
+
+func TestRetrier_dnsFailures(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name       string
+		config     RetryConfig
+		method     string
+		failures   int
+		wantStatus int32
+		wantDNS    bool
+		wantCalls  int
+		wantSleeps []time.Duration
+	}{
+		{"recovers", RetryConfig{DNSAttempts: 2}, http.MethodGet, 2, 200, false, 3, []time.Duration{defaultRetryDNSDelay, defaultRetryDNSDelay}},
+		{"configured delay", RetryConfig{DNSAttempts: 1, DNSDelay: time.Second}, http.MethodGet, 1, 200, false, 2, []time.Duration{time.Second}},
+		{"gives up after dnsAttempts", RetryConfig{DNSAttempts: 2}, http.MethodGet, 5, 502, true, 3, []time.Duration{defaultRetryDNSDelay, defaultRetryDNSDelay}},
+		{"not idempotent", RetryConfig{DNSAttempts: 2}, http.MethodPost, 1, 502, true, 1, nil},
+		{"without dnsAttempts, retried as any 502", RetryConfig{Attempts: 1}, http.MethodGet, 1, 200, false, 2, nil},
+		{"separate from attempts", RetryConfig{Attempts: 1, DNSAttempts: 1}, http.MethodGet, 2, 502, true, 2, []time.Duration{defaultRetryDNSDelay}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newFlakyResolverProcessor(upstream, tt.failures)
+			r, _ := makeTestRetrier("dns", tt.config, upstream)
+			var sleeps []time.Duration
+			r.sleep = func(_ context.Context, d time.Duration) bool {
+				sleeps = append(sleeps, d)
+				return true
+			}
+
+			dataflow := make(chan *tunnel.MessageWrapper, 10)
+			r.ExecuteHTTPRequest("", dataflow, &tunnel.OpenHTTPTunnelRequest{Id: "dns-request", Method: tt.method, URI: "/"})
+			resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+			require.NotNil(t, resp)
+			assert.Equal(t, tt.wantStatus, resp.Status)
+			assert.Equal(t, tt.wantDNS, tunnel.IsDNSFailureResponse(resp))
+			assert.Equal(t, tt.wantCalls, upstream.calls)
+			assert.Equal(t, tt.wantSleeps, sleeps)
+		})
+	}
+}
+
+func TestRetrier_dnsDelayCancelled(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	flaky := newFlakyResolverProcessor(upstream, 5)
+	r, _ := makeTestRetrier("dns-cancel", RetryConfig{DNSAttempts: 2, DNSDelay: time.Hour}, flaky)
+
+	dataflow := make(chan *tunnel.MessageWrapper, 10)
+	done := make(chan struct{})
+	go func() {
+		r.ExecuteHTTPRequest("", dataflow, &tunnel.OpenHTTPTunnelRequest{Id: "dns-cancel-request", Method: http.MethodGet, URI: "/"})
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		flaky.Lock()
+		defer flaky.Unlock()
+		return flaky.calls == 1
+	}, 5*time.Second, time.Millisecond)
+
+	// Keep cancelling until the retrier stops waiting, as the first call may
+	// come before it registers for the delay.
+	require.Eventually(t, func() bool {
+		tunnel.CallCancelFunction("dns-cancel-request")
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+	resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+	require.NotNil(t, resp)
+	assert.True(t, tunnel.IsDNSFailureResponse(resp))
+	assert.Equal(t, 1, flaky.calls)
+}
+
+func TestRetrier_dnsAttemptsOnly(t *testing.T) {
+	// Other failures are sent as they are, body and all.
+	upstream := &sequenceProcessor{statuses: []int32{http.StatusBadGateway, http.StatusOK}}
+	r, _ := makeTestRetrier("dns-only", RetryConfig{DNSAttempts: 2}, upstream)
+	status, count := executeRetry(t, r, http.MethodGet)
+	assert.Equal(t, int32(http.StatusBadGateway), status)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 1, upstream.calls)
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultSelfTestTimeout is how long each endpoint's self-test may take
+// if no timeout is given.
+const DefaultSelfTestTimeout = 5 * time.Second
+
+// selfTester is implemented by endpoints which can check that the service
+// they forward to can be reached.
+type selfTester interface {
+	selfTest(ctx context.Context) error
+}
+
+// SelfTestResult is the outcome of one endpoint's self-test.  Skipped is
+// set for endpoints which are not configured, or have no fixed service
+// to check, such as aws or connect.
+type SelfTestResult struct {
+	Type     string
+	Name     string
+	Skipped  bool
+	Duration time.Duration
+	Err      error
+}
+
+// Passed returns true if the endpoint was tested, and could be reached.
+func (r SelfTestResult) Passed() bool {
+	return !r.Skipped && r.Err == nil
+}
+
+// selfTesterFor returns the endpoint behind any wrappers, such as the
+// retrier or circuit breaker, so a failed self-test does not count against
+// the breaker, and is not cached or logged as a request.
+func selfTesterFor(p httpRequestProcessor) selfTester {
+	for {
+		if w, ok := p.(processorWrapper); ok {
+			p = w.unwrap()
+			continue
+		}
+		tester, _ := p.(selfTester)
+		return tester
+	}
+}
+
+// SelfTestEndpoints checks every configured endpoint at once, allowing
+// each at most timeout, and logs and returns the results in the same
+// order as endpoints.  A failure is only reported; the endpoint is still
+// used.
+func SelfTestEndpoints(ctx context.Context, endpoints []ConfiguredEndpoint, timeout time.Duration) []SelfTestResult {
+	results := CheckEndpoints(ctx, endpoints, timeout)
+	for _, result := range results {
+		switch {
+		case result.Skipped:
+			zap.S().Infow("endpoint self-test skipped",
+				"endpointType", result.Type,
+				"endpointName", result.Name)
+		case result.Err != nil:
+			zap.S().Warnw("endpoint self-test failed",
+				"endpointType", result.Type,
+				"endpointName", result.Name,
+				"duration", result.Duration,
+				"error", result.Err)
+		default:
+			zap.S().Infow("endpoint self-test passed",
+				"endpointType", result.Type,
+				"endpointName", result.Name,
+				"duration", result.Duration)
+		}
+	}
+	return results
+}
+
+// CheckEndpoints is SelfTestEndpoints without the logging, for checks
+// which are repeated.
+func CheckEndpoints(ctx context.Context, endpoints []ConfiguredEndpoint, timeout time.Duration) []SelfTestResult {
+	if timeout <= 0 {
+		timeout = DefaultSelfTestTimeout
+	}
+	results := make([]SelfTestResult, len(endpoints))
+	var wg sync.WaitGroup
+	for i, ep := range endpoints {
+		results[i] = SelfTestResult{Type: ep.Type, Name: ep.Name, Skipped: true}
+		if !ep.Configured {
+			continue
+		}
+		tester := selfTesterFor(ep.Instance)
+		if tester == nil {
+			continue
+		}
+		results[i].Skipped = false
+		wg.Add(1)
+		go func(result *SelfTestResult) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			result.Err = tester.selfTest(ctx)
+			result.Duration = time.Since(start)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// selfTest sends a HEAD request to the endpoint's URL.  Any response
+// passes, as the base URL may well not allow HEAD, or need credentials.
+func (ep *GenericEndpoint) selfTest(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, ep.config.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ep.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// selfTest checks the API server's /healthz with the endpoint's
+// credentials, so a rejected token fails as well.
+func (ke *KubernetesEndpoint) selfTest(ctx context.Context) error {
+	c := ke.makeServerContextFields()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.serverURL+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+	if token := c.bearerToken(); len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("/healthz returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// selfTest opens a TCP connection to the service, the way requests are
+// sent, through any host overrides or SOCKS5 proxy.
+func (ep *GRPCEndpoint) selfTest(ctx context.Context) error {
+	u, err := url.Parse(ep.config.URL)
+	if err != nil {
+		return err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := ep.config.Transport.dialContext()(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTestEndpoints(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hang":
+			<-r.Context().Done()
+		case "/healthz":
+			if r.Header.Get("Authorization") != "Bearer good" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer upstream.Close()
+	unreachable := fmt.Sprintf("http://127.0.0.1:%d", freePort(t, "127.0.0.1"))
+
+	generic := func(t *testing.T, url string) httpRequestProcessor {
+		ep, configured, err := MakeGenericEndpoint("jenkins", "test", []byte("url: "+url), nil)
+		require.NoError(t, err)
+		require.True(t, configured)
+		return ep
+	}
+	kubernetes := func(token string) httpRequestProcessor {
+		return &KubernetesEndpoint{f: kubeContext{serverURL: upstream.URL, token: token, client: upstream.Client()}}
+	}
+	grpc := func(t *testing.T, url string) httpRequestProcessor {
+		ep, configured, err := MakeGRPCEndpoint("test", []byte("url: "+url))
+		require.NoError(t, err)
+		require.True(t, configured)
+		return ep
+	}
+
+	tests := []struct {
+		name         string
+		instance     func(t *testing.T) httpRequestProcessor
+		unconfigured bool
+		wantSkipped  bool
+		wantErr      string
+	}{
+		{"generic reachable", func(t *testing.T) httpRequestProcessor { return generic(t, upstream.URL) }, false, false, ""},
+		{"generic unreachable", func(t *testing.T) httpRequestProcessor { return generic(t, unreachable) }, false, false, "connection refused"},
+		{"generic timeout", func(t *testing.T) httpRequestProcessor { return generic(t, upstream.URL+"/hang") }, false, false, "deadline exceeded"},
+		{"kubernetes healthy", func(t *testing.T) httpRequestProcessor { return kubernetes("good") }, false, false, ""},
+		{"kubernetes bad token", func(t *testing.T) httpRequestProcessor { return kubernetes("bad") }, false, false, "status 401"},
+		{"grpc reachable", func(t *testing.T) httpRequestProcessor { return grpc(t, upstream.URL) }, false, false, ""},
+		{"grpc unreachable", func(t *testing.T) httpRequestProcessor { return grpc(t, unreachable) }, false, false, "connection refused"},
+		{"grpc host override", func(t *testing.T) httpRequestProcessor {
+			u, err := url.Parse(upstream.URL)
+			require.NoError(t, err)
+			config := fmt.Sprintf("url: http://grpc.invalid:%s\ntransport:\n  hostOverrides:\n    grpc.invalid: 127.0.0.1\n", u.Port())
+			ep, configured, err := MakeGRPCEndpoint("test", []byte(config))
+			require.NoError(t, err)
+			require.True(t, configured)
+			return ep
+		}, false, false, ""},
+		{"behind circuit breaker", func(t *testing.T) httpRequestProcessor {
+			return newCircuitBreaker("jenkins", "test", CircuitBreakerConfig{FailureThreshold: 1}, generic(t, unreachable))
+		}, false, false, "connection refused"},
+		{"behind every wrapper", func(t *testing.T) httpRequestProcessor {
+			var p httpRequestProcessor = generic(t, unreachable)
+			p = newRetrier("jenkins", "test", RetryConfig{Attempts: 1}, p)
+			p = newCircuitBreaker("jenkins", "test", CircuitBreakerConfig{FailureThreshold: 1}, p)
+			p = newConcurrencyLimiter("jenkins", "test", 1, p)
+			p = newCoalescer("jenkins", "test", p)
+			p = newResponseCache("jenkins", "test", ResponseCacheConfig{TTL: time.Minute}, p)
+			return newAccessLogger("jenkins", "test", AccessLogConfig{Enabled: true}, p)
+		}, false, false, "connection refused"},
+		{"not testable", func(t *testing.T) httpRequestProcessor { return &AwsEndpoint{} }, false, true, ""},
+		{"unconfigured", func(t *testing.T) httpRequestProcessor { return nil }, true, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoints := []ConfiguredEndpoint{{
+				Type:       "jenkins",
+				Name:       "test",
+				Configured: !tt.unconfigured,
+				Instance:   tt.instance(t),
+			}}
+			start := time.Now()
+			results := SelfTestEndpoints(context.Background(), endpoints, 200*time.Millisecond)
+			assert.Less(t, time.Since(start), 2*time.Second)
+			require.Len(t, results, 1)
+			result := results[0]
+			assert.Equal(t, "jenkins", result.Type)
+			assert.Equal(t, "test", result.Name)
+			assert.Equal(t, tt.wantSkipped, result.Skipped)
+			if tt.wantErr != "" {
+				require.Error(t, result.Err)
+				assert.Contains(t, result.Err.Error(), tt.wantErr)
+				assert.False(t, result.Passed())
+			} else {
+				assert.NoError(t, result.Err)
+				assert.Equal(t, !tt.wantSkipped, result.Passed())
+			}
+		})
+	}
+}
@@ -17,11 +17,18 @@
 package serviceconfig
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/OpsMx/go-app-base/httputil"
 	"github.com/opsmx/oes-birger/internal/ca"
@@ -34,6 +41,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/tevino/abool"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
@@ -45,61 +54,136 @@ var (
 )
 
 // RunHTTPSServer will listen for incoming service requests on a provided port, and
-// currently will use certificates or JWT to identify the destination.
-func RunHTTPSServer(routes *tunnelroute.ConnectedRoutes, ca *ca.CA, serverCert tls.Certificate, service IncomingServiceConfig) {
-	zap.S().Infof("Running service HTTPS listener on port %d", service.Port)
+// currently will use certificates or JWT to identify the destination.  Each
+// request must be allowed by the authorizer.  The server certificate, with
+// any stapled OCSP response, comes from getCertificate.
+//
+// All services must share the same port, and are chosen between by the
+// request's Host header.  See GroupIncomingServices.
+//
+// If the services set NextProtos, only those ALPN protocols are offered.
+// Protocols other than h2 and http/1.1 are served by their handler in
+// protocols, which may be nil.
+func RunHTTPSServer(routes *tunnelroute.ConnectedRoutes, authority *ca.CA, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), services []IncomingServiceConfig, authorizer Authorizer, protocols map[string]ProtocolHandler) {
+	server, err := makeHTTPSServer(routes, authority, getCertificate, services, authorizer, protocols)
+	if err != nil {
+		zap.S().Fatal(err)
+	}
+	zap.S().Infof("Running service HTTPS listener on %s", server.Addr)
+	zap.S().Fatal(server.ListenAndServeTLS("", ""))
+}
+
+// makeHTTPSServer returns the server RunHTTPSServer runs.
+func makeHTTPSServer(routes *tunnelroute.ConnectedRoutes, authority *ca.CA, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), services []IncomingServiceConfig, authorizer Authorizer, protocols map[string]ProtocolHandler) (*http.Server, error) {
+	addr := util.ListenAddress(services[0].BindAddress, services[0].Port)
 
-	certPool, err := ca.MakeCertPool()
+	certPool, err := authority.MakeCertPool()
 	if err != nil {
-		zap.S().Fatalf("While making certpool: %v", err)
+		return nil, fmt.Errorf("while making certpool: %v", err)
 	}
 
 	tlsConfig := &tls.Config{
-		ClientCAs:    certPool,
-		ClientAuth:   tls.VerifyClientCertIfGiven,
-		Certificates: []tls.Certificate{serverCert},
-		MinVersion:   tls.VersionTLS12,
+		ClientCAs:      certPool,
+		ClientAuth:     tls.VerifyClientCertIfGiven,
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS12,
 	}
+	util.ApplyTLSSettings(tlsConfig)
+	ca.ReloadingClientCAs(tlsConfig, authority)
 
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/", secureAPIHandlerMaker(routes, service))
+	handler := makeVirtualHosts(services, func(service IncomingServiceConfig) http.Handler {
+		return serviceHandler(secureAPIHandlerMaker(routes, service, authorizer))
+	})
 
 	server := &http.Server{
-		Addr:      fmt.Sprintf(":%d", service.Port),
-		TLSConfig: tlsConfig,
-		Handler:   mux,
+		Addr:           addr,
+		TLSConfig:      tlsConfig,
+		Handler:        handler,
+		MaxHeaderBytes: maxHeaderBytes(services),
 	}
-
-	zap.S().Fatal(server.ListenAndServeTLS("", ""))
+	if err := configureProtocols(server, nextProtos(services), protocols); err != nil {
+		return nil, fmt.Errorf("while configuring ALPN protocols: %v", err)
+	}
+	return server, nil
 }
 
 // RunHTTPServer will listen on an unencrypted HTTP only port, and will always forward
-// incoming requests to the hard-coded configured destination.
-func RunHTTPServer(routes *tunnelroute.ConnectedRoutes, service IncomingServiceConfig) {
-	zap.S().Infof("Running service HTTP listener on port %d", service.Port)
-
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/", fixedIdentityAPIHandlerMaker(routes, service))
-
+// incoming requests to the hard-coded configured destination, if allowed by
+// the authorizer.  As with RunHTTPSServer, several services may share the
+// port.
+func RunHTTPServer(routes *tunnelroute.ConnectedRoutes, services []IncomingServiceConfig, authorizer Authorizer) {
+	addr := util.ListenAddress(services[0].BindAddress, services[0].Port)
+	zap.S().Infof("Running service HTTP listener on %s", addr)
+
+	handler := makeVirtualHosts(services, func(service IncomingServiceConfig) http.Handler {
+		return serviceHandler(fixedIdentityAPIHandlerMaker(routes, service, authorizer))
+	})
+
+	// Without TLS, HTTP/2 (needed for gRPC) is only available to clients
+	// which use it with prior knowledge or ask to upgrade to it.
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", service.Port),
-		Handler: mux,
+		Addr:           addr,
+		Handler:        h2c.NewHandler(handler, &http2.Server{}),
+		MaxHeaderBytes: maxHeaderBytes(services),
 	}
 
 	zap.S().Fatal(server.ListenAndServe())
 }
 
-func fixedIdentityAPIHandlerMaker(routes *tunnelroute.ConnectedRoutes, service IncomingServiceConfig) func(http.ResponseWriter, *http.Request) {
+// serviceHandler serves every path with handler, including CONNECT
+// requests.
+func serviceHandler(handler http.HandlerFunc) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler)
+	return tunnel.RecoverHandler("service", allowConnect(mux, handler))
+}
+
+// allowConnect sends CONNECT requests, whose target is a host and port
+// rather than a path the mux can match, directly to the handler.
+func allowConnect(mux http.Handler, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			handler(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func fixedIdentityAPIHandlerMaker(routes *tunnelroute.ConnectedRoutes, service IncomingServiceConfig, authorizer Authorizer) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ep := tunnelroute.Search{
 			Name:         service.Destination,
 			EndpointType: service.ServiceType,
 			EndpointName: service.DestinationService,
 		}
-		runAPIHandler(routes, ep, w, r)
+		identity := ServiceIdentity{Method: IdentityMethodFixed}
+		release, allowed := authorize(authorizer, service, w, r, identity, ep)
+		if !allowed {
+			return
+		}
+		runAPIHandler(routes, service, ep, w, r, release)
+	}
+}
+
+// authorize returns true if the credential's scope and the authorizer allow
+// the request, and otherwise fails it.  The returned function releases the
+// authorization if the request is then not sent on.
+func authorize(authorizer Authorizer, service IncomingServiceConfig, w http.ResponseWriter, r *http.Request, identity ServiceIdentity, ep tunnelroute.Search) (func(), bool) {
+	err := checkScope(identity.Scope, service, r)
+	if err == nil {
+		err = authorizer.Authorize(r, identity, ep)
+	}
+	if err != nil {
+		zap.S().Warnw("request denied", "error", err, "identityMethod", identity.Method, "agent", identity.Agent, "destination", ep.Name, "service", ep.EndpointName, "serviceType", ep.EndpointType)
+		util.FailRequest(w, fmt.Errorf("request not allowed"), http.StatusForbidden)
+		return nil, false
+	}
+	release := func() {}
+	if releaser, ok := authorizer.(AuthorizationReleaser); ok {
+		release = func() { releaser.Release(r, identity) }
 	}
+	return release, true
 }
 
 func extractEndpointFromCert(r *http.Request) (agentIdentity string, endpointType string, endpointName string, validated bool) {
@@ -120,7 +204,7 @@ func extractEndpointFromCert(r *http.Request) (agentIdentity string, endpointTyp
 	return names.Agent, names.Type, names.Name, true
 }
 
-func extractEndpointFromJWT(r *http.Request) (agentIdentity string, endpointType string, endpointName string, validated bool) {
+func extractEndpointFromJWT(r *http.Request) (identity ServiceIdentity, validated bool) {
 	// First check for our specific header.
 	authPassword := r.Header.Get("X-Opsmx-Token")
 	r.Header.Del("X-Opsmx-Token")
@@ -136,55 +220,97 @@ func extractEndpointFromJWT(r *http.Request) (agentIdentity string, endpointType
 		}
 	}
 
+	// CONNECT clients send their credentials for the proxy in Proxy-Authorization.
+	if authPassword == "" && r.Method == http.MethodConnect {
+		authPassword = proxyAuthorizationPassword(r)
+	}
+	r.Header.Del("Proxy-Authorization")
+
 	// If that fails, check HTTP Basic (ignoring the username)
 	if authPassword == "" {
 		var ok bool
 		if _, authPassword, ok = r.BasicAuth(); !ok {
-			return "", "", "", false
+			return ServiceIdentity{}, false
 		}
 	}
 
-	endpointType, endpointName, agentIdentity, err := jwtutil.ValidateJWT(authPassword, nil)
+	endpointType, endpointName, agentIdentity, scope, err := jwtutil.ValidateScopedJWT(authPassword, nil)
 	if err != nil {
 		zap.S().Errorf("%v", err)
-		return "", "", "", false
+		return ServiceIdentity{}, false
 	}
 
-	return agentIdentity, endpointType, endpointName, true
+	tokenID, tokenExpires := jwtutil.TokenID(authPassword)
+	return ServiceIdentity{
+		Method:       IdentityMethodJWT,
+		Agent:        agentIdentity,
+		EndpointType: endpointType,
+		EndpointName: endpointName,
+		Scope:        scope,
+		TokenID:      tokenID,
+		TokenExpires: tokenExpires,
+	}, true
+}
+
+// proxyAuthorizationPassword returns the token from a Bearer, or the
+// password (ignoring the username) from a Basic, Proxy-Authorization header.
+func proxyAuthorizationPassword(r *http.Request) string {
+	items := strings.SplitN(r.Header.Get("Proxy-Authorization"), " ", 2)
+	if len(items) != 2 {
+		return ""
+	}
+	switch items[0] {
+	case "Bearer":
+		return items[1]
+	case "Basic":
+		decoded, err := base64.StdEncoding.DecodeString(items[1])
+		if err != nil {
+			return ""
+		}
+		_, password, _ := strings.Cut(string(decoded), ":")
+		return password
+	}
+	return ""
 }
 
-func extractEndpoint(r *http.Request) (agentIdentity string, endpointType string, endpointName string, err error) {
+func extractEndpoint(r *http.Request) (ServiceIdentity, error) {
 	agentIdentity, endpointType, endpointName, found := extractEndpointFromCert(r)
 	if found {
-		return agentIdentity, endpointType, endpointName, nil
+		return ServiceIdentity{Method: IdentityMethodCertificate, Agent: agentIdentity, EndpointType: endpointType, EndpointName: endpointName}, nil
 	}
 
-	agentIdentity, endpointType, endpointName, found = extractEndpointFromJWT(r)
-	if found {
-		return agentIdentity, endpointType, endpointName, nil
+	if identity, found := extractEndpointFromJWT(r); found {
+		return identity, nil
 	}
 
 	zap.S().Warnw("invalid-credentials", "remote", r.RemoteAddr, "url", r.URL)
 
-	return "", "", "", fmt.Errorf("no valid credentials or JWT found")
+	return ServiceIdentity{}, fmt.Errorf("no valid credentials or JWT found")
 }
 
-func secureAPIHandlerMaker(routes *tunnelroute.ConnectedRoutes, service IncomingServiceConfig) func(http.ResponseWriter, *http.Request) {
+func secureAPIHandlerMaker(routes *tunnelroute.ConnectedRoutes, service IncomingServiceConfig, authorizer Authorizer) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		agentIdentity, endpointType, endpointName, err := extractEndpoint(r)
+		identity, err := extractEndpoint(r)
 		if err != nil {
 			util.FailRequest(w, err, http.StatusBadRequest)
 			return
 		}
 		ep := tunnelroute.Search{
-			Name:         agentIdentity,
-			EndpointType: endpointType,
-			EndpointName: endpointName,
+			Name:         identity.Agent,
+			EndpointType: identity.EndpointType,
+			EndpointName: identity.EndpointName,
+		}
+		release, allowed := authorize(authorizer, service, w, r, identity, ep)
+		if !allowed {
+			return
 		}
-		runAPIHandler(routes, ep, w, r)
+		runAPIHandler(routes, service, ep, w, r, release)
 	}
 }
 
+// copyHeaders replaces the response headers with those from the agent.
+// The agent's UpstreamErrorHeader is only for deciding whether to retry,
+// so it is not relayed to the client.
 func copyHeaders(resp *tunnel.HttpTunnelResponse, w http.ResponseWriter) {
 	for name := range w.Header() {
 		w.Header().Del(name)
@@ -194,6 +320,7 @@ func copyHeaders(resp *tunnel.HttpTunnelResponse, w http.ResponseWriter) {
 			w.Header().Add(header.Name, value)
 		}
 	}
+	w.Header().Del(tunnel.UpstreamErrorHeader)
 }
 
 func handleDone(n <-chan struct{}, routes *tunnelroute.ConnectedRoutes, state *apiHandlerState, target tunnelroute.Search, id string) {
@@ -211,18 +338,173 @@ type apiHandlerState struct {
 	isChunked  bool
 	flusher    http.Flusher
 	cleanClose abool.AtomicBool
+	upgraded   net.Conn
+	sendWindow *tunnel.SendWindow
+	windowSize int64
+	unacked    int64
 }
 
-func runAPIHandler(routes *tunnelroute.ConnectedRoutes, ep tunnelroute.Search, w http.ResponseWriter, r *http.Request) {
-	apiRequestCounter.WithLabelValues(ep.Name, ep.EndpointName).Inc()
-	transactionID := ulid.GlobalContext.Ulid()
+// acknowledge lets the sender know the client has consumed n more bytes of
+// the response.  Updates are batched to half the window to reduce the
+// number of messages sent.
+func (state *apiHandlerState) acknowledge(routes *tunnelroute.ConnectedRoutes, ep tunnelroute.Search, id string, n int) {
+	if state.windowSize <= 0 {
+		return
+	}
+	state.unacked += int64(n)
+	if state.unacked < state.windowSize/2 {
+		return
+	}
+	if err := routes.SendToSession(ep, &tunnelroute.HTTPWindowUpdate{ID: id, Bytes: state.unacked}); err != nil {
+		zap.S().Debugw("unable to send window update", "error", err, "destination", ep.Name, "session", ep.Session)
+	}
+	state.unacked = 0
+}
+
+// requestTimeoutHeader lets a client say how long it will wait for a response,
+// either as a duration such as "30s" or as a number of seconds.
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// requestTimeout returns how long the client will wait for the request, from
+// its X-Request-Timeout header or its request's deadline, whichever is sooner.
+// Zero means the client has not said.
+func requestTimeout(r *http.Request) time.Duration {
+	var timeout time.Duration
+	if value := r.Header.Get(requestTimeoutHeader); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			timeout = time.Duration(seconds * float64(time.Second))
+		} else if d, err := time.ParseDuration(value); err == nil {
+			timeout = d
+		} else {
+			zap.S().Debugw("ignoring invalid request timeout", "value", value)
+		}
+		if timeout < 0 {
+			timeout = 0
+		}
+	}
+	if deadline, ok := r.Context().Deadline(); ok {
+		remaining := time.Until(deadline)
+		if timeout == 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+	// Less than a millisecond would be sent as no timeout at all.
+	if timeout != 0 && timeout < time.Millisecond {
+		timeout = time.Millisecond
+	}
+	return timeout
+}
 
-	body, err := io.ReadAll(r.Body)
+// requestPriority returns the priority to send with the request, from the
+// service's PriorityHeader if the client sent a valid one, or else the
+// service's Priority.  The header is removed from the request.
+func requestPriority(service IncomingServiceConfig, r *http.Request) int32 {
+	if service.PriorityHeader == "" {
+		return service.Priority
+	}
+	value := r.Header.Get(service.PriorityHeader)
+	r.Header.Del(service.PriorityHeader)
+	if value == "" {
+		return service.Priority
+	}
+	priority, err := strconv.ParseInt(value, 10, 32)
 	if err != nil {
-		zap.S().Errorf("unable to read entire message body")
-		w.WriteHeader(http.StatusServiceUnavailable)
+		zap.S().Debugw("ignoring invalid request priority", "value", value)
+		return service.Priority
+	}
+	return int32(priority)
+}
+
+// waitForAgent waits for an agent to connect with the endpoint, returning
+// true if one has.  An agent being handed over from a draining peer may
+// not have connected yet, one which just disconnected may be reconnecting,
+// and the service may allow time for an agent to restart.
+func waitForAgent(ctx context.Context, routes *tunnelroute.ConnectedRoutes, service IncomingServiceConfig, ep tunnelroute.Search) bool {
+	if routes.Handoff().WaitForRoute(ctx, ep) {
+		return true
+	}
+	if routes.WaitForReconnect(ctx, ep) {
+		return true
+	}
+	if service.WaitForAgent <= 0 {
+		return false
+	}
+	zap.S().Debugw("waiting for agent", "destination", ep.Name, "service", routes.ResolveEndpointAlias(ep).EndpointName, "waitForAgent", service.WaitForAgent)
+	return routes.WaitForRoute(ctx, ep, time.Now().Add(service.WaitForAgent))
+}
+
+// agentSessionHeader lets a client send a request to a specific agent
+// session, such as one shown on /debug/routes, rather than any session
+// with the endpoint.  It is not sent on to the agent.
+const agentSessionHeader = "X-Opsmx-Agent-Session"
+
+// runAPIHandler sends the request to an agent, and relays its response.
+// If the request cannot be sent, release is called to undo its
+// authorization.
+func runAPIHandler(routes *tunnelroute.ConnectedRoutes, service IncomingServiceConfig, ep tunnelroute.Search, w http.ResponseWriter, r *http.Request, release func()) {
+	sent := false
+	defer func() {
+		if !sent {
+			release()
+		}
+	}()
+
+	redirect, done := routes.Handoff().Accept()
+	if redirect != nil {
+		redirectToPeer(w, r, *redirect)
 		return
 	}
+	defer done()
+
+	transactionID := ulid.GlobalContext.Ulid()
+
+	ep.Session = r.Header.Get(agentSessionHeader)
+	r.Header.Del(agentSessionHeader)
+
+	// The request is routed by the name the client used, which Send resolves
+	// once, but is counted and logged by the endpoint's real name.
+	requested := ep
+	ep = routes.ResolveEndpointAlias(ep)
+	apiRequestCounter.WithLabelValues(ep.Name, ep.EndpointName).Inc()
+	priority := requestPriority(service, r)
+
+	if err := verifyUserHeader(service, r.Header, nil); err != nil {
+		zap.S().Warnw("rejecting request with invalid user header", "destination", ep.Name, "service", ep.EndpointName, "error", err)
+		util.FailRequest(w, err, http.StatusForbidden)
+		return
+	}
+
+	if service.MaxRequestBodyBytes > 0 {
+		if r.ContentLength > service.MaxRequestBodyBytes {
+			zap.S().Warnw("request body too large", "destination", ep.Name, "service", ep.EndpointName, "contentLength", r.ContentLength)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, service.MaxRequestBodyBytes)
+	}
+
+	// gRPC calls may stream in both directions, and large uploads should not
+	// be held in memory, so the body is sent to the agent as it arrives rather
+	// than read up front.  Upgraded connections carry their own data.
+	streamBody := ep.EndpointType == "grpc"
+	if r.Method != http.MethodConnect && !tunnel.IsUpgradeRequest(r.Header) && service.streamRequestBody(r.ContentLength) {
+		streamBody = true
+	}
+	var body []byte
+	if !streamBody {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			zap.S().Errorf("unable to read entire message body")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
 
 	headers, err := tunnel.MakeHeaders(r.Header)
 	if err != nil {
@@ -232,24 +514,57 @@ func runAPIHandler(routes *tunnelroute.ConnectedRoutes, ep tunnelroute.Search, w
 	}
 
 	req := &tunnel.OpenHTTPTunnelRequest{
-		Id:      transactionID,
-		Type:    ep.EndpointType,
-		Name:    ep.EndpointName,
-		Method:  r.Method,
-		URI:     r.RequestURI,
-		Headers: headers,
-		Body:    body,
+		Id:            transactionID,
+		Type:          ep.EndpointType,
+		Name:          ep.EndpointName,
+		Method:        r.Method,
+		URI:           r.RequestURI,
+		Headers:       headers,
+		Body:          body,
+		WindowSize:    service.windowSize(),
+		StreamBody:    streamBody,
+		TimeoutMillis: requestTimeout(r).Milliseconds(),
+		Priority:      priority,
 	}
+	requestID := tunnel.RequestID(req)
+	zap.S().Debugw("forwarding request", "destination", ep.Name, "service", ep.EndpointName, "method", r.Method, "requestId", requestID)
 	message := &tunnelroute.HTTPMessage{Out: make(chan *tunnel.MessageWrapper), Cmd: req}
-	sessionID, err := routes.Send(ep, message)
+	defer message.Done()
+	// Client data on an upgraded connection is flow controlled in the same
+	// way as a streamed body.
+	upgrade := r.Method == http.MethodConnect || tunnel.IsUpgradeRequest(r.Header)
+	var window *tunnel.SendWindow
+	if streamBody || upgrade {
+		// Opened before sending, as acknowledgements may arrive at once.
+		window = tunnel.OpenSendWindow(transactionID, tunnel.DefaultWindowSize)
+		defer window.Close()
+	}
+	defer trackInFlight(ep.Name, ep.EndpointName)()
+	sessionID, err := routes.Send(requested, message)
+	if err != nil && len(ep.Session) == 0 && waitForAgent(r.Context(), routes, service, requested) {
+		sessionID, err = routes.Send(requested, message)
+	}
 	if err != nil {
-		zap.S().Warnw("cannot-send", "error", err, "destination", ep.Name, "service", ep.EndpointName, "serviceType", ep.EndpointType)
+		zap.S().Warnw("cannot-send", "error", err, "destination", ep.Name, "service", ep.EndpointName, "serviceType", ep.EndpointType, "session", ep.Session, "requestId", requestID)
+		if len(ep.Session) > 0 {
+			util.FailRequest(w, fmt.Errorf("agent session %s is not available for this service", ep.Session), http.StatusBadGateway)
+			return
+		}
+		if service.WaitForAgent > 0 {
+			util.FailRequest(w, fmt.Errorf("no agent connected for this service within %s", service.WaitForAgent), http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusBadGateway)
 		return
 	}
 	ep.Session = sessionID
+	sent = true
+
+	if streamBody {
+		go pumpRequestBody(routes, ep, transactionID, r.Body, window)
+	}
 
-	var handlerState = &apiHandlerState{}
+	var handlerState = &apiHandlerState{windowSize: req.WindowSize, sendWindow: window}
 	notify := r.Context().Done()
 	go handleDone(notify, routes, handlerState, ep, transactionID)
 
@@ -257,8 +572,11 @@ func runAPIHandler(routes *tunnelroute.ConnectedRoutes, ep tunnelroute.Search, w
 	for {
 		in, more := <-message.Out
 		if !more {
+			if handlerState.upgraded != nil {
+				handlerState.upgraded.Close()
+			}
 			if !handlerState.seenHeader {
-				zap.S().Warnw("timeout sending", "destination", ep.Name, "service", ep.EndpointName, "serviceType", ep.EndpointType, "session", ep.Session)
+				zap.S().Warnw("timeout sending", "destination", ep.Name, "service", ep.EndpointName, "serviceType", ep.EndpointType, "session", ep.Session, "requestId", requestID)
 				w.WriteHeader(http.StatusBadGateway)
 			}
 			handlerState.cleanClose.Set()
@@ -267,7 +585,7 @@ func runAPIHandler(routes *tunnelroute.ConnectedRoutes, ep tunnelroute.Search, w
 
 		switch x := in.Event.(type) {
 		case *tunnel.MessageWrapper_HttpTunnelControl:
-			if handleTunnelControl(ep, handlerState, x.HttpTunnelControl, w, r) {
+			if handleTunnelControl(routes, ep, handlerState, x.HttpTunnelControl, w, r) {
 				return
 			}
 		case nil:
@@ -278,10 +596,19 @@ func runAPIHandler(routes *tunnelroute.ConnectedRoutes, ep tunnelroute.Search, w
 	}
 }
 
-func handleTunnelControl(ep tunnelroute.Search, state *apiHandlerState, tunnelControl *tunnel.HttpTunnelControl, w http.ResponseWriter, r *http.Request) bool {
+func handleTunnelControl(routes *tunnelroute.ConnectedRoutes, ep tunnelroute.Search, state *apiHandlerState, tunnelControl *tunnel.HttpTunnelControl, w http.ResponseWriter, r *http.Request) bool {
 	switch controlMessage := tunnelControl.ControlType.(type) {
 	case *tunnel.HttpTunnelControl_HttpTunnelResponse:
 		resp := controlMessage.HttpTunnelResponse
+		if resp.Status == http.StatusSwitchingProtocols || (r.Method == http.MethodConnect && resp.Status == http.StatusOK) {
+			if err := startUpgrade(routes, ep, state, resp, w); err != nil {
+				zap.S().Warnw("unable to upgrade connection", "error", err, "destination", ep.Name, "service", ep.EndpointName, "serviceType", ep.EndpointType, "session", ep.Session)
+				w.WriteHeader(http.StatusBadGateway)
+				return true
+			}
+			state.seenHeader = true
+			return false
+		}
 		state.seenHeader = true
 		state.isChunked = resp.ContentLength < 0
 		copyHeaders(resp, w)
@@ -301,9 +628,33 @@ func handleTunnelControl(ep tunnelroute.Search, state *apiHandlerState, tunnelCo
 			return true
 		}
 		if len(resp.Body) == 0 {
+			if state.upgraded != nil {
+				state.upgraded.Close()
+			}
+			// Trailers are sent when the handler returns.
+			for _, trailer := range resp.Trailers {
+				if http.CanonicalHeaderKey(trailer.Name) == tunnel.ResponseTruncatedTrailer {
+					// Abort, so the client sees an incomplete response
+					// rather than one which ended normally.
+					zap.S().Warnw("response truncated by agent", "destination", ep.Name, "service", ep.EndpointName, "serviceType", ep.EndpointType, "session", ep.Session, "limit", trailer.Values)
+					state.cleanClose.Set()
+					panic(http.ErrAbortHandler)
+				}
+				for _, value := range trailer.Values {
+					w.Header().Add(http.TrailerPrefix+trailer.Name, value)
+				}
+			}
 			state.cleanClose.Set()
 			return true
 		}
+		if state.upgraded != nil {
+			if _, err := state.upgraded.Write(resp.Body); err != nil {
+				zap.S().Debugf("cannot write to upgraded connection: %v", err)
+				return true
+			}
+			state.acknowledge(routes, ep, resp.Id, len(resp.Body))
+			return false
+		}
 		n, err := w.Write(resp.Body)
 		if err != nil {
 			zap.S().Errorf("cannot write: %v", err)
@@ -322,6 +673,10 @@ func handleTunnelControl(ep tunnelroute.Search, state *apiHandlerState, tunnelCo
 		if state.isChunked {
 			state.flusher.Flush()
 		}
+		state.acknowledge(routes, ep, resp.Id, n)
+	case *tunnel.HttpTunnelControl_HttpTunnelWindowUpdate:
+		update := controlMessage.HttpTunnelWindowUpdate
+		tunnel.UpdateFlowWindow(update.Id, update.Bytes)
 	case nil:
 		// ignore for now
 	default:
@@ -329,3 +684,117 @@ func handleTunnelControl(ep tunnelroute.Search, state *apiHandlerState, tunnelCo
 	}
 	return false
 }
+
+// startUpgrade takes over the client's connection once the upstream has agreed
+// to switch protocols, or the agent has connected to the target of a CONNECT
+// request.  From here on, data read from the client is sent to the
+// session handling this request, and data from the upstream is written directly
+// to the connection.  HTTP/2 connections cannot be taken over, so upgrades only
+// work for HTTP/1.1 clients.
+func startUpgrade(routes *tunnelroute.ConnectedRoutes, ep tunnelroute.Search, state *apiHandlerState, resp *tunnel.HttpTunnelResponse, w http.ResponseWriter) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("client connection does not support upgrades")
+	}
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+
+	headers := http.Header{}
+	for _, header := range resp.Headers {
+		for _, value := range header.Values {
+			headers.Add(header.Name, value)
+		}
+	}
+	fmt.Fprintf(bufrw, "HTTP/1.1 %d %s\r\n", resp.Status, http.StatusText(int(resp.Status)))
+	if err := headers.Write(bufrw); err != nil {
+		conn.Close()
+		return err
+	}
+	if _, err := bufrw.WriteString("\r\n"); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := bufrw.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	// Reading through bufrw would cancel the request's context, and so the
+	// request, when the client closes its side, so only what the server has
+	// already buffered is read from it.
+	buffered, err := bufrw.Reader.Peek(bufrw.Reader.Buffered())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	state.upgraded = conn
+	go pumpUpgradeData(routes, ep, resp.Id, io.MultiReader(bytes.NewReader(buffered), conn), state.sendWindow)
+	return nil
+}
+
+// pumpUpgradeData reads from the client until it closes the connection, and
+// sends the data to the agent no faster than the agent acknowledges it.  A
+// zero length message is sent on EOF.
+func pumpUpgradeData(routes *tunnelroute.ConnectedRoutes, ep tunnelroute.Search, id string, r io.Reader, window *tunnel.SendWindow) {
+	for {
+		buf := make([]byte, 10240)
+		available := window.Wait(int64(len(buf)))
+		if available == 0 {
+			return
+		}
+		n, err := r.Read(buf[:available])
+		if n > 0 {
+			window.Consume(int64(n))
+			if err := routes.SendToSession(ep, &tunnelroute.HTTPUpgradeData{ID: id, Body: buf[:n]}); err != nil {
+				zap.S().Warnw("unable to send upgrade data", "error", err, "destination", ep.Name, "session", ep.Session)
+				return
+			}
+		}
+		if err != nil {
+			if err := routes.SendToSession(ep, &tunnelroute.HTTPUpgradeData{ID: id, Body: []byte{}}); err != nil {
+				zap.S().Debugw("unable to send upgrade EOF", "error", err, "destination", ep.Name, "session", ep.Session)
+			}
+			return
+		}
+	}
+}
+
+// pumpRequestBody sends a streamed request body to the agent, no faster than
+// the agent acknowledges it.  A zero length message is sent at the end of the
+// body, and the request is cancelled if the body cannot be read in full.  If
+// the request completes first, the window is closed and nothing more is sent.
+func pumpRequestBody(routes *tunnelroute.ConnectedRoutes, ep tunnelroute.Search, id string, r io.Reader, window *tunnel.SendWindow) {
+	buf := make([]byte, 10240)
+	for {
+		available := window.Wait(int64(len(buf)))
+		if available == 0 {
+			return
+		}
+		n, err := r.Read(buf[:available])
+		if n > 0 {
+			window.Consume(int64(n))
+			body := make([]byte, n)
+			copy(body, buf[:n])
+			if err := routes.SendToSession(ep, &tunnelroute.HTTPUpgradeData{ID: id, Body: body}); err != nil {
+				zap.S().Warnw("unable to send request body", "error", err, "destination", ep.Name, "session", ep.Session)
+				return
+			}
+		}
+		if err != nil && err != io.EOF {
+			// A truncated body must not look complete to the upstream.
+			zap.S().Debugw("unable to read request body", "error", err, "destination", ep.Name, "session", ep.Session)
+			if err := routes.Cancel(ep, id); err != nil {
+				zap.S().Debugw("unable to cancel request", "error", err, "destination", ep.Name, "session", ep.Session)
+			}
+			return
+		}
+		if err != nil {
+			if err := routes.SendToSession(ep, &tunnelroute.HTTPUpgradeData{ID: id, Body: []byte{}}); err != nil {
+				zap.S().Debugw("unable to send request body EOF", "error", err, "destination", ep.Name, "session", ep.Session)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,1105 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/jwtutil"
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunAPIHandler_maxRequestBodyBytes(t *testing.T) {
+	service := IncomingServiceConfig{MaxRequestBodyBytes: 10}
+	ep := tunnelroute.Search{Name: "agent", EndpointType: "jenkins", EndpointName: "jenkins"}
+
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantStatus    int
+	}{
+		// No agent is connected, so a request which passes the limit
+		// gets as far as trying to send it and fails there.
+		{"under limit", "0123456789", 10, http.StatusBadGateway},
+		{"over limit by content-length", "0123456789a", 11, http.StatusRequestEntityTooLarge},
+		{"over limit without content-length", "0123456789a", -1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader(tt.body)))
+			r.ContentLength = tt.contentLength
+			w := httptest.NewRecorder()
+			runAPIHandler(tunnelroute.MakeRoutes(), service, ep, w, r, func() {})
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
+
+func TestIncomingServiceConfig_streamRequestBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		threshold     int64
+		contentLength int64
+		want          bool
+	}{
+		{"disabled", 0, 100, false},
+		{"disabled, unknown length", 0, -1, false},
+		{"under threshold", 100, 100, false},
+		{"over threshold", 100, 101, true},
+		{"unknown length", 100, -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := IncomingServiceConfig{StreamRequestBodyBytes: tt.threshold}
+			assert.Equal(t, tt.want, service.streamRequestBody(tt.contentLength))
+		})
+	}
+}
+
+// recordingProcessor remembers the requests it is asked to run.
+type recordingProcessor struct {
+	sync.Mutex
+	ep       httpRequestProcessor
+	requests []*tunnel.OpenHTTPTunnelRequest
+}
+
+func (p *recordingProcessor) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	p.Lock()
+	p.requests = append(p.requests, req)
+	p.Unlock()
+	p.ep.ExecuteHTTPRequest(agentName, dataflow, req)
+}
+
+func TestRunAPIHandler_streamedUpload(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := sha256.New()
+		n, err := io.Copy(h, r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%d %s", n, hex.EncodeToString(h.Sum(nil)))
+	}))
+	defer upstream.Close()
+
+	generic, configured, err := MakeGenericEndpoint("jenkins", "uploads", []byte("url: "+upstream.URL), nil)
+	require.NoError(t, err)
+	require.True(t, configured)
+	recorder := &recordingProcessor{ep: generic}
+
+	routes := tunnelroute.MakeRoutes()
+	route := &tunnelroute.DirectlyConnectedRoute{
+		Name:            "upload-agent",
+		Session:         "session",
+		Endpoints:       []tunnelroute.Endpoint{{Type: "jenkins", Name: "uploads", Configured: true}},
+		InRequest:       make(chan interface{}),
+		InCancelRequest: make(chan string),
+	}
+	routes.Add(route)
+	defer routes.Remove(route, tunnelroute.DisconnectClean)
+	go runFakeAgent(route, recorder)
+
+	service := IncomingServiceConfig{
+		Destination:            "upload-agent",
+		ServiceType:            "jenkins",
+		DestinationService:     "uploads",
+		StreamRequestBodyBytes: 1024,
+	}
+	proxy := httptest.NewServer(http.HandlerFunc(fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})))
+	defer proxy.Close()
+
+	// Several times the flow control window, so the upload only completes if
+	// the agent acknowledges what it has read.
+	body := make([]byte, 8*tunnel.DefaultWindowSize)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+	sum := sha256.Sum256(body)
+	want := fmt.Sprintf("%d %s", len(body), hex.EncodeToString(sum[:]))
+
+	tests := []struct {
+		name string
+		body io.Reader
+	}{
+		{"content-length", bytes.NewReader(body)},
+		{"chunked", io.MultiReader(bytes.NewReader(body))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Timeout: 30 * time.Second}
+			resp, err := client.Post(proxy.URL+"/upload", "application/octet-stream", tt.body)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, want, string(got))
+
+			recorder.Lock()
+			req := recorder.requests[len(recorder.requests)-1]
+			recorder.Unlock()
+			assert.True(t, req.StreamBody)
+			assert.Empty(t, req.Body, "body should not be sent with the request")
+		})
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		deadline time.Duration
+		want     time.Duration
+	}{
+		{"none", "", 0, 0},
+		{"seconds", "2", 0, 2 * time.Second},
+		{"fractional seconds", "1.5", 0, 1500 * time.Millisecond},
+		{"duration", "250ms", 0, 250 * time.Millisecond},
+		{"invalid", "soon", 0, 0},
+		{"negative", "-1", 0, 0},
+		{"tiny", "1us", 0, time.Millisecond},
+		{"context deadline", "", time.Hour, time.Hour},
+		{"header sooner than deadline", "2", time.Hour, 2 * time.Second},
+		{"deadline sooner than header", "2h", time.Hour, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set(requestTimeoutHeader, tt.header)
+			}
+			if tt.deadline > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), tt.deadline)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+			got := requestTimeout(r)
+			if tt.deadline > 0 && tt.want == tt.deadline {
+				// Some of the deadline has passed by now.
+				assert.InDelta(t, float64(tt.want), float64(got), float64(time.Second))
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+	tests := []struct {
+		name    string
+		service IncomingServiceConfig
+		header  string
+		want    int32
+	}{
+		{"none", IncomingServiceConfig{}, "", 0},
+		{"service priority", IncomingServiceConfig{Priority: 5}, "", 5},
+		{"header not configured", IncomingServiceConfig{Priority: 5}, "10", 5},
+		{"header", IncomingServiceConfig{Priority: 5, PriorityHeader: "X-Priority"}, "10", 10},
+		{"negative header", IncomingServiceConfig{PriorityHeader: "X-Priority"}, "-3", -3},
+		{"missing header", IncomingServiceConfig{Priority: 5, PriorityHeader: "X-Priority"}, "", 5},
+		{"invalid header", IncomingServiceConfig{Priority: 5, PriorityHeader: "X-Priority"}, "urgent", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Priority", tt.header)
+			}
+			assert.Equal(t, tt.want, requestPriority(tt.service, r))
+			if tt.service.PriorityHeader != "" {
+				assert.Empty(t, r.Header.Get(tt.service.PriorityHeader), "header should not be sent on")
+			}
+		})
+	}
+}
+
+func TestRunAPIHandler_requestTimeout(t *testing.T) {
+	cancelled := make(chan time.Time, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- time.Now()
+		case <-time.After(10 * time.Second):
+			_, _ = w.Write([]byte("too late"))
+		}
+	}))
+	defer upstream.Close()
+
+	generic, configured, err := MakeGenericEndpoint("jenkins", "slow", []byte("url: "+upstream.URL), nil)
+	require.NoError(t, err)
+	require.True(t, configured)
+
+	routes := tunnelroute.MakeRoutes()
+	route := &tunnelroute.DirectlyConnectedRoute{
+		Name:            "timeout-agent",
+		Session:         "session",
+		Endpoints:       []tunnelroute.Endpoint{{Type: "jenkins", Name: "slow", Configured: true}},
+		InRequest:       make(chan interface{}),
+		InCancelRequest: make(chan string),
+	}
+	routes.Add(route)
+	defer routes.Remove(route, tunnelroute.DisconnectClean)
+	go runFakeAgent(route, generic)
+
+	service := IncomingServiceConfig{Destination: "timeout-agent", ServiceType: "jenkins", DestinationService: "slow"}
+	proxy := httptest.NewServer(http.HandlerFunc(fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})))
+	defer proxy.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL+"/job", nil)
+	require.NoError(t, err)
+	req.Header.Set(requestTimeoutHeader, "300ms")
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+	select {
+	case at := <-cancelled:
+		elapsed := at.Sub(start)
+		assert.GreaterOrEqual(t, elapsed, 300*time.Millisecond)
+		assert.Less(t, elapsed, 5*time.Second)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "upstream request was not cancelled")
+	}
+}
+
+// denyEndpointAuthorizer denies requests to one endpoint name, and records
+// the identities it was asked about.
+type denyEndpointAuthorizer struct {
+	sync.Mutex
+	denied     string
+	identities []ServiceIdentity
+}
+
+func (a *denyEndpointAuthorizer) Authorize(r *http.Request, identity ServiceIdentity, target tunnelroute.Search) error {
+	a.Lock()
+	defer a.Unlock()
+	a.identities = append(a.identities, identity)
+	if target.EndpointName == a.denied {
+		return fmt.Errorf("endpoint %s is not allowed", target.EndpointName)
+	}
+	return nil
+}
+
+func TestRunAPIHandler_authorizer(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	routes := tunnelroute.MakeRoutes()
+	route := &tunnelroute.DirectlyConnectedRoute{
+		Name:    "authz-agent",
+		Session: "session",
+		Endpoints: []tunnelroute.Endpoint{
+			{Type: "jenkins", Name: "public", Configured: true},
+			{Type: "jenkins", Name: "secret", Configured: true},
+		},
+		InRequest:       make(chan interface{}),
+		InCancelRequest: make(chan string),
+	}
+	routes.Add(route)
+	defer routes.Remove(route, tunnelroute.DisconnectClean)
+	generic, configured, err := MakeGenericEndpoint("jenkins", "public", []byte("url: "+upstream.URL), nil)
+	require.NoError(t, err)
+	require.True(t, configured)
+	go runFakeAgent(route, generic)
+
+	authorizer := &denyEndpointAuthorizer{denied: "secret"}
+	tests := []struct {
+		endpoint   string
+		wantStatus int
+	}{
+		{"public", http.StatusOK},
+		{"secret", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			service := IncomingServiceConfig{Destination: "authz-agent", ServiceType: "jenkins", DestinationService: tt.endpoint}
+			proxy := httptest.NewServer(http.HandlerFunc(fixedIdentityAPIHandlerMaker(routes, service, authorizer)))
+			defer proxy.Close()
+
+			resp, err := http.Get(proxy.URL + "/job")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+		})
+	}
+
+	authorizer.Lock()
+	defer authorizer.Unlock()
+	require.Len(t, authorizer.identities, 2)
+	for _, identity := range authorizer.identities {
+		assert.Equal(t, IdentityMethodFixed, identity.Method)
+	}
+}
+
+func TestRunAPIHandler_scopedCredential(t *testing.T) {
+	require.NoError(t, jwtutil.RegisterServiceauthKeyset(jwtutil.LoadTestKeys(t), "key1"))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	routes := tunnelroute.MakeRoutes()
+	route := &tunnelroute.DirectlyConnectedRoute{
+		Name:            "scoped-agent",
+		Session:         "session",
+		Endpoints:       []tunnelroute.Endpoint{{Type: "jenkins", Name: "ci", Configured: true}},
+		InRequest:       make(chan interface{}),
+		InCancelRequest: make(chan string),
+	}
+	routes.Add(route)
+	defer routes.Remove(route, tunnelroute.DisconnectClean)
+	generic, configured, err := MakeGenericEndpoint("jenkins", "ci", []byte("url: "+upstream.URL), nil)
+	require.NoError(t, err)
+	require.True(t, configured)
+	go runFakeAgent(route, generic)
+
+	scoped, err := jwtutil.MakeScopedJWT("jenkins", "ci", "scoped-agent", jwtutil.Scope{Services: []string{"service-a"}, Methods: []string{"GET"}}, nil)
+	require.NoError(t, err)
+	unscoped, err := jwtutil.MakeJWT("jenkins", "ci", "scoped-agent", nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		token      string
+		service    string
+		method     string
+		wantStatus int
+	}{
+		{"scoped, in scope", scoped, "service-a", http.MethodGet, http.StatusOK},
+		{"scoped, other service", scoped, "service-b", http.MethodGet, http.StatusForbidden},
+		{"scoped, other method", scoped, "service-a", http.MethodPost, http.StatusForbidden},
+		{"unscoped", unscoped, "service-b", http.MethodPost, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := IncomingServiceConfig{Name: tt.service, ServiceType: "jenkins"}
+			proxy := httptest.NewTLSServer(http.HandlerFunc(secureAPIHandlerMaker(routes, service, AllowAllAuthorizer{})))
+			defer proxy.Close()
+
+			req, err := http.NewRequest(tt.method, proxy.URL+"/job", nil)
+			require.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			resp, err := proxy.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestRunAPIHandler_replayedCredential(t *testing.T) {
+	require.NoError(t, jwtutil.RegisterServiceauthKeyset(jwtutil.LoadTestKeys(t), "key1"))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	routes := tunnelroute.MakeRoutes()
+	route := &tunnelroute.DirectlyConnectedRoute{
+		Name:            "replay-agent",
+		Session:         "session",
+		Endpoints:       []tunnelroute.Endpoint{{Type: "jenkins", Name: "ci", Configured: true}},
+		InRequest:       make(chan interface{}),
+		InCancelRequest: make(chan string),
+	}
+	routes.Add(route)
+	defer routes.Remove(route, tunnelroute.DisconnectClean)
+	generic, configured, err := MakeGenericEndpoint("jenkins", "ci", []byte("url: "+upstream.URL), nil)
+	require.NoError(t, err)
+	require.True(t, configured)
+	go runFakeAgent(route, generic)
+
+	authorizer := ReplayProtectingAuthorizer{
+		Cache: jwtutil.NewReplayCache(jwtutil.ReplayConfig{}),
+		Next:  AllowAllAuthorizer{},
+	}
+	service := IncomingServiceConfig{Name: "jenkins", ServiceType: "jenkins"}
+	proxy := httptest.NewTLSServer(http.HandlerFunc(secureAPIHandlerMaker(routes, service, authorizer)))
+	defer proxy.Close()
+
+	send := func(method string, token string) int {
+		req, err := http.NewRequest(method, proxy.URL+"/job", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := proxy.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	newToken := func() string {
+		token, err := jwtutil.MakeIdentifiedJWT("jenkins", "ci", "replay-agent", jwtutil.Scope{}, nil)
+		require.NoError(t, err)
+		return token
+	}
+
+	first, second := newToken(), newToken()
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, first))
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPost, first), "replayed token ID")
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, second), "distinct token ID")
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPatch, second), "replayed token ID")
+
+	// Idempotent requests may reuse the token.
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, first))
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, first))
+
+	// Tokens without a token ID cannot be tracked.
+	unidentified, err := jwtutil.MakeJWT("jenkins", "ci", "replay-agent", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, unidentified))
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, unidentified))
+
+	// A request which is not sent on does not use up its token ID, so it
+	// may be retried.
+	absent, err := jwtutil.MakeIdentifiedJWT("jenkins", "ci", "absent-agent", jwtutil.Scope{}, nil)
+	require.NoError(t, err)
+	recorded := authorizer.Cache.Len()
+	assert.Equal(t, http.StatusBadGateway, send(http.MethodPost, absent))
+	assert.Equal(t, http.StatusBadGateway, send(http.MethodPost, absent), "token ID released")
+	assert.Equal(t, recorded, authorizer.Cache.Len())
+}
+
+func TestRunAPIHandler_agentSession(t *testing.T) {
+	routes := tunnelroute.MakeRoutes()
+	for _, session := range []string{"one", "two"} {
+		session := session
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, r.Header.Get(agentSessionHeader))
+			_, _ = w.Write([]byte(session))
+		}))
+		defer upstream.Close()
+		route := &tunnelroute.DirectlyConnectedRoute{
+			Name:            "session-agent",
+			Session:         session,
+			Endpoints:       []tunnelroute.Endpoint{{Type: "jenkins", Name: "ci", Configured: true}},
+			InRequest:       make(chan interface{}),
+			InCancelRequest: make(chan string),
+		}
+		routes.Add(route)
+		defer routes.Remove(route, tunnelroute.DisconnectClean)
+		generic, configured, err := MakeGenericEndpoint("jenkins", "ci", []byte("url: "+upstream.URL), nil)
+		require.NoError(t, err)
+		require.True(t, configured)
+		go runFakeAgent(route, generic)
+	}
+
+	service := IncomingServiceConfig{Destination: "session-agent", ServiceType: "jenkins", DestinationService: "ci"}
+	proxy := httptest.NewServer(http.HandlerFunc(fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})))
+	defer proxy.Close()
+
+	tests := []struct {
+		name       string
+		session    string
+		wantStatus int
+		wantBody   string
+	}{
+		{"pinned one", "one", http.StatusOK, "one"},
+		{"pinned two", "two", http.StatusOK, "two"},
+		{"pinned gone", "three", http.StatusBadGateway, "agent session three is not available"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Repeated, as an unpinned request picks a session at random.
+			for i := 0; i < 10; i++ {
+				req, err := http.NewRequest(http.MethodGet, proxy.URL+"/job", nil)
+				require.NoError(t, err)
+				req.Header.Set(agentSessionHeader, tt.session)
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				require.NoError(t, err)
+				assert.Equal(t, tt.wantStatus, resp.StatusCode)
+				assert.Contains(t, string(body), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRunAPIHandler_allowResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Internal-Server", "pod-1.cluster.local")
+		w.Header().Set("X-Request-Id", "abc")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name        string
+		config      string
+		wantPresent []string
+		wantAbsent  []string
+	}{
+		{
+			"no list",
+			"url: " + upstream.URL,
+			[]string{"Content-Type", "X-Internal-Server", "X-Request-Id"},
+			nil,
+		},
+		{
+			"allow list",
+			"url: " + upstream.URL + "\nallowResponseHeaders: [content-type, X-Request-Id]",
+			[]string{"Content-Type", "X-Request-Id"},
+			[]string{"X-Internal-Server"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generic, configured, err := MakeGenericEndpoint("jenkins", "headers", []byte(tt.config), nil)
+			require.NoError(t, err)
+			require.True(t, configured)
+
+			routes := tunnelroute.MakeRoutes()
+			route := &tunnelroute.DirectlyConnectedRoute{
+				Name:            "headers-agent",
+				Session:         "session",
+				Endpoints:       []tunnelroute.Endpoint{{Type: "jenkins", Name: "headers", Configured: true}},
+				InRequest:       make(chan interface{}),
+				InCancelRequest: make(chan string),
+			}
+			routes.Add(route)
+			defer routes.Remove(route, tunnelroute.DisconnectClean)
+			go runFakeAgent(route, generic)
+
+			service := IncomingServiceConfig{Destination: "headers-agent", ServiceType: "jenkins", DestinationService: "headers"}
+			proxy := httptest.NewServer(http.HandlerFunc(fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})))
+			defer proxy.Close()
+
+			resp, err := http.Get(proxy.URL + "/job")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			for _, name := range tt.wantPresent {
+				assert.NotEmpty(t, resp.Header.Get(name), name)
+			}
+			for _, name := range tt.wantAbsent {
+				assert.Empty(t, resp.Header.Get(name), name)
+			}
+		})
+	}
+}
+
+// dnsFailureProcessor answers every request as if the upstream's hostname
+// did not resolve.
+type dnsFailureProcessor struct{}
+
+func (dnsFailureProcessor) ExecuteHTTPRequest(_ string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	tunnel.ReleaseRequestBody(req)
+	dataflow <- tunnel.MakeDNSFailureResponse(req.Id)
+}
+
+func TestRunAPIHandler_upstreamErrorHeader(t *testing.T) {
+	routes := tunnelroute.MakeRoutes()
+	route := &tunnelroute.DirectlyConnectedRoute{
+		Name:            "dns-agent",
+		Session:         "session",
+		Endpoints:       []tunnelroute.Endpoint{{Type: "jenkins", Name: "dns", Configured: true}},
+		InRequest:       make(chan interface{}),
+		InCancelRequest: make(chan string),
+	}
+	routes.Add(route)
+	defer routes.Remove(route, tunnelroute.DisconnectClean)
+	go runFakeAgent(route, dnsFailureProcessor{})
+
+	service := IncomingServiceConfig{Destination: "dns-agent", ServiceType: "jenkins", DestinationService: "dns"}
+	proxy := httptest.NewServer(http.HandlerFunc(fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + "/job")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.NotContains(t, resp.Header, tunnel.UpstreamErrorHeader, "the marker for the retry decision is not relayed")
+}
+
+func TestRunAPIHandler_maxResponseBytes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			_, _ = w.Write(bytes.Repeat([]byte("x"), 100))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name     string
+		limit    int
+		wantErr  bool
+		wantSize int
+	}{
+		{"under limit", 1000, false, 1000},
+		{"over limit", 250, true, 250},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := fmt.Sprintf("url: %s\nmaxResponseBytes: %d", upstream.URL, tt.limit)
+			generic, configured, err := MakeGenericEndpoint("jenkins", "logs", []byte(config), nil)
+			require.NoError(t, err)
+			require.True(t, configured)
+
+			routes := tunnelroute.MakeRoutes()
+			route := &tunnelroute.DirectlyConnectedRoute{
+				Name:            "logs-agent",
+				Session:         "session",
+				Endpoints:       []tunnelroute.Endpoint{{Type: "jenkins", Name: "logs", Configured: true}},
+				InRequest:       make(chan interface{}),
+				InCancelRequest: make(chan string),
+			}
+			routes.Add(route)
+			defer routes.Remove(route, tunnelroute.DisconnectClean)
+			go runFakeAgent(route, generic)
+
+			service := IncomingServiceConfig{Destination: "logs-agent", ServiceType: "jenkins", DestinationService: "logs"}
+			proxy := httptest.NewServer(http.HandlerFunc(fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})))
+			defer proxy.Close()
+
+			resp, err := http.Get(proxy.URL + "/log")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			if tt.wantErr {
+				require.Error(t, err, "a truncated response must not end normally")
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Len(t, body, tt.wantSize)
+		})
+	}
+}
+
+func TestRunAPIHandler_trailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = w.Write([]byte("build log"))
+		w.(http.Flusher).Flush()
+		w.Header().Set("X-Checksum", "abc123")
+		w.Header().Set(http.TrailerPrefix+"X-Build-Status", "passed")
+	}))
+	defer upstream.Close()
+
+	generic, configured, err := MakeGenericEndpoint("jenkins", "logs", []byte("url: "+upstream.URL), nil)
+	require.NoError(t, err)
+	require.True(t, configured)
+
+	routes := tunnelroute.MakeRoutes()
+	route := &tunnelroute.DirectlyConnectedRoute{
+		Name:            "trailer-agent",
+		Session:         "session",
+		Endpoints:       []tunnelroute.Endpoint{{Type: "jenkins", Name: "logs", Configured: true}},
+		InRequest:       make(chan interface{}),
+		InCancelRequest: make(chan string),
+	}
+	routes.Add(route)
+	defer routes.Remove(route, tunnelroute.DisconnectClean)
+	go runFakeAgent(route, generic)
+
+	service := IncomingServiceConfig{Destination: "trailer-agent", ServiceType: "jenkins", DestinationService: "logs"}
+	proxy := httptest.NewServer(http.HandlerFunc(fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + "/log")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "build log", string(body))
+	// Trailers are only known once the body has been read.
+	assert.Equal(t, "abc123", resp.Trailer.Get("X-Checksum"))
+	assert.Equal(t, "passed", resp.Trailer.Get("X-Build-Status"))
+}
+
+// freePort returns a port which was free on the address when checked.
+func freePort(t *testing.T, address string) uint16 {
+	l, err := net.Listen("tcp", net.JoinHostPort(address, "0"))
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", address, err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func waitForListener(t *testing.T, addr string) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.FailNow(t, "listener did not start", addr)
+}
+
+func TestRunHTTPServer_bindAddress(t *testing.T) {
+	tests := []struct {
+		name        string
+		bindAddress string
+		dialAddress string
+	}{
+		{"ipv4", "127.0.0.1", "127.0.0.1"},
+		{"ipv6", "::1", "::1"},
+		{"ipv6 with brackets", "[::1]", "::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := freePort(t, tt.dialAddress)
+			service := IncomingServiceConfig{Port: port, BindAddress: tt.bindAddress}
+			go RunHTTPServer(tunnelroute.MakeRoutes(), []IncomingServiceConfig{service}, AllowAllAuthorizer{})
+			waitForListener(t, net.JoinHostPort(tt.dialAddress, fmt.Sprint(port)))
+		})
+	}
+}
+
+func TestRunHTTPServer_bindAddressNotAllInterfaces(t *testing.T) {
+	port := freePort(t, "127.0.0.1")
+	service := IncomingServiceConfig{Port: port, BindAddress: "127.0.0.1"}
+	go RunHTTPServer(tunnelroute.MakeRoutes(), []IncomingServiceConfig{service}, AllowAllAuthorizer{})
+	waitForListener(t, net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+
+	// Had the server bound to all interfaces, this address would be in use.
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", fmt.Sprint(port)))
+	if errors.Is(err, syscall.EADDRINUSE) {
+		require.FailNow(t, "server is listening on all interfaces")
+	}
+	if err != nil {
+		t.Skipf("cannot listen on 127.0.0.2: %v", err)
+	}
+	l.Close()
+}
+
+// runFakeAgent handles requests sent to the route the way an agent would,
+// using ep for all of them.
+func runFakeAgent(route *tunnelroute.DirectlyConnectedRoute, ep httpRequestProcessor) {
+	for {
+		select {
+		case message, ok := <-route.InRequest:
+			if !ok {
+				return
+			}
+			switch m := message.(type) {
+			case *tunnelroute.HTTPMessage:
+				tunnel.PrepareRequestBody(m.Cmd)
+				go ep.ExecuteHTTPRequest(route.Name, m.Out, m.Cmd)
+			case *tunnelroute.HTTPUpgradeData:
+				_ = tunnel.WriteUpgradeData(m.ID, m.Body)
+			case *tunnelroute.HTTPWindowUpdate:
+				tunnel.UpdateFlowWindow(m.ID, m.Bytes)
+			}
+		case id, ok := <-route.InCancelRequest:
+			if !ok {
+				return
+			}
+			tunnel.CallCancelFunction(id)
+		}
+	}
+}
+
+func TestRunAPIHandler_connect(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello through the tunnel"))
+	}))
+	defer upstream.Close()
+	upstreamCAs := x509.NewCertPool()
+	upstreamCAs.AddCert(upstream.Certificate())
+
+	tests := []struct {
+		name    string
+		allowed string
+		wantErr string
+	}{
+		{"allowed", "127.0.0.1:*", ""},
+		{"not allowed", "example.com:443", "Forbidden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connect, configured, err := MakeConnectEndpoint("proxy", []byte("allowedTargets: ['"+tt.allowed+"']"))
+			require.NoError(t, err)
+			require.True(t, configured)
+
+			routes := tunnelroute.MakeRoutes()
+			route := &tunnelroute.DirectlyConnectedRoute{
+				Name:            "connect-agent",
+				Session:         "session",
+				Endpoints:       []tunnelroute.Endpoint{{Type: "connect", Name: "proxy", Configured: true}},
+				InRequest:       make(chan interface{}),
+				InCancelRequest: make(chan string),
+			}
+			routes.Add(route)
+			defer routes.Remove(route, tunnelroute.DisconnectClean)
+			go runFakeAgent(route, connect)
+
+			service := IncomingServiceConfig{Destination: "connect-agent", ServiceType: "connect", DestinationService: "proxy"}
+			handler := fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})
+			mux := http.NewServeMux()
+			mux.HandleFunc("/", handler)
+			proxy := httptest.NewServer(allowConnect(mux, handler))
+			defer proxy.Close()
+			proxyURL, err := url.Parse(proxy.URL)
+			require.NoError(t, err)
+
+			client := &http.Client{
+				Transport: &http.Transport{
+					Proxy:           http.ProxyURL(proxyURL),
+					TLSClientConfig: &tls.Config{RootCAs: upstreamCAs},
+				},
+				Timeout: 10 * time.Second,
+			}
+			resp, err := client.Get(upstream.URL)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "hello through the tunnel", string(body))
+			require.NotNil(t, resp.TLS, "the TLS handshake should be with the upstream")
+			assert.Equal(t, upstream.Certificate().Raw, resp.TLS.PeerCertificates[0].Raw)
+		})
+	}
+}
+
+func TestRunAPIHandler_connectLargeUpload(t *testing.T) {
+	// The upstream counts what it is sent, and replies once the client
+	// closes its side.
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n, _ := io.Copy(io.Discard, conn)
+		fmt.Fprintf(conn, "%d", n)
+	}()
+
+	connect, configured, err := MakeConnectEndpoint("proxy", []byte("allowedTargets: ['127.0.0.1:*']"))
+	require.NoError(t, err)
+	require.True(t, configured)
+	routes := tunnelroute.MakeRoutes()
+	route := &tunnelroute.DirectlyConnectedRoute{
+		Name:            "upload-connect-agent",
+		Session:         "session",
+		Endpoints:       []tunnelroute.Endpoint{{Type: "connect", Name: "proxy", Configured: true}},
+		InRequest:       make(chan interface{}),
+		InCancelRequest: make(chan string),
+	}
+	routes.Add(route)
+	defer routes.Remove(route, tunnelroute.DisconnectClean)
+	go runFakeAgent(route, connect)
+
+	service := IncomingServiceConfig{Destination: "upload-connect-agent", ServiceType: "connect", DestinationService: "proxy"}
+	handler := fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})
+	proxy := httptest.NewServer(allowConnect(http.NewServeMux(), handler))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(30*time.Second)))
+	target := upstream.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Several times the flow control window, so the upload only completes if
+	// the agent acknowledges what it has passed on.
+	size := 4 * tunnel.DefaultWindowSize
+	_, err = conn.Write(make([]byte, size))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d", size), string(got))
+}
+
+func TestProxyAuthorizationPassword(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"none", "", ""},
+		{"bearer", "Bearer token", "token"},
+		{"basic", "Basic dXNlcjp0b2tlbg==", "token"},
+		{"basic no password", "Basic dXNlcg==", ""},
+		{"bad base64", "Basic !!!", ""},
+		{"unknown", "Digest foo", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+			r.Header.Set("Proxy-Authorization", tt.header)
+			assert.Equal(t, tt.want, proxyAuthorizationPassword(r))
+		})
+	}
+}
+
+func TestRunAPIHandler_waitForAgent(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("served"))
+	}))
+	defer upstream.Close()
+	generic, configured, err := MakeGenericEndpoint("jenkins", "ci", []byte("url: "+upstream.URL), nil)
+	require.NoError(t, err)
+	require.True(t, configured)
+
+	tests := []struct {
+		name         string
+		waitForAgent time.Duration
+		connectAfter time.Duration
+		wantStatus   int
+	}{
+		{"no wait", 0, 100 * time.Millisecond, http.StatusBadGateway},
+		{"agent connects in time", 5 * time.Second, 100 * time.Millisecond, http.StatusOK},
+		{"agent too late", 100 * time.Millisecond, 2 * time.Second, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes := tunnelroute.MakeRoutes()
+			route := &tunnelroute.DirectlyConnectedRoute{
+				Name:            "restarting-agent",
+				Session:         "session",
+				Endpoints:       []tunnelroute.Endpoint{{Type: "jenkins", Name: "ci", Configured: true}},
+				InRequest:       make(chan interface{}),
+				InCancelRequest: make(chan string),
+			}
+			timer := time.AfterFunc(tt.connectAfter, func() {
+				routes.Add(route)
+				go runFakeAgent(route, generic)
+			})
+			defer func() {
+				if !timer.Stop() {
+					routes.Remove(route, tunnelroute.DisconnectClean)
+				}
+			}()
+
+			service := IncomingServiceConfig{
+				Destination:        "restarting-agent",
+				ServiceType:        "jenkins",
+				DestinationService: "ci",
+				WaitForAgent:       tt.waitForAgent,
+			}
+			proxy := httptest.NewServer(http.HandlerFunc(fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})))
+			defer proxy.Close()
+
+			resp, err := http.Get(proxy.URL + "/job")
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode, string(body))
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, "served", string(body))
+			}
+		})
+	}
+}
+
+// nameRecorder records the endpoint name of each request it passes on.
+type nameRecorder struct {
+	names chan string
+	next  httpRequestProcessor
+}
+
+func (n *nameRecorder) ExecuteHTTPRequest(agentName string, dataflow chan *tunnel.MessageWrapper, req *tunnel.OpenHTTPTunnelRequest) {
+	n.names <- req.Name
+	n.next.ExecuteHTTPRequest(agentName, dataflow, req)
+}
+
+func TestRunAPIHandler_endpointAlias(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	generic, configured, err := MakeGenericEndpoint("jenkins", "jenkins1", []byte("url: "+upstream.URL), nil)
+	require.NoError(t, err)
+	require.True(t, configured)
+	recorder := &nameRecorder{names: make(chan string, 1), next: generic}
+
+	routes := tunnelroute.MakeRoutes()
+	// The second alias would make a chain to an endpoint the agent does not
+	// have, which is only followed if the alias is resolved more than once.
+	routes.SetEndpointAliases(tunnelroute.EndpointAliases{
+		{Type: "jenkins", Alias: "old-jenkins", Name: "jenkins1"},
+		{Agent: "alias-agent", Type: "jenkins", Alias: "jenkins1", Name: "jenkins2"},
+	})
+	route := &tunnelroute.DirectlyConnectedRoute{
+		Name:            "alias-agent",
+		Session:         "session",
+		Endpoints:       []tunnelroute.Endpoint{{Type: "jenkins", Name: "jenkins1", Configured: true}},
+		InRequest:       make(chan interface{}),
+		InCancelRequest: make(chan string),
+	}
+	routes.Add(route)
+	defer routes.Remove(route, tunnelroute.DisconnectClean)
+	go runFakeAgent(route, recorder)
+
+	service := IncomingServiceConfig{Destination: "alias-agent", ServiceType: "jenkins", DestinationService: "old-jenkins"}
+	proxy := httptest.NewServer(http.HandlerFunc(fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + "/job")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "jenkins1", <-recorder.names, "the agent is sent the endpoint's real name")
+
+	// Metrics are labelled with the real name too.
+	assert.Equal(t, 1.0, testutil.ToFloat64(apiRequestCounter.WithLabelValues("alias-agent", "jenkins1")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(apiRequestCounter.WithLabelValues("alias-agent", "old-jenkins")))
+}
@@ -22,7 +22,9 @@ package serviceconfig
 
 import (
 	"os"
+	"time"
 
+	"github.com/opsmx/oes-birger/internal/tunnel"
 	"gopkg.in/yaml.v3"
 )
 
@@ -30,16 +32,100 @@ import (
 // "http" or "auto" for the service type, and lock the destination down to a
 // specific outgoing service on a specific agent.  If not specified, the
 // type, destination, service will be detected based on credentials provided.
+//
+// WindowSize is the number of response bytes which may be in flight for
+// each request before the sender waits for an acknowledgement.  If zero,
+// tunnel.DefaultWindowSize is used, and if negative, flow control is disabled.
+//
+// BindAddress is the address to listen on, which defaults to all interfaces.
+//
+// MaxRequestBodyBytes, if set, rejects requests with a larger body with
+// a 413 status before they are sent to the agent.
+//
+// MaxHeaderBytes, if set, limits the size of a request's headers, in place
+// of the net/http default of 1 MiB.  Larger requests get a 431 status.
+//
+// Hostnames lets several services share a port.  Each request goes to the
+// service listing its Host header, or to the one service on the port
+// without Hostnames if none do.
+//
+// TrustUserHeader signs any X-Spinnaker-User header a client sends, rather
+// than only passing on values the controller signed itself.  Only set this
+// for ports which untrusted clients cannot reach.
+//
+// WaitForAgent, if set, holds a request for an endpoint no agent serves
+// for up to this long, sending it when an agent connects, such as after a
+// restart.  If none does in time, the request gets a 503 status.
+//
+// NextProtos, if set, are the only ALPN protocols offered on the port, in
+// order of preference.  All services sharing a port must list the same.
+//
+// Priority is sent with each request, so an agent at its concurrency limit
+// for the endpoint starts higher priority requests first.  PriorityHeader,
+// if set, names a header a client may send to override it with its own
+// integer priority.  The header is not sent on to the agent.
 type IncomingServiceConfig struct {
 	Name               string `yaml:"name,omitempty"`
 	Port               uint16 `yaml:"port,omitempty"`
+	BindAddress        string `yaml:"bindAddress,omitempty"`
 	UseHTTP            bool   `yaml:"useHTTP,omitempty"`
 	ServiceType        string `yaml:"serviceType,omitempty"`
 	Destination        string `yaml:"destination,omitempty"`
 	DestinationService string `yaml:"destinationService,omitempty"`
+	WindowSize         int64  `yaml:"windowSize,omitempty"`
+
+	MaxRequestBodyBytes    int64 `yaml:"maxRequestBodyBytes,omitempty"`
+	StreamRequestBodyBytes int64 `yaml:"streamRequestBodyBytes,omitempty"`
+	MaxHeaderBytes         int   `yaml:"maxHeaderBytes,omitempty"`
+
+	TrustUserHeader bool `yaml:"trustUserHeader,omitempty"`
+
+	WaitForAgent time.Duration `yaml:"waitForAgent,omitempty"`
+
+	NextProtos []string `yaml:"nextProtos,omitempty"`
+
+	Priority       int32  `yaml:"priority,omitempty"`
+	PriorityHeader string `yaml:"priorityHeader,omitempty"`
+
+	Hostnames []string `yaml:"hostnames,omitempty"`
+}
+
+func (s IncomingServiceConfig) windowSize() int64 {
+	if s.WindowSize < 0 {
+		return 0
+	}
+	if s.WindowSize == 0 {
+		return tunnel.DefaultWindowSize
+	}
+	return s.WindowSize
+}
+
+// streamRequestBody returns true if a request body of contentLength bytes
+// (-1 if unknown) should be streamed to the agent rather than sent with
+// the request.  Streaming is off unless StreamRequestBodyBytes is set, as
+// older agents cannot receive a streamed body.
+func (s IncomingServiceConfig) streamRequestBody(contentLength int64) bool {
+	if s.StreamRequestBodyBytes <= 0 {
+		return false
+	}
+	return contentLength < 0 || contentLength > s.StreamRequestBodyBytes
 }
 
 // OutgoingServiceConfig defines a way to reach out to another service, such as Jenkins.
+//
+// MaxConcurrency and Weight, if set, are sent to the controller to override
+// its defaults for the endpoint, within the bounds it allows.  The agent
+// also runs no more than MaxConcurrency requests to the endpoint at once,
+// starting those waiting highest priority first.
+//
+// CoalesceGETs, if set, lets identical GET requests which are in flight at
+// the same time share one request to the service.
+//
+// Cache, if its TTL is set, answers repeated GET requests from responses
+// the agent has already seen.
+//
+// AccessLog, if enabled, logs requests as they complete, including those
+// answered from the cache.
 type OutgoingServiceConfig struct {
 	Enabled     bool                        `yaml:"enabled"`
 	Name        string                      `yaml:"name"`
@@ -49,6 +135,15 @@ type OutgoingServiceConfig struct {
 	Namespaces  []serviceNamespace          `yaml:"namespaces,omitempty"`
 	AccountID   string                      `yaml:"accountId,omitempty"`
 	AssumeRole  string                      `yaml:"assumeRole,omitempty"`
+
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuitBreaker,omitempty"`
+	Retry          RetryConfig          `yaml:"retry,omitempty"`
+	CoalesceGETs   bool                 `yaml:"coalesceGets,omitempty"`
+	Cache          ResponseCacheConfig  `yaml:"cache,omitempty"`
+	AccessLog      AccessLogConfig      `yaml:"accessLog,omitempty"`
+
+	MaxConcurrency int `yaml:"maxConcurrency,omitempty"`
+	Weight         int `yaml:"weight,omitempty"`
 }
 
 type serviceNamespace struct {
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// tokenFileCheckInterval is how often a token file is checked for a
+	// rotated token.  The kubelet refreshes projected tokens well before
+	// they expire, so this need not be short.
+	tokenFileCheckInterval = 10 * time.Second
+
+	// tokenExpiryMargin is how long before its expiry a token is re-read
+	// on every use, to catch a rotation as soon as it happens.
+	tokenExpiryMargin = 30 * time.Second
+)
+
+// tokenFile holds a bearer token read from a file which is replaced as the
+// token rotates, such as a projected service account token.  The file is
+// checked for changes at most every tokenFileCheckInterval, and whenever
+// the token is close to the expiry in its "exp" claim.
+type tokenFile struct {
+	sync.Mutex
+	path    string
+	token   string
+	modTime time.Time
+	size    int64
+	expiry  time.Time
+	checked time.Time
+	now     func() time.Time
+}
+
+func newTokenFile(path string) (*tokenFile, error) {
+	f := &tokenFile{path: path, now: time.Now}
+	if err := f.reload(f.now()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *tokenFile) reload(now time.Time) error {
+	f.checked = now
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	nearExpiry := !f.expiry.IsZero() && now.After(f.expiry.Add(-tokenExpiryMargin))
+	if f.token != "" && info.ModTime().Equal(f.modTime) && info.Size() == f.size && !nearExpiry {
+		return nil
+	}
+	contents, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(contents))
+	if token != f.token && f.token != "" {
+		zap.S().Infow("service account token rotated", "path", f.path)
+	}
+	f.token = token
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.expiry = tokenExpiry(token)
+	return nil
+}
+
+// Token returns the current token.  If the file cannot be read, the last
+// token read is returned.
+func (f *tokenFile) Token() string {
+	f.Lock()
+	defer f.Unlock()
+	now := f.now()
+	due := now.Sub(f.checked) >= tokenFileCheckInterval
+	if !f.expiry.IsZero() && now.After(f.expiry.Add(-tokenExpiryMargin)) {
+		due = true
+	}
+	if due {
+		if err := f.reload(now); err != nil {
+			zap.S().Warnw("unable to re-read token file, using the previous token", "path", f.path, "error", err)
+		}
+	}
+	return f.token
+}
+
+// tokenExpiry returns the time in a JWT's "exp" claim, or the zero time if
+// the token is not a JWT or has no expiry.  The signature is not checked,
+// as this is only used to decide when to look for a new token.
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
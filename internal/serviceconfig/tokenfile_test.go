@@ -0,0 +1,129 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeJWT returns an unsigned token with the given subject and expiry.
+func fakeJWT(subject string, exp time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":%q,"exp":%d}`, subject, exp.Unix())))
+	return header + "." + payload + ".signature"
+}
+
+// writeToken replaces the token file, giving it a distinct modification
+// time as a kubelet rotation would.
+func writeToken(t *testing.T, path string, token string, modTime time.Time) {
+	require.NoError(t, os.WriteFile(path, []byte(token+"\n"), 0600))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func makeTestTokenFile(t *testing.T, token string) (*tokenFile, *fakeClock, string) {
+	path := filepath.Join(t.TempDir(), "token")
+	writeToken(t, path, token, time.Unix(1000, 0))
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	f := &tokenFile{path: path, now: clock.now}
+	require.NoError(t, f.reload(clock.now()))
+	return f, clock, path
+}
+
+func TestTokenExpiry(t *testing.T) {
+	exp := time.Unix(2000, 0)
+	assert.Equal(t, exp, tokenExpiry(fakeJWT("user", exp)))
+	assert.True(t, tokenExpiry("opaque-token").IsZero())
+	assert.True(t, tokenExpiry("a.!!!.c").IsZero())
+	noExp := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user"}`))
+	assert.True(t, tokenExpiry("a."+noExp+".c").IsZero())
+}
+
+func TestTokenFile_rotation(t *testing.T) {
+	f, clock, path := makeTestTokenFile(t, "token1")
+	assert.Equal(t, "token1", f.Token())
+
+	writeToken(t, path, "token2", time.Unix(1005, 0))
+
+	// Not checked again until the interval has passed.
+	clock.t = clock.t.Add(tokenFileCheckInterval / 2)
+	assert.Equal(t, "token1", f.Token())
+
+	clock.t = clock.t.Add(tokenFileCheckInterval / 2)
+	assert.Equal(t, "token2", f.Token())
+}
+
+func TestTokenFile_nearExpiry(t *testing.T) {
+	expiry := time.Unix(1000, 0).Add(time.Hour)
+	f, clock, path := makeTestTokenFile(t, fakeJWT("token1", expiry))
+
+	rotated := fakeJWT("token2", expiry.Add(time.Hour))
+	writeToken(t, path, rotated, time.Unix(1005, 0))
+
+	// Close to expiry, the file is checked on every use.
+	clock.t = expiry.Add(-tokenExpiryMargin / 2)
+	f.checked = clock.t
+	assert.Equal(t, rotated, f.Token())
+	assert.Equal(t, expiry.Add(time.Hour), f.expiry)
+}
+
+func TestTokenFile_unreadable(t *testing.T) {
+	f, clock, path := makeTestTokenFile(t, "token1")
+	require.NoError(t, os.Remove(path))
+
+	clock.t = clock.t.Add(tokenFileCheckInterval)
+	assert.Equal(t, "token1", f.Token())
+}
+
+func TestKubernetesEndpoint_ExecuteHTTPRequest_rotatedToken(t *testing.T) {
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+
+	f, clock, path := makeTestTokenFile(t, "token1")
+	ke := &KubernetesEndpoint{saToken: f}
+	ke.f = kubeContext{serverURL: upstream.URL, tokenFile: f}
+	ke.f.client = ke.makeClient(&ke.f)
+
+	execute := func() {
+		dataflow := make(chan *tunnel.MessageWrapper, 10)
+		ke.ExecuteHTTPRequest("", dataflow, &tunnel.OpenHTTPTunnelRequest{Id: "id", Method: http.MethodGet, URI: "/api"})
+		resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+		require.NotNil(t, resp)
+		assert.Equal(t, int32(http.StatusOK), resp.Status)
+	}
+
+	execute()
+	assert.Equal(t, "Bearer token1", received)
+
+	writeToken(t, path, "token2", time.Unix(1005, 0))
+	clock.t = clock.t.Add(tokenFileCheckInterval)
+	execute()
+	assert.Equal(t, "Bearer token2", received)
+}
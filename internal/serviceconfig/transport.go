@@ -0,0 +1,299 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	defaultMaxIdleConns    = 10
+	defaultIdleConnTimeout = 30 * time.Second
+	defaultDialTimeout     = 30 * time.Second
+	defaultTCPKeepAlive    = 30 * time.Second
+)
+
+// transportConfig tunes the connection pool used to reach an endpoint.
+// Unset values keep the defaults above, or Go's defaults for those
+// not listed, where MaxConnsPerHost and TLSHandshakeTimeout are unlimited.
+//
+// HostOverrides maps a host, or host:port, to the address to connect to
+// instead, as an IP address or host name with an optional port.  TLS
+// server names and certificate verification still use the original host.
+//
+// Proxy, if set, is the proxy all connections to the endpoint go through,
+// as an http, https, or socks5 URL, with optional user:password
+// credentials.  The environment's proxy settings are never used.
+//
+// TCPKeepAlive is how long a connection may be idle before TCP keepalive
+// probes are sent, so those dropped by a firewall are noticed.  It
+// defaults to defaultTCPKeepAlive, and negative disables keepalives.
+//
+// TLSSessionCacheSize, if set, keeps up to that many TLS sessions so new
+// connections can resume one rather than make a full handshake.
+// TLSRenegotiation is whether a TLS 1.2 server may renegotiate: "never",
+// the default, "once", or "freely".
+type transportConfig struct {
+	MaxIdleConns        int           `yaml:"maxIdleConns,omitempty"`
+	MaxIdleConnsPerHost int           `yaml:"maxIdleConnsPerHost,omitempty"`
+	MaxConnsPerHost     int           `yaml:"maxConnsPerHost,omitempty"`
+	IdleConnTimeout     time.Duration `yaml:"idleConnTimeout,omitempty"`
+	TLSHandshakeTimeout time.Duration `yaml:"tlsHandshakeTimeout,omitempty"`
+	TCPKeepAlive        time.Duration `yaml:"tcpKeepAlive,omitempty"`
+
+	HostOverrides map[string]string `yaml:"hostOverrides,omitempty"`
+
+	Proxy string `yaml:"proxy,omitempty"`
+
+	TLSSessionCacheSize int    `yaml:"tlsSessionCacheSize,omitempty"`
+	TLSRenegotiation    string `yaml:"tlsRenegotiation,omitempty"`
+}
+
+var tlsRenegotiationSupport = map[string]tls.RenegotiationSupport{
+	"":       tls.RenegotiateNever,
+	"never":  tls.RenegotiateNever,
+	"once":   tls.RenegotiateOnceAsClient,
+	"freely": tls.RenegotiateFreelyAsClient,
+}
+
+// validate checks the settings makeClient cannot report problems with.
+func (c transportConfig) validate() error {
+	if c.TLSSessionCacheSize < 0 {
+		return fmt.Errorf("tlsSessionCacheSize must not be negative")
+	}
+	if _, found := tlsRenegotiationSupport[c.TLSRenegotiation]; !found {
+		return fmt.Errorf("tlsRenegotiation must be never, once, or freely, not %q", c.TLSRenegotiation)
+	}
+	proxyURL, err := c.proxyURL()
+	if err != nil {
+		return err
+	}
+	if proxyURL != nil && proxyURL.Scheme != "socks5" && len(c.HostOverrides) > 0 {
+		return fmt.Errorf("hostOverrides cannot be used with an %s proxy, which resolves hosts itself", proxyURL.Scheme)
+	}
+	return nil
+}
+
+// proxyURL returns the parsed Proxy, or nil if none is set.
+func (c transportConfig) proxyURL() (*url.URL, error) {
+	if c.Proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(c.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("proxy scheme must be http, https, or socks5, not %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy %q has no host", c.Proxy)
+	}
+	return u, nil
+}
+
+// dialer returns the dialer used to connect to the endpoint, or to its
+// SOCKS5 proxy.
+func (c transportConfig) dialer() *net.Dialer {
+	keepAlive := c.TCPKeepAlive
+	if keepAlive == 0 {
+		keepAlive = defaultTCPKeepAlive
+	}
+	return &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: keepAlive}
+}
+
+// dialContext returns the function connections to the endpoint are made
+// with, through the host overrides and any SOCKS5 proxy.  An HTTP proxy is
+// used by the transport instead.
+func (c transportConfig) dialContext() func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	dialer := c.dialer()
+	// The proxy URL has been checked by validate.
+	if proxyURL, _ := c.proxyURL(); proxyURL != nil && proxyURL.Scheme == "socks5" {
+		return socks5Dialer(dialer, proxyURL, c.HostOverrides)
+	}
+	if len(c.HostOverrides) > 0 {
+		return hostOverrideDialer(dialer, c.HostOverrides)
+	}
+	return dialer.DialContext
+}
+
+// applyTLS applies the TLS session cache and renegotiation settings to
+// tlsConfig, if it is not nil.
+func (c transportConfig) applyTLS(tlsConfig *tls.Config) {
+	if tlsConfig == nil {
+		return
+	}
+	if c.TLSSessionCacheSize > 0 {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(c.TLSSessionCacheSize)
+	}
+	tlsConfig.Renegotiation = tlsRenegotiationSupport[c.TLSRenegotiation]
+}
+
+// makeClient returns a client whose transport should be kept and reused
+// for all requests to the endpoint, so connections are pooled, and TLS
+// sessions cached.  The TLS settings are applied to tlsConfig.
+func (c transportConfig) makeClient(tlsConfig *tls.Config) *http.Client {
+	c.applyTLS(tlsConfig)
+	tr := &http.Transport{
+		MaxIdleConns:        c.MaxIdleConns,
+		MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     c.MaxConnsPerHost,
+		IdleConnTimeout:     c.IdleConnTimeout,
+		TLSHandshakeTimeout: c.TLSHandshakeTimeout,
+		DisableCompression:  true,
+		TLSClientConfig:     tlsConfig,
+		DialContext:         c.dialContext(),
+	}
+	if tr.MaxIdleConns <= 0 {
+		tr.MaxIdleConns = defaultMaxIdleConns
+	}
+	if tr.IdleConnTimeout <= 0 {
+		tr.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if proxyURL, _ := c.proxyURL(); proxyURL != nil && proxyURL.Scheme != "socks5" {
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	return &http.Client{
+		Transport: tr,
+	}
+}
+
+// validateHTTP2 checks the settings as validate does, and that they can
+// be used by makeHTTP2Client.
+func (c transportConfig) validateHTTP2() error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if proxyURL, _ := c.proxyURL(); proxyURL != nil && proxyURL.Scheme != "socks5" {
+		return fmt.Errorf("only a socks5 proxy can be used for HTTP/2, not %s", proxyURL.Scheme)
+	}
+	return nil
+}
+
+// makeHTTP2Client returns a client which only speaks HTTP/2, over TLS
+// using tlsConfig, or without TLS if plaintext is set.  It is made with
+// the same dialer and TLS settings as makeClient.  Requests share a few
+// connections rather than using a pool, so the connection pool settings do
+// not apply.
+func (c transportConfig) makeHTTP2Client(tlsConfig *tls.Config, plaintext bool) *http.Client {
+	c.applyTLS(tlsConfig)
+	dial := c.dialContext()
+	tr := &http2.Transport{
+		TLSClientConfig:    tlsConfig,
+		AllowHTTP:          plaintext,
+		DisableCompression: true,
+	}
+	tr.DialTLSContext = func(ctx context.Context, network string, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil || plaintext {
+			return conn, err
+		}
+		return c.handshakeHTTP2(ctx, conn, tlsConfig)
+	}
+	return &http.Client{
+		Transport: tr,
+	}
+}
+
+// handshakeHTTP2 makes the TLS handshake on conn, which must negotiate
+// HTTP/2, within TLSHandshakeTimeout if it is set.
+func (c transportConfig) handshakeHTTP2(ctx context.Context, conn net.Conn, tlsConfig *tls.Config) (net.Conn, error) {
+	if c.TLSHandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.TLSHandshakeTimeout)
+		defer cancel()
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		conn.Close()
+		return nil, fmt.Errorf("server negotiated %q rather than HTTP/2", p)
+	}
+	return tlsConn, nil
+}
+
+// overrideAddress returns the address to dial in place of addr, a
+// host:port, using overrides keyed by host:port or host.
+func overrideAddress(overrides map[string]string, addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	host = strings.ToLower(host)
+	target, found := overrides[net.JoinHostPort(host, port)]
+	if !found {
+		if target, found = overrides[host]; !found {
+			return addr
+		}
+	}
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target
+	}
+	return net.JoinHostPort(strings.Trim(target, "[]"), port)
+}
+
+// socks5Dialer returns a dialer which connects through the SOCKS5 proxy,
+// asking it for the override address, if any, in place of the original.
+// The proxy is reached with forward.
+func socks5Dialer(forward *net.Dialer, proxyURL *url.URL, overrides map[string]string) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+	addr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		addr = net.JoinHostPort(proxyURL.Hostname(), "1080")
+	}
+	// SOCKS5 never returns an error.
+	dialer, _ := proxy.SOCKS5("tcp", addr, auth, forward)
+	contextDialer := dialer.(proxy.ContextDialer)
+	normalized := normalizeOverrides(overrides)
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return contextDialer.DialContext(ctx, network, overrideAddress(normalized, addr))
+	}
+}
+
+func hostOverrideDialer(dialer *net.Dialer, overrides map[string]string) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	normalized := normalizeOverrides(overrides)
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, overrideAddress(normalized, addr))
+	}
+}
+
+func normalizeOverrides(overrides map[string]string) map[string]string {
+	normalized := map[string]string{}
+	for from, to := range overrides {
+		normalized[strings.ToLower(from)] = to
+	}
+	return normalized
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+// keepAliveOptions returns whether keepalives are enabled on the
+// connection, and how long in seconds it is idle before the first probe.
+func keepAliveOptions(t *testing.T, conn net.Conn) (bool, int) {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var enabled, idle int
+	var sockErr error
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		enabled, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		if sockErr != nil {
+			return
+		}
+		idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	}))
+	require.NoError(t, sockErr)
+	return enabled != 0, idle
+}
+
+func TestTransportConfig_tcpKeepAlive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name        string
+		config      transportConfig
+		wantEnabled bool
+		wantIdle    int
+	}{
+		{"default", transportConfig{}, true, int(defaultTCPKeepAlive / time.Second)},
+		{"set", transportConfig{TCPKeepAlive: 45 * time.Second}, true, 45},
+		{"host overrides", transportConfig{TCPKeepAlive: 20 * time.Second, HostOverrides: map[string]string{"example.com": "127.0.0.1"}}, true, 20},
+		{"disabled", transportConfig{TCPKeepAlive: -1}, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := tt.config.makeClient(nil).Transport.(*http.Transport)
+			conn, err := tr.DialContext(context.Background(), "tcp", listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			enabled, idle := keepAliveOptions(t, conn)
+			assert.Equal(t, tt.wantEnabled, enabled)
+			if tt.wantEnabled {
+				assert.Equal(t, tt.wantIdle, idle)
+			}
+		})
+		t.Run(tt.name+" http2", func(t *testing.T) {
+			tr := tt.config.makeHTTP2Client(nil, true).Transport.(*http2.Transport)
+			conn, err := tr.DialTLSContext(context.Background(), "tcp", listener.Addr().String(), nil)
+			require.NoError(t, err)
+			defer conn.Close()
+			enabled, idle := keepAliveOptions(t, conn)
+			assert.Equal(t, tt.wantEnabled, enabled)
+			if tt.wantEnabled {
+				assert.Equal(t, tt.wantIdle, idle)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/opsmx/oes-birger/internal/jwtutil"
+	"go.uber.org/zap"
+)
+
+// spinnakerUserHeader carries the user a Spinnaker request is made on behalf
+// of.  When a mutation keyset is registered, tunnel.MakeHeaders signs it
+// before it is sent to an agent.
+const spinnakerUserHeader = "X-Spinnaker-User"
+
+// verifyUserHeader makes sure the user header only carries an identity the
+// controller has signed.  A signed value is verified and replaced with the
+// user it names, to be signed again when the request is sent, and a value
+// which fails verification is an error.  An unsigned value could name anyone,
+// so it is removed unless the service is configured to trust it.  Nothing is
+// done if no mutation keyset is registered.
+func verifyUserHeader(service IncomingServiceConfig, headers http.Header, clock jwt.Clock) error {
+	if !jwtutil.MutationIsRegistered() || service.TrustUserHeader {
+		return nil
+	}
+	value := headers.Get(spinnakerUserHeader)
+	if value == "" {
+		headers.Del(spinnakerUserHeader)
+		return nil
+	}
+	if !looksSigned(value) {
+		zap.S().Debugw("removing unsigned user header", "service", service.Name)
+		headers.Del(spinnakerUserHeader)
+		return nil
+	}
+	user, err := jwtutil.UnmutateHeader([]byte(value), clock)
+	if err != nil {
+		return fmt.Errorf("%s: %v", spinnakerUserHeader, err)
+	}
+	headers.Set(spinnakerUserHeader, user)
+	return nil
+}
+
+// looksSigned returns true if the value has the three parts of a JWT.
+func looksSigned(value string) bool {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
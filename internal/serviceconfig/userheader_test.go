@@ -0,0 +1,149 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opsmx/oes-birger/internal/jwtutil"
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func registerTestMutationKeys(t *testing.T) {
+	require.NoError(t, jwtutil.RegisterMutationKeyset(jwtutil.LoadTestKeys(t), "key1"))
+	t.Cleanup(jwtutil.UnregisterMutationKeyset)
+}
+
+func signUser(t *testing.T, user string) string {
+	signed, err := jwtutil.MutateHeader(user, nil)
+	require.NoError(t, err)
+	return string(signed)
+}
+
+// forge returns a token with the signature of another, so the signature
+// will not match its contents.
+func forge(t *testing.T, user string, signatureFrom string) string {
+	token := signUser(t, user)
+	other := signUser(t, signatureFrom)
+	return token[:strings.LastIndex(token, ".")] + other[strings.LastIndex(other, "."):]
+}
+
+func TestVerifyUserHeader(t *testing.T) {
+	registerTestMutationKeys(t)
+
+	tests := []struct {
+		name     string
+		service  IncomingServiceConfig
+		value    string
+		want     string
+		wantSent bool
+		wantErr  bool
+	}{
+		{"no header", IncomingServiceConfig{}, "", "", false, false},
+		{"signed", IncomingServiceConfig{}, signUser(t, "alice"), "alice", true, false},
+		{"forged", IncomingServiceConfig{}, forge(t, "mallory", "alice"), "", false, true},
+		{"garbled", IncomingServiceConfig{}, "not.a.token", "", false, true},
+		{"unsigned", IncomingServiceConfig{}, "mallory", "", false, false},
+		{"unsigned trusted", IncomingServiceConfig{TrustUserHeader: true}, "alice", "alice", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.value != "" {
+				headers.Set(spinnakerUserHeader, tt.value)
+			}
+			err := verifyUserHeader(tt.service, headers, nil)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			_, sent := headers[spinnakerUserHeader]
+			assert.Equal(t, tt.wantSent, sent)
+			assert.Equal(t, tt.want, headers.Get(spinnakerUserHeader))
+		})
+	}
+}
+
+func TestVerifyUserHeader_notRegistered(t *testing.T) {
+	jwtutil.UnregisterMutationKeyset()
+	headers := http.Header{spinnakerUserHeader: {"alice"}}
+	require.NoError(t, verifyUserHeader(IncomingServiceConfig{}, headers, nil))
+	assert.Equal(t, "alice", headers.Get(spinnakerUserHeader))
+}
+
+func TestRunAPIHandler_userHeader(t *testing.T) {
+	registerTestMutationKeys(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get(spinnakerUserHeader)))
+	}))
+	defer upstream.Close()
+
+	generic, configured, err := MakeGenericEndpoint("jenkins", "users", []byte("url: "+upstream.URL), nil)
+	require.NoError(t, err)
+	require.True(t, configured)
+
+	routes := tunnelroute.MakeRoutes()
+	route := &tunnelroute.DirectlyConnectedRoute{
+		Name:            "user-agent",
+		Session:         "session",
+		Endpoints:       []tunnelroute.Endpoint{{Type: "jenkins", Name: "users", Configured: true}},
+		InRequest:       make(chan interface{}),
+		InCancelRequest: make(chan string),
+	}
+	routes.Add(route)
+	defer routes.Remove(route, tunnelroute.DisconnectClean)
+	go runFakeAgent(route, generic)
+
+	service := IncomingServiceConfig{Destination: "user-agent", ServiceType: "jenkins", DestinationService: "users"}
+	proxy := httptest.NewServer(http.HandlerFunc(fixedIdentityAPIHandlerMaker(routes, service, AllowAllAuthorizer{})))
+	defer proxy.Close()
+
+	tests := []struct {
+		name       string
+		value      string
+		wantStatus int
+		wantUser   string
+	}{
+		{"signed", signUser(t, "alice"), http.StatusOK, "alice"},
+		{"forged", forge(t, "mallory", "alice"), http.StatusForbidden, ""},
+		{"unsigned", "mallory", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, proxy.URL+"/whoami", nil)
+			require.NoError(t, err)
+			req.Header.Set(spinnakerUserHeader, tt.value)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantStatus == http.StatusOK {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, tt.wantUser, string(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	"github.com/opsmx/oes-birger/internal/util"
+	"gopkg.in/yaml.v3"
+)
+
+var genericCredentialTypes = map[string]bool{
+	"":       true,
+	"none":   true,
+	"basic":  true,
+	"bearer": true,
+	"token":  true,
+}
+
+// Validate checks the service configuration, and returns every problem
+// found rather than stopping at the first.  Endpoint specific settings are
+// checked when the endpoint is configured, except for generic credential
+// types, which are checked here.
+func (c *ServiceConfig) Validate() []error {
+	problems := []error{}
+
+	ports := map[uint16]*sharedPort{}
+	for i, service := range c.IncomingServices {
+		name := service.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+			problems = append(problems, fmt.Errorf("incomingServices[%d]: name is required", i))
+		}
+		if service.Port == 0 {
+			problems = append(problems, fmt.Errorf("incomingServices %s: port is required", name))
+		} else {
+			port, found := ports[service.Port]
+			if !found {
+				port = &sharedPort{hostnames: map[string]string{}}
+				ports[service.Port] = port
+			}
+			for _, err := range port.add(service, name) {
+				problems = append(problems, fmt.Errorf("incomingServices %s: %v", name, err))
+			}
+		}
+		// Plain HTTP services have no credentials to route by, so always
+		// send to the same place.
+		if service.UseHTTP {
+			if service.Destination == "" {
+				problems = append(problems, fmt.Errorf("incomingServices %s: destination is required with useHTTP", name))
+			}
+			if service.ServiceType == "" {
+				problems = append(problems, fmt.Errorf("incomingServices %s: serviceType is required with useHTTP", name))
+			}
+			if service.DestinationService == "" {
+				problems = append(problems, fmt.Errorf("incomingServices %s: destinationService is required with useHTTP", name))
+			}
+		}
+		if service.MaxRequestBodyBytes < 0 {
+			problems = append(problems, fmt.Errorf("incomingServices %s: maxRequestBodyBytes must not be negative", name))
+		}
+		if service.StreamRequestBodyBytes < 0 {
+			problems = append(problems, fmt.Errorf("incomingServices %s: streamRequestBodyBytes must not be negative", name))
+		}
+		if service.MaxHeaderBytes < 0 {
+			problems = append(problems, fmt.Errorf("incomingServices %s: maxHeaderBytes must not be negative", name))
+		}
+		seen := map[string]bool{}
+		for _, protocol := range service.NextProtos {
+			if protocol == "" || seen[protocol] {
+				problems = append(problems, fmt.Errorf("incomingServices %s: nextProtos must be unique and not empty", name))
+				break
+			}
+			seen[protocol] = true
+		}
+		if len(service.NextProtos) > 0 && service.UseHTTP {
+			problems = append(problems, fmt.Errorf("incomingServices %s: nextProtos cannot be used with useHTTP", name))
+		}
+		if service.WaitForAgent < 0 {
+			problems = append(problems, fmt.Errorf("incomingServices %s: waitForAgent must not be negative", name))
+		}
+	}
+
+	for i, service := range c.OutgoingServices {
+		if service.Name == "" {
+			problems = append(problems, fmt.Errorf("outgoingServices[%d]: name is required", i))
+		}
+		if service.Type == "" {
+			problems = append(problems, fmt.Errorf("outgoingServices[%d]: type is required", i))
+		}
+		if err := tunnelroute.ValidateEndpointName(service.Name); err != nil {
+			problems = append(problems, fmt.Errorf("outgoingServices[%d]: %v", i, err))
+		}
+		for _, ns := range service.Namespaces {
+			if err := tunnelroute.ValidateEndpointName(ns.Name); err != nil {
+				problems = append(problems, fmt.Errorf("outgoingServices[%d]: namespaces: %v", i, err))
+			}
+		}
+		retry := service.Retry
+		if retry.Attempts < 0 || retry.BudgetRatio < 0 || retry.BudgetMinPerSecond < 0 || retry.BudgetMax < 0 || retry.DNSAttempts < 0 || retry.DNSDelay < 0 {
+			problems = append(problems, fmt.Errorf("outgoingServices[%d]: retry settings must not be negative", i))
+		}
+		cache := service.Cache
+		if cache.TTL < 0 || cache.MaxEntries < 0 || cache.MaxBodyBytes < 0 {
+			problems = append(problems, fmt.Errorf("outgoingServices[%d]: cache settings must not be negative", i))
+		}
+		switch service.Type {
+		case "kubernetes", "aws", "connect", "grpc":
+		default:
+			credentialType, err := genericCredentialType(service.Config)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("outgoingServices[%d]: config: %v", i, err))
+			} else if !genericCredentialTypes[credentialType] {
+				problems = append(problems, fmt.Errorf("outgoingServices[%d]: credentials type '%s' must be one of none, basic, bearer, or token", i, credentialType))
+			}
+		}
+	}
+
+	return problems
+}
+
+// sharedPort tracks the services on one port, which must agree on how to
+// listen, and be told apart by their hostnames.
+type sharedPort struct {
+	first       *IncomingServiceConfig
+	firstName   string
+	defaultName string
+	hostnames   map[string]string
+}
+
+func (p *sharedPort) add(service IncomingServiceConfig, name string) []error {
+	if len(service.Hostnames) == 0 {
+		if p.defaultName != "" {
+			return []error{fmt.Errorf("port %d is also used by %s", service.Port, p.defaultName)}
+		}
+		p.defaultName = name
+	}
+	problems := []error{}
+	if p.first == nil {
+		p.first = &service
+		p.firstName = name
+	} else {
+		if service.UseHTTP != p.first.UseHTTP {
+			problems = append(problems, fmt.Errorf("useHTTP must match %s, which also uses port %d", p.firstName, service.Port))
+		}
+		if util.ListenAddress(service.BindAddress, service.Port) != util.ListenAddress(p.first.BindAddress, p.first.Port) {
+			problems = append(problems, fmt.Errorf("bindAddress must match %s, which also uses port %d", p.firstName, service.Port))
+		}
+		if strings.Join(service.NextProtos, ",") != strings.Join(p.first.NextProtos, ",") {
+			problems = append(problems, fmt.Errorf("nextProtos must match %s, which also uses port %d", p.firstName, service.Port))
+		}
+	}
+	for _, hostname := range service.Hostnames {
+		host := normalizeHostname(hostname)
+		if host == "" || strings.ContainsAny(hostname, ":/") {
+			problems = append(problems, fmt.Errorf("hostname '%s' must be a host name without a port", hostname))
+		} else if other, found := p.hostnames[host]; found {
+			problems = append(problems, fmt.Errorf("hostname '%s' on port %d is also used by %s", hostname, service.Port, other))
+		} else {
+			p.hostnames[host] = name
+		}
+	}
+	return problems
+}
+
+func genericCredentialType(config map[interface{}]interface{}) (string, error) {
+	configBytes, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	var generic genericEndpointConfig
+	if err := yaml.Unmarshal(configBytes, &generic); err != nil {
+		return "", err
+	}
+	return generic.Credentials.Type, nil
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/opsmx/oes-birger/internal/util"
+)
+
+// GroupIncomingServices groups services by the address they listen on, in
+// the order each address first appears, so services sharing a port can
+// be served by one listener.
+func GroupIncomingServices(services []IncomingServiceConfig) [][]IncomingServiceConfig {
+	groups := [][]IncomingServiceConfig{}
+	index := map[string]int{}
+	for _, service := range services {
+		addr := util.ListenAddress(service.BindAddress, service.Port)
+		i, found := index[addr]
+		if !found {
+			i = len(groups)
+			index[addr] = i
+			groups = append(groups, []IncomingServiceConfig{})
+		}
+		groups[i] = append(groups[i], service)
+	}
+	return groups
+}
+
+// normalizeHostname lower cases a host name and removes any port and
+// trailing dot.
+func normalizeHostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// virtualHosts sends each request to the service whose Hostnames include
+// the request's host, or to the service without Hostnames if none match.
+type virtualHosts struct {
+	hosts    map[string]http.Handler
+	fallback http.Handler
+}
+
+func makeVirtualHosts(services []IncomingServiceConfig, makeHandler func(IncomingServiceConfig) http.Handler) http.Handler {
+	if len(services) == 1 && len(services[0].Hostnames) == 0 {
+		return makeHandler(services[0])
+	}
+	v := &virtualHosts{hosts: map[string]http.Handler{}}
+	for _, service := range services {
+		handler := makeHandler(service)
+		if len(service.Hostnames) == 0 {
+			v.fallback = handler
+		}
+		for _, hostname := range service.Hostnames {
+			v.hosts[normalizeHostname(hostname)] = handler
+		}
+	}
+	return v
+}
+
+// requestHostname returns the host name the client used to reach the
+// listener.  A CONNECT request's Host is where the client wants to go
+// instead, so for those only the TLS server name is used.
+func requestHostname(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		if r.TLS == nil {
+			return ""
+		}
+		return normalizeHostname(r.TLS.ServerName)
+	}
+	return normalizeHostname(r.Host)
+}
+
+func (v *virtualHosts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, found := v.hosts[requestHostname(r)]; found {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	if v.fallback != nil {
+		v.fallback.ServeHTTP(w, r)
+		return
+	}
+	util.FailRequest(w, fmt.Errorf("no service for host '%s'", r.Host), http.StatusNotFound)
+}
+
+// maxHeaderBytes returns the largest MaxHeaderBytes of services sharing a
+// listener, as the limit applies to the listener as a whole.
+func maxHeaderBytes(services []IncomingServiceConfig) int {
+	max := 0
+	for _, service := range services {
+		limit := service.MaxHeaderBytes
+		if limit == 0 {
+			limit = http.DefaultMaxHeaderBytes
+		}
+		if limit > max {
+			max = limit
+		}
+	}
+	return max
+}
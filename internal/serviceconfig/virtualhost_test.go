@@ -0,0 +1,170 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package serviceconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/internal/tunnelroute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupIncomingServices(t *testing.T) {
+	services := []IncomingServiceConfig{
+		{Name: "a", Port: 8001},
+		{Name: "b", Port: 8002},
+		{Name: "c", Port: 8001},
+		{Name: "d", Port: 8001, BindAddress: "127.0.0.1"},
+	}
+	groups := GroupIncomingServices(services)
+	names := [][]string{}
+	for _, group := range groups {
+		groupNames := []string{}
+		for _, service := range group {
+			groupNames = append(groupNames, service.Name)
+		}
+		names = append(names, groupNames)
+	}
+	assert.Equal(t, [][]string{{"a", "c"}, {"b"}, {"d"}}, names)
+}
+
+func TestRequestHostname(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		tls    *tls.ConnectionState
+		want   string
+	}{
+		{"plain", http.MethodGet, "jenkins.example.com", nil, "jenkins.example.com"},
+		{"port and case", http.MethodGet, "Jenkins.Example.com:8443", nil, "jenkins.example.com"},
+		{"trailing dot", http.MethodGet, "jenkins.example.com.", nil, "jenkins.example.com"},
+		{"connect without tls", http.MethodConnect, "upstream:443", nil, ""},
+		{"connect with tls", http.MethodConnect, "upstream:443", &tls.ConnectionState{ServerName: "jenkins.example.com"}, "jenkins.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			r.Host = tt.host
+			r.TLS = tt.tls
+			assert.Equal(t, tt.want, requestHostname(r))
+		})
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	assert.Equal(t, http.DefaultMaxHeaderBytes, maxHeaderBytes([]IncomingServiceConfig{{}}))
+	assert.Equal(t, 4096, maxHeaderBytes([]IncomingServiceConfig{{MaxHeaderBytes: 4096}}))
+	assert.Equal(t, http.DefaultMaxHeaderBytes, maxHeaderBytes([]IncomingServiceConfig{{MaxHeaderBytes: 4096}, {}}))
+	assert.Equal(t, 2<<20, maxHeaderBytes([]IncomingServiceConfig{{MaxHeaderBytes: 2 << 20}, {}}))
+}
+
+func TestRunHTTPServer_virtualHosts(t *testing.T) {
+	routes := tunnelroute.MakeRoutes()
+	for _, name := range []string{"jenkins", "argo", "fallback"} {
+		name := name
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}))
+		defer upstream.Close()
+
+		route := &tunnelroute.DirectlyConnectedRoute{
+			Name:            name + "-agent",
+			Session:         "session",
+			Endpoints:       []tunnelroute.Endpoint{{Type: "jenkins", Name: name, Configured: true}},
+			InRequest:       make(chan interface{}),
+			InCancelRequest: make(chan string),
+		}
+		routes.Add(route)
+		defer routes.Remove(route, tunnelroute.DisconnectClean)
+		generic, configured, err := MakeGenericEndpoint("jenkins", name, []byte("url: "+upstream.URL), nil)
+		require.NoError(t, err)
+		require.True(t, configured)
+		go runFakeAgent(route, generic)
+	}
+
+	port := freePort(t, "127.0.0.1")
+	service := func(name string, hostnames ...string) IncomingServiceConfig {
+		return IncomingServiceConfig{
+			Name:               name,
+			Port:               port,
+			BindAddress:        "127.0.0.1",
+			UseHTTP:            true,
+			Destination:        name + "-agent",
+			ServiceType:        "jenkins",
+			DestinationService: name,
+			Hostnames:          hostnames,
+		}
+	}
+	services := []IncomingServiceConfig{
+		service("jenkins", "jenkins.example.com"),
+		service("argo", "argo.example.com", "cd.example.com"),
+	}
+
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+	go RunHTTPServer(routes, services, AllowAllAuthorizer{})
+	waitForListener(t, addr)
+
+	fallbackPort := freePort(t, "127.0.0.1")
+	fallback := service("fallback")
+	fallback.Port = fallbackPort
+	jenkins := service("jenkins", "jenkins.example.com")
+	jenkins.Port = fallbackPort
+	fallbackAddr := net.JoinHostPort("127.0.0.1", fmt.Sprint(fallbackPort))
+	go RunHTTPServer(routes, []IncomingServiceConfig{jenkins, fallback}, AllowAllAuthorizer{})
+	waitForListener(t, fallbackAddr)
+
+	tests := []struct {
+		name       string
+		addr       string
+		host       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"jenkins", addr, "jenkins.example.com", http.StatusOK, "jenkins"},
+		{"argo", addr, "argo.example.com", http.StatusOK, "argo"},
+		{"argo alias with port", addr, "CD.example.com:" + fmt.Sprint(port), http.StatusOK, "argo"},
+		{"unknown host", addr, "other.example.com", http.StatusNotFound, ""},
+		{"fallback listener, named host", fallbackAddr, "jenkins.example.com", http.StatusOK, "jenkins"},
+		{"fallback listener, other host", fallbackAddr, "other.example.com", http.StatusOK, "fallback"},
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://"+tt.addr+"/job", nil)
+			require.NoError(t, err)
+			req.Host = tt.host
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, string(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+	defaultBackoffFactor  = 2.0
+	defaultMaxAttempts    = 5
+)
+
+// BackoffConfig is how connecting to a peer controller is retried.  The
+// first retry waits InitialBackoff (default 1s), and each one after waits
+// Multiplier (default 2) times longer, up to MaxBackoff (default 30s).
+// Retrying stops after MaxAttempts attempts, or once MaxDuration has
+// passed since the first, whichever comes first.  If neither is set, at
+// most 5 attempts are made.
+type BackoffConfig struct {
+	InitialBackoff time.Duration `yaml:"initialBackoff,omitempty" json:"initialBackoff,omitempty"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff,omitempty" json:"maxBackoff,omitempty"`
+	Multiplier     float64       `yaml:"multiplier,omitempty" json:"multiplier,omitempty"`
+	MaxAttempts    int           `yaml:"maxAttempts,omitempty" json:"maxAttempts,omitempty"`
+	MaxDuration    time.Duration `yaml:"maxDuration,omitempty" json:"maxDuration,omitempty"`
+}
+
+// Validate returns the problems with the configuration.
+func (c BackoffConfig) Validate() []error {
+	problems := []error{}
+	if c.InitialBackoff < 0 || c.MaxBackoff < 0 || c.MaxAttempts < 0 || c.MaxDuration < 0 {
+		problems = append(problems, fmt.Errorf("initialBackoff, maxBackoff, maxAttempts, and maxDuration must not be negative"))
+	}
+	if c.Multiplier != 0 && c.Multiplier < 1 {
+		problems = append(problems, fmt.Errorf("multiplier must be at least 1"))
+	}
+	if c.InitialBackoff > 0 && c.MaxBackoff > 0 && c.InitialBackoff > c.MaxBackoff {
+		problems = append(problems, fmt.Errorf("initialBackoff must not be greater than maxBackoff"))
+	}
+	return problems
+}
+
+// Retry calls attempt until it succeeds, backing off between attempts.
+// Once the attempts or duration run out, or ctx is done, it returns the
+// last error.
+func (c BackoffConfig) Retry(ctx context.Context, attempt func(ctx context.Context) error) error {
+	return c.retry(ctx, attempt, time.Now, sleepContext)
+}
+
+func (c BackoffConfig) retry(ctx context.Context, attempt func(ctx context.Context) error, now func() time.Time, sleep func(ctx context.Context, d time.Duration) error) error {
+	initial, max, multiplier, maxAttempts := c.InitialBackoff, c.MaxBackoff, c.Multiplier, c.MaxAttempts
+	if initial == 0 {
+		initial = defaultInitialBackoff
+	}
+	if max == 0 {
+		max = defaultMaxBackoff
+	}
+	if max < initial {
+		max = initial
+	}
+	if multiplier == 0 {
+		multiplier = defaultBackoffFactor
+	}
+	if maxAttempts == 0 && c.MaxDuration == 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	start := now()
+	delay := initial
+	for attempts := 1; ; attempts++ {
+		err := attempt(ctx)
+		if err == nil {
+			return nil
+		}
+		if maxAttempts > 0 && attempts >= maxAttempts {
+			return fmt.Errorf("gave up after %d attempts: %w", attempts, err)
+		}
+		if c.MaxDuration > 0 && now().Add(delay).Sub(start) > c.MaxDuration {
+			return fmt.Errorf("gave up after %d attempts in %s: %w", attempts, now().Sub(start).Round(time.Millisecond), err)
+		}
+		if sleepErr := sleep(ctx, delay); sleepErr != nil {
+			return fmt.Errorf("%w after %d attempts, last error: %v", sleepErr, attempts, err)
+		}
+		delay = time.Duration(float64(delay) * multiplier)
+		if delay > max {
+			delay = max
+		}
+	}
+}
+
+// sleepContext sleeps for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSleeper records the backoff delays, advancing its clock instead of
+// sleeping.
+type fakeSleeper struct {
+	clock  time.Time
+	delays []time.Duration
+}
+
+func (f *fakeSleeper) now() time.Time {
+	return f.clock
+}
+
+func (f *fakeSleeper) sleep(ctx context.Context, d time.Duration) error {
+	f.delays = append(f.delays, d)
+	f.clock = f.clock.Add(d)
+	return nil
+}
+
+func failingAttempt(count *int) func(context.Context) error {
+	return func(context.Context) error {
+		*count++
+		return errors.New("connection refused")
+	}
+}
+
+func TestBackoffConfig_Validate(t *testing.T) {
+	assert.Empty(t, BackoffConfig{}.Validate())
+	assert.Empty(t, BackoffConfig{InitialBackoff: time.Second, MaxBackoff: time.Minute, Multiplier: 1.5, MaxAttempts: 3}.Validate())
+	assert.Len(t, BackoffConfig{MaxAttempts: -1}.Validate(), 1)
+	assert.Len(t, BackoffConfig{Multiplier: 0.5}.Validate(), 1)
+	assert.Len(t, BackoffConfig{InitialBackoff: time.Minute, MaxBackoff: time.Second}.Validate(), 1)
+}
+
+func TestBackoffConfig_retryGrowsThenGivesUp(t *testing.T) {
+	f := &fakeSleeper{clock: time.Unix(1000000, 0)}
+	config := BackoffConfig{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2, MaxAttempts: 6}
+	attempts := 0
+	err := config.retry(context.Background(), failingAttempt(&attempts), f.now, f.sleep)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "gave up after 6 attempts")
+	assert.Contains(t, err.Error(), "connection refused")
+	assert.Equal(t, 6, attempts)
+	assert.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+	}, f.delays)
+}
+
+func TestBackoffConfig_retryMaxDuration(t *testing.T) {
+	f := &fakeSleeper{clock: time.Unix(1000000, 0)}
+	config := BackoffConfig{InitialBackoff: time.Second, Multiplier: 2, MaxDuration: 10 * time.Second}
+	attempts := 0
+	err := config.retry(context.Background(), failingAttempt(&attempts), f.now, f.sleep)
+	require.Error(t, err)
+	// 1s + 2s + 4s is 7s; waiting another 8s would pass 10s.
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}, f.delays)
+	assert.Equal(t, 4, attempts)
+}
+
+func TestBackoffConfig_retryDefaults(t *testing.T) {
+	f := &fakeSleeper{clock: time.Unix(1000000, 0)}
+	attempts := 0
+	err := BackoffConfig{}.retry(context.Background(), failingAttempt(&attempts), f.now, f.sleep)
+	require.Error(t, err)
+	assert.Equal(t, 5, attempts)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}, f.delays)
+}
+
+func TestBackoffConfig_retrySucceeds(t *testing.T) {
+	f := &fakeSleeper{clock: time.Unix(1000000, 0)}
+	attempts := 0
+	err := BackoffConfig{}.retry(context.Background(), func(context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}, f.now, f.sleep)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Len(t, f.delays, 2)
+}
+
+func TestBackoffConfig_Retry_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts := 0
+	err := BackoffConfig{InitialBackoff: time.Minute}.Retry(ctx, failingAttempt(&attempts))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, attempts)
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BodyTransform rewrites a request's body before it is sent to an
+// endpoint.  It is given the upstream request's method, URI, and headers,
+// and returns the body to send, which may be the one it was given.
+type BodyTransform interface {
+	Transform(method string, uri string, headers http.Header, body []byte) ([]byte, error)
+}
+
+// BodyTransformFactory makes a transform from its configured options.
+type BodyTransformFactory func(options map[string]string) (BodyTransform, error)
+
+// BodyTransformConfig names a registered transform, and its options.
+type BodyTransformConfig struct {
+	Name    string            `yaml:"name" json:"name"`
+	Options map[string]string `yaml:"options,omitempty" json:"options,omitempty"`
+}
+
+// BodyTransforms are an endpoint's transforms, applied in order.  None,
+// the default, leaves the body as it is.
+type BodyTransforms []BodyTransform
+
+var bodyTransformRegistry = struct {
+	sync.Mutex
+	m map[string]BodyTransformFactory
+}{
+	m: map[string]BodyTransformFactory{
+		"jsonDefaults": makeJSONDefaults,
+	},
+}
+
+// RegisterBodyTransform makes a transform available to endpoint
+// configuration by name, replacing any already registered with it.
+func RegisterBodyTransform(name string, factory BodyTransformFactory) {
+	bodyTransformRegistry.Lock()
+	defer bodyTransformRegistry.Unlock()
+	bodyTransformRegistry.m[name] = factory
+}
+
+// MakeBodyTransforms returns the configured transforms, or an error if one
+// is not registered or its options are invalid.
+func MakeBodyTransforms(configs []BodyTransformConfig) (BodyTransforms, error) {
+	bodyTransformRegistry.Lock()
+	defer bodyTransformRegistry.Unlock()
+	ret := BodyTransforms{}
+	for i, config := range configs {
+		factory, found := bodyTransformRegistry.m[config.Name]
+		if !found {
+			return nil, fmt.Errorf("[%d]: unknown transform '%s'", i, config.Name)
+		}
+		transform, err := factory(config.Options)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %s: %v", i, config.Name, err)
+		}
+		ret = append(ret, transform)
+	}
+	return ret, nil
+}
+
+// Apply reads the request's body in full, runs each transform on it, and
+// replaces it with the result, updating the content length to match.  A
+// body longer than max bytes fails with ErrRequestBodyTooLarge.
+func (t BodyTransforms) Apply(r *http.Request, max int64) error {
+	if len(t) == 0 {
+		return nil
+	}
+	body, err := ReadRequestBody(r.Body, max)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	for _, transform := range t {
+		body, err = transform.Transform(r.Method, r.URL.RequestURI(), r.Header, body)
+		if err != nil {
+			return err
+		}
+	}
+	r.ContentLength = int64(len(body))
+	r.Body = http.NoBody
+	r.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+	if len(body) > 0 {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	}
+	if r.Header.Get("Content-Length") != "" {
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return nil
+}
+
+// jsonDefaults sets fields of a JSON object body which are missing or
+// null.  Each option is a dotted path, such as "metadata.namespace", and
+// the string value to set.  Other bodies are left as they are.
+type jsonDefaults struct {
+	paths  [][]string
+	values []string
+}
+
+func makeJSONDefaults(options map[string]string) (BodyTransform, error) {
+	if len(options) == 0 {
+		return nil, fmt.Errorf("no fields to set")
+	}
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	t := &jsonDefaults{}
+	for _, name := range names {
+		path := strings.Split(name, ".")
+		for _, part := range path {
+			if part == "" {
+				return nil, fmt.Errorf("invalid field '%s'", name)
+			}
+		}
+		t.paths = append(t.paths, path)
+		t.values = append(t.values, options[name])
+	}
+	return t, nil
+}
+
+func (t *jsonDefaults) Transform(_ string, _ string, headers http.Header, body []byte) ([]byte, error) {
+	if len(body) == 0 {
+		return body, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(headers.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return body, nil
+	}
+	doc, ok := decodeJSONObject(body)
+	if !ok {
+		return body, nil
+	}
+	changed := false
+	for i, path := range t.paths {
+		if setDefault(doc, path, t.values[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return body, nil
+	}
+	return json.Marshal(doc)
+}
+
+// decodeJSONObject decodes body as a single JSON object.  Numbers are kept
+// as json.Number, so large integers and the precision of decimals survive
+// being encoded again.
+func decodeJSONObject(body []byte) (map[string]interface{}, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc map[string]interface{}
+	if err := decoder.Decode(&doc); err != nil || doc == nil {
+		return nil, false
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, false // trailing data
+	}
+	return doc, true
+}
+
+// setDefault sets the field at path if it is missing or null, creating
+// objects along the way, and returns true if it did.  A path through a
+// value which is not an object is left alone.
+func setDefault(doc map[string]interface{}, path []string, value string) bool {
+	for _, name := range path[:len(path)-1] {
+		next, found := doc[name]
+		if !found || next == nil {
+			next = map[string]interface{}{}
+			doc[name] = next
+		}
+		obj, ok := next.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		doc = obj
+	}
+	name := path[len(path)-1]
+	if current, found := doc[name]; found && current != nil {
+		return false
+	}
+	doc[name] = value
+	return true
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingTransform struct{}
+
+func (failingTransform) Transform(string, string, http.Header, []byte) ([]byte, error) {
+	return nil, fmt.Errorf("bad body")
+}
+
+func TestMakeBodyTransforms(t *testing.T) {
+	RegisterBodyTransform("test-failing", func(map[string]string) (BodyTransform, error) { return failingTransform{}, nil })
+
+	tests := []struct {
+		name    string
+		configs []BodyTransformConfig
+		wantLen int
+		wantErr string
+	}{
+		{"none", nil, 0, ""},
+		{"registered", []BodyTransformConfig{{Name: "test-failing"}, {Name: "jsonDefaults", Options: map[string]string{"a": "b"}}}, 2, ""},
+		{"unknown", []BodyTransformConfig{{Name: "nope"}}, 0, "[0]: unknown transform 'nope'"},
+		{"no options", []BodyTransformConfig{{Name: "jsonDefaults"}}, 0, "[0]: jsonDefaults: no fields to set"},
+		{"bad path", []BodyTransformConfig{{Name: "jsonDefaults", Options: map[string]string{"a..b": "c"}}}, 0, "[0]: jsonDefaults: invalid field 'a..b'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MakeBodyTransforms(tt.configs)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, got, tt.wantLen)
+		})
+	}
+}
+
+func TestBodyTransforms_Apply(t *testing.T) {
+	defaults, err := makeJSONDefaults(map[string]string{"metadata.namespace": "default"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		transforms  BodyTransforms
+		contentType string
+		body        string
+		want        string
+		wantErr     string
+	}{
+		{"identity", nil, "application/json", `{"a": 1}`, `{"a": 1}`, ""},
+		{"sets missing", BodyTransforms{defaults}, "application/json", `{"kind":"Pod"}`, `{"kind":"Pod","metadata":{"namespace":"default"}}`, ""},
+		{"sets null", BodyTransforms{defaults}, "application/json; charset=utf-8", `{"metadata":{"name":"x","namespace":null}}`, `{"metadata":{"name":"x","namespace":"default"}}`, ""},
+		{"keeps present", BodyTransforms{defaults}, "application/json", `{"metadata": {"namespace": "prod"}}`, `{"metadata": {"namespace": "prod"}}`, ""},
+		{"through non-object", BodyTransforms{defaults}, "application/json", `{"metadata": "x"}`, `{"metadata": "x"}`, ""},
+		{"json suffix", BodyTransforms{defaults}, "application/merge-patch+json", `{}`, `{"metadata":{"namespace":"default"}}`, ""},
+		{"not json", BodyTransforms{defaults}, "application/yaml", `kind: Pod`, `kind: Pod`, ""},
+		{"invalid json", BodyTransforms{defaults}, "application/json", `{`, `{`, ""},
+		{"not an object", BodyTransforms{defaults}, "application/json", `[1]`, `[1]`, ""},
+		{"large numbers", BodyTransforms{defaults}, "application/json", `{"id":12345678901234567890,"ratio":0.10000000000000001}`, `{"id":12345678901234567890,"metadata":{"namespace":"default"},"ratio":0.10000000000000001}`, ""},
+		{"trailing data", BodyTransforms{defaults}, "application/json", `{} {}`, `{} {}`, ""},
+		{"null", BodyTransforms{defaults}, "application/json", `null`, `null`, ""},
+		{"empty", BodyTransforms{defaults}, "application/json", ``, ``, ""},
+		{"error", BodyTransforms{failingTransform{}}, "application/json", `{}`, "", "bad body"},
+		{"too large", BodyTransforms{defaults}, "application/json", `{"kind":"` + strings.Repeat("x", 100) + `"}`, "", "request body too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, "http://example.com/api?x=1", bytes.NewBufferString(tt.body))
+			require.NoError(t, err)
+			r.Header.Set("Content-Type", tt.contentType)
+			r.Header.Set("Content-Length", fmt.Sprint(len(tt.body)))
+
+			err = tt.transforms.Apply(r, 100)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(body))
+			assert.Equal(t, int64(len(tt.want)), r.ContentLength)
+			assert.Equal(t, fmt.Sprint(len(tt.want)), r.Header.Get("Content-Length"))
+			if r.GetBody != nil {
+				again, err := r.GetBody()
+				require.NoError(t, err)
+				body, _ = io.ReadAll(again)
+				assert.Equal(t, tt.want, string(body))
+			}
+		})
+	}
+}
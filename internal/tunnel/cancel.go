@@ -19,37 +19,125 @@ package tunnel
 import (
 	"context"
 	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.uber.org/zap"
 )
 
 var cancelRegistry = struct {
 	sync.Mutex
-	m map[string]context.CancelFunc
-}{m: make(map[string]context.CancelFunc)}
+	m    map[string]*cancelEntry
+	next uint64
+}{m: make(map[string]*cancelEntry)}
+
+// cancelEntry holds the cancel functions registered for a request, by
+// registration number, and when the first was registered.
+type cancelEntry struct {
+	registered time.Time
+	cancels    map[uint64]context.CancelFunc
+}
+
+// CancelRegistration is returned by RegisterCancelFunction, to unregister
+// that one function.
+type CancelRegistration struct {
+	id     string
+	number uint64
+}
+
+var registeredCancelsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "registered_cancel_functions",
+	Help: "The number of requests with cancel functions registered",
+})
 
 // RegisterCancelFunction will associate a cancel function to be called by CallCancelFunction,
-// based on the provided id.
-func RegisterCancelFunction(id string, cancel context.CancelFunc) {
+// based on the provided id.  More than one function may be registered for an id, such as
+// when a wrapper needs to know a request was cancelled.
+func RegisterCancelFunction(id string, cancel context.CancelFunc) CancelRegistration {
 	cancelRegistry.Lock()
 	defer cancelRegistry.Unlock()
-	cancelRegistry.m[id] = cancel
+	entry, ok := cancelRegistry.m[id]
+	if !ok {
+		entry = &cancelEntry{registered: time.Now(), cancels: map[uint64]context.CancelFunc{}}
+		cancelRegistry.m[id] = entry
+		registeredCancelsGauge.Set(float64(len(cancelRegistry.m)))
+	}
+	cancelRegistry.next++
+	entry.cancels[cancelRegistry.next] = cancel
+	return CancelRegistration{id: id, number: cancelRegistry.next}
 }
 
-// UnregisterCancelFunction will remove a remembered cancel function.
-func UnregisterCancelFunction(id string) {
+// UnregisterCancelFunction will remove the cancel function registered by
+// RegisterCancelFunction, leaving any others registered for the same id,
+// such as by a wrapper which is still running.
+func UnregisterCancelFunction(registration CancelRegistration) {
 	cancelRegistry.Lock()
 	defer cancelRegistry.Unlock()
-	delete(cancelRegistry.m, id)
+	entry, ok := cancelRegistry.m[registration.id]
+	if !ok {
+		return
+	}
+	delete(entry.cancels, registration.number)
+	if len(entry.cancels) == 0 {
+		delete(cancelRegistry.m, registration.id)
+		registeredCancelsGauge.Set(float64(len(cancelRegistry.m)))
+	}
 }
 
 // CallCancelFunction will call the function associated with the id, if any.
 func CallCancelFunction(id string) {
 	cancelRegistry.Lock()
 	defer cancelRegistry.Unlock()
-	cancel, ok := cancelRegistry.m[id]
+	entry, ok := cancelRegistry.m[id]
 	if ok {
-		cancel()
+		for _, cancel := range entry.cancels {
+			cancel()
+		}
 		zap.S().Debugf("Cancelling request %s", id)
 	}
 }
+
+// ReapCancelFunctions cancels and removes the functions for every id
+// registered more than maxLifetime ago, which a request should have
+// unregistered by then, and returns how many ids were removed.
+func ReapCancelFunctions(maxLifetime time.Duration) int {
+	cutoff := time.Now().Add(-maxLifetime)
+	cancelRegistry.Lock()
+	defer cancelRegistry.Unlock()
+	count := 0
+	for id, entry := range cancelRegistry.m {
+		if !entry.registered.Before(cutoff) {
+			continue
+		}
+		zap.S().Warnw("reaping stale cancel functions", "requestId", id, "age", time.Since(entry.registered), "maxRequestLifetime", maxLifetime)
+		for _, cancel := range entry.cancels {
+			cancel()
+		}
+		delete(cancelRegistry.m, id)
+		count++
+	}
+	registeredCancelsGauge.Set(float64(len(cancelRegistry.m)))
+	return count
+}
+
+// RunCancelSweeper reaps stale cancel functions, checking several times per
+// maxLifetime so none stays much longer than it.  It never returns.
+func RunCancelSweeper(maxLifetime time.Duration) {
+	interval := maxLifetime / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		ReapCancelFunctions(maxLifetime)
+	}
+}
+
+// RequestContext returns a context to run the request in, which ends when the
+// client's deadline passes, if it sent one.
+func RequestContext(req *OpenHTTPTunnelRequest) (context.Context, context.CancelFunc) {
+	if req.TimeoutMillis > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(req.TimeoutMillis)*time.Millisecond)
+	}
+	return context.WithCancel(context.Background())
+}
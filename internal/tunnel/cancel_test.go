@@ -16,7 +16,10 @@
 
 package tunnel
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 var cancelCalled bool
 
@@ -51,10 +54,107 @@ func TestCancelUnknownId(t *testing.T) {
 // Test that unknown IDs don't crash, but do nothing.
 func TestUnregister(t *testing.T) {
 	reset()
-	RegisterCancelFunction("cf1", cancelFunction)
-	UnregisterCancelFunction("cf1")
+	UnregisterCancelFunction(RegisterCancelFunction("cf1", cancelFunction))
 	CallCancelFunction("cf1")
 	if cancelCalled {
 		t.Failed()
 	}
 }
+
+func TestReapCancelFunctions(t *testing.T) {
+	staleCalled := false
+	freshCalled := false
+	RegisterCancelFunction("stale", func() { staleCalled = true })
+	defer UnregisterCancelFunction(RegisterCancelFunction("fresh", func() { freshCalled = true }))
+
+	cancelRegistry.Lock()
+	cancelRegistry.m["stale"].registered = time.Now().Add(-2 * time.Hour)
+	cancelRegistry.Unlock()
+
+	if got := ReapCancelFunctions(time.Hour); got != 1 {
+		t.Errorf("ReapCancelFunctions() = %d, want 1", got)
+	}
+	if !staleCalled {
+		t.Errorf("stale cancel function was not called")
+	}
+	if freshCalled {
+		t.Errorf("fresh cancel function was called")
+	}
+
+	cancelRegistry.Lock()
+	_, staleFound := cancelRegistry.m["stale"]
+	_, freshFound := cancelRegistry.m["fresh"]
+	cancelRegistry.Unlock()
+	if staleFound {
+		t.Errorf("stale cancel function was not removed")
+	}
+	if !freshFound {
+		t.Errorf("fresh cancel function was removed")
+	}
+}
+
+func TestRegisterCancelFunction_keepsFirstRegistration(t *testing.T) {
+	defer UnregisterCancelFunction(RegisterCancelFunction("wrapped", func() {}))
+	cancelRegistry.Lock()
+	first := cancelRegistry.m["wrapped"].registered
+	cancelRegistry.Unlock()
+
+	defer UnregisterCancelFunction(RegisterCancelFunction("wrapped", func() {}))
+	cancelRegistry.Lock()
+	entry := cancelRegistry.m["wrapped"]
+	cancelRegistry.Unlock()
+	if !entry.registered.Equal(first) {
+		t.Errorf("registration time changed from %v to %v", first, entry.registered)
+	}
+	if len(entry.cancels) != 2 {
+		t.Errorf("got %d cancel functions, want 2", len(entry.cancels))
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	ctx, cancel := RequestContext(&OpenHTTPTunnelRequest{})
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("RequestContext() without a timeout has a deadline")
+	}
+
+	start := time.Now()
+	ctx, cancel = RequestContext(&OpenHTTPTunnelRequest{TimeoutMillis: 1500})
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Fatalf("RequestContext() with a timeout has no deadline")
+	}
+	if got := deadline.Sub(start); got < 1500*time.Millisecond || got > 2*time.Second {
+		t.Errorf("RequestContext() deadline is %v away, want 1.5s", got)
+	}
+}
+
+func TestUnregisterCancelFunction_leavesOthers(t *testing.T) {
+	wrapperCalled := false
+	innerCalled := false
+	wrapper := RegisterCancelFunction("shared", func() { wrapperCalled = true })
+	inner := RegisterCancelFunction("shared", func() { innerCalled = true })
+
+	// The endpoint finishes first, and the wrapper, which is still
+	// waiting, must still hear of a cancel.
+	UnregisterCancelFunction(inner)
+	CallCancelFunction("shared")
+	if !wrapperCalled {
+		t.Errorf("wrapper's cancel function was not called")
+	}
+	if innerCalled {
+		t.Errorf("unregistered cancel function was called")
+	}
+
+	UnregisterCancelFunction(wrapper)
+	cancelRegistry.Lock()
+	_, found := cancelRegistry.m["shared"]
+	cancelRegistry.Unlock()
+	if found {
+		t.Errorf("id is still registered after its last function was unregistered")
+	}
+
+	// Unregistering again, or after the id is gone, does nothing.
+	UnregisterCancelFunction(inner)
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+const (
+	// DefaultChunkSize is the number of bytes read from an upstream response
+	// body into each HttpTunnelChunkedResponse, unless configured otherwise.
+	DefaultChunkSize = 10240
+
+	// defaultAdaptiveChunkSize is where adaptive chunking starts, small enough
+	// that streaming (watch) responses are sent promptly.
+	defaultAdaptiveChunkSize = 1024
+
+	// defaultMaxChunkSize is the largest chunk adaptive chunking will grow to.
+	// This must stay well under the GRPC maximum message size.
+	defaultMaxChunkSize = 1024 * 1024
+)
+
+// ChunkConfig defines how an endpoint's response bodies are broken into chunks
+// sent over the tunnel.  If Adaptive is set, the chunk size starts at Size,
+// doubles each time a read fills the entire chunk (a bulk transfer) up to
+// MaxSize, and drops back to Size when a read returns less than half a chunk
+// (a streaming response).
+type ChunkConfig struct {
+	Size     int  `yaml:"size,omitempty" json:"size,omitempty"`
+	MaxSize  int  `yaml:"maxSize,omitempty" json:"maxSize,omitempty"`
+	Adaptive bool `yaml:"adaptive,omitempty" json:"adaptive,omitempty"`
+}
+
+type chunkSizer struct {
+	size     int
+	min      int
+	max      int
+	adaptive bool
+}
+
+func (c ChunkConfig) sizer() *chunkSizer {
+	s := &chunkSizer{
+		min:      c.Size,
+		max:      c.MaxSize,
+		adaptive: c.Adaptive,
+	}
+	if s.min <= 0 {
+		s.min = DefaultChunkSize
+		if s.adaptive {
+			s.min = defaultAdaptiveChunkSize
+		}
+	}
+	if s.max <= 0 {
+		s.max = defaultMaxChunkSize
+	}
+	if s.max < s.min {
+		s.max = s.min
+	}
+	s.size = s.min
+	return s
+}
+
+// next returns the size of the buffer to use for the next read.
+func (s *chunkSizer) next() int {
+	return s.size
+}
+
+// update adjusts the chunk size based on how much the last read returned.
+func (s *chunkSizer) update(n int) {
+	if !s.adaptive {
+		return
+	}
+	if n >= s.size {
+		s.size *= 2
+		if s.size > s.max {
+			s.size = s.max
+		}
+	} else if n < s.size/2 {
+		s.size = s.min
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkConfig_sizer(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   ChunkConfig
+		reads    []int
+		wantSize []int
+	}{
+		{
+			"default",
+			ChunkConfig{},
+			[]int{DefaultChunkSize, 5},
+			[]int{DefaultChunkSize, DefaultChunkSize},
+		},
+		{
+			"fixed",
+			ChunkConfig{Size: 100},
+			[]int{100, 100},
+			[]int{100, 100},
+		},
+		{
+			"adaptive grows on full reads and caps at max",
+			ChunkConfig{Size: 100, MaxSize: 300, Adaptive: true},
+			[]int{100, 200, 300},
+			[]int{200, 300, 300},
+		},
+		{
+			"adaptive shrinks on short reads",
+			ChunkConfig{Size: 100, MaxSize: 1000, Adaptive: true},
+			[]int{100, 200, 10},
+			[]int{200, 400, 100},
+		},
+		{
+			"adaptive holds on mostly full reads",
+			ChunkConfig{Size: 100, MaxSize: 1000, Adaptive: true},
+			[]int{100, 150},
+			[]int{200, 200},
+		},
+		{
+			"adaptive default start",
+			ChunkConfig{Adaptive: true},
+			[]int{0},
+			[]int{defaultAdaptiveChunkSize},
+		},
+		{
+			"max below size",
+			ChunkConfig{Size: 100, MaxSize: 10, Adaptive: true},
+			[]int{100},
+			[]int{100},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.config.sizer()
+			for i, n := range tt.reads {
+				s.update(n)
+				assert.Equal(t, tt.wantSize[i], s.next(), "after read %d", i)
+			}
+		})
+	}
+}
+
+func TestRunHTTPRequest_ChunkedEOF(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 5000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer upstream.Close()
+
+	req := &OpenHTTPTunnelRequest{Id: "c1", Method: http.MethodGet, URI: "/"}
+	httpRequest, err := http.NewRequest(req.Method, upstream.URL+req.URI, nil)
+	require.NoError(t, err)
+
+	dataflow := make(chan *MessageWrapper, 100)
+	RunHTTPRequest(upstream.Client(), req, httpRequest, dataflow, upstream.URL, ResponseOptions{Chunking: ChunkConfig{Size: 1000}})
+	close(dataflow)
+
+	require.NotNil(t, (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse())
+	var got []byte
+	var last *HttpTunnelChunkedResponse
+	for msg := range dataflow {
+		last = msg.GetHttpTunnelControl().GetHttpTunnelChunkedResponse()
+		require.NotNil(t, last)
+		assert.LessOrEqual(t, len(last.Body), 1000)
+		got = append(got, last.Body...)
+	}
+	assert.Equal(t, body, got)
+	assert.Empty(t, last.Body, "final chunk must be the zero length EOF marker")
+}
+
+func BenchmarkRunHTTPRequest_ChunkSize(b *testing.B) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 4*1024*1024/16)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer upstream.Close()
+
+	configs := []ChunkConfig{
+		{Size: 1024},
+		{Size: DefaultChunkSize},
+		{Size: 64 * 1024},
+		{Size: 256 * 1024},
+		{Adaptive: true},
+	}
+	for _, config := range configs {
+		name := fmt.Sprintf("size=%d", config.Size)
+		if config.Adaptive {
+			name = "adaptive"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				req := &OpenHTTPTunnelRequest{Id: "bench", Method: http.MethodGet, URI: "/"}
+				httpRequest, err := http.NewRequest(req.Method, upstream.URL+req.URI, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				dataflow := make(chan *MessageWrapper, 20)
+				done := make(chan struct{})
+				go func() {
+					for range dataflow {
+					}
+					close(done)
+				}()
+				RunHTTPRequest(upstream.Client(), req, httpRequest, dataflow, upstream.URL, ResponseOptions{Chunking: config})
+				close(dataflow)
+				<-done
+			}
+		})
+	}
+}
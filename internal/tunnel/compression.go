@@ -0,0 +1,110 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// CompressionName is the gRPC encoding used to compress the tunnel.
+const CompressionName = "gzip"
+
+var registerCompressionOnce sync.Once
+
+// EnableCompression registers the gzip compressor with gRPC, so the tunnel
+// can carry compressed messages.  It must be called before the tunnel is
+// dialed or served.
+//
+// The controller compresses what it sends to an agent only if the agent
+// compresses what it sends, so compression is chosen by each agent, but a
+// controller which has not enabled it refuses compressed streams.  It is
+// registered here, rather than by importing grpc's gzip package, so that
+// it is only accepted when configured.
+func EnableCompression() {
+	registerCompressionOnce.Do(func() {
+		encoding.RegisterCompressor(&gzipCompressor{})
+	})
+}
+
+// CompressionDialOptions returns the options for an agent to compress the
+// messages it sends over the tunnel.
+func CompressionDialOptions() []grpc.DialOption {
+	EnableCompression()
+	return []grpc.DialOption{grpc.WithDefaultCallOptions(grpc.UseCompressor(CompressionName))}
+}
+
+// gzipCompressor implements encoding.Compressor, reusing writers and
+// readers as each message is compressed separately.
+type gzipCompressor struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+type gzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (w *gzipWriter) Close() error {
+	defer w.pool.Put(w)
+	return w.Writer.Close()
+}
+
+type gzipReader struct {
+	*gzip.Reader
+	pool *sync.Pool
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.pool.Put(r)
+	}
+	return n, err
+}
+
+func (c *gzipCompressor) Name() string {
+	return CompressionName
+}
+
+func (c *gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	if z, ok := c.writers.Get().(*gzipWriter); ok {
+		z.Reset(w)
+		return z, nil
+	}
+	return &gzipWriter{Writer: gzip.NewWriter(w), pool: &c.writers}, nil
+}
+
+func (c *gzipCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	if z, ok := c.readers.Get().(*gzipReader); ok {
+		if err := z.Reset(r); err != nil {
+			c.readers.Put(z)
+			return nil, err
+		}
+		return z, nil
+	}
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipReader{Reader: z, pool: &c.readers}, nil
+}
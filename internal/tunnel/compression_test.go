@@ -0,0 +1,195 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// echoTunnelServer sends every message it receives straight back.
+type echoTunnelServer struct {
+	UnimplementedAgentTunnelServiceServer
+}
+
+func (echoTunnelServer) EventTunnel(stream AgentTunnelService_EventTunnelServer) error {
+	for {
+		in, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		if err := stream.Send(in); err != nil {
+			return err
+		}
+	}
+}
+
+// payloadCounter totals the size of received messages, before and after
+// decompression.
+type payloadCounter struct {
+	length     int64
+	wireLength int64
+}
+
+func (c *payloadCounter) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (c *payloadCounter) HandleRPC(_ context.Context, s stats.RPCStats) {
+	if in, ok := s.(*stats.InPayload); ok {
+		atomic.AddInt64(&c.length, int64(in.Length))
+		atomic.AddInt64(&c.wireLength, int64(in.WireLength))
+	}
+}
+
+func (c *payloadCounter) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (c *payloadCounter) HandleConn(context.Context, stats.ConnStats) {}
+
+// startEchoTunnel serves an echo tunnel with compression enabled, and
+// returns a stream to it, compressed if compress is set.
+func startEchoTunnel(tb testing.TB, compress bool) (AgentTunnelService_EventTunnelClient, *payloadCounter, *payloadCounter) {
+	EnableCompression()
+	lis := bufconn.Listen(1 << 20)
+	serverCounter := &payloadCounter{}
+	server := grpc.NewServer(grpc.StatsHandler(serverCounter))
+	RegisterAgentTunnelServiceServer(server, echoTunnelServer{})
+	go func() { _ = server.Serve(lis) }()
+	tb.Cleanup(server.Stop)
+
+	clientCounter := &payloadCounter{}
+	opts := []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStatsHandler(clientCounter),
+	}
+	if compress {
+		opts = append(opts, CompressionDialOptions()...)
+	}
+	conn, err := grpc.Dial("bufnet", opts...)
+	require.NoError(tb, err)
+	tb.Cleanup(func() { conn.Close() })
+	stream, err := NewAgentTunnelServiceClient(conn).EventTunnel(context.Background())
+	require.NoError(tb, err)
+	return stream, serverCounter, clientCounter
+}
+
+// sampleBody is a JSON document much like a Kubernetes list response.
+func sampleBody(items int) []byte {
+	parts := make([]string, items)
+	for i := range parts {
+		parts[i] = fmt.Sprintf(`{"metadata":{"name":"pod-%d","namespace":"default","labels":{"app":"web"}},"status":{"phase":"Running"}}`, i)
+	}
+	return []byte(`{"kind":"PodList","items":[` + strings.Join(parts, ",") + `]}`)
+}
+
+func tunnelMessages() []*MessageWrapper {
+	return []*MessageWrapper{
+		{Event: &MessageWrapper_PingRequest{PingRequest: &PingRequest{Ts: 12345}}},
+		{Event: &MessageWrapper_Hello{Hello: &Hello{
+			Version:   "v1.2.3",
+			Hostname:  "agent-pod",
+			Endpoints: []*EndpointHealth{{Name: "k8s", Type: "kubernetes", Configured: true, Namespaces: []string{"a", "b"}}},
+		}}},
+		{Event: MakeHTTPTunnelOpenTunnelRequest(&OpenHTTPTunnelRequest{
+			Id:      "id1",
+			Method:  "GET",
+			URI:     "/api/v1/pods",
+			Headers: []*HttpHeader{{Name: "Accept", Values: []string{"application/json"}}},
+		})},
+		{Event: &MessageWrapper_HttpTunnelControl{HttpTunnelControl: &HttpTunnelControl{
+			ControlType: &HttpTunnelControl_HttpTunnelChunkedResponse{
+				HttpTunnelChunkedResponse: &HttpTunnelChunkedResponse{Id: "id1", Body: sampleBody(500)},
+			},
+		}}},
+		{Event: MakeHTTPTunnelCancelRequest("id1")},
+	}
+}
+
+func TestCompression_roundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		compress bool
+	}{
+		{"uncompressed", false},
+		{"compressed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, serverCounter, clientCounter := startEchoTunnel(t, tt.compress)
+			for _, message := range tunnelMessages() {
+				require.NoError(t, stream.Send(message))
+				echoed, err := stream.Recv()
+				require.NoError(t, err)
+				assert.True(t, proto.Equal(message, echoed), "got %v", echoed)
+			}
+			require.NoError(t, stream.CloseSend())
+
+			// The controller answers in kind.
+			for _, counter := range []*payloadCounter{serverCounter, clientCounter} {
+				if tt.compress {
+					assert.Less(t, counter.wireLength, counter.length/4)
+				} else {
+					assert.GreaterOrEqual(t, counter.wireLength, counter.length)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCompression compares the time, and bytes sent, to carry a
+// response body through the tunnel and back.
+func BenchmarkCompression(b *testing.B) {
+	for _, items := range []int{10, 500} {
+		message := &MessageWrapper{Event: &MessageWrapper_HttpTunnelControl{HttpTunnelControl: &HttpTunnelControl{
+			ControlType: &HttpTunnelControl_HttpTunnelChunkedResponse{
+				HttpTunnelChunkedResponse: &HttpTunnelChunkedResponse{Id: "id1", Body: sampleBody(items)},
+			},
+		}}}
+		for _, compress := range []bool{false, true} {
+			b.Run(fmt.Sprintf("items=%d/compress=%v", items, compress), func(b *testing.B) {
+				stream, serverCounter, _ := startEchoTunnel(b, compress)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := stream.Send(message); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := stream.Recv(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(atomic.LoadInt64(&serverCounter.wireLength))/float64(b.N), "wire-bytes/op")
+			})
+		}
+	}
+}
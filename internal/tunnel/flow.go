@@ -0,0 +1,182 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import "sync"
+
+// Flow control bounds the amount of response data in flight for a single
+// request.  The requester sets OpenHTTPTunnelRequest.WindowSize, and the
+// side running the request will not send more than that many body bytes
+// which have not yet been acknowledged with a HttpTunnelWindowUpdate.
+// A requester which does not set a window gets no flow control, which
+// keeps older controllers and agents working.  Streamed request bodies, and
+// client data on an upgraded connection, are always flow controlled, with a
+// window of DefaultWindowSize.
+
+// DefaultWindowSize is the flow control window used when none is configured.
+const DefaultWindowSize = 1024 * 1024
+
+type flowWindow struct {
+	sync.Mutex
+	cond      *sync.Cond
+	available int64
+	closed    bool
+}
+
+func newFlowWindow(size int64) *flowWindow {
+	w := &flowWindow{available: size}
+	w.cond = sync.NewCond(w)
+	return w
+}
+
+// wait blocks until some of the window is available, and returns how much,
+// capped at max.  Zero is returned if the window was closed.
+func (w *flowWindow) wait(max int64) int64 {
+	w.Lock()
+	defer w.Unlock()
+	for w.available <= 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return 0
+	}
+	if w.available < max {
+		return w.available
+	}
+	return max
+}
+
+func (w *flowWindow) consume(n int64) {
+	w.Lock()
+	defer w.Unlock()
+	w.available -= n
+}
+
+func (w *flowWindow) release(n int64) {
+	w.Lock()
+	defer w.Unlock()
+	w.available += n
+	w.cond.Broadcast()
+}
+
+func (w *flowWindow) close() {
+	w.Lock()
+	defer w.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+type flowWindowRegistry struct {
+	sync.Mutex
+	m map[string]*flowWindow
+}
+
+// Windows for responses being sent from here are kept apart from those for
+// streamed request bodies, as a process talking to itself (as the tests do)
+// would otherwise have both under the same request id.
+var (
+	flowRegistry = &flowWindowRegistry{m: make(map[string]*flowWindow)}
+	sendRegistry = &flowWindowRegistry{m: make(map[string]*flowWindow)}
+)
+
+func (r *flowWindowRegistry) register(id string, w *flowWindow) {
+	r.Lock()
+	defer r.Unlock()
+	r.m[id] = w
+}
+
+func (r *flowWindowRegistry) unregister(id string) {
+	r.Lock()
+	defer r.Unlock()
+	if w, ok := r.m[id]; ok {
+		w.close()
+		delete(r.m, id)
+	}
+}
+
+func (r *flowWindowRegistry) release(id string, n int64) {
+	r.Lock()
+	w, ok := r.m[id]
+	r.Unlock()
+	if ok {
+		w.release(n)
+	}
+}
+
+func registerFlowWindow(id string, w *flowWindow) {
+	flowRegistry.register(id, w)
+}
+
+func unregisterFlowWindow(id string) {
+	flowRegistry.unregister(id)
+}
+
+// SendWindow limits the streamed request body sent for a request id to what
+// the receiver has acknowledged with HttpTunnelWindowUpdate messages.
+type SendWindow struct {
+	id string
+	w  *flowWindow
+}
+
+// OpenSendWindow registers a window of size bytes for the id.  Close must
+// be called once sending is done.
+func OpenSendWindow(id string, size int64) *SendWindow {
+	w := newFlowWindow(size)
+	sendRegistry.register(id, w)
+	return &SendWindow{id: id, w: w}
+}
+
+// Wait blocks until some of the window is available, and returns how much,
+// capped at max.  Zero is returned once the window is closed.
+func (s *SendWindow) Wait(max int64) int64 {
+	return s.w.wait(max)
+}
+
+// Consume records that n bytes have been sent.
+func (s *SendWindow) Consume(n int64) {
+	s.w.consume(n)
+}
+
+// Close unregisters the window, and unblocks any Wait.
+func (s *SendWindow) Close() {
+	sendRegistry.unregister(s.id)
+	s.w.close()
+}
+
+// UpdateFlowWindow acknowledges that the other side has consumed n bytes of
+// the response, or of the streamed request body, for the id, allowing more
+// to be sent.  Unknown ids are ignored, as the request may have completed
+// while the update was in flight.
+func UpdateFlowWindow(id string, n int64) {
+	flowRegistry.release(id, n)
+	sendRegistry.release(id, n)
+}
+
+// MakeHTTPTunnelWindowUpdate will make a wrapped message acknowledging n bytes of
+// response data for the id.
+func MakeHTTPTunnelWindowUpdate(id string, n int64) *MessageWrapper_HttpTunnelControl {
+	return &MessageWrapper_HttpTunnelControl{
+		HttpTunnelControl: &HttpTunnelControl{
+			ControlType: &HttpTunnelControl_HttpTunnelWindowUpdate{
+				HttpTunnelWindowUpdate: &HttpTunnelWindowUpdate{
+					Id:    id,
+					Bytes: n,
+				},
+			},
+		},
+	}
+}
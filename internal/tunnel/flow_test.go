@@ -0,0 +1,157 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowWindow_wait(t *testing.T) {
+	w := newFlowWindow(100)
+	assert.Equal(t, int64(50), w.wait(50))
+	assert.Equal(t, int64(100), w.wait(1000))
+	w.consume(100)
+
+	got := make(chan int64)
+	go func() { got <- w.wait(1000) }()
+	select {
+	case <-got:
+		require.FailNow(t, "wait returned with an empty window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.release(30)
+	assert.Equal(t, int64(30), <-got)
+
+	w.close()
+	assert.Equal(t, int64(0), w.wait(1000))
+}
+
+func TestSendWindow(t *testing.T) {
+	w := OpenSendWindow("send1", 100)
+	w.Consume(w.Wait(1000))
+
+	got := make(chan int64)
+	go func() { got <- w.Wait(1000) }()
+	select {
+	case <-got:
+		require.FailNow(t, "wait returned with an empty window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	UpdateFlowWindow("send1", 40)
+	assert.Equal(t, int64(40), <-got)
+
+	w.Close()
+	assert.Equal(t, int64(0), w.Wait(1000))
+	UpdateFlowWindow("send1", 40) // ignored once closed
+	assert.Equal(t, int64(0), w.Wait(1000))
+}
+
+// drain reads whatever is currently queued, waiting briefly for more.
+func drain(dataflow chan *MessageWrapper) (body []byte, eof bool) {
+	for {
+		select {
+		case msg := <-dataflow:
+			chunk := msg.GetHttpTunnelControl().GetHttpTunnelChunkedResponse()
+			if len(chunk.Body) == 0 {
+				return body, true
+			}
+			body = append(body, chunk.Body...)
+		case <-time.After(100 * time.Millisecond):
+			return body, false
+		}
+	}
+}
+
+func TestRunHTTPRequest_SlowConsumer(t *testing.T) {
+	const window = 4096
+	body := bytes.Repeat([]byte("0123456789abcdef"), 64*1024/16)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer upstream.Close()
+
+	req := &OpenHTTPTunnelRequest{Id: "flow1", Method: http.MethodGet, URI: "/", WindowSize: window}
+	httpRequest, err := http.NewRequest(req.Method, upstream.URL+req.URI, nil)
+	require.NoError(t, err)
+
+	// The channel could hold the entire body, so only the window limits
+	// what is sent.
+	dataflow := make(chan *MessageWrapper, 1000)
+	finished := make(chan struct{})
+	go func() {
+		RunHTTPRequest(upstream.Client(), req, httpRequest, dataflow, upstream.URL, ResponseOptions{Chunking: ChunkConfig{Size: 1024}})
+		close(finished)
+	}()
+
+	require.NotNil(t, nextMessage(t, dataflow).GetHttpTunnelResponse())
+
+	var got []byte
+	for {
+		chunk, eof := drain(dataflow)
+		assert.LessOrEqual(t, len(chunk), window, "more than a window in flight")
+		got = append(got, chunk...)
+		if eof {
+			break
+		}
+		require.NotEmpty(t, chunk, "sender stalled with an open window")
+		UpdateFlowWindow(req.Id, int64(len(chunk)))
+	}
+	assert.Equal(t, body, got)
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "RunHTTPRequest did not return")
+	}
+}
+
+func TestRunHTTPRequest_WindowClosedOnCancel(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 64*1024)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer upstream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := &OpenHTTPTunnelRequest{Id: "flow2", Method: http.MethodGet, URI: "/", WindowSize: 1024}
+	httpRequest, err := http.NewRequestWithContext(ctx, req.Method, upstream.URL+req.URI, nil)
+	require.NoError(t, err)
+
+	dataflow := make(chan *MessageWrapper, 100)
+	finished := make(chan struct{})
+	go func() {
+		RunHTTPRequest(upstream.Client(), req, httpRequest, dataflow, upstream.URL, ResponseOptions{Chunking: ChunkConfig{Size: 1024}})
+		close(finished)
+	}()
+
+	require.NotNil(t, nextMessage(t, dataflow).GetHttpTunnelResponse())
+	cancel()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "RunHTTPRequest blocked on a cancelled request")
+	}
+}
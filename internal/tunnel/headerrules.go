@@ -0,0 +1,49 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HeaderRules modify the headers of a request before it is sent to an
+// endpoint.  Headers named in Remove are deleted first, matched without
+// regard to case.  Set then replaces any existing values, and Add appends
+// a value, keeping any already present.
+type HeaderRules struct {
+	Remove []string          `yaml:"remove,omitempty" json:"remove,omitempty"`
+	Set    map[string]string `yaml:"set,omitempty" json:"set,omitempty"`
+	Add    map[string]string `yaml:"add,omitempty" json:"add,omitempty"`
+}
+
+// Apply modifies the headers according to the rules.
+func (r HeaderRules) Apply(headers http.Header) {
+	for _, name := range r.Remove {
+		for key := range headers {
+			if strings.EqualFold(key, name) {
+				delete(headers, key)
+			}
+		}
+	}
+	for name, value := range r.Set {
+		headers.Set(name, value)
+	}
+	for name, value := range r.Add {
+		headers.Add(name, value)
+	}
+}
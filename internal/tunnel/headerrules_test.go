@@ -0,0 +1,88 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderRules_Apply(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   HeaderRules
+		headers http.Header
+		want    http.Header
+	}{
+		{
+			"no rules",
+			HeaderRules{},
+			http.Header{"Accept": {"text/plain"}},
+			http.Header{"Accept": {"text/plain"}},
+		},
+		{
+			"add new",
+			HeaderRules{Add: map[string]string{"x-forwarded-host": "example.com"}},
+			http.Header{"Accept": {"text/plain"}},
+			http.Header{"Accept": {"text/plain"}, "X-Forwarded-Host": {"example.com"}},
+		},
+		{
+			"add keeps existing",
+			HeaderRules{Add: map[string]string{"Accept": "application/json"}},
+			http.Header{"Accept": {"text/plain"}},
+			http.Header{"Accept": {"text/plain", "application/json"}},
+		},
+		{
+			"set overwrites",
+			HeaderRules{Set: map[string]string{"accept": "application/json"}},
+			http.Header{"Accept": {"text/plain", "text/html"}},
+			http.Header{"Accept": {"application/json"}},
+		},
+		{
+			"remove exact",
+			HeaderRules{Remove: []string{"Cookie"}},
+			http.Header{"Accept": {"text/plain"}, "Cookie": {"a=b"}},
+			http.Header{"Accept": {"text/plain"}},
+		},
+		{
+			"remove ignores case",
+			HeaderRules{Remove: []string{"COOKIE", "x-secret"}},
+			http.Header{"Cookie": {"a=b"}, "x-secret": {"noncanonical"}, "X-Other": {"kept"}},
+			http.Header{"X-Other": {"kept"}},
+		},
+		{
+			"remove then set",
+			HeaderRules{Remove: []string{"Host-Override"}, Set: map[string]string{"Host-Override": "fixed"}},
+			http.Header{"Host-Override": {"client"}},
+			http.Header{"Host-Override": {"fixed"}},
+		},
+		{
+			"remove missing",
+			HeaderRules{Remove: []string{"Cookie"}},
+			http.Header{},
+			http.Header{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rules.Apply(tt.headers)
+			assert.Equal(t, tt.want, tt.headers)
+		})
+	}
+}
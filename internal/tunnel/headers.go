@@ -16,7 +16,10 @@
 
 package tunnel
 
-import "strings"
+import (
+	"net/http"
+	"strings"
+)
 
 // GetHeaderValue will search the array of headers, and return the first
 // value if found.  If not found, it will return an empty string.
@@ -28,3 +31,19 @@ func (t *OpenHTTPTunnelRequest) GetHeaderValue(name string) string {
 	}
 	return ""
 }
+
+// allowHeaders returns a copy of the headers with only those named in allow,
+// matched without regard to case.  If allow is empty, all the headers are
+// returned.
+func allowHeaders(headers http.Header, allow []string) http.Header {
+	if len(allow) == 0 {
+		return headers
+	}
+	ret := http.Header{}
+	for name, values := range headers {
+		if containsFolded(allow, name) {
+			ret[name] = values
+		}
+	}
+	return ret
+}
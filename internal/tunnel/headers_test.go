@@ -0,0 +1,83 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowHeaders(t *testing.T) {
+	headers := http.Header{
+		"Content-Type":      {"text/plain"},
+		"X-Internal-Server": {"pod-1.cluster.local"},
+		"X-Request-Id":      {"abc"},
+	}
+	tests := []struct {
+		name  string
+		allow []string
+		want  http.Header
+	}{
+		{"empty allows all", nil, headers},
+		{
+			"allowed only",
+			[]string{"content-type", "X-Request-Id"},
+			http.Header{"Content-Type": {"text/plain"}, "X-Request-Id": {"abc"}},
+		},
+		{"nothing matches", []string{"X-Other"}, http.Header{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, allowHeaders(headers, tt.allow))
+		})
+	}
+}
+
+func TestMakeResponse_allowedHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		allow  []string
+		want   http.Header
+	}{
+		{"all", http.StatusOK, nil, http.Header{"Content-Type": {"text/plain"}, "X-Internal-Server": {"pod-1"}}},
+		{"allowed", http.StatusOK, []string{"Content-Type"}, http.Header{"Content-Type": {"text/plain"}}},
+		{
+			"upgrade keeps upgrade headers",
+			http.StatusSwitchingProtocols,
+			[]string{"Content-Type"},
+			http.Header{"Content-Type": {"text/plain"}, "Connection": {"Upgrade"}, "Upgrade": {"websocket"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{
+				"Content-Type":      {"text/plain"},
+				"X-Internal-Server": {"pod-1"},
+			}
+			if tt.status == http.StatusSwitchingProtocols {
+				header.Set("Connection", "Upgrade")
+				header.Set("Upgrade", "websocket")
+			}
+			msg, err := makeResponse("id", &http.Response{StatusCode: tt.status, Header: header}, nil, tt.allow)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, headerMap(msg.GetHttpTunnelControl().GetHttpTunnelResponse().Headers))
+		})
+	}
+}
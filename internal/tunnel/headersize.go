@@ -0,0 +1,53 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+const (
+	// DefaultMaxHeaderBytes is the largest set of response headers sent back
+	// over the tunnel, unless configured otherwise.
+	DefaultMaxHeaderBytes = 1024 * 1024
+
+	// maxMaxHeaderBytes is the largest limit which may be configured.  The
+	// headers are sent in a single message, so this must stay well under
+	// the GRPC maximum message size.
+	maxMaxHeaderBytes = 2 * 1024 * 1024
+)
+
+// headerLimit returns the response header size limit to use when max is
+// configured.  Zero means DefaultMaxHeaderBytes, and anything larger than
+// the GRPC message size allows is reduced to fit.
+func headerLimit(max int64) int64 {
+	if max <= 0 {
+		return DefaultMaxHeaderBytes
+	}
+	if max > maxMaxHeaderBytes {
+		return maxMaxHeaderBytes
+	}
+	return max
+}
+
+// headerBytes returns the size of the headers as they would be written in
+// an HTTP/1.1 message, with a "Name: value\r\n" line for each value.
+func headerBytes(headers []*HttpHeader) int64 {
+	var n int64
+	for _, header := range headers {
+		for _, value := range header.Values {
+			n += int64(len(header.Name) + len(value) + 4)
+		}
+	}
+	return n
+}
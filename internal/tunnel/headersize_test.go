@@ -0,0 +1,107 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderLimit(t *testing.T) {
+	assert.Equal(t, int64(DefaultMaxHeaderBytes), headerLimit(0))
+	assert.Equal(t, int64(DefaultMaxHeaderBytes), headerLimit(-1))
+	assert.Equal(t, int64(100), headerLimit(100))
+	assert.Equal(t, int64(maxMaxHeaderBytes), headerLimit(maxMaxHeaderBytes+1))
+}
+
+func TestHeaderBytes(t *testing.T) {
+	headers := []*HttpHeader{
+		{Name: "Warning", Values: []string{"299 - \"a\"", "299 - \"b\""}},
+		{Name: "X-Empty", Values: []string{""}},
+	}
+	// "Warning: 299 - "a"\r\n" twice, and "X-Empty: \r\n"
+	assert.Equal(t, int64(20+20+11), headerBytes(headers))
+}
+
+// runLargeHeaderRequest returns the response sent for an upstream reply
+// with a Warning header of warningSize bytes.
+func runLargeHeaderRequest(t *testing.T, warningSize int, maxHeaderBytes int64) *HttpTunnelResponse {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Warning", strings.Repeat("w", warningSize))
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("body"))
+	}))
+	defer upstream.Close()
+
+	req := &OpenHTTPTunnelRequest{Id: "large-headers", Method: http.MethodGet, URI: "/"}
+	httpRequest, err := http.NewRequest(req.Method, upstream.URL+req.URI, nil)
+	require.NoError(t, err)
+
+	dataflow := make(chan *MessageWrapper, 10)
+	RunHTTPRequest(upstream.Client(), req, httpRequest, dataflow, upstream.URL, ResponseOptions{MaxHeaderBytes: maxHeaderBytes})
+	close(dataflow)
+	resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+	require.NotNil(t, resp)
+	return resp
+}
+
+func TestRunHTTPRequest_maxHeaderBytes(t *testing.T) {
+	// The other headers (Date, Content-Type, Content-Length) are a fixed
+	// size, so find the size of the response's headers, and use that as
+	// the limit.
+	resp := runLargeHeaderRequest(t, 1000, 0)
+	require.Equal(t, int32(http.StatusOK), resp.Status)
+	limit := headerBytes(resp.Headers)
+
+	tests := []struct {
+		name        string
+		warningSize int
+		limit       int64
+		wantStatus  int32
+	}{
+		{"under limit", 999, limit, http.StatusOK},
+		{"at limit", 1000, limit, http.StatusOK},
+		{"over limit", 1001, limit, http.StatusBadGateway},
+		{"over default limit", DefaultMaxHeaderBytes, 0, http.StatusBadGateway},
+		{"raised limit", DefaultMaxHeaderBytes, DefaultMaxHeaderBytes + 1000, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := runLargeHeaderRequest(t, tt.warningSize, tt.limit)
+			assert.Equal(t, tt.wantStatus, resp.Status)
+			if tt.wantStatus == http.StatusBadGateway {
+				assert.Empty(t, resp.Headers, "oversized headers must not be sent")
+			} else {
+				assert.Len(t, responseHeader(resp, "Warning"), tt.warningSize)
+			}
+		})
+	}
+}
+
+func responseHeader(resp *HttpTunnelResponse, name string) string {
+	for _, header := range resp.Headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Values[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders describe the connection to the upstream rather than the
+// response (RFC 7230, section 6.1), and are not relayed to the requester,
+// whose own connection to the controller has its own.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// stripHopByHopHeaders returns a copy of the headers without the hop-by-hop
+// headers, including any named in the Connection header, unless they are
+// listed in preserve.
+func stripHopByHopHeaders(headers http.Header, preserve []string) http.Header {
+	strip := append([]string{}, hopByHopHeaders...)
+	for _, value := range headers.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				strip = append(strip, token)
+			}
+		}
+	}
+
+	ret := http.Header{}
+	for name, values := range headers {
+		if containsFolded(strip, name) && !containsFolded(preserve, name) {
+			continue
+		}
+		ret[name] = values
+	}
+	return ret
+}
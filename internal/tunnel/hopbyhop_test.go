@@ -0,0 +1,143 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripHopByHopHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  http.Header
+		preserve []string
+		want     http.Header
+	}{
+		{
+			"end-to-end only",
+			http.Header{"Content-Type": {"text/plain"}, "X-Custom": {"a"}},
+			nil,
+			http.Header{"Content-Type": {"text/plain"}, "X-Custom": {"a"}},
+		},
+		{
+			"standard hop-by-hop",
+			http.Header{
+				"Connection":        {"keep-alive"},
+				"Keep-Alive":        {"timeout=5"},
+				"Transfer-Encoding": {"chunked"},
+				"Upgrade":           {"h2c"},
+				"Te":                {"trailers"},
+				"Content-Type":      {"text/plain"},
+			},
+			nil,
+			http.Header{"Content-Type": {"text/plain"}},
+		},
+		{
+			"named in Connection",
+			http.Header{"Connection": {"X-Hop, x-other"}, "X-Hop": {"a"}, "X-Other": {"b"}, "X-Keep": {"c"}},
+			nil,
+			http.Header{"X-Keep": {"c"}},
+		},
+		{
+			"preserved",
+			http.Header{"Connection": {"X-Hop"}, "X-Hop": {"a"}, "Keep-Alive": {"timeout=5"}},
+			[]string{"x-hop", "Keep-Alive"},
+			http.Header{"X-Hop": {"a"}, "Keep-Alive": {"timeout=5"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, stripHopByHopHeaders(tt.headers, tt.preserve))
+		})
+	}
+}
+
+func headerMap(headers []*HttpHeader) http.Header {
+	ret := http.Header{}
+	for _, header := range headers {
+		ret[header.Name] = header.Values
+	}
+	return ret
+}
+
+func TestMakeResponse_hopByHop(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		preserve []string
+		want     http.Header
+	}{
+		{"stripped", http.StatusOK, nil, http.Header{"X-End": {"b"}}},
+		{"preserved", http.StatusOK, []string{"Keep-Alive"}, http.Header{"X-End": {"b"}, "Keep-Alive": {"timeout=5"}}},
+		{"upgrade", http.StatusSwitchingProtocols, nil, http.Header{"X-End": {"b"}, "Connection": {"Upgrade"}, "Upgrade": {"websocket"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := &http.Response{
+				StatusCode: tt.status,
+				Header: http.Header{
+					"Connection":        {"Upgrade"},
+					"Upgrade":           {"websocket"},
+					"Keep-Alive":        {"timeout=5"},
+					"Transfer-Encoding": {"chunked"},
+					"X-End":             {"b"},
+				},
+			}
+			msg, err := makeResponse("id", response, tt.preserve, nil)
+			require.NoError(t, err)
+			resp := msg.GetHttpTunnelControl().GetHttpTunnelResponse()
+			assert.Equal(t, tt.want, headerMap(resp.Headers))
+		})
+	}
+}
+
+func TestRunHTTPRequest_hopByHop(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "hop")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-End", "end")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		// Flushing before the body forces a chunked response.
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte("body"))
+	}))
+	defer upstream.Close()
+
+	req := &OpenHTTPTunnelRequest{Id: "hop1", Method: http.MethodGet, URI: "/"}
+	httpRequest, err := http.NewRequest(req.Method, upstream.URL+req.URI, nil)
+	require.NoError(t, err)
+
+	dataflow := make(chan *MessageWrapper, 10)
+	RunHTTPRequest(upstream.Client(), req, httpRequest, dataflow, upstream.URL, ResponseOptions{})
+	close(dataflow)
+
+	resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+	require.NotNil(t, resp)
+	headers := headerMap(resp.Headers)
+	for _, name := range []string{"Connection", "X-Hop", "Keep-Alive", "Transfer-Encoding"} {
+		assert.NotContains(t, headers, name)
+	}
+	assert.Equal(t, []string{"end"}, headers["X-End"])
+	assert.Equal(t, []string{"text/plain"}, headers["Content-Type"])
+}
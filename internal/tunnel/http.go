@@ -18,7 +18,9 @@ package tunnel
 
 import (
 	"context"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"strings"
 
@@ -27,6 +29,15 @@ import (
 	"go.uber.org/zap"
 )
 
+// UpstreamErrorHeader is set on a 502 sent because the request could not
+// be made, to say why.  UpstreamErrorDNS means the upstream's hostname did
+// not resolve, which is often transient.  The controller does not relay
+// it to the client.
+const (
+	UpstreamErrorHeader = "X-Opsmx-Upstream-Error"
+	UpstreamErrorDNS    = "dns"
+)
+
 var (
 	emptyBytes              = []byte("")
 	mutatedHeaders          = []string{"X-Spinnaker-User"}
@@ -82,6 +93,24 @@ func CopyHeaders(headers []*HttpHeader, out *http.Header) error {
 	return nil
 }
 
+// makeFinalChunkedResponse makes the zero length chunk which indicates EOF,
+// with any trailers.
+func makeFinalChunkedResponse(id string, trailers func() http.Header) *MessageWrapper {
+	msg := makeChunkedResponse(id, emptyBytes)
+	if trailers == nil {
+		return msg
+	}
+	headers, err := MakeHeaders(trailers())
+	if err != nil {
+		zap.S().Warnf("Failed to convert trailers: %v", err)
+		return msg
+	}
+	if len(headers) > 0 {
+		msg.GetHttpTunnelControl().GetHttpTunnelChunkedResponse().Trailers = headers
+	}
+	return msg
+}
+
 func makeChunkedResponse(id string, data []byte) *MessageWrapper {
 	return &MessageWrapper{
 		Event: &MessageWrapper_HttpTunnelControl{
@@ -100,13 +129,84 @@ func makeChunkedResponse(id string, data []byte) *MessageWrapper {
 // MakeBadGatewayResponse will generate a 502 HTTP status code and return it,
 // to indicate there is no such endpoint in the agent.
 func MakeBadGatewayResponse(id string) *MessageWrapper {
+	return makeStatusResponse(id, http.StatusBadGateway)
+}
+
+// MakeDNSFailureResponse will generate a 502 HTTP status code and return
+// it, marked to indicate the upstream's hostname did not resolve.
+func MakeDNSFailureResponse(id string) *MessageWrapper {
+	msg := makeStatusResponse(id, http.StatusBadGateway)
+	msg.GetHttpTunnelControl().GetHttpTunnelResponse().Headers = []*HttpHeader{
+		{Name: UpstreamErrorHeader, Values: []string{UpstreamErrorDNS}},
+	}
+	return msg
+}
+
+// IsDNSFailureResponse returns true if resp was made by
+// MakeDNSFailureResponse.
+func IsDNSFailureResponse(resp *HttpTunnelResponse) bool {
+	if resp.Status != http.StatusBadGateway {
+		return false
+	}
+	for _, header := range resp.Headers {
+		if header.Name == UpstreamErrorHeader && len(header.Values) == 1 && header.Values[0] == UpstreamErrorDNS {
+			return true
+		}
+	}
+	return false
+}
+
+// MakeGatewayTimeoutResponse will generate a 504 HTTP status code and
+// return it, to indicate the upstream did not respond before the deadline.
+func MakeGatewayTimeoutResponse(id string) *MessageWrapper {
+	return makeStatusResponse(id, http.StatusGatewayTimeout)
+}
+
+// MakeBadRequestResponse will generate a 400 HTTP status code and return
+// it, to indicate the endpoint cannot make the request as asked.
+func MakeBadRequestResponse(id string) *MessageWrapper {
+	return makeStatusResponse(id, http.StatusBadRequest)
+}
+
+// MakeForbiddenResponse will generate a 403 HTTP status code and return it,
+// to indicate the endpoint does not allow the request.
+func MakeForbiddenResponse(id string) *MessageWrapper {
+	return makeStatusResponse(id, http.StatusForbidden)
+}
+
+// MakeMethodNotAllowedResponse will generate a 405 HTTP status code and
+// return it, to indicate the endpoint does not support the request method.
+func MakeMethodNotAllowedResponse(id string) *MessageWrapper {
+	return makeStatusResponse(id, http.StatusMethodNotAllowed)
+}
+
+// MakeServiceUnavailableResponse will generate a 503 HTTP status code and
+// return it, to indicate the endpoint is not currently accepting requests.
+func MakeServiceUnavailableResponse(id string) *MessageWrapper {
+	return makeStatusResponse(id, http.StatusServiceUnavailable)
+}
+
+// MakeRequestEntityTooLargeResponse will generate a 413 HTTP status code and
+// return it, to indicate the request body is larger than the endpoint allows.
+func MakeRequestEntityTooLargeResponse(id string) *MessageWrapper {
+	return makeStatusResponse(id, http.StatusRequestEntityTooLarge)
+}
+
+// RequestBodyTooLarge returns true if max is set and the request's body
+// is known to be larger than it.  A streamed body of unknown length is
+// checked as it is read, by LimitRequestBody.
+func RequestBodyTooLarge(req *OpenHTTPTunnelRequest, max int64) bool {
+	return max > 0 && RequestContentLength(req) > max
+}
+
+func makeStatusResponse(id string, status int) *MessageWrapper {
 	return &MessageWrapper{
 		Event: &MessageWrapper_HttpTunnelControl{
 			HttpTunnelControl: &HttpTunnelControl{
 				ControlType: &HttpTunnelControl_HttpTunnelResponse{
 					HttpTunnelResponse: &HttpTunnelResponse{
 						Id:            id,
-						Status:        http.StatusBadGateway,
+						Status:        int32(status),
 						ContentLength: 0,
 					},
 				},
@@ -115,8 +215,18 @@ func MakeBadGatewayResponse(id string) *MessageWrapper {
 	}
 }
 
-func makeResponse(id string, response *http.Response) (ret *MessageWrapper, err error) {
-	headers, err := MakeHeaders(response.Header)
+func makeResponse(id string, response *http.Response, preserveHeaders []string, allowedHeaders []string) (ret *MessageWrapper, err error) {
+	contentLength := response.ContentLength
+	if response.StatusCode == http.StatusSwitchingProtocols {
+		// an upgraded connection streams until one side closes it, and
+		// the client needs to see what it was upgraded to.
+		contentLength = -1
+		preserveHeaders = append([]string{"Connection", "Upgrade"}, preserveHeaders...)
+		if len(allowedHeaders) > 0 {
+			allowedHeaders = append([]string{"Connection", "Upgrade"}, allowedHeaders...)
+		}
+	}
+	headers, err := MakeHeaders(stripHopByHopHeaders(allowHeaders(response.Header, allowedHeaders), preserveHeaders))
 	if err != nil {
 		return
 	}
@@ -127,7 +237,7 @@ func makeResponse(id string, response *http.Response) (ret *MessageWrapper, err
 					HttpTunnelResponse: &HttpTunnelResponse{
 						Id:            id,
 						Status:        int32(response.StatusCode),
-						ContentLength: response.ContentLength,
+						ContentLength: contentLength,
 						Headers:       headers,
 					},
 				},
@@ -137,52 +247,208 @@ func makeResponse(id string, response *http.Response) (ret *MessageWrapper, err
 	return
 }
 
+// ResponseOptions are how an endpoint sends its upstream's responses back
+// through the tunnel.  The body is sent in chunks sized according to
+// Chunking.  Hop-by-hop response headers are not sent, other than those
+// named in PreserveHeaders.  If AllowedHeaders is not empty, only the
+// response headers it names are sent.  If the headers sent would be larger
+// than MaxHeaderBytes (DefaultMaxHeaderBytes if zero), a 502 is returned
+// instead.  The body is limited by BodyLimit.  Responses whose status is in
+// StatusMap are remapped.
+type ResponseOptions struct {
+	Chunking        ChunkConfig
+	PreserveHeaders []string
+	AllowedHeaders  []string
+	MaxHeaderBytes  int64
+	BodyLimit       ResponseBodyLimit
+	StatusMap       StatusMap
+}
+
 // RunHTTPRequest will make a HTTP request, and send the data to the remote end.
-func RunHTTPRequest(client *http.Client, req *OpenHTTPTunnelRequest, httpRequest *http.Request, dataflow chan *MessageWrapper, baseURL string) {
+// The response is sent according to options, with the body followed by a
+// zero length chunk to indicate EOF.  A 502 or 504 returned because no
+// response was received is not remapped.  If the upstream's hostname did
+// not resolve, the 502 says so in UpstreamErrorHeader.
+func RunHTTPRequest(client *http.Client, req *OpenHTTPTunnelRequest, httpRequest *http.Request, dataflow chan *MessageWrapper, baseURL string, options ResponseOptions) {
 	requestURI := baseURL + req.URI
-	zap.S().Debugf("Sending HTTP request: %s to %s", req.Method, requestURI)
+	zap.S().Debugw("sending HTTP request", "method", req.Method, "uri", requestURI, "requestId", RequestID(req))
 	httpResponse, err := client.Do(httpRequest)
+	if err != nil && errors.Is(err, ErrRequestBodyTooLarge) {
+		zap.S().Warnw("request body too large",
+			"method", req.Method,
+			"uri", baseURL+req.URI,
+			"requestId", RequestID(req))
+		dataflow <- MakeRequestEntityTooLargeResponse(req.Id)
+		return
+	}
 	if err != nil {
 		zap.S().Warnw("failed to execute request",
 			"method", req.Method,
 			"uri", baseURL+req.URI,
+			"requestId", RequestID(req),
 			"error", err)
+		if errors.Is(httpRequest.Context().Err(), context.Canceled) {
+			recordUpstreamCancelled(req)
+		} else {
+			recordUpstreamFailure(req)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			dataflow <- MakeGatewayTimeoutResponse(req.Id)
+			return
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			dataflow <- MakeDNSFailureResponse(req.Id)
+			return
+		}
 		dataflow <- MakeBadGatewayResponse(req.Id)
 		return
 	}
+	recordUpstreamStatus(req, httpResponse.StatusCode)
 
 	defer httpResponse.Body.Close()
 
+	mapping := options.StatusMap.find(httpResponse.StatusCode)
+	if mapping != nil {
+		zap.S().Debugw("remapping upstream status",
+			"method", req.Method,
+			"uri", requestURI,
+			"requestId", RequestID(req),
+			"status", httpResponse.StatusCode,
+			"mappedStatus", mapping.To)
+		if mapping.Body != "" {
+			mapping.sendMappedBody(req.Id, dataflow)
+			return
+		}
+	}
+
+	// If the connection was upgraded, the body is also where the client's data
+	// is written.  This needs to be registered before the headers are sent, as
+	// the client may start sending as soon as it sees them.
+	if httpResponse.StatusCode == http.StatusSwitchingProtocols {
+		rwc, ok := httpResponse.Body.(io.ReadWriteCloser)
+		if !ok {
+			zap.S().Warnw("upgraded response body is not writable",
+				"method", req.Method,
+				"uri", requestURI)
+			dataflow <- MakeBadGatewayResponse(req.Id)
+			return
+		}
+		defer RegisterUpgradeConnection(req.Id, rwc, dataflow)()
+	}
+
 	// First, send the headers.
-	response, err := makeResponse(req.Id, httpResponse)
+	response, err := makeResponse(req.Id, httpResponse, options.PreserveHeaders, options.AllowedHeaders)
 	if err != nil {
 		zap.S().Warnf("Failed to unmutate headers: %v", err)
 		dataflow <- MakeBadGatewayResponse(req.Id)
 		return
 	}
+	size := headerBytes(response.GetHttpTunnelControl().GetHttpTunnelResponse().Headers)
+	if limit := headerLimit(options.MaxHeaderBytes); size > limit {
+		zap.S().Warnw("response headers too large",
+			"method", req.Method,
+			"uri", requestURI,
+			"requestId", RequestID(req),
+			"size", size,
+			"limit", limit)
+		dataflow <- MakeBadGatewayResponse(req.Id)
+		return
+	}
+	if mapping != nil {
+		mapping.sendMappedStatus(req.Id, response, dataflow)
+		return
+	}
+	maxBodyBytes := options.BodyLimit.limit(httpResponse)
+	if maxBodyBytes > 0 && httpResponse.ContentLength > maxBodyBytes {
+		zap.S().Warnw("response body too large",
+			"method", req.Method,
+			"uri", requestURI,
+			"requestId", RequestID(req),
+			"contentLength", httpResponse.ContentLength,
+			"limit", maxBodyBytes)
+		dataflow <- MakeBadGatewayResponse(req.Id)
+		return
+	}
 	dataflow <- response
 
 	if !httputil.StatusCodeOK(httpResponse.StatusCode) {
-		zap.S().Warnw("non-2xx status for request", "method", req.Method, "url", requestURI)
+		zap.S().Warnw("non-2xx status for request", "method", req.Method, "url", requestURI, "requestId", RequestID(req))
 	}
 
-	// Now, send one or more data packet.
+	// Now, send one or more data packet.  Trailers are only known once the
+	// body has been read.
+	sendBody(httpRequest.Context(), req, httpResponse.Body, dataflow, options.Chunking, maxBodyBytes, func() http.Header {
+		return httpResponse.Trailer
+	})
+}
+
+// sendBody sends the body in chunks, ending with a zero length chunk to
+// indicate EOF, unless ctx is cancelled first.  If trailers is not nil,
+// the headers it returns are sent with the EOF chunk.  If maxBytes is set,
+// no more than that is sent, and a longer body ends early with the
+// ResponseTruncatedTrailer.
+func sendBody(ctx context.Context, req *OpenHTTPTunnelRequest, body io.Reader, dataflow chan *MessageWrapper, chunking ChunkConfig, maxBytes int64, trailers func() http.Header) {
+	// If the requester will acknowledge what it has consumed, only read as much
+	// of the body as it has room for.
+	var window *flowWindow
+	if req.WindowSize > 0 {
+		window = newFlowWindow(req.WindowSize)
+		registerFlowWindow(req.Id, window)
+		defer unregisterFlowWindow(req.Id)
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				window.close()
+			case <-done:
+			}
+		}()
+	}
+
+	sizer := chunking.sizer()
+	var sent int64
 	for {
-		buf := make([]byte, 10240)
-		n, err := httpResponse.Body.Read(buf)
+		size := int64(sizer.next())
+		if window != nil {
+			if size = window.wait(size); size == 0 {
+				zap.S().Debugf("Flow control window closed, request ID %s", req.Id)
+				return
+			}
+		}
+		buf := make([]byte, size)
+		n, err := body.Read(buf)
+		if maxBytes > 0 && sent+int64(n) > maxBytes {
+			zap.S().Warnw("response body too large, truncating",
+				"method", req.Method,
+				"uri", req.URI,
+				"requestId", RequestID(req),
+				"limit", maxBytes)
+			if remaining := maxBytes - sent; remaining > 0 {
+				dataflow <- makeChunkedResponse(req.Id, buf[:remaining])
+			}
+			dataflow <- makeFinalChunkedResponse(req.Id, truncatedTrailers(trailers, maxBytes))
+			return
+		}
+		sent += int64(n)
 		if n > 0 {
+			if window != nil {
+				window.consume(int64(n))
+			}
 			dataflow <- makeChunkedResponse(req.Id, buf[:n])
 		}
+		sizer.update(n)
 		if err == io.EOF {
-			dataflow <- makeChunkedResponse(req.Id, emptyBytes)
+			dataflow <- makeFinalChunkedResponse(req.Id, trailers)
 			return
 		}
-		if err == context.Canceled {
+		if err == context.Canceled || (err != nil && ctx.Err() != nil) {
 			zap.S().Debugf("Context cancelled, request ID %s", req.Id)
 			return
 		}
 		if err != nil {
-			zap.S().Warnf("Got error on HTTP read: %v", err)
+			zap.S().Warnf("Got error on read: %v", err)
 			// todo: send an error message somehow.  For now, just send EOF
 			dataflow <- makeChunkedResponse(req.Id, emptyBytes)
 			return
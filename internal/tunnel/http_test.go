@@ -17,7 +17,11 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/opsmx/oes-birger/internal/jwtutil"
@@ -320,3 +324,61 @@ func TestCopyHeaders_Unmutate(t *testing.T) {
 		})
 	}
 }
+
+func TestRunHTTPRequest_Trailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = w.Write([]byte("body"))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	defer upstream.Close()
+
+	req := &OpenHTTPTunnelRequest{Id: "t1", Method: http.MethodGet, URI: "/"}
+	httpRequest, err := http.NewRequest(req.Method, upstream.URL+req.URI, nil)
+	require.NoError(t, err)
+
+	dataflow := make(chan *MessageWrapper, 10)
+	RunHTTPRequest(upstream.Client(), req, httpRequest, dataflow, upstream.URL, ResponseOptions{})
+	close(dataflow)
+
+	require.NotNil(t, (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse())
+	var last *HttpTunnelChunkedResponse
+	for msg := range dataflow {
+		last = msg.GetHttpTunnelControl().GetHttpTunnelChunkedResponse()
+		require.NotNil(t, last)
+	}
+	assert.Empty(t, last.Body)
+	require.Len(t, last.Trailers, 1)
+	assert.Equal(t, "Grpc-Status", last.Trailers[0].Name)
+	assert.Equal(t, []string{"0"}, last.Trailers[0].Values)
+}
+
+func TestRunHTTPRequest_dnsFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialErr error
+		wantDNS bool
+	}{
+		{"dns", &net.DNSError{Err: "server misbehaving", Name: "upstream.example.com", IsTemporary: true}, true},
+		{"connection refused", errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return nil, &net.OpError{Op: "dial", Net: network, Err: tt.dialErr}
+				},
+			}}
+			req := &OpenHTTPTunnelRequest{Id: "dns", Method: http.MethodGet, URI: "/"}
+			httpRequest, err := http.NewRequest(req.Method, "http://upstream.example.com/", nil)
+			require.NoError(t, err)
+
+			dataflow := make(chan *MessageWrapper, 10)
+			RunHTTPRequest(client, req, httpRequest, dataflow, "http://upstream.example.com", ResponseOptions{})
+			resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+			require.NotNil(t, resp)
+			assert.Equal(t, int32(http.StatusBadGateway), resp.Status)
+			assert.Equal(t, tt.wantDNS, IsDNSFailureResponse(resp))
+		})
+	}
+}
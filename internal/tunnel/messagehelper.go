@@ -36,3 +36,13 @@ func MakePingResponse(req *PingRequest) *MessageWrapper {
 	}
 	return resp
 }
+
+// MakeReconnect will format a request asking an agent to reconnect to another
+// controller, able to be sent directly over the tunnel.
+func MakeReconnect(controllerHostname string) *MessageWrapper {
+	return &MessageWrapper{
+		Event: &MessageWrapper_Reconnect{
+			Reconnect: &Reconnect{ControllerHostname: controllerHostname},
+		},
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// upstreamConnectionFailed is the code recorded when no response was
+	// received from the upstream at all, such as when it could not be reached.
+	upstreamConnectionFailed = "0"
+	// upstreamCancelled is the code recorded when the client gave up on the
+	// request before the upstream responded.
+	upstreamCancelled = "cancelled"
+)
+
+var (
+	upstreamResponseStatusCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_response_status_total",
+		Help: "The total number of upstream responses, by endpoint and HTTP status code (0 if the request failed, cancelled if the client gave up)",
+	}, []string{"endpoint", "code"})
+)
+
+func recordUpstreamStatus(req *OpenHTTPTunnelRequest, statusCode int) {
+	upstreamResponseStatusCounter.WithLabelValues(req.Name, strconv.Itoa(statusCode)).Inc()
+}
+
+func recordUpstreamFailure(req *OpenHTTPTunnelRequest) {
+	upstreamResponseStatusCounter.WithLabelValues(req.Name, upstreamConnectionFailed).Inc()
+}
+
+func recordUpstreamCancelled(req *OpenHTTPTunnelRequest) {
+	upstreamResponseStatusCounter.WithLabelValues(req.Name, upstreamCancelled).Inc()
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunHTTPRequest_UpstreamStatusMetric(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	// A port nothing is listening on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedURL := "http://" + l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name     string
+		endpoint string
+		baseURL  string
+		uri      string
+		cancel   bool
+		wantCode string
+	}{
+		{"ok", "metrics-ok", upstream.URL, "/", false, "200"},
+		{"not found", "metrics-missing", upstream.URL, "/missing", false, "404"},
+		{"connection failure", "metrics-down", closedURL, "/", false, "0"},
+		{"cancelled", "metrics-cancelled", upstream.URL, "/", true, "cancelled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := upstreamResponseStatusCounter.WithLabelValues(tt.endpoint, tt.wantCode)
+			before := testutil.ToFloat64(counter)
+
+			req := &OpenHTTPTunnelRequest{Id: "metrics", Name: tt.endpoint, Method: http.MethodGet, URI: tt.uri}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+			httpRequest, err := http.NewRequestWithContext(ctx, req.Method, tt.baseURL+req.URI, nil)
+			require.NoError(t, err)
+			dataflow := make(chan *MessageWrapper, 10)
+			RunHTTPRequest(upstream.Client(), req, httpRequest, dataflow, tt.baseURL, ResponseOptions{})
+
+			assert.Equal(t, before+1, testutil.ToFloat64(counter))
+			for _, code := range []string{"200", "404", "0", "cancelled"} {
+				if code != tt.wantCode {
+					assert.Zero(t, testutil.ToFloat64(upstreamResponseStatusCounter.WithLabelValues(tt.endpoint, code)), "code %s", code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// DefaultMaxMessageSize is the largest message sent or received over
+	// the tunnel unless configured otherwise.  It is larger than gRPC's
+	// 4MB default so a request body, or a chunk of the largest size, fits
+	// with room to spare for headers.
+	DefaultMaxMessageSize = 16 * 1024 * 1024
+
+	// MinMaxMessageSize is the smallest message size limit allowed, which
+	// holds a chunk of the default maximum size and its headers.
+	MinMaxMessageSize = defaultMaxChunkSize + 64*1024
+)
+
+// MessageSizeConfig limits the size of the messages sent and received over
+// the tunnel.  Zero uses DefaultMaxMessageSize.  The agent and controller
+// should use the same limits, as a message larger than the receiver's
+// limit closes the tunnel.
+type MessageSizeConfig struct {
+	MaxRecvMsgSize int `yaml:"maxRecvMsgSize,omitempty" json:"maxRecvMsgSize,omitempty"`
+	MaxSendMsgSize int `yaml:"maxSendMsgSize,omitempty" json:"maxSendMsgSize,omitempty"`
+}
+
+// Validate returns the problems with the limits.
+func (c MessageSizeConfig) Validate() []error {
+	problems := []error{}
+	check := func(name string, size int) {
+		if size < 0 {
+			problems = append(problems, fmt.Errorf("%s must not be negative", name))
+		} else if size > 0 && size < MinMaxMessageSize {
+			problems = append(problems, fmt.Errorf("%s must be at least %d bytes", name, MinMaxMessageSize))
+		}
+	}
+	check("maxRecvMsgSize", c.MaxRecvMsgSize)
+	check("maxSendMsgSize", c.MaxSendMsgSize)
+	return problems
+}
+
+// RecvSize returns the largest message which may be received.
+func (c MessageSizeConfig) RecvSize() int {
+	if c.MaxRecvMsgSize > 0 {
+		return c.MaxRecvMsgSize
+	}
+	return DefaultMaxMessageSize
+}
+
+// SendSize returns the largest message which may be sent.
+func (c MessageSizeConfig) SendSize() int {
+	if c.MaxSendMsgSize > 0 {
+		return c.MaxSendMsgSize
+	}
+	return DefaultMaxMessageSize
+}
+
+// ServerOptions returns the options for the controller to apply the limits.
+func (c MessageSizeConfig) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(c.RecvSize()),
+		grpc.MaxSendMsgSize(c.SendSize()),
+	}
+}
+
+// DialOptions returns the options for an agent to apply the limits.
+func (c MessageSizeConfig) DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{grpc.WithDefaultCallOptions(
+		grpc.MaxCallRecvMsgSize(c.RecvSize()),
+		grpc.MaxCallSendMsgSize(c.SendSize()),
+	)}
+}
+
+// MessageTooLargeError is returned by CheckSend for a message larger than
+// the send limit.
+type MessageTooLargeError struct {
+	RequestID string
+	Size      int
+	Limit     int
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("tunnel message for request %q is %d bytes, larger than the limit of %d: raise maxSendMsgSize, or lower the endpoint's chunk size", e.RequestID, e.Size, e.Limit)
+}
+
+// CheckSend returns a *MessageTooLargeError if msg is too large to send.
+func (c MessageSizeConfig) CheckSend(msg *MessageWrapper) error {
+	size := proto.Size(msg)
+	if limit := c.SendSize(); size > limit {
+		return &MessageTooLargeError{RequestID: messageRequestID(msg), Size: size, Limit: limit}
+	}
+	return nil
+}
+
+// MessageSender sends messages on a stream, keeping to the send limit.  It
+// is not safe for concurrent use, as only one goroutine may send on a
+// stream.
+type MessageSender struct {
+	config  MessageSizeConfig
+	stream  GRPCEventStream
+	aborted map[string]time.Time
+}
+
+// abortedRetention is how long the rest of an aborted response is watched
+// for.  A cancelled request usually sends nothing more, so without a final
+// message to end it, the request is forgotten after this long.
+const abortedRetention = time.Minute
+
+// Sender returns a MessageSender for the stream.
+func (c MessageSizeConfig) Sender(stream GRPCEventStream) *MessageSender {
+	return &MessageSender{config: c, stream: stream, aborted: map[string]time.Time{}}
+}
+
+// Send sends msg on the stream.  If it is too large, the error is logged
+// and a replacement is sent, so the request it belongs to fails rather
+// than waits for it.  It is checked here because gRPC refusing to send
+// the message would also end the stream.  A response, or a response chunk
+// which is not the last, is replaced by the end of the response, so the
+// request is also cancelled and the rest of its response dropped.
+func (s *MessageSender) Send(msg *MessageWrapper) error {
+	id, final, isResponse := responseMessage(msg)
+	if _, found := s.aborted[id]; isResponse && found {
+		if final {
+			delete(s.aborted, id)
+		}
+		return nil
+	}
+	if err := s.config.CheckSend(msg); err != nil {
+		zap.S().Errorw("unable to send tunnel message", "requestId", messageRequestID(msg), "error", err)
+		msg = oversizeReplacement(msg, s.config.SendSize())
+		if msg == nil {
+			return nil
+		}
+		if !final {
+			s.abort(id)
+		}
+	}
+	return s.stream.Send(msg)
+}
+
+// abort cancels the request, and drops the rest of its response.
+func (s *MessageSender) abort(id string) {
+	now := time.Now()
+	for abortedID, at := range s.aborted {
+		if now.Sub(at) > abortedRetention {
+			delete(s.aborted, abortedID)
+		}
+	}
+	s.aborted[id] = now
+	CallCancelFunction(id)
+}
+
+// responseMessage returns the request ID of a response or response chunk,
+// and whether it is the last message of the response.
+func responseMessage(msg *MessageWrapper) (string, bool, bool) {
+	switch control := msg.GetHttpTunnelControl().GetControlType().(type) {
+	case *HttpTunnelControl_HttpTunnelResponse:
+		return control.HttpTunnelResponse.Id, control.HttpTunnelResponse.ContentLength == 0, true
+	case *HttpTunnelControl_HttpTunnelChunkedResponse:
+		return control.HttpTunnelChunkedResponse.Id, len(control.HttpTunnelChunkedResponse.Body) == 0, true
+	}
+	return "", false, false
+}
+
+// oversizeReplacement returns the message to send in place of one too
+// large to send.  A response is replaced by a 502, and a response chunk by
+// a final chunk marking the response truncated.  Other messages are
+// dropped, and nil is returned.
+func oversizeReplacement(msg *MessageWrapper, limit int) *MessageWrapper {
+	switch control := msg.GetHttpTunnelControl().GetControlType().(type) {
+	case *HttpTunnelControl_HttpTunnelResponse:
+		return MakeBadGatewayResponse(control.HttpTunnelResponse.Id)
+	case *HttpTunnelControl_HttpTunnelChunkedResponse:
+		return makeFinalChunkedResponse(control.HttpTunnelChunkedResponse.Id, truncatedTrailers(nil, int64(limit)))
+	}
+	return nil
+}
+
+func messageRequestID(msg *MessageWrapper) string {
+	switch control := msg.GetHttpTunnelControl().GetControlType().(type) {
+	case *HttpTunnelControl_OpenHTTPTunnelRequest:
+		return control.OpenHTTPTunnelRequest.Id
+	case *HttpTunnelControl_HttpTunnelResponse:
+		return control.HttpTunnelResponse.Id
+	case *HttpTunnelControl_HttpTunnelChunkedResponse:
+		return control.HttpTunnelChunkedResponse.Id
+	case *HttpTunnelControl_HttpTunnelChunkedRequest:
+		return control.HttpTunnelChunkedRequest.Id
+	}
+	return ""
+}
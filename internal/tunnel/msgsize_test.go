@@ -0,0 +1,184 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMessageSizeConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  MessageSizeConfig
+		wantErr int
+	}{
+		{"defaults", MessageSizeConfig{}, 0},
+		{"large enough", MessageSizeConfig{MaxRecvMsgSize: MinMaxMessageSize, MaxSendMsgSize: 64 * 1024 * 1024}, 0},
+		{"negative", MessageSizeConfig{MaxRecvMsgSize: -1}, 1},
+		{"too small for a chunk", MessageSizeConfig{MaxRecvMsgSize: 4096, MaxSendMsgSize: 4096}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Len(t, tt.config.Validate(), tt.wantErr)
+		})
+	}
+}
+
+func TestMessageSizeConfig_sizes(t *testing.T) {
+	assert.Equal(t, DefaultMaxMessageSize, MessageSizeConfig{}.RecvSize())
+	assert.Equal(t, DefaultMaxMessageSize, MessageSizeConfig{}.SendSize())
+	c := MessageSizeConfig{MaxRecvMsgSize: 1 << 21, MaxSendMsgSize: 1 << 22}
+	assert.Equal(t, 1<<21, c.RecvSize())
+	assert.Equal(t, 1<<22, c.SendSize())
+}
+
+// startSizedEchoTunnel serves an echo tunnel, and returns a stream to it,
+// with both ends limited by c.
+func startSizedEchoTunnel(t *testing.T, c MessageSizeConfig) AgentTunnelService_EventTunnelClient {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(c.ServerOptions()...)
+	RegisterAgentTunnelServiceServer(server, echoTunnelServer{})
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	opts := append([]grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}, c.DialOptions()...)
+	conn, err := grpc.Dial("bufnet", opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	stream, err := NewAgentTunnelServiceClient(conn).EventTunnel(context.Background())
+	require.NoError(t, err)
+	return stream
+}
+
+// chunkOfSize returns a response chunk whose encoded size is size bytes.
+func chunkOfSize(t *testing.T, id string, size int) *MessageWrapper {
+	msg := makeChunkedResponse(id, nil)
+	overhead := proto.Size(makeChunkedResponse(id, make([]byte, size)))
+	msg.GetHttpTunnelControl().GetHttpTunnelChunkedResponse().Body = make([]byte, size-(overhead-size))
+	require.Equal(t, size, proto.Size(msg))
+	return msg
+}
+
+func TestMessageSizeConfig_grpc(t *testing.T) {
+	c := MessageSizeConfig{MaxRecvMsgSize: MinMaxMessageSize, MaxSendMsgSize: MinMaxMessageSize}
+	stream := startSizedEchoTunnel(t, c)
+	sender := c.Sender(stream)
+
+	t.Run("chunk near the limit", func(t *testing.T) {
+		msg := chunkOfSize(t, "near", c.SendSize())
+		require.NoError(t, c.CheckSend(msg))
+		require.NoError(t, sender.Send(msg))
+		echoed, err := stream.Recv()
+		require.NoError(t, err)
+		chunk := echoed.GetHttpTunnelControl().GetHttpTunnelChunkedResponse()
+		assert.Equal(t, "near", chunk.Id)
+		assert.Len(t, chunk.Body, len(msg.GetHttpTunnelControl().GetHttpTunnelChunkedResponse().Body))
+	})
+
+	t.Run("chunk over the limit", func(t *testing.T) {
+		msg := chunkOfSize(t, "over", c.SendSize()+1)
+		err := c.CheckSend(msg)
+		var tooLarge *MessageTooLargeError
+		require.ErrorAs(t, err, &tooLarge)
+		assert.Equal(t, "over", tooLarge.RequestID)
+		assert.Equal(t, c.SendSize()+1, tooLarge.Size)
+		assert.Contains(t, err.Error(), "maxSendMsgSize")
+
+		// The response is ended and marked truncated instead.
+		require.NoError(t, sender.Send(msg))
+		echoed, err := stream.Recv()
+		require.NoError(t, err)
+		chunk := echoed.GetHttpTunnelControl().GetHttpTunnelChunkedResponse()
+		assert.Equal(t, "over", chunk.Id)
+		assert.Empty(t, chunk.Body)
+		require.Len(t, chunk.Trailers, 1)
+		assert.Equal(t, ResponseTruncatedTrailer, chunk.Trailers[0].Name)
+		assert.Equal(t, []string{strconv.Itoa(c.SendSize())}, chunk.Trailers[0].Values)
+	})
+
+	t.Run("rest of a truncated response is dropped", func(t *testing.T) {
+		cancelled := false
+		registration := RegisterCancelFunction("aborted", func() { cancelled = true })
+		defer UnregisterCancelFunction(registration)
+
+		require.NoError(t, sender.Send(chunkOfSize(t, "aborted", c.SendSize()+1)))
+		assert.True(t, cancelled, "the request should be cancelled")
+		require.NoError(t, sender.Send(chunkOfSize(t, "aborted", 1024)))
+		require.NoError(t, sender.Send(makeChunkedResponse("aborted", emptyBytes)))
+		require.NoError(t, sender.Send(chunkOfSize(t, "after-abort", 1024)))
+
+		echoed, err := stream.Recv()
+		require.NoError(t, err)
+		chunk := echoed.GetHttpTunnelControl().GetHttpTunnelChunkedResponse()
+		assert.Equal(t, "aborted", chunk.Id)
+		assert.Empty(t, chunk.Body)
+		echoed, err = stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "after-abort", echoed.GetHttpTunnelControl().GetHttpTunnelChunkedResponse().Id)
+		assert.NotContains(t, sender.aborted, "aborted", "the final chunk ends the abort")
+	})
+
+	t.Run("response over the limit", func(t *testing.T) {
+		msg := makeStatusResponse("headers", http.StatusOK)
+		msg.GetHttpTunnelControl().GetHttpTunnelResponse().Headers = []*HttpHeader{
+			{Name: "X-Large", Values: []string{string(make([]byte, c.SendSize()))}},
+		}
+		require.NoError(t, sender.Send(msg))
+		echoed, err := stream.Recv()
+		require.NoError(t, err)
+		resp := echoed.GetHttpTunnelControl().GetHttpTunnelResponse()
+		assert.Equal(t, "headers", resp.Id)
+		assert.Equal(t, int32(http.StatusBadGateway), resp.Status)
+	})
+
+	t.Run("other messages over the limit are dropped", func(t *testing.T) {
+		msg := &MessageWrapper{Event: MakeHTTPTunnelChunkedRequest("upgrade", make([]byte, c.SendSize()))}
+		require.NoError(t, sender.Send(msg))
+
+		// The stream still works.
+		require.NoError(t, sender.Send(chunkOfSize(t, "after", 1024)))
+		echoed, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "after", echoed.GetHttpTunnelControl().GetHttpTunnelChunkedResponse().Id)
+	})
+}
+
+func TestMessageSizeConfig_grpcWithoutCheck(t *testing.T) {
+	c := MessageSizeConfig{MaxRecvMsgSize: MinMaxMessageSize, MaxSendMsgSize: MinMaxMessageSize}
+	stream := startSizedEchoTunnel(t, c)
+
+	// gRPC refuses the message itself, but also ends the stream.
+	assert.Equal(t, codes.ResourceExhausted, status.Code(stream.Send(chunkOfSize(t, "over", c.SendSize()+1))))
+	_, err := stream.Recv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var panicsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "panics_total",
+	Help: "The total number of panics recovered, by the goroutine or handler they happened in",
+}, []string{"goroutine"})
+
+// recordPanic logs a recovered panic with the stack which raised it, and
+// counts it.
+func recordPanic(name string, p interface{}, keysAndValues ...interface{}) {
+	panicsCounter.WithLabelValues(name).Inc()
+	args := append([]interface{}{"goroutine", name, "panic", fmt.Sprint(p), "stack", string(debug.Stack())}, keysAndValues...)
+	zap.S().Errorw("recovered from panic", args...)
+}
+
+// RunRequest runs a single tunneled request, whose response run sends to
+// the dataflow it is given.  A panic is logged and counted rather than
+// taking down the process and every tunnel with it.  If no response
+// headers were sent for the request yet a 500 is sent, and if the body was
+// started it is ended, so the requester is not left waiting.
+func RunRequest(id string, dataflow chan *MessageWrapper, run func(dataflow chan *MessageWrapper)) {
+	// Watch how far the response got as it passes by.  The channel run is
+	// given is never closed, as a request body or upgraded connection the
+	// endpoint did not close may still hold it after run returns.
+	intercept := make(chan *MessageWrapper)
+	done := make(chan struct{})
+	progressChan := make(chan responseProgress)
+	go func() {
+		var progress responseProgress
+		for {
+			select {
+			case msg := <-intercept:
+				progress.update(msg)
+				dataflow <- msg
+			case <-done:
+				progressChan <- progress
+				return
+			}
+		}
+	}()
+	defer func() {
+		p := recover()
+		close(done)
+		progress := <-progressChan
+		if p == nil {
+			return
+		}
+		recordPanic("request", p, "requestId", id)
+		switch {
+		case !progress.headers:
+			dataflow <- makeStatusResponse(id, http.StatusInternalServerError)
+		case !progress.done:
+			dataflow <- makeChunkedResponse(id, emptyBytes)
+		}
+	}()
+	run(intercept)
+}
+
+// responseProgress is how much of a tunneled response has been sent.
+type responseProgress struct {
+	headers bool
+	done    bool
+}
+
+func (p *responseProgress) update(msg *MessageWrapper) {
+	control := msg.GetHttpTunnelControl()
+	if resp := control.GetHttpTunnelResponse(); resp != nil && !p.headers {
+		p.headers = true
+		p.done = resp.ContentLength == 0
+	}
+	if chunk := control.GetHttpTunnelChunkedResponse(); chunk != nil && len(chunk.Body) == 0 {
+		p.done = true
+	}
+}
+
+// Go runs f in a new goroutine, logging and counting a panic rather than
+// letting it crash the process.
+func Go(name string, f func()) {
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				recordPanic(name, p)
+			}
+		}()
+		f()
+	}()
+}
+
+// RecoverHandler serves requests with next, logging and counting a panic.
+// A 500 is returned if nothing has been written yet; otherwise the
+// response is aborted, as the client already has part of another one.  A
+// handler which panics with http.ErrAbortHandler is still aborted.
+func RecoverHandler(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recoverWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			recordPanic(name, p, "method", r.Method, "uri", r.URL.Path)
+			if rw.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// recoverWriter notes whether the response headers have been written.
+type recoverWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *recoverWriter) WriteHeader(code int) {
+	// Informational responses may be followed by the real one.
+	if code >= http.StatusOK || code == http.StatusSwitchingProtocols {
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recoverWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recoverWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		flusher.Flush()
+	}
+}
+
+func (w *recoverWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("client connection does not support hijacking")
+	}
+	w.wroteHeader = true
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController.
+func (w *recoverWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunRequest(t *testing.T) {
+	counter := panicsCounter.WithLabelValues("request")
+	before := testutil.ToFloat64(counter)
+	dataflow := make(chan *MessageWrapper, 10)
+
+	RunRequest("panicky", dataflow, func(dataflow chan *MessageWrapper) {
+		panic("endpoint bug")
+	})
+
+	require.Len(t, dataflow, 1)
+	resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+	assert.Equal(t, "panicky", resp.Id)
+	assert.Equal(t, int32(http.StatusInternalServerError), resp.Status)
+	assert.Equal(t, int64(0), resp.ContentLength)
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+
+	// Nothing more is sent when the request finishes normally.
+	RunRequest("fine", dataflow, func(dataflow chan *MessageWrapper) {
+		dataflow <- makeStatusResponse("fine", http.StatusNoContent)
+	})
+	require.Len(t, dataflow, 1)
+	assert.Equal(t, int32(http.StatusNoContent), (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse().Status)
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+}
+
+func TestRunRequest_panicAfterHeaders(t *testing.T) {
+	dataflow := make(chan *MessageWrapper, 10)
+
+	RunRequest("partial", dataflow, func(dataflow chan *MessageWrapper) {
+		dataflow <- &MessageWrapper{Event: &MessageWrapper_HttpTunnelControl{HttpTunnelControl: &HttpTunnelControl{
+			ControlType: &HttpTunnelControl_HttpTunnelResponse{
+				HttpTunnelResponse: &HttpTunnelResponse{Id: "partial", Status: http.StatusOK, ContentLength: -1},
+			},
+		}}}
+		dataflow <- makeChunkedResponse("partial", []byte("some of the body"))
+		panic("endpoint bug")
+	})
+
+	// The body is ended rather than followed by a second status.
+	require.Len(t, dataflow, 3)
+	assert.Equal(t, int32(http.StatusOK), (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse().Status)
+	assert.Equal(t, []byte("some of the body"), (<-dataflow).GetHttpTunnelControl().GetHttpTunnelChunkedResponse().Body)
+	end := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelChunkedResponse()
+	require.NotNil(t, end)
+	assert.Equal(t, "partial", end.Id)
+	assert.Empty(t, end.Body)
+}
+
+func TestRunRequest_panicAfterResponse(t *testing.T) {
+	dataflow := make(chan *MessageWrapper, 10)
+
+	RunRequest("complete", dataflow, func(dataflow chan *MessageWrapper) {
+		dataflow <- makeStatusResponse("complete", http.StatusNoContent)
+		panic("endpoint bug")
+	})
+
+	// A complete response is left alone.
+	require.Len(t, dataflow, 1)
+	assert.Equal(t, int32(http.StatusNoContent), (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse().Status)
+}
+
+func TestGo(t *testing.T) {
+	counter := panicsCounter.WithLabelValues("test-go")
+	before := testutil.ToFloat64(counter)
+
+	Go("test-go", func() { panic("session bug") })
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(counter) == before+1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRecoverHandler(t *testing.T) {
+	counter := panicsCounter.WithLabelValues("test-handler")
+	before := testutil.ToFloat64(counter)
+	handler := RecoverHandler("test-handler", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("handler bug")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ok", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+
+	// An aborted handler is still aborted, and not counted.
+	abort := RecoverHandler("test-handler", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		abort.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/abort", nil))
+	})
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+}
+
+func TestRecoverHandler_panicAfterWrite(t *testing.T) {
+	counter := panicsCounter.WithLabelValues("test-partial")
+	before := testutil.ToFloat64(counter)
+	handler := RecoverHandler("test-partial", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("some of the body"))
+		w.(http.Flusher).Flush()
+		panic("handler bug")
+	}))
+
+	// The response already started is aborted, rather than getting a 500
+	// written into it.
+	w := httptest.NewRecorder()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/partial", nil))
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "some of the body", w.Body.String())
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+
+	// A real client sees the connection cut, not a 500.
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/partial")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = io.ReadAll(resp.Body)
+	assert.Error(t, err)
+}
+
+func TestRecoverHandler_informational(t *testing.T) {
+	handler := RecoverHandler("test-handler", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusEarlyHints)
+		panic("handler bug")
+	}))
+
+	// Only an informational response was sent, so there is still room for
+	// the 500.
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/early")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+func TestRecoverHandler_keepsInterfaces(t *testing.T) {
+	handler := RecoverHandler("test-handler", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, flusher := w.(http.Flusher)
+		_, hijacker := w.(http.Hijacker)
+		assert.True(t, flusher)
+		assert.True(t, hijacker)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
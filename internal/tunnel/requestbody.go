@@ -0,0 +1,258 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// Streamed request bodies are used when the whole body is not available when
+// the request is sent, such as for a gRPC streaming call, or is too large to
+// hold in memory, such as for a large upload.  The body arrives in
+// HttpTunnelChunkedRequest messages, as client data does for an upgraded
+// connection, and is buffered here until the endpoint reads it.  The sender
+// keeps no more than DefaultWindowSize bytes unacknowledged, and the body is
+// acknowledged as it is read, which bounds the buffer to that size.
+
+type streamedBody struct {
+	sync.Mutex
+	cond     *sync.Cond
+	id       string
+	buf      bytes.Buffer
+	eof      bool
+	closed   bool
+	dataflow chan *MessageWrapper
+	unacked  int64
+
+	// acking is held while an acknowledgement is sent, so Close can wait
+	// for it and none is sent once the body is closed.
+	acking sync.Mutex
+}
+
+func newStreamedBody(id string) *streamedBody {
+	b := &streamedBody{id: id}
+	b.cond = sync.NewCond(b)
+	return b
+}
+
+func (b *streamedBody) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed || b.eof {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := b.buf.Write(p)
+	b.cond.Broadcast()
+	return n, err
+}
+
+// CloseWrite marks the end of the body.
+func (b *streamedBody) CloseWrite() error {
+	b.Lock()
+	defer b.Unlock()
+	b.eof = true
+	b.cond.Broadcast()
+	return nil
+}
+
+func (b *streamedBody) Read(p []byte) (int, error) {
+	n, ack, err := b.read(p)
+	if ack > 0 {
+		b.acknowledge(ack)
+	}
+	return n, err
+}
+
+// acknowledge sends a window update for data read from the body, unless
+// the body has been closed.  The reader may outlive the endpoint, such as
+// http.Transport's body writer after RoundTrip returns, and the request's
+// dataflow may be gone by then.
+func (b *streamedBody) acknowledge(ack int64) {
+	b.acking.Lock()
+	defer b.acking.Unlock()
+	b.Lock()
+	closed := b.closed
+	b.Unlock()
+	if !closed {
+		b.dataflow <- &MessageWrapper{Event: MakeHTTPTunnelWindowUpdate(b.id, ack)}
+	}
+}
+
+// read returns data from the buffer, and how much should be acknowledged.
+// Acknowledgements are batched to half the window.
+func (b *streamedBody) read(p []byte) (int, int64, error) {
+	b.Lock()
+	defer b.Unlock()
+	for b.buf.Len() == 0 && !b.eof && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return 0, 0, io.ErrClosedPipe
+	}
+	if b.buf.Len() == 0 {
+		return 0, 0, io.EOF
+	}
+	n, err := b.buf.Read(p)
+	if b.dataflow == nil {
+		return n, 0, err
+	}
+	b.unacked += int64(n)
+	if b.unacked < DefaultWindowSize/2 {
+		return n, 0, err
+	}
+	ack := b.unacked
+	b.unacked = 0
+	return n, ack, err
+}
+
+// Close discards the body, and any data which arrives later.  Once it
+// returns, nothing more is sent on the body's dataflow.
+func (b *streamedBody) Close() error {
+	b.Lock()
+	b.closed = true
+	b.buf.Reset()
+	b.cond.Broadcast()
+	b.Unlock()
+
+	// Wait for an acknowledgement already being sent.
+	b.acking.Lock()
+	defer b.acking.Unlock()
+	return nil
+}
+
+// PrepareRequestBody registers a buffer to receive the request's body, if it
+// is streamed.  It must be called before any of the body can arrive, which
+// means before the request is handed to an endpoint.
+func PrepareRequestBody(req *OpenHTTPTunnelRequest) {
+	if req.StreamBody {
+		RegisterUpgradeWriter(req.Id, newStreamedBody(req.Id))
+	}
+}
+
+// ReleaseRequestBody discards the request's streamed body, if any.
+func ReleaseRequestBody(req *OpenHTTPTunnelRequest) {
+	if !req.StreamBody {
+		return
+	}
+	upgradeRegistry.Lock()
+	w, ok := upgradeRegistry.m[req.Id]
+	delete(upgradeRegistry.m, req.Id)
+	upgradeRegistry.Unlock()
+	if ok {
+		w.Close()
+	}
+}
+
+// RequestBody returns the request's body, either sent with the request or
+// streamed into the buffer registered by PrepareRequestBody.  A streamed
+// body is acknowledged on dataflow as it is read.
+func RequestBody(req *OpenHTTPTunnelRequest, dataflow chan *MessageWrapper) io.ReadCloser {
+	if !req.StreamBody {
+		return io.NopCloser(bytes.NewReader(req.Body))
+	}
+	upgradeRegistry.Lock()
+	defer upgradeRegistry.Unlock()
+	if body, ok := upgradeRegistry.m[req.Id].(*streamedBody); ok {
+		body.Lock()
+		body.dataflow = dataflow
+		body.Unlock()
+		return body
+	}
+	return io.NopCloser(bytes.NewReader(nil))
+}
+
+// RequestContentLength returns the length of the request's body, or -1 if
+// it is streamed and the client did not say how long it is.
+func RequestContentLength(req *OpenHTTPTunnelRequest) int64 {
+	if !req.StreamBody {
+		return int64(len(req.Body))
+	}
+	contentLength, err := strconv.ParseInt(req.GetHeaderValue("Content-Length"), 10, 64)
+	if err != nil || contentLength < 0 {
+		return -1
+	}
+	return contentLength
+}
+
+// DefaultMaxBufferedBodyBytes is the most of a request's body which is read
+// into memory, such as to sign or transform it, when the endpoint does not
+// set maxRequestBodyBytes.
+const DefaultMaxBufferedBodyBytes = 32 * 1024 * 1024
+
+// ErrRequestBodyTooLarge is returned when reading more of a request's body
+// than its limit allows.
+var ErrRequestBodyTooLarge = errors.New("request body too large")
+
+// BufferedBodyLimit returns the most of a request's body which may be read
+// into memory, given an endpoint's maxRequestBodyBytes.
+func BufferedBodyLimit(max int64) int64 {
+	if max > 0 {
+		return max
+	}
+	return DefaultMaxBufferedBodyBytes
+}
+
+// ReadRequestBody reads body in full, returning ErrRequestBodyTooLarge if it
+// is longer than max.
+func ReadRequestBody(body io.Reader, max int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, ErrRequestBodyTooLarge
+	}
+	return data, nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+// LimitRequestBody returns body, which fails with ErrRequestBodyTooLarge once
+// more than max bytes are read from it.  Unlike RequestBodyTooLarge, this
+// catches a streamed body of unknown length.  A max of zero or less leaves
+// the body unlimited.
+func LimitRequestBody(body io.ReadCloser, max int64) io.ReadCloser {
+	if max <= 0 {
+		return body
+	}
+	return &limitedBody{ReadCloser: body, remaining: max}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Only fail if there is more, so a body of exactly max bytes is fine.
+		var extra [1]byte
+		n, err := b.ReadCloser.Read(extra[:])
+		if n > 0 {
+			return 0, ErrRequestBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
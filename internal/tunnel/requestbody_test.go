@@ -0,0 +1,214 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestBody_notStreamed(t *testing.T) {
+	req := &OpenHTTPTunnelRequest{Id: "body1", Body: []byte("whole body")}
+	PrepareRequestBody(req)
+	defer ReleaseRequestBody(req)
+
+	body, err := io.ReadAll(RequestBody(req, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "whole body", string(body))
+	require.Error(t, WriteUpgradeData("body1", []byte("more")), "nothing should be registered")
+}
+
+func TestRequestBody_streamed(t *testing.T) {
+	req := &OpenHTTPTunnelRequest{Id: "body2", StreamBody: true}
+	PrepareRequestBody(req)
+	defer ReleaseRequestBody(req)
+
+	// Data which arrives before the endpoint reads is buffered.
+	require.NoError(t, WriteUpgradeData("body2", []byte("first ")))
+	body := RequestBody(req, nil)
+
+	got := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(body)
+		got <- string(data)
+	}()
+	require.NoError(t, WriteUpgradeData("body2", []byte("second")))
+	select {
+	case <-got:
+		require.FailNow(t, "body ended before EOF was sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, WriteUpgradeData("body2", []byte{}))
+	select {
+	case data := <-got:
+		assert.Equal(t, "first second", data)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for body")
+	}
+}
+
+func TestRequestBody_release(t *testing.T) {
+	req := &OpenHTTPTunnelRequest{Id: "body3", StreamBody: true}
+	PrepareRequestBody(req)
+	body := RequestBody(req, nil)
+
+	done := make(chan error)
+	go func() {
+		_, err := body.Read(make([]byte, 10))
+		done <- err
+	}()
+	ReleaseRequestBody(req)
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "read was not unblocked by release")
+	}
+	require.Error(t, WriteUpgradeData("body3", []byte("late")))
+}
+
+func TestRequestBody_acknowledged(t *testing.T) {
+	req := &OpenHTTPTunnelRequest{Id: "body4", StreamBody: true}
+	PrepareRequestBody(req)
+	defer ReleaseRequestBody(req)
+
+	dataflow := make(chan *MessageWrapper, 10)
+	body := RequestBody(req, dataflow)
+	data := bytes.Repeat([]byte("x"), DefaultWindowSize)
+	require.NoError(t, WriteUpgradeData("body4", data))
+	require.NoError(t, WriteUpgradeData("body4", []byte{}))
+
+	got, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, len(data), len(got))
+
+	var acked int64
+	for len(dataflow) > 0 {
+		update := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelWindowUpdate()
+		require.NotNil(t, update)
+		assert.Equal(t, "body4", update.Id)
+		assert.GreaterOrEqual(t, update.Bytes, int64(DefaultWindowSize/2), "acknowledgements are batched")
+		acked += update.Bytes
+	}
+	// Whatever is left unacknowledged is less than half the window, so the
+	// sender is never stalled.
+	assert.Greater(t, acked, int64(DefaultWindowSize/2))
+	assert.LessOrEqual(t, acked, int64(DefaultWindowSize))
+}
+
+func TestRequestBody_releaseWaitsForAcknowledgement(t *testing.T) {
+	req := &OpenHTTPTunnelRequest{Id: "body5", StreamBody: true}
+	PrepareRequestBody(req)
+
+	dataflow := make(chan *MessageWrapper)
+	body := RequestBody(req, dataflow)
+	require.NoError(t, WriteUpgradeData("body5", bytes.Repeat([]byte("x"), DefaultWindowSize)))
+
+	// The reader is held up sending an acknowledgement when the request ends.
+	go func() { _, _ = io.ReadAll(body) }()
+	time.Sleep(50 * time.Millisecond)
+	released := make(chan struct{})
+	go func() {
+		ReleaseRequestBody(req)
+		close(released)
+	}()
+	select {
+	case <-released:
+		require.FailNow(t, "release did not wait for the acknowledgement")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NotNil(t, (<-dataflow).GetHttpTunnelControl().GetHttpTunnelWindowUpdate())
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for release")
+	}
+
+	// Nothing is sent once the body is released, so its dataflow may go.
+	select {
+	case msg := <-dataflow:
+		require.FailNow(t, "sent after release", "%v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRequestContentLength(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *OpenHTTPTunnelRequest
+		want int64
+	}{
+		{"sent with request", &OpenHTTPTunnelRequest{Body: []byte("12345")}, 5},
+		{"empty", &OpenHTTPTunnelRequest{}, 0},
+		{
+			"streamed with length",
+			&OpenHTTPTunnelRequest{StreamBody: true, Headers: []*HttpHeader{{Name: "Content-Length", Values: []string{"1000"}}}},
+			1000,
+		},
+		{"streamed without length", &OpenHTTPTunnelRequest{StreamBody: true}, -1},
+		{
+			"streamed with bad length",
+			&OpenHTTPTunnelRequest{StreamBody: true, Headers: []*HttpHeader{{Name: "Content-Length", Values: []string{"lots"}}}},
+			-1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, RequestContentLength(tt.req))
+		})
+	}
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		max     int64
+		wantErr bool
+	}{
+		{"under limit", "123456789", 10, false},
+		{"at limit", "0123456789", 10, false},
+		{"over limit", "0123456789a", 10, true},
+		{"unlimited", "0123456789a", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(LimitRequestBody(io.NopCloser(bytes.NewReader([]byte(tt.body))), tt.max))
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrRequestBodyTooLarge)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(got))
+		})
+	}
+}
+
+func TestReadRequestBody(t *testing.T) {
+	got, err := ReadRequestBody(bytes.NewReader([]byte("0123456789")), 10)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(got))
+
+	_, err = ReadRequestBody(bytes.NewReader([]byte("0123456789a")), 10)
+	assert.ErrorIs(t, err, ErrRequestBodyTooLarge)
+}
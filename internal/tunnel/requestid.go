@@ -0,0 +1,66 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"net/http"
+	"sync"
+)
+
+// RequestIDHeader carries an id for a request, supplied by the client or
+// the tunnel request's own id, so it can be matched up in the logs of the
+// controller, the agent, and the upstream service.
+const RequestIDHeader = "X-Request-Id"
+
+// DefaultUserAgent is sent to upstream services unless SetUserAgent is
+// called.
+const DefaultUserAgent = "oes-birger-agent"
+
+var userAgent = struct {
+	sync.Mutex
+	value string
+}{value: DefaultUserAgent}
+
+// SetUserAgent sets the User-Agent sent on upstream requests.
+func SetUserAgent(ua string) {
+	userAgent.Lock()
+	defer userAgent.Unlock()
+	userAgent.value = ua
+}
+
+func getUserAgent() string {
+	userAgent.Lock()
+	defer userAgent.Unlock()
+	return userAgent.value
+}
+
+// RequestID returns the client supplied request id, or if there is none,
+// the tunnel request's id.
+func RequestID(req *OpenHTTPTunnelRequest) string {
+	if id := req.GetHeaderValue(RequestIDHeader); id != "" {
+		return id
+	}
+	return req.Id
+}
+
+// SetUpstreamHeaders sets the User-Agent and request id headers on a request
+// to an upstream service.  Endpoints call this before applying their own
+// configured headers, so those may still override the User-Agent.
+func SetUpstreamHeaders(req *OpenHTTPTunnelRequest, headers http.Header) {
+	headers.Set("User-Agent", getUserAgent())
+	headers.Set(RequestIDHeader, RequestID(req))
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []*HttpHeader
+		want    string
+	}{
+		{"none supplied", nil, "tunnel-id"},
+		{"supplied", []*HttpHeader{{Name: "X-Request-Id", Values: []string{"client-id"}}}, "client-id"},
+		{"case insensitive", []*HttpHeader{{Name: "x-request-id", Values: []string{"client-id"}}}, "client-id"},
+		{"empty", []*HttpHeader{{Name: "X-Request-Id", Values: []string{""}}}, "tunnel-id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &OpenHTTPTunnelRequest{Id: "tunnel-id", Headers: tt.headers}
+			assert.Equal(t, tt.want, RequestID(req))
+		})
+	}
+}
+
+func TestSetUpstreamHeaders(t *testing.T) {
+	headers := http.Header{"User-Agent": {"curl/7.0"}}
+	SetUpstreamHeaders(&OpenHTTPTunnelRequest{Id: "tunnel-id"}, headers)
+	assert.Equal(t, http.Header{
+		"User-Agent":   {DefaultUserAgent},
+		"X-Request-Id": {"tunnel-id"},
+	}, headers)
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// ResponseTruncatedTrailer is sent with the final chunk of a response
+// which was cut off at its endpoint's limit, so the controller can fail
+// the response rather than end it as if it were complete.  Its value is
+// the limit.
+const ResponseTruncatedTrailer = "X-Opsmx-Response-Truncated"
+
+// ResponseBodyLimit limits the size of response bodies sent back over the
+// tunnel.  If MaxBytes is set, a response declaring a larger Content-Length
+// gets a 502 instead, and one without a Content-Length is cut off after
+// MaxBytes.  If ExemptStreaming is set, responses without a Content-Length,
+// such as watches and event streams, are not limited.  Upgraded connections
+// are never limited.
+type ResponseBodyLimit struct {
+	MaxBytes        int64 `yaml:"maxResponseBytes,omitempty"`
+	ExemptStreaming bool  `yaml:"exemptStreamingResponses,omitempty"`
+}
+
+// limit returns the body size limit for the response, or zero if it is
+// not limited.
+func (l ResponseBodyLimit) limit(response *http.Response) int64 {
+	if l.MaxBytes <= 0 || response.StatusCode == http.StatusSwitchingProtocols {
+		return 0
+	}
+	if l.ExemptStreaming && response.ContentLength < 0 {
+		return 0
+	}
+	return l.MaxBytes
+}
+
+func truncatedTrailers(trailers func() http.Header, limit int64) func() http.Header {
+	return func() http.Header {
+		h := http.Header{}
+		if trailers != nil {
+			h = trailers().Clone()
+			if h == nil {
+				h = http.Header{}
+			}
+		}
+		h.Set(ResponseTruncatedTrailer, strconv.FormatInt(limit, 10))
+		return h
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runSizedResponseRequest returns the response, body, and final chunk sent
+// for an upstream reply of size bytes, streamed without a Content-Length
+// unless fixedLength is set.
+func runSizedResponseRequest(t *testing.T, size int, fixedLength bool, limit ResponseBodyLimit) (*HttpTunnelResponse, []byte, *HttpTunnelChunkedResponse) {
+	body := bytes.Repeat([]byte("0123456789"), size/10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fixedLength {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			_, _ = w.Write(body)
+			return
+		}
+		for i := 0; i < len(body); i += 100 {
+			_, _ = w.Write(body[i : i+100])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+
+	req := &OpenHTTPTunnelRequest{Id: "sized", Method: http.MethodGet, URI: "/"}
+	httpRequest, err := http.NewRequest(req.Method, upstream.URL+req.URI, nil)
+	require.NoError(t, err)
+
+	dataflow := make(chan *MessageWrapper, 1000)
+	RunHTTPRequest(upstream.Client(), req, httpRequest, dataflow, upstream.URL, ResponseOptions{Chunking: ChunkConfig{Size: 64}, BodyLimit: limit})
+	close(dataflow)
+
+	resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+	require.NotNil(t, resp)
+	received := []byte{}
+	var final *HttpTunnelChunkedResponse
+	for msg := range dataflow {
+		chunk := msg.GetHttpTunnelControl().GetHttpTunnelChunkedResponse()
+		require.NotNil(t, chunk)
+		if len(chunk.Body) == 0 {
+			final = chunk
+			continue
+		}
+		received = append(received, chunk.Body...)
+	}
+	return resp, received, final
+}
+
+func truncatedLimit(chunk *HttpTunnelChunkedResponse) string {
+	for _, trailer := range chunk.Trailers {
+		if http.CanonicalHeaderKey(trailer.Name) == ResponseTruncatedTrailer {
+			return trailer.Values[0]
+		}
+	}
+	return ""
+}
+
+func TestRunHTTPRequest_maxResponseBytes(t *testing.T) {
+	tests := []struct {
+		name          string
+		size          int
+		fixedLength   bool
+		limit         ResponseBodyLimit
+		wantStatus    int32
+		wantBytes     int
+		wantTruncated string
+	}{
+		{"unlimited", 1000, false, ResponseBodyLimit{}, http.StatusOK, 1000, ""},
+		{"streamed under limit", 1000, false, ResponseBodyLimit{MaxBytes: 1000}, http.StatusOK, 1000, ""},
+		{"streamed over limit", 1000, false, ResponseBodyLimit{MaxBytes: 250}, http.StatusOK, 250, "250"},
+		{"streamed over limit, exempt", 1000, false, ResponseBodyLimit{MaxBytes: 250, ExemptStreaming: true}, http.StatusOK, 1000, ""},
+		{"fixed length under limit", 1000, true, ResponseBodyLimit{MaxBytes: 1000, ExemptStreaming: true}, http.StatusOK, 1000, ""},
+		{"fixed length over limit", 1000, true, ResponseBodyLimit{MaxBytes: 250}, http.StatusBadGateway, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body, final := runSizedResponseRequest(t, tt.size, tt.fixedLength, tt.limit)
+			assert.Equal(t, tt.wantStatus, resp.Status)
+			assert.Len(t, body, tt.wantBytes)
+			if tt.wantStatus != http.StatusOK {
+				assert.Nil(t, final)
+				return
+			}
+			require.NotNil(t, final, "response must end with a final chunk")
+			assert.Equal(t, tt.wantTruncated, truncatedLimit(final))
+		})
+	}
+}
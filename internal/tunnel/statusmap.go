@@ -0,0 +1,113 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// StatusMapping replaces an upstream response with the status From by one
+// with the status To, for clients which cannot tell an upstream's status
+// from the controller's own.  If Body is set, it is sent as text/plain in
+// place of the upstream's headers and body.  Otherwise the upstream's body,
+// which described the original status, is dropped along with the headers
+// describing it, and the rest of its headers are sent with the new status.
+type StatusMapping struct {
+	From int    `yaml:"from"`
+	To   int    `yaml:"to"`
+	Body string `yaml:"body,omitempty"`
+}
+
+// StatusMap is an endpoint's table of status mappings.  It only applies to
+// responses from the upstream, never to the errors the agent returns
+// itself, such as a 502 when the upstream cannot be reached.
+type StatusMap []StatusMapping
+
+// Validate checks each status is a valid response status other than 101,
+// as an upgraded connection cannot be remapped, and no status is mapped
+// twice.
+func (m StatusMap) Validate() error {
+	seen := map[int]bool{}
+	for i, mapping := range m {
+		for _, status := range []int{mapping.From, mapping.To} {
+			if status < 100 || status > 599 || status == http.StatusSwitchingProtocols {
+				return fmt.Errorf("[%d]: invalid status %d", i, status)
+			}
+		}
+		if seen[mapping.From] {
+			return fmt.Errorf("[%d]: status %d is mapped more than once", i, mapping.From)
+		}
+		seen[mapping.From] = true
+	}
+	return nil
+}
+
+// find returns the mapping for the status, or nil if there is none.
+func (m StatusMap) find(status int) *StatusMapping {
+	for i := range m {
+		if m[i].From == status {
+			return &m[i]
+		}
+	}
+	return nil
+}
+
+// sendMappedBody sends the mapping's status and body in place of the
+// upstream's response.
+func (mapping *StatusMapping) sendMappedBody(id string, dataflow chan *MessageWrapper) {
+	msg := makeStatusResponse(id, mapping.To)
+	resp := msg.GetHttpTunnelControl().GetHttpTunnelResponse()
+	resp.ContentLength = int64(len(mapping.Body))
+	resp.Headers = []*HttpHeader{{Name: "Content-Type", Values: []string{"text/plain; charset=utf-8"}}}
+	dataflow <- msg
+	dataflow <- makeChunkedResponse(id, []byte(mapping.Body))
+	dataflow <- makeFinalChunkedResponse(id, nil)
+}
+
+// bodyHeaders describe a response's body, and are dropped with it.
+var bodyHeaders = map[string]bool{
+	"Content-Disposition": true,
+	"Content-Encoding":    true,
+	"Content-Language":    true,
+	"Content-Length":      true,
+	"Content-Location":    true,
+	"Content-Md5":         true,
+	"Content-Range":       true,
+	"Content-Type":        true,
+	"Etag":                true,
+	"Last-Modified":       true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+}
+
+// sendMappedStatus sends the upstream's response with the mapping's status,
+// and without its body.
+func (mapping *StatusMapping) sendMappedStatus(id string, msg *MessageWrapper, dataflow chan *MessageWrapper) {
+	resp := msg.GetHttpTunnelControl().GetHttpTunnelResponse()
+	resp.Status = int32(mapping.To)
+	resp.ContentLength = 0
+	headers := make([]*HttpHeader, 0, len(resp.Headers))
+	for _, header := range resp.Headers {
+		if !bodyHeaders[http.CanonicalHeaderKey(header.Name)] {
+			headers = append(headers, header)
+		}
+	}
+	resp.Headers = headers
+	dataflow <- msg
+	dataflow <- makeFinalChunkedResponse(id, nil)
+}
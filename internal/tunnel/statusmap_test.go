@@ -0,0 +1,151 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runMappedRequest returns the response and body sent for a request to an
+// upstream which answers with status and "upstream body".
+func runMappedRequest(t *testing.T, status int, statusMap StatusMap) (*HttpTunnelResponse, string) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "yes")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("upstream body"))
+	}))
+	defer upstream.Close()
+	return runMappedRequestTo(t, upstream.Client(), upstream.URL, statusMap)
+}
+
+// runMappedRequestTo returns the response and body sent for a request to
+// baseURL.
+func runMappedRequestTo(t *testing.T, client *http.Client, baseURL string, statusMap StatusMap) (*HttpTunnelResponse, string) {
+	req := &OpenHTTPTunnelRequest{Id: "mapped", Method: http.MethodGet, URI: "/"}
+	httpRequest, err := http.NewRequest(req.Method, baseURL+req.URI, nil)
+	require.NoError(t, err)
+
+	dataflow := make(chan *MessageWrapper, 10)
+	RunHTTPRequest(client, req, httpRequest, dataflow, baseURL, ResponseOptions{StatusMap: statusMap})
+	close(dataflow)
+
+	resp := (<-dataflow).GetHttpTunnelControl().GetHttpTunnelResponse()
+	require.NotNil(t, resp)
+	body := ""
+	for msg := range dataflow {
+		chunk := msg.GetHttpTunnelControl().GetHttpTunnelChunkedResponse()
+		require.NotNil(t, chunk)
+		body += string(chunk.Body)
+	}
+	return resp, body
+}
+
+func headerValue(headers []*HttpHeader, name string) string {
+	for _, header := range headers {
+		if http.CanonicalHeaderKey(header.Name) == name && len(header.Values) > 0 {
+			return header.Values[0]
+		}
+	}
+	return ""
+}
+
+func TestRunHTTPRequest_statusMap(t *testing.T) {
+	statusMap := StatusMap{
+		{From: http.StatusUnauthorized, To: http.StatusForbidden, Body: "the service rejected the agent's credentials"},
+		{From: http.StatusTeapot, To: http.StatusOK},
+	}
+
+	t.Run("404 passes through", func(t *testing.T) {
+		resp, body := runMappedRequest(t, http.StatusNotFound, statusMap)
+		assert.Equal(t, int32(http.StatusNotFound), resp.Status)
+		assert.Equal(t, "yes", headerValue(resp.Headers, "X-Upstream"))
+		assert.Equal(t, "upstream body", body)
+	})
+
+	t.Run("401 remapped with body", func(t *testing.T) {
+		resp, body := runMappedRequest(t, http.StatusUnauthorized, statusMap)
+		assert.Equal(t, int32(http.StatusForbidden), resp.Status)
+		assert.Empty(t, headerValue(resp.Headers, "X-Upstream"))
+		assert.Equal(t, "text/plain; charset=utf-8", headerValue(resp.Headers, "Content-Type"))
+		assert.Equal(t, "the service rejected the agent's credentials", body)
+		assert.Equal(t, int64(len(body)), resp.ContentLength)
+	})
+
+	t.Run("remapped without body", func(t *testing.T) {
+		resp, body := runMappedRequest(t, http.StatusTeapot, statusMap)
+		assert.Equal(t, int32(http.StatusOK), resp.Status)
+		assert.Equal(t, "yes", headerValue(resp.Headers, "X-Upstream"))
+		assert.Empty(t, headerValue(resp.Headers, "Content-Type"))
+		assert.Empty(t, headerValue(resp.Headers, "Content-Length"))
+		assert.Equal(t, int64(0), resp.ContentLength)
+		assert.Empty(t, body)
+	})
+
+	t.Run("401 unmapped", func(t *testing.T) {
+		resp, body := runMappedRequest(t, http.StatusUnauthorized, nil)
+		assert.Equal(t, int32(http.StatusUnauthorized), resp.Status)
+		assert.Equal(t, "upstream body", body)
+	})
+}
+
+func TestRunHTTPRequest_statusMapConnectionError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	baseURL := upstream.URL
+	client := upstream.Client()
+	upstream.Close()
+
+	// A 502 from the upstream may be remapped, but not one the agent
+	// returns because there was no response.
+	statusMap := StatusMap{{From: http.StatusBadGateway, To: http.StatusOK, Body: "fine"}}
+	resp, body := runMappedRequestTo(t, client, baseURL, statusMap)
+	assert.Equal(t, int32(http.StatusBadGateway), resp.Status)
+	assert.Empty(t, body)
+
+	resp, body = runMappedRequest(t, http.StatusBadGateway, statusMap)
+	assert.Equal(t, int32(http.StatusOK), resp.Status)
+	assert.Equal(t, "fine", body)
+}
+
+func TestStatusMap_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       StatusMap
+		wantErr string
+	}{
+		{"empty", nil, ""},
+		{"valid", StatusMap{{From: 401, To: 403}, {From: 404, To: 200, Body: "none"}}, ""},
+		{"invalid from", StatusMap{{From: 42, To: 403}}, "[0]: invalid status 42"},
+		{"invalid to", StatusMap{{From: 401, To: 600}}, "[0]: invalid status 600"},
+		{"switching protocols", StatusMap{{From: 101, To: 200}}, "[0]: invalid status 101"},
+		{"duplicate", StatusMap{{From: 401, To: 403}, {From: 401, To: 404}}, "[1]: status 401 is mapped more than once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.m.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// RunTCPStream connects the requester to conn, a connection opened on its
+// behalf, such as for a CONNECT request.  A 200 response is sent, after
+// which data flows in both directions as it does for an upgraded HTTP
+// connection, until either side closes or the context is cancelled.
+func RunTCPStream(ctx context.Context, req *OpenHTTPTunnelRequest, conn io.ReadWriteCloser, dataflow chan *MessageWrapper, chunking ChunkConfig) {
+	defer conn.Close()
+
+	// Reads on conn do not watch the context, so closing it is how a
+	// cancelled request stops the stream.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	defer RegisterUpgradeConnection(req.Id, conn, dataflow)()
+
+	dataflow <- &MessageWrapper{
+		Event: &MessageWrapper_HttpTunnelControl{
+			HttpTunnelControl: &HttpTunnelControl{
+				ControlType: &HttpTunnelControl_HttpTunnelResponse{
+					HttpTunnelResponse: &HttpTunnelResponse{
+						Id:            req.Id,
+						Status:        http.StatusOK,
+						ContentLength: -1,
+					},
+				},
+			},
+		},
+	}
+
+	sendBody(ctx, req, conn, dataflow, chunking, 0, nil)
+}
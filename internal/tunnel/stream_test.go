@@ -0,0 +1,100 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestRunTCPStream_echo(t *testing.T) {
+	l := startEchoServer(t)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	req := &OpenHTTPTunnelRequest{Id: "tcp1", Method: "CONNECT", URI: l.Addr().String()}
+	dataflow := make(chan *MessageWrapper, 10)
+	go RunTCPStream(context.Background(), req, conn, dataflow, ChunkConfig{})
+
+	resp := nextMessage(t, dataflow).GetHttpTunnelResponse()
+	require.NotNil(t, resp)
+	assert.Equal(t, int32(200), resp.Status)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+
+	require.NoError(t, WriteUpgradeData("tcp1", []byte("hello")))
+	var echoed []byte
+	for len(echoed) < 5 {
+		chunk := nextMessage(t, dataflow).GetHttpTunnelChunkedResponse()
+		require.NotNil(t, chunk)
+		require.NotEmpty(t, chunk.Body, "unexpected EOF")
+		echoed = append(echoed, chunk.Body...)
+	}
+	assert.Equal(t, "hello", string(echoed))
+
+	// Closing the client side half-closes the connection, so the echo
+	// server finishes and the stream ends with a zero length chunk.
+	require.NoError(t, WriteUpgradeData("tcp1", []byte{}))
+	chunk := nextMessage(t, dataflow).GetHttpTunnelChunkedResponse()
+	require.NotNil(t, chunk)
+	assert.Empty(t, chunk.Body)
+}
+
+func TestRunTCPStream_cancel(t *testing.T) {
+	l := startEchoServer(t)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	req := &OpenHTTPTunnelRequest{Id: "tcp2", Method: "CONNECT", URI: l.Addr().String()}
+	dataflow := make(chan *MessageWrapper, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		RunTCPStream(ctx, req, conn, dataflow, ChunkConfig{})
+		close(finished)
+	}()
+	require.NotNil(t, nextMessage(t, dataflow).GetHttpTunnelResponse())
+
+	cancel()
+	<-finished
+	assert.Empty(t, dataflow, "a cancelled stream should not send EOF")
+	assert.Error(t, WriteUpgradeData("tcp2", []byte("late")))
+}
@@ -197,13 +197,17 @@ type OpenHTTPTunnelRequest struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Id      string        `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Name    string        `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
-	Type    string        `protobuf:"bytes,3,opt,name=type,proto3" json:"type,omitempty"`
-	Method  string        `protobuf:"bytes,4,opt,name=method,proto3" json:"method,omitempty"`
-	URI     string        `protobuf:"bytes,5,opt,name=URI,proto3" json:"URI,omitempty"`
-	Headers []*HttpHeader `protobuf:"bytes,6,rep,name=headers,proto3" json:"headers,omitempty"`
-	Body    []byte        `protobuf:"bytes,7,opt,name=body,proto3" json:"body,omitempty"`
+	Id            string        `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name          string        `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Type          string        `protobuf:"bytes,3,opt,name=type,proto3" json:"type,omitempty"`
+	Method        string        `protobuf:"bytes,4,opt,name=method,proto3" json:"method,omitempty"`
+	URI           string        `protobuf:"bytes,5,opt,name=URI,proto3" json:"URI,omitempty"`
+	Headers       []*HttpHeader `protobuf:"bytes,6,rep,name=headers,proto3" json:"headers,omitempty"`
+	Body          []byte        `protobuf:"bytes,7,opt,name=body,proto3" json:"body,omitempty"`
+	WindowSize    int64         `protobuf:"varint,8,opt,name=windowSize,proto3" json:"windowSize,omitempty"`        // if > 0, the sender will acknowledge response data with HttpTunnelWindowUpdate
+	StreamBody    bool          `protobuf:"varint,9,opt,name=streamBody,proto3" json:"streamBody,omitempty"`        // if set, the body follows in HttpTunnelChunkedRequest messages, and is acknowledged with HttpTunnelWindowUpdate
+	TimeoutMillis int64         `protobuf:"varint,10,opt,name=timeoutMillis,proto3" json:"timeoutMillis,omitempty"` // if > 0, how long the client will wait, and so how long the upstream request may take
+	Priority      int32         `protobuf:"varint,11,opt,name=priority,proto3" json:"priority,omitempty"`           // requests waiting for the endpoint's concurrency limit are started highest priority first
 }
 
 func (x *OpenHTTPTunnelRequest) Reset() {
@@ -287,6 +291,34 @@ func (x *OpenHTTPTunnelRequest) GetBody() []byte {
 	return nil
 }
 
+func (x *OpenHTTPTunnelRequest) GetWindowSize() int64 {
+	if x != nil {
+		return x.WindowSize
+	}
+	return 0
+}
+
+func (x *OpenHTTPTunnelRequest) GetStreamBody() bool {
+	if x != nil {
+		return x.StreamBody
+	}
+	return false
+}
+
+func (x *OpenHTTPTunnelRequest) GetTimeoutMillis() int64 {
+	if x != nil {
+		return x.TimeoutMillis
+	}
+	return 0
+}
+
+func (x *OpenHTTPTunnelRequest) GetPriority() int32 {
+	if x != nil {
+		return x.Priority
+	}
+	return 0
+}
+
 type CancelRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -408,13 +440,16 @@ func (x *HttpTunnelResponse) GetContentLength() int64 {
 	return 0
 }
 
+// The final, zero length, chunk carries any trailers sent by the upstream,
+// such as the status of a gRPC call.
 type HttpTunnelChunkedResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Id   string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Body []byte `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
+	Id       string        `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Body     []byte        `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
+	Trailers []*HttpHeader `protobuf:"bytes,3,rep,name=trailers,proto3" json:"trailers,omitempty"`
 }
 
 func (x *HttpTunnelChunkedResponse) Reset() {
@@ -463,6 +498,131 @@ func (x *HttpTunnelChunkedResponse) GetBody() []byte {
 	return nil
 }
 
+func (x *HttpTunnelChunkedResponse) GetTrailers() []*HttpHeader {
+	if x != nil {
+		return x.Trailers
+	}
+	return nil
+}
+
+// Once a connection has been upgraded (HTTP status 101), data sent by the
+// client is carried to the agent in a series of HttpTunnelChunkedRequest
+// messages, with a zero length meaning EOF.  These also carry the body of
+// a request opened with streamBody set.
+type HttpTunnelChunkedRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id   string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Body []byte `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
+}
+
+func (x *HttpTunnelChunkedRequest) Reset() {
+	*x = HttpTunnelChunkedRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_tunnel_tunnel_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *HttpTunnelChunkedRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HttpTunnelChunkedRequest) ProtoMessage() {}
+
+func (x *HttpTunnelChunkedRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_tunnel_tunnel_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HttpTunnelChunkedRequest.ProtoReflect.Descriptor instead.
+func (*HttpTunnelChunkedRequest) Descriptor() ([]byte, []int) {
+	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *HttpTunnelChunkedRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *HttpTunnelChunkedRequest) GetBody() []byte {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+// Sent by the receiver of a response body to acknowledge consumed bytes,
+// allowing the sender to read more of the upstream's response.  Also sent
+// by the agent as it consumes a streamed request body, allowing more of it
+// to be sent.
+type HttpTunnelWindowUpdate struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id    string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Bytes int64  `protobuf:"varint,2,opt,name=bytes,proto3" json:"bytes,omitempty"`
+}
+
+func (x *HttpTunnelWindowUpdate) Reset() {
+	*x = HttpTunnelWindowUpdate{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_tunnel_tunnel_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *HttpTunnelWindowUpdate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HttpTunnelWindowUpdate) ProtoMessage() {}
+
+func (x *HttpTunnelWindowUpdate) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_tunnel_tunnel_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HttpTunnelWindowUpdate.ProtoReflect.Descriptor instead.
+func (*HttpTunnelWindowUpdate) Descriptor() ([]byte, []int) {
+	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *HttpTunnelWindowUpdate) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *HttpTunnelWindowUpdate) GetBytes() int64 {
+	if x != nil {
+		return x.Bytes
+	}
+	return 0
+}
+
 type Annotation struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -475,7 +635,7 @@ type Annotation struct {
 func (x *Annotation) Reset() {
 	*x = Annotation{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_internal_tunnel_tunnel_proto_msgTypes[7]
+		mi := &file_internal_tunnel_tunnel_proto_msgTypes[9]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -488,7 +648,7 @@ func (x *Annotation) String() string {
 func (*Annotation) ProtoMessage() {}
 
 func (x *Annotation) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_tunnel_tunnel_proto_msgTypes[7]
+	mi := &file_internal_tunnel_tunnel_proto_msgTypes[9]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -501,7 +661,7 @@ func (x *Annotation) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Annotation.ProtoReflect.Descriptor instead.
 func (*Annotation) Descriptor() ([]byte, []int) {
-	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{7}
+	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{9}
 }
 
 func (x *Annotation) GetName() string {
@@ -530,12 +690,16 @@ type EndpointHealth struct {
 	AccountID   string        `protobuf:"bytes,5,opt,name=accountID,proto3" json:"accountID,omitempty"`   // AWS
 	AssumeRole  string        `protobuf:"bytes,6,opt,name=assumeRole,proto3" json:"assumeRole,omitempty"` // AWS
 	Annotations []*Annotation `protobuf:"bytes,7,rep,name=annotations,proto3" json:"annotations,omitempty"`
+	// Overrides for the controller's defaults, checked against its
+	// configured bounds.  Zero means no override.
+	MaxConcurrency int32 `protobuf:"varint,8,opt,name=maxConcurrency,proto3" json:"maxConcurrency,omitempty"`
+	Weight         int32 `protobuf:"varint,9,opt,name=weight,proto3" json:"weight,omitempty"`
 }
 
 func (x *EndpointHealth) Reset() {
 	*x = EndpointHealth{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_internal_tunnel_tunnel_proto_msgTypes[8]
+		mi := &file_internal_tunnel_tunnel_proto_msgTypes[10]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -548,7 +712,7 @@ func (x *EndpointHealth) String() string {
 func (*EndpointHealth) ProtoMessage() {}
 
 func (x *EndpointHealth) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_tunnel_tunnel_proto_msgTypes[8]
+	mi := &file_internal_tunnel_tunnel_proto_msgTypes[10]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -561,7 +725,7 @@ func (x *EndpointHealth) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use EndpointHealth.ProtoReflect.Descriptor instead.
 func (*EndpointHealth) Descriptor() ([]byte, []int) {
-	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{8}
+	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{10}
 }
 
 func (x *EndpointHealth) GetName() string {
@@ -613,6 +777,201 @@ func (x *EndpointHealth) GetAnnotations() []*Annotation {
 	return nil
 }
 
+func (x *EndpointHealth) GetMaxConcurrency() int32 {
+	if x != nil {
+		return x.MaxConcurrency
+	}
+	return 0
+}
+
+func (x *EndpointHealth) GetWeight() int32 {
+	if x != nil {
+		return x.Weight
+	}
+	return 0
+}
+
+// The health of one endpoint, as last checked by the agent.  The reason
+// says why an unhealthy endpoint failed its check.
+type EndpointStatus struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Type    string `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	Name    string `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Healthy bool   `protobuf:"varint,3,opt,name=healthy,proto3" json:"healthy,omitempty"`
+	Reason  string `protobuf:"bytes,4,opt,name=reason,proto3" json:"reason,omitempty"`
+	// The state of the endpoint's circuit breaker, closed, open, or
+	// half-open, if it has one.
+	CircuitBreaker string `protobuf:"bytes,5,opt,name=circuitBreaker,proto3" json:"circuitBreaker,omitempty"`
+}
+
+func (x *EndpointStatus) Reset() {
+	*x = EndpointStatus{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_tunnel_tunnel_proto_msgTypes[11]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *EndpointStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EndpointStatus) ProtoMessage() {}
+
+func (x *EndpointStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_tunnel_tunnel_proto_msgTypes[11]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EndpointStatus.ProtoReflect.Descriptor instead.
+func (*EndpointStatus) Descriptor() ([]byte, []int) {
+	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *EndpointStatus) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *EndpointStatus) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *EndpointStatus) GetHealthy() bool {
+	if x != nil {
+		return x.Healthy
+	}
+	return false
+}
+
+func (x *EndpointStatus) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *EndpointStatus) GetCircuitBreaker() string {
+	if x != nil {
+		return x.CircuitBreaker
+	}
+	return ""
+}
+
+// Sent periodically by the agent with the health of its endpoints.
+// Endpoints which are not listed keep their last reported health.
+type EndpointHealthReport struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Endpoints []*EndpointStatus `protobuf:"bytes,1,rep,name=endpoints,proto3" json:"endpoints,omitempty"`
+}
+
+func (x *EndpointHealthReport) Reset() {
+	*x = EndpointHealthReport{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_tunnel_tunnel_proto_msgTypes[12]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *EndpointHealthReport) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EndpointHealthReport) ProtoMessage() {}
+
+func (x *EndpointHealthReport) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_tunnel_tunnel_proto_msgTypes[12]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EndpointHealthReport.ProtoReflect.Descriptor instead.
+func (*EndpointHealthReport) Descriptor() ([]byte, []int) {
+	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *EndpointHealthReport) GetEndpoints() []*EndpointStatus {
+	if x != nil {
+		return x.Endpoints
+	}
+	return nil
+}
+
+// Sent by a controller which is being drained, once the requests it had in
+// progress have finished, asking the agent to connect to another controller.
+type Reconnect struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ControllerHostname string `protobuf:"bytes,1,opt,name=controllerHostname,proto3" json:"controllerHostname,omitempty"` // host:port
+}
+
+func (x *Reconnect) Reset() {
+	*x = Reconnect{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_tunnel_tunnel_proto_msgTypes[13]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Reconnect) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Reconnect) ProtoMessage() {}
+
+func (x *Reconnect) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_tunnel_tunnel_proto_msgTypes[13]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Reconnect.ProtoReflect.Descriptor instead.
+func (*Reconnect) Descriptor() ([]byte, []int) {
+	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *Reconnect) GetControllerHostname() string {
+	if x != nil {
+		return x.ControllerHostname
+	}
+	return ""
+}
+
 type AgentInformation struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -624,7 +983,7 @@ type AgentInformation struct {
 func (x *AgentInformation) Reset() {
 	*x = AgentInformation{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_internal_tunnel_tunnel_proto_msgTypes[9]
+		mi := &file_internal_tunnel_tunnel_proto_msgTypes[14]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -637,7 +996,7 @@ func (x *AgentInformation) String() string {
 func (*AgentInformation) ProtoMessage() {}
 
 func (x *AgentInformation) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_tunnel_tunnel_proto_msgTypes[9]
+	mi := &file_internal_tunnel_tunnel_proto_msgTypes[14]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -650,7 +1009,7 @@ func (x *AgentInformation) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use AgentInformation.ProtoReflect.Descriptor instead.
 func (*AgentInformation) Descriptor() ([]byte, []int) {
-	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{9}
+	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{14}
 }
 
 func (x *AgentInformation) GetAnnotations() []*Annotation {
@@ -675,7 +1034,7 @@ type Hello struct {
 func (x *Hello) Reset() {
 	*x = Hello{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_internal_tunnel_tunnel_proto_msgTypes[10]
+		mi := &file_internal_tunnel_tunnel_proto_msgTypes[15]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -688,7 +1047,7 @@ func (x *Hello) String() string {
 func (*Hello) ProtoMessage() {}
 
 func (x *Hello) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_tunnel_tunnel_proto_msgTypes[10]
+	mi := &file_internal_tunnel_tunnel_proto_msgTypes[15]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -701,7 +1060,7 @@ func (x *Hello) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Hello.ProtoReflect.Descriptor instead.
 func (*Hello) Descriptor() ([]byte, []int) {
-	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{10}
+	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{15}
 }
 
 func (x *Hello) GetEndpoints() []*EndpointHealth {
@@ -750,13 +1109,15 @@ type HttpTunnelControl struct {
 	//	*HttpTunnelControl_CancelRequest
 	//	*HttpTunnelControl_HttpTunnelResponse
 	//	*HttpTunnelControl_HttpTunnelChunkedResponse
+	//	*HttpTunnelControl_HttpTunnelChunkedRequest
+	//	*HttpTunnelControl_HttpTunnelWindowUpdate
 	ControlType isHttpTunnelControl_ControlType `protobuf_oneof:"controlType"`
 }
 
 func (x *HttpTunnelControl) Reset() {
 	*x = HttpTunnelControl{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_internal_tunnel_tunnel_proto_msgTypes[11]
+		mi := &file_internal_tunnel_tunnel_proto_msgTypes[16]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -769,7 +1130,7 @@ func (x *HttpTunnelControl) String() string {
 func (*HttpTunnelControl) ProtoMessage() {}
 
 func (x *HttpTunnelControl) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_tunnel_tunnel_proto_msgTypes[11]
+	mi := &file_internal_tunnel_tunnel_proto_msgTypes[16]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -782,7 +1143,7 @@ func (x *HttpTunnelControl) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use HttpTunnelControl.ProtoReflect.Descriptor instead.
 func (*HttpTunnelControl) Descriptor() ([]byte, []int) {
-	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{11}
+	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{16}
 }
 
 func (m *HttpTunnelControl) GetControlType() isHttpTunnelControl_ControlType {
@@ -820,6 +1181,20 @@ func (x *HttpTunnelControl) GetHttpTunnelChunkedResponse() *HttpTunnelChunkedRes
 	return nil
 }
 
+func (x *HttpTunnelControl) GetHttpTunnelChunkedRequest() *HttpTunnelChunkedRequest {
+	if x, ok := x.GetControlType().(*HttpTunnelControl_HttpTunnelChunkedRequest); ok {
+		return x.HttpTunnelChunkedRequest
+	}
+	return nil
+}
+
+func (x *HttpTunnelControl) GetHttpTunnelWindowUpdate() *HttpTunnelWindowUpdate {
+	if x, ok := x.GetControlType().(*HttpTunnelControl_HttpTunnelWindowUpdate); ok {
+		return x.HttpTunnelWindowUpdate
+	}
+	return nil
+}
+
 type isHttpTunnelControl_ControlType interface {
 	isHttpTunnelControl_ControlType()
 }
@@ -840,6 +1215,14 @@ type HttpTunnelControl_HttpTunnelChunkedResponse struct {
 	HttpTunnelChunkedResponse *HttpTunnelChunkedResponse `protobuf:"bytes,4,opt,name=httpTunnelChunkedResponse,proto3,oneof"`
 }
 
+type HttpTunnelControl_HttpTunnelChunkedRequest struct {
+	HttpTunnelChunkedRequest *HttpTunnelChunkedRequest `protobuf:"bytes,5,opt,name=httpTunnelChunkedRequest,proto3,oneof"`
+}
+
+type HttpTunnelControl_HttpTunnelWindowUpdate struct {
+	HttpTunnelWindowUpdate *HttpTunnelWindowUpdate `protobuf:"bytes,6,opt,name=httpTunnelWindowUpdate,proto3,oneof"`
+}
+
 func (*HttpTunnelControl_OpenHTTPTunnelRequest) isHttpTunnelControl_ControlType() {}
 
 func (*HttpTunnelControl_CancelRequest) isHttpTunnelControl_ControlType() {}
@@ -848,6 +1231,10 @@ func (*HttpTunnelControl_HttpTunnelResponse) isHttpTunnelControl_ControlType() {
 
 func (*HttpTunnelControl_HttpTunnelChunkedResponse) isHttpTunnelControl_ControlType() {}
 
+func (*HttpTunnelControl_HttpTunnelChunkedRequest) isHttpTunnelControl_ControlType() {}
+
+func (*HttpTunnelControl_HttpTunnelWindowUpdate) isHttpTunnelControl_ControlType() {}
+
 // Messages sent from controller to agent, or agent to controller
 type MessageWrapper struct {
 	state         protoimpl.MessageState
@@ -860,13 +1247,15 @@ type MessageWrapper struct {
 	//	*MessageWrapper_PingResponse
 	//	*MessageWrapper_Hello
 	//	*MessageWrapper_HttpTunnelControl
+	//	*MessageWrapper_EndpointHealthReport
+	//	*MessageWrapper_Reconnect
 	Event isMessageWrapper_Event `protobuf_oneof:"event"`
 }
 
 func (x *MessageWrapper) Reset() {
 	*x = MessageWrapper{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_internal_tunnel_tunnel_proto_msgTypes[12]
+		mi := &file_internal_tunnel_tunnel_proto_msgTypes[17]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -879,7 +1268,7 @@ func (x *MessageWrapper) String() string {
 func (*MessageWrapper) ProtoMessage() {}
 
 func (x *MessageWrapper) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_tunnel_tunnel_proto_msgTypes[12]
+	mi := &file_internal_tunnel_tunnel_proto_msgTypes[17]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -892,7 +1281,7 @@ func (x *MessageWrapper) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use MessageWrapper.ProtoReflect.Descriptor instead.
 func (*MessageWrapper) Descriptor() ([]byte, []int) {
-	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{12}
+	return file_internal_tunnel_tunnel_proto_rawDescGZIP(), []int{17}
 }
 
 func (m *MessageWrapper) GetEvent() isMessageWrapper_Event {
@@ -930,6 +1319,20 @@ func (x *MessageWrapper) GetHttpTunnelControl() *HttpTunnelControl {
 	return nil
 }
 
+func (x *MessageWrapper) GetEndpointHealthReport() *EndpointHealthReport {
+	if x, ok := x.GetEvent().(*MessageWrapper_EndpointHealthReport); ok {
+		return x.EndpointHealthReport
+	}
+	return nil
+}
+
+func (x *MessageWrapper) GetReconnect() *Reconnect {
+	if x, ok := x.GetEvent().(*MessageWrapper_Reconnect); ok {
+		return x.Reconnect
+	}
+	return nil
+}
+
 type isMessageWrapper_Event interface {
 	isMessageWrapper_Event()
 }
@@ -950,6 +1353,14 @@ type MessageWrapper_HttpTunnelControl struct {
 	HttpTunnelControl *HttpTunnelControl `protobuf:"bytes,4,opt,name=httpTunnelControl,proto3,oneof"`
 }
 
+type MessageWrapper_EndpointHealthReport struct {
+	EndpointHealthReport *EndpointHealthReport `protobuf:"bytes,5,opt,name=endpointHealthReport,proto3,oneof"`
+}
+
+type MessageWrapper_Reconnect struct {
+	Reconnect *Reconnect `protobuf:"bytes,6,opt,name=reconnect,proto3,oneof"`
+}
+
 func (*MessageWrapper_PingRequest) isMessageWrapper_Event() {}
 
 func (*MessageWrapper_PingResponse) isMessageWrapper_Event() {}
@@ -958,6 +1369,10 @@ func (*MessageWrapper_Hello) isMessageWrapper_Event() {}
 
 func (*MessageWrapper_HttpTunnelControl) isMessageWrapper_Event() {}
 
+func (*MessageWrapper_EndpointHealthReport) isMessageWrapper_Event() {}
+
+func (*MessageWrapper_Reconnect) isMessageWrapper_Event() {}
+
 var File_internal_tunnel_tunnel_proto protoreflect.FileDescriptor
 
 var file_internal_tunnel_tunnel_proto_rawDesc = []byte{
@@ -972,7 +1387,7 @@ var file_internal_tunnel_tunnel_proto_rawDesc = []byte{
 	0x73, 0x22, 0x38, 0x0a, 0x0a, 0x48, 0x74, 0x74, 0x70, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x12,
 	0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e,
 	0x61, 0x6d, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x18, 0x02, 0x20,
-	0x03, 0x28, 0x09, 0x52, 0x06, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x22, 0xbb, 0x01, 0x0a, 0x15,
+	0x03, 0x28, 0x09, 0x52, 0x06, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x22, 0xf0, 0x02, 0x0a, 0x15,
 	0x4f, 0x70, 0x65, 0x6e, 0x48, 0x54, 0x54, 0x50, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65,
 	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
 	0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20,
@@ -984,105 +1399,169 @@ var file_internal_tunnel_tunnel_proto_rawDesc = []byte{
 	0x72, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65,
 	0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x52, 0x07, 0x68, 0x65,
 	0x61, 0x64, 0x65, 0x72, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x07, 0x20,
-	0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x22, 0x1f, 0x0a, 0x0d, 0x43, 0x61, 0x6e,
-	0x63, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64,
-	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x22, 0x90, 0x01, 0x0a, 0x12, 0x48,
-	0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
-	0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69,
-	0x64, 0x12, 0x16, 0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28,
-	0x05, 0x52, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x2c, 0x0a, 0x07, 0x68, 0x65, 0x61,
-	0x64, 0x65, 0x72, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x74, 0x75, 0x6e,
-	0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x52, 0x07,
-	0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x12, 0x24, 0x0a, 0x0d, 0x63, 0x6f, 0x6e, 0x74, 0x65,
-	0x6e, 0x74, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0d,
-	0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x22, 0x3f, 0x0a,
-	0x19, 0x48, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x43, 0x68, 0x75, 0x6e, 0x6b,
-	0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64,
-	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f,
-	0x64, 0x79, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x22, 0x36,
-	0x0a, 0x0a, 0x41, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x12, 0x0a, 0x04,
-	0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65,
-	0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
-	0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x22, 0xec, 0x01, 0x0a, 0x0e, 0x45, 0x6e, 0x64, 0x70, 0x6f,
-	0x69, 0x6e, 0x74, 0x48, 0x65, 0x61, 0x6c, 0x74, 0x68, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d,
-	0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x12, 0x0a,
-	0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x74, 0x79, 0x70,
-	0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75, 0x72, 0x65, 0x64, 0x18,
-	0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75, 0x72, 0x65,
-	0x64, 0x12, 0x1e, 0x0a, 0x0a, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x70, 0x61, 0x63, 0x65, 0x73, 0x18,
-	0x04, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0a, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x70, 0x61, 0x63, 0x65,
-	0x73, 0x12, 0x1c, 0x0a, 0x09, 0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x49, 0x44, 0x18, 0x05,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x49, 0x44, 0x12,
-	0x1e, 0x0a, 0x0a, 0x61, 0x73, 0x73, 0x75, 0x6d, 0x65, 0x52, 0x6f, 0x6c, 0x65, 0x18, 0x06, 0x20,
-	0x01, 0x28, 0x09, 0x52, 0x0a, 0x61, 0x73, 0x73, 0x75, 0x6d, 0x65, 0x52, 0x6f, 0x6c, 0x65, 0x12,
-	0x34, 0x0a, 0x0b, 0x61, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x07,
-	0x20, 0x03, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x41, 0x6e,
-	0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x0b, 0x61, 0x6e, 0x6e, 0x6f, 0x74, 0x61,
-	0x74, 0x69, 0x6f, 0x6e, 0x73, 0x22, 0x48, 0x0a, 0x10, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x6e,
-	0x66, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x34, 0x0a, 0x0b, 0x61, 0x6e, 0x6e,
-	0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x12,
-	0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x41, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69,
-	0x6f, 0x6e, 0x52, 0x0b, 0x61, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x22,
-	0xd9, 0x01, 0x0a, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x12, 0x34, 0x0a, 0x09, 0x65, 0x6e, 0x64,
-	0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x74,
-	0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x45, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x48, 0x65,
-	0x61, 0x6c, 0x74, 0x68, 0x52, 0x09, 0x65, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73, 0x12,
-	0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x08, 0x68, 0x6f, 0x73,
-	0x74, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x68, 0x6f, 0x73,
-	0x74, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x2c, 0x0a, 0x11, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x43,
-	0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c,
-	0x52, 0x11, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x43, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63,
-	0x61, 0x74, 0x65, 0x12, 0x36, 0x0a, 0x09, 0x61, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x6e, 0x66, 0x6f,
-	0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e,
-	0x41, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x6e, 0x66, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x69, 0x6f, 0x6e,
-	0x52, 0x09, 0x61, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x6e, 0x66, 0x6f, 0x22, 0xe9, 0x02, 0x0a, 0x11,
-	0x48, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f,
-	0x6c, 0x12, 0x55, 0x0a, 0x15, 0x6f, 0x70, 0x65, 0x6e, 0x48, 0x54, 0x54, 0x50, 0x54, 0x75, 0x6e,
-	0x6e, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b,
-	0x32, 0x1d, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x4f, 0x70, 0x65, 0x6e, 0x48, 0x54,
-	0x54, 0x50, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48,
-	0x00, 0x52, 0x15, 0x6f, 0x70, 0x65, 0x6e, 0x48, 0x54, 0x54, 0x50, 0x54, 0x75, 0x6e, 0x6e, 0x65,
-	0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x3d, 0x0a, 0x0d, 0x63, 0x61, 0x6e, 0x63,
-	0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32,
-	0x15, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x52,
-	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x0d, 0x63, 0x61, 0x6e, 0x63, 0x65, 0x6c,
-	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x4c, 0x0a, 0x12, 0x68, 0x74, 0x74, 0x70, 0x54,
-	0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x03, 0x20,
-	0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74,
-	0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x48,
-	0x00, 0x52, 0x12, 0x68, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x73,
-	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x61, 0x0a, 0x19, 0x68, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e,
-	0x6e, 0x65, 0x6c, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
-	0x73, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x21, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65,
-	0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x43, 0x68, 0x75, 0x6e,
-	0x6b, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x48, 0x00, 0x52, 0x19, 0x68,
-	0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64,
-	0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42, 0x0d, 0x0a, 0x0b, 0x63, 0x6f, 0x6e, 0x74,
-	0x72, 0x6f, 0x6c, 0x54, 0x79, 0x70, 0x65, 0x22, 0x80, 0x02, 0x0a, 0x0e, 0x4d, 0x65, 0x73, 0x73,
-	0x61, 0x67, 0x65, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x12, 0x37, 0x0a, 0x0b, 0x70, 0x69,
-	0x6e, 0x67, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32,
-	0x13, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x50, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x71,
-	0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x0b, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x71, 0x75,
-	0x65, 0x73, 0x74, 0x12, 0x3a, 0x0a, 0x0c, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f,
-	0x6e, 0x73, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x74, 0x75, 0x6e, 0x6e,
-	0x65, 0x6c, 0x2e, 0x50, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x48,
-	0x00, 0x52, 0x0c, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12,
-	0x25, 0x0a, 0x05, 0x68, 0x65, 0x6c, 0x6c, 0x6f, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0d,
-	0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x48, 0x00, 0x52,
-	0x05, 0x68, 0x65, 0x6c, 0x6c, 0x6f, 0x12, 0x49, 0x0a, 0x11, 0x68, 0x74, 0x74, 0x70, 0x54, 0x75,
-	0x6e, 0x6e, 0x65, 0x6c, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x18, 0x04, 0x20, 0x01, 0x28,
-	0x0b, 0x32, 0x19, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x54,
-	0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x48, 0x00, 0x52, 0x11,
-	0x68, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f,
-	0x6c, 0x42, 0x07, 0x0a, 0x05, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x32, 0x59, 0x0a, 0x12, 0x41, 0x67,
-	0x65, 0x6e, 0x74, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65,
-	0x12, 0x43, 0x0a, 0x0b, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x12,
-	0x16, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65,
-	0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x1a, 0x16, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c,
-	0x2e, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x22,
-	0x00, 0x28, 0x01, 0x30, 0x01, 0x42, 0x0b, 0x5a, 0x09, 0x2e, 0x2f, 0x3b, 0x74, 0x75, 0x6e, 0x6e,
-	0x65, 0x6c, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x12, 0x1e, 0x0a, 0x0a, 0x77, 0x69, 0x6e,
+	0x64, 0x6f, 0x77, 0x53, 0x69, 0x7a, 0x65, 0x18, 0x08, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a, 0x77,
+	0x69, 0x6e, 0x64, 0x6f, 0x77, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x73, 0x74, 0x72,
+	0x65, 0x61, 0x6d, 0x42, 0x6f, 0x64, 0x79, 0x18, 0x09, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a, 0x73,
+	0x74, 0x72, 0x65, 0x61, 0x6d, 0x42, 0x6f, 0x64, 0x79, 0x12, 0x24, 0x0a, 0x0d, 0x74, 0x69, 0x6d,
+	0x65, 0x6f, 0x75, 0x74, 0x4d, 0x69, 0x6c, 0x6c, 0x69, 0x73, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x0d, 0x74, 0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74, 0x4d, 0x69, 0x6c, 0x6c, 0x69, 0x73, 0x12,
+	0x1a, 0x0a, 0x08, 0x70, 0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x18, 0x0b, 0x20, 0x01, 0x28,
+	0x05, 0x52, 0x08, 0x70, 0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x4a, 0x04, 0x08, 0x0c, 0x10,
+	0x0d, 0x4a, 0x04, 0x08, 0x0d, 0x10, 0x0e, 0x52, 0x12, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c,
+	0x6c, 0x65, 0x72, 0x49, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x52, 0x11, 0x69, 0x64, 0x65,
+	0x6e, 0x74, 0x69, 0x74, 0x79, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x22, 0x1f,
+	0x0a, 0x0d, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x22,
+	0x90, 0x01, 0x0a, 0x12, 0x48, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x2c,
+	0x0a, 0x07, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32,
+	0x12, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x48, 0x65, 0x61,
+	0x64, 0x65, 0x72, 0x52, 0x07, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x12, 0x24, 0x0a, 0x0d,
+	0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x0d, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x4c, 0x65, 0x6e, 0x67,
+	0x74, 0x68, 0x22, 0x6f, 0x0a, 0x19, 0x48, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c,
+	0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12,
+	0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12,
+	0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x62,
+	0x6f, 0x64, 0x79, 0x12, 0x2e, 0x0a, 0x08, 0x74, 0x72, 0x61, 0x69, 0x6c, 0x65, 0x72, 0x73, 0x18,
+	0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48,
+	0x74, 0x74, 0x70, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x52, 0x08, 0x74, 0x72, 0x61, 0x69, 0x6c,
+	0x65, 0x72, 0x73, 0x22, 0x3e, 0x0a, 0x18, 0x48, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65,
+	0x6c, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12,
+	0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x62,
+	0x6f, 0x64, 0x79, 0x22, 0x3e, 0x0a, 0x16, 0x48, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65,
+	0x6c, 0x57, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x12, 0x0e, 0x0a,
+	0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x14, 0x0a,
+	0x05, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x62, 0x79,
+	0x74, 0x65, 0x73, 0x22, 0x36, 0x0a, 0x0a, 0x41, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x22, 0xac, 0x02, 0x0a, 0x0e,
+	0x45, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x48, 0x65, 0x61, 0x6c, 0x74, 0x68, 0x12, 0x12,
+	0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61,
+	0x6d, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67,
+	0x75, 0x72, 0x65, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a, 0x63, 0x6f, 0x6e, 0x66,
+	0x69, 0x67, 0x75, 0x72, 0x65, 0x64, 0x12, 0x1e, 0x0a, 0x0a, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x70,
+	0x61, 0x63, 0x65, 0x73, 0x18, 0x04, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0a, 0x6e, 0x61, 0x6d, 0x65,
+	0x73, 0x70, 0x61, 0x63, 0x65, 0x73, 0x12, 0x1c, 0x0a, 0x09, 0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e,
+	0x74, 0x49, 0x44, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x61, 0x63, 0x63, 0x6f, 0x75,
+	0x6e, 0x74, 0x49, 0x44, 0x12, 0x1e, 0x0a, 0x0a, 0x61, 0x73, 0x73, 0x75, 0x6d, 0x65, 0x52, 0x6f,
+	0x6c, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x61, 0x73, 0x73, 0x75, 0x6d, 0x65,
+	0x52, 0x6f, 0x6c, 0x65, 0x12, 0x34, 0x0a, 0x0b, 0x61, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x74, 0x75, 0x6e, 0x6e,
+	0x65, 0x6c, 0x2e, 0x41, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x0b, 0x61,
+	0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x26, 0x0a, 0x0e, 0x6d, 0x61,
+	0x78, 0x43, 0x6f, 0x6e, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x63, 0x79, 0x18, 0x08, 0x20, 0x01,
+	0x28, 0x05, 0x52, 0x0e, 0x6d, 0x61, 0x78, 0x43, 0x6f, 0x6e, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e,
+	0x63, 0x79, 0x12, 0x16, 0x0a, 0x06, 0x77, 0x65, 0x69, 0x67, 0x68, 0x74, 0x18, 0x09, 0x20, 0x01,
+	0x28, 0x05, 0x52, 0x06, 0x77, 0x65, 0x69, 0x67, 0x68, 0x74, 0x22, 0x92, 0x01, 0x0a, 0x0e, 0x45,
+	0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x12, 0x0a,
+	0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x74, 0x79, 0x70,
+	0x65, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x68, 0x65, 0x61, 0x6c, 0x74, 0x68, 0x79,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x68, 0x65, 0x61, 0x6c, 0x74, 0x68, 0x79, 0x12,
+	0x16, 0x0a, 0x06, 0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x06, 0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x12, 0x26, 0x0a, 0x0e, 0x63, 0x69, 0x72, 0x63, 0x75,
+	0x69, 0x74, 0x42, 0x72, 0x65, 0x61, 0x6b, 0x65, 0x72, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x0e, 0x63, 0x69, 0x72, 0x63, 0x75, 0x69, 0x74, 0x42, 0x72, 0x65, 0x61, 0x6b, 0x65, 0x72, 0x22,
+	0x4c, 0x0a, 0x14, 0x45, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x48, 0x65, 0x61, 0x6c, 0x74,
+	0x68, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x34, 0x0a, 0x09, 0x65, 0x6e, 0x64, 0x70, 0x6f,
+	0x69, 0x6e, 0x74, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x74, 0x75, 0x6e,
+	0x6e, 0x65, 0x6c, 0x2e, 0x45, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x53, 0x74, 0x61, 0x74,
+	0x75, 0x73, 0x52, 0x09, 0x65, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73, 0x22, 0x3b, 0x0a,
+	0x09, 0x52, 0x65, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x12, 0x2e, 0x0a, 0x12, 0x63, 0x6f,
+	0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x12, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c,
+	0x65, 0x72, 0x48, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x22, 0x48, 0x0a, 0x10, 0x41, 0x67,
+	0x65, 0x6e, 0x74, 0x49, 0x6e, 0x66, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x34,
+	0x0a, 0x0b, 0x61, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x02, 0x20,
+	0x03, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x41, 0x6e, 0x6e,
+	0x6f, 0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x0b, 0x61, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74,
+	0x69, 0x6f, 0x6e, 0x73, 0x22, 0xd9, 0x01, 0x0a, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x12, 0x34,
+	0x0a, 0x09, 0x65, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28,
+	0x0b, 0x32, 0x16, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x45, 0x6e, 0x64, 0x70, 0x6f,
+	0x69, 0x6e, 0x74, 0x48, 0x65, 0x61, 0x6c, 0x74, 0x68, 0x52, 0x09, 0x65, 0x6e, 0x64, 0x70, 0x6f,
+	0x69, 0x6e, 0x74, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1a,
+	0x0a, 0x08, 0x68, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x08, 0x68, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x2c, 0x0a, 0x11, 0x63, 0x6c,
+	0x69, 0x65, 0x6e, 0x74, 0x43, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x11, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x43, 0x65, 0x72,
+	0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x12, 0x36, 0x0a, 0x09, 0x61, 0x67, 0x65, 0x6e,
+	0x74, 0x49, 0x6e, 0x66, 0x6f, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x74, 0x75,
+	0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x6e, 0x66, 0x6f, 0x72, 0x6d,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x09, 0x61, 0x67, 0x65, 0x6e, 0x74, 0x49, 0x6e, 0x66, 0x6f,
+	0x22, 0xa3, 0x04, 0x0a, 0x11, 0x48, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x43,
+	0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x12, 0x55, 0x0a, 0x15, 0x6f, 0x70, 0x65, 0x6e, 0x48, 0x54,
+	0x54, 0x50, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x4f,
+	0x70, 0x65, 0x6e, 0x48, 0x54, 0x54, 0x50, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x15, 0x6f, 0x70, 0x65, 0x6e, 0x48, 0x54, 0x54, 0x50,
+	0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x3d, 0x0a,
+	0x0d, 0x63, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x61,
+	0x6e, 0x63, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x0d, 0x63,
+	0x61, 0x6e, 0x63, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x4c, 0x0a, 0x12,
+	0x68, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65,
+	0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x48, 0x00, 0x52, 0x12, 0x68, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e,
+	0x65, 0x6c, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x61, 0x0a, 0x19, 0x68, 0x74,
+	0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x21, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65,
+	0x6c, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x48, 0x00, 0x52, 0x19, 0x68, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x43, 0x68,
+	0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x5e, 0x0a,
+	0x18, 0x68, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x43, 0x68, 0x75, 0x6e, 0x6b,
+	0x65, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x20, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e,
+	0x6e, 0x65, 0x6c, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x48, 0x00, 0x52, 0x18, 0x68, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x43,
+	0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x58, 0x0a,
+	0x16, 0x68, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x57, 0x69, 0x6e, 0x64, 0x6f,
+	0x77, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1e, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65,
+	0x6c, 0x57, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x48, 0x00, 0x52,
+	0x16, 0x68, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x57, 0x69, 0x6e, 0x64, 0x6f,
+	0x77, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x42, 0x0d, 0x0a, 0x0b, 0x63, 0x6f, 0x6e, 0x74, 0x72,
+	0x6f, 0x6c, 0x54, 0x79, 0x70, 0x65, 0x22, 0x87, 0x03, 0x0a, 0x0e, 0x4d, 0x65, 0x73, 0x73, 0x61,
+	0x67, 0x65, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x12, 0x37, 0x0a, 0x0b, 0x70, 0x69, 0x6e,
+	0x67, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13,
+	0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x50, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x0b, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x12, 0x3a, 0x0a, 0x0c, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65,
+	0x6c, 0x2e, 0x50, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x48, 0x00,
+	0x52, 0x0c, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x25,
+	0x0a, 0x05, 0x68, 0x65, 0x6c, 0x6c, 0x6f, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0d, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x48, 0x00, 0x52, 0x05,
+	0x68, 0x65, 0x6c, 0x6c, 0x6f, 0x12, 0x49, 0x0a, 0x11, 0x68, 0x74, 0x74, 0x70, 0x54, 0x75, 0x6e,
+	0x6e, 0x65, 0x6c, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x19, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x54, 0x75,
+	0x6e, 0x6e, 0x65, 0x6c, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x48, 0x00, 0x52, 0x11, 0x68,
+	0x74, 0x74, 0x70, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c,
+	0x12, 0x52, 0x0a, 0x14, 0x65, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x48, 0x65, 0x61, 0x6c,
+	0x74, 0x68, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1c,
+	0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x45, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74,
+	0x48, 0x65, 0x61, 0x6c, 0x74, 0x68, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x48, 0x00, 0x52, 0x14,
+	0x65, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x48, 0x65, 0x61, 0x6c, 0x74, 0x68, 0x52, 0x65,
+	0x70, 0x6f, 0x72, 0x74, 0x12, 0x31, 0x0a, 0x09, 0x72, 0x65, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63,
+	0x74, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c,
+	0x2e, 0x52, 0x65, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x48, 0x00, 0x52, 0x09, 0x72, 0x65,
+	0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x42, 0x07, 0x0a, 0x05, 0x65, 0x76, 0x65, 0x6e, 0x74,
+	0x32, 0x59, 0x0a, 0x12, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x53,
+	0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x43, 0x0a, 0x0b, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x54,
+	0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x12, 0x16, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x4d,
+	0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x1a, 0x16, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x57, 0x72,
+	0x61, 0x70, 0x70, 0x65, 0x72, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x42, 0x0b, 0x5a, 0x09, 0x2e,
+	0x2f, 0x3b, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -1097,7 +1576,7 @@ func file_internal_tunnel_tunnel_proto_rawDescGZIP() []byte {
 	return file_internal_tunnel_tunnel_proto_rawDescData
 }
 
-var file_internal_tunnel_tunnel_proto_msgTypes = make([]protoimpl.MessageInfo, 13)
+var file_internal_tunnel_tunnel_proto_msgTypes = make([]protoimpl.MessageInfo, 18)
 var file_internal_tunnel_tunnel_proto_goTypes = []interface{}{
 	(*PingRequest)(nil),               // 0: tunnel.PingRequest
 	(*PingResponse)(nil),              // 1: tunnel.PingResponse
@@ -1106,35 +1585,46 @@ var file_internal_tunnel_tunnel_proto_goTypes = []interface{}{
 	(*CancelRequest)(nil),             // 4: tunnel.CancelRequest
 	(*HttpTunnelResponse)(nil),        // 5: tunnel.HttpTunnelResponse
 	(*HttpTunnelChunkedResponse)(nil), // 6: tunnel.HttpTunnelChunkedResponse
-	(*Annotation)(nil),                // 7: tunnel.Annotation
-	(*EndpointHealth)(nil),            // 8: tunnel.EndpointHealth
-	(*AgentInformation)(nil),          // 9: tunnel.AgentInformation
-	(*Hello)(nil),                     // 10: tunnel.Hello
-	(*HttpTunnelControl)(nil),         // 11: tunnel.HttpTunnelControl
-	(*MessageWrapper)(nil),            // 12: tunnel.MessageWrapper
+	(*HttpTunnelChunkedRequest)(nil),  // 7: tunnel.HttpTunnelChunkedRequest
+	(*HttpTunnelWindowUpdate)(nil),    // 8: tunnel.HttpTunnelWindowUpdate
+	(*Annotation)(nil),                // 9: tunnel.Annotation
+	(*EndpointHealth)(nil),            // 10: tunnel.EndpointHealth
+	(*EndpointStatus)(nil),            // 11: tunnel.EndpointStatus
+	(*EndpointHealthReport)(nil),      // 12: tunnel.EndpointHealthReport
+	(*Reconnect)(nil),                 // 13: tunnel.Reconnect
+	(*AgentInformation)(nil),          // 14: tunnel.AgentInformation
+	(*Hello)(nil),                     // 15: tunnel.Hello
+	(*HttpTunnelControl)(nil),         // 16: tunnel.HttpTunnelControl
+	(*MessageWrapper)(nil),            // 17: tunnel.MessageWrapper
 }
 var file_internal_tunnel_tunnel_proto_depIdxs = []int32{
 	2,  // 0: tunnel.OpenHTTPTunnelRequest.headers:type_name -> tunnel.HttpHeader
 	2,  // 1: tunnel.HttpTunnelResponse.headers:type_name -> tunnel.HttpHeader
-	7,  // 2: tunnel.EndpointHealth.annotations:type_name -> tunnel.Annotation
-	7,  // 3: tunnel.AgentInformation.annotations:type_name -> tunnel.Annotation
-	8,  // 4: tunnel.Hello.endpoints:type_name -> tunnel.EndpointHealth
-	9,  // 5: tunnel.Hello.agentInfo:type_name -> tunnel.AgentInformation
-	3,  // 6: tunnel.HttpTunnelControl.openHTTPTunnelRequest:type_name -> tunnel.OpenHTTPTunnelRequest
-	4,  // 7: tunnel.HttpTunnelControl.cancelRequest:type_name -> tunnel.CancelRequest
-	5,  // 8: tunnel.HttpTunnelControl.httpTunnelResponse:type_name -> tunnel.HttpTunnelResponse
-	6,  // 9: tunnel.HttpTunnelControl.httpTunnelChunkedResponse:type_name -> tunnel.HttpTunnelChunkedResponse
-	0,  // 10: tunnel.MessageWrapper.pingRequest:type_name -> tunnel.PingRequest
-	1,  // 11: tunnel.MessageWrapper.pingResponse:type_name -> tunnel.PingResponse
-	10, // 12: tunnel.MessageWrapper.hello:type_name -> tunnel.Hello
-	11, // 13: tunnel.MessageWrapper.httpTunnelControl:type_name -> tunnel.HttpTunnelControl
-	12, // 14: tunnel.AgentTunnelService.EventTunnel:input_type -> tunnel.MessageWrapper
-	12, // 15: tunnel.AgentTunnelService.EventTunnel:output_type -> tunnel.MessageWrapper
-	15, // [15:16] is the sub-list for method output_type
-	14, // [14:15] is the sub-list for method input_type
-	14, // [14:14] is the sub-list for extension type_name
-	14, // [14:14] is the sub-list for extension extendee
-	0,  // [0:14] is the sub-list for field type_name
+	2,  // 2: tunnel.HttpTunnelChunkedResponse.trailers:type_name -> tunnel.HttpHeader
+	9,  // 3: tunnel.EndpointHealth.annotations:type_name -> tunnel.Annotation
+	11, // 4: tunnel.EndpointHealthReport.endpoints:type_name -> tunnel.EndpointStatus
+	9,  // 5: tunnel.AgentInformation.annotations:type_name -> tunnel.Annotation
+	10, // 6: tunnel.Hello.endpoints:type_name -> tunnel.EndpointHealth
+	14, // 7: tunnel.Hello.agentInfo:type_name -> tunnel.AgentInformation
+	3,  // 8: tunnel.HttpTunnelControl.openHTTPTunnelRequest:type_name -> tunnel.OpenHTTPTunnelRequest
+	4,  // 9: tunnel.HttpTunnelControl.cancelRequest:type_name -> tunnel.CancelRequest
+	5,  // 10: tunnel.HttpTunnelControl.httpTunnelResponse:type_name -> tunnel.HttpTunnelResponse
+	6,  // 11: tunnel.HttpTunnelControl.httpTunnelChunkedResponse:type_name -> tunnel.HttpTunnelChunkedResponse
+	7,  // 12: tunnel.HttpTunnelControl.httpTunnelChunkedRequest:type_name -> tunnel.HttpTunnelChunkedRequest
+	8,  // 13: tunnel.HttpTunnelControl.httpTunnelWindowUpdate:type_name -> tunnel.HttpTunnelWindowUpdate
+	0,  // 14: tunnel.MessageWrapper.pingRequest:type_name -> tunnel.PingRequest
+	1,  // 15: tunnel.MessageWrapper.pingResponse:type_name -> tunnel.PingResponse
+	15, // 16: tunnel.MessageWrapper.hello:type_name -> tunnel.Hello
+	16, // 17: tunnel.MessageWrapper.httpTunnelControl:type_name -> tunnel.HttpTunnelControl
+	12, // 18: tunnel.MessageWrapper.endpointHealthReport:type_name -> tunnel.EndpointHealthReport
+	13, // 19: tunnel.MessageWrapper.reconnect:type_name -> tunnel.Reconnect
+	17, // 20: tunnel.AgentTunnelService.EventTunnel:input_type -> tunnel.MessageWrapper
+	17, // 21: tunnel.AgentTunnelService.EventTunnel:output_type -> tunnel.MessageWrapper
+	21, // [21:22] is the sub-list for method output_type
+	20, // [20:21] is the sub-list for method input_type
+	20, // [20:20] is the sub-list for extension type_name
+	20, // [20:20] is the sub-list for extension extendee
+	0,  // [0:20] is the sub-list for field type_name
 }
 
 func init() { file_internal_tunnel_tunnel_proto_init() }
@@ -1228,7 +1718,7 @@ func file_internal_tunnel_tunnel_proto_init() {
 			}
 		}
 		file_internal_tunnel_tunnel_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Annotation); i {
+			switch v := v.(*HttpTunnelChunkedRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1240,7 +1730,7 @@ func file_internal_tunnel_tunnel_proto_init() {
 			}
 		}
 		file_internal_tunnel_tunnel_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*EndpointHealth); i {
+			switch v := v.(*HttpTunnelWindowUpdate); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1252,7 +1742,7 @@ func file_internal_tunnel_tunnel_proto_init() {
 			}
 		}
 		file_internal_tunnel_tunnel_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*AgentInformation); i {
+			switch v := v.(*Annotation); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1264,7 +1754,7 @@ func file_internal_tunnel_tunnel_proto_init() {
 			}
 		}
 		file_internal_tunnel_tunnel_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Hello); i {
+			switch v := v.(*EndpointHealth); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1276,7 +1766,7 @@ func file_internal_tunnel_tunnel_proto_init() {
 			}
 		}
 		file_internal_tunnel_tunnel_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*HttpTunnelControl); i {
+			switch v := v.(*EndpointStatus); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1288,6 +1778,66 @@ func file_internal_tunnel_tunnel_proto_init() {
 			}
 		}
 		file_internal_tunnel_tunnel_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*EndpointHealthReport); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_tunnel_tunnel_proto_msgTypes[13].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Reconnect); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_tunnel_tunnel_proto_msgTypes[14].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*AgentInformation); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_tunnel_tunnel_proto_msgTypes[15].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Hello); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_tunnel_tunnel_proto_msgTypes[16].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HttpTunnelControl); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_tunnel_tunnel_proto_msgTypes[17].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*MessageWrapper); i {
 			case 0:
 				return &v.state
@@ -1300,17 +1850,21 @@ func file_internal_tunnel_tunnel_proto_init() {
 			}
 		}
 	}
-	file_internal_tunnel_tunnel_proto_msgTypes[11].OneofWrappers = []interface{}{
+	file_internal_tunnel_tunnel_proto_msgTypes[16].OneofWrappers = []interface{}{
 		(*HttpTunnelControl_OpenHTTPTunnelRequest)(nil),
 		(*HttpTunnelControl_CancelRequest)(nil),
 		(*HttpTunnelControl_HttpTunnelResponse)(nil),
 		(*HttpTunnelControl_HttpTunnelChunkedResponse)(nil),
+		(*HttpTunnelControl_HttpTunnelChunkedRequest)(nil),
+		(*HttpTunnelControl_HttpTunnelWindowUpdate)(nil),
 	}
-	file_internal_tunnel_tunnel_proto_msgTypes[12].OneofWrappers = []interface{}{
+	file_internal_tunnel_tunnel_proto_msgTypes[17].OneofWrappers = []interface{}{
 		(*MessageWrapper_PingRequest)(nil),
 		(*MessageWrapper_PingResponse)(nil),
 		(*MessageWrapper_Hello)(nil),
 		(*MessageWrapper_HttpTunnelControl)(nil),
+		(*MessageWrapper_EndpointHealthReport)(nil),
+		(*MessageWrapper_Reconnect)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -1318,7 +1872,7 @@ func file_internal_tunnel_tunnel_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_internal_tunnel_tunnel_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   13,
+			NumMessages:   18,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Connection upgrades (WebSocket, SPDY as used by "kubectl exec") switch
+// the request from the usual request, response, then body model to a
+// bidirectional stream.  Data from the upstream flows back as the usual
+// HttpTunnelChunkedResponse messages, and data from the client flows
+// to the agent as HttpTunnelChunkedRequest messages, which are buffered and
+// written to the upgraded connection registered here.
+
+var upgradeRegistry = struct {
+	sync.Mutex
+	m map[string]io.WriteCloser
+}{m: make(map[string]io.WriteCloser)}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// IsUpgradeRequest returns true if the headers ask for a connection upgrade.
+func IsUpgradeRequest(headers http.Header) bool {
+	if headers.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range headers.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RegisterUpgradeWriter will associate the writable side of an upgraded
+// connection with the request id.
+func RegisterUpgradeWriter(id string, w io.WriteCloser) {
+	upgradeRegistry.Lock()
+	defer upgradeRegistry.Unlock()
+	upgradeRegistry.m[id] = w
+}
+
+// UnregisterUpgradeWriter will remove a remembered upgraded connection.
+func UnregisterUpgradeWriter(id string) {
+	upgradeRegistry.Lock()
+	defer upgradeRegistry.Unlock()
+	delete(upgradeRegistry.m, id)
+}
+
+// WriteUpgradeData writes client data to the upgraded connection for the id.
+// A zero length write indicates the client has closed its side, and the
+// connection's write side is closed.
+func WriteUpgradeData(id string, data []byte) error {
+	upgradeRegistry.Lock()
+	w, ok := upgradeRegistry.m[id]
+	upgradeRegistry.Unlock()
+	if !ok {
+		return fmt.Errorf("no upgraded connection for request id %s", id)
+	}
+	if len(data) == 0 {
+		if cw, ok := w.(closeWriter); ok {
+			return cw.CloseWrite()
+		}
+		return w.Close()
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// RegisterUpgradeConnection registers w to receive the client's data for an
+// upgraded connection.  The data is buffered, written to w as it can take
+// it, and acknowledged on dataflow as it is passed on, so the sender keeps no
+// more than DefaultWindowSize bytes in flight and a slow connection does
+// not hold up the tunnel.  A zero length message from the client closes
+// the write side of w.  The returned function unregisters it, discarding
+// any data not yet written, and once it returns nothing more is sent on
+// dataflow.
+func RegisterUpgradeConnection(id string, w io.WriteCloser, dataflow chan *MessageWrapper) func() {
+	body := newStreamedBody(id)
+	body.dataflow = dataflow
+	RegisterUpgradeWriter(id, body)
+	go func() {
+		if _, err := io.Copy(w, body); err != nil {
+			return
+		}
+		if cw, ok := w.(closeWriter); ok {
+			_ = cw.CloseWrite()
+			return
+		}
+		_ = w.Close()
+	}()
+	return func() {
+		UnregisterUpgradeWriter(id)
+		body.Close()
+	}
+}
+
+// MakeHTTPTunnelChunkedRequest will make a wrapped request to send client data
+// on an upgraded connection.
+func MakeHTTPTunnelChunkedRequest(id string, data []byte) *MessageWrapper_HttpTunnelControl {
+	return &MessageWrapper_HttpTunnelControl{
+		HttpTunnelControl: &HttpTunnelControl{
+			ControlType: &HttpTunnelControl_HttpTunnelChunkedRequest{
+				HttpTunnelChunkedRequest: &HttpTunnelChunkedRequest{
+					Id:   id,
+					Body: data,
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func TestIsUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    bool
+	}{
+		{"no headers", http.Header{}, false},
+		{"upgrade only", http.Header{"Upgrade": {"websocket"}}, false},
+		{"connection only", http.Header{"Connection": {"Upgrade"}}, false},
+		{"websocket", http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}}, true},
+		{"token list", http.Header{"Upgrade": {"SPDY/3.1"}, "Connection": {"keep-alive, upgrade"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsUpgradeRequest(tt.headers))
+		})
+	}
+}
+
+// maskedTextFrame builds a single client-to-server WebSocket text frame.
+func maskedTextFrame(payload string) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x81, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+func nextMessage(t *testing.T, dataflow chan *MessageWrapper) *HttpTunnelControl {
+	select {
+	case msg := <-dataflow:
+		return msg.GetHttpTunnelControl()
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for tunnel message")
+	}
+	return nil
+}
+
+func TestRunHTTPRequest_WebSocketEcho(t *testing.T) {
+	upstream := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		_, _ = io.Copy(ws, ws)
+	}))
+	defer upstream.Close()
+
+	req := &OpenHTTPTunnelRequest{Id: "ws1", Method: http.MethodGet, URI: "/"}
+	httpRequest, err := http.NewRequest(req.Method, upstream.URL+req.URI, nil)
+	require.NoError(t, err)
+	httpRequest.Header.Set("Upgrade", "websocket")
+	httpRequest.Header.Set("Connection", "Upgrade")
+	httpRequest.Header.Set("Origin", upstream.URL)
+	httpRequest.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	httpRequest.Header.Set("Sec-WebSocket-Version", "13")
+
+	dataflow := make(chan *MessageWrapper, 10)
+	go RunHTTPRequest(upstream.Client(), req, httpRequest, dataflow, upstream.URL, ResponseOptions{})
+
+	resp := nextMessage(t, dataflow).GetHttpTunnelResponse()
+	require.NotNil(t, resp)
+	assert.Equal(t, int32(http.StatusSwitchingProtocols), resp.Status)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+
+	require.NoError(t, WriteUpgradeData("ws1", maskedTextFrame("hello")))
+	var echoed []byte
+	for len(echoed) < 7 {
+		chunk := nextMessage(t, dataflow).GetHttpTunnelChunkedResponse()
+		require.NotNil(t, chunk)
+		require.NotEmpty(t, chunk.Body, "unexpected EOF")
+		echoed = append(echoed, chunk.Body...)
+	}
+	assert.Equal(t, append([]byte{0x81, 0x05}, "hello"...), echoed)
+
+	// Closing the client side ends the stream with a zero length chunk.
+	require.NoError(t, WriteUpgradeData("ws1", []byte{}))
+	for {
+		chunk := nextMessage(t, dataflow).GetHttpTunnelChunkedResponse()
+		require.NotNil(t, chunk)
+		if len(chunk.Body) == 0 {
+			break
+		}
+	}
+}
+
+func TestWriteUpgradeData_UnknownID(t *testing.T) {
+	require.Error(t, WriteUpgradeData("no-such-id", []byte("data")))
+}
+
+// gatedConn is an upgraded connection whose writes wait for the gate.
+type gatedConn struct {
+	sync.Mutex
+	gate        chan struct{}
+	written     bytes.Buffer
+	writeClosed bool
+}
+
+func (c *gatedConn) Write(p []byte) (int, error) {
+	<-c.gate
+	c.Lock()
+	defer c.Unlock()
+	return c.written.Write(p)
+}
+
+func (c *gatedConn) CloseWrite() error {
+	c.Lock()
+	defer c.Unlock()
+	c.writeClosed = true
+	return nil
+}
+
+func (c *gatedConn) Close() error {
+	return nil
+}
+
+func (c *gatedConn) state() (int, bool) {
+	c.Lock()
+	defer c.Unlock()
+	return c.written.Len(), c.writeClosed
+}
+
+func TestRegisterUpgradeConnection(t *testing.T) {
+	conn := &gatedConn{gate: make(chan struct{})}
+	dataflow := make(chan *MessageWrapper, 10)
+	unregister := RegisterUpgradeConnection("up1", conn, dataflow)
+
+	// A connection which is slow to take the data does not hold up the
+	// tunnel, and nothing is acknowledged until it is written.
+	size := DefaultWindowSize / 2
+	require.NoError(t, WriteUpgradeData("up1", make([]byte, size)))
+	require.NoError(t, WriteUpgradeData("up1", []byte{}))
+	assert.Empty(t, dataflow)
+
+	close(conn.gate)
+	update := nextMessage(t, dataflow).GetHttpTunnelWindowUpdate()
+	require.NotNil(t, update)
+	assert.Equal(t, "up1", update.Id)
+	assert.Equal(t, int64(size), update.Bytes)
+	require.Eventually(t, func() bool {
+		written, closed := conn.state()
+		return written == size && closed
+	}, 5*time.Second, time.Millisecond)
+
+	unregister()
+	assert.Error(t, WriteUpgradeData("up1", []byte("late")))
+}
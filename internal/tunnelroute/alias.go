@@ -0,0 +1,111 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import "fmt"
+
+// EndpointAlias lets requests use another name for an endpoint an agent
+// advertises.  If Agent is set, the alias applies only to that agent's
+// endpoint.
+type EndpointAlias struct {
+	Agent string `yaml:"agent,omitempty" json:"agent,omitempty"`
+	Type  string `yaml:"type" json:"type"`
+	Alias string `yaml:"alias" json:"alias"`
+	Name  string `yaml:"name" json:"name"`
+}
+
+// EndpointAliases are the aliases the controller resolves before routing
+// a request.  Aliases are never advertised, so they do not appear in
+// statistics.
+type EndpointAliases []EndpointAlias
+
+// Validate returns the problems with the aliases.  An alias may not be
+// defined twice, nor name another alias, so one lookup resolves it.
+func (a EndpointAliases) Validate() []error {
+	problems := []error{}
+	seen := map[EndpointAlias]bool{}
+	for i, alias := range a {
+		if alias.Type == "" || alias.Alias == "" || alias.Name == "" {
+			problems = append(problems, fmt.Errorf("[%d]: type, alias, and name are required", i))
+			continue
+		}
+		if alias.Alias == alias.Name {
+			problems = append(problems, fmt.Errorf("[%d]: alias %s/%s names itself", i, alias.Type, alias.Alias))
+			continue
+		}
+		key := EndpointAlias{Agent: alias.Agent, Type: alias.Type, Alias: alias.Alias}
+		if seen[key] {
+			problems = append(problems, fmt.Errorf("[%d]: alias %s/%s is defined more than once", i, alias.Type, alias.Alias))
+		}
+		seen[key] = true
+	}
+	for i, alias := range a {
+		if alias.Name == "" || alias.Name == alias.Alias {
+			continue
+		}
+		for _, other := range a {
+			// An alias for every agent names another alias if any agent
+			// has one by that name.
+			if other.Type == alias.Type && other.Alias == alias.Name && (alias.Agent == "" || other.Agent == "" || other.Agent == alias.Agent) {
+				problems = append(problems, fmt.Errorf("[%d]: alias %s/%s names another alias", i, alias.Type, alias.Alias))
+				break
+			}
+		}
+	}
+	return problems
+}
+
+// resolve returns the search with its endpoint name replaced by the name
+// it is an alias of, preferring an alias for the search's agent to one
+// for every agent.
+func (a EndpointAliases) resolve(ep Search) Search {
+	var match *EndpointAlias
+	for i := range a {
+		alias := &a[i]
+		if alias.Type != ep.EndpointType || alias.Alias != ep.EndpointName {
+			continue
+		}
+		if alias.Agent == ep.Name {
+			match = alias
+			break
+		}
+		if alias.Agent == "" && match == nil {
+			match = alias
+		}
+	}
+	if match != nil {
+		ep.EndpointName = match.Name
+	}
+	return ep
+}
+
+// SetEndpointAliases replaces the endpoint aliases.
+func (s *ConnectedRoutes) SetEndpointAliases(aliases EndpointAliases) {
+	s.Lock()
+	defer s.Unlock()
+	s.aliases = aliases
+}
+
+// ResolveEndpointAlias returns the search with an aliased endpoint name
+// replaced by the endpoint's real name, for labelling metrics and logs.
+// Send resolves the name itself, so it should be given the search as the
+// client made it.
+func (s *ConnectedRoutes) ResolveEndpointAlias(ep Search) Search {
+	s.RLock()
+	defer s.RUnlock()
+	return s.aliases.resolve(ep)
+}
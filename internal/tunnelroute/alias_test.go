@@ -0,0 +1,125 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import (
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestEndpointAliases_routing(c *C) {
+	agent := &FakeAgent{
+		name:      "agent1",
+		session:   "agent1.session1",
+		endpoints: []Endpoint{{Name: "ep1", Type: "type1", Configured: true}},
+	}
+	other := &FakeAgent{
+		name:      "agent2",
+		session:   "agent2.session1",
+		endpoints: []Endpoint{{Name: "ep2", Type: "type1", Configured: true}},
+	}
+	routes := MakeRoutes()
+	routes.SetEndpointAliases(EndpointAliases{
+		{Type: "type1", Alias: "legacy", Name: "ep1"},
+		{Agent: "agent2", Type: "type1", Alias: "legacy", Name: "ep2"},
+	})
+	routes.Add(agent)
+	routes.Add(other)
+
+	session, err := routes.Send(Search{Name: "agent1", EndpointType: "type1", EndpointName: "legacy"}, 1)
+	c.Assert(err, IsNil)
+	c.Check(session, Equals, "agent1.session1")
+	c.Check(agent.lastMessage, Equals, 1)
+
+	// An alias for one agent is preferred to one for every agent.
+	session, err = routes.Send(Search{Name: "agent2", EndpointType: "type1", EndpointName: "legacy"}, 2)
+	c.Assert(err, IsNil)
+	c.Check(session, Equals, "agent2.session1")
+
+	resolved := func(ep Search) string {
+		_, found, _ := routes.findService(ep)
+		return found.EndpointName
+	}
+	c.Check(resolved(Search{Name: "agent1", EndpointType: "type1", EndpointName: "legacy"}), Equals, "ep1")
+	c.Check(resolved(Search{Name: "agent2", EndpointType: "type1", EndpointName: "legacy"}), Equals, "ep2")
+	c.Check(resolved(Search{Name: "agent1", EndpointType: "type2", EndpointName: "legacy"}), Equals, "legacy")
+	c.Check(resolved(Search{Name: "agent1", EndpointType: "type1", EndpointName: "ep1"}), Equals, "ep1")
+
+	// A HTTP request is sent with the endpoint's real name.
+	message := &HTTPMessage{Cmd: &tunnel.OpenHTTPTunnelRequest{Type: "type1", Name: "legacy"}}
+	_, err = routes.Send(Search{Name: "agent2", EndpointType: "type1", EndpointName: "legacy"}, message)
+	c.Assert(err, IsNil)
+	c.Check(message.Cmd.Name, Equals, "ep2")
+
+	// Aliases are not advertised as endpoints.
+	for _, summary := range routes.GetEndpointSummaries() {
+		c.Check(summary.Name, Not(Equals), "legacy")
+	}
+}
+
+func (s *MySuite) TestEndpointAliases_resolvedOnce(c *C) {
+	agent := &FakeAgent{
+		name:    "agent1",
+		session: "agent1.session1",
+		endpoints: []Endpoint{
+			{Name: "b", Type: "type1", Configured: true},
+			{Name: "c", Type: "type1", Configured: true},
+		},
+	}
+	routes := MakeRoutes()
+	// Validate refuses this chain, but a request for a must still only
+	// follow one alias.
+	routes.SetEndpointAliases(EndpointAliases{
+		{Type: "type1", Alias: "a", Name: "b"},
+		{Agent: "agent1", Type: "type1", Alias: "b", Name: "c"},
+	})
+	routes.Add(agent)
+
+	message := &HTTPMessage{Cmd: &tunnel.OpenHTTPTunnelRequest{Type: "type1", Name: "a"}}
+	_, err := routes.Send(Search{Name: "agent1", EndpointType: "type1", EndpointName: "a"}, message)
+	c.Assert(err, IsNil)
+	c.Check(message.Cmd.Name, Equals, "b")
+
+	// Sending again, as after waiting for an agent, resolves from the
+	// search, not the name already sent.
+	_, err = routes.Send(Search{Name: "agent1", EndpointType: "type1", EndpointName: "a"}, message)
+	c.Assert(err, IsNil)
+	c.Check(message.Cmd.Name, Equals, "b")
+}
+
+func (s *MySuite) TestEndpointAliases_Validate(c *C) {
+	c.Check(EndpointAliases{
+		{Type: "type1", Alias: "legacy", Name: "ep1"},
+		{Agent: "agent2", Type: "type1", Alias: "legacy", Name: "ep2"},
+	}.Validate(), HasLen, 0)
+
+	problems := EndpointAliases{
+		{Type: "type1", Alias: "legacy"},
+		{Type: "type1", Alias: "self", Name: "self"},
+		{Type: "type1", Alias: "a", Name: "ep1"},
+		{Type: "type1", Alias: "a", Name: "ep2"},
+		{Type: "type1", Alias: "b", Name: "a"},
+		{Type: "type1", Alias: "c", Name: "d"},
+		{Agent: "agent1", Type: "type1", Alias: "d", Name: "ep1"},
+	}.Validate()
+	c.Assert(problems, HasLen, 5)
+	c.Check(problems[0], ErrorMatches, `\[0\]: type, alias, and name are required`)
+	c.Check(problems[1], ErrorMatches, `\[1\]: alias type1/self names itself`)
+	c.Check(problems[2], ErrorMatches, `\[3\]: alias type1/a is defined more than once`)
+	c.Check(problems[3], ErrorMatches, `\[4\]: alias type1/b names another alias`)
+	c.Check(problems[4], ErrorMatches, `\[5\]: alias type1/c names another alias`)
+}
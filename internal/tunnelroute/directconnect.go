@@ -18,10 +18,17 @@ package tunnelroute
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	"github.com/opsmx/oes-birger/internal/tunnel"
 )
 
+// InFlightCounter reports the requests in progress on a route.
+type InFlightCounter interface {
+	Len() int
+	IDs() []string
+}
+
 // DirectlyConnectedRoute holds all the magic needed to implement a directly connected route,
 // such as an agent.
 type DirectlyConnectedRoute struct {
@@ -36,6 +43,11 @@ type DirectlyConnectedRoute struct {
 	ConnectedAt     uint64
 	LastPing        uint64
 	LastUse         uint64
+	InFlight        InFlightCounter
+
+	closed uint32
+	health endpointHealth
+	load   endpointLoad
 }
 
 // GetSession returns the randomly assigned session ID.  This is assigned each time
@@ -50,40 +62,133 @@ func (s *DirectlyConnectedRoute) GetName() string {
 	return s.Name
 }
 
+// GetHostname returns the hostname the agent reported when it connected.
+func (s *DirectlyConnectedRoute) GetHostname() string {
+	return s.Hostname
+}
+
+// GetConnectionType returns "direct", as this route is connected to us.
+func (s *DirectlyConnectedRoute) GetConnectionType() string {
+	return "direct"
+}
+
 // GetEndpoints returns the list of endpoints.
 func (s *DirectlyConnectedRoute) GetEndpoints() []Endpoint {
 	return s.Endpoints
 }
 
-func (s DirectlyConnectedRoute) String() string {
+func (s *DirectlyConnectedRoute) String() string {
 	return fmt.Sprintf("(name=%s, session=%s)", s.Name, s.Session)
 }
 
-// Close will shut down an agent's requests channels.
+// Close will shut down an agent's requests channels.  It is safe to call
+// more than once, as a route may be removed for being idle and then again
+// when its connection ends.
 func (s *DirectlyConnectedRoute) Close() {
+	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		return
+	}
 	close(s.InRequest)
 	close(s.InCancelRequest)
 }
 
+// IsClosed returns true once Close has been called.
+func (s *DirectlyConnectedRoute) IsClosed() bool {
+	return atomic.LoadUint32(&s.closed) != 0
+}
+
 // Send sends a message to a specific Route
 func (s *DirectlyConnectedRoute) Send(message interface{}) string {
+	if _, ok := message.(*HTTPMessage); ok {
+		atomic.StoreUint64(&s.LastUse, tunnel.Now())
+	}
 	s.InRequest <- message
 	return s.Session
 }
 
+// GetLastActivity returns when the last request was sent to the route, or
+// when it connected if none have been.  A route with requests in progress
+// is active now.
+func (s *DirectlyConnectedRoute) GetLastActivity() uint64 {
+	if s.InFlight != nil && s.InFlight.Len() > 0 {
+		return tunnel.Now()
+	}
+	if lastUse := atomic.LoadUint64(&s.LastUse); lastUse > s.ConnectedAt {
+		return lastUse
+	}
+	return s.ConnectedAt
+}
+
 // Cancel cancels a specific stream
 func (s *DirectlyConnectedRoute) Cancel(id string) {
 	s.InCancelRequest <- id
 }
 
-// HasEndpoint returns true if the endpoint is presend and configured.
+// CancelAll cancels every request in progress on the route, returning how
+// many were cancelled.
+func (s *DirectlyConnectedRoute) CancelAll() int {
+	if s.InFlight == nil {
+		return 0
+	}
+	ids := s.InFlight.IDs()
+	for _, id := range ids {
+		s.Cancel(id)
+	}
+	return len(ids)
+}
+
+// HasEndpoint returns true if the endpoint is presend, configured, and
+// of a supported type.  An endpoint with exactly the name is used over one
+// whose name is a matching pattern.
 func (s *DirectlyConnectedRoute) HasEndpoint(endpointType string, endpointName string) bool {
-	for _, ep := range s.Endpoints {
-		if ep.Type == endpointType && ep.Name == endpointName {
-			return ep.Configured
-		}
+	ep := FindEndpoint(s.Endpoints, endpointType, endpointName)
+	return ep != nil && ep.Configured && !ep.Unsupported
+}
+
+// SetEndpointHealth records the agent's report of an endpoint's health,
+// using the type and name the endpoint was advertised with.  It returns
+// true if the endpoint changed between healthy and unhealthy.
+func (s *DirectlyConnectedRoute) SetEndpointHealth(endpointType string, endpointName string, healthy bool, reason string) bool {
+	return s.health.set(endpointKey{endpointType, endpointName}, healthy, reason)
+}
+
+// SetEndpointCircuitBreaker records the agent's report of the state of an
+// endpoint's circuit breaker, shown in the route's statistics.
+func (s *DirectlyConnectedRoute) SetEndpointCircuitBreaker(endpointType string, endpointName string, state string) {
+	s.health.setCircuitBreaker(endpointKey{endpointType, endpointName}, state)
+}
+
+// IsEndpointHealthy returns false if the agent last reported the endpoint
+// which would serve the request as unhealthy.
+func (s *DirectlyConnectedRoute) IsEndpointHealthy(endpointType string, endpointName string) bool {
+	ep := FindEndpoint(s.Endpoints, endpointType, endpointName)
+	if ep == nil {
+		return true
 	}
-	return false
+	healthy, _ := s.health.get(endpointKey{ep.Type, ep.Name})
+	return healthy
+}
+
+// endpointBusy returns true if the endpoint which would serve the request
+// has as many requests in progress as its MaxConcurrency allows.
+func (s *DirectlyConnectedRoute) endpointBusy(endpointType string, endpointName string) bool {
+	ep := FindEndpoint(s.Endpoints, endpointType, endpointName)
+	return ep != nil && s.load.busy(endpointKey{ep.Type, ep.Name}, ep.MaxConcurrency)
+}
+
+// acquireEndpoint counts a new request to the endpoint which would serve
+// it, returning false if the endpoint is busy.  Otherwise the returned
+// function must be called when the request is finished.
+func (s *DirectlyConnectedRoute) acquireEndpoint(endpointType string, endpointName string) (func(), bool) {
+	ep := FindEndpoint(s.Endpoints, endpointType, endpointName)
+	if ep == nil {
+		return func() {}, true
+	}
+	key := endpointKey{ep.Type, ep.Name}
+	if !s.load.acquire(key, ep.MaxConcurrency) {
+		return nil, false
+	}
+	return func() { s.load.release(key) }, true
 }
 
 // DirectlyConnectedRouteStatistics describes statistics for a directly connected route.
@@ -93,6 +198,7 @@ type DirectlyConnectedRouteStatistics struct {
 	LastPing    uint64           `json:"lastPing,omitempty"`
 	LastUse     uint64           `json:"lastUse,omitempty"`
 	AgentInfo   tunnel.AgentInfo `json:"agentInfo,omitempty"`
+	InFlight    int              `json:"inFlight,omitempty"`
 }
 
 // GetStatistics returns a set of stats for connected routes.
@@ -100,14 +206,24 @@ func (s *DirectlyConnectedRoute) GetStatistics() interface{} {
 	ret := &DirectlyConnectedRouteStatistics{
 		ConnectedAt: s.ConnectedAt,
 		LastPing:    s.LastPing,
-		LastUse:     s.LastUse,
+		LastUse:     atomic.LoadUint64(&s.LastUse),
 		AgentInfo:   s.AgentInfo,
 	}
 	ret.Name = s.Name
 	ret.Session = s.Session
-	ret.ConnectionType = "direct"
-	ret.Endpoints = s.Endpoints
+	ret.ConnectionType = s.GetConnectionType()
+	ret.Endpoints = make([]Endpoint, len(s.Endpoints))
+	for i, ep := range s.Endpoints {
+		healthy, reason := s.health.get(endpointKey{ep.Type, ep.Name})
+		ep.Unhealthy = !healthy
+		ep.UnhealthyReason = reason
+		ep.CircuitBreaker = s.health.circuitBreaker(endpointKey{ep.Type, ep.Name})
+		ret.Endpoints[i] = ep
+	}
 	ret.Version = s.Version
 	ret.Hostname = s.Hostname
+	if s.InFlight != nil {
+		ret.InFlight = s.InFlight.Len()
+	}
 	return ret
 }
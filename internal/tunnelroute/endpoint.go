@@ -16,13 +16,31 @@
 
 package tunnelroute
 
-import "fmt"
+import (
+	"fmt"
+	"path"
+	"strings"
+)
 
 // Endpoint defines the configuration and description provided by the
 // route.  This describes a service endpoint of a specific type.
 // The tuple (Type, Name) must be unique per route connection,
 // although multiple routes (even with the same route name) may
 // provide the same endpoint.
+//
+// MaxConcurrency and Weight are the agent's overrides, merged with the
+// controller's defaults by EndpointOverrideLimits.Apply.
+//
+// Unsupported is set by EndpointTypes.MarkUnsupported when the controller
+// does not know the type, and such endpoints are never routed to.
+//
+// Name may be a glob pattern, such as "jenkins-*", which serves any
+// requested name it matches.
+//
+// Unhealthy and UnhealthyReason are set in statistics when the agent last
+// reported the endpoint as failing its health check, and CircuitBreaker is
+// the state of its circuit breaker, closed, open, or half-open, as last
+// reported.
 type Endpoint struct {
 	Name        string            `json:"name,omitempty"`
 	Type        string            `json:"type,omitempty"`
@@ -31,8 +49,67 @@ type Endpoint struct {
 	Namespaces  []string          `json:"namespaces,omitempty"` // kubernetes
 	AccountID   string            `json:"accountId,omitempty"`  // AWS
 	AssumeRole  string            `json:"assumeRole,omitempty"` // AWS
+
+	MaxConcurrency int `json:"maxConcurrency,omitempty"`
+	Weight         int `json:"weight,omitempty"`
+
+	Unsupported bool `json:"unsupported,omitempty"`
+
+	Unhealthy       bool   `json:"unhealthy,omitempty"`
+	UnhealthyReason string `json:"unhealthyReason,omitempty"`
+
+	CircuitBreaker string `json:"circuitBreaker,omitempty"`
 }
 
 func (e *Endpoint) String() string {
+	if e.Unsupported {
+		return fmt.Sprintf("(type=%s, name=%s, configured=%v, unsupported)", e.Type, e.Name, e.Configured)
+	}
 	return fmt.Sprintf("(type=%s, name=%s, configured=%v)", e.Type, e.Name, e.Configured)
 }
+
+// IsEndpointPattern returns true if an endpoint name is a glob pattern
+// rather than a single name.
+func IsEndpointPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// ValidateEndpointName returns an error if the name is a malformed pattern.
+func ValidateEndpointName(name string) error {
+	if _, err := path.Match(name, ""); err != nil {
+		return fmt.Errorf("invalid endpoint name pattern '%s'", name)
+	}
+	return nil
+}
+
+// EndpointNameMatches returns true if the requested name is the endpoint's
+// name, or matches it as a pattern.
+func EndpointNameMatches(endpointName string, name string) bool {
+	if endpointName == name {
+		return true
+	}
+	if !IsEndpointPattern(endpointName) {
+		return false
+	}
+	matched, err := path.Match(endpointName, name)
+	return err == nil && matched
+}
+
+// FindEndpoint returns the endpoint with the type and name, or if there is
+// none, the first whose name is a pattern matching it.
+func FindEndpoint(endpoints []Endpoint, endpointType string, endpointName string) *Endpoint {
+	var match *Endpoint
+	for i := range endpoints {
+		ep := &endpoints[i]
+		if ep.Type != endpointType {
+			continue
+		}
+		if ep.Name == endpointName {
+			return ep
+		}
+		if match == nil && EndpointNameMatches(ep.Name, endpointName) {
+			match = ep
+		}
+	}
+	return match
+}
@@ -16,7 +16,10 @@
 
 package tunnelroute
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestEndpoint_String(t *testing.T) {
 	type fields struct {
@@ -48,3 +51,78 @@ func TestEndpoint_String(t *testing.T) {
 		})
 	}
 }
+
+func TestEndpointNameMatches(t *testing.T) {
+	tests := []struct {
+		endpointName string
+		want         []string
+	}{
+		{"jenkins", []string{"jenkins"}},
+		{"jenkins-*", []string{"jenkins-", "jenkins-a", "jenkins-b2", "jenkins-prod"}},
+		{"jenkins-?", []string{"jenkins-a"}},
+		{"jenkins-[ab]*", []string{"jenkins-a", "jenkins-b2"}},
+		{"jenkins-[", []string{}},
+	}
+	names := []string{"jenkins", "jenkins-", "jenkins-a", "jenkins-b2", "jenkins-prod", "jenkinsx", "argo"}
+	for _, tt := range tests {
+		t.Run(tt.endpointName, func(t *testing.T) {
+			got := []string{}
+			for _, name := range names {
+				if EndpointNameMatches(tt.endpointName, name) {
+					got = append(got, name)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EndpointNameMatches(%s) matched %v, want %v", tt.endpointName, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindEndpoint(t *testing.T) {
+	endpoints := []Endpoint{
+		{Type: "jenkins", Name: "jenkins-*", Configured: true},
+		{Type: "argo", Name: "jenkins-prod", Configured: true},
+		{Type: "jenkins", Name: "jenkins-prod", Configured: false},
+		{Type: "jenkins", Name: "jenkins-p*", Configured: true},
+	}
+	tests := []struct {
+		endpointType string
+		endpointName string
+		want         *Endpoint
+	}{
+		{"jenkins", "jenkins-prod", &endpoints[2]},
+		{"jenkins", "jenkins-dev", &endpoints[0]},
+		{"jenkins", "jenkins-pre", &endpoints[0]},
+		{"argo", "jenkins-prod", &endpoints[1]},
+		{"argo", "jenkins-dev", nil},
+		{"jenkins", "argo", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpointType+"/"+tt.endpointName, func(t *testing.T) {
+			if got := FindEndpoint(endpoints, tt.endpointType, tt.endpointName); got != tt.want {
+				t.Errorf("FindEndpoint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The exact match is unconfigured, and is not replaced by the pattern.
+	route := &DirectlyConnectedRoute{Endpoints: endpoints}
+	if route.HasEndpoint("jenkins", "jenkins-prod") {
+		t.Errorf("HasEndpoint(jenkins-prod) = true, want false")
+	}
+	if !route.HasEndpoint("jenkins", "jenkins-dev") {
+		t.Errorf("HasEndpoint(jenkins-dev) = false, want true")
+	}
+}
+
+func TestValidateEndpointName(t *testing.T) {
+	for _, name := range []string{"jenkins", "jenkins-*", "jenkins-[a-z]"} {
+		if err := ValidateEndpointName(name); err != nil {
+			t.Errorf("ValidateEndpointName(%s) = %v", name, err)
+		}
+	}
+	if err := ValidateEndpointName("jenkins-[a-"); err == nil {
+		t.Errorf("ValidateEndpointName(jenkins-[a-) = nil, want error")
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import (
+	"fmt"
+	"strings"
+)
+
+// builtinEndpointTypes are the endpoint types the controller knows how to
+// route to, from the service registry in the README.  They are also the
+// values of the endpointType metrics label.
+var builtinEndpointTypes = map[string]bool{
+	"argocd":      true,
+	"aws":         true,
+	"clouddriver": true,
+	"connect":     true,
+	"fiat":        true,
+	"front50":     true,
+	"grpc":        true,
+	"jenkins":     true,
+	"kubernetes":  true,
+}
+
+// EndpointTypes lists endpoint types which are supported in addition to the
+// built in ones.  Custom types starting with "x-" are always supported.
+type EndpointTypes []string
+
+// Supports returns true if endpoints of this type may be routed to.
+func (t EndpointTypes) Supports(endpointType string) bool {
+	if builtinEndpointTypes[endpointType] || strings.HasPrefix(endpointType, "x-") {
+		return true
+	}
+	for _, extra := range t {
+		if extra == endpointType {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkUnsupported marks each endpoint with a type which is not supported,
+// so requests are not routed to it, and returns a problem for each.
+func (t EndpointTypes) MarkUnsupported(endpoints []Endpoint) []error {
+	problems := []error{}
+	for i := range endpoints {
+		ep := &endpoints[i]
+		if !t.Supports(ep.Type) {
+			ep.Unsupported = true
+			problems = append(problems, fmt.Errorf("endpoint %s/%s: unknown endpoint type", ep.Type, ep.Name))
+		}
+	}
+	return problems
+}
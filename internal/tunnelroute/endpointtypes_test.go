@@ -0,0 +1,78 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import (
+	"encoding/json"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestEndpointTypes_Supports(c *C) {
+	types := EndpointTypes{"whoami"}
+	c.Assert(types.Supports("jenkins"), Equals, true)
+	c.Assert(types.Supports("kubernetes"), Equals, true)
+	c.Assert(types.Supports("x-my-api"), Equals, true)
+	c.Assert(types.Supports("whoami"), Equals, true)
+	c.Assert(types.Supports("mystery"), Equals, false)
+	c.Assert(types.Supports(""), Equals, false)
+	c.Assert(EndpointTypes{}.Supports("whoami"), Equals, false)
+}
+
+func (s *MySuite) TestEndpointTypes_MarkUnsupported(c *C) {
+	route := &DirectlyConnectedRoute{
+		Name:            "agent1",
+		Session:         "agent1.session1",
+		InRequest:       make(chan interface{}),
+		InCancelRequest: make(chan string),
+		Endpoints: []Endpoint{
+			{Type: "jenkins", Name: "ci", Configured: true},
+			{Type: "mystery", Name: "box", Configured: true},
+			{Type: "x-custom", Name: "api", Configured: true},
+			{Type: "kubernetes", Name: "prod", Configured: false},
+		},
+	}
+
+	problems := EndpointTypes{}.MarkUnsupported(route.Endpoints)
+	c.Assert(problems, HasLen, 1)
+	c.Assert(problems[0], ErrorMatches, "endpoint mystery/box: unknown endpoint type")
+
+	c.Assert(route.HasEndpoint("jenkins", "ci"), Equals, true)
+	c.Assert(route.HasEndpoint("mystery", "box"), Equals, false)
+	c.Assert(route.HasEndpoint("x-custom", "api"), Equals, true)
+	c.Assert(route.HasEndpoint("kubernetes", "prod"), Equals, false)
+
+	// Unsupported endpoints are still reported, but marked as such.
+	stats, err := json.Marshal(route.GetStatistics())
+	c.Assert(err, IsNil)
+	var decoded BaseStatistics
+	c.Assert(json.Unmarshal(stats, &decoded), IsNil)
+	c.Assert(decoded.Endpoints, HasLen, 4)
+	c.Assert(decoded.Endpoints[0].Unsupported, Equals, false)
+	c.Assert(decoded.Endpoints[1].Unsupported, Equals, true)
+	c.Assert(decoded.Endpoints[2].Unsupported, Equals, false)
+
+	routes := MakeRoutes()
+	routes.Add(route)
+	defer routes.Remove(route, DisconnectClean)
+	summaries := routes.GetEndpointSummaries()
+	c.Assert(summaries, HasLen, 2)
+	c.Assert(summaries[0].Type, Equals, "jenkins")
+	c.Assert(summaries[1].Type, Equals, "x-custom")
+	_, err = routes.Send(Search{Name: "agent1", EndpointType: "mystery", EndpointName: "box"}, nil)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HandoffState is how far a controller has got in handing its agents to a
+// peer controller.
+type HandoffState string
+
+const (
+	// HandoffActive means requests are served as usual.
+	HandoffActive HandoffState = "active"
+	// HandoffDraining means new requests are redirected to the peer, while
+	// those in progress are finished.
+	HandoffDraining HandoffState = "draining"
+	// HandoffReconnecting means agents are being asked to reconnect to the
+	// peer.
+	HandoffReconnecting HandoffState = "reconnecting"
+	// HandoffDrained means every agent has been asked to reconnect to the
+	// peer.  New requests are still redirected.
+	HandoffDrained HandoffState = "drained"
+)
+
+// HandoffReconnectGrace is how long, after the drain timeout, a peer waits
+// for the agents handed to it to connect.
+const HandoffReconnectGrace = 30 * time.Second
+
+// Peer is the controller a draining controller hands its agents to.
+type Peer struct {
+	// ServiceHostname is where new service requests are redirected, on
+	// the port they were made to.
+	ServiceHostname string
+	// AgentHostname is the host:port agents reconnect to.
+	AgentHostname string
+	// ControlURL is the peer's control API, which the routes are
+	// advertised to.
+	ControlURL string
+}
+
+// ReconnectMessage is sent to a route to ask its agent to reconnect to
+// another controller.
+type ReconnectMessage struct {
+	ControllerHostname string
+}
+
+// RouteAdvertiser tells a peer which agents are about to be handed to it,
+// so it can hold requests for them until they connect, up to until.
+type RouteAdvertiser interface {
+	AdvertiseRoutes(peer Peer, agents []string, until time.Time) error
+}
+
+// Handoff hands the agents of a controller to a peer controller, so it can
+// be taken down without requests failing.  Once started, new requests are
+// redirected to the peer, the agents are advertised to it, and when the
+// requests in progress have finished (or the timeout passes) each agent is
+// asked to reconnect to the peer.
+//
+// The peer side of a handoff uses Expect and WaitForRoute to hold requests
+// for the agents being handed to it until they connect.
+type Handoff struct {
+	sync.Mutex
+	routes   *ConnectedRoutes
+	state    HandoffState
+	peer     Peer
+	inFlight int
+	idle     chan struct{}
+	done     chan struct{}
+	expected map[string]time.Time
+}
+
+func makeHandoff(routes *ConnectedRoutes) *Handoff {
+	return &Handoff{
+		routes:   routes,
+		state:    HandoffActive,
+		done:     make(chan struct{}),
+		expected: map[string]time.Time{},
+	}
+}
+
+// State returns how far the handoff has got, and the peer once started.
+func (h *Handoff) State() (HandoffState, Peer) {
+	h.Lock()
+	defer h.Unlock()
+	return h.state, h.peer
+}
+
+// Done is closed once the handoff has finished.
+func (h *Handoff) Done() <-chan struct{} {
+	return h.done
+}
+
+// Accept is called as each request arrives.  While the controller is
+// active, the request is counted as in progress until done is called, and
+// redirect is nil.  Otherwise the request should be redirected to the
+// peer, and done does nothing.
+func (h *Handoff) Accept() (redirect *Peer, done func()) {
+	h.Lock()
+	defer h.Unlock()
+	if h.state != HandoffActive {
+		peer := h.peer
+		return &peer, func() {}
+	}
+	h.inFlight++
+	var once sync.Once
+	return nil, func() {
+		once.Do(h.finished)
+	}
+}
+
+func (h *Handoff) finished() {
+	h.Lock()
+	defer h.Unlock()
+	h.inFlight--
+	if h.inFlight == 0 && h.idle != nil {
+		close(h.idle)
+		h.idle = nil
+	}
+}
+
+// Start begins handing off to the peer.  New requests are redirected from
+// when it returns, and the rest of the handoff continues in the
+// background.  Requests still in progress after timeout are cancelled.
+// The advertiser may be nil.
+func (h *Handoff) Start(peer Peer, timeout time.Duration, advertiser RouteAdvertiser) error {
+	h.Lock()
+	defer h.Unlock()
+	if h.state != HandoffActive {
+		return fmt.Errorf("handoff is already %s", h.state)
+	}
+	h.state = HandoffDraining
+	h.peer = peer
+	idle := make(chan struct{})
+	if h.inFlight == 0 {
+		close(idle)
+	} else {
+		h.idle = idle
+	}
+	go h.run(peer, timeout, advertiser, idle)
+	return nil
+}
+
+func (h *Handoff) run(peer Peer, timeout time.Duration, advertiser RouteAdvertiser, idle chan struct{}) {
+	defer close(h.done)
+	zap.S().Infow("handoff-draining", "peer", peer.AgentHostname, "timeout", timeout)
+
+	if advertiser != nil {
+		agents := h.routes.agentNames()
+		until := time.Now().Add(timeout + HandoffReconnectGrace)
+		if err := advertiser.AdvertiseRoutes(peer, agents, until); err != nil {
+			zap.S().Warnw("unable to advertise routes to peer", "peer", peer.ControlURL, "error", err)
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+	case <-timer.C:
+		h.Lock()
+		inFlight := h.inFlight
+		h.Unlock()
+		cancelled := 0
+		for _, name := range h.routes.agentNames() {
+			cancelled += h.routes.CancelAll(name)
+		}
+		zap.S().Warnw("requests still in progress at the handoff timeout", "inFlight", inFlight, "cancelled", cancelled)
+	}
+
+	// Each agent finishes answering the requests on its tunnel, cancelled
+	// or not, before it closes the tunnel.
+	h.setState(HandoffReconnecting)
+	count := h.routes.sendToAll(&ReconnectMessage{ControllerHostname: peer.AgentHostname})
+	zap.S().Infow("handoff-reconnect", "peer", peer.AgentHostname, "routes", count)
+	h.setState(HandoffDrained)
+}
+
+func (h *Handoff) setState(state HandoffState) {
+	h.Lock()
+	defer h.Unlock()
+	h.state = state
+}
+
+// Expect records that the agents are being handed to this controller by a
+// draining peer, so requests for them wait for them to connect, up to
+// until.
+func (h *Handoff) Expect(agents []string, until time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	now := time.Now()
+	for name, expiry := range h.expected {
+		if expiry.Before(now) {
+			delete(h.expected, name)
+		}
+	}
+	for _, name := range agents {
+		h.expected[name] = until
+	}
+}
+
+// WaitForRoute waits for a route matching the search to connect, if its
+// agent is expected, and returns true if one has.  It returns false at
+// once for agents which are not expected.
+func (h *Handoff) WaitForRoute(ctx context.Context, ep Search) bool {
+	h.Lock()
+	until, expected := h.expected[ep.Name]
+	h.Unlock()
+	if !expected {
+		return false
+	}
+	return h.routes.WaitForRoute(ctx, ep, until)
+}
+
+// agentNames returns the names of the connected agents, sorted.
+func (s *ConnectedRoutes) agentNames() []string {
+	s.RLock()
+	defer s.RUnlock()
+	names := []string{}
+	for name, routeList := range s.m {
+		if len(routeList) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sendToAll sends the message to every route, returning how many it was
+// sent to.
+func (s *ConnectedRoutes) sendToAll(message interface{}) int {
+	s.RLock()
+	defer s.RUnlock()
+	count := 0
+	for _, routeList := range s.m {
+		for _, route := range routeList {
+			route.Send(message)
+			count++
+		}
+	}
+	return count
+}
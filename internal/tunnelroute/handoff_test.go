@@ -0,0 +1,192 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeAdvertiser struct {
+	sync.Mutex
+	err    error
+	agents []string
+	until  time.Time
+	called chan struct{}
+}
+
+func (a *fakeAdvertiser) AdvertiseRoutes(peer Peer, agents []string, until time.Time) error {
+	a.Lock()
+	defer a.Unlock()
+	a.agents = agents
+	a.until = until
+	close(a.called)
+	return a.err
+}
+
+func makeHandoffRoute(name string) *DirectlyConnectedRoute {
+	return &DirectlyConnectedRoute{
+		Name:            name,
+		Session:         name + ".session1",
+		InRequest:       make(chan interface{}, 1),
+		InCancelRequest: make(chan string, 1),
+		Endpoints:       []Endpoint{{Type: "jenkins", Name: "ci", Configured: true}},
+	}
+}
+
+func assertHandoffState(t *testing.T, h *Handoff, want HandoffState) {
+	t.Helper()
+	if got, _ := h.State(); got != want {
+		t.Errorf("State() = %s, want %s", got, want)
+	}
+}
+
+func TestHandoff_inFlightRequest(t *testing.T) {
+	routes := MakeRoutes()
+	route := makeHandoffRoute("agent1")
+	routes.Add(route)
+	h := routes.Handoff()
+	peer := Peer{ServiceHostname: "peer.local", AgentHostname: "peer.local:9001", ControlURL: "https://peer.local:9003"}
+
+	redirect, done := h.Accept()
+	if redirect != nil {
+		t.Fatalf("Accept() redirected before the handoff started")
+	}
+	assertHandoffState(t, h, HandoffActive)
+
+	advertiser := &fakeAdvertiser{called: make(chan struct{})}
+	if err := h.Start(peer, time.Minute, advertiser); err != nil {
+		t.Fatal(err)
+	}
+	assertHandoffState(t, h, HandoffDraining)
+
+	redirect, newDone := h.Accept()
+	if redirect == nil || *redirect != peer {
+		t.Errorf("Accept() = %v, want redirect to %v", redirect, peer)
+	}
+	newDone()
+
+	<-advertiser.called
+	advertiser.Lock()
+	if !reflect.DeepEqual(advertiser.agents, []string{"agent1"}) {
+		t.Errorf("advertised %v, want [agent1]", advertiser.agents)
+	}
+	if advertiser.until.Before(time.Now().Add(time.Minute)) {
+		t.Errorf("advertised until %v, want after the timeout", advertiser.until)
+	}
+	advertiser.Unlock()
+
+	// The agent is not asked to reconnect while the request is in progress.
+	select {
+	case m := <-route.InRequest:
+		t.Fatalf("route was sent %#v while a request was in progress", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assertHandoffState(t, h, HandoffDraining)
+
+	done()
+	done() // only the first call counts
+
+	select {
+	case m := <-route.InRequest:
+		want := &ReconnectMessage{ControllerHostname: "peer.local:9001"}
+		if !reflect.DeepEqual(m, want) {
+			t.Errorf("route was sent %#v, want %#v", m, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("route was not asked to reconnect")
+	}
+	<-h.Done()
+	assertHandoffState(t, h, HandoffDrained)
+
+	if redirect, _ := h.Accept(); redirect == nil {
+		t.Errorf("Accept() after the handoff did not redirect")
+	}
+	if err := h.Start(peer, time.Minute, nil); err == nil {
+		t.Errorf("Start() again did not fail")
+	}
+}
+
+func TestHandoff_timeout(t *testing.T) {
+	routes := MakeRoutes()
+	route := makeHandoffRoute("agent1")
+	route.InFlight = fakeInFlightIDs{"stuck"}
+	routes.Add(route)
+	h := routes.Handoff()
+
+	_, done := h.Accept()
+	defer done()
+	advertiser := &fakeAdvertiser{err: fmt.Errorf("peer is down"), called: make(chan struct{})}
+	if err := h.Start(Peer{AgentHostname: "peer.local:9001"}, 50*time.Millisecond, advertiser); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failure to advertise, or a request which does not finish, does
+	// not stop the agents from being handed over.
+	select {
+	case <-h.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("handoff did not finish after the timeout")
+	}
+	if id := <-route.InCancelRequest; id != "stuck" {
+		t.Errorf("cancelled %q, want the request still in progress", id)
+	}
+	if _, ok := (<-route.InRequest).(*ReconnectMessage); !ok {
+		t.Errorf("route was not asked to reconnect")
+	}
+	assertHandoffState(t, h, HandoffDrained)
+}
+
+func TestHandoff_WaitForRoute(t *testing.T) {
+	routes := MakeRoutes()
+	h := routes.Handoff()
+	ep := Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "ci"}
+
+	if h.WaitForRoute(context.Background(), ep) {
+		t.Errorf("WaitForRoute() = true for an agent which is not expected")
+	}
+
+	h.Expect([]string{"agent1"}, time.Now().Add(5*time.Second))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		routes.Add(makeHandoffRoute("agent1"))
+	}()
+	if !h.WaitForRoute(context.Background(), ep) {
+		t.Errorf("WaitForRoute() = false, want true once the agent connects")
+	}
+
+	other := Search{Name: "agent2", EndpointType: "jenkins", EndpointName: "ci"}
+	h.Expect([]string{"agent2"}, time.Now().Add(50*time.Millisecond))
+	start := time.Now()
+	if h.WaitForRoute(context.Background(), other) {
+		t.Errorf("WaitForRoute() = true for an agent which did not connect")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("WaitForRoute() waited %v, past when the agent was expected", elapsed)
+	}
+
+	h.Expect([]string{"agent2"}, time.Now().Add(time.Minute))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if h.WaitForRoute(ctx, other) {
+		t.Errorf("WaitForRoute() = true after the context was cancelled")
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import "sync"
+
+// endpointHealth holds the endpoints an agent has reported unhealthy, by
+// type and advertised name, and the reason each failed its check.
+// Endpoints are healthy until reported otherwise.  It also holds the last
+// reported state of each endpoint's circuit breaker.
+type endpointHealth struct {
+	sync.RWMutex
+	unhealthy       map[endpointKey]string
+	circuitBreakers map[endpointKey]string
+}
+
+// set records an endpoint's health, and returns true if it changed
+// between healthy and unhealthy.
+func (h *endpointHealth) set(key endpointKey, healthy bool, reason string) bool {
+	h.Lock()
+	defer h.Unlock()
+	_, wasUnhealthy := h.unhealthy[key]
+	if healthy {
+		delete(h.unhealthy, key)
+		return wasUnhealthy
+	}
+	if h.unhealthy == nil {
+		h.unhealthy = map[endpointKey]string{}
+	}
+	h.unhealthy[key] = reason
+	return !wasUnhealthy
+}
+
+// get returns false, and the reason, if the endpoint is unhealthy.
+func (h *endpointHealth) get(key endpointKey) (bool, string) {
+	h.RLock()
+	defer h.RUnlock()
+	reason, unhealthy := h.unhealthy[key]
+	return !unhealthy, reason
+}
+
+// setCircuitBreaker records the state of an endpoint's circuit breaker,
+// or that it has none if state is empty.
+func (h *endpointHealth) setCircuitBreaker(key endpointKey, state string) {
+	h.Lock()
+	defer h.Unlock()
+	if state == "" {
+		delete(h.circuitBreakers, key)
+		return
+	}
+	if h.circuitBreakers == nil {
+		h.circuitBreakers = map[endpointKey]string{}
+	}
+	h.circuitBreakers[key] = state
+}
+
+// circuitBreaker returns the last reported state of the endpoint's circuit
+// breaker, or "" if none was reported.
+func (h *endpointHealth) circuitBreaker(key endpointKey) string {
+	h.RLock()
+	defer h.RUnlock()
+	return h.circuitBreakers[key]
+}
@@ -22,4 +22,30 @@ import "github.com/opsmx/oes-birger/internal/tunnel"
 type HTTPMessage struct {
 	Out chan *tunnel.MessageWrapper
 	Cmd *tunnel.OpenHTTPTunnelRequest
+
+	release func()
+}
+
+// Done marks the request as finished, making room for another if the
+// endpoint it was sent to limits how many it runs at once.  It does nothing
+// if the message was never sent.
+func (m *HTTPMessage) Done() {
+	if m.release != nil {
+		m.release()
+		m.release = nil
+	}
+}
+
+// HTTPUpgradeData holds data sent by the client on an upgraded connection,
+// which must be delivered to the session handling the request.
+type HTTPUpgradeData struct {
+	ID   string
+	Body []byte
+}
+
+// HTTPWindowUpdate acknowledges response data consumed by the requester,
+// which must be delivered to the session handling the request.
+type HTTPWindowUpdate struct {
+	ID    string
+	Bytes int64
 }
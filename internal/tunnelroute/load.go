@@ -0,0 +1,60 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import "sync"
+
+// endpointLoad counts the requests in progress to each of a route's
+// endpoints, by type and advertised name, so no more than an endpoint's
+// MaxConcurrency are sent to it at once.
+type endpointLoad struct {
+	sync.Mutex
+	active map[endpointKey]int
+}
+
+// busy returns true if max requests to the endpoint are in progress.  A
+// max of zero is unlimited.
+func (l *endpointLoad) busy(key endpointKey, max int) bool {
+	l.Lock()
+	defer l.Unlock()
+	return max > 0 && l.active[key] >= max
+}
+
+// acquire counts a new request to the endpoint, unless it is busy, and
+// returns true if it did.
+func (l *endpointLoad) acquire(key endpointKey, max int) bool {
+	l.Lock()
+	defer l.Unlock()
+	if max > 0 && l.active[key] >= max {
+		return false
+	}
+	if l.active == nil {
+		l.active = map[endpointKey]int{}
+	}
+	l.active[key]++
+	return true
+}
+
+// release counts a request to the endpoint as finished.
+func (l *endpointLoad) release(key endpointKey) {
+	l.Lock()
+	defer l.Unlock()
+	l.active[key]--
+	if l.active[key] <= 0 {
+		delete(l.active, key)
+	}
+}
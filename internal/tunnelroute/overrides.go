@@ -0,0 +1,99 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import "fmt"
+
+// OverrideBounds limits a value agents may set for their endpoints.  Default
+// is used when an agent does not set the value, or sets one outside Min and
+// Max.  A zero Min or Max is not checked.
+type OverrideBounds struct {
+	Default int `yaml:"default,omitempty"`
+	Min     int `yaml:"min,omitempty"`
+	Max     int `yaml:"max,omitempty"`
+}
+
+// EndpointOverrideLimits holds the bounds for each endpoint attribute an
+// agent may override when it connects.
+type EndpointOverrideLimits struct {
+	MaxConcurrency OverrideBounds `yaml:"maxConcurrency,omitempty"`
+	Weight         OverrideBounds `yaml:"weight,omitempty"`
+}
+
+func (b OverrideBounds) validate(name string) []error {
+	problems := []error{}
+	if b.Default < 0 || b.Min < 0 || b.Max < 0 {
+		problems = append(problems, fmt.Errorf("%s: values must not be negative", name))
+	}
+	if b.Max > 0 && b.Min > b.Max {
+		problems = append(problems, fmt.Errorf("%s: min %d is more than max %d", name, b.Min, b.Max))
+	}
+	if b.Default != 0 && !b.contains(b.Default) {
+		problems = append(problems, fmt.Errorf("%s: default %d is outside min and max", name, b.Default))
+	}
+	return problems
+}
+
+func (b OverrideBounds) contains(value int) bool {
+	if value < 0 {
+		return false
+	}
+	if b.Min > 0 && value < b.Min {
+		return false
+	}
+	if b.Max > 0 && value > b.Max {
+		return false
+	}
+	return true
+}
+
+// resolve returns the value to use for an override, which is the default
+// if the override is not set or is out of range.  The error reports an out
+// of range override.
+func (b OverrideBounds) resolve(name string, value int) (int, error) {
+	if value == 0 {
+		return b.Default, nil
+	}
+	if !b.contains(value) {
+		return b.Default, fmt.Errorf("%s %d is outside %d to %d, using %d", name, value, b.Min, b.Max, b.Default)
+	}
+	return value, nil
+}
+
+// Validate returns every problem with the limits.
+func (l EndpointOverrideLimits) Validate() []error {
+	problems := l.MaxConcurrency.validate("maxConcurrency")
+	return append(problems, l.Weight.validate("weight")...)
+}
+
+// Apply replaces the overrides agents sent for each endpoint with the values
+// to use.  An override outside its bounds is rejected, and the default used
+// instead, with an error returned for each one rejected.
+func (l EndpointOverrideLimits) Apply(endpoints []Endpoint) []error {
+	problems := []error{}
+	for i := range endpoints {
+		ep := &endpoints[i]
+		var err error
+		if ep.MaxConcurrency, err = l.MaxConcurrency.resolve("maxConcurrency", ep.MaxConcurrency); err != nil {
+			problems = append(problems, fmt.Errorf("endpoint %s: %v", ep, err))
+		}
+		if ep.Weight, err = l.Weight.resolve("weight", ep.Weight); err != nil {
+			problems = append(problems, fmt.Errorf("endpoint %s: %v", ep, err))
+		}
+	}
+	return problems
+}
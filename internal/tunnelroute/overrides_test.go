@@ -0,0 +1,121 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import (
+	"github.com/opsmx/oes-birger/internal/tunnel"
+	. "gopkg.in/check.v1"
+)
+
+var testOverrideLimits = EndpointOverrideLimits{
+	MaxConcurrency: OverrideBounds{Default: 10, Min: 1, Max: 50},
+	Weight:         OverrideBounds{Default: 1, Max: 100},
+}
+
+func (s *MySuite) TestEndpointOverrideLimits_Apply(c *C) {
+	endpoints := []Endpoint{
+		{Type: "jenkins", Name: "defaults"},
+		{Type: "jenkins", Name: "valid", MaxConcurrency: 20, Weight: 5},
+		{Type: "jenkins", Name: "too-high", MaxConcurrency: 500, Weight: 5},
+		{Type: "jenkins", Name: "negative", MaxConcurrency: 20, Weight: -3},
+	}
+	problems := testOverrideLimits.Apply(endpoints)
+
+	c.Assert(endpoints[0].MaxConcurrency, Equals, 10)
+	c.Assert(endpoints[0].Weight, Equals, 1)
+
+	c.Assert(endpoints[1].MaxConcurrency, Equals, 20)
+	c.Assert(endpoints[1].Weight, Equals, 5)
+
+	// Out of range values are rejected, and the default used.
+	c.Assert(endpoints[2].MaxConcurrency, Equals, 10)
+	c.Assert(endpoints[2].Weight, Equals, 5)
+	c.Assert(endpoints[3].MaxConcurrency, Equals, 20)
+	c.Assert(endpoints[3].Weight, Equals, 1)
+
+	c.Assert(problems, HasLen, 2)
+	c.Assert(problems[0], ErrorMatches, `endpoint \(type=jenkins, name=too-high.*maxConcurrency 500 is outside 1 to 50, using 10`)
+	c.Assert(problems[1], ErrorMatches, `endpoint \(type=jenkins, name=negative.*weight -3 is outside 0 to 100, using 1`)
+}
+
+func (s *MySuite) TestEndpointOverrideLimits_Apply_unbounded(c *C) {
+	endpoints := []Endpoint{{Type: "jenkins", Name: "any", MaxConcurrency: 5000, Weight: 7}}
+	c.Assert(EndpointOverrideLimits{}.Apply(endpoints), HasLen, 0)
+	c.Assert(endpoints[0].MaxConcurrency, Equals, 5000)
+	c.Assert(endpoints[0].Weight, Equals, 7)
+}
+
+func (s *MySuite) TestEndpointOverrideLimits_Validate(c *C) {
+	c.Assert(testOverrideLimits.Validate(), HasLen, 0)
+	c.Assert(EndpointOverrideLimits{}.Validate(), HasLen, 0)
+
+	invalid := EndpointOverrideLimits{
+		MaxConcurrency: OverrideBounds{Min: 10, Max: 5},
+		Weight:         OverrideBounds{Default: 200, Max: 100},
+	}
+	problems := invalid.Validate()
+	c.Assert(problems, HasLen, 2)
+	c.Assert(problems[0], ErrorMatches, "maxConcurrency: min 10 is more than max 5")
+	c.Assert(problems[1], ErrorMatches, "weight: default 200 is outside min and max")
+}
+
+func (s *MySuite) TestConnectedAgents_findServiceWeight(c *C) {
+	agents := MakeRoutes()
+	light := &DirectlyConnectedRoute{Name: "agent1", Session: "light", Endpoints: []Endpoint{{Name: "ci", Type: "jenkins", Configured: true, Weight: 1}}}
+	heavy := &DirectlyConnectedRoute{Name: "agent1", Session: "heavy", Endpoints: []Endpoint{{Name: "ci", Type: "jenkins", Configured: true, Weight: 99}}}
+	agents.m["agent1"] = []Route{light, heavy}
+
+	chosen := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		found, _, err := agents.findService(Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "ci"})
+		c.Assert(err, IsNil)
+		chosen[found.GetSession()]++
+	}
+	c.Assert(chosen["heavy"] > 900, Equals, true, Commentf("chosen %v", chosen))
+}
+
+func (s *MySuite) TestConnectedAgents_SendMaxConcurrency(c *C) {
+	agents := MakeRoutes()
+	route := &DirectlyConnectedRoute{
+		Name:      "agent1",
+		Session:   "session",
+		Endpoints: []Endpoint{{Name: "ci", Type: "jenkins", Configured: true, MaxConcurrency: 2}},
+		InRequest: make(chan interface{}, 10),
+	}
+	agents.m["agent1"] = []Route{route}
+	search := Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "ci"}
+	send := func() (*HTTPMessage, error) {
+		message := &HTTPMessage{Cmd: &tunnel.OpenHTTPTunnelRequest{}}
+		_, err := agents.Send(search, message)
+		return message, err
+	}
+
+	first, err := send()
+	c.Assert(err, IsNil)
+	_, err = send()
+	c.Assert(err, IsNil)
+	_, err = send()
+	c.Assert(err, ErrorMatches, ".*at its concurrency limit.*")
+
+	// Finishing a request makes room for another.
+	first.Done()
+	first.Done()
+	_, err = send()
+	c.Assert(err, IsNil)
+	_, err = send()
+	c.Assert(err, NotNil)
+}
@@ -17,6 +17,8 @@
 package tunnelroute
 
 import (
+	"strings"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -25,5 +27,59 @@ var (
 	connectedRoutesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "routess_connected",
 		Help: "The number of currently connected routes",
-	}, []string{"route"})
+	}, []string{"route", "connectionType"})
+
+	connectedEndpointsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "route_endpoints_connected",
+		Help: "The number of endpoints provided by currently connected routes",
+	}, []string{"route", "endpointType"})
+
+	routeConnectionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "route_connection_events_total",
+		Help: "The total number of route connects and disconnects",
+	}, []string{"route", "connectionType", "event"})
+
+	disconnectsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "agent_disconnects_total",
+		Help: "The total number of route disconnects, by why the route was removed",
+	}, []string{"reason"})
 )
+
+// endpointTypeLabel returns the endpointType label for a type.  The built in
+// types are used as-is.  Agents can report any type they like, so anything
+// else is collapsed into "custom" (for "x-" types) or "other" to keep the
+// number of label values bounded.
+func endpointTypeLabel(endpointType string) string {
+	if builtinEndpointTypes[endpointType] {
+		return endpointType
+	}
+	if strings.HasPrefix(endpointType, "x-") {
+		return "custom"
+	}
+	return "other"
+}
+
+func recordRouteConnected(state Route) {
+	connectedRoutesGauge.WithLabelValues(state.GetName(), state.GetConnectionType()).Inc()
+	routeConnectionsCounter.WithLabelValues(state.GetName(), state.GetConnectionType(), "connect").Inc()
+	for _, endpoint := range state.GetEndpoints() {
+		connectedEndpointsGauge.WithLabelValues(state.GetName(), endpointTypeLabel(endpoint.Type)).Inc()
+	}
+}
+
+// recordRouteDisconnected undoes recordRouteConnected, and counts the reason.  When the last session
+// for a name goes away, its gauges are removed entirely so names which are no
+// longer connected do not linger.
+func recordRouteDisconnected(state Route, remaining int, reason DisconnectReason) {
+	routeConnectionsCounter.WithLabelValues(state.GetName(), state.GetConnectionType(), "disconnect").Inc()
+	disconnectsCounter.WithLabelValues(string(reason)).Inc()
+	if remaining == 0 {
+		connectedRoutesGauge.DeletePartialMatch(prometheus.Labels{"route": state.GetName()})
+		connectedEndpointsGauge.DeletePartialMatch(prometheus.Labels{"route": state.GetName()})
+		return
+	}
+	connectedRoutesGauge.WithLabelValues(state.GetName(), state.GetConnectionType()).Dec()
+	for _, endpoint := range state.GetEndpoints() {
+		connectedEndpointsGauge.WithLabelValues(state.GetName(), endpointTypeLabel(endpoint.Type)).Dec()
+	}
+}
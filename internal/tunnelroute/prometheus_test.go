@@ -0,0 +1,106 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestMetrics_multipleSessions(c *C) {
+	routes := MakeRoutes()
+	session1 := &FakeAgent{
+		name:      "metrics1",
+		session:   "metrics1.session1",
+		endpoints: []Endpoint{{Name: "ep1", Type: "kubernetes"}},
+	}
+	session2 := &FakeAgent{
+		name:      "metrics1",
+		session:   "metrics1.session2",
+		endpoints: []Endpoint{{Name: "ep1", Type: "kubernetes"}, {Name: "ep2", Type: "x-mine"}},
+	}
+	connects := routeConnectionsCounter.WithLabelValues("metrics1", "fake", "connect")
+	disconnects := routeConnectionsCounter.WithLabelValues("metrics1", "fake", "disconnect")
+	routeSeries := testutil.CollectAndCount(connectedRoutesGauge)
+	endpointSeries := testutil.CollectAndCount(connectedEndpointsGauge)
+
+	routes.Add(session1)
+	routes.Add(session2)
+	c.Assert(testutil.ToFloat64(connects), Equals, 2.0)
+	c.Assert(testutil.ToFloat64(connectedRoutesGauge.WithLabelValues("metrics1", "fake")), Equals, 2.0)
+	c.Assert(testutil.ToFloat64(connectedEndpointsGauge.WithLabelValues("metrics1", "kubernetes")), Equals, 2.0)
+	c.Assert(testutil.ToFloat64(connectedEndpointsGauge.WithLabelValues("metrics1", "custom")), Equals, 1.0)
+
+	routes.Remove(session1, DisconnectClean)
+	c.Assert(testutil.ToFloat64(disconnects), Equals, 1.0)
+	c.Assert(testutil.ToFloat64(connectedRoutesGauge.WithLabelValues("metrics1", "fake")), Equals, 1.0)
+	c.Assert(testutil.ToFloat64(connectedEndpointsGauge.WithLabelValues("metrics1", "kubernetes")), Equals, 1.0)
+
+	// Removing an already removed session changes nothing.
+	routes.Remove(session1, DisconnectClean)
+	c.Assert(testutil.ToFloat64(disconnects), Equals, 1.0)
+	c.Assert(testutil.ToFloat64(connectedRoutesGauge.WithLabelValues("metrics1", "fake")), Equals, 1.0)
+
+	// Flapping: reconnect and disconnect again.
+	routes.Add(session1)
+	routes.Remove(session1, DisconnectClean)
+	routes.Remove(session2, DisconnectClean)
+	c.Assert(testutil.ToFloat64(connects), Equals, 3.0)
+	c.Assert(testutil.ToFloat64(disconnects), Equals, 3.0)
+
+	// Once no sessions remain, the gauges for the name are gone.
+	c.Assert(testutil.CollectAndCount(connectedRoutesGauge), Equals, routeSeries)
+	c.Assert(testutil.CollectAndCount(connectedEndpointsGauge), Equals, endpointSeries)
+}
+
+func (s *MySuite) TestMetrics_endpointTypeLabel(c *C) {
+	c.Assert(endpointTypeLabel("kubernetes"), Equals, "kubernetes")
+	c.Assert(endpointTypeLabel("grpc"), Equals, "grpc")
+	c.Assert(endpointTypeLabel("x-my-api"), Equals, "custom")
+	c.Assert(endpointTypeLabel("random-value"), Equals, "other")
+}
+
+func (s *MySuite) TestMetrics_disconnectReasons(c *C) {
+	routes := MakeRoutes()
+	clean := testutil.ToFloat64(disconnectsCounter.WithLabelValues("clean"))
+	failed := testutil.ToFloat64(disconnectsCounter.WithLabelValues("error"))
+	idle := testutil.ToFloat64(disconnectsCounter.WithLabelValues("idle"))
+
+	session1 := &FakeAgent{name: "reasons1", session: "reasons1.session1", lastActivity: uint64(time.Now().UnixMilli())}
+	session2 := &FakeAgent{name: "reasons1", session: "reasons1.session2", lastActivity: uint64(time.Now().UnixMilli())}
+	session3 := &FakeAgent{name: "reasons1", session: "reasons1.session3"}
+	routes.Add(session1)
+	routes.Add(session2)
+	routes.Add(session3)
+
+	routes.Remove(session1, DisconnectClean)
+	c.Assert(testutil.ToFloat64(disconnectsCounter.WithLabelValues("clean")), Equals, clean+1)
+	c.Assert(testutil.ToFloat64(disconnectsCounter.WithLabelValues("error")), Equals, failed)
+
+	routes.Remove(session2, DisconnectError)
+	c.Assert(testutil.ToFloat64(disconnectsCounter.WithLabelValues("clean")), Equals, clean+1)
+	c.Assert(testutil.ToFloat64(disconnectsCounter.WithLabelValues("error")), Equals, failed+1)
+
+	c.Assert(routes.RemoveIdle(time.Minute), Equals, 1)
+	c.Assert(testutil.ToFloat64(disconnectsCounter.WithLabelValues("idle")), Equals, idle+1)
+
+	// Removing an already removed session is not counted again.
+	routes.Remove(session2, DisconnectError)
+	c.Assert(testutil.ToFloat64(disconnectsCounter.WithLabelValues("error")), Equals, failed+1)
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// departedRoute is a route which disconnected within the reconnect grace
+// window.  It is counted as connected until its agent reconnects, which
+// replaces it, or the window ends, which removes it.
+type departedRoute struct {
+	route  Route
+	reason DisconnectReason
+	until  time.Time
+	timer  *time.Timer
+}
+
+// SetReconnectGrace sets how long after a route disconnects its agent has
+// to reconnect before the route is counted as gone.  Requests for the
+// agent's endpoints wait for it, rather than failing, during the window.
+// Zero, the default, removes routes at once.
+func (s *ConnectedRoutes) SetReconnectGrace(grace time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.reconnectGrace = grace
+}
+
+// depart starts the grace window for a route which has disconnected.  The
+// lock must be held.
+func (s *ConnectedRoutes) depart(state Route, reason DisconnectReason) {
+	d := &departedRoute{
+		route:  state,
+		reason: reason,
+		until:  time.Now().Add(s.reconnectGrace),
+	}
+	d.timer = time.AfterFunc(s.reconnectGrace, func() { s.expire(d) })
+	s.departed[state.GetName()] = append(s.departed[state.GetName()], d)
+	zap.S().Infow("route disconnected, waiting for it to reconnect",
+		"destination", state.GetName(),
+		"sessionId", state.GetSession(),
+		"reason", reason,
+		"reconnectGrace", s.reconnectGrace)
+}
+
+// expire removes a departed route whose agent did not reconnect in time.
+func (s *ConnectedRoutes) expire(d *departedRoute) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.forgetDeparted(d) {
+		return
+	}
+	s.recordRemoved(d.route, d.reason)
+}
+
+// hostnamed is implemented by routes which know the hostname of their
+// agent.
+type hostnamed interface {
+	GetHostname() string
+}
+
+// sameAgent returns true if the route which has just connected is the same
+// agent instance as the departed one: it has the same session, or reported
+// the same hostname.  Other instances of the agent do not replace it.
+func sameAgent(departed Route, state Route) bool {
+	if departed.GetSession() == state.GetSession() {
+		return true
+	}
+	old, ok := departed.(hostnamed)
+	if !ok {
+		return false
+	}
+	current, ok := state.(hostnamed)
+	if !ok {
+		return false
+	}
+	return old.GetHostname() != "" && old.GetHostname() == current.GetHostname()
+}
+
+// reconnected replaces the oldest departed route of the same agent
+// instance, if any, with the route which has just connected.  The lock must
+// be held.
+func (s *ConnectedRoutes) reconnected(state Route) {
+	var d *departedRoute
+	for _, other := range s.departed[state.GetName()] {
+		if sameAgent(other.route, state) {
+			d = other
+			break
+		}
+	}
+	if d == nil {
+		return
+	}
+	d.timer.Stop()
+	s.forgetDeparted(d)
+	remaining := len(s.m[state.GetName()]) + len(s.departed[state.GetName()])
+	recordRouteDisconnected(d.route, remaining, d.reason)
+	zap.S().Infow("route reconnected within the grace window",
+		"destination", state.GetName(),
+		"sessionId", state.GetSession(),
+		"previousSessionId", d.route.GetSession())
+}
+
+// forgetDeparted removes the departed route, returning false if it was
+// already gone.  The lock must be held.
+func (s *ConnectedRoutes) forgetDeparted(d *departedRoute) bool {
+	name := d.route.GetName()
+	departed := s.departed[name]
+	for i, other := range departed {
+		if other != d {
+			continue
+		}
+		departed = append(departed[:i], departed[i+1:]...)
+		if len(departed) == 0 {
+			delete(s.departed, name)
+		} else {
+			s.departed[name] = departed
+		}
+		return true
+	}
+	return false
+}
+
+// WaitForReconnect waits for an agent to reconnect, if a route for it with
+// the endpoint disconnected within the grace window, and returns true if
+// one has.  It returns false at once if no such route disconnected.
+func (s *ConnectedRoutes) WaitForReconnect(ctx context.Context, ep Search) bool {
+	s.RLock()
+	until, departed := s.reconnectDeadline(ep)
+	s.RUnlock()
+	if !departed {
+		return false
+	}
+	return s.WaitForRoute(ctx, ep, until)
+}
+
+// reconnectDeadline returns when the last grace window for the search's
+// endpoint ends.  The lock must be held.
+func (s *ConnectedRoutes) reconnectDeadline(ep Search) (time.Time, bool) {
+	ep = s.aliases.resolve(ep)
+	var until time.Time
+	for _, d := range s.departed[ep.Name] {
+		if d.route.HasEndpoint(ep.EndpointType, ep.EndpointName) && d.until.After(until) {
+			until = d.until
+		}
+	}
+	return until, !until.IsZero()
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func departedCount(routes *ConnectedRoutes, name string) int {
+	routes.RLock()
+	defer routes.RUnlock()
+	return len(routes.departed[name])
+}
+
+func TestConnectedRoutes_reconnectWithinGrace(t *testing.T) {
+	routes := MakeRoutes()
+	routes.SetReconnectGrace(time.Minute)
+	ep := Search{Name: "reconnect1", EndpointType: "jenkins", EndpointName: "ci"}
+	disconnects := routeConnectionsCounter.WithLabelValues("reconnect1", "direct", "disconnect")
+	connected := connectedRoutesGauge.WithLabelValues("reconnect1", "direct")
+
+	old := makeHandoffRoute("reconnect1")
+	old.Hostname = "agent-pod-1"
+	routes.Add(old)
+	routes.Remove(old, DisconnectError)
+	if !old.IsClosed() {
+		t.Errorf("Remove() did not close the disconnected route")
+	}
+	if got := testutil.ToFloat64(connected); got != 1 {
+		t.Errorf("connected routes = %v during the grace window, want 1", got)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		reconnected := makeHandoffRoute("reconnect1")
+		reconnected.Session = "reconnect1.session2"
+		reconnected.Hostname = "agent-pod-1"
+		routes.Add(reconnected)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !routes.WaitForReconnect(ctx, ep) {
+		t.Fatalf("WaitForReconnect() = false, want true once the agent reconnects")
+	}
+	session, err := routes.Send(ep, "message")
+	if err != nil || session != "reconnect1.session2" {
+		t.Errorf("Send() = %q, %v, want the reconnected session", session, err)
+	}
+
+	// The old route was replaced, without the agent being counted as gone.
+	if n := departedCount(routes, "reconnect1"); n != 0 {
+		t.Errorf("%d departed routes remain after reconnecting", n)
+	}
+	if got := testutil.ToFloat64(disconnects); got != 1 {
+		t.Errorf("disconnects = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(connected); got != 1 {
+		t.Errorf("connected routes = %v after reconnecting, want 1", got)
+	}
+}
+
+func TestConnectedRoutes_reconnectGraceExpires(t *testing.T) {
+	routes := MakeRoutes()
+	routes.SetReconnectGrace(50 * time.Millisecond)
+	ep := Search{Name: "reconnect2", EndpointType: "jenkins", EndpointName: "ci"}
+	routeSeries := testutil.CollectAndCount(connectedRoutesGauge)
+
+	route := makeHandoffRoute("reconnect2")
+	routes.Add(route)
+	routes.Remove(route, DisconnectClean)
+
+	start := time.Now()
+	if routes.WaitForReconnect(context.Background(), ep) {
+		t.Errorf("WaitForReconnect() = true, but the agent did not reconnect")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("WaitForReconnect() returned after %v, before the grace window ended", elapsed)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for departedCount(routes, "reconnect2") > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the departed route was not removed after the grace window")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := testutil.CollectAndCount(connectedRoutesGauge); got != routeSeries {
+		t.Errorf("connected route series = %d after the grace window, want %d", got, routeSeries)
+	}
+	if routes.WaitForReconnect(context.Background(), ep) {
+		t.Errorf("WaitForReconnect() = true once the grace window has ended")
+	}
+}
+
+func TestConnectedRoutes_reconnectGraceSkipsIdle(t *testing.T) {
+	routes := MakeRoutes()
+	routes.SetReconnectGrace(time.Minute)
+	ep := Search{Name: "reconnect3", EndpointType: "jenkins", EndpointName: "ci"}
+
+	route := makeHandoffRoute("reconnect3")
+	routes.Add(route)
+	routes.Remove(route, DisconnectIdle)
+	if n := departedCount(routes, "reconnect3"); n != 0 {
+		t.Errorf("an idle route was kept for reconnecting")
+	}
+
+	// Only a route with the endpoint is waited for.
+	route = makeHandoffRoute("reconnect3")
+	routes.Add(route)
+	routes.Remove(route, DisconnectError)
+	other := Search{Name: "reconnect3", EndpointType: "jenkins", EndpointName: "other"}
+	if routes.WaitForReconnect(context.Background(), other) {
+		t.Errorf("WaitForReconnect() = true for an endpoint the route did not have")
+	}
+	if _, departed := routes.reconnectDeadline(ep); !departed {
+		t.Errorf("the disconnected route is not waiting to reconnect")
+	}
+}
+
+func TestConnectedRoutes_reconnectMatchesAgent(t *testing.T) {
+	routes := MakeRoutes()
+	routes.SetReconnectGrace(time.Minute)
+
+	old := makeHandoffRoute("reconnect4")
+	old.Hostname = "agent-pod-1"
+	routes.Add(old)
+	routes.Remove(old, DisconnectError)
+
+	// Another instance of the agent connecting does not replace the route.
+	other := makeHandoffRoute("reconnect4")
+	other.Session = "reconnect4.session2"
+	other.Hostname = "agent-pod-2"
+	routes.Add(other)
+	if n := departedCount(routes, "reconnect4"); n != 1 {
+		t.Errorf("%d departed routes after another agent connected, want 1", n)
+	}
+
+	// Nor does one which did not say what host it is on.
+	unnamed := makeHandoffRoute("reconnect4")
+	unnamed.Session = "reconnect4.session3"
+	routes.Add(unnamed)
+	if n := departedCount(routes, "reconnect4"); n != 1 {
+		t.Errorf("%d departed routes after an agent with no hostname connected, want 1", n)
+	}
+
+	reconnected := makeHandoffRoute("reconnect4")
+	reconnected.Session = "reconnect4.session4"
+	reconnected.Hostname = "agent-pod-1"
+	routes.Add(reconnected)
+	if n := departedCount(routes, "reconnect4"); n != 0 {
+		t.Errorf("%d departed routes after the agent reconnected, want 0", n)
+	}
+}
+
+func TestSameAgent(t *testing.T) {
+	route := func(session string, hostname string) *DirectlyConnectedRoute {
+		return &DirectlyConnectedRoute{Name: "agent", Session: session, Hostname: hostname}
+	}
+	tests := []struct {
+		name     string
+		departed Route
+		state    Route
+		want     bool
+	}{
+		{"same session", route("s1", ""), route("s1", ""), true},
+		{"same hostname", route("s1", "pod-a"), route("s2", "pod-a"), true},
+		{"different hostname", route("s1", "pod-a"), route("s2", "pod-b"), false},
+		{"no hostname", route("s1", ""), route("s2", ""), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameAgent(tt.departed, tt.state); got != tt.want {
+				t.Errorf("sameAgent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -22,7 +22,8 @@ import (
 )
 
 // Search defines the parameters to narrow down an agent.  Each field is required
-// other than Session, which may be empty when "any session" is fine.
+// other than Session, which may be empty when "any session" is fine.  When it
+// is set, requests are only sent to that session.
 type Search struct {
 	Name         string // The route (agent) name
 	EndpointType string // the endpoint type, eg "jenkins", "kubernetes"
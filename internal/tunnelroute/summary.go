@@ -0,0 +1,86 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import "sort"
+
+// EndpointSummary describes an endpoint which is reachable now.  An agent
+// connected with several sessions is listed, and counted, once.
+type EndpointSummary struct {
+	Type         string   `json:"type"`
+	Name         string   `json:"name"`
+	AgentCount   int      `json:"agentCount"`
+	SessionCount int      `json:"sessionCount"`
+	Direct       bool     `json:"direct"`
+	Agents       []string `json:"agents"`
+}
+
+type endpointKey struct {
+	endpointType string
+	endpointName string
+}
+
+// GetEndpointSummaries returns every configured endpoint across all routes,
+// sorted by type and name, with the agents which serve it and whether any
+// of them are directly connected.
+func (s *ConnectedRoutes) GetEndpointSummaries() []EndpointSummary {
+	s.RLock()
+	defer s.RUnlock()
+
+	summaries := map[endpointKey]*EndpointSummary{}
+	agents := map[endpointKey]map[string]bool{}
+	for _, routeList := range s.m {
+		for _, route := range routeList {
+			seen := map[endpointKey]bool{}
+			for _, ep := range route.GetEndpoints() {
+				key := endpointKey{ep.Type, ep.Name}
+				if !ep.Configured || ep.Unsupported || seen[key] {
+					continue
+				}
+				seen[key] = true
+				summary, found := summaries[key]
+				if !found {
+					summary = &EndpointSummary{Type: ep.Type, Name: ep.Name}
+					summaries[key] = summary
+					agents[key] = map[string]bool{}
+				}
+				summary.SessionCount++
+				if route.GetConnectionType() == "direct" {
+					summary.Direct = true
+				}
+				agents[key][route.GetName()] = true
+			}
+		}
+	}
+
+	ret := make([]EndpointSummary, 0, len(summaries))
+	for key, summary := range summaries {
+		for name := range agents[key] {
+			summary.Agents = append(summary.Agents, name)
+		}
+		sort.Strings(summary.Agents)
+		summary.AgentCount = len(summary.Agents)
+		ret = append(ret, *summary)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Type != ret[j].Type {
+			return ret[i].Type < ret[j].Type
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
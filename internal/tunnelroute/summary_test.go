@@ -0,0 +1,51 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestConnectedRoutes_GetEndpointSummaries(c *C) {
+	routes := MakeRoutes()
+	c.Assert(routes.GetEndpointSummaries(), DeepEquals, []EndpointSummary{})
+
+	shared := []Endpoint{
+		{Type: "jenkins", Name: "ci", Configured: true},
+		{Type: "kubernetes", Name: "prod", Configured: true},
+	}
+	// agent1 has two sessions, which must only count as one agent.
+	routes.Add(&DirectlyConnectedRoute{Name: "agent1", Session: "agent1.session1", Endpoints: shared})
+	routes.Add(&DirectlyConnectedRoute{Name: "agent1", Session: "agent1.session2", Endpoints: shared})
+	routes.Add(&DirectlyConnectedRoute{Name: "agent2", Session: "agent2.session1", Endpoints: []Endpoint{
+		{Type: "jenkins", Name: "ci", Configured: true},
+		{Type: "jenkins", Name: "ci", Configured: true},
+		{Type: "kubernetes", Name: "prod", Configured: false},
+		{Type: "kubernetes", Name: "dev", Configured: true},
+	}})
+	routes.Add(&FakeAgent{name: "agent3", session: "agent3.session1", endpoints: []Endpoint{
+		{Type: "aws", Name: "account", Configured: true},
+		{Type: "jenkins", Name: "ci", Configured: true},
+	}})
+
+	c.Assert(routes.GetEndpointSummaries(), DeepEquals, []EndpointSummary{
+		{Type: "aws", Name: "account", AgentCount: 1, SessionCount: 1, Direct: false, Agents: []string{"agent3"}},
+		{Type: "jenkins", Name: "ci", AgentCount: 3, SessionCount: 4, Direct: true, Agents: []string{"agent1", "agent2", "agent3"}},
+		{Type: "kubernetes", Name: "dev", AgentCount: 1, SessionCount: 1, Direct: true, Agents: []string{"agent2"}},
+		{Type: "kubernetes", Name: "prod", AgentCount: 1, SessionCount: 2, Direct: true, Agents: []string{"agent1"}},
+	})
+}
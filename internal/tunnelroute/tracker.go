@@ -27,6 +27,15 @@ import (
 
 var (
 	rnd = rand.New(rand.NewSource(time.Now().UnixNano())) // not used for crypto
+
+	// routeSnapshots holds slices used to copy the routes out from under
+	// the lock, so that rendering statistics does not block updates.
+	routeSnapshots = sync.Pool{
+		New: func() interface{} {
+			routes := make([]Route, 0, 16)
+			return &routes
+		},
+	}
 )
 
 // BaseStatistics defines the standard statistics returned for every
@@ -41,46 +50,104 @@ type BaseStatistics struct {
 	Hostname       string     `json:"hostname,omitempty"`
 }
 
+// EventKey returns the agent's name, so the events for each agent are
+// kept in order when published to Kafka.
+func (s *BaseStatistics) EventKey() string {
+	return s.Name
+}
+
 // Route is a thing that looks like a connected route (agent), either directly connected or
 // through another controller.
 type Route interface {
 	Close()
 	Send(interface{}) string
 	Cancel(string)
+	CancelAll() int
 	HasEndpoint(string, string) bool
+	IsEndpointHealthy(string, string) bool
 	GetSession() string
 	GetName() string
+	GetConnectionType() string
 	GetEndpoints() []Endpoint
+	GetLastActivity() uint64
 
 	GetStatistics() interface{}
 }
 
+// endpointLimiter is implemented by routes which keep to the MaxConcurrency
+// of each of their endpoints.
+type endpointLimiter interface {
+	endpointBusy(endpointType string, endpointName string) bool
+	acquireEndpoint(endpointType string, endpointName string) (func(), bool)
+}
+
+// DisconnectReason describes why a route was removed.
+type DisconnectReason string
+
+const (
+	// DisconnectClean means the other side ended the stream.
+	DisconnectClean DisconnectReason = "clean"
+	// DisconnectError means the stream failed, such as a dropped connection.
+	DisconnectError DisconnectReason = "error"
+	// DisconnectIdle means the route was removed for being idle.
+	DisconnectIdle DisconnectReason = "idle"
+)
+
 // ConnectedRoutes holds a list of all currently connected or known routes (agents)
 type ConnectedRoutes struct {
 	sync.RWMutex
-	m map[string][]Route
+	m       map[string][]Route
+	handoff *Handoff
+	added   chan struct{} // closed and replaced when a route is added
+	aliases EndpointAliases
+
+	reconnectGrace time.Duration
+	departed       map[string][]*departedRoute // oldest first
 }
 
 // GetStatistics returns statistics for all routes currently connected.
 // The statistics returned is an opaque object, intended to be rendered to JSON.
+//
+// Only the list of routes is copied while holding the lock; each route's
+// statistics are gathered after it is released.
 func (s *ConnectedRoutes) GetStatistics() interface{} {
-	ret := make([]interface{}, 0)
+	p := routeSnapshots.Get().(*[]Route)
+	routes := s.snapshot((*p)[:0])
+	ret := make([]interface{}, len(routes))
+	for i, route := range routes {
+		ret[i] = route.GetStatistics()
+		routes[i] = nil // do not keep removed routes alive in the pool
+	}
+	*p = routes[:0]
+	routeSnapshots.Put(p)
+	return ret
+}
+
+// snapshot appends every known route to dst.
+func (s *ConnectedRoutes) snapshot(dst []Route) []Route {
 	s.RLock()
 	defer s.RUnlock()
 	for _, routeList := range s.m {
-		for _, route := range routeList {
-			ret = append(ret, route.GetStatistics())
-		}
+		dst = append(dst, routeList...)
 	}
-	return ret
+	return dst
 }
 
 // MakeRoutes returns a new Routes object which will manage (safely) routes, such as agents,
 // connected directly or indirectly.
 func MakeRoutes() *ConnectedRoutes {
-	return &ConnectedRoutes{
-		m: make(map[string][]Route),
+	s := &ConnectedRoutes{
+		m:        make(map[string][]Route),
+		added:    make(chan struct{}),
+		departed: make(map[string][]*departedRoute),
 	}
+	s.handoff = makeHandoff(s)
+	return s
+}
+
+// Handoff returns the handoff of these routes to a peer controller.
+func (s *ConnectedRoutes) Handoff() *Handoff {
+	return s.handoff
 }
 
 func sliceIndex(limit int, predicate func(i int) bool) int {
@@ -115,18 +182,28 @@ func (s *ConnectedRoutes) Add(state Route) {
 			"endpointName", endpoint.Name,
 			"endpointConfigured", endpoint.Configured)
 	}
-	connectedRoutesGauge.WithLabelValues(state.GetName()).Inc()
+	recordRouteConnected(state)
+	s.reconnected(state)
+	close(s.added)
+	s.added = make(chan struct{})
 }
 
 // Remove will remove a route and signal to it that closing down is started.
+// The reason is counted, and unexpected disconnects are logged as warnings.
+// With a reconnect grace window, a route which disconnected rather than
+// went idle is only counted as gone if its agent does not reconnect in time.
 //
 // Rather than return an error here, we will just log it.  This is because we
 // won't likely care in the caller, so there's no need to burden them with
 // an if statement just to check it.
-func (s *ConnectedRoutes) Remove(state Route) {
+func (s *ConnectedRoutes) Remove(state Route, reason DisconnectReason) {
 	s.Lock()
 	defer s.Unlock()
+	s.removeLocked(state, reason)
+}
 
+// removeLocked is Remove, with the lock held.
+func (s *ConnectedRoutes) removeLocked(state Route, reason DisconnectReason) {
 	state.Close()
 
 	routeList, ok := s.m[state.GetName()]
@@ -146,44 +223,164 @@ func (s *ConnectedRoutes) Remove(state Route) {
 	routeList[len(routeList)-1] = nil
 	routeList = routeList[:len(routeList)-1]
 	s.m[state.GetName()] = routeList
-	connectedRoutesGauge.WithLabelValues(state.GetName()).Dec()
-	zap.S().Infow("remove route",
+	if s.reconnectGrace > 0 && reason != DisconnectIdle {
+		s.depart(state, reason)
+		return
+	}
+	s.recordRemoved(state, reason)
+}
+
+// recordRemoved counts and logs a route which is gone.  The lock must be
+// held.
+func (s *ConnectedRoutes) recordRemoved(state Route, reason DisconnectReason) {
+	pathCount := len(s.m[state.GetName()])
+	recordRouteDisconnected(state, pathCount+len(s.departed[state.GetName()]), reason)
+	log := zap.S().Infow
+	if reason == DisconnectError {
+		log = zap.S().Warnw
+	}
+	log("remove route",
 		"destination", state.GetName(),
 		"sessionId", state.GetSession(),
-		"pathCount", len(routeList))
+		"reason", reason,
+		"pathCount", pathCount)
 }
 
-func (s *ConnectedRoutes) findService(ep Search) (Route, error) {
+// findService returns a route with the endpoint, chosen at random by the
+// endpoint's weight, from those with exactly the endpoint's name if there
+// are any, otherwise from those with a matching pattern.  Routes whose
+// endpoint is running as many requests as its MaxConcurrency allows are
+// skipped.  If the search names a session, only that session is used.
+// An aliased endpoint name is resolved first, here and nowhere else.  The
+// search is returned with the name it resolved to.
+func (s *ConnectedRoutes) findService(ep Search) (Route, Search, error) {
+	ep = s.aliases.resolve(ep)
 	routeList, ok := s.m[ep.Name]
 	if !ok || len(routeList) == 0 {
-		return nil, fmt.Errorf("no routes connected for %s", ep)
+		return nil, ep, fmt.Errorf("no routes connected for %s", ep)
+	}
+	if len(ep.Session) > 0 {
+		for _, a := range routeList {
+			if !ep.MatchesRoute(a) {
+				continue
+			}
+			if !a.HasEndpoint(ep.EndpointType, ep.EndpointName) {
+				return nil, ep, fmt.Errorf("request for %s, the session has no such endpoint or it is unconfigured", ep)
+			}
+			return a, ep, nil
+		}
+		return nil, ep, fmt.Errorf("request for %s, the session is not connected", ep)
 	}
 	possibleRoutes := []int{}
+	exactRoutes := []int{}
+	weights := map[int]int{}
+	unhealthy := 0
+	busy := 0
 	for i, a := range routeList {
-		if a.HasEndpoint(ep.EndpointType, ep.EndpointName) {
-			possibleRoutes = append(possibleRoutes, i)
+		if !a.HasEndpoint(ep.EndpointType, ep.EndpointName) {
+			continue
+		}
+		if !a.IsEndpointHealthy(ep.EndpointType, ep.EndpointName) {
+			unhealthy++
+			continue
+		}
+		if limiter, ok := a.(endpointLimiter); ok && limiter.endpointBusy(ep.EndpointType, ep.EndpointName) {
+			busy++
+			continue
 		}
+		possibleRoutes = append(possibleRoutes, i)
+		weights[i] = 1
+		if found := FindEndpoint(a.GetEndpoints(), ep.EndpointType, ep.EndpointName); found != nil {
+			if found.Weight > 0 {
+				weights[i] = found.Weight
+			}
+			if found.Name == ep.EndpointName {
+				exactRoutes = append(exactRoutes, i)
+			}
+		}
+	}
+	if len(exactRoutes) > 0 {
+		possibleRoutes = exactRoutes
+	}
+	if len(possibleRoutes) == 0 && busy > 0 {
+		return nil, ep, fmt.Errorf("request for %s, every route with the endpoint is at its concurrency limit", ep)
+	}
+	if len(possibleRoutes) == 0 && unhealthy > 0 {
+		return nil, ep, fmt.Errorf("request for %s, every route with the endpoint reports it unhealthy", ep)
 	}
 	if len(possibleRoutes) == 0 {
-		return nil, fmt.Errorf("request for %s, no such route exists or all are unconfigured", ep)
+		return nil, ep, fmt.Errorf("request for %s, no such route exists or all are unconfigured", ep)
+	}
+	return routeList[pickWeighted(possibleRoutes, weights)], ep, nil
+}
+
+// pickWeighted returns one of choices at random, each in proportion to its
+// weight.
+func pickWeighted(choices []int, weights map[int]int) int {
+	total := 0
+	for _, choice := range choices {
+		total += weights[choice]
 	}
-	selected := possibleRoutes[rnd.Intn(len(possibleRoutes))]
-	return routeList[selected], nil
+	n := rnd.Intn(total)
+	for _, choice := range choices {
+		n -= weights[choice]
+		if n < 0 {
+			return choice
+		}
+	}
+	return choices[len(choices)-1]
 }
 
 // Send will search for the specific route and endpoint. send a message to an route, and return true if a route
-// was found.
+// was found.  A HTTP request for an aliased endpoint is sent with the
+// endpoint's real name, which is the one the agent knows it by.
 func (s *ConnectedRoutes) Send(ep Search, message interface{}) (string, error) {
 	s.RLock()
 	defer s.RUnlock()
-	route, err := s.findService(ep)
+	route, resolved, err := s.findService(ep)
 	if err != nil {
 		return "", err
 	}
+	if m, ok := message.(*HTTPMessage); ok && m.Cmd != nil {
+		m.Cmd.Name = resolved.EndpointName
+		if limiter, ok := route.(endpointLimiter); ok {
+			release, acquired := limiter.acquireEndpoint(resolved.EndpointType, resolved.EndpointName)
+			if !acquired {
+				return "", fmt.Errorf("request for %s, the endpoint is at its concurrency limit", resolved)
+			}
+			m.release = release
+		}
+	}
 	session := route.Send(message)
 	return session, nil
 }
 
+// SendToSession will send a message to the specific session in the search, rather than
+// to any route which has the endpoint.  This is used for messages which belong to a
+// request already in progress.
+func (s *ConnectedRoutes) SendToSession(ep Search, message interface{}) error {
+	// The session must be set, if not this is an error.
+	if len(ep.Session) == 0 {
+		return fmt.Errorf("session is not set (coding error)")
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	routeList, ok := s.m[ep.Name]
+	if !ok || len(routeList) == 0 {
+		return fmt.Errorf("no routes connected for: %s", ep)
+	}
+
+	for _, a := range routeList {
+		if ep.MatchesRoute(a) {
+			a.Send(message)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no routes with specific session exist for %s", ep)
+}
+
 // Cancel will cancel an ongoing request.
 func (s *ConnectedRoutes) Cancel(ep Search, id string) error {
 	// The session must be set, if not this is an error.
@@ -207,3 +404,54 @@ func (s *ConnectedRoutes) Cancel(ep Search, id string) error {
 
 	return fmt.Errorf("no routes with specific session exist for %s (likely coding error)", ep)
 }
+
+// CancelAll cancels every request in progress on every session of the
+// named route, returning how many were cancelled.
+func (s *ConnectedRoutes) CancelAll(name string) int {
+	s.RLock()
+	defer s.RUnlock()
+	count := 0
+	for _, route := range s.m[name] {
+		count += route.CancelAll()
+	}
+	return count
+}
+
+// RemoveIdle removes every route which has not had a request for longer than
+// timeout, and returns how many were removed.
+func (s *ConnectedRoutes) RemoveIdle(timeout time.Duration) int {
+	cutoff := uint64(time.Now().Add(-timeout).UnixNano() / 1000000)
+
+	// Checking and removing under one lock means no lookup can pick a
+	// route between it being found idle and being removed.
+	s.Lock()
+	defer s.Unlock()
+	idle := []Route{}
+	for _, routeList := range s.m {
+		for _, route := range routeList {
+			if route.GetLastActivity() < cutoff {
+				idle = append(idle, route)
+			}
+		}
+	}
+	for _, route := range idle {
+		zap.S().Infow("removing idle route",
+			"destination", route.GetName(),
+			"sessionId", route.GetSession(),
+			"idleTimeout", timeout)
+		s.removeLocked(route, DisconnectIdle)
+	}
+	return len(idle)
+}
+
+// RunIdleSweeper removes idle routes, checking several times per timeout
+// so none stays much longer than it.  It never returns.
+func (s *ConnectedRoutes) RunIdleSweeper(timeout time.Duration) {
+	interval := timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		s.RemoveIdle(timeout)
+	}
+}
@@ -18,8 +18,12 @@ package tunnelroute
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/opsmx/oes-birger/internal/tunnel"
 	. "gopkg.in/check.v1"
 )
 
@@ -61,13 +65,20 @@ type FakeAgent struct {
 	endpoints []Endpoint
 
 	lastCancelled string
+	inFlight      int
 	lastMessage   int
+	lastActivity  uint64
+	closed        bool
 }
 
-func (a *FakeAgent) Close() {}
+func (a *FakeAgent) Close() {
+	a.closed = true
+}
 
 func (a *FakeAgent) Send(m interface{}) string {
-	a.lastMessage = m.(int)
+	if n, ok := m.(int); ok {
+		a.lastMessage = n
+	}
 	return a.session
 }
 
@@ -75,6 +86,10 @@ func (a *FakeAgent) Cancel(id string) {
 	a.lastCancelled = id
 }
 
+func (a *FakeAgent) CancelAll() int {
+	return a.inFlight
+}
+
 func (a *FakeAgent) HasEndpoint(endpointType string, endpointName string) bool {
 	for _, ep := range a.endpoints {
 		if ep.Type == endpointType && ep.Name == endpointName {
@@ -84,23 +99,34 @@ func (a *FakeAgent) HasEndpoint(endpointType string, endpointName string) bool {
 	return false
 }
 
+func (a *FakeAgent) IsEndpointHealthy(endpointType string, endpointName string) bool {
+	return true
+}
+
 func (a *FakeAgent) GetName() string {
 	return a.name
 }
 func (a *FakeAgent) GetSession() string {
 	return a.session
 }
+func (a *FakeAgent) GetConnectionType() string {
+	return "fake"
+}
 
 type FakeStats BaseStatistics
 
 func (a *FakeAgent) GetStatistics() interface{} {
-	return FakeStats{Name: a.name, Session: a.session, ConnectionType: "fake"}
+	return FakeStats{Name: a.name, Session: a.session, ConnectionType: a.GetConnectionType()}
 }
 
 func (a *FakeAgent) GetEndpoints() []Endpoint {
 	return a.endpoints
 }
 
+func (a *FakeAgent) GetLastActivity() uint64 {
+	return a.lastActivity
+}
+
 func (s *MySuite) TestConnectedAgents(c *C) {
 	agents := MakeRoutes()
 
@@ -120,34 +146,53 @@ func (s *MySuite) TestConnectedAgents(c *C) {
 	/// RemoveAgent()
 	///
 
-	agents.Remove(agent1Session1)
+	agents.Remove(agent1Session1, DisconnectClean)
 	c.Assert(agents.m, HasLen, 1)
 	c.Assert(agents.m["agent1"], HasLen, 1)
 
 	// bogus agent, never was added
-	agents.Remove(bogusagent)
+	agents.Remove(bogusagent, DisconnectClean)
 
 	// agent name exists, session does not
-	agents.Remove(agent1Session1)
+	agents.Remove(agent1Session1, DisconnectClean)
 
 	///
 	/// findService()
 	///
 
 	// now that only agent1State2 exists in the list, find some endpoints.
-	agent, err := agents.findService(Search{Name: "agent1", EndpointType: "type1", EndpointName: "ep1"})
+	agent, _, err := agents.findService(Search{Name: "agent1", EndpointType: "type1", EndpointName: "ep1"})
 	c.Assert(err, IsNil)
 	c.Assert(agent.GetName(), Equals, "agent1")
 	c.Assert(agent.GetSession(), Equals, "agent1.session2")
 
 	// Try to find an agent that does not exist
-	_, err = agents.findService(Search{Name: "agent99", EndpointType: "type1", EndpointName: "ep1"})
+	_, _, err = agents.findService(Search{Name: "agent99", EndpointType: "type1", EndpointName: "ep1"})
 	c.Assert(err, ErrorMatches, "no routes connected for.*")
 
 	// Try to find a service on an agent, where the agent exists but the service does not.
-	_, err = agents.findService(Search{Name: "agent1", EndpointType: "type99", EndpointName: "ep1"})
+	_, _, err = agents.findService(Search{Name: "agent1", EndpointType: "type99", EndpointName: "ep1"})
 	c.Assert(err, ErrorMatches, ".*no such route exists.*")
 
+	// A pinned session is used even when another session has the endpoint.
+	agents.Add(agent1Session1)
+	agent1Session1.endpoints = []Endpoint{{Name: "ep1", Type: "type1", Configured: true}}
+	for i := 0; i < 20; i++ {
+		agent, _, err = agents.findService(Search{Name: "agent1", EndpointType: "type1", EndpointName: "ep1", Session: "agent1.session1"})
+		c.Assert(err, IsNil)
+		c.Assert(agent.GetSession(), Equals, "agent1.session1")
+	}
+
+	// A pinned session without the endpoint is not replaced by another.
+	_, _, err = agents.findService(Search{Name: "agent1", EndpointType: "type2", EndpointName: "ep3", Session: "agent1.session1"})
+	c.Assert(err, ErrorMatches, ".*session has no such endpoint.*")
+
+	// A pinned session which is gone is an error.
+	agents.Remove(agent1Session1, DisconnectClean)
+	agent1Session1.endpoints = []Endpoint{}
+	_, _, err = agents.findService(Search{Name: "agent1", EndpointType: "type1", EndpointName: "ep1", Session: "agent1.session1"})
+	c.Assert(err, ErrorMatches, `request for \(name=agent1, session=agent1.session1, endpointType=type1, endpointName=ep1\), the session is not connected`)
+
 	///
 	/// Send()
 	///
@@ -163,6 +208,23 @@ func (s *MySuite) TestConnectedAgents(c *C) {
 	c.Assert(session, Equals, "agent1.session2")
 	c.Assert(agent1Session2.lastMessage, Equals, 5)
 
+	///
+	/// SendToSession()
+	///
+
+	// No session
+	err = agents.SendToSession(Search{Name: "agent1"}, 6)
+	c.Assert(err, ErrorMatches, ".*session is not set.*")
+
+	// Agent exists, session does not
+	err = agents.SendToSession(Search{Name: "agent1", Session: "nosession"}, 6)
+	c.Assert(err, ErrorMatches, ".*with specific session.*")
+
+	// working
+	err = agents.SendToSession(Search{Name: "agent1", Session: "agent1.session2"}, 6)
+	c.Assert(err, IsNil)
+	c.Assert(agent1Session2.lastMessage, Equals, 6)
+
 	///
 	/// Cancel()
 	///
@@ -200,3 +262,289 @@ func (s *MySuite) TestConnectedAgents_sliceIndex(c *C) {
 	c.Assert(sliceIndex(len(ints), func(i int) bool { return ints[i] == 8 }), Equals, 1)
 	c.Assert(sliceIndex(len(ints), func(i int) bool { return ints[i] == -99 }), Equals, -1)
 }
+
+func (s *MySuite) TestConnectedAgents_RemoveIdle(c *C) {
+	agents := MakeRoutes()
+	now := tunnel.Now()
+	idle := &FakeAgent{name: "agent1", session: "idle", lastActivity: now - uint64(time.Hour/time.Millisecond)}
+	active := &FakeAgent{name: "agent1", session: "active", lastActivity: now}
+	agents.Add(idle)
+	agents.Add(active)
+
+	c.Assert(agents.RemoveIdle(30*time.Minute), Equals, 1)
+	c.Assert(idle.closed, Equals, true)
+	c.Assert(active.closed, Equals, false)
+	c.Assert(agents.m["agent1"], HasLen, 1)
+	c.Assert(agents.m["agent1"][0].GetSession(), Equals, "active")
+
+	c.Assert(agents.RemoveIdle(30*time.Minute), Equals, 0)
+}
+
+type fakeInFlight int
+
+func (f fakeInFlight) Len() int { return int(f) }
+
+func (f fakeInFlight) IDs() []string { return make([]string, f) }
+
+func (s *MySuite) TestDirectlyConnectedRoute_GetLastActivity(c *C) {
+	route := &DirectlyConnectedRoute{
+		Name:            "agent1",
+		Session:         "session",
+		InRequest:       make(chan interface{}, 2),
+		InCancelRequest: make(chan string),
+		ConnectedAt:     1000,
+	}
+	c.Assert(route.GetLastActivity(), Equals, uint64(1000))
+
+	// Only new requests count as activity.
+	route.Send(&HTTPUpgradeData{ID: "id"})
+	c.Assert(route.GetLastActivity(), Equals, uint64(1000))
+	before := tunnel.Now()
+	route.Send(&HTTPMessage{})
+	c.Assert(route.GetLastActivity() >= before, Equals, true)
+
+	// Requests in progress keep the route active.
+	route.LastUse = 0
+	route.InFlight = fakeInFlight(1)
+	c.Assert(route.GetLastActivity() >= before, Equals, true)
+
+	route.Close()
+	route.Close()
+	c.Assert(route.IsClosed(), Equals, true)
+}
+
+type fakeInFlightIDs []string
+
+func (f fakeInFlightIDs) Len() int { return len(f) }
+
+func (f fakeInFlightIDs) IDs() []string { return f }
+
+func makeCancelRoute(name string, session string, ids ...string) *DirectlyConnectedRoute {
+	return &DirectlyConnectedRoute{
+		Name:            name,
+		Session:         session,
+		InRequest:       make(chan interface{}, 1),
+		InCancelRequest: make(chan string, len(ids)),
+		InFlight:        fakeInFlightIDs(ids),
+	}
+}
+
+func cancelled(route *DirectlyConnectedRoute) []string {
+	ids := []string{}
+	for len(route.InCancelRequest) > 0 {
+		ids = append(ids, <-route.InCancelRequest)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *MySuite) TestConnectedAgents_CancelAll(c *C) {
+	agents := MakeRoutes()
+	session1 := makeCancelRoute("agent1", "session1", "id1", "id2")
+	session2 := makeCancelRoute("agent1", "session2", "id3")
+	idle := makeCancelRoute("agent1", "session3")
+	other := makeCancelRoute("agent2", "session1", "id4")
+	agents.Add(session1)
+	agents.Add(session2)
+	agents.Add(idle)
+	agents.Add(other)
+
+	c.Assert(agents.CancelAll("agent1"), Equals, 3)
+	c.Assert(cancelled(session1), DeepEquals, []string{"id1", "id2"})
+	c.Assert(cancelled(session2), DeepEquals, []string{"id3"})
+	c.Assert(cancelled(idle), DeepEquals, []string{})
+	c.Assert(cancelled(other), DeepEquals, []string{})
+
+	c.Assert(agents.CancelAll("unknown"), Equals, 0)
+	c.Assert((&DirectlyConnectedRoute{}).CancelAll(), Equals, 0)
+}
+
+// getStatisticsLocked is GetStatistics as it was before routes were
+// copied out from under the lock, kept to compare against.
+func getStatisticsLocked(s *ConnectedRoutes) interface{} {
+	ret := make([]interface{}, 0)
+	s.RLock()
+	defer s.RUnlock()
+	for _, routeList := range s.m {
+		for _, route := range routeList {
+			ret = append(ret, route.GetStatistics())
+		}
+	}
+	return ret
+}
+
+// makeBenchmarkRoutes returns n directly connected routes, several
+// sessions per name, without the logging and metrics Add does.
+func makeBenchmarkRoutes(n int) *ConnectedRoutes {
+	routes := MakeRoutes()
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("agent%d", i%(n/4+1))
+		routes.m[name] = append(routes.m[name], &DirectlyConnectedRoute{
+			Name:    name,
+			Session: fmt.Sprintf("session%d", i),
+			Endpoints: []Endpoint{
+				{Name: "ep1", Type: "kubernetes", Configured: true},
+				{Name: "ep2", Type: "jenkins", Configured: true},
+			},
+			Version:     "v1.0.0",
+			Hostname:    "agent-pod",
+			ConnectedAt: uint64(i),
+			LastPing:    uint64(i),
+		})
+	}
+	return routes
+}
+
+// sortedJSON renders each entry, sorted, as map order is random.
+func sortedJSON(c *C, stats interface{}) []string {
+	ret := []string{}
+	for _, stat := range stats.([]interface{}) {
+		j, err := json.Marshal(stat)
+		c.Assert(err, IsNil)
+		ret = append(ret, string(j))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (s *MySuite) TestConnectedAgents_GetStatistics(c *C) {
+	routes := makeBenchmarkRoutes(50)
+	want := sortedJSON(c, getStatisticsLocked(routes))
+	c.Assert(want, HasLen, 50)
+	// twice, so the second uses a pooled slice.
+	c.Assert(sortedJSON(c, routes.GetStatistics()), DeepEquals, want)
+	c.Assert(sortedJSON(c, routes.GetStatistics()), DeepEquals, want)
+
+	j, err := json.Marshal(MakeRoutes().GetStatistics())
+	c.Assert(err, IsNil)
+	c.Assert(string(j), Equals, "[]")
+}
+
+// BenchmarkConnectedRoutes_GetStatistics compares the old and current
+// GetStatistics while a writer keeps taking the lock, as Add and Remove
+// do.  writer-wait-ns is how long each write waited for the lock.
+func BenchmarkConnectedRoutes_GetStatistics(b *testing.B) {
+	routes := makeBenchmarkRoutes(1000)
+	impls := []struct {
+		name string
+		get  func() interface{}
+	}{
+		{"locked", func() interface{} { return getStatisticsLocked(routes) }},
+		{"snapshot", routes.GetStatistics},
+	}
+	for _, impl := range impls {
+		b.Run(impl.name, func(b *testing.B) {
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			var waited time.Duration
+			writes := 0
+			go func() {
+				defer close(done)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					start := time.Now()
+					routes.Lock()
+					waited += time.Since(start)
+					writes++
+					routes.Unlock()
+				}
+			}()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				impl.get()
+			}
+			b.StopTimer()
+			close(stop)
+			<-done
+			if writes > 0 {
+				b.ReportMetric(float64(waited.Nanoseconds())/float64(writes), "writer-wait-ns")
+			}
+		})
+	}
+}
+
+func (s *MySuite) TestConnectedAgents_findServicePattern(c *C) {
+	agents := MakeRoutes()
+	route := &DirectlyConnectedRoute{Name: "agent1", Session: "pattern", Endpoints: []Endpoint{{Name: "jenkins-*", Type: "jenkins", Configured: true}}}
+	agents.m["agent1"] = []Route{route}
+	found, _, err := agents.findService(Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "jenkins-prod"})
+	c.Assert(err, IsNil)
+	c.Assert(found.GetSession(), Equals, "pattern")
+
+	// A session with the exact name is always chosen over the pattern.
+	exact := &DirectlyConnectedRoute{Name: "agent1", Session: "exact", Endpoints: []Endpoint{{Name: "jenkins-prod", Type: "jenkins", Configured: true}}}
+	agents.m["agent1"] = []Route{route, exact}
+	for i := 0; i < 20; i++ {
+		found, _, err = agents.findService(Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "jenkins-prod"})
+		c.Assert(err, IsNil)
+		c.Assert(found.GetSession(), Equals, "exact")
+	}
+
+	// Other names still go to the pattern.
+	found, _, err = agents.findService(Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "jenkins-dev"})
+	c.Assert(err, IsNil)
+	c.Assert(found.GetSession(), Equals, "pattern")
+
+	_, _, err = agents.findService(Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "argo"})
+	c.Assert(err, ErrorMatches, ".*no such route exists.*")
+}
+
+func (s *MySuite) TestConnectedAgents_findServiceHealth(c *C) {
+	agents := MakeRoutes()
+	one := &DirectlyConnectedRoute{Name: "agent1", Session: "one", Endpoints: []Endpoint{{Name: "jenkins-*", Type: "jenkins", Configured: true}}}
+	two := &DirectlyConnectedRoute{Name: "agent1", Session: "two", Endpoints: []Endpoint{{Name: "jenkins-*", Type: "jenkins", Configured: true}}}
+	agents.m["agent1"] = []Route{one, two}
+	search := Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "jenkins-prod"}
+
+	// Health is reported for the endpoint as advertised.
+	c.Assert(one.SetEndpointHealth("jenkins", "jenkins-*", false, "connection refused"), Equals, true)
+	c.Assert(one.SetEndpointHealth("jenkins", "jenkins-*", false, "timeout"), Equals, false)
+	c.Assert(one.IsEndpointHealthy("jenkins", "jenkins-prod"), Equals, false)
+	for i := 0; i < 20; i++ {
+		found, _, err := agents.findService(search)
+		c.Assert(err, IsNil)
+		c.Assert(found.GetSession(), Equals, "two")
+	}
+
+	stats := one.GetStatistics().(*DirectlyConnectedRouteStatistics)
+	c.Assert(stats.Endpoints[0].Unhealthy, Equals, true)
+	c.Assert(stats.Endpoints[0].UnhealthyReason, Equals, "timeout")
+	c.Assert(one.Endpoints[0].Unhealthy, Equals, false)
+
+	// With none healthy, nothing is selected, unless pinned.
+	two.SetEndpointHealth("jenkins", "jenkins-*", false, "timeout")
+	_, _, err := agents.findService(search)
+	c.Assert(err, ErrorMatches, ".*reports it unhealthy.*")
+	pinned := search
+	pinned.Session = "one"
+	found, _, err := agents.findService(pinned)
+	c.Assert(err, IsNil)
+	c.Assert(found.GetSession(), Equals, "one")
+
+	// Recovery restores the endpoint.
+	c.Assert(one.SetEndpointHealth("jenkins", "jenkins-*", true, ""), Equals, true)
+	c.Assert(one.SetEndpointHealth("jenkins", "jenkins-*", true, ""), Equals, false)
+	for i := 0; i < 20; i++ {
+		found, _, err := agents.findService(search)
+		c.Assert(err, IsNil)
+		c.Assert(found.GetSession(), Equals, "one")
+	}
+	stats = one.GetStatistics().(*DirectlyConnectedRouteStatistics)
+	c.Assert(stats.Endpoints[0].Unhealthy, Equals, false)
+	c.Assert(stats.Endpoints[0].UnhealthyReason, Equals, "")
+
+	// The circuit breaker's state is shown as last reported.
+	c.Assert(stats.Endpoints[0].CircuitBreaker, Equals, "")
+	one.SetEndpointCircuitBreaker("jenkins", "jenkins-*", "open")
+	stats = one.GetStatistics().(*DirectlyConnectedRouteStatistics)
+	c.Assert(stats.Endpoints[0].CircuitBreaker, Equals, "open")
+	one.SetEndpointCircuitBreaker("jenkins", "jenkins-*", "")
+	stats = one.GetStatistics().(*DirectlyConnectedRouteStatistics)
+	c.Assert(stats.Endpoints[0].CircuitBreaker, Equals, "")
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import (
+	"context"
+	"time"
+)
+
+// WaitForRoute waits until a route matching the search is connected, and
+// returns true if one is.  It returns false once until has passed or ctx
+// is done.  Routes are looked for again each time one is added.
+func (s *ConnectedRoutes) WaitForRoute(ctx context.Context, ep Search, until time.Time) bool {
+	for {
+		s.RLock()
+		_, _, err := s.findService(ep)
+		added := s.added
+		s.RUnlock()
+		if err == nil {
+			return true
+		}
+		wait := time.Until(until)
+		if wait <= 0 {
+			return false
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-added:
+			timer.Stop()
+		case <-timer.C:
+			return s.hasRoute(ep)
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// hasRoute returns true if a route would be found for the search.
+func (s *ConnectedRoutes) hasRoute(ep Search) bool {
+	s.RLock()
+	defer s.RUnlock()
+	_, _, err := s.findService(ep)
+	return err == nil
+}
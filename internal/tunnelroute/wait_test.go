@@ -0,0 +1,77 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnelroute
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConnectedRoutes_WaitForRoute(t *testing.T) {
+	ep := Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "ci"}
+
+	t.Run("already connected", func(t *testing.T) {
+		routes := MakeRoutes()
+		routes.Add(makeHandoffRoute("agent1"))
+		if !routes.WaitForRoute(context.Background(), ep, time.Now()) {
+			t.Errorf("WaitForRoute() = false for a connected agent")
+		}
+	})
+
+	t.Run("connects in time", func(t *testing.T) {
+		routes := MakeRoutes()
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			// An agent without the endpoint does not satisfy the wait.
+			other := makeHandoffRoute("agent1")
+			other.Endpoints = []Endpoint{{Type: "jenkins", Name: "other", Configured: true}}
+			routes.Add(other)
+			time.Sleep(20 * time.Millisecond)
+			routes.Add(makeHandoffRoute("agent1"))
+		}()
+		if !routes.WaitForRoute(context.Background(), ep, time.Now().Add(5*time.Second)) {
+			t.Errorf("WaitForRoute() = false, want true once the agent connects")
+		}
+	})
+
+	t.Run("too late", func(t *testing.T) {
+		routes := MakeRoutes()
+		other := makeHandoffRoute("agent1")
+		other.Endpoints = nil
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			routes.Add(other)
+		}()
+		start := time.Now()
+		if routes.WaitForRoute(context.Background(), ep, start.Add(100*time.Millisecond)) {
+			t.Errorf("WaitForRoute() = true, but no agent has the endpoint")
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("WaitForRoute() returned after %v, before the deadline", elapsed)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		routes := MakeRoutes()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if routes.WaitForRoute(ctx, ep, time.Now().Add(time.Minute)) {
+			t.Errorf("WaitForRoute() = true after the context was cancelled")
+		}
+	})
+}
@@ -66,6 +66,39 @@ func (s *SessionList) Remove(id string) {
 	delete(s.m, id)
 }
 
+// Len returns the number of IDs in the list, which are the requests in progress.
+func (s *SessionList) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.m)
+}
+
+// IDs returns the IDs in the list, which are the requests in progress.
+func (s *SessionList) IDs() []string {
+	s.RLock()
+	defer s.RUnlock()
+	ids := make([]string, 0, len(s.m))
+	for k := range s.m {
+		ids = append(ids, k)
+	}
+	return ids
+}
+
+// Close removes a specific id from the list and closes its channel, so
+// anything waiting for its response ends.  It returns false if the id was
+// not in the list.
+func (s *SessionList) Close(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	c, ok := s.m[id]
+	if !ok {
+		return false
+	}
+	close(c)
+	delete(s.m, id)
+	return true
+}
+
 // CloseAll empties the list of all IDs, and closes all channels.
 func (s *SessionList) CloseAll() {
 	s.Lock()
@@ -0,0 +1,31 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ListenAddress returns the address a listener should use for the bind
+// address and port.  An empty bind address listens on all interfaces.
+// IPv6 addresses may be given with or without brackets.
+func ListenAddress(bind string, port uint16) string {
+	bind = strings.TrimSuffix(strings.TrimPrefix(bind, "["), "]")
+	return net.JoinHostPort(bind, strconv.Itoa(int(port)))
+}
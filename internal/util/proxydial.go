@@ -0,0 +1,139 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// ProxyFunc returns the HTTP proxy to use to reach addr, or nil if the
+// connection should be made directly.
+type ProxyFunc func(addr string) (*url.URL, error)
+
+// ControllerProxy returns the ProxyFunc an agent uses to reach its
+// controller.  If proxyURL is set, that proxy is always used.  Otherwise,
+// HTTPS_PROXY (or HTTP_PROXY, if the connection is not secure) and NO_PROXY
+// are read from the environment.
+func ControllerProxy(proxyURL string, secure bool) (ProxyFunc, error) {
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %v", err)
+		}
+		if u.Scheme != "http" || u.Host == "" {
+			return nil, fmt.Errorf("proxy url must be http://host:port, not %q", proxyURL)
+		}
+		return func(string) (*url.URL, error) { return u, nil }, nil
+	}
+
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	proxyFunc := httpproxy.FromEnvironment().ProxyFunc()
+	return func(addr string) (*url.URL, error) {
+		return proxyFunc(&url.URL{Scheme: scheme, Host: addr})
+	}, nil
+}
+
+// ProxyDialer returns a dialer, suitable for grpc.WithContextDialer, which
+// connects through the HTTP CONNECT proxy the ProxyFunc returns for the
+// address, or directly if there is none.
+func ProxyDialer(proxy ProxyFunc) func(ctx context.Context, addr string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		proxyURL, err := proxy(addr)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL == nil {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", addr)
+		}
+		return dialProxy(ctx, proxyURL, addr)
+	}
+}
+
+func dialProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	if proxyURL.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing proxy %s: %v", proxyAddr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sending CONNECT to proxy %s: %v", proxyAddr, err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading CONNECT response from proxy %s: %v", proxyAddr, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", proxyAddr, addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns any data the proxy sent after its CONNECT response,
+// and read along with it, before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// connectProxy is a minimal HTTP CONNECT proxy which records the targets
+// it was asked to reach.
+type connectProxy struct {
+	sync.Mutex
+	auth    string
+	targets []string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if p.auth != "" && r.Header.Get("Proxy-Authorization") != p.auth {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	p.Lock()
+	p.targets = append(p.targets, r.Host)
+	p.Unlock()
+
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	w.WriteHeader(http.StatusOK)
+	client, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	go func() { _, _ = io.Copy(upstream, client) }()
+	_, _ = io.Copy(client, upstream)
+}
+
+func (p *connectProxy) seen() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string{}, p.targets...)
+}
+
+func startHealthServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func dialThroughProxy(proxyURL string, target string) (*grpc.ClientConn, error) {
+	proxy, err := ControllerProxy(proxyURL, false)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return grpc.DialContext(ctx, target,
+		grpc.WithBlock(),
+		grpc.WithReturnConnectionError(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(ProxyDialer(proxy)))
+}
+
+func TestProxyDialer_grpcThroughProxy(t *testing.T) {
+	target := startHealthServer(t)
+	proxy := &connectProxy{auth: "Basic dXNlcjpzZWNyZXQ="} // user:secret
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	conn, err := dialThroughProxy("http://user:secret@"+proxyServer.Listener.Addr().String(), target)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	assert.Equal(t, []string{target}, proxy.seen())
+}
+
+func TestProxyDialer_refused(t *testing.T) {
+	target := startHealthServer(t)
+	proxy := &connectProxy{auth: "Basic dXNlcjpzZWNyZXQ="}
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyFunc, err := ControllerProxy("http://"+proxyServer.Listener.Addr().String(), false)
+	require.NoError(t, err)
+	_, err = ProxyDialer(proxyFunc)(context.Background(), target)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "407")
+	assert.Empty(t, proxy.seen())
+}
+
+func TestControllerProxy(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://secure-proxy:3128")
+	t.Setenv("HTTP_PROXY", "http://plain-proxy:3128")
+	t.Setenv("NO_PROXY", "internal.example.com")
+
+	tests := []struct {
+		name     string
+		proxyURL string
+		secure   bool
+		addr     string
+		want     string
+		wantErr  bool
+	}{
+		{"https from environment", "", true, "controller.example.com:9001", "http://secure-proxy:3128", false},
+		{"http from environment", "", false, "controller.example.com:9001", "http://plain-proxy:3128", false},
+		{"no proxy", "", true, "internal.example.com:9001", "", false},
+		{"explicit", "http://explicit:8080", true, "internal.example.com:9001", "http://explicit:8080", false},
+		{"explicit bad scheme", "socks5://explicit:1080", true, "", "", true},
+		{"explicit no host", "http://", true, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := ControllerProxy(tt.proxyURL, tt.secure)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			got, err := proxy(tt.addr)
+			require.NoError(t, err)
+			if tt.want == "" {
+				assert.Nil(t, got)
+				return
+			}
+			require.NotNil(t, got)
+			assert.Equal(t, tt.want, got.String())
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+)
+
+// TLSSettings restricts the TLS versions and cipher suites used by every
+// listener and upstream transport.  MinTLSVersion is "1.2" (the default)
+// or "1.3".  CipherSuites, if set, lists the TLS 1.2 cipher suites allowed,
+// named as in crypto/tls, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+// TLS 1.3 cipher suites are not configurable.
+type TLSSettings struct {
+	MinTLSVersion string   `yaml:"minTLSVersion,omitempty" json:"minTLSVersion,omitempty"`
+	CipherSuites  []string `yaml:"cipherSuites,omitempty" json:"cipherSuites,omitempty"`
+}
+
+var tlsSettings = struct {
+	sync.RWMutex
+	minVersion   uint16
+	cipherSuites []uint16
+}{}
+
+func (s TLSSettings) minVersion() (uint16, error) {
+	switch s.MinTLSVersion {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("minTLSVersion must be 1.2 or 1.3, not '%s'", s.MinTLSVersion)
+	}
+}
+
+func (s TLSSettings) cipherSuites() ([]uint16, []error) {
+	problems := []error{}
+	if len(s.CipherSuites) == 0 {
+		return nil, problems
+	}
+	known := map[string]*tls.CipherSuite{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite
+	}
+	ids := []uint16{}
+	for _, name := range s.CipherSuites {
+		suite, found := known[name]
+		if !found {
+			problems = append(problems, fmt.Errorf("cipherSuites: '%s' is not a known secure cipher suite", name))
+			continue
+		}
+		if !supportsTLS12(suite) {
+			problems = append(problems, fmt.Errorf("cipherSuites: '%s' is a TLS 1.3 cipher suite, which cannot be configured", name))
+			continue
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, problems
+}
+
+func supportsTLS12(suite *tls.CipherSuite) bool {
+	for _, version := range suite.SupportedVersions {
+		if version == tls.VersionTLS12 {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns every problem with the settings.
+func (s TLSSettings) Validate() []error {
+	problems := []error{}
+	if _, err := s.minVersion(); err != nil {
+		problems = append(problems, err)
+	}
+	_, suiteProblems := s.cipherSuites()
+	return append(problems, suiteProblems...)
+}
+
+// SetTLSSettings makes ApplyTLSSettings use the settings from now on.  An
+// error is returned, and nothing changed, if they are invalid.
+func SetTLSSettings(s TLSSettings) error {
+	if problems := s.Validate(); len(problems) > 0 {
+		return problems[0]
+	}
+	minVersion, _ := s.minVersion()
+	suites, _ := s.cipherSuites()
+	tlsSettings.Lock()
+	defer tlsSettings.Unlock()
+	tlsSettings.minVersion = minVersion
+	tlsSettings.cipherSuites = suites
+	return nil
+}
+
+// ApplyTLSSettings raises c.MinVersion to the configured minimum, and
+// restricts its cipher suites if configured, then returns c.  A config
+// which already requires a newer version is left at that version.
+func ApplyTLSSettings(c *tls.Config) *tls.Config {
+	tlsSettings.RLock()
+	defer tlsSettings.RUnlock()
+	if c.MinVersion < tlsSettings.minVersion {
+		c.MinVersion = tlsSettings.minVersion
+	}
+	if len(tlsSettings.cipherSuites) > 0 {
+		c.CipherSuites = append([]uint16{}, tlsSettings.cipherSuites...)
+	}
+	return c
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2022 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSSettings_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings TLSSettings
+		want     []string
+	}{
+		{"defaults", TLSSettings{}, []string{}},
+		{"tls 1.2", TLSSettings{MinTLSVersion: "1.2"}, []string{}},
+		{"tls 1.3", TLSSettings{MinTLSVersion: "1.3"}, []string{}},
+		{"tls 1.1", TLSSettings{MinTLSVersion: "1.1"}, []string{"minTLSVersion must be 1.2 or 1.3, not '1.1'"}},
+		{
+			"cipher suites",
+			TLSSettings{CipherSuites: []string{
+				"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+				"TLS_RSA_WITH_RC4_128_SHA",
+				"TLS_CHACHA20_POLY1305_SHA256",
+			}},
+			[]string{
+				"cipherSuites: 'TLS_RSA_WITH_RC4_128_SHA' is not a known secure cipher suite",
+				"cipherSuites: 'TLS_CHACHA20_POLY1305_SHA256' is a TLS 1.3 cipher suite, which cannot be configured",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := tt.settings.Validate()
+			require.Len(t, problems, len(tt.want), "%v", problems)
+			for i, want := range tt.want {
+				assert.Equal(t, want, problems[i].Error())
+			}
+		})
+	}
+}
+
+func TestApplyTLSSettings(t *testing.T) {
+	t.Cleanup(func() { _ = SetTLSSettings(TLSSettings{}) })
+
+	c := ApplyTLSSettings(&tls.Config{MinVersion: tls.VersionTLS12})
+	assert.Equal(t, uint16(tls.VersionTLS12), c.MinVersion)
+	assert.Nil(t, c.CipherSuites)
+
+	require.NoError(t, SetTLSSettings(TLSSettings{
+		MinTLSVersion: "1.3",
+		CipherSuites:  []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+	}))
+	c = ApplyTLSSettings(&tls.Config{MinVersion: tls.VersionTLS12})
+	assert.Equal(t, uint16(tls.VersionTLS13), c.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, c.CipherSuites)
+
+	// a configured minimum never lowers a stricter one.
+	require.NoError(t, SetTLSSettings(TLSSettings{MinTLSVersion: "1.2"}))
+	c = ApplyTLSSettings(&tls.Config{MinVersion: tls.VersionTLS13})
+	assert.Equal(t, uint16(tls.VersionTLS13), c.MinVersion)
+
+	// invalid settings are rejected and leave the current ones in place.
+	require.Error(t, SetTLSSettings(TLSSettings{MinTLSVersion: "1.1"}))
+	c = ApplyTLSSettings(&tls.Config{})
+	assert.Equal(t, uint16(tls.VersionTLS12), c.MinVersion)
+}
+
+func TestApplyTLSSettings_handshake(t *testing.T) {
+	t.Cleanup(func() { _ = SetTLSSettings(TLSSettings{}) })
+	require.NoError(t, SetTLSSettings(TLSSettings{MinTLSVersion: "1.3"}))
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.TLS = ApplyTLSSettings(&tls.Config{MinVersion: tls.VersionTLS12})
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		maxVersion uint16
+		wantErr    bool
+	}{
+		{"tls 1.1", tls.VersionTLS11, true},
+		{"tls 1.2", tls.VersionTLS12, true},
+		{"tls 1.3", tls.VersionTLS13, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{
+				MinVersion:         tls.VersionTLS10,
+				MaxVersion:         tt.maxVersion,
+				InsecureSkipVerify: true,
+			})
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer conn.Close()
+			assert.Equal(t, uint16(tls.VersionTLS13), conn.ConnectionState().Version)
+		})
+	}
+}